@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What's done with a file once it's uploaded, see after_upload
+const (
+	actionDelete  = "delete"
+	actionKeep    = "keep"
+	actionArchive = "archive"
+	actionTrash   = "trash"
+)
+
+var uploadActions = []string{actionDelete, actionKeep, actionArchive, actionTrash}
+
+// afterUploadRule picks what's done with files of a category, or with one
+// of the listed extensions, once they're uploaded, e.g.
+//
+//	[[after_upload]]
+//	category = "video"
+//	action   = "keep"
+//
+// Files no rule matches get what keep_local, trash and archive_dir say.
+type afterUploadRule struct {
+	Category   string   `toml:"category"`
+	Extensions []string `toml:"extensions"`
+	Action     string   `toml:"action"`
+}
+
+// afterUpload is what's done with an uploaded file with the extension ext:
+// the action of the first after_upload rule that matches, otherwise the
+// one keep_local, trash and archive_dir make the default
+func (s *settings) afterUpload(ext string) string {
+	for _, r := range s.AfterUpload {
+		if (route{Category: r.Category, Extensions: r.Extensions}).matches(ext) {
+			return r.Action
+		}
+	}
+	switch {
+	case s.KeepLocal:
+		return actionKeep
+	case s.Trash:
+		return actionTrash
+	case s.ArchiveDir != "":
+		return actionArchive
+	}
+	return actionDelete
+}
+
+// archivesByRule tells whether an after_upload rule moves files to
+// archive_dir
+func (s *settings) archivesByRule() bool {
+	for _, r := range s.AfterUpload {
+		if r.Action == actionArchive {
+			return true
+		}
+	}
+	return false
+}
+
+// afterUploadProblems reports rules that can never match or whose action
+// isn't one
+func (s *settings) afterUploadProblems() []string {
+	var problems []string
+	for i, r := range s.AfterUpload {
+		if r.Category == "" && len(r.Extensions) == 0 {
+			problems = append(problems, fmt.Sprintf("after_upload %d needs a category or extensions", i+1))
+		}
+		if _, ok := categories[r.Category]; r.Category != "" && !ok {
+			problems = append(problems, fmt.Sprintf("after_upload %d: unknown category %q, use image, video or archive", i+1, r.Category))
+		}
+		if !contains(uploadActions, r.Action) {
+			problems = append(problems, fmt.Sprintf("after_upload %d: action must be %s, not %q", i+1, strings.Join(uploadActions, ", "), r.Action))
+		}
+		if r.Action == actionArchive && s.ArchiveDir == "" {
+			problems = append(problems, fmt.Sprintf("after_upload %d archives files, that takes archive_dir", i+1))
+		}
+	}
+	return problems
+}
+
+// transcodedFile holds the .mov files kept after they were transcoded, by
+// path with the modification time they had, in the state directory. One
+// whose mp4 was uploaded and deleted isn't transcoded again until it
+// changes, even after a restart.
+const transcodedFile = "transcoded.json"
+
+// transcodedMu guards transcodedFile
+var transcodedMu sync.Mutex
+
+// readTranscoded loads the kept .mov files, an unreadable file counts as
+// empty since all that's lost is a transcode
+func readTranscoded() map[string]time.Time {
+	kept := make(map[string]time.Time)
+	if err := readState(transcodedFile, &kept); err != nil && !os.IsNotExist(err) {
+		debugf("ignoring %s: %v", transcodedFile, err)
+	}
+	return kept
+}
+
+// rememberTranscoded remembers that the .mov at path, as f has it, was
+// transcoded and kept
+func rememberTranscoded(path string, f os.FileInfo) {
+	transcodedMu.Lock()
+	defer transcodedMu.Unlock()
+	kept := readTranscoded()
+	kept[path] = f.ModTime()
+	if err := writeState(transcodedFile, kept); err != nil {
+		log.Printf("can't save that %s is transcoded: %v", path, err)
+	}
+}
+
+// transcodedAlready tells whether the .mov at path was transcoded and kept
+// as f has it
+func transcodedAlready(path string, f os.FileInfo) bool {
+	transcodedMu.Lock()
+	defer transcodedMu.Unlock()
+	modified, ok := readTranscoded()[path]
+	return ok && modified.Equal(f.ModTime())
+}
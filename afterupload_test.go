@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTranscodedAlready(t *testing.T) {
+	tempStateDir(t)
+	path := retryFile(t)
+	f, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transcodedAlready(path, f) {
+		t.Fatal("transcoded before it was")
+	}
+
+	// left by the last run, as if skrins restarted since
+	if err := writeState(transcodedFile, map[string]time.Time{path: f.ModTime()}); err != nil {
+		t.Fatal(err)
+	}
+	if !transcodedAlready(path, f) {
+		t.Error("transcoded at the last run, but not after a restart")
+	}
+
+	// a .mov that changed is transcoded again
+	later := f.ModTime().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transcodedAlready(path, changed) {
+		t.Error("transcoded already after it changed")
+	}
+	rememberTranscoded(path, changed)
+	if !transcodedAlready(path, changed) {
+		t.Error("not remembered")
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+)
+
+// agentAvailable tells whether an SSH agent seems to be running
+func agentAvailable() bool {
+	return os.Getenv("SSH_AUTH_SOCK") != ""
+}
+
+// dialAgent connects to the SSH agent named by SSH_AUTH_SOCK
+func dialAgent() (io.ReadWriteCloser, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, errors.New("SSH_AUTH_SOCK is not set")
+	}
+	return net.Dial("unix", sock)
+}
@@ -0,0 +1,56 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDialAgent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skrins-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			c.Write([]byte("hi"))
+			c.Close()
+		}
+	}()
+
+	setEnv(t, "SSH_AUTH_SOCK", sock)
+	if !agentAvailable() {
+		t.Error("no agent with SSH_AUTH_SOCK set")
+	}
+	c, err := dialAgent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got, err := ioutil.ReadAll(c); err != nil || string(got) != "hi" {
+		t.Errorf("read %q, %v from the agent", got, err)
+	}
+}
+
+func TestAgentMissing(t *testing.T) {
+	setEnv(t, "SSH_AUTH_SOCK", "")
+	if agentAvailable() {
+		t.Error("an agent is available without SSH_AUTH_SOCK")
+	}
+	if c, err := dialAgent(); err == nil {
+		c.Close()
+		t.Error("connected to an agent without SSH_AUTH_SOCK")
+	}
+}
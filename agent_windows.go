@@ -0,0 +1,32 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// openSSHAgentPipe is where OpenSSH for Windows' agent listens
+const openSSHAgentPipe = `\\.\pipe\openssh-ssh-agent`
+
+// agentPipe returns the agent pipe, SSH_AUTH_SOCK when it's set
+func agentPipe() string {
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		return sock
+	}
+	return openSSHAgentPipe
+}
+
+// agentAvailable tells whether an SSH agent seems to be running
+func agentAvailable() bool {
+	_, err := os.Stat(agentPipe())
+	return err == nil
+}
+
+// dialAgent connects to the agent's named pipe. A pipe can be opened like
+// a file, which is all the agent protocol needs.
+func dialAgent() (io.ReadWriteCloser, error) {
+	return os.OpenFile(agentPipe(), os.O_RDWR, 0)
+}
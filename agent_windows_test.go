@@ -0,0 +1,32 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestAgentPipe(t *testing.T) {
+	setEnv(t, "SSH_AUTH_SOCK", "")
+	os.Unsetenv("SSH_AUTH_SOCK")
+	if got := agentPipe(); got != openSSHAgentPipe {
+		t.Errorf("without SSH_AUTH_SOCK: %s, want %s", got, openSSHAgentPipe)
+	}
+	os.Setenv("SSH_AUTH_SOCK", `\\.\pipe\pageant.me.1234`)
+	if got := agentPipe(); got != `\\.\pipe\pageant.me.1234` {
+		t.Errorf("with SSH_AUTH_SOCK: %s", got)
+	}
+}
+
+func TestAgentMissing(t *testing.T) {
+	setEnv(t, "SSH_AUTH_SOCK", `\\.\pipe\skrins-no-such-agent`)
+	if agentAvailable() {
+		t.Error("an agent is available on a pipe nobody listens on")
+	}
+	if c, err := dialAgent(); err == nil {
+		c.Close()
+		t.Error("connected to a pipe nobody listens on")
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// archiveMonth is the layout of the folder below archive_dir files are
+// moved to, one per month they're archived in
+const archiveMonth = "2006-01"
+
+// archiveTarget is where the file at path goes in the folder dir, its own
+// name unless that's taken, with -1, -2 and so on before the extension then
+func archiveTarget(dir, path string) string {
+	name := filepath.Base(path)
+	ext := dotExtension(name)
+	stem := strings.TrimSuffix(name, ext)
+	target := filepath.Join(dir, name)
+	for n := 1; ; n++ {
+		if _, err := os.Lstat(target); os.IsNotExist(err) {
+			return target
+		}
+		target = filepath.Join(dir, fmt.Sprintf("%s-%d%s", stem, n, ext))
+	}
+}
+
+// archiveFile moves the file at path to the month's folder in archiveDir
+// and returns where it is now. Across filesystems it's copied and removed.
+func archiveFile(path, archiveDir string, now time.Time) (string, error) {
+	dir := filepath.Join(archiveDir, now.Format(archiveMonth))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	target := archiveTarget(dir, path)
+	if err := os.Rename(path, target); err == nil {
+		return target, nil
+	} else if os.IsNotExist(err) {
+		return "", err
+	}
+	// most likely another filesystem, which a rename can't cross
+	if err := copyFile(path, target); err != nil {
+		return "", err
+	}
+	return target, removeFile(path)
+}
+
+// copyFile copies the file at from to the new file to, with its
+// permissions and modification time. A copy that fails is removed.
+func copyFile(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(to)
+		return err
+	}
+	return os.Chtimes(to, time.Now(), fi.ModTime())
+}
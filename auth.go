@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// usesAgent tells whether p authenticates through the SSH agent. That's
+// the case when asked for, or when there's an agent but no key file.
+func (p profile) usesAgent() bool {
+	return isTrue(p.UseAgent) || (p.Key == "" && agentAvailable())
+}
+
+// keys lists the private key files of p, Key holds them comma separated
+func (p profile) keys() []string {
+	var keys []string
+	for _, k := range strings.Split(p.Key, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// defaultKeyNames are looked for in ~/.ssh when no key is given, in the
+// order OpenSSH tries them
+var defaultKeyNames = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// findDefaultKey returns the first of the default keys that exists and is
+// a private key, possibly an encrypted one, or "" if there's none
+func findDefaultKey(getenv func(string) string) string {
+	for _, name := range defaultKeyNames {
+		path, err := expandPath("~/.ssh/"+name, getenv)
+		if err != nil {
+			return ""
+		}
+		key, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		_, err = ssh.ParsePrivateKey(key)
+		var missing *ssh.PassphraseMissingError
+		if err == nil || errors.As(err, &missing) {
+			return path
+		}
+	}
+	return ""
+}
+
+// authMethods builds the ways to authenticate to p's host, in the order key
+// files, agent, default key, password, and names them for error messages. Key files that
+// can't be read are skipped with a warning. The returned closer must be
+// called once the handshake is done, used names the key that authenticated
+// after that.
+func authMethods(p profile) (methods []ssh.AuthMethod, names []string, used *string, closer io.Closer, err error) {
+	var signers []ssh.Signer
+	used = new(string)
+	closer = ioutil.NopCloser(nil)
+
+	for _, path := range p.keys() {
+		signer, err := loadKey(path)
+		if os.IsNotExist(err) || os.IsPermission(err) {
+			log.Printf("warning: skipping private key: %v", err)
+			continue
+		}
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		names = append(names, "key "+path)
+		signers = append(signers, namedSigner{signer, "key " + path, used})
+	}
+
+	fallback := len(signers) > 0 || p.Password != "" || p.DefaultKey != ""
+	if p.usesAgent() {
+		conn, err := dialAgent()
+		if err != nil {
+			if !fallback {
+				return nil, nil, nil, nil, fmt.Errorf("ssh agent: %w", err)
+			}
+		} else {
+			closer = conn
+			agentSigners, err := agent.NewClient(conn).Signers()
+			if err != nil && !fallback {
+				conn.Close()
+				return nil, nil, nil, nil, fmt.Errorf("ssh agent: %w", err)
+			}
+			if len(agentSigners) > 0 {
+				names = append(names, "agent")
+			}
+			for _, signer := range agentSigners {
+				name := "agent identity " + ssh.FingerprintSHA256(signer.PublicKey())
+				signers = append(signers, namedSigner{signer, name, used})
+			}
+		}
+	}
+
+	if p.DefaultKey != "" {
+		// a locked default key unlockKey had to skip is left out as well
+		if signer, err := loadKey(p.DefaultKey); err == nil {
+			names = append(names, "key "+p.DefaultKey)
+			signers = append(signers, namedSigner{signer, "key " + p.DefaultKey, used})
+		}
+	}
+
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+
+	if p.Password != "" {
+		password, err := cachedSecret(p.Password, passwordLabel(p))
+		if err != nil {
+			closer.Close()
+			return nil, nil, nil, nil, err
+		}
+		methods = append(methods, ssh.Password(password), ssh.KeyboardInteractive(answerWith(password)))
+		names = append(names, "password", "keyboard-interactive")
+	}
+
+	if len(methods) == 0 {
+		closer.Close()
+		return nil, nil, nil, nil, errors.New("ssh agent has no identities and no private key or password is configured, add one with ssh-add or set -pk")
+	}
+
+	return methods, names, used, closer, nil
+}
+
+// namedSigner notes its name in used when signing. The client only signs
+// once the server said it accepts the key, so after a successful handshake
+// used names the key that authenticated.
+type namedSigner struct {
+	ssh.Signer
+	name string
+	used *string
+}
+
+func (s namedSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	*s.used = s.name
+	return s.Signer.Sign(rand, data)
+}
+
+// answerWith answers every hidden keyboard-interactive question, which is
+// how servers ask for passwords that way, with password
+func answerWith(password string) ssh.KeyboardInteractiveChallenge {
+	return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i := range questions {
+			if !echos[i] {
+				answers[i] = password
+			}
+		}
+		return answers, nil
+	}
+}
+
+// passwordLabel names p's password in prompts
+func passwordLabel(p profile) string {
+	return fmt.Sprintf("Password for %s@%s", p.RemoteUser, p.RemoteHost)
+}
+
+// unlockPassword resolves p's password so there's no prompt per upload
+func unlockPassword(p profile, interactive bool) error {
+	if p.Password == "" {
+		return nil
+	}
+	_, err := resolveSecret(p.Password, passwordLabel(p), interactive)
+	return err
+}
+
+// unlockedKeys caches parsed keys by path, so a passphrase is only asked
+// for once per process
+var unlockedKeys = struct {
+	sync.Mutex
+	signers map[string]ssh.Signer
+}{signers: map[string]ssh.Signer{}}
+
+// loadKey returns the signer for the private key at path. Passphrase
+// protected keys have to be unlocked with unlockKey first.
+func loadKey(path string) (ssh.Signer, error) {
+	unlockedKeys.Lock()
+	signer, ok := unlockedKeys.signers[path]
+	unlockedKeys.Unlock()
+	if ok {
+		return signer, nil
+	}
+
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err = ssh.ParsePrivateKey(key)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		return nil, lockedKeyError(path)
+	}
+	return signer, err
+}
+
+// unlockKey parses the private keys of p, decrypting them when they're
+// passphrase protected, and caches the result. The passphrase comes from
+// key_passphrase_file, SKRINS_KEY_PASSPHRASE or, when interactive is set
+// and skrins runs in a terminal, a prompt. Keys that can't be read are left
+// for authMethods to skip, and so is a default key that can't be unlocked
+// when there are other ways to authenticate.
+func unlockKey(p profile, interactive bool) error {
+	for _, path := range p.keys() {
+		if err := unlockKeyFile(p, path, interactive); err != nil && !os.IsNotExist(err) && !os.IsPermission(err) {
+			return err
+		}
+	}
+	if p.DefaultKey != "" {
+		err := unlockKeyFile(p, p.DefaultKey, interactive)
+		if err != nil && (p.usesAgent() || p.Password != "") {
+			log.Printf("warning: not using default key: %v", err)
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// unlockKeyFile is unlockKey for the key at path
+func unlockKeyFile(p profile, path string, interactive bool) error {
+	unlockedKeys.Lock()
+	defer unlockedKeys.Unlock()
+	if _, ok := unlockedKeys.signers[path]; ok {
+		return nil
+	}
+
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		passphrase, perr := keyPassphrase(p, path, interactive)
+		if perr != nil {
+			return perr
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, passphrase)
+		if err == x509.IncorrectPasswordError || err != nil && legacyEncrypted(key) {
+			return fmt.Errorf("wrong passphrase for private key %s", path)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("private key %s: %w", path, err)
+	}
+
+	unlockedKeys.signers[path] = signer
+	return nil
+}
+
+// legacyEncrypted tells whether key is a PEM block encrypted the old way.
+// Its padding check lets about one wrong passphrase in 256 through, the key
+// then fails to parse instead.
+func legacyEncrypted(key []byte) bool {
+	block, _ := pem.Decode(key)
+	return block != nil && x509.IsEncryptedPEMBlock(block)
+}
+
+// keyPassphrase finds the passphrase for p's key at path
+func keyPassphrase(p profile, path string, interactive bool) ([]byte, error) {
+	if p.KeyPassphraseFile != "" {
+		b, err := ioutil.ReadFile(p.KeyPassphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("key passphrase: %w", err)
+		}
+		return bytes.TrimRight(b, "\r\n"), nil
+	}
+	if v := os.Getenv("SKRINS_KEY_PASSPHRASE"); v != "" {
+		return []byte(v), nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !interactive || !terminal.IsTerminal(fd) {
+		return nil, lockedKeyError(path)
+	}
+	fmt.Fprintf(os.Stderr, "Passphrase for %s: ", path)
+	passphrase, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	return passphrase, err
+}
+
+// lockedKeyError explains how to unlock the key at path
+func lockedKeyError(path string) error {
+	return fmt.Errorf("private key %s is passphrase protected, pass the passphrase with -pk-pass-file or SKRINS_KEY_PASSPHRASE, or start skrins from a terminal", path)
+}
+
+// unlockCredentials unlocks the key and resolves the password of every
+// profile s may upload to
+func unlockCredentials(s *settings, interactive bool) error {
+	profiles := []profile{s.Profile}
+	for _, p := range s.RuleProfiles {
+		profiles = append(profiles, p)
+	}
+	for _, p := range profiles {
+		hops, _ := p.jumpHops()
+		profiles = append(profiles, hops...)
+	}
+	for _, p := range profiles {
+		for label, ref := range backendSecrets(p) {
+			if _, err := resolveSecret(ref, label, interactive); err != nil {
+				return err
+			}
+		}
+		if !p.usesSSH() {
+			continue
+		}
+		if err := unlockKey(p, interactive); err != nil {
+			return err
+		}
+		if err := unlockPassword(p, interactive); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// tempHome points the home directory to a temporary one with an empty
+// .ssh in it, which it returns
+func tempHome(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "skrins-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	setEnv(t, "HOME", dir)
+	setEnv(t, "USERPROFILE", dir)
+	ssh := filepath.Join(dir, ".ssh")
+	if err := os.Mkdir(ssh, 0700); err != nil {
+		t.Fatal(err)
+	}
+	return ssh
+}
+
+// writeKey writes a new private key to path, encrypted with passphrase
+// unless it's empty
+func writeKey(t *testing.T, path, passphrase string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	if passphrase != "" {
+		// deprecated, but ssh still reads these
+		if block, err = x509.EncryptPEMBlock(rand.Reader, block.Type, der, []byte(passphrase), x509.PEMCipherAES256); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// freshKeys empties the cache of unlocked keys for t
+func freshKeys(t *testing.T) {
+	unlockedKeys.Lock()
+	old := unlockedKeys.signers
+	unlockedKeys.signers = map[string]ssh.Signer{}
+	unlockedKeys.Unlock()
+	t.Cleanup(func() {
+		unlockedKeys.Lock()
+		unlockedKeys.signers = old
+		unlockedKeys.Unlock()
+	})
+}
+
+func TestFindDefaultKey(t *testing.T) {
+	dir := tempHome(t)
+	if got := findDefaultKey(os.Getenv); got != "" {
+		t.Errorf("without keys: %s", got)
+	}
+
+	rsa := filepath.Join(dir, "id_rsa")
+	writeKey(t, rsa, "")
+	if got := findDefaultKey(os.Getenv); got != rsa {
+		t.Errorf("with id_rsa: %s", got)
+	}
+	// the first that parses
+	ecdsa := filepath.Join(dir, "id_ecdsa")
+	writeKey(t, ecdsa, "")
+	if err := ioutil.WriteFile(filepath.Join(dir, "id_ed25519"), []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got := findDefaultKey(os.Getenv); got != ecdsa {
+		t.Errorf("with id_ed25519 broken: %s, want %s", got, ecdsa)
+	}
+	// an encrypted one counts, it's unlocked later
+	ed25519 := filepath.Join(dir, "id_ed25519")
+	writeKey(t, ed25519, "s3cr3t")
+	if got := findDefaultKey(os.Getenv); got != ed25519 {
+		t.Errorf("with id_ed25519 encrypted: %s, want %s", got, ed25519)
+	}
+}
+
+func TestFindDefaultKeyUnreadable(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("permissions don't keep this user from reading")
+	}
+	dir := tempHome(t)
+	ed25519, rsa := filepath.Join(dir, "id_ed25519"), filepath.Join(dir, "id_rsa")
+	writeKey(t, ed25519, "")
+	writeKey(t, rsa, "")
+	if err := os.Chmod(ed25519, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := findDefaultKey(os.Getenv); got != rsa {
+		t.Errorf("with id_ed25519 unreadable: %s, want %s", got, rsa)
+	}
+}
+
+func TestUnlockDefaultKey(t *testing.T) {
+	freshKeys(t)
+	setEnv(t, "SSH_AUTH_SOCK", "")
+	setEnv(t, "SKRINS_KEY_PASSPHRASE", "")
+	key := filepath.Join(tempHome(t), "id_ed25519")
+	writeKey(t, key, "s3cr3t")
+	p := profile{RemoteHost: "example.com", RemoteUser: "me", DefaultKey: key}
+
+	err := unlockKey(p, false)
+	if err == nil || !strings.Contains(err.Error(), "passphrase protected") {
+		t.Fatalf("a locked default key without a passphrase: %v", err)
+	}
+	if _, err := loadKey(key); err == nil {
+		t.Error("loaded a locked key")
+	}
+	// with other ways to log in it's left out
+	withPassword := p
+	withPassword.Password = "hunter2"
+	if err := unlockKey(withPassword, false); err != nil {
+		t.Errorf("with a password: %v", err)
+	}
+
+	os.Setenv("SKRINS_KEY_PASSPHRASE", "wrong")
+	if err := unlockKey(p, false); err == nil || !strings.Contains(err.Error(), "wrong passphrase") {
+		t.Errorf("with the wrong passphrase: %v", err)
+	}
+	os.Setenv("SKRINS_KEY_PASSPHRASE", "s3cr3t")
+	if err := unlockKey(p, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadKey(key); err != nil {
+		t.Errorf("after unlocking: %v", err)
+	}
+	_, names, _, closer, err := authMethods(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closer.Close()
+	if len(names) != 1 || names[0] != "key "+key {
+		t.Errorf("authenticating with %v, want the default key", names)
+	}
+}
+
+func TestUnlockKeyWrongPassphrasePadding(t *testing.T) {
+	freshKeys(t)
+	key := filepath.Join(tempHome(t), "id_ecdsa")
+	writeKey(t, key, "s3cr3t")
+	pemBytes, err := ioutil.ReadFile(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(pemBytes)
+	// a wrong passphrase that gets past the padding check, about one in
+	// 256 do
+	wrong := ""
+	for i := 0; i < 10000 && wrong == ""; i++ {
+		if _, err := x509.DecryptPEMBlock(block, []byte(fmt.Sprint("wrong", i))); err == nil {
+			wrong = fmt.Sprint("wrong", i)
+		}
+	}
+	if wrong == "" {
+		t.Skip("no wrong passphrase gets past the padding check")
+	}
+	setEnv(t, "SKRINS_KEY_PASSPHRASE", wrong)
+	p := profile{RemoteHost: "example.com", RemoteUser: "me", Key: key}
+	if err := unlockKey(p, false); err == nil || !strings.Contains(err.Error(), "wrong passphrase") {
+		t.Errorf("with %q: %v", wrong, err)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// awsCredentials sign requests to AWS. SessionToken is only set for
+// temporary credentials.
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// errNoAWSCredentials is returned when none of the usual places has AWS
+// credentials
+var errNoAWSCredentials = errors.New("no AWS credentials found, set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY or add them to ~/.aws/credentials")
+
+// awsProfileName is the shared config profile in use, AWS_PROFILE or
+// "default"
+func awsProfileName(getenv func(string) string) string {
+	if name := getenv("AWS_PROFILE"); name != "" {
+		return name
+	}
+	return "default"
+}
+
+// loadAWSCredentials finds credentials the way the AWS tools do, first in
+// the environment, then in the shared credentials file for AWS_PROFILE.
+// SSO, credential_process and instance roles aren't supported.
+func loadAWSCredentials(getenv func(string) string) (awsCredentials, error) {
+	if id, secret := getenv("AWS_ACCESS_KEY_ID"), getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		return awsCredentials{AccessKeyID: id, SecretAccessKey: secret, SessionToken: getenv("AWS_SESSION_TOKEN")}, nil
+	}
+
+	file := getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if file == "" {
+		file = "~/.aws/credentials"
+	}
+	path, err := expandPath(file, getenv)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	values, err := readINISection(path, awsProfileName(getenv))
+	if os.IsNotExist(err) {
+		return awsCredentials{}, errNoAWSCredentials
+	}
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("AWS credentials: %w", err)
+	}
+	c := awsCredentials{
+		AccessKeyID:     values["aws_access_key_id"],
+		SecretAccessKey: values["aws_secret_access_key"],
+		SessionToken:    values["aws_session_token"],
+	}
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return awsCredentials{}, errNoAWSCredentials
+	}
+	return c, nil
+}
+
+// awsRegion is region, or when that's empty AWS_REGION, AWS_DEFAULT_REGION
+// or the region of AWS_PROFILE in ~/.aws/config
+func awsRegion(region string, getenv func(string) string) string {
+	if region != "" {
+		return region
+	}
+	if region = firstEnv(getenv, "AWS_REGION", "AWS_DEFAULT_REGION"); region != "" {
+		return region
+	}
+	file := getenv("AWS_CONFIG_FILE")
+	if file == "" {
+		file = "~/.aws/config"
+	}
+	path, err := expandPath(file, getenv)
+	if err != nil {
+		return ""
+	}
+	section := "profile " + awsProfileName(getenv)
+	if section == "profile default" {
+		section = "default"
+	}
+	values, _ := readINISection(path, section)
+	return values["region"]
+}
+
+// readINISection returns the keys of one section of an INI file like the
+// AWS tools write them, lower cased
+func readINISection(path, section string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := map[string]string{}
+	in := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			in = strings.TrimSpace(line[1:len(line)-1]) == section
+			continue
+		}
+		if i := strings.Index(line, "="); in && i > 0 {
+			values[strings.ToLower(strings.TrimSpace(line[:i]))] = strings.TrimSpace(line[i+1:])
+		}
+	}
+	return values, scanner.Err()
+}
+
+// unsignedPayload is signed instead of the body's hash, so bodies can be
+// streamed from disk. It's only allowed over HTTPS.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// signAWS signs req for service in region with signature version 4. The
+// body isn't part of the signature, payloadHash stands in for it.
+func signAWS(req *http.Request, c awsCredentials, service, region, payloadHash string, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	stamp := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.SessionToken)
+	}
+
+	// host and every x-amz-* header are signed
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		awsEscapePath(req.URL.Path),
+		awsCanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := hmacSHA256([]byte("AWS4"+c.SecretAccessKey), date)
+	for _, part := range []string{region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", c.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// awsMaxPresign is the longest a signature version 4 presigned URL can be
+// valid for
+const awsMaxPresign = 7 * 24 * time.Hour
+
+// presignAWS returns u, a GET of an object of service in region, with a
+// query string signature valid for expires from now on. Only the host
+// header is signed, so anyone can fetch the URL.
+func presignAWS(u *url.URL, c awsCredentials, service, region string, expires time.Duration, now time.Time) *url.URL {
+	now = now.UTC()
+	date := now.Format("20060102")
+	stamp := now.Format("20060102T150405Z")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+
+	signed := *u
+	query := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {c.AccessKeyID + "/" + scope},
+		"X-Amz-Date":          {stamp},
+		"X-Amz-Expires":       {strconv.Itoa(int(expires.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	if c.SessionToken != "" {
+		query.Set("X-Amz-Security-Token", c.SessionToken)
+	}
+	canonical := strings.Join([]string{
+		http.MethodGet,
+		awsEscapePath(u.Path),
+		awsCanonicalQuery(query),
+		"host:" + u.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := hmacSHA256([]byte("AWS4"+c.SecretAccessKey), date)
+	for _, part := range []string{region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	// the query has to be escaped the way it was signed
+	signed.RawPath = awsEscapePath(u.Path)
+	signed.RawQuery = awsCanonicalQuery(query) + "&X-Amz-Signature=" + hex.EncodeToString(hmacSHA256(key, toSign))
+	return &signed
+}
+
+// presignExpiry is when the presigned link stops working
+func presignExpiry(link string) (time.Time, bool) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return time.Time{}, false
+	}
+	q := u.Query()
+	date, err := time.Parse("20060102T150405Z", q.Get("X-Amz-Date"))
+	if err != nil {
+		return time.Time{}, false
+	}
+	seconds, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return date.Add(time.Duration(seconds) * time.Second), true
+}
+
+// awsEscape percent-encodes everything but unreserved characters, which is
+// stricter than url.PathEscape and what signatures are calculated over
+func awsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// awsEscapePath is awsEscape for every segment of a path
+func awsEscapePath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = awsEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// awsCanonicalQuery writes query sorted and escaped for signing
+func awsCanonicalQuery(query url.Values) string {
+	var pairs []string
+	for name, values := range query {
+		for _, v := range values {
+			pairs = append(pairs, awsEscape(name)+"="+awsEscape(v))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
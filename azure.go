@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Files of azureBlockThreshold bytes and more are uploaded as blocks of at
+// least azureBlockSize, so a broken connection only costs one block and a
+// retry reuses the blocks already sent. A blob has at most 50000 blocks.
+const (
+	azureBlockThreshold = 16 << 20
+	azureBlockSize      = 8 << 20
+	azureMaxBlocks      = 50000
+)
+
+// azureAPIVersion is the Blob service version requests are made for
+const azureAPIVersion = "2021-08-06"
+
+// azuriteKey is the well-known key of Azurite's devstoreaccount1
+const azuriteKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+
+// azureUploader uploads to an Azure Blob Storage container. Blobs are
+// named azure_prefix followed by the remote name, and their URL is base_url
+// followed by that.
+type azureUploader struct {
+	p    profile
+	opts uploadOptions
+}
+
+// azureAccount is how to reach and authenticate to a storage account,
+// with its key or a SAS token
+type azureAccount struct {
+	Name     string
+	Key      []byte
+	SAS      url.Values
+	Endpoint *url.URL
+}
+
+// azureAccountFor reads p's azure_connection_string, or
+// AZURE_STORAGE_CONNECTION_STRING, or else combines azure_account and
+// azure_sas
+func azureAccountFor(p profile, getenv func(string) string) (azureAccount, error) {
+	conn := p.AzureConnectionString
+	if conn == "" && p.AzureAccount == "" {
+		conn = getenv("AZURE_STORAGE_CONNECTION_STRING")
+	}
+	if conn != "" {
+		return parseAzureConnectionString(conn)
+	}
+	if p.AzureAccount == "" || p.AzureSAS == "" {
+		return azureAccount{}, errors.New("azure_connection_string, or azure_account and azure_sas, have to be set")
+	}
+	sas, err := url.ParseQuery(strings.TrimPrefix(p.AzureSAS, "?"))
+	if err != nil {
+		return azureAccount{}, fmt.Errorf("azure_sas: %w", err)
+	}
+	endpoint := &url.URL{Scheme: "https", Host: p.AzureAccount + ".blob.core.windows.net"}
+	return azureAccount{Name: p.AzureAccount, SAS: sas, Endpoint: endpoint}, nil
+}
+
+// parseAzureConnectionString reads a connection string like the portal
+// shows it, or UseDevelopmentStorage=true for Azurite
+func parseAzureConnectionString(s string) (azureAccount, error) {
+	values := map[string]string{}
+	for _, part := range strings.Split(s, ";") {
+		if i := strings.Index(part, "="); i > 0 {
+			values[strings.ToLower(strings.TrimSpace(part[:i]))] = strings.TrimSpace(part[i+1:])
+		}
+	}
+	if strings.EqualFold(values["usedevelopmentstorage"], "true") {
+		azurite := map[string]string{
+			"accountname":  "devstoreaccount1",
+			"accountkey":   azuriteKey,
+			"blobendpoint": "http://127.0.0.1:10000/devstoreaccount1",
+		}
+		for k, v := range azurite {
+			if values[k] == "" {
+				values[k] = v
+			}
+		}
+	}
+
+	a := azureAccount{Name: values["accountname"]}
+	if a.Name == "" {
+		return azureAccount{}, errors.New("azure_connection_string: AccountName missing")
+	}
+	var err error
+	if key := values["accountkey"]; key != "" {
+		if a.Key, err = base64.StdEncoding.DecodeString(key); err != nil {
+			return azureAccount{}, fmt.Errorf("azure_connection_string: AccountKey: %w", err)
+		}
+	}
+	if sas := values["sharedaccesssignature"]; sas != "" {
+		if a.SAS, err = url.ParseQuery(strings.TrimPrefix(sas, "?")); err != nil {
+			return azureAccount{}, fmt.Errorf("azure_connection_string: SharedAccessSignature: %w", err)
+		}
+	}
+	if a.Key == nil && a.SAS == nil {
+		return azureAccount{}, errors.New("azure_connection_string: AccountKey or SharedAccessSignature missing")
+	}
+
+	endpoint := values["blobendpoint"]
+	if endpoint == "" {
+		scheme, suffix := values["defaultendpointsprotocol"], values["endpointsuffix"]
+		setDefault(&scheme, "https")
+		setDefault(&suffix, "core.windows.net")
+		endpoint = scheme + "://" + a.Name + ".blob." + suffix
+	}
+	if a.Endpoint, err = url.Parse(strings.TrimRight(endpoint, "/")); err != nil || a.Endpoint.Host == "" {
+		return azureAccount{}, fmt.Errorf("azure_connection_string: BlobEndpoint %q is not a URL", endpoint)
+	}
+	return a, nil
+}
+
+// sasExpiry is when a SAS token stops working, zero when it doesn't say
+func (a azureAccount) sasExpiry() time.Time {
+	expiry, _ := time.Parse(time.RFC3339, a.SAS.Get("se"))
+	if expiry.IsZero() {
+		expiry, _ = time.Parse("2006-01-02", a.SAS.Get("se"))
+	}
+	return expiry
+}
+
+// containerURL is the URL of p's container, without a trailing slash
+func containerURL(p profile, getenv func(string) string) (*url.URL, error) {
+	a, err := azureAccountFor(p, getenv)
+	if err != nil {
+		return nil, err
+	}
+	u := *a.Endpoint
+	u.Path += "/" + p.AzureContainer
+	return &u, nil
+}
+
+// azureProblems checks the settings an Azure profile needs beyond the
+// required ones, including that a SAS token hasn't expired
+func azureProblems(p profile, getenv func(string) string) []string {
+	a, err := azureAccountFor(p, getenv)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	if expiry := a.sasExpiry(); a.Key == nil && !expiry.IsZero() && time.Now().After(expiry) {
+		return []string{fmt.Sprintf("the Azure SAS token expired on %s, create a new one", expiry.Format("2006-01-02 15:04"))}
+	}
+	return nil
+}
+
+// azureError is an error response from the Blob service, see
+// https://learn.microsoft.com/rest/api/storageservices/blob-service-error-codes
+type azureError struct {
+	Container string
+	Status    int
+	Code      string `xml:"Code"`
+	Message   string `xml:"Message"`
+	Detail    string `xml:"AuthenticationErrorDetail"`
+}
+
+func (e *azureError) Error() string {
+	switch e.Code {
+	case "ContainerNotFound":
+		return fmt.Sprintf("Azure container %s doesn't exist", e.Container)
+	case "AuthenticationFailed":
+		if strings.Contains(e.Detail, "xpir") {
+			return "the Azure SAS token has expired, create a new one"
+		}
+		if e.Detail != "" {
+			return "Azure rejected the credentials: " + e.Detail
+		}
+		return "Azure rejected the credentials, check the account key or SAS token"
+	case "AuthorizationFailure", "AuthorizationPermissionMismatch", "AuthorizationResourceTypeMismatch":
+		return fmt.Sprintf("the Azure credentials don't allow writing to container %s", e.Container)
+	}
+	// messages end in lines with the request ID and time
+	if msg := strings.SplitN(e.Message, "\n", 2)[0]; msg != "" {
+		return fmt.Sprintf("Azure: %s (%s)", msg, e.Code)
+	}
+	return fmt.Sprintf("Azure answered %d %s", e.Status, http.StatusText(e.Status))
+}
+
+// temporary tells whether trying again may help, i.e. Azure was busy
+func (e *azureError) temporary() bool {
+	return e.Status >= 500 || e.Status == http.StatusTooManyRequests || e.Code == "ServerBusy" || e.Code == "OperationTimedOut"
+}
+
+func (u azureUploader) upload(ctx context.Context, localPath, remoteName string) (string, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	name := u.p.AzurePrefix + remoteName
+	ctx, cancel := context.WithTimeout(ctx, u.p.TransferTimeout.Duration)
+	defer cancel()
+	header := http.Header{"X-Ms-Blob-Content-Type": {contentType(name)}}
+	var blocks []string
+	var offset int64
+	if fi.Size() >= azureBlockThreshold {
+		if blocks, offset, err = u.sentBlocks(ctx, name, fi.Size()); err != nil {
+			return "", err
+		}
+		if offset > 0 {
+			log.Printf("resuming upload of %s at %s", localPath, formatSize(uint64(offset)))
+		}
+	}
+
+	t := startTransfer(localPath, fi.Size(), offset, u.opts.Progress)
+	defer t.finish()
+	ctx, stalled := watchStall(ctx, t, u.p.StallTimeout.Duration)
+	if fi.Size() < azureBlockThreshold {
+		header.Set("X-Ms-Blob-Type", "BlockBlob")
+		body := progressTracker{limitedReader{f, uploadLimiter}, t}
+		_, _, err = u.send(ctx, http.MethodPut, name, nil, header, body, fi.Size())
+	} else {
+		err = u.uploadBlocks(ctx, name, header, f, blocks, t)
+	}
+	if stalled() {
+		return "", &timeoutError{Op: "stall", Host: u.host(), After: u.p.StallTimeout.Duration}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", &timeoutError{Op: "transfer", Host: u.host(), After: u.p.TransferTimeout.Duration, Err: err}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	log.Println(t.summary())
+	return u.p.destinationFor(remoteExtension(remoteName)).BaseURL + name, nil
+}
+
+// blockSize is how large the blocks of a file of size bytes are
+func blockSize(size int64) int64 {
+	if size/azureBlockSize >= azureMaxBlocks {
+		return size/azureMaxBlocks + 1
+	}
+	return azureBlockSize
+}
+
+// blockID names the nth block. IDs of a blob must all be the same length.
+func blockID(n int) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%06d", n)))
+}
+
+// sentBlocks returns the IDs of the leading blocks an earlier attempt to
+// upload name already sent and how many bytes they hold
+func (u azureUploader) sentBlocks(ctx context.Context, name string, size int64) ([]string, int64, error) {
+	query := url.Values{"comp": {"blocklist"}, "blocklisttype": {"uncommitted"}}
+	_, body, err := u.send(ctx, http.MethodGet, name, query, nil, nil, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	var list struct {
+		Blocks []struct {
+			Name string `xml:"Name"`
+			Size int64  `xml:"Size"`
+		} `xml:"UncommittedBlocks>Block"`
+	}
+	if err := xml.Unmarshal(body, &list); err != nil {
+		return nil, 0, err
+	}
+	partSize := blockSize(size)
+	var ids []string
+	var offset int64
+	for i, b := range list.Blocks {
+		if b.Name != blockID(i) || (b.Size != partSize && offset+b.Size != size) {
+			break
+		}
+		ids = append(ids, b.Name)
+		offset += b.Size
+	}
+	return ids, offset, nil
+}
+
+// uploadBlocks sends the blocks of f after the ones already sent and
+// commits them as name
+func (u azureUploader) uploadBlocks(ctx context.Context, name string, header http.Header, f *os.File, sent []string, t *transfer) error {
+	size := t.Size
+	partSize := blockSize(size)
+	ids := sent
+	for offset := t.offset; offset < size; offset += partSize {
+		length := partSize
+		if offset+length > size {
+			length = size - offset
+		}
+		id := blockID(len(ids))
+		query := url.Values{"comp": {"block"}, "blockid": {id}}
+		body := progressTracker{limitedReader{io.NewSectionReader(f, offset, length), uploadLimiter}, t}
+		if _, _, err := u.send(ctx, http.MethodPut, name, query, nil, body, length); err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+
+	var list bytes.Buffer
+	list.WriteString(xml.Header + "<BlockList>")
+	for _, id := range ids {
+		list.WriteString("<Latest>" + id + "</Latest>")
+	}
+	list.WriteString("</BlockList>")
+	_, _, err := u.send(ctx, http.MethodPut, name, url.Values{"comp": {"blocklist"}}, header, &list, int64(list.Len()))
+	return err
+}
+
+func (u azureUploader) remove(ctx context.Context, remoteName string) error {
+	_, _, err := u.send(ctx, http.MethodDelete, u.p.AzurePrefix+remoteName, nil, nil, nil, 0)
+	return err
+}
+
+func (u azureUploader) stat(ctx context.Context, remoteName string) (os.FileInfo, error) {
+	resp, _, err := u.send(ctx, http.MethodHead, u.p.AzurePrefix+remoteName, nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return remoteFileInfo{name: remoteName, size: resp.ContentLength, modTime: modTime}, nil
+}
+
+// host is where requests for the container go
+func (u azureUploader) host() string {
+	if c, err := containerURL(u.p, os.Getenv); err == nil {
+		return c.Host
+	}
+	return u.p.AzureAccount + ".blob.core.windows.net"
+}
+
+// send makes an authenticated request about the blob name and returns the
+// response with its body read. Error responses are turned into an
+// *azureError, a missing blob into os.ErrNotExist.
+func (u azureUploader) send(ctx context.Context, method, name string, query url.Values, header http.Header, body io.Reader, length int64) (*http.Response, []byte, error) {
+	a, err := azureAccountFor(u.p, os.Getenv)
+	if err != nil {
+		return nil, nil, err
+	}
+	target := *a.Endpoint
+	target.Path += "/" + u.p.AzureContainer + "/" + name
+	q := url.Values{}
+	for k, v := range a.SAS {
+		q[k] = v
+	}
+	for k, v := range query {
+		q[k] = v
+	}
+	target.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(method, target.String(), body)
+	if err != nil {
+		return nil, nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.ContentLength = length
+	if length == 0 {
+		req.Body = http.NoBody
+	}
+	req.Header.Set("X-Ms-Version", azureAPIVersion)
+	req.Header.Set("X-Ms-Date", time.Now().UTC().Format(http.TimeFormat))
+	if a.Key != nil && a.SAS == nil {
+		signAzure(req, a)
+	}
+
+	resp, err := httpClientFor(u.p).Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		e := &azureError{Container: u.p.AzureContainer, Status: resp.StatusCode}
+		xml.Unmarshal(respBody, e)
+		setDefault(&e.Code, resp.Header.Get("X-Ms-Error-Code"))
+		if e.Code == "BlobNotFound" || (e.Code == "" && resp.StatusCode == http.StatusNotFound) {
+			return nil, nil, os.ErrNotExist
+		}
+		return nil, nil, e
+	}
+	return resp, respBody, nil
+}
+
+// signAzure signs req with the account key, see
+// https://learn.microsoft.com/rest/api/storageservices/authorize-with-shared-key
+func signAzure(req *http.Request, a azureAccount) {
+	length := ""
+	if req.ContentLength > 0 {
+		length = strconv.FormatInt(req.ContentLength, 10)
+	}
+	h := req.Header.Get
+	var msHeaders []string
+	for name := range req.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-ms-") {
+			msHeaders = append(msHeaders, name)
+		}
+	}
+	sort.Strings(msHeaders)
+	var canonical strings.Builder
+	for _, name := range msHeaders {
+		canonical.WriteString(name + ":" + strings.TrimSpace(h(name)) + "\n")
+	}
+
+	resource := "/" + a.Name + req.URL.EscapedPath()
+	query := req.URL.Query()
+	var params []string
+	for name := range query {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, name := range params {
+		values := query[name]
+		sort.Strings(values)
+		resource += "\n" + strings.ToLower(name) + ":" + strings.Join(values, ",")
+	}
+
+	toSign := strings.Join([]string{
+		req.Method,
+		h("Content-Encoding"),
+		h("Content-Language"),
+		length,
+		h("Content-MD5"),
+		h("Content-Type"),
+		"", // Date, x-ms-date is used instead
+		h("If-Modified-Since"),
+		h("If-Match"),
+		h("If-None-Match"),
+		h("If-Unmodified-Since"),
+		h("Range"),
+		canonical.String() + resource,
+	}, "\n")
+	mac := hmac.New(sha256.New, a.Key)
+	mac.Write([]byte(toSign))
+	req.Header.Set("Authorization", "SharedKey "+a.Name+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
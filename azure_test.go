@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAzureConnectionString(t *testing.T) {
+	tests := []struct {
+		conn     string
+		name     string
+		endpoint string
+		key, sas bool
+		err      string
+	}{
+		{"DefaultEndpointsProtocol=https;AccountName=shots;AccountKey=" + azuriteKey + ";EndpointSuffix=core.windows.net", "shots", "https://shots.blob.core.windows.net", true, false, ""},
+		{"AccountName=shots;SharedAccessSignature=?sv=2021-08-06&sig=abc", "shots", "https://shots.blob.core.windows.net", false, true, ""},
+		{"accountname=shots; accountkey=" + azuriteKey + "; blobendpoint=https://cdn.example.com/", "shots", "https://cdn.example.com", true, false, ""},
+		{"AccountName=shots;AccountKey=" + azuriteKey + ";EndpointSuffix=core.chinacloudapi.cn", "shots", "https://shots.blob.core.chinacloudapi.cn", true, false, ""},
+		{"UseDevelopmentStorage=true", "devstoreaccount1", "http://127.0.0.1:10000/devstoreaccount1", true, false, ""},
+		{"UseDevelopmentStorage=true;BlobEndpoint=http://azurite:10000/devstoreaccount1", "devstoreaccount1", "http://azurite:10000/devstoreaccount1", true, false, ""},
+		{"AccountKey=" + azuriteKey, "", "", false, false, "AccountName missing"},
+		{"AccountName=shots", "", "", false, false, "AccountKey or SharedAccessSignature missing"},
+		{"AccountName=shots;AccountKey=not base64!", "", "", false, false, "AccountKey"},
+		{"AccountName=shots;AccountKey=" + azuriteKey + ";BlobEndpoint=nowhere", "", "", false, false, `BlobEndpoint "nowhere" is not a URL`},
+	}
+	for _, tt := range tests {
+		a, err := parseAzureConnectionString(tt.conn)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: err = %v, want %s", tt.conn, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.conn, err)
+			continue
+		}
+		if a.Name != tt.name || a.Endpoint.String() != tt.endpoint || (a.Key != nil) != tt.key || (a.SAS != nil) != tt.sas {
+			t.Errorf("%s: account %s at %s with key %t and SAS %t", tt.conn, a.Name, a.Endpoint, a.Key != nil, a.SAS != nil)
+		}
+	}
+}
+
+func TestAzureProblems(t *testing.T) {
+	yesterday := time.Now().Add(-24 * time.Hour).UTC().Format("2006-01-02T15:04:05Z")
+	tomorrow := time.Now().Add(24 * time.Hour).UTC().Format("2006-01-02")
+	tests := []struct {
+		p    profile
+		want string
+	}{
+		{profile{AzureAccount: "shots", AzureSAS: "?sv=2021-08-06&se=" + tomorrow + "&sig=abc"}, ""},
+		{profile{AzureAccount: "shots", AzureSAS: "sv=2021-08-06&sig=abc"}, ""},
+		{profile{AzureAccount: "shots", AzureSAS: "?sv=2021-08-06&se=" + yesterday + "&sig=abc"}, "the Azure SAS token expired on "},
+		{profile{AzureAccount: "shots"}, "azure_connection_string, or azure_account and azure_sas, have to be set"},
+		{profile{AzureConnectionString: "UseDevelopmentStorage=true"}, ""},
+	}
+	for _, tt := range tests {
+		problems := azureProblems(tt.p, fakeEnv(nil))
+		if tt.want == "" && len(problems) > 0 {
+			t.Errorf("%+v: %v", tt.p, problems)
+		}
+		if tt.want != "" && (len(problems) != 1 || !strings.HasPrefix(problems[0], tt.want)) {
+			t.Errorf("%+v: %v, want %s", tt.p, problems, tt.want)
+		}
+	}
+
+	// AZURE_STORAGE_CONNECTION_STRING is only used without settings
+	env := fakeEnv(map[string]string{"AZURE_STORAGE_CONNECTION_STRING": "UseDevelopmentStorage=true"})
+	if problems := azureProblems(profile{}, env); len(problems) > 0 {
+		t.Errorf("with AZURE_STORAGE_CONNECTION_STRING: %v", problems)
+	}
+}
+
+// azureTestUploader uploads to the container shots on srv as Azurite's
+// account, with the key or with sas
+func azureTestUploader(srvURL, sas string) azureUploader {
+	conn := "AccountName=devstoreaccount1;AccountKey=" + azuriteKey
+	if sas != "" {
+		conn = "AccountName=devstoreaccount1;SharedAccessSignature=" + sas
+	}
+	return azureUploader{p: testProfile(profile{
+		Backend:               backendAzure,
+		AzureContainer:        "shots",
+		AzurePrefix:           "i/",
+		AzureConnectionString: conn + ";BlobEndpoint=" + srvURL + "/devstoreaccount1",
+	})}
+}
+
+func TestAzureUpload(t *testing.T) {
+	srv, log := recordingServer(t, func(w http.ResponseWriter, r recordedRequest) {
+		w.WriteHeader(http.StatusCreated)
+	})
+	u := azureTestUploader(srv.URL, "")
+	url, err := u.upload(context.Background(), uploadTestFile(t, "clip.MOV", []byte("moov")), "Zr8tW.MOV")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// without base_url, the raw blob URL
+	if want := srv.URL + "/devstoreaccount1/shots/i/Zr8tW.MOV"; url != want {
+		t.Errorf("url = %s, want %s", url, want)
+	}
+	reqs := log.all()
+	if len(reqs) != 1 {
+		t.Fatalf("%d requests, want one PUT", len(reqs))
+	}
+	r := reqs[0]
+	if r.Method != http.MethodPut || r.Path != "/devstoreaccount1/shots/i/Zr8tW.MOV" || string(r.Body) != "moov" {
+		t.Errorf("%s %s with %q", r.Method, r.Path, r.Body)
+	}
+	for name, want := range map[string]string{
+		"X-Ms-Blob-Type":         "BlockBlob",
+		"X-Ms-Blob-Content-Type": "video/quicktime",
+		"X-Ms-Version":           azureAPIVersion,
+	} {
+		if got := r.Header.Get(name); got != want {
+			t.Errorf("%s: %q, want %q", name, got, want)
+		}
+	}
+	if auth := r.Header.Get("Authorization"); !strings.HasPrefix(auth, "SharedKey devstoreaccount1:") {
+		t.Errorf("Authorization: %s", auth)
+	}
+}
+
+func TestAzureUploadSAS(t *testing.T) {
+	srv, log := recordingServer(t, func(w http.ResponseWriter, r recordedRequest) {
+		w.WriteHeader(http.StatusCreated)
+	})
+	u := azureTestUploader(srv.URL, "?sv=2021-08-06&sp=cw&sig=abc%2B")
+	u.p.BaseURL = "https://cdn.example.com/"
+	url, err := u.upload(context.Background(), uploadTestFile(t, "shot.png", []byte("png")), "Zr8tW.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "https://cdn.example.com/i/Zr8tW.png" {
+		t.Errorf("url = %s, want base_url followed by the blob name", url)
+	}
+	r := log.all()[0]
+	if r.Query.Get("sig") != "abc+" || r.Query.Get("sp") != "cw" {
+		t.Errorf("query %v, want the SAS token", r.Query)
+	}
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		t.Errorf("signed with %s although there's a SAS token", auth)
+	}
+}
+
+func TestAzureBlocksResumed(t *testing.T) {
+	srv, log := recordingServer(t, func(w http.ResponseWriter, r recordedRequest) {
+		if r.Method == http.MethodGet {
+			// the first block made it last time
+			fmt.Fprintf(w, "<BlockList><UncommittedBlocks><Block><Name>%s</Name><Size>%d</Size></Block></UncommittedBlocks></BlockList>", blockID(0), azureBlockSize)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	u := azureTestUploader(srv.URL, "")
+	size := azureBlockThreshold + 1<<20
+	if _, err := u.upload(context.Background(), uploadTestFile(t, "rec.mp4", bytes.Repeat([]byte{'x'}, size)), "rec.mp4"); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := log.all()
+	// the block list, the two blocks left, the commit
+	if len(reqs) != 4 {
+		t.Fatalf("%d requests, want 4", len(reqs))
+	}
+	if reqs[0].Query.Get("blocklisttype") != "uncommitted" {
+		t.Errorf("first asked for %v, want the uncommitted blocks", reqs[0].Query)
+	}
+	sent := 0
+	for i, r := range reqs[1:3] {
+		if r.Query.Get("comp") != "block" || r.Query.Get("blockid") != blockID(i+1) {
+			t.Errorf("block %d: query %v", i+1, r.Query)
+		}
+		sent += len(r.Body)
+	}
+	if sent != size-azureBlockSize {
+		t.Errorf("sent %d bytes, want the %d after the first block", sent, size-azureBlockSize)
+	}
+	commit := reqs[3]
+	var list struct {
+		Latest []string `xml:"Latest"`
+	}
+	if err := xml.Unmarshal(commit.Body, &list); err != nil || commit.Query.Get("comp") != "blocklist" {
+		t.Fatalf("commit %v: %v", commit.Query, err)
+	}
+	if len(list.Latest) != 3 || list.Latest[0] != blockID(0) {
+		t.Errorf("committed %v, want all three blocks", list.Latest)
+	}
+	if commit.Header.Get("X-Ms-Blob-Content-Type") != "video/mp4" {
+		t.Errorf("committed as %q", commit.Header.Get("X-Ms-Blob-Content-Type"))
+	}
+}
+
+func TestAzureErrors(t *testing.T) {
+	tests := []struct {
+		status int
+		code   string // in the X-Ms-Error-Code header when the body is empty
+		body   string
+		want   string
+		temp   bool
+	}{
+		{404, "", "<Error><Code>ContainerNotFound</Code><Message>The specified container does not exist.\nRequestId:1</Message></Error>", "Azure container shots doesn't exist", false},
+		{403, "", "<Error><Code>AuthenticationFailed</Code><AuthenticationErrorDetail>Signed expiry time [Mon, 01 Jan 2024] has to be after signed start time</AuthenticationErrorDetail></Error>", "the Azure SAS token has expired, create a new one", false},
+		{403, "", "<Error><Code>AuthenticationFailed</Code></Error>", "Azure rejected the credentials, check the account key or SAS token", false},
+		{403, "AuthorizationPermissionMismatch", "", "the Azure credentials don't allow writing to container shots", false},
+		{503, "", "<Error><Code>ServerBusy</Code><Message>The server is busy.\nRequestId:1</Message></Error>", "Azure: The server is busy. (ServerBusy)", true},
+		{500, "", "", "Azure answered 500 Internal Server Error", true},
+	}
+	for _, tt := range tests {
+		srv, _ := recordingServer(t, func(w http.ResponseWriter, r recordedRequest) {
+			if tt.code != "" {
+				w.Header().Set("X-Ms-Error-Code", tt.code)
+			}
+			w.WriteHeader(tt.status)
+			fmt.Fprint(w, tt.body)
+		})
+		u := azureTestUploader(srv.URL, "")
+		_, err := u.upload(context.Background(), uploadTestFile(t, "shot.png", []byte("png")), "Zr8tW.png")
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("%d %s: err = %v, want %s", tt.status, tt.body, err, tt.want)
+			continue
+		}
+		if transient(err) != tt.temp {
+			t.Errorf("%d %s: transient = %t, want %t", tt.status, tt.body, !tt.temp, tt.temp)
+		}
+	}
+}
+
+func TestAzureStat(t *testing.T) {
+	srv, _ := recordingServer(t, func(w http.ResponseWriter, r recordedRequest) {
+		if r.Path != "/devstoreaccount1/shots/i/taken.png" {
+			w.Header().Set("X-Ms-Error-Code", "BlobNotFound")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", "1234")
+	})
+	u := azureTestUploader(srv.URL, "")
+	if _, err := u.stat(context.Background(), "free.png"); !os.IsNotExist(err) {
+		t.Errorf("free.png: %v, want it not to exist", err)
+	}
+	fi, err := u.stat(context.Background(), "taken.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 1234 {
+		t.Errorf("taken.png has %d bytes, want 1234", fi.Size())
+	}
+}
+
+// TestAzurite uploads to Azurite at SKRINS_TEST_AZURITE, e.g.
+// http://127.0.0.1:10000 for one in a container, as its development
+// account. The container skrins-test is created when it's missing.
+func TestAzurite(t *testing.T) {
+	endpoint := os.Getenv("SKRINS_TEST_AZURITE")
+	if endpoint == "" {
+		t.Skip("SKRINS_TEST_AZURITE isn't set")
+	}
+	u := azureUploader{p: testProfile(profile{
+		Backend:               backendAzure,
+		AzureContainer:        "skrins-test",
+		AzurePrefix:           "i/",
+		AzureConnectionString: "UseDevelopmentStorage=true;BlobEndpoint=" + strings.TrimSuffix(endpoint, "/") + "/devstoreaccount1",
+	})}
+	a, err := azureAccountFor(u.p, os.Getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodPut, a.Endpoint.String()+"/skrins-test?restype=container", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Ms-Version", azureAPIVersion)
+	req.Header.Set("X-Ms-Date", time.Now().UTC().Format(http.TimeFormat))
+	signAzure(req, a)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusConflict {
+		t.Fatalf("can't create the container: %s", resp.Status)
+	}
+
+	ctx := context.Background()
+	// one uploaded at once and one in blocks
+	for _, size := range []int{16, azureBlockThreshold + 1} {
+		content := bytes.Repeat([]byte("skrins!"), size/7+1)[:size]
+		name := fmt.Sprintf("%d.png", size)
+		url, err := u.upload(ctx, uploadTestFile(t, "shot.png", content), name)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if want := a.Endpoint.String() + "/skrins-test/i/" + name; url != want {
+			t.Errorf("url = %s, want the blob's %s", url, want)
+		}
+		_, got, err := u.send(ctx, http.MethodGet, "i/"+name, nil, nil, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("%s has %d bytes that aren't the %d of the file", name, len(got), size)
+		}
+		if err := u.remove(ctx, name); err != nil {
+			t.Error(err)
+		}
+		if _, err := u.stat(ctx, name); !os.IsNotExist(err) {
+			t.Errorf("%s after removing it: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,582 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// b2AuthorizeURL is where B2 accounts are logged in to, the API and
+// download hosts come from its answer, see
+// https://www.backblaze.com/docs/cloud-storage-native-api
+var b2AuthorizeURL = "https://api.backblazeb2.com/b2api/v2/b2_authorize_account"
+
+// B2 takes at most b2MaxParts parts per large file, larger files get
+// larger parts than recommended. b2DefaultPartSize is used when the
+// account doesn't recommend one.
+const (
+	b2MaxParts        = 10000
+	b2DefaultPartSize = 100 << 20
+)
+
+// b2Uploader uploads to a B2 bucket with the native API. Files larger than
+// the part size the account recommends are uploaded in parts, each checked
+// by B2 against its SHA-1 like small files are.
+type b2Uploader struct {
+	p    profile
+	opts uploadOptions
+}
+
+// b2Label describes a B2 secret in prompts and errors
+func b2Label(what string) string {
+	return "B2 " + what
+}
+
+// b2Problems checks the settings of a b2 profile
+func b2Problems(p profile) []string {
+	if strings.HasPrefix(p.B2Prefix, "/") {
+		return []string{fmt.Sprintf("b2_prefix: %q can't start with a slash, B2 file names don't", p.B2Prefix)}
+	}
+	return nil
+}
+
+// b2Error is an error answer of the B2 API, Wait how long to hold off when
+// B2 is busy
+type b2Error struct {
+	Bucket  string
+	Status  int
+	Code    string
+	Message string
+	Wait    time.Duration
+}
+
+func (e *b2Error) Error() string {
+	switch e.Code {
+	case "bad_auth_token", "unauthorized":
+		return "B2 rejected the application key, check b2_key_id and b2_application_key and that the key may write to " + e.Bucket
+	case "cap_exceeded":
+		return "the B2 account reached its storage or transaction cap"
+	case "no_such_bucket", "bad_bucket_id":
+		return fmt.Sprintf("B2 bucket %s doesn't exist", e.Bucket)
+	}
+	if e.Message != "" {
+		return fmt.Sprintf("B2: %s (%s)", e.Message, e.Code)
+	}
+	return fmt.Sprintf("B2 answered %d %s", e.Status, http.StatusText(e.Status))
+}
+
+// temporary tells whether trying again may help, i.e. B2 was busy
+func (e *b2Error) temporary() bool {
+	return e.Status >= 500 || e.Status == http.StatusTooManyRequests || e.Status == http.StatusRequestTimeout
+}
+
+// retryAfter is how long to wait before trying again
+func (e *b2Error) retryAfter() time.Duration {
+	return e.Wait
+}
+
+// expired tells whether the token a request was made with ran out, after
+// a day or when B2 moved things around
+func (e *b2Error) expired() bool {
+	return e.Status == http.StatusUnauthorized && e.Code == "expired_auth_token"
+}
+
+// b2Session is a logged in account with the bucket's ID. Upload URLs are
+// kept for the next upload, B2 hands them out for one upload at a time.
+type b2Session struct {
+	Token       string `json:"authorizationToken"`
+	APIURL      string `json:"apiUrl"`
+	DownloadURL string `json:"downloadUrl"`
+	AccountID   string `json:"accountId"`
+	PartSize    int64  `json:"recommendedPartSize"`
+	MinPartSize int64  `json:"absoluteMinimumPartSize"`
+	Allowed     struct {
+		BucketID   string `json:"bucketId"`
+		BucketName string `json:"bucketName"`
+	} `json:"allowed"`
+
+	bucketID   string
+	uploadURLs []b2UploadURL
+}
+
+// b2UploadURL is where a file or the parts of a large file go, with its own
+// token
+type b2UploadURL struct {
+	URL   string `json:"uploadUrl"`
+	Token string `json:"authorizationToken"`
+}
+
+// b2File describes a file in a bucket
+type b2File struct {
+	ID        string `json:"fileId"`
+	Name      string `json:"fileName"`
+	Size      int64  `json:"contentLength"`
+	Timestamp int64  `json:"uploadTimestamp"`
+}
+
+// b2Sessions caches sessions by key ID and bucket, B2 limits how often
+// accounts may be logged in to
+var b2Sessions = struct {
+	sync.Mutex
+	m map[string]*b2Session
+}{m: map[string]*b2Session{}}
+
+func (u b2Uploader) sessionKey() string {
+	return u.p.B2KeyID + "\x00" + u.p.B2Bucket
+}
+
+// session returns the cached session, or logs in and looks up the bucket
+func (u b2Uploader) session(ctx context.Context) (*b2Session, error) {
+	b2Sessions.Lock()
+	s, ok := b2Sessions.m[u.sessionKey()]
+	b2Sessions.Unlock()
+	if ok {
+		return s, nil
+	}
+
+	key, err := cachedSecret(u.p.B2ApplicationKey, b2Label("application key"))
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, b2AuthorizeURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.SetBasicAuth(u.p.B2KeyID, key)
+	s = &b2Session{}
+	if err := u.do(req, s); err != nil {
+		return nil, err
+	}
+
+	s.bucketID = s.Allowed.BucketID
+	if s.Allowed.BucketName != "" && s.Allowed.BucketName != u.p.B2Bucket {
+		return nil, fmt.Errorf("the B2 application key only has access to bucket %s, not %s", s.Allowed.BucketName, u.p.B2Bucket)
+	}
+	if s.bucketID == "" {
+		var buckets struct {
+			Buckets []struct {
+				ID string `json:"bucketId"`
+			} `json:"buckets"`
+		}
+		if err := u.call(ctx, s, "b2_list_buckets", map[string]string{"accountId": s.AccountID, "bucketName": u.p.B2Bucket}, &buckets); err != nil {
+			return nil, err
+		}
+		if len(buckets.Buckets) == 0 {
+			return nil, &b2Error{Bucket: u.p.B2Bucket, Code: "no_such_bucket"}
+		}
+		s.bucketID = buckets.Buckets[0].ID
+	}
+
+	b2Sessions.Lock()
+	b2Sessions.m[u.sessionKey()] = s
+	b2Sessions.Unlock()
+	return s, nil
+}
+
+// forgetSession drops the cached session, so the next request logs in
+// again
+func (u b2Uploader) forgetSession() {
+	b2Sessions.Lock()
+	delete(b2Sessions.m, u.sessionKey())
+	b2Sessions.Unlock()
+}
+
+// api calls an API endpoint of the session with arg as JSON and decodes the
+// answer into v, unless it's nil. When the session expired it logs in again
+// and makes the call once more.
+func (u b2Uploader) api(ctx context.Context, endpoint string, arg, v interface{}) error {
+	for attempt := 0; ; attempt++ {
+		s, err := u.session(ctx)
+		if err != nil {
+			return err
+		}
+		err = u.call(ctx, s, endpoint, arg, v)
+		var apiErr *b2Error
+		if errors.As(err, &apiErr) && apiErr.expired() && attempt == 0 {
+			debugf("the B2 session expired, logging in again")
+			u.forgetSession()
+			continue
+		}
+		return err
+	}
+}
+
+// call is api with the session s
+func (u b2Uploader) call(ctx context.Context, s *b2Session, endpoint string, arg, v interface{}) error {
+	b, err := json.Marshal(arg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.APIURL+"/b2api/v2/"+endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", s.Token)
+	req.Header.Set("Content-Type", "application/json")
+	return u.do(req, v)
+}
+
+// do makes a request and decodes the answer into v, unless it's nil.
+// Failures are a *b2Error.
+func (u b2Uploader) do(req *http.Request, v interface{}) error {
+	resp, err := httpClientFor(u.p).Do(req)
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		e := &b2Error{Bucket: u.p.B2Bucket, Status: resp.StatusCode, Wait: retryAfterHeader(resp.Header, time.Now())}
+		var answer struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(body, &answer) == nil {
+			e.Code, e.Message = answer.Code, answer.Message
+		} else {
+			e.Message = shorten(strings.TrimSpace(string(body)), 200)
+		}
+		return e
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(body, v)
+}
+
+// fileName is the name of the file called remoteName in the bucket
+func (u b2Uploader) fileName(remoteName string) string {
+	return u.p.B2Prefix + remoteName
+}
+
+func (u b2Uploader) upload(ctx context.Context, localPath, remoteName string) (string, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	name := u.fileName(remoteName)
+
+	ctx, cancel := context.WithTimeout(ctx, u.p.TransferTimeout.Duration)
+	defer cancel()
+	s, err := u.session(ctx)
+	if err != nil {
+		return "", err
+	}
+	t := startTransfer(localPath, fi.Size(), 0, u.opts.Progress)
+	defer t.finish()
+	// deleting a bad upload comes after stalled() ends the context of the
+	// transfer
+	transferCtx, stalled := watchStall(ctx, t, u.p.StallTimeout.Duration)
+
+	var file b2File
+	if partSize := u.partSize(s, fi.Size()); fi.Size() > partSize {
+		file, err = u.uploadLarge(transferCtx, f, name, partSize, t)
+	} else {
+		file, err = u.uploadSmall(transferCtx, f, name, t)
+	}
+	if stalled() {
+		return "", &timeoutError{Op: "stall", Host: u.host(), After: u.p.StallTimeout.Duration}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", &timeoutError{Op: "transfer", Host: u.host(), After: u.p.TransferTimeout.Duration, Err: err}
+	}
+	if err != nil {
+		return "", err
+	}
+	if file.Size != fi.Size() {
+		if delErr := u.api(ctx, "b2_delete_file_version", map[string]string{"fileName": name, "fileId": file.ID}, nil); delErr != nil {
+			log.Printf("can't delete %s: %v", name, delErr)
+		}
+		return "", &sizeMismatchError{Name: name, Got: file.Size, Local: fi.Size()}
+	}
+	log.Println(t.summary())
+
+	// base_url is "/" when it's not set
+	if base := u.p.destinationFor(remoteExtension(remoteName)).BaseURL; base != "/" {
+		return base + b2Escape(name), nil
+	}
+	return s.DownloadURL + "/file/" + url.PathEscape(u.p.B2Bucket) + "/" + b2Escape(name), nil
+}
+
+// partSize is how large the parts of a file of size bytes are
+func (u b2Uploader) partSize(s *b2Session, size int64) int64 {
+	partSize := max64(s.PartSize, s.MinPartSize)
+	if partSize <= 0 {
+		partSize = b2DefaultPartSize
+	}
+	if size/partSize >= b2MaxParts {
+		partSize = size/b2MaxParts + 1
+	}
+	return partSize
+}
+
+// uploadSmall uploads f in a single request
+func (u b2Uploader) uploadSmall(ctx context.Context, f *os.File, name string, t *transfer) (b2File, error) {
+	var file b2File
+	size := t.Size
+	sum, err := sha1Hex(io.NewSectionReader(f, 0, size))
+	if err != nil {
+		return file, err
+	}
+	header := http.Header{
+		"X-Bz-File-Name":    {b2Escape(name)},
+		"Content-Type":      {contentType(name)},
+		"X-Bz-Content-Sha1": {sum},
+	}
+	err = u.send(ctx, b2FileURLs{u}, header, f, 0, size, t, &file)
+	return file, err
+}
+
+// uploadLarge uploads f in parts of partSize bytes. A failed upload is
+// canceled so its parts don't linger, and cost, in the bucket.
+func (u b2Uploader) uploadLarge(ctx context.Context, f *os.File, name string, partSize int64, t *transfer) (b2File, error) {
+	var file b2File
+	s, err := u.session(ctx)
+	if err != nil {
+		return file, err
+	}
+	start := map[string]string{"bucketId": s.bucketID, "fileName": name, "contentType": contentType(name)}
+	if err := u.api(ctx, "b2_start_large_file", start, &file); err != nil {
+		return file, err
+	}
+
+	err = u.sendParts(ctx, f, file.ID, partSize, t, &file)
+	if err != nil {
+		// the upload's context may be what failed
+		cancelCtx, cancel := context.WithTimeout(context.Background(), u.p.DialTimeout.Duration)
+		defer cancel()
+		if cancelErr := u.api(cancelCtx, "b2_cancel_large_file", map[string]string{"fileId": file.ID}, nil); cancelErr != nil {
+			log.Printf("can't cancel the large file upload of %s: %v", name, cancelErr)
+		}
+	}
+	return file, err
+}
+
+// sendParts uploads the parts of f to the large file fileID and finishes
+// it, decoding the finished file into file
+func (u b2Uploader) sendParts(ctx context.Context, f *os.File, fileID string, partSize int64, t *transfer, file *b2File) error {
+	size := t.Size
+	urls := &b2PartURLs{u: u, fileID: fileID}
+	var sums []string
+	for n, offset := 1, int64(0); offset < size; n, offset = n+1, offset+partSize {
+		length := partSize
+		if offset+length > size {
+			length = size - offset
+		}
+		sum, err := sha1Hex(io.NewSectionReader(f, offset, length))
+		if err != nil {
+			return err
+		}
+		header := http.Header{
+			"X-Bz-Part-Number":  {strconv.Itoa(n)},
+			"X-Bz-Content-Sha1": {sum},
+		}
+		if err := u.send(ctx, urls, header, f, offset, length, t, nil); err != nil {
+			return err
+		}
+		sums = append(sums, sum)
+	}
+	return u.api(ctx, "b2_finish_large_file", map[string]interface{}{"fileId": fileID, "partSha1Array": sums}, file)
+}
+
+// b2URLs hands out upload URLs, one that worked before or a new one. B2
+// takes one upload at a time per URL, so a URL is only kept again once an
+// upload to it worked.
+type b2URLs interface {
+	take(ctx context.Context) (b2UploadURL, error)
+	keep(target b2UploadURL)
+}
+
+// send posts the length bytes of f from offset on to an upload URL from
+// urls. An upload URL whose token expired, or whose host is busy or gone,
+// is replaced by a new one and the data sent again, as B2 asks clients to.
+func (u b2Uploader) send(ctx context.Context, urls b2URLs, header http.Header, f *os.File, offset, length int64, t *transfer, v interface{}) error {
+	for attempt := 0; ; attempt++ {
+		target, err := urls.take(ctx)
+		if err != nil {
+			return err
+		}
+		atomic.StoreInt64(&t.done, offset)
+		body := progressTracker{limitedReader{io.NewSectionReader(f, offset, length), uploadLimiter}, t}
+		req, err := http.NewRequest(http.MethodPost, target.URL, body)
+		if err != nil {
+			return err
+		}
+		req = req.WithContext(ctx)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		req.ContentLength = length
+		req.Header.Set("Authorization", target.Token)
+		err = u.do(req, v)
+		if err == nil {
+			urls.keep(target)
+			return nil
+		}
+		if attempt > 0 || ctx.Err() != nil || !b2NewUploadURL(err) {
+			return err
+		}
+		debugf("B2 upload URL failed, getting a new one: %v", err)
+	}
+}
+
+// b2NewUploadURL tells whether err means the upload URL should be replaced
+func b2NewUploadURL(err error) bool {
+	var apiErr *b2Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Status == http.StatusUnauthorized || apiErr.Status == http.StatusRequestTimeout || apiErr.Status >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// b2FileURLs are the upload URLs of the bucket, kept in the session for
+// the following files
+type b2FileURLs struct {
+	u b2Uploader
+}
+
+func (urls b2FileURLs) take(ctx context.Context) (b2UploadURL, error) {
+	s, err := urls.u.session(ctx)
+	if err != nil {
+		return b2UploadURL{}, err
+	}
+	b2Sessions.Lock()
+	if n := len(s.uploadURLs); n > 0 {
+		target := s.uploadURLs[n-1]
+		s.uploadURLs = s.uploadURLs[:n-1]
+		b2Sessions.Unlock()
+		return target, nil
+	}
+	b2Sessions.Unlock()
+	var target b2UploadURL
+	err = urls.u.api(ctx, "b2_get_upload_url", map[string]string{"bucketId": s.bucketID}, &target)
+	return target, err
+}
+
+func (urls b2FileURLs) keep(target b2UploadURL) {
+	b2Sessions.Lock()
+	defer b2Sessions.Unlock()
+	if s, ok := b2Sessions.m[urls.u.sessionKey()]; ok {
+		s.uploadURLs = append(s.uploadURLs, target)
+	}
+}
+
+// b2PartURLs is the upload URL of the parts of one large file
+type b2PartURLs struct {
+	u      b2Uploader
+	fileID string
+	kept   *b2UploadURL
+}
+
+func (urls *b2PartURLs) take(ctx context.Context) (b2UploadURL, error) {
+	if target := urls.kept; target != nil {
+		urls.kept = nil
+		return *target, nil
+	}
+	var target b2UploadURL
+	err := urls.u.api(ctx, "b2_get_upload_part_url", map[string]string{"fileId": urls.fileID}, &target)
+	return target, err
+}
+
+func (urls *b2PartURLs) keep(target b2UploadURL) {
+	urls.kept = &target
+}
+
+// sha1Hex is the hex encoded SHA-1 of what r reads
+func sha1Hex(r io.Reader) (string, error) {
+	h := sha1.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// b2Escape percent-encodes a file name for headers and URLs, leaving the
+// slashes B2 shows as folders
+func b2Escape(name string) string {
+	segments := strings.Split(name, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// host is where uploads go, for errors
+func (u b2Uploader) host() string {
+	if api, err := url.Parse(b2AuthorizeURL); err == nil {
+		return api.Host
+	}
+	return "api.backblazeb2.com"
+}
+
+// find returns the file called name in the bucket
+func (u b2Uploader) find(ctx context.Context, name string) (b2File, error) {
+	s, err := u.session(ctx)
+	if err != nil {
+		return b2File{}, err
+	}
+	var files struct {
+		Files []b2File `json:"files"`
+	}
+	arg := map[string]interface{}{"bucketId": s.bucketID, "startFileName": name, "prefix": name, "maxFileCount": 1}
+	if err := u.api(ctx, "b2_list_file_names", arg, &files); err != nil {
+		return b2File{}, err
+	}
+	if len(files.Files) == 0 || files.Files[0].Name != name {
+		return b2File{}, os.ErrNotExist
+	}
+	return files.Files[0], nil
+}
+
+func (u b2Uploader) remove(ctx context.Context, remoteName string) error {
+	file, err := u.find(ctx, u.fileName(remoteName))
+	if err != nil {
+		return err
+	}
+	return u.api(ctx, "b2_delete_file_version", map[string]string{"fileName": file.Name, "fileId": file.ID}, nil)
+}
+
+func (u b2Uploader) stat(ctx context.Context, remoteName string) (os.FileInfo, error) {
+	file, err := u.find(ctx, u.fileName(remoteName))
+	if err != nil {
+		return nil, err
+	}
+	return remoteFileInfo{name: remoteName, size: file.Size, modTime: time.Unix(0, file.Timestamp*int64(time.Millisecond))}, nil
+}
+
+// check makes sure the application key works and the bucket exists
+func (u b2Uploader) check(ctx context.Context) error {
+	s, err := u.session(ctx)
+	if err != nil {
+		return fmt.Errorf("b2: %w", err)
+	}
+	debugf("uploading to B2 bucket %s (%s)", u.p.B2Bucket, s.bucketID)
+	return nil
+}
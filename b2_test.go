@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// b2Server is the B2 native API in memory, for one bucket called shots
+type b2Server struct {
+	mu       sync.Mutex
+	url      string
+	partSize int64
+	files    map[string][]byte
+	large    map[string][][]byte
+	names    map[string]string // of large files by ID
+	logins   int
+	calls    []string
+	// fail holds answers to give instead, by endpoint, one at a time
+	fail map[string][]int
+}
+
+// newB2Server starts a B2 server and points b2AuthorizeURL to it
+func newB2Server(t *testing.T, partSize int64) *b2Server {
+	b := &b2Server{partSize: partSize, files: map[string][]byte{}, large: map[string][][]byte{}, names: map[string]string{}, fail: map[string][]int{}}
+	srv, _ := recordingServer(t, b.serve)
+	b.url = srv.URL
+	old := b2AuthorizeURL
+	b2AuthorizeURL = srv.URL + "/b2api/v2/b2_authorize_account"
+	b2Sessions.Lock()
+	oldSessions := b2Sessions.m
+	b2Sessions.m = map[string]*b2Session{}
+	b2Sessions.Unlock()
+	t.Cleanup(func() {
+		b2AuthorizeURL = old
+		b2Sessions.Lock()
+		b2Sessions.m = oldSessions
+		b2Sessions.Unlock()
+	})
+	return b
+}
+
+func (b *b2Server) serve(w http.ResponseWriter, r recordedRequest) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	endpoint := strings.TrimPrefix(r.Path, "/b2api/v2/")
+	b.calls = append(b.calls, endpoint)
+	if fails := b.fail[endpoint]; len(fails) > 0 {
+		b.fail[endpoint] = fails[1:]
+		code := map[int]string{401: "expired_auth_token", 503: "service_unavailable"}[fails[0]]
+		w.WriteHeader(fails[0])
+		fmt.Fprintf(w, `{"status":%d,"code":%q,"message":"not now"}`, fails[0], code)
+		return
+	}
+	answer := func(v interface{}) { json.NewEncoder(w).Encode(v) }
+	var arg map[string]interface{}
+	json.Unmarshal(r.Body, &arg)
+	str := func(name string) string { s, _ := arg[name].(string); return s }
+
+	if endpoint != "b2_authorize_account" && !strings.HasPrefix(r.Header.Get("Authorization"), "tok-") {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"status":401,"code":"bad_auth_token","message":"Invalid authorization token"}`)
+		return
+	}
+	switch endpoint {
+	case "b2_authorize_account":
+		if r.Header.Get("Authorization") != "Basic a2V5SUQ6czNjcjN0" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"status":401,"code":"unauthorized","message":""}`)
+			return
+		}
+		b.logins++
+		answer(map[string]interface{}{
+			"authorizationToken":      "tok-" + strconv.Itoa(b.logins),
+			"apiUrl":                  b.url,
+			"downloadUrl":             b.url + "/dl",
+			"accountId":               "acc",
+			"recommendedPartSize":     b.partSize,
+			"absoluteMinimumPartSize": 1,
+		})
+	case "b2_list_buckets":
+		if str("bucketName") != "shots" {
+			answer(map[string]interface{}{"buckets": []interface{}{}})
+			return
+		}
+		answer(map[string]interface{}{"buckets": []interface{}{map[string]string{"bucketId": "bkt"}}})
+	case "b2_get_upload_url":
+		answer(b2UploadURL{URL: b.url + "/upload", Token: "tok-upload"})
+	case "b2_get_upload_part_url":
+		answer(b2UploadURL{URL: b.url + "/part/" + str("fileId"), Token: "tok-part"})
+	case "/upload":
+		name := r.Header.Get("X-Bz-File-Name")
+		if sum := sha1.Sum(r.Body); r.Header.Get("X-Bz-Content-Sha1") != hex.EncodeToString(sum[:]) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"status":400,"code":"bad_request","message":"Checksum did not match data received"}`)
+			return
+		}
+		b.files[name] = r.Body
+		answer(b2File{ID: "id-" + name, Name: name, Size: int64(len(r.Body)), Timestamp: 1719828000000})
+	case "b2_start_large_file":
+		id := "large-" + str("fileName")
+		b.names[id] = str("fileName")
+		answer(b2File{ID: id, Name: str("fileName")})
+	case "b2_finish_large_file":
+		id := str("fileId")
+		parts := b.large[id]
+		if sums, _ := arg["partSha1Array"].([]interface{}); len(sums) != len(parts) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"status":400,"code":"bad_request","message":"wrong number of parts"}`)
+			return
+		}
+		content := bytes.Join(parts, nil)
+		b.files[b.names[id]] = content
+		answer(b2File{ID: id, Name: b.names[id], Size: int64(len(content))})
+	case "b2_cancel_large_file":
+		delete(b.large, str("fileId"))
+		answer(map[string]string{})
+	case "b2_list_file_names":
+		var files []b2File
+		if content, ok := b.files[str("prefix")]; ok {
+			files = append(files, b2File{ID: "id-" + str("prefix"), Name: str("prefix"), Size: int64(len(content)), Timestamp: 1719828000000})
+		}
+		answer(map[string]interface{}{"files": files})
+	case "b2_delete_file_version":
+		delete(b.files, str("fileName"))
+		answer(map[string]string{})
+	default:
+		if !strings.HasPrefix(endpoint, "/part/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		id := strings.TrimPrefix(endpoint, "/part/")
+		n, _ := strconv.Atoi(r.Header.Get("X-Bz-Part-Number"))
+		if n != len(b.large[id])+1 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"status":400,"code":"bad_request","message":"part %d out of order"}`, n)
+			return
+		}
+		b.large[id] = append(b.large[id], r.Body)
+		answer(map[string]string{})
+	}
+}
+
+// count is how often endpoint was called
+func (b *b2Server) count(endpoint string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for _, c := range b.calls {
+		if c == endpoint {
+			n++
+		}
+	}
+	return n
+}
+
+func b2TestUploader(bucket string) b2Uploader {
+	return b2Uploader{p: testProfile(profile{
+		Backend:          backendB2,
+		B2Bucket:         bucket,
+		B2Prefix:         "shots/",
+		B2KeyID:          "keyID",
+		B2ApplicationKey: "s3cr3t",
+	})}
+}
+
+func TestB2Upload(t *testing.T) {
+	b := newB2Server(t, 1<<20)
+	u := b2TestUploader("shots")
+	for _, name := range []string{"Zr8tW.png", "a b.png"} {
+		url, err := u.upload(context.Background(), uploadTestFile(t, "shot.png", []byte("png")), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := b.url + "/dl/file/shots/shots/" + strings.Replace(name, " ", "%20", 1); url != want {
+			t.Errorf("url = %s, want %s", url, want)
+		}
+	}
+	if string(b.files["shots/Zr8tW.png"]) != "png" {
+		t.Errorf("files %v", b.files)
+	}
+	// one login and one upload URL for both
+	if b.logins != 1 || b.count("b2_get_upload_url") != 1 {
+		t.Errorf("%d logins and %d upload URLs, want them reused", b.logins, b.count("b2_get_upload_url"))
+	}
+
+	u.p.BaseURL = "https://shots.example.com/"
+	if url, err := u.upload(context.Background(), uploadTestFile(t, "shot.png", []byte("png")), "x.png"); err != nil || url != "https://shots.example.com/shots/x.png" {
+		t.Errorf("with base_url: %s, %v", url, err)
+	}
+}
+
+func TestB2UploadLarge(t *testing.T) {
+	b := newB2Server(t, 1000)
+	u := b2TestUploader("shots")
+	content := bytes.Repeat([]byte("0123456789"), 250)
+	if _, err := u.upload(context.Background(), uploadTestFile(t, "rec.mp4", content), "rec.mp4"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b.files["shots/rec.mp4"], content) {
+		t.Errorf("uploaded %d bytes, want the %d of the file", len(b.files["shots/rec.mp4"]), len(content))
+	}
+	if n := b.count("/part/large-shots/rec.mp4"); n != 3 {
+		t.Errorf("%d parts, want 3 of 1000 bytes at most", n)
+	}
+
+	// a part that can't be sent cancels the file
+	b.fail["/part/large-shots/big.mp4"] = []int{400}
+	if _, err := u.upload(context.Background(), uploadTestFile(t, "big.mp4", content), "big.mp4"); err == nil {
+		t.Fatal("uploaded although a part was turned down")
+	}
+	if b.count("b2_cancel_large_file") != 1 {
+		t.Error("the large file wasn't canceled")
+	}
+}
+
+func TestB2PartSize(t *testing.T) {
+	u := b2Uploader{}
+	tests := []struct {
+		s    b2Session
+		size int64
+		want int64
+	}{
+		{b2Session{PartSize: 100 << 20, MinPartSize: 5 << 20}, 1 << 30, 100 << 20},
+		{b2Session{PartSize: 1 << 20, MinPartSize: 5 << 20}, 1 << 30, 5 << 20},
+		{b2Session{}, 1 << 30, b2DefaultPartSize},
+		{b2Session{PartSize: 1000}, 100000000, 10001},
+	}
+	for _, tt := range tests {
+		if got := u.partSize(&tt.s, tt.size); got != tt.want {
+			t.Errorf("part size of %d bytes with %d recommended: %d, want %d", tt.size, tt.s.PartSize, got, tt.want)
+		}
+	}
+}
+
+func TestB2NewUploadURL(t *testing.T) {
+	b := newB2Server(t, 1<<20)
+	b.fail["/upload"] = []int{503}
+	u := b2TestUploader("shots")
+	if _, err := u.upload(context.Background(), uploadTestFile(t, "shot.png", []byte("png")), "Zr8tW.png"); err != nil {
+		t.Fatal(err)
+	}
+	if n := b.count("b2_get_upload_url"); n != 2 {
+		t.Errorf("%d upload URLs, want a new one after the busy one", n)
+	}
+}
+
+func TestB2SessionExpired(t *testing.T) {
+	b := newB2Server(t, 1<<20)
+	u := b2TestUploader("shots")
+	if err := u.check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	b.fail["b2_get_upload_url"] = []int{401}
+	if _, err := u.upload(context.Background(), uploadTestFile(t, "shot.png", []byte("png")), "Zr8tW.png"); err != nil {
+		t.Fatal(err)
+	}
+	if b.logins != 2 {
+		t.Errorf("%d logins, want another one after the token expired", b.logins)
+	}
+}
+
+func TestB2Errors(t *testing.T) {
+	newB2Server(t, 1<<20)
+	u := b2TestUploader("screenshots")
+	if err := u.check(context.Background()); err == nil || !strings.Contains(err.Error(), "B2 bucket screenshots doesn't exist") {
+		t.Errorf("missing bucket: %v", err)
+	}
+	u = b2TestUploader("shots")
+	u.p.B2ApplicationKey = "wrong"
+	if err := u.check(context.Background()); err == nil || !strings.Contains(err.Error(), "B2 rejected the application key") {
+		t.Errorf("wrong key: %v", err)
+	}
+	e := &b2Error{Status: http.StatusServiceUnavailable, Code: "service_unavailable", Message: "not now"}
+	if !transient(e) || e.Error() != "B2: not now (service_unavailable)" {
+		t.Errorf("%v, transient %t", e, transient(e))
+	}
+}
+
+func TestB2StatAndRemove(t *testing.T) {
+	b := newB2Server(t, 1<<20)
+	u := b2TestUploader("shots")
+	if _, err := u.stat(context.Background(), "Zr8tW.png"); !os.IsNotExist(err) {
+		t.Errorf("stat before uploading: %v", err)
+	}
+	if _, err := u.upload(context.Background(), uploadTestFile(t, "shot.png", []byte("png")), "Zr8tW.png"); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := u.stat(context.Background(), "Zr8tW.png")
+	if err != nil || fi.Size() != 3 || fi.ModTime().Unix() != 1719828000 {
+		t.Errorf("stat: %v, %v", fi, err)
+	}
+	if err := u.remove(context.Background(), "Zr8tW.png"); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.files) != 0 {
+		t.Errorf("files %v after removing", b.files)
+	}
+}
+
+func TestB2Problems(t *testing.T) {
+	if got := b2Problems(profile{B2Prefix: "/shots/"}); len(got) != 1 {
+		t.Errorf("b2_prefix with a slash: %v", got)
+	}
+	if got := b2Problems(profile{B2Prefix: "shots/"}); len(got) != 0 {
+		t.Errorf("b2_prefix shots/: %v", got)
+	}
+}
@@ -0,0 +1,580 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backends files can be uploaded to, picked per profile with backend
+const (
+	backendSFTP     = "sftp"
+	backendS3       = "s3"
+	backendGCS      = "gcs"
+	backendAzure    = "azure"
+	backendHTTP     = "http"
+	backendWebDAV   = "webdav"
+	backendFTP      = "ftp"
+	backendImgur    = "imgur"
+	backendDropbox  = "dropbox"
+	backendGDrive   = "gdrive"
+	backendLocal    = "local"
+	backendRsync    = "rsync"
+	backendB2       = "b2"
+	backendOneDrive = "onedrive"
+	backendTelegram = "telegram"
+	backendIPFS     = "ipfs"
+)
+
+// uploader stores files somewhere they can be fetched from by URL. Every
+// kind of destination is one, the upload pipeline only goes through it.
+type uploader interface {
+	// upload stores the local file at localPath as remoteName and returns
+	// its URL
+	upload(ctx context.Context, localPath, remoteName string) (string, error)
+}
+
+// remover is an uploader that can delete what it uploaded
+type remover interface {
+	remove(ctx context.Context, remoteName string) error
+}
+
+// lister is an uploader that can list what's been uploaded
+type lister interface {
+	list(ctx context.Context) ([]string, error)
+}
+
+// statter is an uploader that can look up an uploaded file
+type statter interface {
+	stat(ctx context.Context, remoteName string) (os.FileInfo, error)
+}
+
+// checker is an uploader that can make sure its settings work, e.g. that
+// its credentials are accepted, before the first upload
+type checker interface {
+	check(ctx context.Context) error
+}
+
+// extensionFilter is an uploader that only takes some kinds of files
+type extensionFilter interface {
+	// supports tells whether files with the lower case extension ext can
+	// be uploaded
+	supports(ext string) bool
+}
+
+// errNotSupported is returned for operations a backend can't do
+var errNotSupported = errors.New("not supported")
+
+// newUploader returns the uploader for p's backend
+func newUploader(p profile, opts uploadOptions) uploader {
+	if _, ok := httpPresets[p.Backend]; ok {
+		return httpUploader{p: p, opts: opts}
+	}
+	switch p.Backend {
+	case backendS3:
+		return s3Uploader{p: p, opts: opts}
+	case backendGCS:
+		return gcsUploader{p: p, opts: opts}
+	case backendAzure:
+		return azureUploader{p: p, opts: opts}
+	case backendHTTP:
+		return httpUploader{p: p, opts: opts}
+	case backendWebDAV:
+		return webdavUploader{p: p, opts: opts}
+	case backendFTP:
+		return ftpUploader{p: p, opts: opts}
+	case backendImgur:
+		return imgurUploader{p: p, opts: opts}
+	case backendDropbox:
+		return dropboxUploader{p: p, opts: opts}
+	case backendGDrive:
+		return gdriveUploader{p: p, opts: opts}
+	case backendLocal:
+		return localUploader{p: p, opts: opts}
+	case backendRsync:
+		return rsyncUploader{p: p, opts: opts}
+	case backendB2:
+		return b2Uploader{p: p, opts: opts}
+	case backendOneDrive:
+		return onedriveUploader{p: p, opts: opts}
+	case backendTelegram:
+		return telegramUploader{p: p, opts: opts}
+	case backendIPFS:
+		return ipfsUploader{p: p, opts: opts}
+	}
+	return sftpUploader{p: p, opts: opts}
+}
+
+// usesSSH tells whether p uploads over SSH, so the SSH settings matter
+func (p profile) usesSSH() bool {
+	return len(p.Destinations) == 0 && (p.Backend == "" || p.Backend == backendSFTP)
+}
+
+// hasFolders tells whether p's backend keeps files in folders by the
+// slashes in their names, file hosts and Google Drive don't
+func (p profile) hasFolders() bool {
+	if _, ok := httpPresets[p.Backend]; ok {
+		return false
+	}
+	switch p.Backend {
+	case backendHTTP, backendImgur, backendTelegram, backendIPFS, backendGDrive:
+		return false
+	}
+	return true
+}
+
+// backendProblems reports an unknown backend and problems with the
+// settings of p's backend
+func backendProblems(p profile) []string {
+	if _, ok := httpPresets[p.Backend]; ok {
+		return append(httpProblems(p), httpPresetProblems(p)...)
+	}
+	switch p.Backend {
+	case "", backendSFTP:
+		return nil
+	case backendS3:
+		return s3Problems(p, os.Getenv)
+	case backendGCS:
+		return gcsProblems(p, os.Getenv)
+	case backendAzure:
+		return azureProblems(p, os.Getenv)
+	case backendHTTP:
+		return httpProblems(p)
+	case backendWebDAV:
+		return webdavProblems(p)
+	case backendFTP:
+		return ftpProblems(p)
+	case backendImgur:
+		return nil
+	case backendDropbox:
+		return dropboxProblems(p)
+	case backendGDrive:
+		return gdriveProblems(p, os.Getenv)
+	case backendLocal:
+		return localProblems(p)
+	case backendRsync:
+		return rsyncProblems(p)
+	case backendB2:
+		return b2Problems(p)
+	case backendOneDrive:
+		return onedriveProblems(p)
+	case backendTelegram:
+		return telegramProblems(p)
+	case backendIPFS:
+		return ipfsProblems(p)
+	}
+	return []string{fmt.Sprintf("unknown backend %q, use %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s or %s, or one of the file hosts %s", p.Backend, backendSFTP, backendS3, backendGCS, backendAzure, backendHTTP, backendWebDAV, backendFTP, backendImgur, backendDropbox, backendGDrive, backendLocal, backendRsync, backendB2, backendOneDrive, backendTelegram, backendIPFS, httpPresetNames())}
+}
+
+// backendSecrets are the secret references p's backend uses, by the label
+// they're resolved with
+func backendSecrets(p profile) map[string]string {
+	secrets := map[string]string{}
+	if _, ok := httpPresets[p.Backend]; ok || p.Backend == backendHTTP {
+		for name, ref := range p.HTTPHeaders {
+			secrets[headerLabel(p, name)] = ref
+		}
+	}
+	switch p.Backend {
+	case backendWebDAV:
+		if p.WebDAVPassword != "" {
+			secrets[webdavLabel(p, "password")] = p.WebDAVPassword
+		}
+		if p.WebDAVToken != "" {
+			secrets[webdavLabel(p, "token")] = p.WebDAVToken
+		}
+	case backendFTP:
+		if p.FTPPassword != "" {
+			secrets[ftpLabel(p)] = p.FTPPassword
+		}
+	case backendImgur:
+		if p.ImgurClientID != "" {
+			secrets[imgurLabel("client ID")] = p.ImgurClientID
+		}
+		if p.ImgurToken != "" {
+			secrets[imgurLabel("token")] = p.ImgurToken
+		}
+	case backendDropbox:
+		if p.DropboxToken != "" {
+			secrets[dropboxLabel("token")] = p.DropboxToken
+		}
+		if p.DropboxRefreshToken != "" {
+			secrets[dropboxLabel("refresh token")] = p.DropboxRefreshToken
+		}
+		if p.DropboxAppSecret != "" {
+			secrets[dropboxLabel("app secret")] = p.DropboxAppSecret
+		}
+	case backendB2:
+		if p.B2ApplicationKey != "" {
+			secrets[b2Label("application key")] = p.B2ApplicationKey
+		}
+	case backendTelegram:
+		if p.TelegramToken != "" {
+			secrets[telegramLabel("bot token")] = p.TelegramToken
+		}
+	case backendIPFS:
+		if p.IPFSToken != "" {
+			secrets[ipfsLabel("token")] = p.IPFSToken
+		}
+		if p.IPFSPinToken != "" {
+			secrets[ipfsLabel("pinning token")] = p.IPFSPinToken
+		}
+	case backendGDrive:
+		// the token is looked up when it's used, so it can be missing
+		// until skrins auth saved it
+		if p.GDriveClientSecret != "" && p.GDriveCredentials == "" {
+			secrets[gdriveLabel("client secret")] = p.GDriveClientSecret
+		}
+	}
+	return secrets
+}
+
+// backendSummary describes where a profile that doesn't upload over SSH
+// puts files, for the log
+func (p profile) backendSummary() string {
+	if len(p.Destinations) > 0 {
+		return fmt.Sprintf("destinations=%s policy=%s", strings.Join(p.Destinations, ","), p.policy())
+	}
+	if _, ok := httpPresets[p.Backend]; ok {
+		return fmt.Sprintf("host=%s url=%q expiry=%s", p.Backend, p.HTTPURL, p.HTTPExpiry.Duration)
+	}
+	switch p.Backend {
+	case backendS3:
+		return fmt.Sprintf("bucket=%q prefix=%q base_url=%q", p.S3Bucket, p.S3Prefix, p.BaseURL)
+	case backendGCS:
+		return fmt.Sprintf("bucket=%q prefix=%q base_url=%q", p.GCSBucket, p.GCSPrefix, p.BaseURL)
+	case backendAzure:
+		return fmt.Sprintf("container=%q prefix=%q base_url=%q", p.AzureContainer, p.AzurePrefix, p.BaseURL)
+	case backendHTTP:
+		return fmt.Sprintf("url=%q", p.HTTPURL)
+	case backendWebDAV:
+		return fmt.Sprintf("url=%q user=%q base_url=%q", p.WebDAVURL, p.WebDAVUser, p.BaseURL)
+	case backendFTP:
+		return fmt.Sprintf("host=%q user=%q tls=%s remote_path=%q base_url=%q", p.FTPHost, p.FTPUser, p.ftpTLSMode(), p.RemotePath, p.BaseURL)
+	case backendImgur:
+		account := "anonymous"
+		if p.ImgurToken != "" {
+			account = "token"
+		}
+		return fmt.Sprintf("account=%s fallback_profile=%q", account, p.FallbackProfile)
+	case backendDropbox:
+		return fmt.Sprintf("folder=%q app_key=%q", path.Join("/", p.DropboxFolder), p.DropboxAppKey)
+	case backendGDrive:
+		account := "oauth"
+		if p.GDriveCredentials != "" {
+			account = "credentials=" + strconv.Quote(p.GDriveCredentials)
+		}
+		return fmt.Sprintf("folder=%q %s", p.GDriveFolder, account)
+	case backendLocal:
+		mode := p.LocalMode
+		if mode == "" {
+			mode = localCopy
+		}
+		return fmt.Sprintf("dir=%q mode=%s base_url=%q", p.RemotePath, mode, p.BaseURL)
+	case backendRsync:
+		return fmt.Sprintf("host=%q user=%q rsync=%q remote_path=%q base_url=%q", p.RemoteHost, p.RemoteUser, p.rsyncBinary(), p.RemotePath, p.BaseURL)
+	case backendB2:
+		return fmt.Sprintf("bucket=%q prefix=%q key_id=%q base_url=%q", p.B2Bucket, p.B2Prefix, p.B2KeyID, p.BaseURL)
+	case backendOneDrive:
+		return fmt.Sprintf("folder=%q tenant=%s link_scope=%s", path.Join("/", p.OneDriveFolder), p.onedriveTenant(), p.onedriveLinkScope())
+	case backendTelegram:
+		return fmt.Sprintf("chat=%q caption=%q", p.TelegramChatID, p.TelegramCaption)
+	case backendIPFS:
+		return fmt.Sprintf("api=%q pin=%t pin_service=%q gateway=%q", p.ipfsAPI(), p.IPFSPin, p.IPFSPinService, p.IPFSGateway)
+	}
+	return ""
+}
+
+// checkBackends runs the self-check of every profile's backend that has
+// one. Checks that fail because the network is down are only logged, the
+// uploads will tell once it's back.
+func checkBackends(s *settings) error {
+	profiles := []profile{s.Profile}
+	for _, p := range s.RuleProfiles {
+		profiles = append(profiles, p)
+	}
+	for _, p := range profiles {
+		c, ok := newUploader(p, uploadOptions{}).(checker)
+		if !ok || len(p.Destinations) > 0 {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), p.DialTimeout.Duration)
+		err := c.check(ctx)
+		cancel()
+		if err != nil && transient(err) {
+			log.Printf("can't check the %s backend now: %v", p.Backend, err)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remoteExtension is the extension of a remote name, like fileExtension
+func remoteExtension(remoteName string) string {
+	return fileExtension(remoteName)
+}
+
+// compoundExtensions are the extensions with a dot of their own, a
+// .tar.gz is a tar.gz and not a gz
+var compoundExtensions = []string{"tar.gz", "tar.bz2", "tar.xz", "tar.zst"}
+
+// fileExtension is the extension of the file name without its dot, in the
+// case it's written in: one of compoundExtensions or what's after the last
+// dot. Names without a dot, or with nothing before or after it, have none.
+func fileExtension(name string) string {
+	name = path.Base(name)
+	lower := strings.ToLower(name)
+	for _, ext := range compoundExtensions {
+		if strings.HasSuffix(lower, "."+ext) && len(name) > len(ext)+1 {
+			return name[len(name)-len(ext):]
+		}
+	}
+	i := strings.LastIndex(name, ".")
+	if i <= 0 || i == len(name)-1 {
+		return ""
+	}
+	return name[i+1:]
+}
+
+// dotExtension is fileExtension with its dot, so a suffix goes before all
+// of a .tar.gz, or nothing when there's none
+func dotExtension(name string) string {
+	if ext := fileExtension(name); ext != "" {
+		return "." + ext
+	}
+	return ""
+}
+
+// sftpUploader uploads over SSH, with SFTP or SCP, to the destination p's
+// routes pick
+type sftpUploader struct {
+	p    profile
+	opts uploadOptions
+}
+
+func (u sftpUploader) upload(ctx context.Context, localPath, remoteName string) (string, error) {
+	dst := u.p.destinationFor(remoteExtension(remoteName))
+	if err := uploadObjectToDestination(ctx, u.p, localPath, dst.RemotePath+remoteName, u.opts); err != nil {
+		return "", err
+	}
+	return dst.BaseURL + remoteName, nil
+}
+
+func (u sftpUploader) uploadCompressed(ctx context.Context, localPath, remoteName string) (string, error) {
+	dst := u.p.destinationFor(remoteExtension(remoteName))
+	if err := compressObjectToDestination(ctx, u.p, localPath, dst.RemotePath+remoteName+gzipSuffix, u.opts); err != nil {
+		return "", err
+	}
+	return dst.BaseURL + remoteName + gzipSuffix, nil
+}
+
+func (u sftpUploader) remove(ctx context.Context, remoteName string) error {
+	name := u.p.destinationFor(remoteExtension(remoteName)).RemotePath + remoteName
+	return u.withClient(ctx, func(c *sftpConn) error {
+		if c.transport() == transportSCP {
+			_, err := runRemote(c, "rm -- "+shellQuote(name))
+			return err
+		}
+		return c.Remove(name)
+	})
+}
+
+// list returns the names of the files in every remote directory p uploads
+// to, temporary ones left out
+func (u sftpUploader) list(ctx context.Context) ([]string, error) {
+	dirs := []string{u.p.RemotePath}
+	for _, r := range u.p.Routes {
+		if r.RemotePath != "" && !contains(dirs, r.RemotePath) {
+			dirs = append(dirs, r.RemotePath)
+		}
+	}
+	var names []string
+	err := u.withClient(ctx, func(c *sftpConn) error {
+		if c.transport() == transportSCP {
+			return errNotSupported
+		}
+		names = nil
+		for _, dir := range dirs {
+			files, err := c.ReadDir(dir)
+			if err != nil {
+				return err
+			}
+			for _, f := range files {
+				if !f.IsDir() && !tempName.MatchString(f.Name()) {
+					names = append(names, f.Name())
+				}
+			}
+		}
+		return nil
+	})
+	return names, err
+}
+
+func (u sftpUploader) stat(ctx context.Context, remoteName string) (os.FileInfo, error) {
+	return u.statPath(ctx, u.p.destinationFor(remoteExtension(remoteName)).RemotePath+remoteName)
+}
+
+func (u sftpUploader) statCompressed(ctx context.Context, remoteName string) (os.FileInfo, error) {
+	return u.statPath(ctx, u.p.destinationFor(remoteExtension(remoteName)).RemotePath+remoteName+gzipSuffix)
+}
+
+// statPath looks up the remote file at name
+func (u sftpUploader) statPath(ctx context.Context, name string) (os.FileInfo, error) {
+	var fi os.FileInfo
+	err := u.withClient(ctx, func(c *sftpConn) error {
+		if c.transport() == transportSCP {
+			return errNotSupported
+		}
+		var err error
+		fi, err = c.Stat(name)
+		return err
+	})
+	return fi, err
+}
+
+// withClient runs fn with a connection, a pooled one unless persistent
+// connections are turned off
+func (u sftpUploader) withClient(ctx context.Context, fn func(*sftpConn) error) error {
+	if u.opts.Persistent {
+		return conns.withClient(ctx, u.p, fn)
+	}
+	return withNewClient(ctx, u.p, fn)
+}
+
+// dryRunUploader only logs what would have been uploaded where
+type dryRunUploader struct {
+	p profile
+}
+
+func (u dryRunUploader) upload(ctx context.Context, localPath, remoteName string) (string, error) {
+	dst := u.p.destinationFor(remoteExtension(remoteName))
+	log.Printf("[dry-run] would upload %s to %s:%s", localPath, u.p.RemoteHost, dst.RemotePath+remoteName)
+	return dst.BaseURL + remoteName, nil
+}
+
+func (u dryRunUploader) uploadCompressed(ctx context.Context, localPath, remoteName string) (string, error) {
+	dst := u.p.destinationFor(remoteExtension(remoteName))
+	log.Printf("[dry-run] would upload %s gzipped to %s:%s", localPath, u.p.RemoteHost, dst.RemotePath+remoteName+gzipSuffix)
+	return dst.BaseURL + remoteName + gzipSuffix, nil
+}
+
+// httpClients are shared by the uploads with the same proxy and dial
+// timeout, so connections are reused
+var httpClients sync.Map
+
+// httpClientFor returns the HTTP client for uploads to p. It connects
+// through p's proxy, or the one in the environment.
+func httpClientFor(p profile) *http.Client {
+	key := fmt.Sprintf("%s|%s|%s|%t", p.Proxy, p.DialTimeout, p.TLSCAFile, p.InsecureTLS)
+	if c, ok := httpClients.Load(key); ok {
+		return c.(*http.Client)
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: p.DialTimeout.Duration}).DialContext,
+		TLSHandshakeTimeout:   p.DialTimeout.Duration,
+		ResponseHeaderTimeout: p.TransferTimeout.Duration,
+		IdleConnTimeout:       p.KeepaliveInterval.Duration * time.Duration(p.KeepaliveMaxMissed),
+	}
+	if u, err := url.Parse(p.Proxy); err == nil && p.Proxy != "" {
+		transport.Proxy = http.ProxyURL(u)
+	}
+	// checkProfile reported a CA file that can't be used
+	if cfg, err := tlsConfigFor(p); err == nil {
+		transport.TLSClientConfig = cfg
+	}
+	c, _ := httpClients.LoadOrStore(key, &http.Client{Transport: transport})
+	return c.(*http.Client)
+}
+
+// tlsConfigFor trusts the certificates in p's tls_ca_file on top of the
+// system's, or any certificate with insecure_tls. It's nil when neither is
+// set.
+func tlsConfigFor(p profile) (*tls.Config, error) {
+	if p.TLSCAFile == "" && !p.InsecureTLS {
+		return nil, nil
+	}
+	cfg := &tls.Config{InsecureSkipVerify: p.InsecureTLS}
+	if p.TLSCAFile == "" {
+		return cfg, nil
+	}
+	pem, err := ioutil.ReadFile(p.TLSCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls_ca_file: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("tls_ca_file: no certificates in %s", p.TLSCAFile)
+	}
+	cfg.RootCAs = pool
+	return cfg, nil
+}
+
+// remoteFileInfo describes an uploaded file
+type remoteFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi remoteFileInfo) Name() string       { return fi.name }
+func (fi remoteFileInfo) Size() int64        { return fi.size }
+func (fi remoteFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi remoteFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi remoteFileInfo) IsDir() bool        { return false }
+func (fi remoteFileInfo) Sys() interface{}   { return nil }
+
+// contentTypes covers the default extensions mime doesn't know everywhere
+var contentTypes = map[string]string{
+	"png":     "image/png",
+	"jpg":     "image/jpeg",
+	"jpeg":    "image/jpeg",
+	"gif":     "image/gif",
+	"webm":    "video/webm",
+	"mp4":     "video/mp4",
+	"mov":     "video/quicktime",
+	"zip":     "application/zip",
+	"tar":     "application/x-tar",
+	"gz":      "application/gzip",
+	"tar.gz":  "application/gzip",
+	"bz2":     "application/x-bzip2",
+	"tar.bz2": "application/x-bzip2",
+	"xz":      "application/x-xz",
+	"tar.xz":  "application/x-xz",
+	"zst":     "application/zstd",
+	"tar.zst": "application/zstd",
+}
+
+// contentType is the MIME type of name, so browsers show the file instead
+// of downloading it
+func contentType(name string) string {
+	ext := strings.ToLower(remoteExtension(name))
+	if t, ok := contentTypes[ext]; ok {
+		return t
+	}
+	if i := strings.LastIndex(ext, "."); i >= 0 {
+		ext = ext[i+1:]
+	}
+	if t := mime.TypeByExtension("." + ext); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
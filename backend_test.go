@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+func TestFileExtension(t *testing.T) {
+	tests := []struct {
+		name string
+		ext  string
+		dot  string
+	}{
+		{"shot.png", "png", ".png"},
+		{"/home/me/shots/shot.png", "png", ".png"},
+		{"clip.MOV", "MOV", ".MOV"},
+		{"backup.tar.gz", "tar.gz", ".tar.gz"},
+		{"archive.TAR.GZ", "TAR.GZ", ".TAR.GZ"},
+		{"logs.tar.zst", "tar.zst", ".tar.zst"},
+		{"weird.name.with.dots.png", "png", ".png"},
+		{"not.a.tar.gzip", "gzip", ".gzip"},
+		{"/srv/v1.2/shot", "", ""},
+		{"README", "", ""},
+		{".bashrc", "", ""},
+		{".tar.gz", "gz", ".gz"},
+		{"trailing.", "", ""},
+	}
+	for _, tt := range tests {
+		if got := fileExtension(tt.name); got != tt.ext {
+			t.Errorf("fileExtension(%q) = %q, want %q", tt.name, got, tt.ext)
+		}
+		if got := dotExtension(tt.name); got != tt.dot {
+			t.Errorf("dotExtension(%q) = %q, want %q", tt.name, got, tt.dot)
+		}
+	}
+}
+
+func TestAllowedExtension(t *testing.T) {
+	s := &settings{Extensions: defaultExtensions, DenyExtensions: []string{"gif"}}
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"shot.png", true},
+		{"CLIP.MOV", true},
+		{"backup.tar.gz", true},
+		{"archive.TAR.GZ", true},
+		{"weird.name.with.dots.png", true},
+		{"anim.gif", false},
+		{"notes.txt", false},
+		{"README", false},
+	}
+	for _, tt := range tests {
+		if got := s.allowedExtension(fileExtension(tt.name)); got != tt.want {
+			t.Errorf("%s allowed = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestContentType(t *testing.T) {
+	tests := []struct{ name, want string }{
+		{"shot.png", "image/png"},
+		{"SHOT.PNG", "image/png"},
+		{"clip.MOV", "video/quicktime"},
+		{"backup.tar.gz", "application/gzip"},
+		{"archive.TAR.GZ", "application/gzip"},
+		{"weird.name.with.dots.png", "image/png"},
+		{"README", "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		if got := contentType(tt.name); got != tt.want {
+			t.Errorf("contentType(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNewUploader(t *testing.T) {
+	tests := map[string]string{
+		"":            "main.sftpUploader",
+		backendSFTP:   "main.sftpUploader",
+		backendS3:     "main.s3Uploader",
+		backendAzure:  "main.azureUploader",
+		backendHTTP:   "main.httpUploader",
+		"0x0":         "main.httpUploader",
+		backendWebDAV: "main.webdavUploader",
+		backendImgur:  "main.imgurUploader",
+		backendB2:     "main.b2Uploader",
+		backendLocal:  "main.localUploader",
+	}
+	for backend, want := range tests {
+		if got := fmt.Sprintf("%T", newUploader(profile{Backend: backend}, uploadOptions{})); got != want {
+			t.Errorf("backend %q: %s, want %s", backend, got, want)
+		}
+	}
+}
+
+func TestUploadToBestProfile(t *testing.T) {
+	up := &fakeUploader{}
+	url, _, err := uploadToBestProfile(context.Background(), retrySettings(1), fakeEffects{up: up}, retryFile(t), "abc.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "https://fake.example/abc.png" {
+		t.Errorf("url = %q", url)
+	}
+	if len(up.uploaded) != 1 || up.uploaded[0] != "abc.png" {
+		t.Errorf("uploaded %v, want abc.png", up.uploaded)
+	}
+}
+
+func TestUploadCompressedRouted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skrins-routes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logs := filepath.Join(dir, "logs") + string(filepath.Separator)
+	s := retrySettings(1)
+	s.Compress = compressGzip
+	s.Profile = profile{
+		Backend:    backendLocal,
+		RemotePath: dir + string(filepath.Separator),
+		BaseURL:    "https://example.com/",
+		Routes:     []route{{Extensions: []string{"txt"}, RemotePath: logs, BaseURL: "https://logs.example.com/"}},
+	}
+	path := uploadTestFile(t, "build.txt", []byte("ok"))
+	url, name, err := uploadToBestProfile(context.Background(), s, live{opts: uploadOptions{Mkdirs: true}}, path, "build.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "build.txt.gz" || url != "https://logs.example.com/build.txt.gz" {
+		t.Errorf("uploaded as %s to %s, want build.txt.gz on the txt route", name, url)
+	}
+	if _, err := os.Stat(filepath.Join(logs, "build.txt.gz")); err != nil {
+		t.Errorf("not in the txt route's directory: %v", err)
+	}
+}
+
+// pipelineLog is what became of the files uploadFile took care of
+type pipelineLog struct {
+	clipboard []string
+	notified  []string
+	failed    []string
+	removed   []string
+	recorded  []historyEntry
+}
+
+// pipelineEffects uploads to a fake backend and logs everything else
+type pipelineEffects struct {
+	fakeEffects
+	log *pipelineLog
+}
+
+func (fx pipelineEffects) copyToClipboard(s string) { fx.log.clipboard = append(fx.log.clipboard, s) }
+func (fx pipelineEffects) notify(url string)        { fx.log.notified = append(fx.log.notified, url) }
+func (fx pipelineEffects) notifyFailure(name string, err error) {
+	fx.log.failed = append(fx.log.failed, name)
+}
+func (fx pipelineEffects) record(e historyEntry) { fx.log.recorded = append(fx.log.recorded, e) }
+func (fx pipelineEffects) remove(path string) error {
+	fx.log.removed = append(fx.log.removed, path)
+	return nil
+}
+
+// pipelineFile is a screenshot uploadFile takes as written right away, with
+// settings for it
+func pipelineFile(t *testing.T) (string, os.FileInfo, *settings) {
+	t.Helper()
+	tempStateDir(t)
+	path := retryFile(t)
+	if err := ioutil.WriteFile(path, make([]byte, 1024), 0600); err != nil {
+		t.Fatal(err)
+	}
+	hourAgo := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, hourAgo, hourAgo); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := retrySettings(1)
+	s.Extensions = defaultExtensions
+	s.DetectType = detectExtension
+	s.StablePeriod, s.StableMaxWait = time.Second, time.Second
+	s.MinBytes = defaultMinSize
+	s.NoQuarantine = true
+	return path, fi, s
+}
+
+func TestUploadFilePipeline(t *testing.T) {
+	path, fi, s := pipelineFile(t)
+	up := &fakeUploader{}
+	fx := pipelineEffects{fakeEffects{up: up}, &pipelineLog{}}
+	uploadFile(context.Background(), s, fx, path, fi)
+
+	if len(up.uploaded) != 1 || !strings.HasSuffix(up.uploaded[0], ".png") {
+		t.Fatalf("uploaded %v, want one png", up.uploaded)
+	}
+	url := "https://fake.example/" + up.uploaded[0]
+	if len(fx.log.clipboard) != 1 || fx.log.clipboard[0] != url {
+		t.Errorf("copied %v, want %s", fx.log.clipboard, url)
+	}
+	if len(fx.log.notified) != 1 || fx.log.notified[0] != url {
+		t.Errorf("notified %v, want %s", fx.log.notified, url)
+	}
+	if len(fx.log.removed) != 1 || fx.log.removed[0] != path {
+		t.Errorf("removed %v, want %s", fx.log.removed, path)
+	}
+	if len(fx.log.recorded) != 1 || fx.log.recorded[0].Status != historyUploaded || fx.log.recorded[0].URL != url {
+		t.Errorf("history %+v, want the upload", fx.log.recorded)
+	}
+}
+
+func TestUploadFilePipelineFails(t *testing.T) {
+	path, fi, s := pipelineFile(t)
+	up := &fakeUploader{errs: []error{sftp.ErrSSHFxPermissionDenied}}
+	fx := pipelineEffects{fakeEffects{up: up}, &pipelineLog{}}
+	uploadFile(context.Background(), s, fx, path, fi)
+
+	if len(fx.log.failed) != 1 || fx.log.failed[0] != filepath.Base(path) {
+		t.Errorf("failures notified %v, want %s", fx.log.failed, filepath.Base(path))
+	}
+	if len(fx.log.clipboard) != 0 || len(fx.log.removed) != 0 {
+		t.Errorf("copied %v and removed %v after a failed upload", fx.log.clipboard, fx.log.removed)
+	}
+	if len(fx.log.recorded) != 1 || fx.log.recorded[0].Status != historyFailed {
+		t.Errorf("history %+v, want the failure", fx.log.recorded)
+	}
+}
+
+// testProfile is p with the defaults and slashes every profile gets
+func testProfile(p profile) profile {
+	p, _ = p.finish(false, fakeEnv(nil))
+	return p.withSlashes()
+}
+
+// recordedRequest is a request a test server got
+type recordedRequest struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Header http.Header
+	Body   []byte
+}
+
+// requestLog is what a test server got, in order
+type requestLog struct {
+	mu   sync.Mutex
+	reqs []recordedRequest
+}
+
+func (l *requestLog) all() []recordedRequest {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]recordedRequest(nil), l.reqs...)
+}
+
+// recordingServer is a test server that records every request before
+// answering it with respond
+func recordingServer(t *testing.T, respond func(w http.ResponseWriter, r recordedRequest)) (*httptest.Server, *requestLog) {
+	t.Helper()
+	l := &requestLog{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		rec := recordedRequest{Method: r.Method, Path: r.URL.EscapedPath(), Query: r.URL.Query(), Header: r.Header, Body: body}
+		l.mu.Lock()
+		l.reqs = append(l.reqs, rec)
+		l.mu.Unlock()
+		respond(w, rec)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, l
+}
+
+// uploadTestFile is a local file with content to upload
+func uploadTestFile(t *testing.T, name string, content []byte) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "skrins-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// postedForm is the multipart form r posted
+func postedForm(t *testing.T, r recordedRequest) *multipart.Form {
+	t.Helper()
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	form, err := multipart.NewReader(bytes.NewReader(r.Body), params["boundary"]).ReadForm(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return form
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultBatchSeparator is what the URLs of a batch are joined with on the
+// clipboard unless the config file sets batch_separator
+const defaultBatchSeparator = "\n"
+
+// batchResult is how the upload of one file of a batch went, with the URL
+// it got or the error it failed with
+type batchResult struct {
+	name string
+	url  string
+	err  error
+	// announce notifies of url like the file would have been by itself,
+	// as a duplicate or with copies missing
+	announce func(fx effects)
+	modified time.Time
+	started  time.Time
+}
+
+// batch collects the results of uploads that overlap, several files
+// waiting for or being uploaded at once, or the files of a directory
+// uploaded together. They're announced all at once when the last one is
+// done, see endBatch.
+var batch = struct {
+	sync.Mutex
+	listing int
+	results []batchResult
+}{}
+
+// joinBatch adds r to the batch if the upload is one of several, and tells
+// whether it did. A file uploaded by itself isn't, it's announced right away
+// as always.
+func joinBatch(r batchResult) bool {
+	waiting, active := uploads.depth()
+	batch.Lock()
+	defer batch.Unlock()
+	if waiting == 0 && active <= 1 && batch.listing == 0 && len(batch.results) == 0 {
+		return false
+	}
+	batch.results = append(batch.results, r)
+	return true
+}
+
+// uploadingListing tells joinBatch that the files of a listing are uploaded
+// one after the other, until the returned function is called
+func uploadingListing() func() {
+	batch.Lock()
+	batch.listing++
+	batch.Unlock()
+	return func() {
+		batch.Lock()
+		batch.listing--
+		batch.Unlock()
+	}
+}
+
+// endBatch announces the batch once nothing is left waiting or uploading:
+// one notification for every file, with those that failed, and the URLs
+// copied at once, joined by batch_separator. A batch that came to a single
+// file is announced like that file would have been by itself.
+func endBatch(s *settings, fx effects) {
+	waiting, active := uploads.depth()
+	if waiting > 0 || active > 0 {
+		return
+	}
+	batch.Lock()
+	results := batch.results
+	if batch.listing > 0 {
+		results = nil
+	}
+	if len(results) > 0 {
+		batch.results = nil
+	}
+	batch.Unlock()
+	if len(results) == 0 {
+		return
+	}
+
+	announcing.Lock()
+	defer announcing.Unlock()
+	if len(results) == 1 {
+		r := results[0]
+		if r.err != nil {
+			fx.notifyFailure(r.name, r.err)
+			return
+		}
+		copyURL(fx, r.url, r.modified, r.started)
+		r.announce(fx)
+		return
+	}
+	var urls, failed []string
+	modified, started := results[0].modified, results[0].started
+	for _, r := range results {
+		if r.err != nil {
+			failed = append(failed, r.name)
+			continue
+		}
+		if !contains(urls, r.url) {
+			urls = append(urls, r.url)
+		}
+		if r.modified.After(modified) {
+			modified = r.modified
+		}
+		if r.started.Before(started) {
+			started = r.started
+		}
+	}
+	log.Printf("%d of %d files uploaded", len(results)-len(failed), len(results))
+	if len(urls) > 0 {
+		copyURL(fx, strings.Join(urls, s.BatchSeparator), modified, started)
+	}
+	fx.notifyBatch(len(results)-len(failed), failed, urls)
+}
+
+// showBatchNotification tells how many files of a batch were uploaded, and
+// which failed
+func showBatchNotification(uploaded int, failed, urls []string) {
+	title := fmt.Sprintf("%d files uploaded", uploaded)
+	body := strings.Join(urls, "\n")
+	if len(failed) > 0 {
+		title = fmt.Sprintf("%d of %d files uploaded", uploaded, uploaded+len(failed))
+		body = strings.TrimSuffix("Failed: "+strings.Join(failed, ", ")+"\n"+body, "\n")
+	}
+	if err := pushNotification(title, body); err != nil {
+		log.Println("notification failed:", err)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultBundleWindow is how long files are gathered for a bundle unless
+// the config file sets bundle_window
+const defaultBundleWindow = 2 * time.Second
+
+// bundles gathers the files that come in within bundle_window of the first
+// one. More than bundle_over are zipped and uploaded as one, fewer go on to
+// be uploaded one by one, passing through here once.
+var bundles = struct {
+	sync.Mutex
+	gathering []string
+	gathered  map[string]bool
+	through   map[string]bool
+	// ready are the files of bundles waiting in the upload queue, by the
+	// path of the zip they're packed into there
+	ready map[string][]string
+	n     int
+}{gathered: map[string]bool{}, through: map[string]bool{}, ready: map[string][]string{}}
+
+// gathered tells whether the file at path is held back to find out whether
+// it's one of many that came in at once, see bundle_over
+func gathered(s *settings, path string) bool {
+	if s.BundleOver == 0 {
+		return false
+	}
+	if ext := fileExtension(path); ext == "" || !s.allowedExtension(ext) {
+		// not uploaded at all, uploadFile tells
+		return false
+	}
+	bundles.Lock()
+	defer bundles.Unlock()
+	if bundles.through[path] {
+		delete(bundles.through, path)
+		return false
+	}
+	if bundles.gathered[path] {
+		return true
+	}
+	bundles.gathered[path] = true
+	bundles.gathering = append(bundles.gathering, path)
+	if len(bundles.gathering) == 1 {
+		time.AfterFunc(s.BundleWindow, func() { endBundle(s.BundleOver) })
+	}
+	return true
+}
+
+// endBundle queues the files gathered as one bundle if there are more than
+// over of them, one by one otherwise
+func endBundle(over int) {
+	bundles.Lock()
+	paths := bundles.gathering
+	bundles.gathering, bundles.gathered = nil, map[string]bool{}
+	if len(paths) <= over {
+		for _, path := range paths {
+			bundles.through[path] = true
+		}
+		bundles.Unlock()
+		for _, path := range paths {
+			uploads.add(path)
+		}
+		return
+	}
+	bundles.n++
+	zipPath := filepath.Join(os.TempDir(), fmt.Sprintf("skrins-%d-%d", os.Getpid(), bundles.n), "bundle-"+time.Now().Format(defaultDateLayout)+".zip")
+	bundles.ready[zipPath] = paths
+	bundles.Unlock()
+	log.Printf("%d files came in within %s, uploading them as one zip", len(paths), currentSettings().BundleWindow)
+	uploads.add(zipPath)
+}
+
+// readyBundle returns the files to pack into the zip at zipPath if it's a
+// bundle's
+func readyBundle(zipPath string) ([]string, bool) {
+	bundles.Lock()
+	defer bundles.Unlock()
+	paths, ok := bundles.ready[zipPath]
+	delete(bundles.ready, zipPath)
+	return paths, ok
+}
+
+// uploadBundle zips the files at paths into zipPath, uploads that and
+// copies its URL, then disposes of the files like uploadFile does. When it
+// can't be uploaded the files are uploaded one by one instead.
+func uploadBundle(ctx context.Context, s *settings, fx effects, zipPath string, paths []string) {
+	started := time.Now()
+	var infos []os.FileInfo
+	var packed []string
+	for _, path := range paths {
+		f, err := waitUntilWritten(path, s.StablePeriod, s.StableMaxWait)
+		if err != nil {
+			debugf("not bundling %s: %v", path, err)
+			continue
+		}
+		infos, packed = append(infos, f), append(packed, path)
+	}
+	if len(packed) == 0 {
+		return
+	}
+	defer os.RemoveAll(filepath.Dir(zipPath))
+	zf, err := zipFiles(zipPath, packed)
+	if err != nil {
+		log.Printf("can't bundle %d files, uploading them one by one: %v", len(packed), err)
+		uploadSeparately(packed)
+		return
+	}
+
+	url, remoteFilename, err := uploadWithRetries(ctx, s, fx, zipPath, s.remoteNameFor(zipPath, "zip", ""))
+	var degraded *degradedError
+	if errors.As(err, &degraded) {
+		// the link works, uploading the files again would only make more
+		log.Println(err)
+	} else if err != nil {
+		log.Printf("can't upload the bundle of %d files, uploading them one by one: %v", len(packed), err)
+		uploadSeparately(packed)
+		return
+	}
+	newest := infos[0].ModTime()
+	for _, f := range infos {
+		if f.ModTime().After(newest) {
+			newest = f.ModTime()
+		}
+	}
+	announcing.Lock()
+	copyURL(fx, url, newest, started)
+	fx.notifyBundle(url, len(packed))
+	announcing.Unlock()
+	log.Printf("uploaded %d files as %s, %s", len(packed), filepath.Base(zipPath), formatSize(uint64(zf.Size())))
+	for i, path := range packed {
+		digest, _ := fileSHA256(path)
+		entry := historyEntryFor(s, path, infos[i], digest)
+		entry.Status, entry.Time = historyBundled, time.Now()
+		entry.Remote, entry.URL = remoteFilename, url
+		entry.Expires = linkExpiry(s.Profile, url, entry.Time)
+		dispose(s, fx, path, &entry)
+		fx.record(entry)
+	}
+}
+
+// uploadSeparately queues the files at paths to be uploaded one by one
+func uploadSeparately(paths []string) {
+	bundles.Lock()
+	for _, path := range paths {
+		bundles.through[path] = true
+	}
+	bundles.Unlock()
+	for _, path := range paths {
+		uploads.add(path)
+	}
+}
+
+// zipFiles packs the files at paths into a new zip at zipPath, a file at a
+// time so none has to fit into memory. Files of the same name get -1, -2
+// and so on in it.
+func zipFiles(zipPath string, paths []string) (os.FileInfo, error) {
+	if err := os.MkdirAll(filepath.Dir(zipPath), 0700); err != nil {
+		return nil, err
+	}
+	out, err := os.OpenFile(zipPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+	w := zip.NewWriter(out)
+	names := map[string]bool{}
+	for _, path := range paths {
+		if err := addToZip(w, path, names); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if err := out.Close(); err != nil {
+		return nil, err
+	}
+	return os.Stat(zipPath)
+}
+
+// addToZip adds the file at path to w by its name, unless that's in names
+// already
+func addToZip(w *zip.Writer, path string, names map[string]bool) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	h, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return err
+	}
+	ext := dotExtension(h.Name)
+	stem := strings.TrimSuffix(h.Name, ext)
+	for n := 1; names[h.Name]; n++ {
+		h.Name = fmt.Sprintf("%s-%d%s", stem, n, ext)
+	}
+	names[h.Name] = true
+	h.Method = zip.Deflate
+	zw, err := w.CreateHeader(h)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(zw, in)
+	return err
+}
+
+// showBundleNotification tells the user that n files were uploaded as one
+// zip at url
+func showBundleNotification(url string, n int) {
+	if err := pushNotification(fmt.Sprintf("%d files uploaded as one zip", n), url); err != nil {
+		log.Println("notification failed:", err)
+	}
+}
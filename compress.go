@@ -0,0 +1,104 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// compressGzip is the compression compress can be set to, files get
+// gzipSuffix on the server
+const (
+	compressGzip = "gzip"
+	gzipSuffix   = ".gz"
+)
+
+// compressedExtensions are formats that compress by themselves and
+// gain nothing from gzip, they're never compressed
+var compressedExtensions = []string{
+	"png", "jpg", "jpeg", "gif", "webp", "avif", "heic",
+	"mp4", "webm", "mov", "mkv", "avi", "mp3", "m4a", "ogg", "opus", "flac",
+	"zip", "7z", "rar", "gz", "tgz", "bz2", "xz", "zst",
+	"tar.gz", "tar.bz2", "tar.xz", "tar.zst",
+	"docx", "xlsx", "pptx", "odt", "ods", "odp", "epub", "jar", "apk",
+}
+
+// errNoSCPCompression is returned for compressed uploads to servers that
+// turn out to have no SFTP, SCP has to be told the size up front
+var errNoSCPCompression = errors.New("can't upload compressed files over SCP, the server has no SFTP; turn compress off or set transport = \"scp\" to upload them as they are")
+
+// compressor is an uploader that can compress a file on the way to the
+// server, see compress
+type compressor interface {
+	// uploadCompressed stores the local file at localPath, gzipped, as
+	// remoteName with gzipSuffix and returns its URL. It's routed by the
+	// extension of remoteName, not the suffix.
+	uploadCompressed(ctx context.Context, localPath, remoteName string) (string, error)
+}
+
+// compressedStatter looks up the compressed copy of remoteName where it's
+// routed to, see compressor
+type compressedStatter interface {
+	statCompressed(ctx context.Context, remoteName string) (os.FileInfo, error)
+}
+
+// compresses tells whether files with the extension ext are compressed
+// when uploaded with p. Only backends that write to a file of their own can
+// take a stream of unknown size, and SCP can't.
+func (s *settings) compresses(p profile, ext string) bool {
+	if s.Compress == "" || len(p.Destinations) > 0 {
+		return false
+	}
+	switch p.Backend {
+	case "", backendSFTP:
+		if p.Transport == transportSCP {
+			return false
+		}
+	case backendLocal:
+		if p.LocalMode == localLink || p.LocalMode == localRename {
+			return false
+		}
+	default:
+		return false
+	}
+	ext = strings.ToLower(ext)
+	return ext != "" && !contains(compressedExtensions, ext) && !contains(s.CompressSkip, ext)
+}
+
+// gzipReader reads the file at path gzipped. It's compressed as it's read,
+// by a goroutine writing into a pipe, so nothing is put on disk. Closing it
+// stops the goroutine.
+func gzipReader(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		defer f.Close()
+		zw := gzip.NewWriter(pw)
+		_, err := io.Copy(zw, f)
+		if closeErr := zw.Close(); err == nil {
+			err = closeErr
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+// compressedNames looks up names with gzipSuffix, so freeRemoteName and the
+// like find a free name for a file that's compressed on the way
+type compressedNames struct {
+	uploader
+}
+
+func (c compressedNames) stat(ctx context.Context, remoteName string) (os.FileInfo, error) {
+	st, ok := c.uploader.(compressedStatter)
+	if !ok {
+		return nil, errNotSupported
+	}
+	return st.statCompressed(ctx, remoteName)
+}
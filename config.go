@@ -0,0 +1,1175 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// profile is a single upload destination.
+type profile struct {
+	RemoteHost string `toml:"remote_host"`
+	RemoteUser string `toml:"remote_user"`
+	// Key is one or more private key files, comma separated
+	Key        string  `toml:"key"`
+	RemotePath string  `toml:"remote_path"`
+	BaseURL    string  `toml:"base_url"`
+	Routes     []route `toml:"routes"`
+
+	// SSH algorithms to offer, the library defaults when empty
+	Ciphers           []string `toml:"ciphers"`
+	KeyExchanges      []string `toml:"key_exchanges"`
+	HostKeyAlgorithms []string `toml:"host_key_algorithms"`
+	MACs              []string `toml:"macs"`
+
+	// KnownHosts is checked for the server's key, ~/.ssh/known_hosts by
+	// default. InsecureHostKey skips the check completely.
+	KnownHosts      string `toml:"known_hosts"`
+	InsecureHostKey *bool  `toml:"insecure_host_key"`
+
+	// UseAgent authenticates with the SSH agent's identities before Key.
+	// The agent is also used when there's no Key.
+	UseAgent *bool `toml:"use_agent"`
+
+	// KeyPassphraseFile holds the passphrase of an encrypted Key
+	KeyPassphraseFile string `toml:"key_passphrase_file"`
+
+	// Password is a secret reference (see resolveSecret) for servers that
+	// only allow password or keyboard-interactive authentication
+	Password string `toml:"password"`
+
+	// DialTimeout bounds connecting and the SSH handshake, TransferTimeout
+	// a single file's upload. StallTimeout is how long an upload may make
+	// no progress before the connection is taken for dead.
+	DialTimeout     duration `toml:"dial_timeout"`
+	TransferTimeout duration `toml:"transfer_timeout"`
+	StallTimeout    duration `toml:"stall_timeout"`
+
+	// A keepalive is sent every KeepaliveInterval, the connection counts as
+	// dead after KeepaliveMaxMissed of them went unanswered
+	KeepaliveInterval  duration `toml:"keepalive_interval"`
+	KeepaliveMaxMissed int      `toml:"keepalive_max_missed"`
+
+	// Uploaded files are chmodded to FileMode and created directories to
+	// DirMode, when set. SkipChmod leaves both to the server.
+	FileMode  fileMode `toml:"file_mode"`
+	DirMode   fileMode `toml:"dir_mode"`
+	SkipChmod *bool    `toml:"skip_chmod"`
+
+	// SFTP packet size in bytes and how many packets of a file may be in
+	// flight, the library defaults of 32768 and 64 when 0. Larger packets
+	// help on high latency links but some servers break on them.
+	SFTPMaxPacket          int `toml:"sftp_max_packet"`
+	SFTPConcurrentRequests int `toml:"sftp_concurrent_requests"`
+
+	// Proxy is a socks5:// or http:// URL to connect through, ALL_PROXY
+	// and NO_PROXY apply when it's empty
+	Proxy string `toml:"proxy"`
+
+	// Files of SpaceCheckThreshold bytes and more are only uploaded when
+	// the server has room for them and SpaceMargin more
+	SpaceCheckThreshold byteSize `toml:"space_check_threshold"`
+	SpaceMargin         byteSize `toml:"space_margin"`
+
+	// Backend is what files are uploaded to, sftp when empty.
+	// FallbackProfile names the profile for files the backend doesn't
+	// take, like videos on imgur.
+	Backend         string `toml:"backend"`
+	FallbackProfile string `toml:"fallback_profile"`
+
+	// Destinations names the profiles a file goes to instead of a backend
+	// of its own. DestinationPolicy is mirror, uploading to all of them, or
+	// failover, uploading to the first one that works.
+	Destinations      []string `toml:"destinations"`
+	DestinationPolicy string   `toml:"destination_policy"`
+
+	// The s3 backend uploads to S3Bucket in S3Region, the AWS_REGION when
+	// empty, naming objects S3Prefix followed by the remote name.
+	// S3CacheControl is sent as the objects' Cache-Control header.
+	S3Bucket       string `toml:"s3_bucket"`
+	S3Region       string `toml:"s3_region"`
+	S3Prefix       string `toml:"s3_prefix"`
+	S3CacheControl string `toml:"s3_cache_control"`
+	// S3Endpoint is the URL of an S3-compatible service to use instead of
+	// AWS, addressed with the bucket in the path when S3PathStyle is set.
+	// S3DisableChecksum leaves out Content-MD5 for services that reject it.
+	S3Endpoint        string `toml:"s3_endpoint"`
+	S3PathStyle       bool   `toml:"s3_path_style"`
+	S3DisableChecksum bool   `toml:"s3_disable_checksum"`
+	// S3Presign makes the URL a presigned link valid for that long, for
+	// private buckets, instead of base_url followed by the key
+	S3Presign duration `toml:"s3_presign"`
+
+	// The gcs backend uploads to GCSBucket, naming objects GCSPrefix
+	// followed by the remote name, with the service account key in
+	// GCSCredentials or the application default credentials. GCSACL is the
+	// predefined ACL objects get, for buckets without uniform access.
+	GCSBucket      string `toml:"gcs_bucket"`
+	GCSPrefix      string `toml:"gcs_prefix"`
+	GCSCredentials string `toml:"gcs_credentials"`
+	GCSACL         string `toml:"gcs_acl"`
+
+	// The azure backend uploads to AzureContainer, naming blobs AzurePrefix
+	// followed by the remote name. The account and its key or SAS token
+	// come from AzureConnectionString, or AzureAccount and AzureSAS.
+	AzureContainer        string `toml:"azure_container"`
+	AzurePrefix           string `toml:"azure_prefix"`
+	AzureConnectionString string `toml:"azure_connection_string"`
+	AzureAccount          string `toml:"azure_account"`
+	AzureSAS              string `toml:"azure_sas"`
+
+	// The http backend posts files as the form field HTTPField to HTTPURL,
+	// along with HTTPForm and the headers HTTPHeaders, whose values are
+	// secret references. The URL is taken from the response at the JSON
+	// path HTTPURLJSON, from the first group of HTTPURLRegex or is the whole
+	// body. The backends named after file hosts, see httpPresets, fill these
+	// in and ask the host to delete files after HTTPExpiry.
+	HTTPURL      string            `toml:"http_url"`
+	HTTPField    string            `toml:"http_field"`
+	HTTPForm     map[string]string `toml:"http_form"`
+	HTTPHeaders  map[string]string `toml:"http_headers"`
+	HTTPURLJSON  string            `toml:"http_url_json"`
+	HTTPURLRegex string            `toml:"http_url_regex"`
+	HTTPExpiry   duration          `toml:"http_expiry"`
+
+	// The webdav backend uploads into the collection WebDAVURL, logging in
+	// as WebDAVUser with WebDAVPassword, or with the bearer token
+	// WebDAVToken; both are secret references. NextcloudShare copies the
+	// link of a public Nextcloud share instead of a URL under BaseURL.
+	WebDAVURL      string `toml:"webdav_url"`
+	WebDAVUser     string `toml:"webdav_user"`
+	WebDAVPassword string `toml:"webdav_password"`
+	WebDAVToken    string `toml:"webdav_token"`
+	NextcloudShare bool   `toml:"nextcloud_share"`
+
+	// The ftp backend uploads to RemotePath on FTPHost, logging in as
+	// FTPUser with the secret reference FTPPassword. The connection is
+	// secured with AUTH TLS, or from the start with FTPImplicitTLS; plain
+	// FTP needs AllowInsecure. FTPActive has the server connect back for
+	// transfers instead of using passive mode.
+	FTPHost        string `toml:"ftp_host"`
+	FTPUser        string `toml:"ftp_user"`
+	FTPPassword    string `toml:"ftp_password"`
+	FTPActive      bool   `toml:"ftp_active"`
+	FTPImplicitTLS bool   `toml:"ftp_implicit_tls"`
+	AllowInsecure  *bool  `toml:"allow_insecure"`
+
+	// The imgur backend uploads images to Imgur, anonymously with the
+	// application's ImgurClientID or to the account of the access token
+	// ImgurToken. Both are secret references.
+	ImgurClientID string `toml:"imgur_client_id"`
+	ImgurToken    string `toml:"imgur_token"`
+
+	// The dropbox backend uploads into DropboxFolder of a Dropbox and
+	// returns a direct link to the file's shared link. It authenticates with
+	// the access token DropboxToken, or trades DropboxRefreshToken for one
+	// with the app's DropboxAppKey and, unless it uses PKCE,
+	// DropboxAppSecret. Tokens and secret are secret references.
+	DropboxFolder       string `toml:"dropbox_folder"`
+	DropboxToken        string `toml:"dropbox_token"`
+	DropboxRefreshToken string `toml:"dropbox_refresh_token"`
+	DropboxAppKey       string `toml:"dropbox_app_key"`
+	DropboxAppSecret    string `toml:"dropbox_app_secret"`
+
+	// The gdrive backend uploads into the Google Drive folder with the ID
+	// GDriveFolder and shares the file with anyone with the link. It
+	// authenticates with the service account key file GDriveCredentials, or
+	// with the refresh token `skrins auth` saves to the secret reference
+	// GDriveToken for the OAuth client GDriveClientID and
+	// GDriveClientSecret, a secret reference too.
+	GDriveFolder       string `toml:"gdrive_folder"`
+	GDriveCredentials  string `toml:"gdrive_credentials"`
+	GDriveClientID     string `toml:"gdrive_client_id"`
+	GDriveClientSecret string `toml:"gdrive_client_secret"`
+	GDriveToken        string `toml:"gdrive_token"`
+
+	// The local backend puts files into the directory remote_path on this
+	// machine, like a synced or mounted folder. LocalMode is how: copy,
+	// link for a hard link or rename to move the file; the last two copy
+	// when remote_path is on another filesystem.
+	LocalMode string `toml:"local_mode"`
+
+	// The rsync backend runs RsyncPath, rsync from PATH by default, to copy
+	// files over the system's ssh to remote_host, with remote_user, key,
+	// known_hosts and jump taken from the SSH settings
+	RsyncPath string `toml:"rsync_path"`
+
+	// The b2 backend uploads to the Backblaze B2 bucket B2Bucket, naming
+	// files B2Prefix followed by the remote name, with the application key
+	// B2KeyID and its secret B2ApplicationKey, a secret reference. The URL
+	// is base_url followed by the name, or the bucket's friendly URL.
+	B2Bucket         string `toml:"b2_bucket"`
+	B2Prefix         string `toml:"b2_prefix"`
+	B2KeyID          string `toml:"b2_key_id"`
+	B2ApplicationKey string `toml:"b2_application_key"`
+
+	// The onedrive backend uploads into the folder OneDriveFolder of the
+	// user's OneDrive and shares the file with a view link for anyone, or
+	// for the organization with OneDriveLinkScope. It signs in to
+	// OneDriveTenant with the app OneDriveClientID and the refresh token
+	// `skrins auth` saves to the secret reference OneDriveToken.
+	OneDriveFolder    string `toml:"onedrive_folder"`
+	OneDriveClientID  string `toml:"onedrive_client_id"`
+	OneDriveTenant    string `toml:"onedrive_tenant"`
+	OneDriveToken     string `toml:"onedrive_token"`
+	OneDriveLinkScope string `toml:"onedrive_link_scope"`
+
+	// The telegram backend sends files as the bot with the token
+	// TelegramToken, a secret reference, to the chat TelegramChatID, with
+	// TelegramCaption as the caption after filling in its placeholders
+	TelegramToken   string `toml:"telegram_token"`
+	TelegramChatID  string `toml:"telegram_chat_id"`
+	TelegramCaption string `toml:"telegram_caption"`
+
+	// The ipfs backend adds files, pinned on the node with IPFSPin, through
+	// the RPC API at IPFSAPI, authorized with the secret reference IPFSToken
+	// for hosted ones. With IPFSPinService, a pinning service API taking the
+	// token IPFSPinToken, the file is pinned there too. The URL is
+	// IPFSGateway with the CID.
+	IPFSAPI        string `toml:"ipfs_api"`
+	IPFSToken      string `toml:"ipfs_token"`
+	IPFSPin        bool   `toml:"ipfs_pin"`
+	IPFSGateway    string `toml:"ipfs_gateway"`
+	IPFSPinService string `toml:"ipfs_pin_service"`
+	IPFSPinToken   string `toml:"ipfs_pin_token"`
+
+	// TLSCAFile holds certificates trusted by backends that upload over
+	// HTTPS or FTPS on top of the system's, InsecureTLS trusts any
+	// certificate
+	TLSCAFile   string `toml:"tls_ca_file"`
+	InsecureTLS bool   `toml:"insecure_tls"`
+
+	// Transport is sftp or scp, when empty SFTP is used unless the server
+	// doesn't have it
+	Transport string `toml:"transport"`
+
+	// Jump is one or more jump hosts, [user@]host[:port] comma separated,
+	// to connect through like ssh -J. They're logged in to with JumpKey and
+	// JumpPassword when set and the server's credentials otherwise.
+	Jump         string `toml:"jump"`
+	JumpKey      string `toml:"jump_key"`
+	JumpPassword string `toml:"jump_password"`
+
+	// DefaultKey is the key found in ~/.ssh when Key is empty, it's never
+	// read from the config file
+	DefaultKey string `toml:"-"`
+}
+
+// empty tells whether nothing at all is set.
+func (p profile) empty() bool {
+	return p.RemoteHost == "" && p.RemoteUser == "" && p.Key == "" &&
+		p.RemotePath == "" && p.BaseURL == "" && len(p.Routes) == 0 &&
+		len(p.Destinations) == 0 && p.KnownHosts == "" && p.InsecureHostKey == nil && p.UseAgent == nil && p.KeyPassphraseFile == "" && p.Password == ""
+}
+
+// merge fills every empty field of p from other.
+func (p *profile) merge(other profile) {
+	setDefault(&p.RemoteHost, other.RemoteHost)
+	setDefault(&p.RemoteUser, other.RemoteUser)
+	setDefault(&p.Key, other.Key)
+	setDefault(&p.RemotePath, other.RemotePath)
+	setDefault(&p.BaseURL, other.BaseURL)
+	if len(p.Routes) == 0 {
+		p.Routes = other.Routes
+	}
+	setDefaultList(&p.Ciphers, other.Ciphers)
+	setDefaultList(&p.KeyExchanges, other.KeyExchanges)
+	setDefaultList(&p.HostKeyAlgorithms, other.HostKeyAlgorithms)
+	setDefaultList(&p.MACs, other.MACs)
+	setDefault(&p.KnownHosts, other.KnownHosts)
+	setDefaultBool(&p.InsecureHostKey, other.InsecureHostKey)
+	setDefaultBool(&p.UseAgent, other.UseAgent)
+	setDefault(&p.KeyPassphraseFile, other.KeyPassphraseFile)
+	setDefault(&p.Password, other.Password)
+	setDefaultDuration(&p.DialTimeout, other.DialTimeout)
+	setDefaultDuration(&p.TransferTimeout, other.TransferTimeout)
+	setDefaultDuration(&p.StallTimeout, other.StallTimeout)
+	setDefaultDuration(&p.KeepaliveInterval, other.KeepaliveInterval)
+	if p.KeepaliveMaxMissed == 0 {
+		p.KeepaliveMaxMissed = other.KeepaliveMaxMissed
+	}
+	if p.FileMode == 0 {
+		p.FileMode = other.FileMode
+	}
+	if p.DirMode == 0 {
+		p.DirMode = other.DirMode
+	}
+	setDefaultBool(&p.SkipChmod, other.SkipChmod)
+	if p.SFTPMaxPacket == 0 {
+		p.SFTPMaxPacket = other.SFTPMaxPacket
+	}
+	if p.SFTPConcurrentRequests == 0 {
+		p.SFTPConcurrentRequests = other.SFTPConcurrentRequests
+	}
+	setDefault(&p.Proxy, other.Proxy)
+	if p.SpaceCheckThreshold == 0 {
+		p.SpaceCheckThreshold = other.SpaceCheckThreshold
+	}
+	if p.SpaceMargin == 0 {
+		p.SpaceMargin = other.SpaceMargin
+	}
+	setDefault(&p.Backend, other.Backend)
+	setDefault(&p.FallbackProfile, other.FallbackProfile)
+	if len(p.Destinations) == 0 {
+		p.Destinations = other.Destinations
+	}
+	setDefault(&p.DestinationPolicy, other.DestinationPolicy)
+	setDefault(&p.S3Bucket, other.S3Bucket)
+	setDefault(&p.S3Region, other.S3Region)
+	setDefault(&p.S3Prefix, other.S3Prefix)
+	setDefault(&p.S3CacheControl, other.S3CacheControl)
+	setDefault(&p.S3Endpoint, other.S3Endpoint)
+	p.S3PathStyle = p.S3PathStyle || other.S3PathStyle
+	p.S3DisableChecksum = p.S3DisableChecksum || other.S3DisableChecksum
+	setDefaultDuration(&p.S3Presign, other.S3Presign)
+	setDefault(&p.GCSBucket, other.GCSBucket)
+	setDefault(&p.GCSPrefix, other.GCSPrefix)
+	setDefault(&p.GCSCredentials, other.GCSCredentials)
+	setDefault(&p.GCSACL, other.GCSACL)
+	setDefault(&p.AzureContainer, other.AzureContainer)
+	setDefault(&p.AzurePrefix, other.AzurePrefix)
+	setDefault(&p.AzureConnectionString, other.AzureConnectionString)
+	setDefault(&p.AzureAccount, other.AzureAccount)
+	setDefault(&p.AzureSAS, other.AzureSAS)
+	setDefault(&p.HTTPURL, other.HTTPURL)
+	setDefault(&p.HTTPField, other.HTTPField)
+	if len(p.HTTPForm) == 0 {
+		p.HTTPForm = other.HTTPForm
+	}
+	if len(p.HTTPHeaders) == 0 {
+		p.HTTPHeaders = other.HTTPHeaders
+	}
+	setDefault(&p.HTTPURLJSON, other.HTTPURLJSON)
+	setDefault(&p.HTTPURLRegex, other.HTTPURLRegex)
+	setDefaultDuration(&p.HTTPExpiry, other.HTTPExpiry)
+	setDefault(&p.WebDAVURL, other.WebDAVURL)
+	setDefault(&p.WebDAVUser, other.WebDAVUser)
+	setDefault(&p.WebDAVPassword, other.WebDAVPassword)
+	setDefault(&p.WebDAVToken, other.WebDAVToken)
+	p.NextcloudShare = p.NextcloudShare || other.NextcloudShare
+	setDefault(&p.FTPHost, other.FTPHost)
+	setDefault(&p.FTPUser, other.FTPUser)
+	setDefault(&p.FTPPassword, other.FTPPassword)
+	p.FTPActive = p.FTPActive || other.FTPActive
+	p.FTPImplicitTLS = p.FTPImplicitTLS || other.FTPImplicitTLS
+	setDefaultBool(&p.AllowInsecure, other.AllowInsecure)
+	setDefault(&p.ImgurClientID, other.ImgurClientID)
+	setDefault(&p.ImgurToken, other.ImgurToken)
+	setDefault(&p.DropboxFolder, other.DropboxFolder)
+	setDefault(&p.DropboxToken, other.DropboxToken)
+	setDefault(&p.DropboxRefreshToken, other.DropboxRefreshToken)
+	setDefault(&p.DropboxAppKey, other.DropboxAppKey)
+	setDefault(&p.DropboxAppSecret, other.DropboxAppSecret)
+	setDefault(&p.GDriveFolder, other.GDriveFolder)
+	setDefault(&p.GDriveCredentials, other.GDriveCredentials)
+	setDefault(&p.GDriveClientID, other.GDriveClientID)
+	setDefault(&p.GDriveClientSecret, other.GDriveClientSecret)
+	setDefault(&p.GDriveToken, other.GDriveToken)
+	setDefault(&p.LocalMode, other.LocalMode)
+	setDefault(&p.RsyncPath, other.RsyncPath)
+	setDefault(&p.B2Bucket, other.B2Bucket)
+	setDefault(&p.B2Prefix, other.B2Prefix)
+	setDefault(&p.B2KeyID, other.B2KeyID)
+	setDefault(&p.B2ApplicationKey, other.B2ApplicationKey)
+	setDefault(&p.OneDriveFolder, other.OneDriveFolder)
+	setDefault(&p.OneDriveClientID, other.OneDriveClientID)
+	setDefault(&p.OneDriveTenant, other.OneDriveTenant)
+	setDefault(&p.OneDriveToken, other.OneDriveToken)
+	setDefault(&p.OneDriveLinkScope, other.OneDriveLinkScope)
+	setDefault(&p.TelegramToken, other.TelegramToken)
+	setDefault(&p.TelegramChatID, other.TelegramChatID)
+	setDefault(&p.TelegramCaption, other.TelegramCaption)
+	setDefault(&p.IPFSAPI, other.IPFSAPI)
+	setDefault(&p.IPFSToken, other.IPFSToken)
+	p.IPFSPin = p.IPFSPin || other.IPFSPin
+	setDefault(&p.IPFSGateway, other.IPFSGateway)
+	setDefault(&p.IPFSPinService, other.IPFSPinService)
+	setDefault(&p.IPFSPinToken, other.IPFSPinToken)
+	setDefault(&p.TLSCAFile, other.TLSCAFile)
+	p.InsecureTLS = p.InsecureTLS || other.InsecureTLS
+	setDefault(&p.Transport, other.Transport)
+	setDefault(&p.Jump, other.Jump)
+	setDefault(&p.JumpKey, other.JumpKey)
+	setDefault(&p.JumpPassword, other.JumpPassword)
+}
+
+// fileConfig mirrors the layout of the config file. Keys are named after
+// what the matching command line flag does, e.g.
+//
+//	path        = "/Users/me/Documents/screenshots"
+//	remote_host = "example.com:22"
+//	remote_user = "i"
+//	key         = "/Users/me/.ssh/id_rsa"
+//	remote_path = "/home/i/i"
+//	base_url    = "https://i.example.com/"
+//
+// Destination settings may also be grouped into named profiles, selected
+// with -profile or default_profile:
+//
+//	default_profile = "personal"
+//
+//	[profiles.personal]
+//	remote_host = "vps.example.com"
+//	base_url    = "https://i.example.com/"
+//
+//	[profiles.work]
+//	remote_host = "screens.corp.example:2222"
+//	base_url    = "https://screens.corp.example/"
+//
+// Top level destination keys, including [[routes]], act as defaults for
+// every profile.
+// Unknown keys are ignored so config files can be shared between versions.
+type fileConfig struct {
+	Path string `toml:"path"`
+	// profile holds the top level destination keys, those of a profile
+	// that act as the defaults of every profile
+	profile
+
+	DefaultProfile string             `toml:"default_profile"`
+	Profiles       map[string]profile `toml:"profiles"`
+	NetworkRules   []networkRule      `toml:"network_rules"`
+
+	// Extensions replaces the default list of extensions that get
+	// uploaded, ExtraExtensions adds to it. DenyExtensions always wins.
+	Extensions      []string `toml:"extensions"`
+	ExtraExtensions []string `toml:"extra_extensions"`
+	DenyExtensions  []string `toml:"deny_extensions"`
+
+	// Ignore replaces the default file name patterns of files that are
+	// left alone, ExtraIgnore adds to them. ignore = [] ignores nothing.
+	Ignore      []string `toml:"ignore"`
+	ExtraIgnore []string `toml:"extra_ignore"`
+	// Include limits uploads to matching file names, see -include
+	Include []string `toml:"include"`
+
+	// Verify is "size" or "sha256", see -verify
+	Verify string `toml:"verify"`
+	// DetectType is how the type of files is told, see -detect-type
+	DetectType string `toml:"detect_type"`
+	// Compress gzips files on the way to the server, see -compress, but
+	// for those with an extension in CompressSkip
+	Compress     string   `toml:"compress"`
+	CompressSkip []string `toml:"compress_skip"`
+	// LimitRate caps the upload bandwidth, see -limit-rate
+	LimitRate string `toml:"limit_rate"`
+	// MaxSize is the size of the largest file uploaded, see -max-size, and
+	// MoveTooLarge moves larger ones aside, see -move-too-large
+	MaxSize      string `toml:"max_size"`
+	MoveTooLarge bool   `toml:"move_too_large"`
+
+	// Failed uploads are tried RetryAttempts times in total, waiting
+	// RetryBaseDelay at first and doubling that up to RetryMaxDelay
+	RetryAttempts  int      `toml:"retry_attempts"`
+	RetryBaseDelay duration `toml:"retry_base_delay"`
+	RetryMaxDelay  duration `toml:"retry_max_delay"`
+
+	// Uploads of ProgressThreshold bytes and more log their progress every
+	// ProgressInterval, see progressOptions
+	ProgressThreshold     byteSize `toml:"progress_threshold"`
+	ProgressInterval      duration `toml:"progress_interval"`
+	ProgressNotifications bool     `toml:"progress_notifications"`
+
+	// Paths are watched on top of Path, see -p
+	Paths []string `toml:"paths"`
+	// Recursive watches the directories below them too, see -recursive
+	Recursive bool `toml:"recursive"`
+	// Poll lists the paths every PollInterval instead of waiting for
+	// events, see -poll
+	Poll         bool     `toml:"poll"`
+	PollInterval duration `toml:"poll_interval"`
+	// MissingPath is fail, wait or create, see missingPathFail, and
+	// MissingPathAlert how long a path may be gone before the user's told
+	MissingPath      string   `toml:"missing_path"`
+	MissingPathAlert duration `toml:"missing_path_alert"`
+	// Debounce is how long files have to be quiet, see -debounce
+	Debounce duration `toml:"debounce"`
+	// Files are uploaded once they didn't change for StablePeriod, for at
+	// most StableMaxWait at a time
+	StablePeriod  duration `toml:"stable_period"`
+	StableMaxWait duration `toml:"stable_max_wait"`
+	// Files smaller than MinSize wait until they grow, they're reported
+	// when they didn't after TinyTimeout. It's a pointer so min_size = 0,
+	// no minimum, isn't taken for unset.
+	MinSize     *byteSize `toml:"min_size"`
+	TinyTimeout duration  `toml:"tiny_timeout"`
+	// ScanOnStart uploads what's in the paths at startup if it isn't older
+	// than ScanMaxAge, see -scan-on-start
+	ScanOnStart bool     `toml:"scan_on_start"`
+	ScanMaxAge  duration `toml:"scan_max_age"`
+	// MaxAge is how old files may be when their events come, see -max-age
+	MaxAge duration `toml:"max_age"`
+	// WhilePaused is queue or ignore, see pausedQueue, and
+	// PauseNotifications shows one when uploads are paused and resumed
+	WhilePaused        string `toml:"while_paused"`
+	PauseNotifications bool   `toml:"pause_notifications"`
+	// Workers is how many files are uploaded at once, see -workers
+	Workers int `toml:"workers"`
+	// NoDedup uploads files again that were uploaded already, see -no-dedup
+	NoDedup bool `toml:"no_dedup"`
+	// BatchSeparator joins the URLs of files uploaded at once on the
+	// clipboard, a line break when unset
+	BatchSeparator string `toml:"batch_separator"`
+	// KeepLocal leaves uploaded files where they are, see -keep-local,
+	// ArchiveDir moves them there, see -archive-dir
+	KeepLocal  bool   `toml:"keep_local"`
+	ArchiveDir string `toml:"archive_dir"`
+	// DeleteAfter keeps uploaded files for a while, see -delete-after
+	DeleteAfter duration `toml:"delete_after"`
+	// Trash moves them to the trash, see -trash
+	Trash bool `toml:"trash"`
+	// AfterUpload picks one of those by extension instead
+	AfterUpload []afterUploadRule `toml:"after_upload"`
+	// Naming is how files are named on the server, see -naming, or
+	// NameTemplate what they're named after, see -name-template
+	Naming       string `toml:"naming"`
+	NameTemplate string `toml:"name_template"`
+	// CounterPrefix, "shot-" when unset, and CounterDigits make the names
+	// of naming counter, which needs AllowGuessableNames
+	CounterPrefix       string `toml:"counter_prefix"`
+	CounterDigits       int    `toml:"counter_digits"`
+	AllowGuessableNames bool   `toml:"allow_guessable_names"`
+	// HashLength is how much of the digest naming hash uses, 16 when unset
+	HashLength int `toml:"hash_length"`
+	// DateDirs puts files into folders by date, see -date-dirs
+	DateDirs string `toml:"date_dirs"`
+	// BundleOver is how many files coming in within BundleWindow are
+	// uploaded one by one at most, more go in a zip, see -bundle-over
+	BundleOver   int      `toml:"bundle_over"`
+	BundleWindow duration `toml:"bundle_window"`
+	// MaxUploads is how many files are uploaded within MaxUploadsPer at
+	// most, see -max-uploads, OverMaxUploads is queue or pause
+	MaxUploads     int      `toml:"max_uploads"`
+	MaxUploadsPer  duration `toml:"max_uploads_per"`
+	OverMaxUploads string   `toml:"over_max_uploads"`
+	// QuarantineAfter is how many failed uploads move a file to failedDir,
+	// NoQuarantine leaves it where it is, see -no-quarantine
+	QuarantineAfter int  `toml:"quarantine_after"`
+	NoQuarantine    bool `toml:"no_quarantine"`
+	// NoNameCheck skips looking up random names, see -no-name-check
+	NoNameCheck bool `toml:"no_name_check"`
+	// Mkdirs creates missing remote directories, see -mkdirs. It's a
+	// pointer since it's on unless the file says mkdirs = false.
+	Mkdirs *bool `toml:"mkdirs"`
+
+	Debug bool `toml:"debug"`
+}
+
+// profileNamed returns the named profile with top level keys filled in. An empty
+// name selects default_profile, or just the top level keys if that's unset.
+func (fc fileConfig) profileNamed(name string) (profile, error) {
+	base := fc.profile
+	if name == "" {
+		name = fc.DefaultProfile
+	}
+	if name == "" {
+		return base, nil
+	}
+
+	p, ok := fc.Profiles[name]
+	if !ok {
+		return profile{}, fmt.Errorf("unknown profile %q, available: %s", name, strings.Join(fc.profileNames(), ", "))
+	}
+	// destinations are taken as they are, they'd name the profile itself
+	base.Destinations, base.DestinationPolicy = nil, ""
+	if len(p.Destinations) > 0 {
+		base.Backend = ""
+	}
+	p.merge(base)
+	return p, nil
+}
+
+// profileNames lists the profiles defined in the config file, sorted.
+func (fc fileConfig) profileNames() []string {
+	names := make([]string, 0, len(fc.Profiles))
+	for name := range fc.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// configCandidates lists the places skrins looks for its config file when
+// -config is not given, most specific first. goos is normally
+// runtime.GOOS, getenv os.Getenv and home the user's home directory.
+//
+//	linux & co: $XDG_CONFIG_HOME/skrins/config.toml (~/.config when unset)
+//	darwin:     ~/Library/Application Support/skrins/config.toml, then the XDG path
+//	windows:    %APPDATA%\skrins\config.toml
+//	everywhere: ~/.skrins.toml
+func configCandidates(goos string, getenv func(string) string, home string) []string {
+	var candidates []string
+
+	xdg := getenv("XDG_CONFIG_HOME")
+	if xdg == "" && home != "" {
+		xdg = filepath.Join(home, ".config")
+	}
+
+	switch goos {
+	case "windows":
+		if appData := getenv("APPDATA"); appData != "" {
+			candidates = append(candidates, filepath.Join(appData, "skrins", "config.toml"))
+		}
+	case "darwin":
+		if home != "" {
+			candidates = append(candidates, filepath.Join(home, "Library", "Application Support", "skrins", "config.toml"))
+		}
+		if xdg != "" {
+			candidates = append(candidates, filepath.Join(xdg, "skrins", "config.toml"))
+		}
+	default:
+		if xdg != "" {
+			candidates = append(candidates, filepath.Join(xdg, "skrins", "config.toml"))
+		}
+	}
+
+	if home != "" {
+		candidates = append(candidates, filepath.Join(home, ".skrins.toml"))
+	}
+	return candidates
+}
+
+// findConfigFile returns the first existing candidate. When none exists it
+// returns the most specific one, which is where a new file should go.
+func findConfigFile(candidates []string) string {
+	for _, c := range candidates {
+		if _, err := os.Stat(c); err == nil {
+			return c
+		}
+	}
+	if len(candidates) > 0 {
+		return candidates[0]
+	}
+	return ""
+}
+
+// defaultConfigCandidates is configCandidates for the running system.
+func defaultConfigCandidates() []string {
+	home, _ := os.UserHomeDir()
+	return configCandidates(runtime.GOOS, os.Getenv, home)
+}
+
+// loadConfigFile reads the config file at path. A missing file is only an
+// error when the path was given explicitly.
+func loadConfigFile(path string, explicit bool) (fileConfig, error) {
+	var fc fileConfig
+	if path == "" {
+		return fc, nil
+	}
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) && !explicit {
+			return fc, nil
+		}
+		return fc, err
+	}
+	if _, err := toml.DecodeFile(path, &fc); err != nil {
+		return fc, fmt.Errorf("config %s: %w", path, err)
+	}
+	return fc, nil
+}
+
+// envProfile reads destination settings from SKRINS_* environment variables.
+func envProfile(getenv func(string) string) profile {
+	return profile{
+		RemoteHost: getenv("SKRINS_REMOTE_HOST"),
+		RemoteUser: getenv("SKRINS_REMOTE_USER"),
+		Key:        getenv("SKRINS_KEY"),
+		Password:   envRef(getenv, "SKRINS_PASSWORD"),
+		RemotePath: getenv("SKRINS_REMOTE_PATH"),
+		BaseURL:    getenv("SKRINS_BASE_URL"),
+	}
+}
+
+// setDefault sets dst to value unless dst already holds something.
+func setDefault(dst *string, value string) {
+	if *dst == "" {
+		*dst = value
+	}
+}
+
+// envRef is a secret reference to the environment variable name, if it's set
+func envRef(getenv func(string) string, name string) string {
+	if getenv(name) == "" {
+		return ""
+	}
+	return "env:" + name
+}
+
+// setDefaultList sets dst to value unless dst already holds something.
+func setDefaultList(dst *[]string, value []string) {
+	if len(*dst) == 0 {
+		*dst = value
+	}
+}
+
+// setDefaultBool sets dst to value unless dst is set already, false
+// included, so a profile can turn off what the top level turns on.
+func setDefaultBool(dst **bool, value *bool) {
+	if *dst == nil {
+		*dst = value
+	}
+}
+
+// isTrue tells whether b is set and true.
+func isTrue(b *bool) bool {
+	return b != nil && *b
+}
+
+// setDefaultDuration sets dst to value unless dst already holds something.
+func setDefaultDuration(dst *duration, value duration) {
+	if dst.Duration == 0 {
+		*dst = value
+	}
+}
+
+// missingSettings lists the required settings that are still empty, as
+// "config_key (-flag)" pairs. The key is optional when the agent, a
+// password or a default key is used.
+func missingSettings(path string, p profile) []string {
+	key := p.Key
+	if p.usesAgent() || p.Password != "" || p.DefaultKey != "" {
+		key = "agent, password or default key"
+	}
+	type setting struct {
+		value, key, flag string
+	}
+	required := []setting{{path, "path", "p"}}
+	if p.usesSSH() {
+		required = append(required,
+			setting{p.RemoteHost, "remote_host", "r"},
+			setting{p.RemoteUser, "remote_user", "ru"},
+			setting{key, "key", "pk"},
+			setting{p.RemotePath, "remote_path", "rp"},
+		)
+	}
+	// base_url defaults to the bucket's URL
+	switch p.Backend {
+	case backendS3:
+		required = append(required, setting{p.S3Bucket, "s3_bucket", ""})
+	case backendGCS:
+		required = append(required, setting{p.GCSBucket, "gcs_bucket", ""})
+	case backendAzure:
+		required = append(required, setting{p.AzureContainer, "azure_container", ""})
+	case backendHTTP:
+		// the URL comes from the response
+		required = append(required, setting{p.HTTPURL, "http_url", ""})
+	case backendWebDAV:
+		required = append(required, setting{p.WebDAVURL, "webdav_url", ""})
+		if !p.NextcloudShare {
+			required = append(required, setting{p.BaseURL, "base_url", "url"})
+		}
+	case backendImgur:
+		// the URL comes from the response, a token works without client ID
+		required = append(required, setting{p.ImgurClientID + p.ImgurToken, "imgur_client_id", ""})
+	case backendDropbox:
+		// the URL is the shared link
+		required = append(required, setting{p.DropboxToken + p.DropboxRefreshToken, "dropbox_token", ""})
+	case backendGDrive:
+		// the URL is the file's download link, a service account needs no
+		// OAuth client
+		if p.GDriveCredentials == "" {
+			required = append(required,
+				setting{p.GDriveClientID, "gdrive_client_id", ""},
+				setting{p.GDriveClientSecret, "gdrive_client_secret", ""},
+				setting{p.GDriveToken, "gdrive_token", ""},
+			)
+		}
+	case backendB2:
+		// the URL defaults to the bucket's friendly URL
+		required = append(required,
+			setting{p.B2Bucket, "b2_bucket", ""},
+			setting{p.B2KeyID, "b2_key_id", ""},
+			setting{p.B2ApplicationKey, "b2_application_key", ""},
+		)
+	case backendOneDrive:
+		// the URL is the sharing link, the token comes from skrins auth
+		required = append(required,
+			setting{p.OneDriveClientID, "onedrive_client_id", ""},
+			setting{p.OneDriveToken, "onedrive_token", ""},
+		)
+	case backendTelegram:
+		// the URL is the message's link
+		required = append(required,
+			setting{p.TelegramToken, "telegram_token", ""},
+			setting{p.TelegramChatID, "telegram_chat_id", ""},
+		)
+	case backendIPFS:
+		// the URL is the gateway's, the node defaults to the local one
+	case backendRsync:
+		// the key is optional, ssh tries its own and the agent
+		required = append(required,
+			setting{p.RemoteHost, "remote_host", "r"},
+			setting{p.RemoteUser, "remote_user", "ru"},
+			setting{p.RemotePath, "remote_path", "rp"},
+			setting{p.BaseURL, "base_url", "url"},
+		)
+	case backendLocal:
+		required = append(required,
+			setting{p.RemotePath, "remote_path", "rp"},
+			setting{p.BaseURL, "base_url", "url"},
+		)
+	case backendFTP:
+		required = append(required,
+			setting{p.FTPHost, "ftp_host", ""},
+			setting{p.FTPUser, "ftp_user", ""},
+			setting{p.RemotePath, "remote_path", "rp"},
+			setting{p.BaseURL, "base_url", "url"},
+		)
+	default:
+		// the destinations have settings of their own, file hosts answer
+		// with the URL
+		if _, ok := httpPresets[p.Backend]; !ok && len(p.Destinations) == 0 {
+			required = append(required, setting{p.BaseURL, "base_url", "url"})
+		}
+	}
+
+	var missing []string
+	for _, r := range required {
+		if strings.TrimSpace(r.value) != "" {
+			continue
+		}
+		if r.flag == "" {
+			missing = append(missing, r.key)
+		} else {
+			missing = append(missing, fmt.Sprintf("%s (-%s)", r.key, r.flag))
+		}
+	}
+	return missing
+}
+
+// settingsProblems describes everything about the resolved settings that
+// would keep uploads from working. An empty result means skrins can start.
+func settingsProblems(path string, p profile) []string {
+	var problems []string
+	for _, m := range missingSettings(path, p) {
+		problems = append(problems, "missing required setting "+m)
+	}
+
+	problems = append(problems, screensPathProblems(path)...)
+	return append(problems, checkProfile(p)...)
+}
+
+// screensPathProblems checks that the screenshots path is a directory
+func screensPathProblems(path string) []string {
+	if path == "" {
+		return nil
+	}
+	if fi, err := os.Stat(path); err != nil {
+		return []string{fmt.Sprintf("screenshots path: %v", err)}
+	} else if !fi.IsDir() {
+		return []string{fmt.Sprintf("screenshots path %s is not a directory", path)}
+	}
+	return nil
+}
+
+// paths are the screenshot paths the config file sets, path first
+func (fc fileConfig) paths() []string {
+	var paths []string
+	if fc.Path != "" {
+		paths = append(paths, fc.Path)
+	}
+	return append(paths, fc.Paths...)
+}
+
+// checkProfile describes problems with p beyond missing settings.
+func checkProfile(p profile) []string {
+	var problems []string
+	problems = append(problems, routeProblems(p.Routes)...)
+	problems = append(problems, backendProblems(p)...)
+	problems = append(problems, destinationProblems(p)...)
+	if p.DialTimeout.Duration < 0 || p.TransferTimeout.Duration < 0 || p.StallTimeout.Duration < 0 || p.KeepaliveInterval.Duration < 0 {
+		problems = append(problems, "timeouts can't be negative")
+	}
+	if _, err := proxyURL(p, os.Getenv); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := tlsConfigFor(p); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if !p.usesSSH() {
+		return problems
+	}
+
+	problems = append(problems, algorithmProblems(p)...)
+
+	// unreadable keys are skipped as long as one is left
+	var keyProblems []string
+	for _, key := range p.keys() {
+		if err := checkReadable(key); err != nil {
+			keyProblems = append(keyProblems, fmt.Sprintf("private key: %v", err))
+		}
+	}
+	if len(keyProblems) == len(p.keys()) {
+		problems = append(problems, keyProblems...)
+	}
+
+	if p.KeepaliveMaxMissed < 0 {
+		problems = append(problems, "keepalive_max_missed can't be negative")
+	}
+	if p.SFTPMaxPacket < 0 || p.SFTPConcurrentRequests < 0 {
+		problems = append(problems, "sftp_max_packet and sftp_concurrent_requests can't be negative")
+	}
+	if p.Transport != "" && p.Transport != transportSFTP && p.Transport != transportSCP {
+		problems = append(problems, fmt.Sprintf("transport must be %s or %s, not %q", transportSFTP, transportSCP, p.Transport))
+	}
+	if _, err := p.jumpHops(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if p.JumpKey != "" {
+		if err := checkReadable(p.JumpKey); err != nil {
+			problems = append(problems, fmt.Sprintf("jump key: %v", err))
+		}
+	}
+
+	if !isTrue(p.InsecureHostKey) {
+		if err := checkReadable(p.KnownHosts); err != nil {
+			problems = append(problems, fmt.Sprintf("known hosts: %v, point -known-hosts at another file or pass -insecure-host-key", err))
+		}
+	}
+
+	return problems
+}
+
+// profileProblems is settingsProblems for a profile that isn't the active
+// one, prefixing every problem with the profile's name.
+func profileProblems(name string, p profile) []string {
+	var problems []string
+	for _, m := range missingSettings("-", p) {
+		problems = append(problems, fmt.Sprintf("profile %s: missing required setting %s", name, m))
+	}
+	for _, problem := range checkProfile(p) {
+		problems = append(problems, fmt.Sprintf("profile %s: %s", name, problem))
+	}
+	return problems
+}
+
+// finish resolves ssh config aliases, expands the key and known hosts paths,
+// normalizes the remote host and fills in defaults once all of p's sources
+// have been merged. A user from an ssh:// remote host is only taken when
+// keepUser is false.
+func (p profile) finish(keepUser bool, getenv func(string) string) (profile, []string) {
+	var problems []string
+	var err error
+	p.applySSHConfig()
+	keys := p.keys()
+	for i := range keys {
+		if keys[i], err = expandPath(keys[i], getenv); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	p.Key = strings.Join(keys, ",")
+	if p.Key == "" {
+		p.DefaultKey = findDefaultKey(getenv)
+	}
+	if p.KeyPassphraseFile, err = expandPath(p.KeyPassphraseFile, getenv); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if p.JumpKey, err = expandPath(p.JumpKey, getenv); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if p.TLSCAFile, err = expandPath(p.TLSCAFile, getenv); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if p.KnownHosts == "" {
+		p.KnownHosts = "~/.ssh/known_hosts"
+	}
+	if p.KnownHosts, err = expandPath(p.KnownHosts, getenv); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := p.normalizeHost(keepUser); err != nil {
+		problems = append(problems, err.Error())
+	}
+	setDefaultDuration(&p.DialTimeout, duration{defaultDialTimeout})
+	setDefaultDuration(&p.TransferTimeout, duration{defaultTransferTimeout})
+	setDefaultDuration(&p.StallTimeout, duration{defaultStallTimeout})
+	setDefaultDuration(&p.KeepaliveInterval, duration{defaultKeepaliveInterval})
+	if p.KeepaliveMaxMissed == 0 {
+		p.KeepaliveMaxMissed = defaultKeepaliveMaxMissed
+	}
+	if p.FileMode == 0 {
+		p.FileMode = defaultFileMode
+	}
+	if p.SpaceCheckThreshold == 0 {
+		p.SpaceCheckThreshold = defaultSpaceCheckThreshold
+	}
+	if p.SpaceMargin == 0 {
+		p.SpaceMargin = defaultSpaceMargin
+	}
+	if p.Backend == backendS3 && p.BaseURL == "" && p.S3Bucket != "" {
+		if u, err := s3BucketURL(p, getenv); err == nil {
+			p.BaseURL = u.String()
+		}
+	}
+	if p.Backend == backendHTTP {
+		setDefault(&p.HTTPField, "file")
+	}
+	p = p.withHTTPPreset()
+	if p.Backend == backendGCS && p.BaseURL == "" && p.GCSBucket != "" {
+		p.BaseURL = "https://storage.googleapis.com/" + p.GCSBucket
+	}
+	if p.Backend == backendAzure && p.BaseURL == "" && p.AzureContainer != "" {
+		if u, err := containerURL(p, getenv); err == nil {
+			p.BaseURL = u.String()
+		}
+	}
+	return p, problems
+}
+
+// withSlashes gives every remote path and URL of p the trailing slash the
+// rest of the code expects. It runs after checking, so empty values are
+// still reported as missing.
+func (p profile) withSlashes() profile {
+	p.RemotePath = strings.TrimRight(p.RemotePath, "/") + "/"
+	p.BaseURL = strings.TrimRight(p.BaseURL, "/") + "/"
+	routes := make([]route, len(p.Routes))
+	for i, r := range p.Routes {
+		if r.RemotePath != "" {
+			r.RemotePath = strings.TrimRight(r.RemotePath, "/") + "/"
+		}
+		if r.BaseURL != "" {
+			r.BaseURL = strings.TrimRight(r.BaseURL, "/") + "/"
+		}
+		routes[i] = r
+	}
+	p.Routes = routes
+	return p
+}
+
+// checkReadable makes sure path is a regular file the current user can read.
+func checkReadable(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	return nil
+}
+
+// keysFlag is a flag.Value for comma separated key paths, repeating the flag
+// adds more
+type keysFlag string
+
+func (k *keysFlag) String() string {
+	if k == nil {
+		return ""
+	}
+	return string(*k)
+}
+
+func (k *keysFlag) Set(value string) error {
+	if *k != "" {
+		*k += ","
+	}
+	*k += keysFlag(value)
+	return nil
+}
+
+// pathsFlag is a flag.Value collecting a path every time the flag is given.
+// Paths aren't split on commas, they may have some.
+type pathsFlag []string
+
+func (l *pathsFlag) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ", ")
+}
+
+func (l *pathsFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// listFlag is a flag.Value collecting comma separated values. The flag may
+// also be repeated.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// boolFlag is a flag.Value for the *bool settings of a profile, only set
+// when the flag is given
+type boolFlag struct {
+	b **bool
+}
+
+func (f boolFlag) String() string {
+	if f.b == nil {
+		return "false"
+	}
+	return strconv.FormatBool(isTrue(*f.b))
+}
+
+func (f boolFlag) Set(value string) error {
+	v, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	*f.b = &v
+	return nil
+}
+
+func (f boolFlag) IsBoolFlag() bool {
+	return true
+}
+
+// duration is a time.Duration written like "10s" or "5m" in the config file
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// fileMode is a permission mode written in octal like "0644" in the config
+// file
+type fileMode os.FileMode
+
+func (m *fileMode) UnmarshalText(text []byte) error {
+	mode, err := strconv.ParseUint(string(text), 8, 32)
+	if err != nil || mode > 0777 {
+		return fmt.Errorf("invalid mode %q, expected something like \"0644\"", text)
+	}
+	*m = fileMode(mode)
+	return nil
+}
+
+// byteSize is a number of bytes written like "500K" or "2M" in the config
+// file, see parseSize
+type byteSize int64
+
+func (b *byteSize) UnmarshalText(text []byte) error {
+	n, err := parseSize(string(text))
+	*b = byteSize(n)
+	return err
+}
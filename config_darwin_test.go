@@ -0,0 +1,22 @@
+//go:build darwin
+// +build darwin
+
+package main
+
+import "testing"
+
+func TestConfigCandidates(t *testing.T) {
+	checkCandidates(t, nil, "/Users/me", []string{
+		"/Users/me/Library/Application Support/skrins/config.toml",
+		"/Users/me/.config/skrins/config.toml",
+		"/Users/me/.skrins.toml",
+	})
+	checkCandidates(t, map[string]string{"XDG_CONFIG_HOME": "/xdg"}, "/Users/me", []string{
+		"/Users/me/Library/Application Support/skrins/config.toml",
+		"/xdg/skrins/config.toml",
+		"/Users/me/.skrins.toml",
+	})
+	checkCandidates(t, map[string]string{"XDG_CONFIG_HOME": "/xdg"}, "",
+		[]string{"/xdg/skrins/config.toml"})
+	checkCandidates(t, nil, "", nil)
+}
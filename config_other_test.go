@@ -0,0 +1,19 @@
+//go:build !darwin && !windows
+// +build !darwin,!windows
+
+package main
+
+import "testing"
+
+func TestConfigCandidates(t *testing.T) {
+	checkCandidates(t, map[string]string{"XDG_CONFIG_HOME": "/xdg"}, "/home/me",
+		[]string{"/xdg/skrins/config.toml", "/home/me/.skrins.toml"})
+	checkCandidates(t, nil, "/home/me",
+		[]string{"/home/me/.config/skrins/config.toml", "/home/me/.skrins.toml"})
+	// APPDATA is for Windows only
+	checkCandidates(t, map[string]string{"APPDATA": "/appdata"}, "/home/me",
+		[]string{"/home/me/.config/skrins/config.toml", "/home/me/.skrins.toml"})
+	checkCandidates(t, map[string]string{"XDG_CONFIG_HOME": "/xdg"}, "",
+		[]string{"/xdg/skrins/config.toml"})
+	checkCandidates(t, nil, "", nil)
+}
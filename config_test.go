@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fakeEnv is a getenv over a map
+func fakeEnv(env map[string]string) func(string) string {
+	return func(name string) string { return env[name] }
+}
+
+// checkCandidates compares the config candidates on this system with want
+func checkCandidates(t *testing.T, env map[string]string, home string, want []string) {
+	t.Helper()
+	if got := configCandidates(runtime.GOOS, fakeEnv(env), home); !reflect.DeepEqual(got, want) {
+		t.Errorf("configCandidates(%v, %q) = %q, want %q", env, home, got, want)
+	}
+}
+
+func TestFindConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skrins-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	specific := filepath.Join(dir, "xdg", "skrins", "config.toml")
+	fallback := filepath.Join(dir, ".skrins.toml")
+
+	if got := findConfigFile([]string{specific, fallback}); got != specific {
+		t.Errorf("with none there: %s, want the most specific %s", got, specific)
+	}
+	if err := ioutil.WriteFile(fallback, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got := findConfigFile([]string{specific, fallback}); got != fallback {
+		t.Errorf("with only the fallback there: %s, want %s", got, fallback)
+	}
+	if err := os.MkdirAll(filepath.Dir(specific), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(specific, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got := findConfigFile([]string{specific, fallback}); got != specific {
+		t.Errorf("with both there: %s, want %s", got, specific)
+	}
+	if got := findConfigFile(nil); got != "" {
+		t.Errorf("without candidates: %q", got)
+	}
+}
+
+func TestMissingSettings(t *testing.T) {
+	setEnv(t, "SSH_AUTH_SOCK", "")
+	if agentAvailable() {
+		t.Skip("the agent stands in for the key")
+	}
+	tests := []struct {
+		name string
+		path string
+		p    profile
+		want []string
+	}{
+		{"nothing", "", profile{}, []string{"path (-p)", "remote_host (-r)", "remote_user (-ru)", "key (-pk)", "remote_path (-rp)", "base_url (-url)"}},
+		{"sftp", "/shots", profile{RemoteHost: "example.com", RemoteUser: "me", Key: "/k", RemotePath: "/srv", BaseURL: "https://example.com"}, nil},
+		{"blank", "/shots", profile{RemoteHost: " ", RemoteUser: "me", Key: "/k", RemotePath: "/srv", BaseURL: "https://example.com"}, []string{"remote_host (-r)"}},
+		{"agent", "/shots", profile{RemoteHost: "example.com", RemoteUser: "me", UseAgent: boolPtr(true), RemotePath: "/srv", BaseURL: "https://example.com"}, nil},
+		{"default key", "/shots", profile{RemoteHost: "example.com", RemoteUser: "me", DefaultKey: "/home/me/.ssh/id_ed25519", RemotePath: "/srv", BaseURL: "https://example.com"}, nil},
+		{"s3", "/shots", profile{Backend: backendS3}, []string{"s3_bucket"}},
+		{"webdav", "/shots", profile{Backend: backendWebDAV, WebDAVURL: "https://dav.example.com"}, []string{"base_url (-url)"}},
+		{"nextcloud", "/shots", profile{Backend: backendWebDAV, WebDAVURL: "https://cloud.example.com", NextcloudShare: true}, nil},
+		{"local", "/shots", profile{Backend: backendLocal}, []string{"remote_path (-rp)", "base_url (-url)"}},
+		{"preset", "/shots", profile{Backend: "0x0"}, nil},
+	}
+	for _, tt := range tests {
+		if got := missingSettings(tt.path, tt.p); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSettingsProblems(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skrins-problems")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := filepath.Join(dir, "id_ed25519")
+	if err := ioutil.WriteFile(key, []byte("key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p := profile{RemoteHost: "example.com", RemoteUser: "me", Key: key, RemotePath: "/srv", BaseURL: "https://example.com", InsecureHostKey: boolPtr(true)}
+	if problems := settingsProblems(dir, p); len(problems) != 0 {
+		t.Errorf("with everything set: %q", problems)
+	}
+
+	// everything wrong is reported at once
+	p.Key, p.RemotePath = filepath.Join(dir, "id_rsa"), ""
+	problems := settingsProblems(key, p)
+	want := []string{
+		"missing required setting remote_path (-rp)",
+		"screenshots path " + key + " is not a directory",
+		"private key: open " + p.Key,
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("problems %q, want %d", problems, len(want))
+	}
+	for i, w := range want {
+		if !strings.HasPrefix(problems[i], w) {
+			t.Errorf("problem %d is %q, want %q", i, problems[i], w)
+		}
+	}
+
+	// a key that's a directory, and one that's readable while another isn't
+	p.RemotePath = "/srv"
+	p.Key = dir
+	if problems := settingsProblems(dir, p); len(problems) != 1 || problems[0] != "private key: "+dir+" is a directory" {
+		t.Errorf("a directory as the key: %q", problems)
+	}
+	p.Key = filepath.Join(dir, "id_rsa") + "," + key
+	if problems := settingsProblems(dir, p); len(problems) != 0 {
+		t.Errorf("with one of two keys there: %q", problems)
+	}
+	if problems := settingsProblems(filepath.Join(dir, "missing"), p); len(problems) != 1 || !strings.HasPrefix(problems[0], "screenshots path: ") {
+		t.Errorf("a missing screenshots path: %q", problems)
+	}
+}
+
+func TestCheckReadable(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("permissions don't keep this user from reading")
+	}
+	f, err := ioutil.TempFile("", "skrins-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	if err := checkReadable(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(f.Name(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkReadable(f.Name()); !os.IsPermission(err) {
+		t.Errorf("an unreadable file: %v", err)
+	}
+}
+
+// boolPtr is a *bool setting set to b
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func TestProfileEmpty(t *testing.T) {
+	if !(profile{}).empty() {
+		t.Error("the zero profile isn't empty")
+	}
+	for _, p := range []profile{{RemoteHost: "example.com"}, {BaseURL: "https://example.com"}, {UseAgent: boolPtr(true)}, {Destinations: []string{"a"}}} {
+		if p.empty() {
+			t.Errorf("%+v is empty", p)
+		}
+	}
+}
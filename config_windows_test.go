@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "testing"
+
+func TestConfigCandidates(t *testing.T) {
+	checkCandidates(t, map[string]string{"APPDATA": `C:\Users\me\AppData\Roaming`}, `C:\Users\me`,
+		[]string{`C:\Users\me\AppData\Roaming\skrins\config.toml`, `C:\Users\me\.skrins.toml`})
+	// XDG_CONFIG_HOME is for Linux and macOS, an MSYS shell may set it
+	checkCandidates(t, map[string]string{"APPDATA": `C:\Users\me\AppData\Roaming`, "XDG_CONFIG_HOME": `C:\xdg`}, `C:\Users\me`,
+		[]string{`C:\Users\me\AppData\Roaming\skrins\config.toml`, `C:\Users\me\.skrins.toml`})
+	checkCandidates(t, nil, `C:\Users\me`, []string{`C:\Users\me\.skrins.toml`})
+	checkCandidates(t, nil, "", nil)
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Timeouts used unless the config file sets dial_timeout, transfer_timeout
+// or stall_timeout
+const (
+	defaultDialTimeout     = 10 * time.Second
+	defaultTransferTimeout = 5 * time.Minute
+	defaultStallTimeout    = 30 * time.Second
+)
+
+// Keepalives used unless the config file sets keepalive_interval or
+// keepalive_max_missed. Home routers tend to forget idle connections after
+// a few minutes.
+const (
+	defaultKeepaliveInterval  = 30 * time.Second
+	defaultKeepaliveMaxMissed = 3
+)
+
+// timeoutError is returned when connecting to a server or uploading a file
+// took longer than allowed. Op is "dial", "handshake", "transfer", or
+// "stall" when an upload made no progress for too long.
+type timeoutError struct {
+	Op    string
+	Host  string
+	After time.Duration
+	Err   error
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("%s %s timed out after %s", e.Op, e.Host, e.After)
+}
+
+func (e *timeoutError) Unwrap() error { return e.Err }
+
+// Timeout makes timeoutError a net.Error that timed out
+func (e *timeoutError) Timeout() bool { return true }
+
+// sftpConn is an SFTP session together with the SSH connection under it.
+// Client is nil when files are uploaded with SCP instead.
+type sftpConn struct {
+	*sftp.Client
+	ssh *ssh.Client
+	// dead is closed once the SFTP session has shut down
+	dead chan struct{}
+	// progress counts the bytes uploaded over the connection, it's read
+	// and written atomically
+	progress int64
+}
+
+// newSFTPConn starts the SFTP session over sshClient, or sets up SCP when
+// p's transport is scp or the server has no SFTP subsystem so p doesn't
+// pick a transport
+func newSFTPConn(p profile, sshClient *ssh.Client) (*sftpConn, error) {
+	c := &sftpConn{ssh: sshClient, dead: make(chan struct{})}
+	if p.Transport != transportSCP {
+		client, err := sftp.NewClient(sshClient, sftpOptions(p)...)
+		var netErr net.Error
+		if err != nil && (p.Transport == transportSFTP || errors.As(err, &netErr) && netErr.Timeout()) {
+			sshClient.Close()
+			return nil, fmt.Errorf("starting sftp on %s: %w", p.RemoteHost, err)
+		}
+		if err != nil {
+			log.Printf("%s has no SFTP (%v), uploading with scp", p.RemoteHost, err)
+		}
+		c.Client = client
+	}
+	go func() {
+		if c.Client != nil {
+			c.Client.Wait()
+		} else {
+			sshClient.Wait()
+		}
+		close(c.dead)
+	}()
+	go c.keepalive(p)
+	return c, nil
+}
+
+// transport is what c uploads files with
+func (c *sftpConn) transport() string {
+	if c.Client == nil {
+		return transportSCP
+	}
+	return transportSFTP
+}
+
+// sftpOptions tunes the SFTP session as p asks for
+func sftpOptions(p profile) []sftp.ClientOption {
+	var opts []sftp.ClientOption
+	if p.SFTPMaxPacket > 0 {
+		// the checked variant refuses anything over 32768 bytes, which is
+		// the point of the setting
+		opts = append(opts, sftp.MaxPacketUnchecked(p.SFTPMaxPacket))
+	}
+	if p.SFTPConcurrentRequests > 0 {
+		opts = append(opts, sftp.MaxConcurrentRequestsPerFile(p.SFTPConcurrentRequests))
+	}
+	return opts
+}
+
+// keepalive pings the server until the connection is closed. When too many
+// pings in a row go unanswered the connection is closed, so the next upload
+// reconnects right away instead of failing on it first.
+func (c *sftpConn) keepalive(p profile) {
+	ticker := time.NewTicker(p.KeepaliveInterval.Duration)
+	defer ticker.Stop()
+
+	// a ping stuck on a dead connection is only answered when it's closed,
+	// hence the buffer
+	replies := make(chan error, 1)
+	pending, missed := false, 0
+	for {
+		select {
+		case <-c.dead:
+			return
+		case err := <-replies:
+			pending = false
+			if err != nil {
+				return
+			}
+			missed = 0
+		case <-ticker.C:
+			if pending {
+				missed++
+				debugf("keepalive to %s unanswered (%d/%d)", p.RemoteHost, missed, p.KeepaliveMaxMissed)
+				if missed >= p.KeepaliveMaxMissed {
+					log.Printf("connection to %s stopped answering keepalives, closing it", p.RemoteHost)
+					c.Close()
+					return
+				}
+				continue
+			}
+			pending = true
+			go func() {
+				_, _, err := c.ssh.SendRequest("keepalive@openssh.com", true, nil)
+				replies <- err
+			}()
+		}
+	}
+}
+
+// Close ends the SSH connection and with it the SFTP session. The network
+// connection goes first so a stalled server can't block closing. The SFTP
+// client then shuts its session down by itself, closing it as well races
+// with uploads still sending in the sftp package.
+func (c *sftpConn) Close() error {
+	err := c.ssh.Close()
+	<-c.dead
+	return err
+}
+
+// run calls fn with c, tearing the connection down when fn takes longer
+// than p's transfer timeout, or when it stops making progress for p's stall
+// timeout, e.g. because the laptop was suspended and the connection is
+// dead without the kernel knowing yet. The same happens when parent is
+// done.
+func (c *sftpConn) run(parent context.Context, p profile, fn func(*sftpConn) error) error {
+	ctx, cancel := context.WithTimeout(parent, p.TransferTimeout.Duration)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fn(c)
+	}()
+
+	stall := p.StallTimeout.Duration
+	check := time.NewTicker(stall / 4)
+	defer check.Stop()
+	last, lastChange := atomic.LoadInt64(&c.progress), time.Now()
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-ctx.Done():
+			c.Close()
+			<-done
+			if err := parent.Err(); err != nil {
+				return err
+			}
+			return &timeoutError{Op: "transfer", Host: p.RemoteHost, After: p.TransferTimeout.Duration, Err: ctx.Err()}
+		case now := <-check.C:
+			if progress := atomic.LoadInt64(&c.progress); progress != last {
+				last, lastChange = progress, now
+				continue
+			}
+			if now.Sub(lastChange) < stall {
+				continue
+			}
+			c.Close()
+			<-done
+			return &timeoutError{Op: "stall", Host: p.RemoteHost, After: stall}
+		}
+	}
+}
+
+// progressReader counts what's read through it in conn's progress
+type progressReader struct {
+	r    io.Reader
+	conn *sftpConn
+}
+
+func (pr progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	atomic.AddInt64(&pr.conn.progress, int64(n))
+	return n, err
+}
+
+// lost tells whether the connection has gone away. An operation failing
+// because of that may return before the session is marked dead, so this
+// waits up to wait for it.
+func (c *sftpConn) lost(wait time.Duration) bool {
+	select {
+	case <-c.dead:
+		return true
+	case <-time.After(wait):
+		return false
+	}
+}
+
+// reconnectDelays are waited before each reconnect after a connection was
+// lost in the middle of an operation
+var reconnectDelays = []time.Duration{0, 500 * time.Millisecond, 2 * time.Second}
+
+// connPool keeps one connection per server open between uploads
+type connPool struct {
+	mu    sync.Mutex
+	conns map[string]*sftpConn
+}
+
+// conns is shared by every upload for the life of the process, see get
+var conns = &connPool{conns: make(map[string]*sftpConn)}
+
+// connKey is what makes two profiles share a connection: everything but
+// where files go on the server
+func connKey(p profile) string {
+	p.RemotePath, p.BaseURL, p.Routes = "", "", nil
+	return fmt.Sprintf("%+v", p)
+}
+
+// get returns the open connection for p, connecting when there's none or
+// the old one went away. Every worker has connections of its own, one
+// timing out doesn't take the uploads of the others with it.
+func (cp *connPool) get(ctx context.Context, p profile) (*sftpConn, error) {
+	key := fmt.Sprintf("%d|%s", workerOf(ctx), connKey(p))
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	if c, ok := cp.conns[key]; ok {
+		if !c.lost(0) {
+			return c, nil
+		}
+		debugf("connection to %s was closed, reconnecting", p.RemoteHost)
+		c.Close()
+		delete(cp.conns, key)
+	}
+	c, err := newSFTPClient(p)
+	if err != nil {
+		return nil, err
+	}
+	cp.conns[key] = c
+	return c, nil
+}
+
+// drop closes c and forgets it if it's still the connection for p
+func (cp *connPool) drop(ctx context.Context, p profile, c *sftpConn) {
+	key := fmt.Sprintf("%d|%s", workerOf(ctx), connKey(p))
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if cp.conns[key] == c {
+		delete(cp.conns, key)
+	}
+	c.Close()
+}
+
+// withClient runs fn with a connection to p. When the connection is lost
+// while fn runs it reconnects and runs fn again, so fn has to be safe to
+// repeat. Failing to connect in the first place is returned right away, so
+// an unreachable server can fall back to another profile quickly, and so is
+// a transfer that timed out. A stalled one is resumed on a new connection.
+func (cp *connPool) withClient(ctx context.Context, p profile, fn func(*sftpConn) error) error {
+	var err error
+	for attempt, delay := range reconnectDelays {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		var c *sftpConn
+		c, err = cp.get(ctx, p)
+		if err != nil {
+			if attempt == 0 {
+				return err
+			}
+			log.Printf("reconnecting to %s failed: %v", p.RemoteHost, err)
+			continue
+		}
+		err = c.run(ctx, p, fn)
+		var timeout *timeoutError
+		if errors.As(err, &timeout) && timeout.Op == "stall" {
+			log.Printf("connection to %s stalled for %s, reconnecting", p.RemoteHost, timeout.After)
+			cp.drop(ctx, p, c)
+			continue
+		}
+		if errors.As(err, &timeout) {
+			cp.drop(ctx, p, c)
+			return err
+		}
+		if err == nil || !c.lost(200*time.Millisecond) {
+			return err
+		}
+		log.Printf("connection to %s lost: %v", p.RemoteHost, err)
+		cp.drop(ctx, p, c)
+	}
+	return err
+}
+
+// closeAll closes every open connection
+func (cp *connPool) closeAll() {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	for key, c := range cp.conns {
+		c.Close()
+		delete(cp.conns, key)
+	}
+}
+
+// withNewClient runs fn with a connection to p made just for it
+func withNewClient(ctx context.Context, p profile, fn func(*sftpConn) error) error {
+	c, err := newSFTPClient(p)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.run(ctx, p, fn)
+}
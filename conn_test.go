@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshServer is an SSH server on localhost serving SFTP with its handlers,
+// whose connections can be killed
+type sshServer struct {
+	addr  string
+	h     sftp.Handlers
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+// newSSHServer serves h to me with the password hunter2 until t is over
+func newSSHServer(t *testing.T, h sftp.Handlers) *sshServer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() != "me" || string(password) != "hunter2" {
+				return nil, errors.New("wrong password")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &sshServer{addr: l.Addr().String(), h: h}
+	t.Cleanup(func() {
+		l.Close()
+		s.kill()
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+			go s.serve(conn, config)
+		}
+	}()
+	return s
+}
+
+func (s *sshServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "no")
+			continue
+		}
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range reqs {
+				if req.Type != "subsystem" || string(req.Payload[4:]) != "sftp" {
+					req.Reply(false, nil)
+					continue
+				}
+				req.Reply(true, nil)
+				go func() {
+					server := sftp.NewRequestServer(ch, s.h)
+					server.Serve()
+					server.Close()
+				}()
+			}
+		}()
+	}
+}
+
+// kill breaks off every connection to s, like a network that went away
+func (s *sshServer) kill() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+// profile logs in to s, giving up on a transfer after stall
+func (s *sshServer) profile(t *testing.T, stall time.Duration) profile {
+	tempHome(t)
+	setEnv(t, "SSH_AUTH_SOCK", "")
+	p := testProfile(profile{
+		RemoteHost:      s.addr,
+		RemoteUser:      "me",
+		Password:        "hunter2",
+		RemotePath:      "/i",
+		InsecureHostKey: boolPtr(true),
+		StallTimeout:    duration{stall},
+	})
+	return p
+}
+
+// hangingWrites is a server that stops writing the first file it's sent
+// at offset at, until it's released. Writes to the files after that are
+// recorded.
+type hangingWrites struct {
+	sftp.FileWriter
+	at       int64
+	hanging  chan struct{}
+	released chan struct{}
+
+	mu      sync.Mutex
+	opened  int
+	offsets []int64
+}
+
+func newHangingWrites(t *testing.T, w sftp.FileWriter, at int64) *hangingWrites {
+	h := &hangingWrites{FileWriter: w, at: at, hanging: make(chan struct{}), released: make(chan struct{})}
+	t.Cleanup(func() { close(h.released) })
+	return h
+}
+
+func (h *hangingWrites) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	wa, err := h.FileWriter.Filewrite(r)
+	if err != nil {
+		return nil, err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.opened++
+	return hangingWriterAt{wa, h, h.opened == 1}, nil
+}
+
+// resumedAt is the offset the first write after the first file started at
+func (h *hangingWrites) resumedAt() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.offsets) == 0 {
+		return -1
+	}
+	min := h.offsets[0]
+	for _, off := range h.offsets {
+		if off < min {
+			min = off
+		}
+	}
+	return min
+}
+
+type hangingWriterAt struct {
+	io.WriterAt
+	h     *hangingWrites
+	first bool
+}
+
+func (w hangingWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if !w.first {
+		w.h.mu.Lock()
+		w.h.offsets = append(w.h.offsets, off)
+		w.h.mu.Unlock()
+		return w.WriterAt.WriteAt(p, off)
+	}
+	if off >= w.h.at {
+		select {
+		case <-w.h.hanging:
+		default:
+			close(w.h.hanging)
+		}
+		<-w.h.released
+		return 0, io.ErrClosedPipe
+	}
+	return w.WriterAt.WriteAt(p, off)
+}
+
+// checkResumed uploads a file over s with a connection pool, which goes
+// wrong as breakOff makes it once the server hangs, and checks it's
+// uploaded in full and resumed where the server stopped writing
+func checkResumed(t *testing.T, stall time.Duration, breakOff func(s *sshServer)) {
+	tempStateDir(t)
+	h := sftp.InMemHandler()
+	hang := newHangingWrites(t, h.FilePut, 1<<20)
+	h.FilePut = hang
+	s := newSSHServer(t, h)
+	p := s.profile(t, stall)
+	src, data := localFile(t, 8<<20)
+
+	pool := &connPool{conns: map[string]*sftpConn{}}
+	defer func() {
+		for _, c := range pool.conns {
+			c.Close()
+		}
+	}()
+	go func() {
+		<-hang.hanging
+		breakOff(s)
+	}()
+	err := pool.withClient(context.Background(), p, func(c *sftpConn) error {
+		if err := c.Mkdir("/i"); err != nil && !isExist(c, "/i") {
+			return err
+		}
+		return copyToRemote(c, p, src, "/i/rec.mp4", uploadOptions{})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := pool.get(context.Background(), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := c.Open("/i/rec.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	uploaded, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(uploaded, data) {
+		t.Errorf("uploaded %d bytes that aren't the %d of the file", len(uploaded), len(data))
+	}
+	if at := hang.resumedAt(); at != 1<<20 {
+		t.Errorf("resumed at %d, want %d where the server stopped", at, 1<<20)
+	}
+}
+
+// isExist tells whether c has dir already
+func isExist(c *sftpConn, dir string) bool {
+	_, err := c.Stat(dir)
+	return err == nil
+}
+
+func TestResumeAfterStall(t *testing.T) {
+	// the connection stays up, nothing gets through
+	checkResumed(t, 400*time.Millisecond, func(s *sshServer) {})
+}
+
+func TestResumeAfterConnectionLost(t *testing.T) {
+	checkResumed(t, time.Minute, func(s *sshServer) { s.kill() })
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// controlSocket is the socket in the state directory the running skrins
+// takes commands on, from `skrins pause`, `skrins resume` and `skrins
+// status`. It's a Unix socket on Windows too, which has no SIGUSR1.
+const controlSocket = "control.sock"
+
+// controlTimeout is how long a command and its answer may take
+const controlTimeout = 10 * time.Second
+
+// controlListener is the listening control socket, nil when there's none
+var controlListener net.Listener
+
+// listenControl opens the control socket. Failing to isn't fatal, only
+// the commands don't work then, e.g. when another skrins has it already.
+func listenControl() {
+	dir := stateDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Println("no control socket:", err)
+		return
+	}
+	path := filepath.Join(dir, controlSocket)
+	if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		c.Close()
+		log.Printf("another skrins listens on %s, skrins pause, resume and status go to that one", path)
+		return
+	}
+	// left behind by a skrins that didn't exit cleanly
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		log.Println("no control socket:", err)
+		return
+	}
+	debugf("taking commands on %s", path)
+	controlListener = l
+	go serveControl(l)
+}
+
+// closeControl closes the control socket, which removes it
+func closeControl() {
+	if controlListener != nil {
+		controlListener.Close()
+	}
+}
+
+// serveControl answers commands until l is closed
+func serveControl(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(controlTimeout))
+			line, err := bufio.NewReader(c).ReadString('\n')
+			if err != nil && line == "" {
+				return
+			}
+			fmt.Fprintln(c, controlCommand(strings.TrimSpace(line)))
+		}()
+	}
+}
+
+// controlCommand runs a command of the control socket and returns its
+// answer
+func controlCommand(command string) string {
+	s := currentSettings()
+	switch command {
+	case "pause":
+		return pause(s)
+	case "resume":
+		return resume(s)
+	case "status":
+		name := s.ProfileName
+		if name == "" {
+			name = "default"
+		}
+		waiting, active := uploads.depth()
+		status := fmt.Sprintf("%s\nqueue: %d waiting, %d uploading with %d workers", pauseStatus(), waiting, active, s.Workers)
+		for _, t := range currentTransfers() {
+			status += "\n  " + t.status()
+		}
+		if s.MaxUploads > 0 {
+			status += fmt.Sprintf("\nmax uploads: %d per %s, %d files waiting for room", s.MaxUploads, s.MaxUploadsPer, len(waitingForWindow()))
+		}
+		local := "deleted"
+		switch {
+		case s.KeepLocal:
+			local = "kept"
+		case s.DeleteAfter > 0:
+			local = "deleted after " + s.DeleteAfter.String()
+		}
+		if len(s.AfterUpload) > 0 {
+			local += fmt.Sprintf(", unless one of %d after_upload rules says otherwise", len(s.AfterUpload))
+		}
+		status = fmt.Sprintf("%s\nprofile: %s\npaths: %s\nwhile paused: %s\nuploaded files: %s", status, name, strings.Join(s.ScreensPaths, ", "), s.WhilePaused, local)
+		if kept := deletionsStatus(); kept != "" {
+			status += "\n" + kept
+		}
+		return status
+	}
+	return fmt.Sprintf("unknown command %q, it's pause, resume or status", command)
+}
+
+// runControl implements `skrins pause`, `skrins resume` and `skrins
+// status`: it sends command to the running skrins and prints the answer
+func runControl(command string, args []string) error {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	fs.Parse(args)
+
+	path := filepath.Join(stateDir(), controlSocket)
+	c, err := net.DialTimeout("unix", path, controlTimeout)
+	if err != nil {
+		return fmt.Errorf("can't reach skrins at %s, is it running? %v", path, err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(controlTimeout))
+	if _, err := fmt.Fprintln(c, command); err != nil {
+		return err
+	}
+	answer, err := ioutil.ReadAll(c)
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(answer))
+	return nil
+}
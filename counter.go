@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// counterFile holds the number of the last file named with naming counter,
+// in the state directory
+const counterFile = "counter.txt"
+
+// seqFile holds what {seq} of name_template stood for last, in the state
+// directory
+const seqFile = "seq.txt"
+
+// defaultCounterPrefix and defaultCounterDigits make names like
+// shot-0001.png
+const (
+	defaultCounterPrefix = "shot-"
+	defaultCounterDigits = 4
+)
+
+// claimCounter counts on and returns the new number. The counter file is
+// locked meanwhile, so several skrins at once never get the same one.
+func claimCounter() (int64, error) {
+	return claimNumber(counterFile)
+}
+
+// claimNumber counts on in the file name in the state directory like
+// claimCounter does
+func claimNumber(name string) (int64, error) {
+	dir := stateDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if err := lockFile(f); err != nil {
+		return 0, err
+	}
+	defer unlockFile(f)
+
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	if s := strings.TrimSpace(string(b)); s != "" {
+		if n, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return 0, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	n++
+	if _, err := f.WriteAt([]byte(strconv.FormatInt(n, 10)+"\n"), 0); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// counterName is the name of the file numbered n with the extension ext
+func (s *settings) counterName(n int64, ext string) string {
+	return fmt.Sprintf("%s%0*d.%s", s.CounterPrefix, s.CounterDigits, n, ext)
+}
+
+// freeCounterName is name, or the name of the next number that's free on
+// up when a file by that name is there already, like when the counter file
+// was lost. Every number tried is claimed, which brings the counter up to
+// what's on the server.
+func (s *settings) freeCounterName(ctx context.Context, up uploader, name string) string {
+	st, ok := up.(statter)
+	if !ok {
+		return name
+	}
+	dir, ext := path.Dir(name), fileExtension(name)
+	for tries := 0; tries < maxNameCounter; tries++ {
+		_, err := st.stat(ctx, name)
+		if errors.Is(err, os.ErrNotExist) {
+			return name
+		}
+		if err != nil {
+			debugf("can't tell whether %s is taken, uploading it as that: %v", name, err)
+			return name
+		}
+		n, err := claimCounter()
+		if err != nil {
+			debugf("can't count on from %s: %v", name, err)
+			return freeRemoteName(ctx, up, name)
+		}
+		debugf("%s is taken, trying number %d", name, n)
+		name = path.Join(dir, s.counterName(n, ext))
+	}
+	return freeRemoteName(ctx, up, name)
+}
+
+// counterProblems checks the settings of naming counter
+func (s *settings) counterProblems() []string {
+	if s.Naming != namingCounter {
+		return nil
+	}
+	var problems []string
+	if !s.AllowGuessableNames {
+		problems = append(problems, "naming counter makes URLs anyone can guess, shot-0001.png is followed by shot-0002.png, set allow_guessable_names = true if that's what you want")
+	}
+	if s.CounterDigits < 1 || s.CounterDigits > 18 {
+		problems = append(problems, fmt.Sprintf("counter_digits must be between 1 and 18, not %d", s.CounterDigits))
+	}
+	// what comes after it keeps a dash at its end
+	if safe := sanitizeName(s.CounterPrefix + "1"); safe != s.CounterPrefix+"1" {
+		problems = append(problems, fmt.Sprintf("counter_prefix %q would be %q on the server, use that", s.CounterPrefix, strings.TrimSuffix(safe, "1")))
+	}
+	return problems
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultDebounce is how long a path has to be quiet before its events are
+// handled, unless the config file sets debounce. Saving a screenshot
+// takes a Create and a few Writes within a handful of milliseconds.
+const defaultDebounce = 500 * time.Millisecond
+
+// debounceMaxWaits caps how many windows a path that keeps changing is
+// held back, a long recording is handed over while it's still growing
+const debounceMaxWaits = 10
+
+// debouncer collapses the events of a path that arrive within a window of
+// each other into one call of fire, made once the path has been quiet for
+// the window. While fire runs for a path, new events for it don't start a
+// second run next to it, the path is handed over again once it's done.
+type debouncer struct {
+	fire func(path string)
+
+	mu      sync.Mutex
+	pending map[string]*pendingEvent
+	running map[string]bool
+	again   map[string]bool
+}
+
+// pendingEvent is a path waiting for its window to pass
+type pendingEvent struct {
+	timer *time.Timer
+	first time.Time
+}
+
+func newDebouncer(fire func(path string)) *debouncer {
+	return &debouncer{
+		fire:    fire,
+		pending: map[string]*pendingEvent{},
+		running: map[string]bool{},
+		again:   map[string]bool{},
+	}
+}
+
+// add records an event for path, handing it to fire once no further event
+// arrived for window
+func (d *debouncer) add(path string, window time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if p, ok := d.pending[path]; ok {
+		if time.Since(p.first) < debounceMaxWaits*window && p.timer.Stop() {
+			p.timer.Reset(window)
+		}
+		return
+	}
+	d.pending[path] = &pendingEvent{
+		timer: time.AfterFunc(window, func() { d.settled(path) }),
+		first: time.Now(),
+	}
+}
+
+// drop forgets the events of path that are still waiting, e.g. because
+// it was renamed
+func (d *debouncer) drop(path string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if p, ok := d.pending[path]; ok && p.timer.Stop() {
+		delete(d.pending, path)
+	}
+}
+
+// settled runs fire for path, or has a running call run it again
+func (d *debouncer) settled(path string) {
+	d.mu.Lock()
+	delete(d.pending, path)
+	if d.running[path] {
+		d.again[path] = true
+		d.mu.Unlock()
+		return
+	}
+	d.running[path] = true
+	d.mu.Unlock()
+
+	for {
+		d.fire(path)
+		d.mu.Lock()
+		if !d.again[path] {
+			delete(d.running, path)
+			d.mu.Unlock()
+			return
+		}
+		delete(d.again, path)
+		d.mu.Unlock()
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// knownUploads are the URLs files were uploaded to by the SHA-256 of their
+// content, from the history, so an identical file is handed out the same
+// URL instead of being uploaded again. Files kept after uploading them are
+// known by path too, with the digest they had, so they're left alone until
+// they change.
+var knownUploads = struct {
+	sync.Mutex
+	byDigest map[string]historyEntry
+	kept     map[string]string
+}{byDigest: map[string]historyEntry{}, kept: map[string]string{}}
+
+// dedupMinValid is how long a URL that expires has to be good for still to
+// be handed out again
+const dedupMinValid = time.Hour
+
+// fileSHA256 is the hex SHA-256 of the file at path, read in chunks so
+// recordings don't have to fit into memory
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// digestKey is the context key of the SHA-256 of the file an upload is of
+type digestKey struct{}
+
+// withDigest is ctx carrying digest, the SHA-256 of the file uploaded with
+// it, taken for dedup and the history, so verifying the upload doesn't
+// read the file once more
+func withDigest(ctx context.Context, digest string) context.Context {
+	if digest == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, digestKey{}, digest)
+}
+
+// localSHA256 is the hex SHA-256 of the size bytes of f, the one ctx
+// carries when it has one
+func localSHA256(ctx context.Context, f io.ReaderAt, size int64) (string, error) {
+	if digest, ok := ctx.Value(digestKey{}).(string); ok {
+		return digest, nil
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, size)); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// rememberUpload makes the URL of e known by its digest if it was
+// uploaded, unless it expires at a time only the file host knows, and the
+// file known if it was kept
+func rememberUpload(e historyEntry) {
+	if e.SHA256 == "" || e.URL == "" || e.Status == historyFailed {
+		return
+	}
+	knownUploads.Lock()
+	defer knownUploads.Unlock()
+	if e.Kept {
+		knownUploads.kept[e.File] = e.SHA256
+	}
+	if e.Status != historyUploaded {
+		return
+	}
+	if preset, isPreset := httpPresets[e.Backend]; isPreset && preset.ExpiryField != "" && e.Expires == nil {
+		return
+	}
+	knownUploads.byDigest[e.SHA256] = e
+}
+
+// keptAlready tells whether the file at path was uploaded and kept with
+// the content that has digest
+func keptAlready(path, digest string) bool {
+	knownUploads.Lock()
+	defer knownUploads.Unlock()
+	return digest != "" && knownUploads.kept[path] == digest
+}
+
+// knownURL returns the URL a file with digest was uploaded to with the
+// profile named profile, if it's still good for a while
+func knownURL(digest, profile string) (string, bool) {
+	knownUploads.Lock()
+	defer knownUploads.Unlock()
+	e, ok := knownUploads.byDigest[digest]
+	if !ok || e.Profile != profile || e.Expires != nil && time.Until(*e.Expires) < dedupMinValid {
+		return "", false
+	}
+	return e.URL, true
+}
+
+// linkExpiry is when url, uploaded with p, stops working, nil when it
+// doesn't or when the file host picks how long it keeps the file
+func linkExpiry(p profile, url string, now time.Time) *time.Time {
+	if expires, presigned := presignExpiry(url); presigned {
+		return &expires
+	}
+	if p.HTTPExpiry.Duration > 0 {
+		expires := now.Add(p.HTTPExpiry.Duration)
+		return &expires
+	}
+	return nil
+}
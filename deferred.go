@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// deletionsFile holds the files kept for delete_after by path, in the
+// state directory
+const deletionsFile = "deletions.json"
+
+// pendingDeletion is an uploaded file kept until Due. Size and ModTime are
+// what it had then, a file that changed since is new content and stays.
+type pendingDeletion struct {
+	Due     time.Time `json:"due"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// deletions are the files kept for delete_after, mirrored in deletionsFile.
+// A single timer goes off for the one that's due first.
+var deletions = struct {
+	sync.Mutex
+	pending map[string]pendingDeletion
+	timer   *time.Timer
+}{pending: map[string]pendingDeletion{}}
+
+// deleteLater keeps the uploaded file at path until due, then it's
+// deleted, trashed or archived like dispose does right away
+func deleteLater(path string, due time.Time) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		debugf("%s is gone already: %v", path, err)
+		return
+	}
+	deletions.Lock()
+	defer deletions.Unlock()
+	deletions.pending[path] = pendingDeletion{Due: due, Size: fi.Size(), ModTime: fi.ModTime()}
+	saveDeletions()
+	armDeletions()
+	debugf("keeping %s until %s", path, due.Format("15:04:05"))
+}
+
+// loadDeletions reads the files kept at the last run at startup, those
+// due in the meantime go right away
+func loadDeletions() {
+	pending := map[string]pendingDeletion{}
+	if err := readState(deletionsFile, &pending); err != nil {
+		if !os.IsNotExist(err) {
+			debugf("ignoring %s: %v", deletionsFile, err)
+		}
+		return
+	}
+	deletions.Lock()
+	defer deletions.Unlock()
+	deletions.pending = pending
+	if len(pending) > 0 {
+		debugf("%d uploaded files kept for delete_after", len(pending))
+	}
+	armDeletions()
+}
+
+// pendingDeletionOf tells whether the file at path, as f has it, is kept
+// for delete_after, so it isn't uploaded again. A file that changed since
+// isn't anymore, it's uploaded as new content.
+func pendingDeletionOf(path string, f os.FileInfo) (pendingDeletion, bool) {
+	deletions.Lock()
+	defer deletions.Unlock()
+	d, ok := deletions.pending[path]
+	if !ok {
+		return d, false
+	}
+	if d.Size != f.Size() || !d.ModTime.Equal(f.ModTime()) {
+		debugf("%s changed since it was uploaded, no longer deleting it", path)
+		delete(deletions.pending, path)
+		saveDeletions()
+		return d, false
+	}
+	return d, true
+}
+
+// armDeletions sets the timer for the deletion due first. deletions must be
+// locked.
+func armDeletions() {
+	if deletions.timer != nil {
+		deletions.timer.Stop()
+		deletions.timer = nil
+	}
+	var first time.Time
+	for _, d := range deletions.pending {
+		if first.IsZero() || d.Due.Before(first) {
+			first = d.Due
+		}
+	}
+	if !first.IsZero() {
+		deletions.timer = time.AfterFunc(time.Until(first), runDeletions)
+	}
+}
+
+// runDeletions deletes, trashes or archives the files that are due as the
+// settings have it now, and records that in the history. Files that
+// changed or went away in the meantime are only forgotten.
+func runDeletions() {
+	s := currentSettings()
+	fx := effectsFor(s)
+	now := time.Now()
+	deletions.Lock()
+	var due []string
+	for path, d := range deletions.pending {
+		if !d.Due.After(now) {
+			due = append(due, path)
+		}
+	}
+	sort.Strings(due)
+	for _, path := range due {
+		d := deletions.pending[path]
+		delete(deletions.pending, path)
+		fi, err := os.Stat(path)
+		switch {
+		case err != nil:
+			debugf("%s is gone already: %v", path, err)
+			continue
+		case fi.Size() != d.Size || !fi.ModTime().Equal(d.ModTime):
+			log.Printf("not deleting %s, it changed since it was uploaded", path)
+			continue
+		}
+		e := historyEntry{Time: now, Status: historyDisposed, File: path, Profile: s.ProfileName, Size: d.Size}
+		if e.Profile == "" {
+			e.Profile = "default"
+		}
+		disposeNow(s, fx, path, &e)
+		fx.record(e)
+	}
+	saveDeletions()
+	armDeletions()
+	deletions.Unlock()
+}
+
+// saveDeletions writes deletions to deletionsFile. deletions must be
+// locked.
+func saveDeletions() {
+	if err := writeState(deletionsFile, deletions.pending); err != nil {
+		log.Printf("can't save the %d files kept for delete_after: %v", len(deletions.pending), err)
+	}
+}
+
+// deletionsStatus lists the files kept for delete_after, the one due first
+// first, for `skrins status`. It's "" when there are none.
+func deletionsStatus() string {
+	deletions.Lock()
+	defer deletions.Unlock()
+	if len(deletions.pending) == 0 {
+		return ""
+	}
+	paths := make([]string, 0, len(deletions.pending))
+	for path := range deletions.pending {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return deletions.pending[paths[i]].Due.Before(deletions.pending[paths[j]].Due)
+	})
+	status := fmt.Sprintf("kept for delete_after: %d files", len(paths))
+	for _, path := range paths {
+		status += fmt.Sprintf("\n  %s  %s", deletions.pending[path].Due.Local().Format("15:04:05"), path)
+	}
+	return status
+}
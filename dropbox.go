@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf16"
+)
+
+// Where the Dropbox API is, files go through the content host, see
+// https://www.dropbox.com/developers/documentation/http/documentation
+var (
+	dropboxAPI     = "https://api.dropboxapi.com/2"
+	dropboxContent = "https://content.dropboxapi.com/2"
+	dropboxOAuth   = "https://api.dropboxapi.com/oauth2/token"
+)
+
+// Files of dropboxSessionThreshold bytes and more are uploaded in an upload
+// session, dropboxChunk bytes per request. Single uploads are limited to
+// 150 MB.
+const (
+	dropboxSessionThreshold = 150 << 20
+	dropboxChunk            = 8 << 20
+)
+
+// dropboxBlock is the block size of Dropbox content hashes
+const dropboxBlock = 4 << 20
+
+// dropboxUploader uploads into dropbox_folder and returns a direct link to
+// the file's shared link
+type dropboxUploader struct {
+	p    profile
+	opts uploadOptions
+}
+
+// dropboxLabel describes a Dropbox secret in prompts and errors
+func dropboxLabel(what string) string {
+	return "Dropbox " + what
+}
+
+// dropboxProblems checks the settings of a dropbox profile
+func dropboxProblems(p profile) []string {
+	var problems []string
+	if p.DropboxRefreshToken != "" && p.DropboxAppKey == "" {
+		problems = append(problems, "dropbox_refresh_token needs dropbox_app_key")
+	}
+	if p.DropboxToken != "" && p.DropboxRefreshToken != "" {
+		problems = append(problems, "only one of dropbox_token and dropbox_refresh_token can be set")
+	}
+	return problems
+}
+
+// dropboxError is an error answer of the Dropbox API. Summary is its
+// error_summary like "path/conflict/file/..", Wait how long to hold off when
+// rate limited.
+type dropboxError struct {
+	Status  int
+	Summary string
+	Wait    time.Duration
+	// Detail is the error object, some errors carry what's needed to go on
+	Detail json.RawMessage
+}
+
+func (e *dropboxError) Error() string {
+	if e.Status == http.StatusUnauthorized && strings.HasPrefix(e.Summary, "expired_access_token") {
+		return "the Dropbox access token expired, set dropbox_refresh_token and dropbox_app_key so it's renewed"
+	}
+	return fmt.Sprintf("Dropbox answered %d %s: %s", e.Status, http.StatusText(e.Status), strings.TrimRight(e.Summary, "/."))
+}
+
+// temporary tells whether trying again may help, i.e. Dropbox is busy or
+// too many files are written at once
+func (e *dropboxError) temporary() bool {
+	return e.Status >= 500 || e.Status == http.StatusTooManyRequests ||
+		strings.Contains(e.Summary, "too_many_write_operations")
+}
+
+// retryAfter is how long to wait before trying again
+func (e *dropboxError) retryAfter() time.Duration {
+	return e.Wait
+}
+
+// dropboxMetadata describes a file on Dropbox
+type dropboxMetadata struct {
+	PathDisplay    string    `json:"path_display"`
+	Size           int64     `json:"size"`
+	ContentHash    string    `json:"content_hash"`
+	ServerModified time.Time `json:"server_modified"`
+}
+
+// dropboxPath is where the file called remoteName goes
+func (u dropboxUploader) dropboxPath(remoteName string) string {
+	return path.Join("/", u.p.DropboxFolder, remoteName)
+}
+
+func (u dropboxUploader) upload(ctx context.Context, localPath, remoteName string) (string, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	dest := u.dropboxPath(remoteName)
+
+	ctx, cancel := context.WithTimeout(ctx, u.p.TransferTimeout.Duration)
+	defer cancel()
+	t := startTransfer(localPath, fi.Size(), 0, u.opts.Progress)
+	defer t.finish()
+	// checking the upload and the shared link come after stalled() ends the
+	// context of the transfer
+	transferCtx, stalled := watchStall(ctx, t, u.p.StallTimeout.Duration)
+
+	var meta dropboxMetadata
+	if fi.Size() < dropboxSessionThreshold {
+		err = u.content(transferCtx, "/files/upload", u.commit(dest), u.part(f, 0, fi.Size(), t), &meta)
+	} else {
+		meta, err = u.uploadSession(transferCtx, f, fi.Size(), dest, t)
+	}
+	var apiErr *dropboxError
+	if errors.As(err, &apiErr) && strings.HasPrefix(apiErr.Summary, "path/conflict") {
+		// names are random, so this is an earlier attempt that made it
+		meta, err = u.sameFile(transferCtx, f, dest)
+	}
+	if stalled() {
+		return "", &timeoutError{Op: "stall", Host: "content.dropboxapi.com", After: u.p.StallTimeout.Duration}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", &timeoutError{Op: "transfer", Host: "content.dropboxapi.com", After: u.p.TransferTimeout.Duration, Err: err}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	err = nil
+	if meta.Size != fi.Size() {
+		err = &sizeMismatchError{Name: dest, Got: meta.Size, Local: fi.Size()}
+	} else if u.opts.Verify == verifySHA256 {
+		var sum string
+		if sum, err = dropboxContentHash(io.NewSectionReader(f, 0, fi.Size())); err == nil && sum != meta.ContentHash {
+			err = &checksumMismatchError{Name: dest, Got: meta.ContentHash, Local: sum}
+		}
+	}
+	if err != nil {
+		// a retry has to be able to use the name again
+		if delErr := u.rpc(ctx, "/files/delete_v2", map[string]string{"path": dest}, nil); delErr != nil {
+			log.Printf("can't delete %s: %v", dest, delErr)
+		}
+		return "", err
+	}
+	log.Println(t.summary())
+
+	link, err := u.sharedLink(ctx, dest)
+	if err != nil {
+		return "", err
+	}
+	return directLink(link), nil
+}
+
+// commit is how uploads are stored: never overwritten and never renamed,
+// so a name that's taken is an error rather than a "conflicted copy"
+func (u dropboxUploader) commit(dest string) map[string]interface{} {
+	return map[string]interface{}{"path": dest, "mode": "add", "autorename": false, "mute": true}
+}
+
+// uploadSession uploads f in chunks, for files too large for a single
+// request
+func (u dropboxUploader) uploadSession(ctx context.Context, f *os.File, size int64, dest string, t *transfer) (dropboxMetadata, error) {
+	var meta dropboxMetadata
+	var session struct {
+		ID string `json:"session_id"`
+	}
+	if err := u.content(ctx, "/files/upload_session/start", map[string]bool{"close": false}, u.part(f, 0, dropboxChunk, t), &session); err != nil {
+		return meta, err
+	}
+	offset := int64(dropboxChunk)
+	for size-offset > dropboxChunk {
+		cursor := map[string]interface{}{"session_id": session.ID, "offset": offset}
+		if err := u.content(ctx, "/files/upload_session/append_v2", map[string]interface{}{"cursor": cursor, "close": false}, u.part(f, offset, dropboxChunk, t), nil); err != nil {
+			return meta, err
+		}
+		offset += dropboxChunk
+	}
+	cursor := map[string]interface{}{"session_id": session.ID, "offset": offset}
+	err := u.content(ctx, "/files/upload_session/finish", map[string]interface{}{"cursor": cursor, "commit": u.commit(dest)}, u.part(f, offset, size-offset, t), &meta)
+	return meta, err
+}
+
+// part returns the n bytes of f from offset on for a request body, counted
+// in t from offset on every time it's asked for again
+func (u dropboxUploader) part(f *os.File, offset, n int64, t *transfer) func() (io.Reader, int64) {
+	return func() (io.Reader, int64) {
+		atomic.StoreInt64(&t.done, offset)
+		return progressTracker{limitedReader{io.NewSectionReader(f, offset, n), uploadLimiter}, t}, n
+	}
+}
+
+// sameFile looks at the file at dest that's in the way of an upload of f.
+// When it has f's content it's taken for f, otherwise that's an error.
+func (u dropboxUploader) sameFile(ctx context.Context, f *os.File, dest string) (dropboxMetadata, error) {
+	var meta dropboxMetadata
+	if err := u.rpc(ctx, "/files/get_metadata", map[string]string{"path": dest}, &meta); err != nil {
+		return meta, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return meta, err
+	}
+	sum, err := dropboxContentHash(io.NewSectionReader(f, 0, fi.Size()))
+	if err != nil {
+		return meta, err
+	}
+	if sum != meta.ContentHash {
+		return meta, fmt.Errorf("%s already exists on Dropbox with other content", dest)
+	}
+	debugf("%s is already on Dropbox", dest)
+	return meta, nil
+}
+
+// sharedLink creates a public link to dest, or returns the one it has
+func (u dropboxUploader) sharedLink(ctx context.Context, dest string) (string, error) {
+	var link struct {
+		URL string `json:"url"`
+	}
+	err := u.rpc(ctx, "/sharing/create_shared_link_with_settings", map[string]string{"path": dest}, &link)
+	var apiErr *dropboxError
+	if errors.As(err, &apiErr) && strings.HasPrefix(apiErr.Summary, "shared_link_already_exists") {
+		var links struct {
+			Links []struct {
+				URL string `json:"url"`
+			} `json:"links"`
+		}
+		if err = u.rpc(ctx, "/sharing/list_shared_links", map[string]interface{}{"path": dest, "direct_only": true}, &links); err != nil {
+			return "", err
+		}
+		if len(links.Links) == 0 {
+			return "", fmt.Errorf("Dropbox has a shared link to %s but doesn't list it", dest)
+		}
+		link.URL = links.Links[0].URL
+	} else if err != nil {
+		return "", err
+	}
+	return link.URL, nil
+}
+
+// directLink turns a shared link, which opens Dropbox's preview page, into
+// one for the file itself
+func directLink(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return link
+	}
+	if u.Host == "www.dropbox.com" || u.Host == "dropbox.com" {
+		u.Host = "dl.dropboxusercontent.com"
+	}
+	q := u.Query()
+	q.Del("dl")
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// dropboxContentHash computes the content hash Dropbox keeps of every file:
+// the SHA-256 of the SHA-256 hashes of its 4 MB blocks
+func dropboxContentHash(r io.Reader) (string, error) {
+	all := sha256.New()
+	block := make([]byte, dropboxBlock)
+	for {
+		n, err := io.ReadFull(r, block)
+		if n > 0 {
+			sum := sha256.Sum256(block[:n])
+			all.Write(sum[:])
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(all.Sum(nil)), nil
+}
+
+func (u dropboxUploader) remove(ctx context.Context, remoteName string) error {
+	return u.rpc(ctx, "/files/delete_v2", map[string]string{"path": u.dropboxPath(remoteName)}, nil)
+}
+
+func (u dropboxUploader) stat(ctx context.Context, remoteName string) (os.FileInfo, error) {
+	var meta dropboxMetadata
+	err := u.rpc(ctx, "/files/get_metadata", map[string]string{"path": u.dropboxPath(remoteName)}, &meta)
+	var apiErr *dropboxError
+	if errors.As(err, &apiErr) && strings.HasPrefix(apiErr.Summary, "path/not_found") {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return remoteFileInfo{name: remoteName, size: meta.Size, modTime: meta.ServerModified}, nil
+}
+
+// check makes sure the token works, renewing it when it's refreshed
+func (u dropboxUploader) check(ctx context.Context) error {
+	var account struct {
+		Email string `json:"email"`
+	}
+	if err := u.rpc(ctx, "/users/get_current_account", nil, &account); err != nil {
+		return fmt.Errorf("dropbox: %w", err)
+	}
+	debugf("uploading to the Dropbox of %s", account.Email)
+	return nil
+}
+
+// rpc calls an API endpoint with arg as JSON and decodes the answer into v,
+// unless it's nil
+func (u dropboxUploader) rpc(ctx context.Context, endpoint string, arg, v interface{}) error {
+	b, err := json.Marshal(arg)
+	if err != nil {
+		return err
+	}
+	header := http.Header{"Content-Type": {"application/json"}}
+	body := func() (io.Reader, int64) { return bytes.NewReader(b), int64(len(b)) }
+	return u.do(ctx, dropboxAPI+endpoint, header, body, v)
+}
+
+// content calls a content endpoint, with arg in the Dropbox-API-Arg header
+// and the file data as the body
+func (u dropboxUploader) content(ctx context.Context, endpoint string, arg interface{}, body func() (io.Reader, int64), v interface{}) error {
+	encoded, err := dropboxArg(arg)
+	if err != nil {
+		return err
+	}
+	header := http.Header{"Content-Type": {"application/octet-stream"}, "Dropbox-Api-Arg": {encoded}}
+	return u.do(ctx, dropboxContent+endpoint, header, body, v)
+}
+
+// do makes an authenticated request. When Dropbox says the access token
+// expired it's renewed and the request made again, with a fresh body.
+// Failures are a *dropboxError.
+func (u dropboxUploader) do(ctx context.Context, target string, header http.Header, body func() (io.Reader, int64), v interface{}) error {
+	for attempt := 0; ; attempt++ {
+		token, err := u.accessToken(ctx)
+		if err != nil {
+			return err
+		}
+		r, length := body()
+		req, err := http.NewRequest(http.MethodPost, target, r)
+		if err != nil {
+			return err
+		}
+		req = req.WithContext(ctx)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		req.ContentLength = length
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := httpClientFor(u.p).Do(req)
+		if err != nil {
+			return err
+		}
+		respBody, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && u.p.DropboxRefreshToken != "" && attempt == 0 {
+			debugf("Dropbox turned down the access token, renewing it")
+			forgetDropboxToken(u.p)
+			continue
+		}
+		if resp.StatusCode/100 != 2 {
+			e := &dropboxError{Status: resp.StatusCode, Wait: retryAfterHeader(resp.Header, time.Now())}
+			var answer struct {
+				Summary string          `json:"error_summary"`
+				Error   json.RawMessage `json:"error"`
+			}
+			if json.Unmarshal(respBody, &answer) == nil && answer.Summary != "" {
+				e.Summary, e.Detail = answer.Summary, answer.Error
+			} else {
+				e.Summary = shorten(strings.TrimSpace(string(respBody)), 200)
+			}
+			return e
+		}
+		if v == nil {
+			return nil
+		}
+		return json.Unmarshal(respBody, v)
+	}
+}
+
+// dropboxArg encodes arg as JSON for the Dropbox-API-Arg header, which has
+// to be ASCII
+func dropboxArg(arg interface{}) (string, error) {
+	b, err := json.Marshal(arg)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	for _, r := range string(b) {
+		if r < 0x80 {
+			sb.WriteRune(r)
+			continue
+		}
+		for _, c := range utf16.Encode([]rune{r}) {
+			fmt.Fprintf(&sb, `\u%04x`, c)
+		}
+	}
+	return sb.String(), nil
+}
+
+// dropboxTokens caches access tokens by refresh token, they're good for
+// four hours
+var dropboxTokens = struct {
+	sync.Mutex
+	m map[string]oauthToken
+}{m: map[string]oauthToken{}}
+
+// accessToken returns the token to authenticate with: dropbox_token, or
+// one the refresh token was traded for, cached unless it's about to expire
+func (u dropboxUploader) accessToken(ctx context.Context) (string, error) {
+	if u.p.DropboxRefreshToken == "" {
+		return cachedSecret(u.p.DropboxToken, dropboxLabel("token"))
+	}
+	refresh, err := cachedSecret(u.p.DropboxRefreshToken, dropboxLabel("refresh token"))
+	if err != nil {
+		return "", err
+	}
+	dropboxTokens.Lock()
+	t, ok := dropboxTokens.m[refresh]
+	dropboxTokens.Unlock()
+	if ok && time.Until(t.expires) > 5*time.Minute {
+		return t.value, nil
+	}
+
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refresh},
+		"client_id":     {u.p.DropboxAppKey},
+	}
+	if u.p.DropboxAppSecret != "" {
+		secret, err := cachedSecret(u.p.DropboxAppSecret, dropboxLabel("app secret"))
+		if err != nil {
+			return "", err
+		}
+		form.Set("client_secret", secret)
+	}
+	req, err := http.NewRequest(http.MethodPost, dropboxOAuth, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := httpClientFor(u.p).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	json.Unmarshal(body, &token)
+	if resp.StatusCode != http.StatusOK || token.AccessToken == "" {
+		msg := token.Description
+		if msg == "" {
+			msg = token.Error
+		}
+		if msg == "" {
+			msg = shorten(strings.TrimSpace(string(body)), 200)
+		}
+		return "", &dropboxError{Status: resp.StatusCode, Summary: "renewing the access token: " + msg}
+	}
+
+	t = oauthToken{value: token.AccessToken, expires: time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)}
+	dropboxTokens.Lock()
+	dropboxTokens.m[refresh] = t
+	dropboxTokens.Unlock()
+	return t.value, nil
+}
+
+// forgetDropboxToken drops the cached access token of p, so the next
+// request gets a new one
+func forgetDropboxToken(p profile) {
+	refresh, err := cachedSecret(p.DropboxRefreshToken, dropboxLabel("refresh token"))
+	if err != nil {
+		return
+	}
+	dropboxTokens.Lock()
+	delete(dropboxTokens.m, refresh)
+	dropboxTokens.Unlock()
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// dropboxCall is a request the Dropbox server got. Arg is the JSON argument
+// from the body or the Dropbox-API-Arg header, Size how many bytes of file
+// data came along.
+type dropboxCall struct {
+	Endpoint string
+	Token    string
+	Arg      map[string]interface{}
+	Size     int64
+}
+
+// dropboxServer is the Dropbox API and content host in one. Upload bodies
+// are counted rather than kept, files of sessions are over 150 MB.
+type dropboxServer struct {
+	mu    sync.Mutex
+	calls []dropboxCall
+	// respond answers the calls, the default answer is an empty object
+	respond func(w http.ResponseWriter, c dropboxCall)
+}
+
+// newDropboxServer starts a Dropbox server and points the API to it
+func newDropboxServer(t *testing.T, respond func(w http.ResponseWriter, c dropboxCall)) *dropboxServer {
+	d := &dropboxServer{respond: respond}
+	srv := httptest.NewServer(http.HandlerFunc(d.serve))
+	t.Cleanup(srv.Close)
+	oldAPI, oldContent, oldOAuth := dropboxAPI, dropboxContent, dropboxOAuth
+	dropboxAPI, dropboxContent, dropboxOAuth = srv.URL+"/2", srv.URL+"/content/2", srv.URL+"/oauth2/token"
+	dropboxTokens.Lock()
+	oldTokens := dropboxTokens.m
+	dropboxTokens.m = map[string]oauthToken{}
+	dropboxTokens.Unlock()
+	t.Cleanup(func() {
+		dropboxAPI, dropboxContent, dropboxOAuth = oldAPI, oldContent, oldOAuth
+		dropboxTokens.Lock()
+		dropboxTokens.m = oldTokens
+		dropboxTokens.Unlock()
+	})
+	setEnv(t, "SKRINS_TEST_DROPBOX_TOKEN", "t0k3n")
+	setEnv(t, "SKRINS_TEST_DROPBOX_REFRESH", "r3fr3sh")
+	return d
+}
+
+func (d *dropboxServer) serve(w http.ResponseWriter, r *http.Request) {
+	c := dropboxCall{Endpoint: strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/content"), "/2"), Token: strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")}
+	if arg := r.Header.Get("Dropbox-API-Arg"); arg != "" {
+		json.Unmarshal([]byte(arg), &c.Arg)
+		c.Size, _ = io.Copy(ioutil.Discard, r.Body)
+	} else {
+		body, _ := ioutil.ReadAll(r.Body)
+		if c.Endpoint == "/oauth2/token" {
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			r.ParseForm()
+			c.Arg = map[string]interface{}{}
+			for name := range r.PostForm {
+				c.Arg[name] = r.PostForm.Get(name)
+			}
+		} else {
+			json.Unmarshal(body, &c.Arg)
+		}
+	}
+	d.mu.Lock()
+	d.calls = append(d.calls, c)
+	d.mu.Unlock()
+	d.respond(w, c)
+}
+
+// endpoints are the endpoints called, in order
+func (d *dropboxServer) endpoints() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var endpoints []string
+	for _, c := range d.calls {
+		endpoints = append(endpoints, c.Endpoint)
+	}
+	return endpoints
+}
+
+// call is the first call to endpoint
+func (d *dropboxServer) call(endpoint string) dropboxCall {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, c := range d.calls {
+		if c.Endpoint == endpoint {
+			return c
+		}
+	}
+	return dropboxCall{}
+}
+
+// dropboxAnswers answers an upload of size bytes to /Screenshots/Zr8tW.png
+// and shares it with a new link
+func dropboxAnswers(size int64) func(w http.ResponseWriter, c dropboxCall) {
+	return func(w http.ResponseWriter, c dropboxCall) {
+		switch c.Endpoint {
+		case "/files/upload", "/files/upload_session/finish":
+			fmt.Fprintf(w, `{"path_display":"/Screenshots/Zr8tW.png","size":%d}`, size)
+		case "/files/upload_session/start":
+			fmt.Fprint(w, `{"session_id":"s3ss10n"}`)
+		case "/sharing/create_shared_link_with_settings":
+			fmt.Fprint(w, `{"url":"https://www.dropbox.com/scl/fi/abc123/Zr8tW.png?rlkey=k3y&dl=0"}`)
+		default:
+			fmt.Fprint(w, `{}`)
+		}
+	}
+}
+
+// dropboxTestUploader uploads to the folder Screenshots with the access
+// token t0k3n
+func dropboxTestUploader() dropboxUploader {
+	return dropboxUploader{p: testProfile(profile{Backend: backendDropbox, DropboxToken: "env:SKRINS_TEST_DROPBOX_TOKEN", DropboxFolder: "Screenshots"})}
+}
+
+func TestDropboxUpload(t *testing.T) {
+	d := newDropboxServer(t, dropboxAnswers(3))
+	link, err := dropboxTestUploader().upload(context.Background(), uploadTestFile(t, "shot.png", []byte("png")), "Zr8tW.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link != "https://dl.dropboxusercontent.com/scl/fi/abc123/Zr8tW.png?rlkey=k3y" {
+		t.Errorf("link = %s, want the direct one", link)
+	}
+	if got := strings.Join(d.endpoints(), ", "); got != "/files/upload, /sharing/create_shared_link_with_settings" {
+		t.Errorf("called %s", got)
+	}
+	// never overwritten or renamed, the name is the one asked for
+	c := d.call("/files/upload")
+	if c.Token != "t0k3n" || c.Size != 3 || c.Arg["path"] != "/Screenshots/Zr8tW.png" || c.Arg["mode"] != "add" || c.Arg["autorename"] != false {
+		t.Errorf("uploaded %+v", c)
+	}
+}
+
+func TestDropboxUploadSession(t *testing.T) {
+	// sparse, the file takes no room
+	dir, err := ioutil.TempDir("", "skrins-dropbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "rec.mp4")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int64(dropboxSessionThreshold + 1)
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	d := newDropboxServer(t, dropboxAnswers(size))
+	if _, err := dropboxTestUploader().upload(context.Background(), path, "Zr8tW.mp4"); err != nil {
+		t.Fatal(err)
+	}
+	var sent, appends int64
+	d.mu.Lock()
+	for _, c := range d.calls {
+		sent += c.Size
+		switch c.Endpoint {
+		case "/files/upload":
+			t.Errorf("over 150 MB uploaded in one request")
+		case "/files/upload_session/append_v2":
+			cursor, _ := c.Arg["cursor"].(map[string]interface{})
+			if cursor["session_id"] != "s3ss10n" || cursor["offset"] != float64((appends+1)*dropboxChunk) || c.Size != dropboxChunk {
+				t.Errorf("append %d: %+v", appends, c)
+			}
+			appends++
+		case "/files/upload_session/finish":
+			cursor, _ := c.Arg["cursor"].(map[string]interface{})
+			commit, _ := c.Arg["commit"].(map[string]interface{})
+			if cursor["offset"] != float64((appends+1)*dropboxChunk) || commit["path"] != "/Screenshots/Zr8tW.mp4" || commit["mode"] != "add" {
+				t.Errorf("finished with %+v", c.Arg)
+			}
+		}
+	}
+	d.mu.Unlock()
+	if sent != size || appends != size/dropboxChunk-1 {
+		t.Errorf("sent %d of %d bytes with %d appends", sent, size, appends)
+	}
+}
+
+func TestDropboxSharedLinkExists(t *testing.T) {
+	answer := dropboxAnswers(3)
+	d := newDropboxServer(t, func(w http.ResponseWriter, c dropboxCall) {
+		switch c.Endpoint {
+		case "/sharing/create_shared_link_with_settings":
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, `{"error_summary":"shared_link_already_exists/metadata/..","error":{".tag":"shared_link_already_exists"}}`)
+		case "/sharing/list_shared_links":
+			fmt.Fprint(w, `{"links":[{"url":"https://www.dropbox.com/s/0ld/Zr8tW.png?dl=0"}]}`)
+		default:
+			answer(w, c)
+		}
+	})
+	link, err := dropboxTestUploader().upload(context.Background(), uploadTestFile(t, "shot.png", []byte("png")), "Zr8tW.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link != "https://dl.dropboxusercontent.com/s/0ld/Zr8tW.png" {
+		t.Errorf("link = %s, want the existing one made direct", link)
+	}
+	if c := d.call("/sharing/list_shared_links"); c.Arg["path"] != "/Screenshots/Zr8tW.png" || c.Arg["direct_only"] != true {
+		t.Errorf("listed links with %v", c.Arg)
+	}
+}
+
+func TestDirectLink(t *testing.T) {
+	tests := []struct{ link, want string }{
+		{"https://www.dropbox.com/s/abc123/shot.png?dl=0", "https://dl.dropboxusercontent.com/s/abc123/shot.png"},
+		{"https://www.dropbox.com/scl/fi/abc123/shot.png?rlkey=k3y&dl=0", "https://dl.dropboxusercontent.com/scl/fi/abc123/shot.png?rlkey=k3y"},
+		{"https://dropbox.com/s/abc123/shot.png?dl=1", "https://dl.dropboxusercontent.com/s/abc123/shot.png"},
+		// links on other hosts are left as they are but for dl
+		{"https://example.com/shot.png", "https://example.com/shot.png"},
+	}
+	for _, tt := range tests {
+		if got := directLink(tt.link); got != tt.want {
+			t.Errorf("%s: %s, want %s", tt.link, got, tt.want)
+		}
+	}
+}
+
+// an expired access token is renewed with the refresh token and the
+// request made again
+func TestDropboxTokenRefresh(t *testing.T) {
+	tokens := 0
+	d := newDropboxServer(t, func(w http.ResponseWriter, c dropboxCall) {
+		switch {
+		case c.Endpoint == "/oauth2/token":
+			tokens++
+			fmt.Fprintf(w, `{"access_token":"acc3ss-%d","token_type":"bearer","expires_in":14400}`, tokens)
+		case c.Token != "acc3ss-2":
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error_summary":"expired_access_token/","error":{".tag":"expired_access_token"}}`)
+		default:
+			fmt.Fprint(w, `{"email":"me@example.com"}`)
+		}
+	})
+	u := dropboxUploader{p: testProfile(profile{Backend: backendDropbox, DropboxRefreshToken: "env:SKRINS_TEST_DROPBOX_REFRESH", DropboxAppKey: "4pp"})}
+	if err := u.check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(d.endpoints(), ", "); tokens != 2 || got != "/oauth2/token, /users/get_current_account, /oauth2/token, /users/get_current_account" {
+		t.Errorf("called %s", got)
+	}
+	if c := d.call("/oauth2/token"); c.Arg["grant_type"] != "refresh_token" || c.Arg["refresh_token"] != "r3fr3sh" || c.Arg["client_id"] != "4pp" {
+		t.Errorf("renewed with %v", c.Arg)
+	}
+
+	// a token that can't be renewed says how to fix that
+	err := dropboxTestUploader().check(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "set dropbox_refresh_token and dropbox_app_key") {
+		t.Errorf("an expired dropbox_token: %v", err)
+	}
+}
+
+// a file in the way is an earlier attempt when it has the same content,
+// and an error otherwise
+func TestDropboxPathConflict(t *testing.T) {
+	path := uploadTestFile(t, "shot.png", []byte("png"))
+	sum, err := dropboxContentHash(strings.NewReader("png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hash := range []string{sum, strings.Repeat("0", 64)} {
+		answer := dropboxAnswers(3)
+		newDropboxServer(t, func(w http.ResponseWriter, c dropboxCall) {
+			switch c.Endpoint {
+			case "/files/upload":
+				w.WriteHeader(http.StatusConflict)
+				fmt.Fprint(w, `{"error_summary":"path/conflict/file/..","error":{".tag":"path","reason":{".tag":"conflict"}}}`)
+			case "/files/get_metadata":
+				fmt.Fprintf(w, `{"path_display":"/Screenshots/Zr8tW.png","size":3,"content_hash":%q}`, hash)
+			default:
+				answer(w, c)
+			}
+		})
+		_, err := dropboxTestUploader().upload(context.Background(), path, "Zr8tW.png")
+		if hash == sum && err != nil {
+			t.Errorf("the same file in the way: %v", err)
+		}
+		if hash != sum && (err == nil || !strings.Contains(err.Error(), "/Screenshots/Zr8tW.png already exists on Dropbox with other content")) {
+			t.Errorf("another file in the way: %v", err)
+		}
+	}
+}
+
+// the Dropbox-API-Arg header is ASCII, other characters are escaped
+func TestDropboxArg(t *testing.T) {
+	got, err := dropboxArg(map[string]string{"path": "/Screenshots/Bildschirmfoto größe 🙂.png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"path":"/Screenshots/Bildschirmfoto gr\u00f6\u00dfe \ud83d\ude42.png"}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"time"
+)
+
+// effects is everything uploadFile does to the world outside the process.
+// The upload pipeline only goes through it so -dry-run is a single switch.
+type effects interface {
+	transcode(fileIn, fileOut string) bool
+	uploader(p profile) uploader
+	remove(path string) error
+	archive(path, dir string) (string, error)
+	trash(path string) error
+	deleteLater(path string, due time.Time)
+	copyToClipboard(s string)
+	notify(url string)
+	notifyDuplicate(url string)
+	notifyBundle(url string, n int)
+	notifyBatch(uploaded int, failed, urls []string)
+	notifyDegraded(url string, done, missing []string)
+	notifyFailure(name string, err error)
+	notifyTooLarge(name string, size, max int64)
+	setAside(path string) (string, error)
+	quarantine(path string, r quarantineReason) (string, error)
+	record(e historyEntry)
+}
+
+// effectsFor returns what uploadFile should use with settings s
+func effectsFor(s *settings) effects {
+	if s.DryRun {
+		return dryRun{}
+	}
+	return live{opts: uploadOptions{Persistent: !s.NoPersistentConn, Mkdirs: s.Mkdirs, Verify: s.Verify, Progress: s.Progress}}
+}
+
+// live performs every action for real
+type live struct {
+	opts uploadOptions
+}
+
+func (live) transcode(fileIn, fileOut string) bool { return ffmpegTranscode(fileIn, fileOut) }
+func (l live) uploader(p profile) uploader         { return newUploader(p, l.opts) }
+func (live) remove(path string) error              { return removeFile(path) }
+func (live) trash(path string) error               { return moveToTrash(path) }
+func (live) archive(path, dir string) (string, error) {
+	return archiveFile(path, dir, time.Now())
+}
+func (live) copyToClipboard(s string)       { copyToClipboard(s) }
+func (live) notify(url string)              { showNotification(url) }
+func (live) notifyDuplicate(url string)     { showDuplicateNotification(url) }
+func (live) notifyBundle(url string, n int) { showBundleNotification(url, n) }
+func (live) notifyBatch(uploaded int, failed, urls []string) {
+	showBatchNotification(uploaded, failed, urls)
+}
+func (live) notifyDegraded(url string, done, missing []string) {
+	showDegradedNotification(url, done, missing)
+}
+func (live) notifyFailure(name string, err error) {
+	showFailureNotification(name, err)
+}
+func (live) notifyTooLarge(name string, size, max int64) {
+	showTooLargeNotification(name, size, max)
+}
+func (live) setAside(path string) (string, error) { return setAside(path) }
+func (live) quarantine(path string, r quarantineReason) (string, error) {
+	return quarantine(path, r)
+}
+func (live) deleteLater(path string, due time.Time) { deleteLater(path, due) }
+func (live) record(e historyEntry)                  { appendHistory(e) }
+
+// dryRun only logs what would have happened. Transcoding is reported as
+// successful so the whole pipeline can be followed.
+type dryRun struct{}
+
+func (dryRun) transcode(fileIn, fileOut string) bool {
+	log.Printf("[dry-run] would transcode %s to %s", fileIn, fileOut)
+	return true
+}
+
+func (dryRun) uploader(p profile) uploader {
+	return dryRunUploader{p: p}
+}
+
+func (dryRun) remove(path string) error {
+	log.Printf("[dry-run] would delete %s", path)
+	return nil
+}
+
+func (dryRun) trash(path string) error {
+	log.Printf("[dry-run] would move %s to the trash", path)
+	return nil
+}
+
+func (dryRun) archive(path, dir string) (string, error) {
+	dir = filepath.Join(dir, time.Now().Format(archiveMonth))
+	log.Printf("[dry-run] would move %s to %s", path, dir)
+	return "", nil
+}
+
+func (dryRun) deleteLater(path string, due time.Time) {
+	log.Printf("[dry-run] would keep %s until %s", path, due.Format("15:04:05"))
+}
+
+func (dryRun) copyToClipboard(s string) {
+	log.Printf("[dry-run] would copy %s to the clipboard", s)
+}
+
+func (dryRun) notify(url string) {}
+
+func (dryRun) notifyDuplicate(url string) {}
+
+func (dryRun) notifyBundle(url string, n int) {}
+
+func (dryRun) notifyBatch(uploaded int, failed, urls []string) {}
+
+func (dryRun) notifyDegraded(url string, done, missing []string) {}
+
+func (dryRun) notifyFailure(name string, err error) {}
+
+func (dryRun) notifyTooLarge(name string, size, max int64) {}
+
+func (dryRun) setAside(path string) (string, error) {
+	log.Printf("[dry-run] would move %s to %s", path, filepath.Join(filepath.Dir(path), tooLargeDir))
+	return "", nil
+}
+
+func (dryRun) quarantine(path string, r quarantineReason) (string, error) {
+	log.Printf("[dry-run] would move %s to %s", path, filepath.Join(filepath.Dir(path), failedDir))
+	return "", nil
+}
+
+func (dryRun) record(e historyEntry) {}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+)
+
+// fakeEffects is dryRun uploading with up, for tests of the upload pipeline
+type fakeEffects struct {
+	dryRun
+	up uploader
+}
+
+func (f fakeEffects) uploader(p profile) uploader { return f.up }
+
+// fakeUploader fails with errs one after the other, then uploads to memory.
+// Names in existing are taken on the server already.
+type fakeUploader struct {
+	mu       sync.Mutex
+	errs     []error
+	calls    int
+	uploaded []string
+	existing map[string]bool
+}
+
+func (u *fakeUploader) upload(ctx context.Context, localPath, remoteName string) (string, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.calls++
+	if len(u.errs) > 0 {
+		err := u.errs[0]
+		u.errs = u.errs[1:]
+		return "", err
+	}
+	u.uploaded = append(u.uploaded, remoteName)
+	return "https://fake.example/" + remoteName, nil
+}
+
+func (u *fakeUploader) stat(ctx context.Context, remoteName string) (os.FileInfo, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.existing[remoteName] {
+		return fakeFileInfo{name: remoteName}, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+// fakeFileInfo is an os.FileInfo of size bytes
+type fakeFileInfo struct {
+	os.FileInfo
+	name string
+	size int64
+}
+
+func (fi fakeFileInfo) Name() string { return fi.name }
+func (fi fakeFileInfo) Size() int64  { return fi.size }
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// defaultIgnore are file names never uploaded unless the config file says
+// otherwise: hidden files, which includes the temporary files screenshot
+// tools rename when they're done and .DS_Store, unfinished downloads and
+// Windows' thumbnail caches
+var defaultIgnore = []string{".*", "*.part", "*.crdownload", "*.tmp", "Thumbs.db"}
+
+// foldCase tells whether file names match patterns regardless of case,
+// like the default filesystems of macOS and Windows treat them
+var foldCase = runtime.GOOS == "darwin" || runtime.GOOS == "windows"
+
+// matchName tells whether the base name of path matches one of patterns,
+// shell patterns as filepath.Match takes them
+func matchName(patterns []string, path string, fold bool) bool {
+	name := filepath.Base(path)
+	if fold {
+		name = strings.ToLower(name)
+	}
+	for _, p := range patterns {
+		if fold {
+			p = strings.ToLower(p)
+		}
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// patternProblems reports the patterns of the setting key that aren't valid
+func patternProblems(key string, patterns []string) []string {
+	var problems []string
+	for _, p := range patterns {
+		if _, err := filepath.Match(p, ""); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %q is not a valid pattern", key, p))
+		}
+	}
+	return problems
+}
+
+// ageOf is how long before now a file was modified at modified. A time
+// in the future, say of a file restored from a backup made in another time
+// zone, counts as now.
+func ageOf(modified, now time.Time) time.Duration {
+	if modified.After(now) {
+		return 0
+	}
+	return now.Sub(modified)
+}
+
+// tooOld tells whether a file at path modified at modified is older than
+// max_age now, like an old picture on the desktop an app just touched
+func (s *settings) tooOld(path string, modified, now time.Time) bool {
+	if s.MaxAge == 0 {
+		return false
+	}
+	if age := ageOf(modified, now); age > s.MaxAge {
+		debugf("ignoring %s, it was modified %s ago, longer than max_age", path, age.Round(time.Second))
+		return true
+	}
+	return false
+}
+
+// included tells whether the file at path matches the include patterns,
+// which every file does when there are none
+func (s *settings) included(path string) bool {
+	return len(s.Include) == 0 || matchName(s.Include, path, foldCase)
+}
+
+// ignored tells whether the file or directory at path is left alone
+// because it matches the ignore patterns or is in the archive directory
+func (s *settings) ignored(path string) bool {
+	if s.ArchiveDir != "" && isWithin(path, s.ArchiveDir) {
+		return true
+	}
+	if s.MoveTooLarge && inTooLargeDir(path) || inFailedDir(path) {
+		return true
+	}
+	return matchName(s.Ignore, path, foldCase)
+}
@@ -0,0 +1,24 @@
+//go:build darwin
+// +build darwin
+
+package main
+
+import "testing"
+
+func TestIgnoredCase(t *testing.T) {
+	if !foldCase {
+		t.Fatal("names are told apart by case, APFS doesn't by default")
+	}
+	s := &settings{Ignore: []string{"*.tmp", ".DS_Store"}}
+	tests := map[string]bool{
+		"/Users/me/Desktop/upload.tmp": true,
+		"/Users/me/Desktop/upload.TMP": true,
+		"/Users/me/Desktop/.ds_store":  true,
+		"/Users/me/Desktop/shot.png":   false,
+	}
+	for path, want := range tests {
+		if got := s.ignored(path); got != want {
+			t.Errorf("ignored(%s) = %t, want %t", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !darwin && !windows
+// +build !darwin,!windows
+
+package main
+
+import "testing"
+
+func TestIgnoredCase(t *testing.T) {
+	if foldCase {
+		t.Fatal("names are told apart by case on a case sensitive filesystem")
+	}
+	s := &settings{Ignore: []string{"*.tmp", "Thumbs.db"}}
+	tests := map[string]bool{
+		"/shots/upload.tmp": true,
+		"/shots/upload.TMP": false,
+		"/shots/Thumbs.db":  true,
+		"/shots/thumbs.db":  false,
+	}
+	for path, want := range tests {
+		if got := s.ignored(path); got != want {
+			t.Errorf("ignored(%s) = %t, want %t", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMatchName(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		path     string
+		fold     bool
+		want     bool
+	}{
+		{defaultIgnore, "/shots/.Screenshot 2024-06-01.png", false, true},
+		{defaultIgnore, "/shots/.DS_Store", false, true},
+		{defaultIgnore, "/shots/movie.mp4.part", false, true},
+		{defaultIgnore, "/shots/Thumbs.db", false, true},
+		{defaultIgnore, "/shots/shot.png", false, false},
+		// only the base name counts, not the directories above it
+		{defaultIgnore, "/home/me/.cache/shot.png", false, false},
+		{[]string{"*.png"}, "/shots/shot.png", false, true},
+		{[]string{"*.png"}, "/shots/shot.PNG", false, false},
+		{[]string{"*.png"}, "/shots/shot.PNG", true, true},
+		{[]string{"*.PNG"}, "/shots/shot.png", true, true},
+		{defaultIgnore, "/shots/THUMBS.DB", false, false},
+		{defaultIgnore, "/shots/THUMBS.DB", true, true},
+		{[]string{"Screenshot*", "*.mov"}, "/shots/clip.mov", false, true},
+		{[]string{"shot?.png"}, "/shots/shot1.png", false, true},
+		{[]string{"shot?.png"}, "/shots/shot10.png", false, false},
+		{[]string{"[a-c]*.png"}, "/shots/b.png", false, true},
+		{nil, "/shots/shot.png", false, false},
+		// an invalid pattern matches nothing
+		{[]string{"[.png"}, "/shots/[.png", false, false},
+	}
+	for _, tt := range tests {
+		if got := matchName(tt.patterns, tt.path, tt.fold); got != tt.want {
+			t.Errorf("matchName(%q, %s, %t) = %t, want %t", tt.patterns, tt.path, tt.fold, got, tt.want)
+		}
+	}
+}
+
+func TestPatternProblems(t *testing.T) {
+	if problems := patternProblems("ignore", defaultIgnore); len(problems) != 0 {
+		t.Errorf("the default patterns: %q", problems)
+	}
+	want := []string{`include: "[.png" is not a valid pattern`}
+	if problems := patternProblems("include", []string{"*.png", "[.png"}); !reflect.DeepEqual(problems, want) {
+		t.Errorf("problems %q, want %q", problems, want)
+	}
+}
+
+func TestIncluded(t *testing.T) {
+	s := &settings{}
+	if !s.included("/shots/notes.txt") {
+		t.Error("without include patterns a file isn't included")
+	}
+	s.Include = []string{"*.png", "*.jpg"}
+	if !s.included("/shots/shot.png") || s.included("/shots/notes.txt") {
+		t.Errorf("with %q: shot.png %t, notes.txt %t", s.Include, s.included("/shots/shot.png"), s.included("/shots/notes.txt"))
+	}
+}
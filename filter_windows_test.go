@@ -0,0 +1,24 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "testing"
+
+func TestIgnoredCase(t *testing.T) {
+	if !foldCase {
+		t.Fatal("names are told apart by case, NTFS doesn't")
+	}
+	s := &settings{Ignore: []string{"*.tmp", "Thumbs.db"}}
+	tests := map[string]bool{
+		`C:\Users\me\Pictures\upload.tmp`: true,
+		`C:\Users\me\Pictures\upload.TMP`: true,
+		`C:\Users\me\Pictures\THUMBS.DB`:  true,
+		`C:\Users\me\Pictures\shot.png`:   false,
+	}
+	for path, want := range tests {
+		if got := s.ignored(path); got != want {
+			t.Errorf("ignored(%s) = %t, want %t", path, got, want)
+		}
+	}
+}
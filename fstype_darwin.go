@@ -0,0 +1,36 @@
+//go:build darwin
+// +build darwin
+
+package main
+
+import (
+	"strings"
+	"syscall"
+)
+
+// eventlessFilesystems are the filesystems where kqueue only sees changes
+// made on this machine: network filesystems and FUSE mounts
+var eventlessFilesystems = []string{"nfs", "smbfs", "afpfs", "webdav", "osxfuse", "macfuse", "fusefs"}
+
+// eventlessFS tells whether the filesystem of path is known not to report
+// changes, and its name if so
+func eventlessFS(path string) (string, bool) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return "", false
+	}
+	var sb strings.Builder
+	for _, c := range st.Fstypename {
+		if c == 0 {
+			break
+		}
+		sb.WriteByte(byte(c))
+	}
+	name := sb.String()
+	for _, fs := range eventlessFilesystems {
+		if strings.HasPrefix(name, fs) {
+			return name, true
+		}
+	}
+	return "", false
+}
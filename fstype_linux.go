@@ -0,0 +1,32 @@
+//go:build linux
+// +build linux
+
+package main
+
+import "syscall"
+
+// eventlessFilesystems are the statfs magic numbers of filesystems where
+// inotify only sees changes made on this machine, if any: network
+// filesystems, FUSE mounts like sshfs and the shares of VMs and WSL
+var eventlessFilesystems = map[uint32]string{
+	0x6969:     "nfs",
+	0x517b:     "smb",
+	0xff534d42: "cifs",
+	0xfe534d42: "smb2",
+	0x65735546: "fuse",
+	0x01021997: "9p",
+	0x786f4256: "vboxsf",
+	0x5346414f: "afs",
+	0x73757245: "coda",
+}
+
+// eventlessFS tells whether the filesystem of path is known not to report
+// changes, and its name if so
+func eventlessFS(path string) (string, bool) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return "", false
+	}
+	name, ok := eventlessFilesystems[uint32(st.Type)]
+	return name, ok
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+// eventlessFS tells whether the filesystem of path is known not to report
+// changes. Elsewhere that's not known, -poll has to be asked for.
+func eventlessFS(path string) (string, bool) {
+	return "", false
+}
@@ -0,0 +1,734 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lithammer/shortuuid/v3"
+)
+
+// Ports used when ftp_host doesn't name one
+const (
+	defaultFTPPort  = "21"
+	defaultFTPSPort = "990"
+)
+
+// ftpUploader uploads to an FTP server, secured with TLS unless
+// allow_insecure says otherwise. Like over SFTP files are written under a
+// temporary name, checked and renamed in place.
+type ftpUploader struct {
+	p    profile
+	opts uploadOptions
+}
+
+// ftpError is a negative reply of an FTP server to the command Cmd
+type ftpError struct {
+	Cmd  string
+	Code int
+	Msg  string
+}
+
+func (e *ftpError) Error() string {
+	return fmt.Sprintf("FTP %s: %d %s", e.Cmd, e.Code, e.Msg)
+}
+
+// temporary tells whether trying again may help, which is what 4xx replies
+// mean
+func (e *ftpError) temporary() bool {
+	return e.Code >= 400 && e.Code < 500
+}
+
+// notImplemented tells whether err is a server saying it doesn't know a
+// command
+func notImplemented(err error) bool {
+	var ftpErr *ftpError
+	return errors.As(err, &ftpErr) && (ftpErr.Code == 500 || ftpErr.Code == 502 || ftpErr.Code == 504)
+}
+
+// ftpAddr is the host:port of p's FTP server
+func ftpAddr(p profile) (string, error) {
+	host, port, err := net.SplitHostPort(p.FTPHost)
+	if err != nil {
+		// no port, a bare IPv6 address also ends up here
+		host, port = strings.TrimSuffix(strings.TrimPrefix(p.FTPHost, "["), "]"), ""
+	}
+	if port == "" {
+		port = defaultFTPPort
+		if p.FTPImplicitTLS {
+			port = defaultFTPSPort
+		}
+	}
+	if host == "" || strings.ContainsAny(host, "/@") {
+		return "", fmt.Errorf("ftp_host: %q is not a host or host:port", p.FTPHost)
+	}
+	if n, err := net.LookupPort("tcp", port); err != nil || n <= 0 {
+		return "", fmt.Errorf("ftp_host: %q has an invalid port", p.FTPHost)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// ftpTLSMode describes how p's FTP connection is secured, for the log
+func (p profile) ftpTLSMode() string {
+	switch {
+	case p.FTPImplicitTLS:
+		return "implicit"
+	case isTrue(p.AllowInsecure):
+		return "off"
+	}
+	return "explicit"
+}
+
+// ftpLabel describes p's FTP password in prompts and errors
+func ftpLabel(p profile) string {
+	return fmt.Sprintf("FTP password for %s@%s", p.FTPUser, p.FTPHost)
+}
+
+// ftpProblems checks the settings of an ftp profile
+func ftpProblems(p profile) []string {
+	var problems []string
+	if _, err := ftpAddr(p); p.FTPHost != "" && err != nil {
+		problems = append(problems, err.Error())
+	}
+	if p.FTPImplicitTLS && isTrue(p.AllowInsecure) {
+		problems = append(problems, "only one of ftp_implicit_tls and allow_insecure can be set")
+	}
+	if p.FTPActive && p.Proxy != "" {
+		problems = append(problems, "ftp_active doesn't work through a proxy, the server can't connect back")
+	}
+	return problems
+}
+
+// ftpConn is a logged in FTP control connection
+type ftpConn struct {
+	// p is the profile with RemoteHost set to the server's host:port, so
+	// dialing and timeouts work like for SSH
+	p    profile
+	raw  net.Conn
+	text *textproto.Conn
+	// tls is what the connections are secured with, nil for plain FTP
+	tls *tls.Config
+	// home is the directory relative paths start from
+	home string
+	// noEPSV is set once the server turned down EPSV
+	noEPSV bool
+
+	mu sync.Mutex
+	// data is the open data connection, closed along with the control one
+	data net.Conn
+}
+
+// dialFTP connects and logs in to p's FTP server
+func dialFTP(p profile) (*ftpConn, error) {
+	addr, err := ftpAddr(p)
+	if err != nil {
+		return nil, err
+	}
+	hop := p
+	hop.RemoteHost = addr
+	raw, err := dialRemote(hop)
+	if err != nil {
+		return nil, withTimeout(err, "dial", hop)
+	}
+	// the deadline covers the greeting, TLS and logging in
+	raw.SetDeadline(time.Now().Add(p.DialTimeout.Duration))
+	c := &ftpConn{p: hop, raw: raw}
+	if err := c.login(); err != nil {
+		raw.Close()
+		return nil, withTimeout(err, "handshake", hop)
+	}
+	raw.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// login secures the connection as c's profile asks for and logs in
+func (c *ftpConn) login() error {
+	host := c.p.RemoteHost
+	if !isTrue(c.p.AllowInsecure) {
+		cfg, err := tlsConfigFor(c.p)
+		if err != nil {
+			return err
+		}
+		if cfg == nil {
+			cfg = &tls.Config{}
+		}
+		c.tls = cfg.Clone()
+		c.tls.ServerName, _, _ = net.SplitHostPort(host)
+		// many servers only accept data connections that resume the
+		// control connection's TLS session
+		c.tls.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+	}
+
+	var conn net.Conn = c.raw
+	if c.p.FTPImplicitTLS {
+		tc := tls.Client(c.raw, c.tls)
+		if err := tc.Handshake(); err != nil {
+			return fmt.Errorf("TLS handshake with %s: %w", host, err)
+		}
+		conn = tc
+	}
+	c.text = textproto.NewConn(conn)
+	if _, _, err := c.reply("greeting", 2); err != nil {
+		return err
+	}
+	if !c.p.FTPImplicitTLS && c.tls != nil {
+		if _, _, err := c.cmd(2, "AUTH", "TLS"); err != nil {
+			var ftpErr *ftpError
+			if errors.As(err, &ftpErr) {
+				return fmt.Errorf("%s doesn't take FTP over TLS (%v), set allow_insecure = true to upload over plain FTP, which sends the password and screenshots unencrypted", host, err)
+			}
+			return err
+		}
+		tc := tls.Client(c.raw, c.tls)
+		if err := tc.Handshake(); err != nil {
+			return fmt.Errorf("TLS handshake with %s: %w", host, err)
+		}
+		c.text = textproto.NewConn(tc)
+	}
+
+	_, _, err := c.cmd(3, "USER", c.p.FTPUser)
+	var ftpErr *ftpError
+	if errors.As(err, &ftpErr) && ftpErr.Code == 230 {
+		// no password needed
+		err = nil
+	} else if err == nil {
+		var password string
+		if c.p.FTPPassword != "" {
+			if password, err = cachedSecret(c.p.FTPPassword, ftpLabel(c.p)); err != nil {
+				return err
+			}
+		}
+		_, _, err = c.cmd(2, "PASS", password)
+	}
+	if errors.As(err, &ftpErr) && ftpErr.Code == 530 {
+		return fmt.Errorf("login as %s on %s failed: %w", c.p.FTPUser, host, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	if c.tls != nil {
+		if _, _, err := c.cmd(2, "PBSZ", "0"); err != nil {
+			return err
+		}
+		if _, _, err := c.cmd(2, "PROT", "P"); err != nil {
+			return err
+		}
+	}
+	if _, _, err := c.cmd(2, "TYPE", "I"); err != nil {
+		return err
+	}
+	if _, msg, err := c.cmd(2, "PWD"); err == nil {
+		c.home = quotedPath(msg)
+	}
+	return nil
+}
+
+// cmd sends a command and reads the reply, which has to start with the
+// digit expect. Other replies are an *ftpError.
+func (c *ftpConn) cmd(expect int, verb string, args ...string) (int, string, error) {
+	line := strings.Join(append([]string{verb}, args...), " ")
+	if strings.ContainsAny(line, "\r\n") {
+		return 0, "", fmt.Errorf("FTP %s: line breaks can't be sent", verb)
+	}
+	if err := c.text.PrintfLine("%s", line); err != nil {
+		return 0, "", err
+	}
+	return c.reply(verb, expect)
+}
+
+// reply reads the server's reply to verb
+func (c *ftpConn) reply(verb string, expect int) (int, string, error) {
+	code, msg, err := c.text.ReadResponse(expect)
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return code, msg, &ftpError{Cmd: verb, Code: protoErr.Code, Msg: protoErr.Msg}
+	}
+	return code, msg, err
+}
+
+// quotedPath is the directory in a 257 reply like `"/home/me" is the
+// current directory`, doubled quotes are quotes in the name
+func quotedPath(msg string) string {
+	start := strings.Index(msg, `"`)
+	if start < 0 {
+		return ""
+	}
+	var b strings.Builder
+	for i := start + 1; i < len(msg); i++ {
+		if msg[i] == '"' {
+			if i+1 < len(msg) && msg[i+1] == '"' {
+				b.WriteByte('"')
+				i++
+				continue
+			}
+			return b.String()
+		}
+		b.WriteByte(msg[i])
+	}
+	return ""
+}
+
+// Close drops the connection without saying goodbye, so a stalled server
+// can't block it
+func (c *ftpConn) Close() error {
+	c.mu.Lock()
+	if c.data != nil {
+		c.data.Close()
+	}
+	c.mu.Unlock()
+	return c.raw.Close()
+}
+
+// openData opens a data connection and sends the command that uses it. The
+// connection is returned once the server accepted the command.
+func (c *ftpConn) openData(verb string, args ...string) (net.Conn, error) {
+	var conn net.Conn
+	var ln *net.TCPListener
+	var err error
+	if c.p.FTPActive {
+		ln, err = c.listen()
+	} else {
+		conn, err = c.passive()
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.setData(conn)
+	if _, _, err := c.cmd(1, verb, args...); err != nil {
+		if ln != nil {
+			ln.Close()
+		} else {
+			conn.Close()
+		}
+		return nil, err
+	}
+	if ln != nil {
+		ln.SetDeadline(time.Now().Add(c.p.DialTimeout.Duration))
+		conn, err = ln.Accept()
+		ln.Close()
+		if err != nil {
+			return nil, withTimeout(fmt.Errorf("%s didn't connect back for %s: %w", c.p.RemoteHost, verb, err), "dial", c.p)
+		}
+		c.setData(conn)
+	}
+	if c.tls != nil {
+		tc := tls.Client(conn, c.tls)
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake on the data connection to %s: %w", c.p.RemoteHost, err)
+		}
+		conn = tc
+	}
+	return conn, nil
+}
+
+// setData remembers the open data connection
+func (c *ftpConn) setData(conn net.Conn) {
+	c.mu.Lock()
+	c.data = conn
+	c.mu.Unlock()
+}
+
+// epsvPort finds the port in a 229 reply like `Entering Extended Passive
+// Mode (|||6446|)`
+var epsvPort = regexp.MustCompile(`\(([!-~])([!-~])?([!-~])?(\d+)([!-~])\)`)
+
+// pasvAddr finds the address in a 227 reply like `Entering Passive Mode
+// (192,0,2,1,4,15)`
+var pasvAddr = regexp.MustCompile(`(\d+),(\d+),(\d+),(\d+),(\d+),(\d+)`)
+
+// passive has the server listen for a data connection and connects to it.
+// The address in PASV replies is ignored, servers behind NAT often get it
+// wrong, and the control connection's host is used instead.
+func (c *ftpConn) passive() (net.Conn, error) {
+	var port string
+	if !c.noEPSV {
+		_, msg, err := c.cmd(2, "EPSV")
+		if m := epsvPort.FindStringSubmatch(msg); err == nil && m != nil {
+			port = m[4]
+		} else if err != nil && !notImplemented(err) {
+			return nil, err
+		} else {
+			c.noEPSV = true
+		}
+	}
+	if port == "" {
+		_, msg, err := c.cmd(2, "PASV")
+		if err != nil {
+			return nil, err
+		}
+		m := pasvAddr.FindStringSubmatch(msg)
+		if m == nil {
+			return nil, fmt.Errorf("FTP PASV: can't understand %q", msg)
+		}
+		hi, _ := strconv.Atoi(m[5])
+		lo, _ := strconv.Atoi(m[6])
+		port = strconv.Itoa(hi<<8 | lo)
+	}
+	host, _, _ := net.SplitHostPort(c.p.RemoteHost)
+	hop := c.p
+	hop.RemoteHost = net.JoinHostPort(host, port)
+	conn, err := dialRemote(hop)
+	if err != nil {
+		return nil, withTimeout(err, "dial", hop)
+	}
+	return conn, nil
+}
+
+// listen waits for the server to connect for a transfer, on the address the
+// control connection goes out from
+func (c *ftpConn) listen() (*net.TCPListener, error) {
+	local, ok := c.raw.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, errors.New("ftp_active needs a direct TCP connection")
+	}
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: local.IP})
+	if err != nil {
+		return nil, err
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	if ip := local.IP.To4(); ip != nil {
+		_, _, err = c.cmd(2, "PORT", fmt.Sprintf("%d,%d,%d,%d,%d,%d", ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff))
+	} else {
+		_, _, err = c.cmd(2, "EPRT", fmt.Sprintf("|2|%s|%d|", local.IP, port))
+	}
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// store uploads size bytes of f as name, counting them in t
+func (c *ftpConn) store(f *os.File, size int64, name string, t *transfer) error {
+	atomic.StoreInt64(&t.done, 0)
+	data, err := c.openData("STOR", name)
+	if err != nil {
+		return err
+	}
+	body := progressTracker{limitedReader{io.NewSectionReader(f, 0, size), uploadLimiter}, t}
+	_, err = io.Copy(data, body)
+	if closeErr := data.Close(); err == nil {
+		err = closeErr
+	}
+	c.setData(nil)
+	if err != nil {
+		return err
+	}
+	_, _, err = c.reply("STOR", 2)
+	return err
+}
+
+// checkSize makes sure name on the server is size bytes long. Servers
+// without SIZE aren't checked.
+func (c *ftpConn) checkSize(name string, size int64) error {
+	_, msg, err := c.cmd(2, "SIZE", name)
+	if notImplemented(err) {
+		debugf("%s can't tell file sizes, %s is unchecked", c.p.RemoteHost, name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	got, err := strconv.ParseInt(strings.TrimSpace(msg), 10, 64)
+	if err != nil {
+		return fmt.Errorf("FTP SIZE: can't understand %q", msg)
+	}
+	if got != size {
+		return &sizeMismatchError{Name: name, Got: got, Local: size}
+	}
+	return nil
+}
+
+// rename moves oldname to newname on the server
+func (c *ftpConn) rename(oldname, newname string) error {
+	if _, _, err := c.cmd(3, "RNFR", oldname); err != nil {
+		return err
+	}
+	_, _, err := c.cmd(2, "RNTO", newname)
+	return err
+}
+
+// chmod sets the mode of name unless mode is 0. Lots of servers have no
+// SITE CHMOD, which is fine.
+func (c *ftpConn) chmod(name string, mode os.FileMode) {
+	if mode == 0 {
+		return
+	}
+	if _, _, err := c.cmd(2, "SITE", "CHMOD", fmt.Sprintf("%o", mode), name); err != nil {
+		debugf("can't chmod %s to %o: %v", name, mode, err)
+	}
+}
+
+// mkdirAll creates dir and every missing parent, chmodding the ones it
+// created to mode
+func (c *ftpConn) mkdirAll(dir string, mode os.FileMode) error {
+	if dir == "." || dir == "/" || dir == "" {
+		return nil
+	}
+	if c.isDir(dir) {
+		return nil
+	}
+	if err := c.mkdirAll(path.Dir(dir), mode); err != nil {
+		return err
+	}
+	if _, _, err := c.cmd(2, "MKD", dir); err != nil {
+		if c.isDir(dir) {
+			return nil
+		}
+		return fmt.Errorf("can't create directory %s: %w", dir, err)
+	}
+	debugf("created remote directory %s", dir)
+	c.chmod(dir, mode)
+	return nil
+}
+
+// isDir tells whether dir is a directory on the server by changing into it
+// and back
+func (c *ftpConn) isDir(dir string) bool {
+	if _, _, err := c.cmd(2, "CWD", dir); err != nil {
+		return false
+	}
+	if c.home != "" {
+		c.cmd(2, "CWD", c.home)
+	}
+	return true
+}
+
+// noRename remembers the servers that can't rename files, they're uploaded
+// to straight away
+var noRename sync.Map
+
+func (u ftpUploader) upload(ctx context.Context, localPath, remoteName string) (string, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	dst := u.p.destinationFor(remoteExtension(remoteName))
+
+	ctx, cancel := context.WithTimeout(ctx, u.p.TransferTimeout.Duration)
+	defer cancel()
+	t := startTransfer(localPath, fi.Size(), 0, u.opts.Progress)
+	defer t.finish()
+	ctx, stalled := watchStall(ctx, t, u.p.StallTimeout.Duration)
+	err = u.withConn(ctx, func(c *ftpConn) error {
+		return u.copyFile(c, f, fi.Size(), dst.RemotePath+remoteName, t)
+	})
+	if stalled() {
+		return "", &timeoutError{Op: "stall", Host: u.p.FTPHost, After: u.p.StallTimeout.Duration}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", &timeoutError{Op: "transfer", Host: u.p.FTPHost, After: u.p.TransferTimeout.Duration, Err: err}
+	}
+	if err != nil {
+		return "", err
+	}
+	log.Println(t.summary())
+	return dst.BaseURL + remoteName, nil
+}
+
+// copyFile uploads f to dest under a temporary name, checks its size and
+// renames it in place. On servers that can't rename it's uploaded to dest
+// right away.
+func (u ftpUploader) copyFile(c *ftpConn, f *os.File, size int64, dest string, t *transfer) error {
+	tmp := dest + tempSuffix + shortuuid.New()
+	if _, ok := noRename.Load(c.p.RemoteHost); ok {
+		tmp = dest
+	}
+	err := c.store(f, size, tmp, t)
+	var ftpErr *ftpError
+	if errors.As(err, &ftpErr) && ftpErr.Code == 550 && u.opts.Mkdirs {
+		// most likely the directory is missing
+		if err = c.mkdirAll(path.Dir(tmp), u.p.dirMode()); err == nil {
+			err = c.store(f, size, tmp, t)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	err = c.checkSize(tmp, size)
+	if err == nil {
+		c.chmod(tmp, u.p.fileMode())
+	}
+	if err == nil && tmp != dest {
+		err = c.rename(tmp, dest)
+		if notImplemented(err) {
+			log.Printf("%s can't rename files, uploading to the final name instead: %v", c.p.RemoteHost, err)
+			noRename.Store(c.p.RemoteHost, true)
+			c.cmd(2, "DELE", tmp)
+			tmp = dest
+			if err = c.store(f, size, dest, t); err == nil {
+				err = c.checkSize(dest, size)
+			}
+		}
+	}
+	if err != nil {
+		c.cmd(2, "DELE", tmp)
+		return err
+	}
+	return nil
+}
+
+func (u ftpUploader) remove(ctx context.Context, remoteName string) error {
+	name := u.p.destinationFor(remoteExtension(remoteName)).RemotePath + remoteName
+	return u.withConn(ctx, func(c *ftpConn) error {
+		_, _, err := c.cmd(2, "DELE", name)
+		return err
+	})
+}
+
+func (u ftpUploader) stat(ctx context.Context, remoteName string) (os.FileInfo, error) {
+	name := u.p.destinationFor(remoteExtension(remoteName)).RemotePath + remoteName
+	fi := remoteFileInfo{name: remoteName, size: -1}
+	err := u.withConn(ctx, func(c *ftpConn) error {
+		_, msg, err := c.cmd(2, "SIZE", name)
+		var ftpErr *ftpError
+		if errors.As(err, &ftpErr) && ftpErr.Code == 550 {
+			return os.ErrNotExist
+		}
+		if err != nil {
+			return err
+		}
+		if fi.size, err = strconv.ParseInt(strings.TrimSpace(msg), 10, 64); err != nil {
+			return fmt.Errorf("FTP SIZE: can't understand %q", msg)
+		}
+		if _, msg, err := c.cmd(2, "MDTM", name); err == nil {
+			// fractions of seconds may follow
+			msg = strings.TrimSpace(msg)
+			if len(msg) > 14 {
+				msg = msg[:14]
+			}
+			if t, err := time.Parse("20060102150405", msg); err == nil {
+				fi.modTime = t
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fi, nil
+}
+
+// check logs in, so a server without TLS or wrong credentials show at
+// startup
+func (u ftpUploader) check(ctx context.Context) error {
+	return u.withConn(ctx, func(c *ftpConn) error { return nil })
+}
+
+// withConn runs fn with a logged in connection, the pooled one unless
+// persistent connections are turned off. The connection is closed when ctx
+// is done before fn returns.
+func (u ftpUploader) withConn(ctx context.Context, fn func(*ftpConn) error) error {
+	var c *ftpConn
+	var err error
+	if u.opts.Persistent {
+		c, err = ftpConns.take(u.p)
+	} else {
+		c, err = dialFTP(u.p)
+	}
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-stop:
+		}
+	}()
+	err = fn(c)
+	close(stop)
+
+	// the connection is still good after the server turned something down
+	var ftpErr *ftpError
+	if u.opts.Persistent && ctx.Err() == nil && (err == nil || errors.As(err, &ftpErr) && ftpErr.Code != 421) {
+		ftpConns.put(u.p, c)
+		return err
+	}
+	if err == nil {
+		c.cmd(2, "QUIT")
+	}
+	c.Close()
+	return err
+}
+
+// ftpPool keeps a connection per FTP server open between uploads, so a
+// batch of screenshots is uploaded with one login
+type ftpPool struct {
+	mu    sync.Mutex
+	conns map[string]*ftpConn
+}
+
+// ftpConns is shared by every upload for the life of the process
+var ftpConns = &ftpPool{conns: make(map[string]*ftpConn)}
+
+// ftpKey is what makes two profiles share an FTP connection
+func ftpKey(p profile) string {
+	return fmt.Sprintf("%s|%s|%s|%t|%s|%s|%t", p.FTPHost, p.FTPUser, p.ftpTLSMode(), p.FTPActive, p.Proxy, p.TLSCAFile, p.InsecureTLS)
+}
+
+// take returns the open connection for p, connecting when there's none or
+// the server closed it. Until it's put back nobody else uses it.
+func (fp *ftpPool) take(p profile) (*ftpConn, error) {
+	key := ftpKey(p)
+	fp.mu.Lock()
+	c := fp.conns[key]
+	delete(fp.conns, key)
+	fp.mu.Unlock()
+
+	if c != nil {
+		c.raw.SetDeadline(time.Now().Add(p.DialTimeout.Duration))
+		_, _, err := c.cmd(2, "NOOP")
+		c.raw.SetDeadline(time.Time{})
+		if err == nil {
+			return c, nil
+		}
+		debugf("connection to %s was closed, reconnecting: %v", p.FTPHost, err)
+		c.Close()
+	}
+	return dialFTP(p)
+}
+
+// put keeps c open for the next upload to p
+func (fp *ftpPool) put(p profile, c *ftpConn) {
+	key := ftpKey(p)
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	if old, ok := fp.conns[key]; ok {
+		old.Close()
+	}
+	fp.conns[key] = c
+}
+
+// closeAll closes every open connection
+func (fp *ftpPool) closeAll() {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	for key, c := range fp.conns {
+		c.Close()
+		delete(fp.conns, key)
+	}
+}
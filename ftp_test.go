@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ftpServer is an FTP server in memory with just enough of RFC 959 and
+// 4217 for uploads
+type ftpServer struct {
+	ln net.Listener
+	// tls secures connections after AUTH TLS, servers without it turn
+	// AUTH down
+	tls *tls.Config
+	// noRename turns RNFR down like servers that can't rename
+	noRename bool
+
+	mu     sync.Mutex
+	files  map[string][]byte
+	cmds   []string
+	logins int
+}
+
+func newFTPServer(t *testing.T, secure bool) *ftpServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &ftpServer{ln: ln, files: map[string][]byte{}}
+	if secure {
+		s.tls = &tls.Config{Certificates: []tls.Certificate{selfSignedCert(t)}}
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// selfSignedCert is a certificate for 127.0.0.1 nobody signed
+func selfSignedCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func (s *ftpServer) addr() string {
+	return s.ln.Addr().String()
+}
+
+// file is the content of name on the server and how many files it has
+func (s *ftpServer) file(name string) (string, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return string(s.files[name]), len(s.files)
+}
+
+// commands are the verbs the server got, in order
+func (s *ftpServer) commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.cmds...)
+}
+
+func (s *ftpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 fake FTP")
+	var data net.Listener
+	var private bool
+	var renaming string
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, arg = line[:i], line[i+1:]
+		}
+		s.mu.Lock()
+		s.cmds = append(s.cmds, verb)
+		s.mu.Unlock()
+
+		switch verb {
+		case "AUTH":
+			if s.tls == nil {
+				text.PrintfLine("502 AUTH not understood")
+				continue
+			}
+			text.PrintfLine("234 go ahead")
+			tc := tls.Server(conn, s.tls)
+			text = textproto.NewConn(tc)
+		case "USER":
+			text.PrintfLine("331 password please")
+		case "PASS":
+			s.mu.Lock()
+			s.logins++
+			s.mu.Unlock()
+			text.PrintfLine("230 logged in")
+		case "PROT":
+			private = arg == "P"
+			text.PrintfLine("200 ok")
+		case "PBSZ", "TYPE", "NOOP", "SITE":
+			text.PrintfLine("200 ok")
+		case "PWD":
+			text.PrintfLine(`257 "/" is the current directory`)
+		case "CWD", "DELE", "MKD":
+			if verb == "DELE" {
+				s.mu.Lock()
+				delete(s.files, arg)
+				s.mu.Unlock()
+			}
+			text.PrintfLine("250 ok")
+		case "EPSV":
+			if data, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+				text.PrintfLine("425 can't listen")
+				continue
+			}
+			text.PrintfLine("229 Entering Extended Passive Mode (|||%d|)", data.Addr().(*net.TCPAddr).Port)
+		case "STOR":
+			text.PrintfLine("150 send it")
+			conn, err := data.Accept()
+			data.Close()
+			if err != nil {
+				text.PrintfLine("425 no connection")
+				continue
+			}
+			if private {
+				conn = tls.Server(conn, s.tls)
+			}
+			b, err := ioutil.ReadAll(bufio.NewReader(conn))
+			conn.Close()
+			if err != nil {
+				text.PrintfLine("426 %v", err)
+				continue
+			}
+			s.mu.Lock()
+			s.files[arg] = b
+			s.mu.Unlock()
+			text.PrintfLine("226 stored")
+		case "SIZE":
+			s.mu.Lock()
+			b, ok := s.files[arg]
+			s.mu.Unlock()
+			if !ok {
+				text.PrintfLine("550 no such file")
+				continue
+			}
+			text.PrintfLine("213 %d", len(b))
+		case "RNFR":
+			if s.noRename {
+				text.PrintfLine("502 RNFR not implemented")
+				continue
+			}
+			renaming = arg
+			text.PrintfLine("350 ready for RNTO")
+		case "RNTO":
+			s.mu.Lock()
+			s.files[arg] = s.files[renaming]
+			delete(s.files, renaming)
+			s.mu.Unlock()
+			text.PrintfLine("250 renamed")
+		case "QUIT":
+			text.PrintfLine("221 bye")
+			return
+		default:
+			text.PrintfLine("502 %s not implemented", verb)
+		}
+	}
+}
+
+// ftpTestUploader uploads to s, p has what's set on top
+func ftpTestUploader(t *testing.T, s *ftpServer, p profile, persistent bool) ftpUploader {
+	p.Backend = backendFTP
+	p.FTPHost = s.addr()
+	p.FTPUser = "me"
+	p.RemotePath = "/shots/"
+	p.BaseURL = "https://example.com/"
+	t.Cleanup(ftpConns.closeAll)
+	return ftpUploader{p: testProfile(p), opts: uploadOptions{Persistent: persistent}}
+}
+
+func TestFTPNeedsTLS(t *testing.T) {
+	s := newFTPServer(t, false)
+	err := ftpTestUploader(t, s, profile{}, false).check(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "doesn't take FTP over TLS") || !strings.Contains(err.Error(), "set allow_insecure = true") {
+		t.Fatalf("a server without TLS: %v", err)
+	}
+	for _, cmd := range s.commands() {
+		if cmd == "USER" || cmd == "PASS" {
+			t.Errorf("logged in over plain FTP: %v", s.commands())
+		}
+	}
+
+	// allow_insecure uploads without asking for TLS
+	up := ftpTestUploader(t, s, profile{AllowInsecure: boolPtr(true)}, false)
+	url, err := up.upload(context.Background(), uploadTestFile(t, "shot.png", []byte("png")), "shot.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.file("/shots/shot.png"); url != "https://example.com/shot.png" || got != "png" {
+		t.Errorf("uploaded to %s, server has %q", url, got)
+	}
+	if cmds := s.commands(); strings.Count(strings.Join(cmds, " "), "AUTH") != 1 {
+		t.Errorf("asked for TLS with allow_insecure: %v", cmds)
+	}
+}
+
+func TestFTPExplicitTLS(t *testing.T) {
+	s := newFTPServer(t, true)
+	up := ftpTestUploader(t, s, profile{InsecureTLS: true}, false)
+	if _, err := up.upload(context.Background(), uploadTestFile(t, "shot.png", []byte("png")), "shot.png"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.file("/shots/shot.png"); got != "png" {
+		t.Errorf("server has %q", got)
+	}
+	if cmds := strings.Join(s.commands(), " "); !strings.HasPrefix(cmds, "AUTH USER PASS PBSZ PROT") {
+		t.Errorf("commands %s, want TLS before logging in", cmds)
+	}
+
+	// the server's certificate is checked
+	up = ftpTestUploader(t, s, profile{}, false)
+	if err := up.check(context.Background()); err == nil || !strings.Contains(err.Error(), "TLS handshake") {
+		t.Errorf("a certificate nobody signed: %v", err)
+	}
+}
+
+// servers that can't rename get files under their final name, the
+// temporary one is cleaned up and not tried again
+func TestFTPRenameFallback(t *testing.T) {
+	s := newFTPServer(t, false)
+	s.noRename = true
+	up := ftpTestUploader(t, s, profile{AllowInsecure: boolPtr(true)}, true)
+	for _, name := range []string{"a.png", "b.png"} {
+		if _, err := up.upload(context.Background(), uploadTestFile(t, name, []byte(name)), name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, _ := s.file("/shots/a.png")
+	b, n := s.file("/shots/b.png")
+	if a != "a.png" || b != "b.png" || n != 2 {
+		t.Errorf("server has %d files, a.png %q and b.png %q", n, a, b)
+	}
+	cmds := strings.Join(s.commands(), " ")
+	if strings.Count(cmds, "RNFR") != 1 || strings.Count(cmds, "STOR") != 3 || !strings.Contains(cmds, "RNFR DELE EPSV STOR") {
+		t.Errorf("commands %s, want one rename tried", cmds)
+	}
+}
+
+// a batch of uploads logs in once, unless persistent connections are off
+func TestFTPConnectionReuse(t *testing.T) {
+	for _, persistent := range []bool{true, false} {
+		s := newFTPServer(t, false)
+		up := ftpTestUploader(t, s, profile{AllowInsecure: boolPtr(true)}, persistent)
+		for i := 0; i < 3; i++ {
+			name := fmt.Sprintf("%d.png", i)
+			if _, err := up.upload(context.Background(), uploadTestFile(t, name, []byte("png")), name); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want := 3
+		if persistent {
+			want = 1
+		}
+		_, files := s.file("")
+		s.mu.Lock()
+		logins := s.logins
+		s.mu.Unlock()
+		if logins != want || files != 3 {
+			t.Errorf("persistent %t: %d logins for %d files, want %d", persistent, logins, files, want)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gcsScope is what access tokens for uploads are asked for
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// googleTokenURL is Google's OAuth token endpoint
+var googleTokenURL = "https://oauth2.googleapis.com/token"
+
+// gcpCredentials are the contents of a service account key or of the
+// application default credentials gcloud writes, see
+// https://google.aip.dev/auth/4112 and https://google.aip.dev/auth/4113
+type gcpCredentials struct {
+	Type string `json:"type"`
+
+	// service_account
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+
+	// authorized_user
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+
+	// path is where the credentials were read from, key the parsed
+	// private key of a service account and scope what its tokens are asked
+	// for, gcsScope when it's empty
+	path  string
+	key   *rsa.PrivateKey
+	scope string
+}
+
+// errNoGCPCredentials is returned when none of the usual places has Google
+// Cloud credentials
+var errNoGCPCredentials = errors.New("no Google Cloud credentials found, set gcs_credentials or GOOGLE_APPLICATION_CREDENTIALS to a service account key, or run gcloud auth application-default login")
+
+// gcpAuthError is an error from Google's OAuth token endpoint, e.g. for a
+// deleted service account key
+type gcpAuthError struct {
+	Path        string
+	Status      int
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *gcpAuthError) Error() string {
+	msg := e.Description
+	if msg == "" {
+		msg = e.Code
+	}
+	if msg == "" {
+		msg = http.StatusText(e.Status)
+	}
+	return fmt.Sprintf("Google rejected the credentials in %s: %s", e.Path, msg)
+}
+
+func (e *gcpAuthError) temporary() bool {
+	return e.Status >= 500
+}
+
+// defaultGCPCredentialsPath is where gcloud auth application-default login
+// saves credentials
+func defaultGCPCredentialsPath(getenv func(string) string) string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(getenv("APPDATA"), "gcloud", "application_default_credentials.json")
+	}
+	dir := getenv("CLOUDSDK_CONFIG")
+	if dir == "" {
+		dir = "~/.config/gcloud"
+	}
+	return filepath.Join(dir, "application_default_credentials.json")
+}
+
+// loadGCPCredentials reads the credentials in path, or when it's empty the
+// application default credentials: GOOGLE_APPLICATION_CREDENTIALS, then
+// what gcloud saved. Metadata server credentials on Google Cloud machines
+// aren't supported.
+func loadGCPCredentials(path string, getenv func(string) string) (*gcpCredentials, error) {
+	explicit := true
+	if path == "" {
+		path = getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if path == "" {
+		path, explicit = defaultGCPCredentialsPath(getenv), false
+	}
+	path, err := expandPath(path, getenv)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !explicit {
+		return nil, errNoGCPCredentials
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Google Cloud credentials: %w", err)
+	}
+
+	c := &gcpCredentials{path: path}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("Google Cloud credentials %s: %w", path, err)
+	}
+	switch c.Type {
+	case "service_account":
+		if c.ClientEmail == "" || c.PrivateKey == "" {
+			return nil, fmt.Errorf("Google Cloud credentials %s: client_email or private_key missing", path)
+		}
+		if c.key, err = parseRSAKey(c.PrivateKey); err != nil {
+			return nil, fmt.Errorf("Google Cloud credentials %s: %w", path, err)
+		}
+		setDefault(&c.TokenURI, googleTokenURL)
+	case "authorized_user":
+		if c.ClientID == "" || c.RefreshToken == "" {
+			return nil, fmt.Errorf("Google Cloud credentials %s: client_id or refresh_token missing", path)
+		}
+		c.TokenURI = googleTokenURL
+	default:
+		return nil, fmt.Errorf("Google Cloud credentials %s: type %q isn't supported, use a service account key", path, c.Type)
+	}
+	return c, nil
+}
+
+// parseRSAKey parses the PEM encoded private key of a service account
+func parseRSAKey(s string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("private_key is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("private_key: %w", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private_key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// oauthToken is an OAuth access token and when it stops working
+type oauthToken struct {
+	value   string
+	expires time.Time
+}
+
+// gcpTokens caches access tokens by credentials file and scope, they're
+// good for an hour
+var gcpTokens = struct {
+	sync.Mutex
+	m map[string]oauthToken
+}{m: map[string]oauthToken{}}
+
+// accessToken returns a token for c, a cached one unless it's about to
+// expire
+func (c *gcpCredentials) accessToken(ctx context.Context, client *http.Client) (string, error) {
+	cacheKey := c.path + "\x00" + c.scope
+	gcpTokens.Lock()
+	t, ok := gcpTokens.m[cacheKey]
+	gcpTokens.Unlock()
+	if ok && time.Until(t.expires) > time.Minute {
+		return t.value, nil
+	}
+
+	form := url.Values{}
+	if c.Type == "service_account" {
+		assertion, err := c.jwt(time.Now())
+		if err != nil {
+			return "", err
+		}
+		form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+		form.Set("assertion", assertion)
+	} else {
+		form.Set("grant_type", "refresh_token")
+		form.Set("client_id", c.ClientID)
+		form.Set("client_secret", c.ClientSecret)
+		form.Set("refresh_token", c.RefreshToken)
+	}
+	req, err := http.NewRequest(http.MethodPost, c.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		e := &gcpAuthError{Path: c.path, Status: resp.StatusCode}
+		json.Unmarshal(body, e)
+		return "", e
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil || token.AccessToken == "" {
+		return "", fmt.Errorf("Google sent no access token: %v", err)
+	}
+
+	t = oauthToken{value: token.AccessToken, expires: time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)}
+	gcpTokens.Lock()
+	gcpTokens.m[cacheKey] = t
+	gcpTokens.Unlock()
+	return t.value, nil
+}
+
+// jwt is the signed assertion a service account trades for an access token
+func (c *gcpCredentials) jwt(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": c.PrivateKeyID})
+	if err != nil {
+		return "", err
+	}
+	scope := c.scope
+	if scope == "" {
+		scope = gcsScope
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   c.ClientEmail,
+		"scope": scope,
+		"aud":   c.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, c.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Files of gcsResumableThreshold bytes and more are sent with a resumable
+// upload in chunks of gcsChunkSize, which must be a multiple of 256K. A
+// retried upload continues where the last attempt stopped.
+const (
+	gcsResumableThreshold = 8 << 20
+	gcsChunkSize          = 8 << 20
+)
+
+// gcsACLs are the predefined ACLs gcs_acl can be set to
+var gcsACLs = []string{"authenticatedRead", "bucketOwnerFullControl", "bucketOwnerRead", "private", "projectPrivate", "publicRead"}
+
+// gcsUploader uploads to a Google Cloud Storage bucket. Objects are named
+// gcs_prefix followed by the remote name, and their URL is base_url
+// followed by that.
+type gcsUploader struct {
+	p    profile
+	opts uploadOptions
+}
+
+// gcsSessions are the resumable uploads that haven't completed yet, by
+// local file and object, so another attempt can pick them up
+var gcsSessions sync.Map
+
+// gcsObject is the part of an object's metadata skrins looks at
+type gcsObject struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size,string"`
+	Updated time.Time `json:"updated"`
+}
+
+// gcsError is an error response from the JSON API, see
+// https://cloud.google.com/storage/docs/json_api/v1/status-codes
+type gcsError struct {
+	Bucket  string
+	Status  int
+	Message string
+	Reason  string
+}
+
+func (e *gcsError) Error() string {
+	switch {
+	case e.Status == http.StatusBadRequest && strings.Contains(e.Message, "uniform bucket-level access"):
+		return fmt.Sprintf("GCS bucket %s uses uniform bucket-level access, remove gcs_acl and grant access on the bucket instead", e.Bucket)
+	case e.Status == http.StatusUnauthorized:
+		return "Google rejected the access token, check gcs_credentials"
+	case e.Status == http.StatusForbidden:
+		return fmt.Sprintf("access to GCS bucket %s denied: %s", e.Bucket, e.Message)
+	case e.Status == http.StatusNotFound && e.Reason == "notFound" && strings.Contains(e.Message, "bucket"):
+		return fmt.Sprintf("GCS bucket %s doesn't exist", e.Bucket)
+	case e.Message != "":
+		return fmt.Sprintf("GCS: %s", e.Message)
+	}
+	return fmt.Sprintf("GCS answered %d %s", e.Status, http.StatusText(e.Status))
+}
+
+// temporary tells whether trying again may help, i.e. GCS was busy
+func (e *gcsError) temporary() bool {
+	return e.Status >= 500 || e.Status == http.StatusTooManyRequests || e.Status == http.StatusRequestTimeout
+}
+
+// gcsAPI is where requests go, STORAGE_EMULATOR_HOST when it's set like
+// the Google Cloud libraries do
+func gcsAPI(getenv func(string) string) string {
+	host := getenv("STORAGE_EMULATOR_HOST")
+	if host == "" {
+		return "https://storage.googleapis.com"
+	}
+	if !strings.Contains(host, "://") {
+		host = "http://" + host
+	}
+	return strings.TrimRight(host, "/")
+}
+
+// gcsProblems checks the settings a GCS profile needs beyond the required
+// ones, so bad credentials show up at startup instead of on the first
+// upload
+func gcsProblems(p profile, getenv func(string) string) []string {
+	var problems []string
+	if p.GCSACL != "" && !contains(gcsACLs, p.GCSACL) {
+		problems = append(problems, fmt.Sprintf("gcs_acl: unknown ACL %q, use one of %s", p.GCSACL, strings.Join(gcsACLs, ", ")))
+	}
+	if getenv("STORAGE_EMULATOR_HOST") == "" {
+		if _, err := loadGCPCredentials(p.GCSCredentials, getenv); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	return problems
+}
+
+// check makes sure Google accepts the credentials
+func (u gcsUploader) check(ctx context.Context) error {
+	_, err := u.token(ctx)
+	return err
+}
+
+func (u gcsUploader) upload(ctx context.Context, localPath, remoteName string) (string, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	name := u.p.GCSPrefix + remoteName
+	ctx, cancel := context.WithTimeout(ctx, u.p.TransferTimeout.Duration)
+	defer cancel()
+	sessionKey := localPath + "\x00" + u.p.GCSBucket + "/" + name
+	var session string
+	var offset int64
+	if fi.Size() >= gcsResumableThreshold {
+		if session, offset, err = u.session(ctx, sessionKey, name, fi.Size()); err != nil {
+			return "", err
+		}
+		if offset > 0 {
+			log.Printf("resuming upload of %s at %s", localPath, formatSize(uint64(offset)))
+		}
+	}
+
+	t := startTransfer(localPath, fi.Size(), offset, u.opts.Progress)
+	defer t.finish()
+	ctx, stalled := watchStall(ctx, t, u.p.StallTimeout.Duration)
+	var obj gcsObject
+	if session == "" {
+		obj, err = u.uploadMedia(ctx, name, f, t)
+	} else {
+		obj, err = u.uploadChunks(ctx, session, f, t)
+	}
+	if stalled() {
+		return "", &timeoutError{Op: "stall", Host: u.host(), After: u.p.StallTimeout.Duration}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", &timeoutError{Op: "transfer", Host: u.host(), After: u.p.TransferTimeout.Duration, Err: err}
+	}
+	if err != nil {
+		return "", err
+	}
+	gcsSessions.Delete(sessionKey)
+	if obj.Size != fi.Size() {
+		return "", &sizeMismatchError{Name: name, Got: obj.Size, Local: fi.Size()}
+	}
+
+	log.Println(t.summary())
+	return u.p.destinationFor(remoteExtension(remoteName)).BaseURL + name, nil
+}
+
+// uploadMedia uploads f as name in a single request
+func (u gcsUploader) uploadMedia(ctx context.Context, name string, f *os.File, t *transfer) (gcsObject, error) {
+	query := u.uploadQuery(name, "media")
+	header := http.Header{"Content-Type": {contentType(name)}}
+	body := progressTracker{limitedReader{f, uploadLimiter}, t}
+	resp, respBody, err := u.send(ctx, http.MethodPost, u.uploadURL(query), header, body, t.Size)
+	if err != nil {
+		return gcsObject{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return gcsObject{}, u.errorFrom(resp, respBody)
+	}
+	var obj gcsObject
+	err = json.Unmarshal(respBody, &obj)
+	return obj, err
+}
+
+// session returns the resumable upload session for key and how much of
+// the file it has, starting a new session when there's none or it expired
+func (u gcsUploader) session(ctx context.Context, key, name string, size int64) (string, int64, error) {
+	if v, ok := gcsSessions.Load(key); ok {
+		offset, err := u.resumeOffset(ctx, v.(string), size)
+		if err == nil {
+			return v.(string), offset, nil
+		}
+		var e *gcsError
+		if !errors.As(err, &e) || (e.Status != http.StatusNotFound && e.Status != http.StatusGone) {
+			return "", 0, err
+		}
+		gcsSessions.Delete(key)
+	}
+
+	header := http.Header{
+		"Content-Type":            {"application/json; charset=UTF-8"},
+		"X-Upload-Content-Type":   {contentType(name)},
+		"X-Upload-Content-Length": {strconv.FormatInt(size, 10)},
+	}
+	metadata, err := json.Marshal(map[string]string{"name": name, "contentType": contentType(name)})
+	if err != nil {
+		return "", 0, err
+	}
+	resp, respBody, err := u.send(ctx, http.MethodPost, u.uploadURL(u.uploadQuery(name, "resumable")), header, bytes.NewReader(metadata), int64(len(metadata)))
+	if err != nil {
+		return "", 0, err
+	}
+	session := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, u.errorFrom(resp, respBody)
+	}
+	if session == "" {
+		return "", 0, fmt.Errorf("GCS: no resumable upload session for %s", name)
+	}
+	gcsSessions.Store(key, session)
+	return session, 0, nil
+}
+
+// resumeOffset asks how many bytes of the upload session has
+func (u gcsUploader) resumeOffset(ctx context.Context, session string, size int64) (int64, error) {
+	header := http.Header{"Content-Range": {fmt.Sprintf("bytes */%d", size)}}
+	resp, respBody, err := u.send(ctx, http.MethodPut, session, header, nil, 0)
+	if err != nil {
+		return 0, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return size, nil
+	case http.StatusPermanentRedirect:
+		return persisted(resp), nil
+	}
+	return 0, u.errorFrom(resp, respBody)
+}
+
+// uploadChunks sends f to a resumable upload session from where the
+// session says it stopped
+func (u gcsUploader) uploadChunks(ctx context.Context, session string, f *os.File, t *transfer) (gcsObject, error) {
+	size := t.Size
+	offset := t.offset
+	for {
+		header := http.Header{}
+		var body io.Reader
+		var length int64
+		if offset < size {
+			length = gcsChunkSize
+			if offset+length > size {
+				length = size - offset
+			}
+			header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size))
+			body = progressTracker{limitedReader{io.NewSectionReader(f, offset, length), uploadLimiter}, t}
+		} else {
+			// everything was sent before but the answer got lost
+			header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		}
+		resp, respBody, err := u.send(ctx, http.MethodPut, session, header, body, length)
+		if err != nil {
+			return gcsObject{}, err
+		}
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusCreated:
+			var obj gcsObject
+			err = json.Unmarshal(respBody, &obj)
+			return obj, err
+		case http.StatusPermanentRedirect:
+			// GCS may keep less than was sent
+			offset = persisted(resp)
+			atomic.StoreInt64(&t.done, offset)
+		default:
+			return gcsObject{}, u.errorFrom(resp, respBody)
+		}
+	}
+}
+
+// persisted is how much of a resumable upload GCS has according to the
+// Range header of a 308 response, "bytes=0-N" or none for nothing yet
+func persisted(resp *http.Response) int64 {
+	r := strings.TrimPrefix(resp.Header.Get("Range"), "bytes=0-")
+	last, err := strconv.ParseInt(r, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return last + 1
+}
+
+func (u gcsUploader) remove(ctx context.Context, remoteName string) error {
+	resp, respBody, err := u.send(ctx, http.MethodDelete, u.objectURL(u.p.GCSPrefix+remoteName, nil), nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return u.errorFrom(resp, respBody)
+	}
+	return nil
+}
+
+func (u gcsUploader) stat(ctx context.Context, remoteName string) (os.FileInfo, error) {
+	target := u.objectURL(u.p.GCSPrefix+remoteName, url.Values{"fields": {"name,size,updated"}})
+	resp, respBody, err := u.send(ctx, http.MethodGet, target, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, os.ErrNotExist
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, u.errorFrom(resp, respBody)
+	}
+	var obj gcsObject
+	if err := json.Unmarshal(respBody, &obj); err != nil {
+		return nil, err
+	}
+	return remoteFileInfo{name: remoteName, size: obj.Size, modTime: obj.Updated}, nil
+}
+
+// uploadQuery is the query of an upload of name, with gcs_acl when set
+func (u gcsUploader) uploadQuery(name, uploadType string) url.Values {
+	query := url.Values{"uploadType": {uploadType}, "name": {name}}
+	if u.p.GCSACL != "" {
+		query.Set("predefinedAcl", u.p.GCSACL)
+	}
+	return query
+}
+
+func (u gcsUploader) uploadURL(query url.Values) string {
+	return gcsAPI(os.Getenv) + "/upload/storage/v1/b/" + url.PathEscape(u.p.GCSBucket) + "/o?" + query.Encode()
+}
+
+func (u gcsUploader) objectURL(name string, query url.Values) string {
+	return gcsAPI(os.Getenv) + "/storage/v1/b/" + url.PathEscape(u.p.GCSBucket) + "/o/" + url.PathEscape(name) + "?" + query.Encode()
+}
+
+// host is where requests go, for errors
+func (u gcsUploader) host() string {
+	if api, err := url.Parse(gcsAPI(os.Getenv)); err == nil {
+		return api.Host
+	}
+	return "storage.googleapis.com"
+}
+
+// token returns an access token for the profile's credentials, or nothing
+// for an emulator
+func (u gcsUploader) token(ctx context.Context) (string, error) {
+	if os.Getenv("STORAGE_EMULATOR_HOST") != "" {
+		return "", nil
+	}
+	creds, err := loadGCPCredentials(u.p.GCSCredentials, os.Getenv)
+	if err != nil {
+		return "", err
+	}
+	return creds.accessToken(ctx, httpClientFor(u.p))
+}
+
+// send makes an authorized request and returns the response with its body
+// read
+func (u gcsUploader) send(ctx context.Context, method, target string, header http.Header, body io.Reader, length int64) (*http.Response, []byte, error) {
+	token, err := u.token(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	req = req.WithContext(ctx)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.ContentLength = length
+	if length == 0 {
+		req.Body = http.NoBody
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := httpClientFor(u.p).Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	return resp, respBody, err
+}
+
+// errorFrom turns an error response into a *gcsError
+func (u gcsUploader) errorFrom(resp *http.Response, body []byte) error {
+	var e struct {
+		Error struct {
+			Message string `json:"message"`
+			Errors  []struct {
+				Reason string `json:"reason"`
+			} `json:"errors"`
+		} `json:"error"`
+	}
+	err := &gcsError{Bucket: u.p.GCSBucket, Status: resp.StatusCode}
+	if json.Unmarshal(body, &e) == nil {
+		err.Message = e.Error.Message
+		if len(e.Error.Errors) > 0 {
+			err.Reason = e.Error.Errors[0].Reason
+		}
+	}
+	return err
+}
@@ -0,0 +1,669 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Where the Google Drive API is, see
+// https://developers.google.com/drive/api/reference/rest/v3
+var (
+	gdriveAPI        = "https://www.googleapis.com/drive/v3"
+	gdriveUploadAPI  = "https://www.googleapis.com/upload/drive/v3"
+	googleDeviceCode = "https://oauth2.googleapis.com/device/code"
+)
+
+// Access tokens of service accounts are asked for the full Drive scope, so
+// folders shared with them can be written to. Signing in on a device only
+// gets drive.file, which covers the files and folders skrins created.
+const (
+	gdriveScope     = "https://www.googleapis.com/auth/drive"
+	gdriveFileScope = "https://www.googleapis.com/auth/drive.file"
+)
+
+// gdriveFields are the file fields asked for in answers
+const gdriveFields = "id,name,size,sha256Checksum,webContentLink,modifiedTime"
+
+// gdriveUploader uploads into the folder gdrive_folder, makes the file
+// viewable by anyone with the link and returns its download link
+type gdriveUploader struct {
+	p    profile
+	opts uploadOptions
+}
+
+// gdriveLabel describes a Google Drive secret in prompts and errors
+func gdriveLabel(what string) string {
+	return "Google Drive " + what
+}
+
+// gdriveProblems checks the settings of a gdrive profile
+func gdriveProblems(p profile, getenv func(string) string) []string {
+	if p.GDriveCredentials == "" {
+		return nil
+	}
+	var problems []string
+	creds, err := loadGCPCredentials(p.GDriveCredentials, getenv)
+	if err != nil {
+		problems = append(problems, err.Error())
+	} else if creds.Type == "service_account" && p.GDriveFolder == "" {
+		problems = append(problems, "a service account has no Drive storage of its own, set gdrive_folder to a folder shared with "+creds.ClientEmail+" or in a shared drive")
+	}
+	return problems
+}
+
+// gdriveFile is what Drive tells about a file
+type gdriveFile struct {
+	ID             string    `json:"id"`
+	Name           string    `json:"name"`
+	Size           int64     `json:"size,string"`
+	SHA256         string    `json:"sha256Checksum"`
+	WebContentLink string    `json:"webContentLink"`
+	ModifiedTime   time.Time `json:"modifiedTime"`
+}
+
+// gdriveError is an error answer of the Drive API. Reason is the first of
+// its reasons, like storageQuotaExceeded or insufficientFilePermissions.
+type gdriveError struct {
+	Status  int
+	Reason  string
+	Message string
+	Wait    time.Duration
+}
+
+// gdriveQuotaReasons are the reasons of a full Drive, gdriveRateReasons
+// those of requests coming in too fast
+var (
+	gdriveQuotaReasons = []string{"storageQuotaExceeded", "quotaExceeded", "teamDriveFileLimitExceeded", "dailyLimitExceeded", "numChildrenInNonRootLimitExceeded"}
+	gdriveRateReasons  = []string{"rateLimitExceeded", "userRateLimitExceeded", "sharingRateLimitExceeded"}
+)
+
+// The notification only shows the message, so it starts with what kind of
+// problem it is
+func (e *gdriveError) Error() string {
+	msg := strings.TrimRight(e.Message, ".")
+	if msg == "" {
+		msg = http.StatusText(e.Status)
+	}
+	switch {
+	case contains(gdriveQuotaReasons, e.Reason):
+		return "Google Drive quota exceeded: " + msg
+	case contains(gdriveRateReasons, e.Reason) || e.Status == http.StatusTooManyRequests:
+		return "Google Drive rate limit reached: " + msg
+	case e.Status == http.StatusUnauthorized || e.Status == http.StatusForbidden:
+		return "Google Drive permission denied: " + msg
+	}
+	return fmt.Sprintf("Google Drive answered %d %s: %s", e.Status, http.StatusText(e.Status), msg)
+}
+
+// temporary tells whether trying again may help, i.e. Drive is busy or the
+// rate limit is reached
+func (e *gdriveError) temporary() bool {
+	return e.Status >= 500 || e.Status == http.StatusTooManyRequests || contains(gdriveRateReasons, e.Reason)
+}
+
+// retryAfter is how long to wait before trying again
+func (e *gdriveError) retryAfter() time.Duration {
+	return e.Wait
+}
+
+// parent is the folder uploads go to
+func (u gdriveUploader) parent() string {
+	if u.p.GDriveFolder == "" {
+		return "root"
+	}
+	return u.p.GDriveFolder
+}
+
+func (u gdriveUploader) upload(ctx context.Context, localPath, remoteName string) (string, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, u.p.TransferTimeout.Duration)
+	defer cancel()
+	session, offset, file, err := u.session(ctx, localPath, fi, remoteName)
+	if err != nil {
+		return "", err
+	}
+	t := startTransfer(localPath, fi.Size(), offset, u.opts.Progress)
+	defer t.finish()
+	// checking, naming and sharing the file come after stalled() ends the
+	// context of the transfer
+	transferCtx, stalled := watchStall(ctx, t, u.p.StallTimeout.Duration)
+
+	// Drive may keep only part of what was sent, the rest is sent again
+	for attempt := 0; file == nil && err == nil && attempt < 3; attempt++ {
+		if attempt > 0 {
+			if offset, file, err = u.uploadStatus(transferCtx, session, fi.Size()); err != nil || file != nil {
+				break
+			}
+		}
+		file, err = u.send(transferCtx, session, f, offset, fi.Size(), t)
+	}
+	if err == nil && file == nil {
+		err = fmt.Errorf("Google Drive didn't take all of %s", localPath)
+	}
+	if stalled() {
+		return "", &timeoutError{Op: "stall", Host: "www.googleapis.com", After: u.p.StallTimeout.Duration}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", &timeoutError{Op: "transfer", Host: "www.googleapis.com", After: u.p.TransferTimeout.Duration, Err: err}
+	}
+	if err != nil {
+		return "", err
+	}
+	clearResumePoint(localPath)
+	log.Println(t.summary())
+
+	if err := u.finishUpload(ctx, f, fi, file, remoteName); err != nil {
+		if delErr := u.delete(ctx, file.ID); delErr != nil {
+			log.Printf("can't delete %s from Google Drive: %v", file.Name, delErr)
+		}
+		return "", err
+	}
+	return file.WebContentLink, nil
+}
+
+// session returns the upload session for localPath and how much of it
+// Drive has, continuing one of an earlier attempt when there's one. file is
+// set when that one was complete.
+func (u gdriveUploader) session(ctx context.Context, localPath string, fi os.FileInfo, remoteName string) (session string, offset int64, file *gdriveFile, err error) {
+	server := "gdrive:" + u.parent()
+	if rp, ok := resumePointFor(localPath, fi, server); ok {
+		if offset, file, err = u.uploadStatus(ctx, rp.Temp, fi.Size()); err == nil {
+			debugf("continuing the upload of %s at %d bytes", localPath, offset)
+			return rp.Temp, offset, file, nil
+		}
+		debugf("can't continue the upload of %s: %v", localPath, err)
+	}
+
+	metadata, err := json.Marshal(map[string]interface{}{"name": remoteName, "parents": []string{u.parent()}})
+	if err != nil {
+		return "", 0, nil, err
+	}
+	header := http.Header{
+		"Content-Type":            {"application/json; charset=UTF-8"},
+		"X-Upload-Content-Type":   {contentType(remoteName)},
+		"X-Upload-Content-Length": {strconv.FormatInt(fi.Size(), 10)},
+	}
+	target := gdriveUploadAPI + "/files?uploadType=resumable&supportsAllDrives=true&fields=" + gdriveFields
+	resp, _, err := u.do(ctx, http.MethodPost, target, header, bytes.NewReader(metadata), int64(len(metadata)))
+	if err != nil {
+		return "", 0, nil, err
+	}
+	session = resp.Header.Get("Location")
+	if session == "" {
+		return "", 0, nil, errors.New("Google Drive started no upload session")
+	}
+	saveResumePoint(localPath, resumePoint{Server: server, Temp: session, Size: fi.Size(), ModTime: fi.ModTime()})
+	return session, 0, nil, nil
+}
+
+// uploadStatus asks how much of the size bytes Drive has in session, and
+// returns the file when it's all there
+func (u gdriveUploader) uploadStatus(ctx context.Context, session string, size int64) (int64, *gdriveFile, error) {
+	header := http.Header{"Content-Range": {fmt.Sprintf("bytes */%d", size)}}
+	resp, body, err := u.do(ctx, http.MethodPut, session, header, nil, 0)
+	if err != nil {
+		return 0, nil, err
+	}
+	if resp.StatusCode == http.StatusPermanentRedirect {
+		return receivedBytes(resp.Header.Get("Range")), nil, nil
+	}
+	var file gdriveFile
+	if err := json.Unmarshal(body, &file); err != nil {
+		return 0, nil, fmt.Errorf("bad answer from Google Drive: %w", err)
+	}
+	return size, &file, nil
+}
+
+// receivedBytes reads how many bytes Drive has from the Range header of an
+// unfinished upload, "bytes=0-1023" for 1024
+func receivedBytes(rangeHeader string) int64 {
+	i := strings.LastIndex(rangeHeader, "-")
+	if i < 0 {
+		return 0
+	}
+	last, err := strconv.ParseInt(rangeHeader[i+1:], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return last + 1
+}
+
+// send uploads f from offset on into session. The file is nil when Drive
+// didn't keep everything.
+func (u gdriveUploader) send(ctx context.Context, session string, f *os.File, offset, size int64, t *transfer) (*gdriveFile, error) {
+	header := http.Header{"Content-Range": {fmt.Sprintf("bytes */%d", size)}}
+	if size > 0 {
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, size-1, size))
+	}
+	atomic.StoreInt64(&t.done, offset)
+	body := progressTracker{limitedReader{io.NewSectionReader(f, offset, size-offset), uploadLimiter}, t}
+	resp, respBody, err := u.do(ctx, http.MethodPut, session, header, body, size-offset)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusPermanentRedirect {
+		return nil, nil
+	}
+	var file gdriveFile
+	if err := json.Unmarshal(respBody, &file); err != nil {
+		return nil, fmt.Errorf("bad answer from Google Drive: %w", err)
+	}
+	return &file, nil
+}
+
+// finishUpload checks the uploaded file, gives it remoteName when it comes
+// from an earlier upload of the same file and shares it
+func (u gdriveUploader) finishUpload(ctx context.Context, f *os.File, fi os.FileInfo, file *gdriveFile, remoteName string) error {
+	if file.Size != fi.Size() {
+		return &sizeMismatchError{Name: file.Name, Got: file.Size, Local: fi.Size()}
+	}
+	if u.opts.Verify == verifySHA256 {
+		if file.SHA256 == "" {
+			log.Printf("warning: Google Drive has no checksum of %s; only its size was checked", file.Name)
+		} else {
+			sum, err := localSHA256(ctx, f, fi.Size())
+			if err != nil {
+				return err
+			}
+			if sum != file.SHA256 {
+				return &checksumMismatchError{Name: file.Name, Got: file.SHA256, Local: sum}
+			}
+		}
+	}
+	if file.Name != remoteName {
+		metadata, err := json.Marshal(map[string]string{"name": remoteName})
+		if err != nil {
+			return err
+		}
+		header := http.Header{"Content-Type": {"application/json; charset=UTF-8"}}
+		if _, _, err := u.do(ctx, http.MethodPatch, gdriveAPI+"/files/"+file.ID+"?supportsAllDrives=true", header, bytes.NewReader(metadata), int64(len(metadata))); err != nil {
+			return err
+		}
+	}
+
+	permission := []byte(`{"role":"reader","type":"anyone"}`)
+	header := http.Header{"Content-Type": {"application/json; charset=UTF-8"}}
+	if _, _, err := u.do(ctx, http.MethodPost, gdriveAPI+"/files/"+file.ID+"/permissions?supportsAllDrives=true", header, bytes.NewReader(permission), int64(len(permission))); err != nil {
+		return fmt.Errorf("%s was uploaded but can't be shared: %w", remoteName, err)
+	}
+	return nil
+}
+
+// find looks up the file called remoteName in the folder
+func (u gdriveUploader) find(ctx context.Context, remoteName string) (gdriveFile, error) {
+	quote := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	q := url.Values{
+		"q":                         {fmt.Sprintf("name = '%s' and '%s' in parents and trashed = false", quote.Replace(remoteName), quote.Replace(u.parent()))},
+		"fields":                    {"files(" + gdriveFields + ")"},
+		"supportsAllDrives":         {"true"},
+		"includeItemsFromAllDrives": {"true"},
+	}
+	_, body, err := u.do(ctx, http.MethodGet, gdriveAPI+"/files?"+q.Encode(), nil, nil, 0)
+	if err != nil {
+		return gdriveFile{}, err
+	}
+	var list struct {
+		Files []gdriveFile `json:"files"`
+	}
+	if err := json.Unmarshal(body, &list); err != nil {
+		return gdriveFile{}, fmt.Errorf("bad answer from Google Drive: %w", err)
+	}
+	if len(list.Files) == 0 {
+		return gdriveFile{}, os.ErrNotExist
+	}
+	return list.Files[0], nil
+}
+
+// delete deletes the file with the ID id for good
+func (u gdriveUploader) delete(ctx context.Context, id string) error {
+	_, _, err := u.do(ctx, http.MethodDelete, gdriveAPI+"/files/"+id+"?supportsAllDrives=true", nil, nil, 0)
+	return err
+}
+
+func (u gdriveUploader) remove(ctx context.Context, remoteName string) error {
+	file, err := u.find(ctx, remoteName)
+	if err != nil {
+		return err
+	}
+	return u.delete(ctx, file.ID)
+}
+
+func (u gdriveUploader) stat(ctx context.Context, remoteName string) (os.FileInfo, error) {
+	file, err := u.find(ctx, remoteName)
+	if err != nil {
+		return nil, err
+	}
+	return remoteFileInfo{name: remoteName, size: file.Size, modTime: file.ModifiedTime}, nil
+}
+
+// check makes sure Google takes the credentials and files can be added to
+// the folder
+func (u gdriveUploader) check(ctx context.Context) error {
+	if u.p.GDriveFolder == "" {
+		if _, _, err := u.do(ctx, http.MethodGet, gdriveAPI+"/about?fields=user(emailAddress)", nil, nil, 0); err != nil {
+			return fmt.Errorf("gdrive: %w", err)
+		}
+		return nil
+	}
+	_, body, err := u.do(ctx, http.MethodGet, gdriveAPI+"/files/"+url.PathEscape(u.p.GDriveFolder)+"?supportsAllDrives=true&fields=name,mimeType,capabilities(canAddChildren)", nil, nil, 0)
+	var apiErr *gdriveError
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound && u.p.GDriveCredentials == "" {
+		return fmt.Errorf("gdrive: %w; signed in on a device skrins only sees folders it created, leave gdrive_folder empty and run skrins auth for one", err)
+	}
+	if err != nil {
+		return fmt.Errorf("gdrive: %w", err)
+	}
+	var folder struct {
+		Name         string `json:"name"`
+		MimeType     string `json:"mimeType"`
+		Capabilities struct {
+			CanAddChildren bool `json:"canAddChildren"`
+		} `json:"capabilities"`
+	}
+	if err := json.Unmarshal(body, &folder); err != nil {
+		return fmt.Errorf("gdrive: bad answer: %w", err)
+	}
+	if folder.MimeType != "application/vnd.google-apps.folder" {
+		return fmt.Errorf("gdrive: gdrive_folder %s is %q, not a folder", u.p.GDriveFolder, folder.Name)
+	}
+	if !folder.Capabilities.CanAddChildren {
+		return fmt.Errorf("gdrive: Google Drive permission denied: files can't be added to %q", folder.Name)
+	}
+	return nil
+}
+
+// credentials are what access tokens come from: the service account key
+// gdrive_credentials, or the refresh token skrins auth saved
+func (u gdriveUploader) credentials() (*gcpCredentials, error) {
+	if u.p.GDriveCredentials != "" {
+		creds, err := loadGCPCredentials(u.p.GDriveCredentials, os.Getenv)
+		if err != nil {
+			return nil, err
+		}
+		creds.scope = gdriveScope
+		return creds, nil
+	}
+	refresh, err := cachedSecret(u.p.GDriveToken, gdriveLabel("token"))
+	if err != nil {
+		return nil, fmt.Errorf("%w; run skrins auth to sign in", err)
+	}
+	secret, err := cachedSecret(u.p.GDriveClientSecret, gdriveLabel("client secret"))
+	if err != nil {
+		return nil, err
+	}
+	// errors name the reference, unless it's the token itself
+	path := u.p.GDriveToken
+	if !strings.Contains(path, ":") {
+		path = "gdrive_token"
+	}
+	return &gcpCredentials{
+		Type:         "authorized_user",
+		ClientID:     u.p.GDriveClientID,
+		ClientSecret: secret,
+		RefreshToken: refresh,
+		TokenURI:     googleTokenURL,
+		path:         path,
+	}, nil
+}
+
+// do makes an authorized request and returns the response with its body.
+// Answers of 400 and more are a *gdriveError.
+func (u gdriveUploader) do(ctx context.Context, method, target string, header http.Header, body io.Reader, length int64) (*http.Response, []byte, error) {
+	creds, err := u.credentials()
+	if err != nil {
+		return nil, nil, err
+	}
+	token, err := creds.accessToken(ctx, httpClientFor(u.p))
+	var authErr *gcpAuthError
+	if errors.As(err, &authErr) && u.p.GDriveCredentials == "" && !authErr.temporary() {
+		return nil, nil, fmt.Errorf("%w; run skrins auth to sign in again", err)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	req = req.WithContext(ctx)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.ContentLength = length
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := httpClientFor(u.p).Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode >= 400 {
+		return nil, nil, gdriveErrorFrom(resp, respBody)
+	}
+	return resp, respBody, nil
+}
+
+// gdriveErrorFrom reads the error in a failed response of the Drive API
+func gdriveErrorFrom(resp *http.Response, body []byte) *gdriveError {
+	e := &gdriveError{Status: resp.StatusCode, Wait: retryAfterHeader(resp.Header, time.Now())}
+	var answer struct {
+		Error struct {
+			Message string `json:"message"`
+			Errors  []struct {
+				Reason string `json:"reason"`
+			} `json:"errors"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &answer) == nil && answer.Error.Message != "" {
+		e.Message = answer.Error.Message
+		if len(answer.Error.Errors) > 0 {
+			e.Reason = answer.Error.Errors[0].Reason
+		}
+	} else {
+		e.Message = shorten(strings.TrimSpace(string(body)), 200)
+	}
+	return e
+}
+
+// runAuth implements `skrins auth`: it signs in, on this or another device,
+// to Google Drive for every gdrive profile without a service account and
+// to OneDrive for every onedrive profile, and saves the refresh tokens to
+// where gdrive_token and onedrive_token point.
+func runAuth(args []string) error {
+	var c settings
+	fs := flag.NewFlagSet("auth", flag.ExitOnError)
+	fs.StringVar(&c.ConfigFile, "config", "", "Path to config file, overrides the lookup")
+	fs.StringVar(&c.ProfileName, "profile", "", "Name of the config file profile to sign in for (default default_profile)")
+	fs.Parse(args)
+
+	s, err := loadSettings(c, os.Getenv)
+	if err != nil {
+		return err
+	}
+	profiles := map[string]profile{}
+	for name, p := range s.RuleProfiles {
+		profiles[name] = p
+	}
+	name := s.ProfileName
+	if name == "" {
+		name = "default"
+	}
+	profiles[name] = s.Profile
+	var names []string
+	for name, p := range profiles {
+		if (p.Backend == backendGDrive && p.GDriveCredentials == "") || p.Backend == backendOneDrive {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("no profile signs in to Google Drive with gdrive_client_id or to OneDrive, nothing to do")
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		p := profiles[name]
+		auth := gdriveAuth
+		if p.Backend == backendOneDrive {
+			fmt.Printf("Signing in to OneDrive for profile %s\n", name)
+			auth = onedriveAuth
+		} else {
+			fmt.Printf("Signing in to Google Drive for profile %s\n", name)
+		}
+		if err := auth(name, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gdriveAuth signs in to Google Drive for the profile called name, saves
+// the refresh token where gdrive_token points to and, without
+// gdrive_folder, creates a folder to upload to
+func gdriveAuth(name string, p profile) error {
+	secret, err := resolveSecret(p.GDriveClientSecret, gdriveLabel("client secret"), true)
+	if err != nil {
+		return err
+	}
+	refresh, err := gdriveDeviceFlow(httpClientFor(p), p.GDriveClientID, secret)
+	if err != nil {
+		return fmt.Errorf("profile %s: %w", name, err)
+	}
+	if err := storeSecret(p.GDriveToken, gdriveLabel("token"), refresh); err != nil {
+		return fmt.Errorf("profile %s: %w", name, err)
+	}
+	fmt.Println("Saved the token to", p.GDriveToken)
+
+	if p.GDriveFolder == "" {
+		u := gdriveUploader{p: p}
+		metadata := []byte(`{"name":"skrins","mimeType":"application/vnd.google-apps.folder"}`)
+		header := http.Header{"Content-Type": {"application/json; charset=UTF-8"}}
+		_, body, err := u.do(context.Background(), http.MethodPost, gdriveAPI+"/files?fields=id", header, bytes.NewReader(metadata), int64(len(metadata)))
+		if err != nil {
+			return fmt.Errorf("profile %s: creating a folder: %w", name, err)
+		}
+		var folder gdriveFile
+		if err := json.Unmarshal(body, &folder); err != nil {
+			return fmt.Errorf("profile %s: creating a folder: %w", name, err)
+		}
+		fmt.Printf("Created the folder skrins in your Drive, upload to it with\n\n\tgdrive_folder = %q\n\n", folder.ID)
+	}
+	return nil
+}
+
+// gdriveDeviceFlow signs in with Google's flow for devices without a
+// browser: the user enters a code on another device, in the meantime the
+// token endpoint is polled. It returns the refresh token. See
+// https://developers.google.com/identity/protocols/oauth2/limited-input-device
+func gdriveDeviceFlow(client *http.Client, clientID, clientSecret string) (string, error) {
+	var code struct {
+		DeviceCode      string `json:"device_code"`
+		UserCode        string `json:"user_code"`
+		VerificationURL string `json:"verification_url"`
+		ExpiresIn       int    `json:"expires_in"`
+		Interval        int    `json:"interval"`
+	}
+	status, err := postForm(client, googleDeviceCode, url.Values{"client_id": {clientID}, "scope": {gdriveFileScope}}, &code)
+	if err != nil {
+		return "", err
+	}
+	if status != http.StatusOK {
+		return "", fmt.Errorf("Google turned down the sign in with %d %s, gdrive_client_id has to be of a \"TVs and Limited Input devices\" client", status, http.StatusText(status))
+	}
+	fmt.Printf("Open %s and enter the code %s\n", code.VerificationURL, code.UserCode)
+
+	form := url.Values{
+		"client_id":     {clientID},
+		"client_secret": {clientSecret},
+		"device_code":   {code.DeviceCode},
+		"grant_type":    {"urn:ietf:params:oauth:grant-type:device_code"},
+	}
+	return pollDeviceToken(client, googleTokenURL, form, code.Interval, code.ExpiresIn, "Google")
+}
+
+// pollDeviceToken polls the token endpoint of a device sign in every
+// interval seconds until the code was entered, for at most expiresIn
+// seconds, and returns the refresh token. provider names who signs in.
+func pollDeviceToken(client *http.Client, tokenURL string, form url.Values, interval, expiresIn int, provider string) (string, error) {
+	wait := time.Duration(interval) * time.Second
+	if wait <= 0 {
+		wait = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(expiresIn) * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(wait)
+		var token struct {
+			RefreshToken string `json:"refresh_token"`
+			Error        string `json:"error"`
+			Description  string `json:"error_description"`
+		}
+		if _, err := postForm(client, tokenURL, form, &token); err != nil {
+			return "", err
+		}
+		switch token.Error {
+		case "":
+			if token.RefreshToken == "" {
+				return "", fmt.Errorf("%s sent no refresh token", provider)
+			}
+			return token.RefreshToken, nil
+		case "authorization_pending":
+		case "slow_down":
+			wait += 5 * time.Second
+		case "access_denied", "authorization_declined":
+			return "", errors.New("the sign in was denied")
+		case "expired_token":
+			return "", errors.New("the code expired before it was entered")
+		default:
+			if token.Description != "" {
+				// Microsoft goes on with trace and correlation IDs
+				return "", fmt.Errorf("sign in failed: %s", strings.TrimSpace(strings.SplitN(token.Description, "\n", 2)[0]))
+			}
+			return "", fmt.Errorf("sign in failed: %s", token.Error)
+		}
+	}
+	return "", errors.New("the code expired before it was entered")
+}
+
+// postForm posts form to target and decodes the JSON answer into v
+func postForm(client *http.Client, target string, form url.Values, v interface{}) (int, error) {
+	resp, err := client.PostForm(target, form)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return resp.StatusCode, fmt.Errorf("bad answer from %s: %w", target, err)
+	}
+	return resp.StatusCode, nil
+}
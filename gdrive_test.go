@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// gdriveTestAPI points the Drive and Google sign in endpoints to a server
+// answering with respond, whose URL it returns
+func gdriveTestAPI(t *testing.T, respond func(w http.ResponseWriter, r recordedRequest)) (string, *requestLog) {
+	srv, log := recordingServer(t, respond)
+	oldAPI, oldUpload, oldDevice, oldToken := gdriveAPI, gdriveUploadAPI, googleDeviceCode, googleTokenURL
+	gdriveAPI, gdriveUploadAPI = srv.URL+"/drive/v3", srv.URL+"/upload/drive/v3"
+	googleDeviceCode, googleTokenURL = srv.URL+"/device/code", srv.URL+"/token"
+	gcpTokens.Lock()
+	oldTokens := gcpTokens.m
+	gcpTokens.m = map[string]oauthToken{}
+	gcpTokens.Unlock()
+	t.Cleanup(func() {
+		gdriveAPI, gdriveUploadAPI, googleDeviceCode, googleTokenURL = oldAPI, oldUpload, oldDevice, oldToken
+		gcpTokens.Lock()
+		gcpTokens.m = oldTokens
+		gcpTokens.Unlock()
+	})
+	tempStateDir(t)
+	setEnv(t, "SKRINS_TEST_GDRIVE_TOKEN", "r3fr3sh")
+	setEnv(t, "SKRINS_TEST_GDRIVE_SECRET", "s3cr3t")
+	return srv.URL, log
+}
+
+// gdriveTestUploader signs in with a refresh token and uploads to the
+// folder f0ld3r
+func gdriveTestUploader() gdriveUploader {
+	return gdriveUploader{p: testProfile(profile{
+		Backend:            backendGDrive,
+		GDriveClientID:     "c1i3nt",
+		GDriveClientSecret: "env:SKRINS_TEST_GDRIVE_SECRET",
+		GDriveToken:        "env:SKRINS_TEST_GDRIVE_TOKEN",
+		GDriveFolder:       "f0ld3r",
+	})}
+}
+
+const gdriveUploaded = `{"id":"f1l3","name":"Zr8tW.png","size":"3","webContentLink":"https://drive.google.com/uc?id=f1l3&export=download"}`
+
+func TestGDriveUpload(t *testing.T) {
+	var base string
+	base, log := gdriveTestAPI(t, func(w http.ResponseWriter, r recordedRequest) {
+		switch {
+		case r.Path == "/token":
+			fmt.Fprint(w, `{"access_token":"acc3ss","expires_in":3600}`)
+		case r.Path == "/upload/drive/v3/files":
+			w.Header().Set("Location", base+"/upload/session/1")
+		case r.Path == "/upload/session/1":
+			fmt.Fprint(w, gdriveUploaded)
+		case r.Path == "/drive/v3/files/f1l3/permissions":
+			fmt.Fprint(w, `{"id":"anyoneWithLink"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	link, err := gdriveTestUploader().upload(context.Background(), uploadTestFile(t, "shot.png", []byte("png")), "Zr8tW.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link != "https://drive.google.com/uc?id=f1l3&export=download" {
+		t.Errorf("link = %s, want the file's webContentLink", link)
+	}
+
+	reqs := log.all()
+	var paths []string
+	for _, r := range reqs {
+		paths = append(paths, r.Method+" "+r.Path)
+	}
+	if want := "POST /token, POST /upload/drive/v3/files, PUT /upload/session/1, POST /drive/v3/files/f1l3/permissions"; strings.Join(paths, ", ") != want {
+		t.Fatalf("requests %s, want %s", strings.Join(paths, ", "), want)
+	}
+	if form := string(reqs[0].Body); !strings.Contains(form, "grant_type=refresh_token") || !strings.Contains(form, "refresh_token=r3fr3sh") {
+		t.Errorf("token request %s, want the refresh token traded", form)
+	}
+	var metadata struct {
+		Name    string   `json:"name"`
+		Parents []string `json:"parents"`
+	}
+	start := reqs[1]
+	json.Unmarshal(start.Body, &metadata)
+	if start.Query.Get("uploadType") != "resumable" || metadata.Name != "Zr8tW.png" || len(metadata.Parents) != 1 || metadata.Parents[0] != "f0ld3r" {
+		t.Errorf("session started with %v and %s", start.Query, start.Body)
+	}
+	if start.Header.Get("X-Upload-Content-Length") != "3" || start.Header.Get("Authorization") != "Bearer acc3ss" {
+		t.Errorf("session started with %v", start.Header)
+	}
+	if put := reqs[2]; string(put.Body) != "png" || put.Header.Get("Content-Range") != "bytes 0-2/3" {
+		t.Errorf("sent %q as %s", put.Body, put.Header.Get("Content-Range"))
+	}
+	// shared with anyone who has the link
+	var permission map[string]string
+	json.Unmarshal(reqs[3].Body, &permission)
+	if permission["role"] != "reader" || permission["type"] != "anyone" {
+		t.Errorf("shared with %v", permission)
+	}
+}
+
+// what Drive kept of a session is asked for and the rest sent again
+func TestGDriveResumableSession(t *testing.T) {
+	var base string
+	puts := 0
+	base, log := gdriveTestAPI(t, func(w http.ResponseWriter, r recordedRequest) {
+		switch r.Path {
+		case "/token":
+			fmt.Fprint(w, `{"access_token":"acc3ss","expires_in":3600}`)
+		case "/upload/drive/v3/files":
+			w.Header().Set("Location", base+"/upload/session/1")
+		case "/upload/session/1":
+			puts++
+			if puts < 3 {
+				// two of the three bytes arrived
+				w.Header().Set("Range", "bytes=0-1")
+				w.WriteHeader(http.StatusPermanentRedirect)
+				return
+			}
+			fmt.Fprint(w, gdriveUploaded)
+		default:
+			fmt.Fprint(w, `{}`)
+		}
+	})
+	if _, err := gdriveTestUploader().upload(context.Background(), uploadTestFile(t, "shot.png", []byte("png")), "Zr8tW.png"); err != nil {
+		t.Fatal(err)
+	}
+	var ranges []string
+	for _, r := range log.all() {
+		if r.Path == "/upload/session/1" {
+			ranges = append(ranges, r.Header.Get("Content-Range")+" "+string(r.Body))
+		}
+	}
+	if want := "bytes 0-2/3 png, bytes */3 , bytes 2-2/3 g"; strings.Join(ranges, ", ") != want {
+		t.Errorf("sent %s, want %s", strings.Join(ranges, ", "), want)
+	}
+}
+
+// a full Drive and a folder that can't be written to are different errors,
+// neither of which goes away by trying again
+func TestGDriveForbidden(t *testing.T) {
+	tests := []struct {
+		reason, message string
+		want            string
+		temporary       bool
+	}{
+		{"storageQuotaExceeded", "The user's Drive storage quota has been exceeded.", "Google Drive quota exceeded: The user's Drive storage quota has been exceeded", false},
+		{"insufficientPermissions", "Insufficient Permission: Request had insufficient authentication scopes.", "Google Drive permission denied: Insufficient Permission: Request had insufficient authentication scopes", false},
+		{"userRateLimitExceeded", "User rate limit exceeded.", "Google Drive rate limit reached: User rate limit exceeded", true},
+	}
+	for _, tt := range tests {
+		gdriveTestAPI(t, func(w http.ResponseWriter, r recordedRequest) {
+			if r.Path == "/token" {
+				fmt.Fprint(w, `{"access_token":"acc3ss","expires_in":3600}`)
+				return
+			}
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, `{"error":{"code":403,"message":%q,"errors":[{"domain":"usageLimits","reason":%q}]}}`, tt.message, tt.reason)
+		})
+		_, err := gdriveTestUploader().upload(context.Background(), uploadTestFile(t, "shot.png", []byte("png")), "Zr8tW.png")
+		var apiErr *gdriveError
+		if !errors.As(err, &apiErr) || apiErr.Reason != tt.reason {
+			t.Errorf("%s: %v, want a gdriveError", tt.reason, err)
+			continue
+		}
+		if err.Error() != tt.want || apiErr.temporary() != tt.temporary {
+			t.Errorf("%s: %q, temporary %t, want %q, %t", tt.reason, err, apiErr.temporary(), tt.want, tt.temporary)
+		}
+	}
+}
+
+// a refresh token Google turned down needs signing in again
+func TestGDriveTokenRevoked(t *testing.T) {
+	gdriveTestAPI(t, func(w http.ResponseWriter, r recordedRequest) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":"invalid_grant","error_description":"Token has been expired or revoked."}`)
+	})
+	err := gdriveTestUploader().check(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "Token has been expired or revoked") || !strings.Contains(err.Error(), "run skrins auth to sign in again") {
+		t.Errorf("check: %v, want to sign in again", err)
+	}
+}
+
+func TestGDriveDeviceFlow(t *testing.T) {
+	polls := 0
+	_, log := gdriveTestAPI(t, func(w http.ResponseWriter, r recordedRequest) {
+		switch r.Path {
+		case "/device/code":
+			fmt.Fprint(w, `{"device_code":"d3v1c3","user_code":"ABCD-EFGH","verification_url":"https://www.google.com/device","expires_in":60,"interval":1}`)
+		case "/token":
+			if polls++; polls == 1 {
+				w.WriteHeader(http.StatusPreconditionRequired)
+				fmt.Fprint(w, `{"error":"authorization_pending","error_description":"Precondition Required"}`)
+				return
+			}
+			fmt.Fprint(w, `{"access_token":"acc3ss","expires_in":3600,"refresh_token":"r3fr3sh"}`)
+		}
+	})
+	refresh, err := gdriveDeviceFlow(http.DefaultClient, "c1i3nt", "s3cr3t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refresh != "r3fr3sh" || polls != 2 {
+		t.Errorf("refresh token %q after %d polls, want r3fr3sh after 2", refresh, polls)
+	}
+	reqs := log.all()
+	if form := string(reqs[0].Body); !strings.Contains(form, "client_id=c1i3nt") || !strings.Contains(form, "drive.file") {
+		t.Errorf("asked for a code with %s, want the drive.file scope", form)
+	}
+	if form := string(reqs[1].Body); !strings.Contains(form, "device_code=d3v1c3") || !strings.Contains(form, "client_secret=s3cr3t") {
+		t.Errorf("polled with %s", form)
+	}
+}
@@ -4,10 +4,14 @@ go 1.14
 
 require (
 	github.com/0xAX/notificator v0.0.0-20191016112426-3962a5ea8da1
+	github.com/BurntSushi/toml v0.3.1
 	github.com/atotto/clipboard v0.1.2
 	github.com/fsnotify/fsnotify v1.4.9
+	github.com/kevinburke/ssh_config v1.1.0
 	github.com/lithammer/shortuuid/v3 v3.0.4
 	github.com/pkg/sftp v1.11.0
 	golang.org/x/crypto v0.0.0-20200323165209-0ec3e9974c59
-	golang.org/x/sys v0.0.0-20200501145240-bc7a7d42d5c3 // indirect
+	golang.org/x/net v0.0.0-20200520004742-59133d7f0dd7
+	golang.org/x/sys v0.0.0-20200501145240-bc7a7d42d5c3
+	golang.org/x/text v0.3.7
 )
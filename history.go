@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// historyFile is the upload history in the state directory, one JSON
+// object per line, only ever appended to
+const historyFile = "history.jsonl"
+
+// What became of a file, the Status of a historyEntry. A bundled one was
+// uploaded in a zip with others, the URL is the zip's. A disposed one was
+// kept for delete_after after its upload and is gone now, as the entry
+// says.
+const (
+	historyUploaded  = "uploaded"
+	historyDuplicate = "duplicate"
+	historyPartial   = "partial"
+	historyBundled   = "bundled"
+	historyFailed    = "failed"
+	historyDisposed  = "disposed"
+)
+
+// historyEntry is a file skrins uploaded, was to upload or found uploaded
+// already
+type historyEntry struct {
+	Time   time.Time `json:"time"`
+	Status string    `json:"status"`
+	// File is the local path, Remote the name it got on the server, with the
+	// folders date_dirs put it in
+	File    string `json:"file"`
+	Remote  string `json:"remote,omitempty"`
+	Profile string `json:"profile"`
+	Backend string `json:"backend"`
+	Size    int64  `json:"size"`
+	SHA256  string `json:"sha256,omitempty"`
+	URL     string `json:"url,omitempty"`
+	// Expires is when URL stops working, nil when it doesn't or when only
+	// the file host knows
+	Expires *time.Time `json:"expires,omitempty"`
+	Error   string     `json:"error,omitempty"`
+	// Kept tells that the local file was left where it is, see keep_local,
+	// Trashed that it's in the trash and Archived where it was moved to
+	// with archive_dir
+	Kept     bool   `json:"kept,omitempty"`
+	Trashed  bool   `json:"trashed,omitempty"`
+	Archived string `json:"archived,omitempty"`
+	// DeleteAt is when the file kept for delete_after was to go, an entry
+	// with historyDisposed tells when it did
+	DeleteAt *time.Time `json:"delete_at,omitempty"`
+	// Quarantined is where a file that kept failing was moved to, see
+	// failedDir
+	Quarantined string `json:"quarantined,omitempty"`
+}
+
+// historyMu guards appending to the history file within the process
+var historyMu sync.Mutex
+
+// historyEntryFor starts the history entry of the file at path uploaded
+// with s
+func historyEntryFor(s *settings, path string, f os.FileInfo, digest string) historyEntry {
+	e := historyEntry{File: path, Profile: s.ProfileName, Backend: s.Profile.Backend, Size: f.Size(), SHA256: digest}
+	if e.Profile == "" {
+		e.Profile = "default"
+	}
+	if e.Backend == "" {
+		e.Backend = backendSFTP
+	}
+	return e
+}
+
+// appendHistory adds e to the history. Each entry goes out in a single
+// write to the file opened for appending, so entries of several skrins
+// running at once don't interleave.
+func appendHistory(e historyEntry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("can't record %s in the history: %v", e.File, err)
+		return
+	}
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	dir := stateDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Printf("can't record %s in the history: %v", e.File, err)
+		return
+	}
+	f, err := os.OpenFile(filepath.Join(dir, historyFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Printf("can't record %s in the history: %v", e.File, err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		log.Printf("can't record %s in the history: %v", e.File, err)
+		return
+	}
+	rememberUpload(e)
+}
+
+// readHistory calls each with every entry of the history, oldest first.
+// Lines that don't parse, like one cut short by a crash, are skipped.
+func readHistory(each func(historyEntry)) error {
+	f, err := os.Open(filepath.Join(stateDir(), historyFile))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	skipped := 0
+	for sc.Scan() {
+		var e historyEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			skipped++
+			continue
+		}
+		each(e)
+	}
+	if skipped > 0 {
+		debugf("skipped %d broken lines of %s", skipped, historyFile)
+	}
+	return sc.Err()
+}
+
+// loadHistory reads the history at startup, for what the files uploaded
+// before are needed for
+func loadHistory() {
+	n := 0
+	err := readHistory(func(e historyEntry) {
+		n++
+		rememberUpload(e)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("can't read the upload history: %v", err)
+		return
+	}
+	debugf("%d uploads in the history", n)
+}
+
+// lastUploaded is the last entry of the history with a URL, false when
+// there's none
+func lastUploaded() (historyEntry, bool, error) {
+	var last historyEntry
+	found := false
+	err := readHistory(func(e historyEntry) {
+		if e.URL != "" && e.Status != historyFailed {
+			last, found = e, true
+		}
+	})
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return last, found, err
+}
+
+// runHistory implements `skrins history`: it prints the last entries of the
+// history, oldest first, with where the local file went
+func runHistory(args []string) error {
+	var n int
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	fs.IntVar(&n, "n", 20, "How many entries to print, 0 for all")
+	fs.Parse(args)
+
+	var entries []historyEntry
+	err := readHistory(func(e historyEntry) {
+		entries = append(entries, e)
+		if n > 0 && len(entries) > n {
+			entries = entries[1:]
+		}
+	})
+	if os.IsNotExist(err) {
+		return fmt.Errorf("nothing uploaded yet")
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		what := e.URL
+		switch e.Status {
+		case historyFailed:
+			what = e.Error
+		case historyDisposed:
+			what = "kept for delete_after"
+		}
+		where := e.File + ", deleted"
+		switch {
+		case e.DeleteAt != nil:
+			where = e.File + ", kept until " + e.DeleteAt.Local().Format("2006-01-02 15:04")
+		case e.Quarantined != "":
+			where = e.File + ", moved to " + e.Quarantined
+		case e.Archived != "":
+			where = e.File + ", archived at " + e.Archived
+		case e.Trashed:
+			where = e.File + ", in the trash"
+		case e.Kept || e.Status == historyFailed:
+			where = e.File
+		}
+		fmt.Printf("%s  %-9s  %s\n    %s\n", e.Time.Local().Format("2006-01-02 15:04"), e.Status, what, where)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// hostKeyCallback verifies the server's key against p's known_hosts file,
+// or accepts anything when insecure_host_key is set. It also returns the
+// key algorithms known_hosts has for addr, so the server is asked for a key
+// that can actually be verified.
+func hostKeyCallback(p profile, addr string) (ssh.HostKeyCallback, []string, error) {
+	if isTrue(p.InsecureHostKey) {
+		return ssh.InsecureIgnoreHostKey(), nil, nil
+	}
+
+	check, err := knownhosts.New(p.KnownHosts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("known hosts: %w", err)
+	}
+
+	callback := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := check(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+		fingerprint := key.Type() + " " + ssh.FingerprintSHA256(key)
+		if len(keyErr.Want) == 0 {
+			return fmt.Errorf("host key of %s is not in %s, server offered %s; add it with `ssh-keyscan` or by connecting with ssh once", hostname, p.KnownHosts, fingerprint)
+		}
+		var known []string
+		for _, k := range keyErr.Want {
+			known = append(known, fmt.Sprintf("%s %s (%s:%d)", k.Key.Type(), ssh.FingerprintSHA256(k.Key), k.Filename, k.Line))
+		}
+		return fmt.Errorf("HOST KEY MISMATCH for %s: server offered %s but known hosts has %s, refusing to upload", hostname, fingerprint, strings.Join(known, ", "))
+	}
+
+	return callback, knownKeyTypes(check, addr), nil
+}
+
+// knownKeyTypes lists the key types known_hosts has for addr. knownhosts
+// has no lookup function, but checking a key no entry can match makes it
+// report every key it has for the host.
+func knownKeyTypes(check ssh.HostKeyCallback, addr string) []string {
+	remote, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		remote = &net.TCPAddr{}
+	}
+	var keyErr *knownhosts.KeyError
+	if !errors.As(check(addr, remote, probeKey{}), &keyErr) {
+		return nil
+	}
+
+	var types []string
+	for _, k := range keyErr.Want {
+		if !contains(types, k.Key.Type()) {
+			types = append(types, k.Key.Type())
+		}
+	}
+	return types
+}
+
+// probeKey is a public key that never matches anything
+type probeKey struct{}
+
+func (probeKey) Type() string                                 { return "skrins-probe" }
+func (probeKey) Marshal() []byte                              { return []byte("skrins-probe") }
+func (probeKey) Verify(data []byte, sig *ssh.Signature) error { return errors.New("probe key") }
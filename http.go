@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// httpUploader posts files as a multipart form to http_url, like the
+// upload forms of simple file hosts, and takes the URL from the response
+type httpUploader struct {
+	p    profile
+	opts uploadOptions
+}
+
+// httpStatusError is a response outside 2xx. Body is what the server said,
+// cut short.
+type httpStatusError struct {
+	Status int
+	Body   string
+}
+
+func (e *httpStatusError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("server answered %d %s", e.Status, http.StatusText(e.Status))
+	}
+	return fmt.Sprintf("server answered %d %s: %s", e.Status, http.StatusText(e.Status), e.Body)
+}
+
+// temporary tells whether trying again may help, i.e. the server was busy
+func (e *httpStatusError) temporary() bool {
+	return e.Status >= 500 || e.Status == http.StatusTooManyRequests || e.Status == http.StatusRequestTimeout
+}
+
+// httpProblems checks the settings of an http profile
+func httpProblems(p profile) []string {
+	var problems []string
+	if u, err := url.Parse(p.HTTPURL); p.HTTPURL != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+		problems = append(problems, fmt.Sprintf("http_url: %q is not an http or https URL", p.HTTPURL))
+	}
+	if p.HTTPURLJSON != "" && p.HTTPURLRegex != "" {
+		problems = append(problems, "only one of http_url_json and http_url_regex can be set")
+	}
+	if _, err := regexp.Compile(p.HTTPURLRegex); err != nil {
+		problems = append(problems, fmt.Sprintf("http_url_regex: %v", err))
+	}
+	return problems
+}
+
+// headerLabel describes a header in prompts and errors
+func headerLabel(p profile, name string) string {
+	return fmt.Sprintf("header %s for %s", name, p.HTTPURL)
+}
+
+func (u httpUploader) upload(ctx context.Context, localPath, remoteName string) (string, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if err := checkPresetSize(u.p, localPath, fi.Size()); err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, u.p.TransferTimeout.Duration)
+	defer cancel()
+	t := startTransfer(localPath, fi.Size(), 0, u.opts.Progress)
+	defer t.finish()
+	ctx, stalled := watchStall(ctx, t, u.p.StallTimeout.Duration)
+
+	file := progressTracker{limitedReader{f, uploadLimiter}, t}
+	body, length, formType, err := multipartBody(u.p.HTTPForm, u.p.HTTPField, remoteName, file, fi.Size())
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodPost, u.p.HTTPURL, body)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = length
+	req.Header.Set("Content-Type", formType)
+	for name, ref := range u.p.HTTPHeaders {
+		value, err := cachedSecret(ref, headerLabel(u.p, name))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set(name, value)
+	}
+
+	resp, err := httpClientFor(u.p).Do(req)
+	var respBody []byte
+	if err == nil {
+		respBody, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if stalled() {
+		return "", &timeoutError{Op: "stall", Host: req.URL.Host, After: u.p.StallTimeout.Duration}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", &timeoutError{Op: "transfer", Host: req.URL.Host, After: u.p.TransferTimeout.Duration, Err: err}
+	}
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode/100 != 2 {
+		log.Printf("%s answered %s: %s", u.p.HTTPURL, resp.Status, respBody)
+		return "", &httpStatusError{Status: resp.StatusCode, Body: shorten(strings.TrimSpace(string(respBody)), 200)}
+	}
+
+	link, err := u.extractURL(respBody)
+	if err != nil {
+		log.Printf("%s answered: %s", u.p.HTTPURL, respBody)
+		return "", err
+	}
+	log.Println(t.summary())
+	return link, nil
+}
+
+// multipartBody is a form with fields and the size bytes of file as field,
+// named after remoteName. It's streamed with its length known up front,
+// some servers don't take chunked uploads.
+func multipartBody(fields map[string]string, field, remoteName string, file io.Reader, size int64) (io.Reader, int64, string, error) {
+	var head bytes.Buffer
+	form := multipart.NewWriter(&head)
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := form.WriteField(name, fields[name]); err != nil {
+			return nil, 0, "", err
+		}
+	}
+	part := textproto.MIMEHeader{}
+	part.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, quoteEscaper.Replace(field), quoteEscaper.Replace(path.Base(remoteName))))
+	part.Set("Content-Type", contentType(remoteName))
+	if _, err := form.CreatePart(part); err != nil {
+		return nil, 0, "", err
+	}
+	tail := "\r\n--" + form.Boundary() + "--\r\n"
+	body := io.MultiReader(&head, file, strings.NewReader(tail))
+	return body, int64(head.Len()) + size + int64(len(tail)), form.FormDataContentType(), nil
+}
+
+// extractURL finds the uploaded file's URL in the response: at the JSON
+// path http_url_json, in the first group of http_url_regex, or else the
+// whole body
+func (u httpUploader) extractURL(body []byte) (string, error) {
+	var link string
+	switch {
+	case u.p.HTTPURLJSON != "":
+		var v interface{}
+		if err := json.Unmarshal(body, &v); err != nil {
+			return "", fmt.Errorf("response is not JSON: %v", err)
+		}
+		s, ok := jsonPath(v, u.p.HTTPURLJSON)
+		if !ok {
+			return "", fmt.Errorf("response has no string at %s", u.p.HTTPURLJSON)
+		}
+		link = s
+	case u.p.HTTPURLRegex != "":
+		m := regexp.MustCompile(u.p.HTTPURLRegex).FindSubmatch(body)
+		if m == nil {
+			return "", fmt.Errorf("response doesn't match %s", u.p.HTTPURLRegex)
+		}
+		link = string(m[0])
+		if len(m) > 1 {
+			link = string(m[1])
+		}
+	default:
+		link = string(body)
+	}
+	link = strings.TrimSpace(link)
+	if link == "" {
+		return "", errors.New("response has no URL")
+	}
+	return link, nil
+}
+
+// jsonPath looks up a dot separated path like files.0.url in a decoded JSON
+// value, numbers index arrays
+func jsonPath(v interface{}, path string) (string, bool) {
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			v = node[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return "", false
+			}
+			v = node[i]
+		default:
+			return "", false
+		}
+	}
+	s, ok := v.(string)
+	return s, ok
+}
+
+// retryAfterHeader is how long the Retry-After header of a response asks
+// to wait, given in seconds or as a date. It's 0 without one.
+func retryAfterHeader(h http.Header, now time.Time) time.Duration {
+	v := h.Get("Retry-After")
+	if n, err := strconv.Atoi(v); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// quoteEscaper escapes form field and file names like mime/multipart does
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// shorten cuts s to at most n bytes, marking that it was cut
+func shorten(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "…"
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// imgurAPI is where the Imgur API is, see https://apidocs.imgur.com
+var imgurAPI = "https://api.imgur.com/3"
+
+// imgurExtensions are the image types Imgur takes. Videos go through a
+// different, slower API and are left to fallback_profile.
+var imgurExtensions = []string{"jpg", "jpeg", "png", "gif", "apng", "tiff", "tif", "bmp", "webp"}
+
+// imgurUploader uploads images to Imgur and returns their i.imgur.com link.
+// The delete hash of every upload is kept in the state directory, so it can
+// be removed again without an account.
+type imgurUploader struct {
+	p    profile
+	opts uploadOptions
+}
+
+// imgurLabel describes an Imgur secret in prompts and errors
+func imgurLabel(what string) string {
+	return "Imgur " + what
+}
+
+// imgurError is an Imgur API error. Wait is how long the rate limit headers
+// say to hold off, 0 when they don't.
+type imgurError struct {
+	Status  int
+	Message string
+	Wait    time.Duration
+}
+
+func (e *imgurError) Error() string {
+	msg := fmt.Sprintf("imgur answered %d %s", e.Status, http.StatusText(e.Status))
+	if e.Message != "" {
+		msg += ": " + strings.TrimRight(e.Message, ".")
+	}
+	if e.Wait > 0 {
+		msg += fmt.Sprintf(", try again in %s", e.Wait.Round(time.Second))
+	}
+	return msg
+}
+
+// temporary tells whether trying again may help, i.e. Imgur is busy or the
+// rate limit is reached
+func (e *imgurError) temporary() bool {
+	return e.Status >= 500 || e.Status == http.StatusTooManyRequests
+}
+
+// retryAfter is how long to wait before trying again
+func (e *imgurError) retryAfter() time.Duration {
+	return e.Wait
+}
+
+// imgurWait reads how long to wait from the rate limit headers of a
+// response: Retry-After, then Imgur's own for the upload and the per user
+// limit
+func imgurWait(h http.Header, now time.Time) time.Duration {
+	if d := retryAfterHeader(h, now); d > 0 {
+		return d
+	}
+	if n, err := strconv.Atoi(h.Get("X-Post-Rate-Limit-Reset")); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	if h.Get("X-RateLimit-UserRemaining") == "0" {
+		if n, err := strconv.ParseInt(h.Get("X-RateLimit-UserReset"), 10, 64); err == nil && time.Unix(n, 0).After(now) {
+			return time.Unix(n, 0).Sub(now)
+		}
+	}
+	return 0
+}
+
+// imgurImage is what Imgur tells about an uploaded image
+type imgurImage struct {
+	ID         string `json:"id"`
+	Link       string `json:"link"`
+	DeleteHash string `json:"deletehash"`
+	Size       int64  `json:"size"`
+	Datetime   int64  `json:"datetime"`
+}
+
+func (u imgurUploader) supports(ext string) bool {
+	return contains(imgurExtensions, ext)
+}
+
+func (u imgurUploader) upload(ctx context.Context, localPath, remoteName string) (string, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, u.p.TransferTimeout.Duration)
+	defer cancel()
+	t := startTransfer(localPath, fi.Size(), 0, u.opts.Progress)
+	defer t.finish()
+	ctx, stalled := watchStall(ctx, t, u.p.StallTimeout.Duration)
+
+	file := progressTracker{limitedReader{f, uploadLimiter}, t}
+	body, length, formType, err := multipartBody(map[string]string{"type": "file"}, "image", remoteName, file, fi.Size())
+	if err != nil {
+		return "", err
+	}
+	header := http.Header{"Content-Type": {formType}}
+	var img imgurImage
+	err = u.do(ctx, http.MethodPost, "/image", header, body, length, &img)
+	if stalled() {
+		return "", &timeoutError{Op: "stall", Host: "api.imgur.com", After: u.p.StallTimeout.Duration}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", &timeoutError{Op: "transfer", Host: "api.imgur.com", After: u.p.TransferTimeout.Duration, Err: err}
+	}
+	if err != nil {
+		return "", err
+	}
+	if img.Link == "" {
+		return "", errors.New("imgur answered without a link")
+	}
+	log.Println(t.summary())
+
+	saveImgurImage(remoteName, img)
+	debugf("imgur delete hash of %s: %s", img.Link, img.DeleteHash)
+	return img.Link, nil
+}
+
+func (u imgurUploader) remove(ctx context.Context, remoteName string) error {
+	img, ok := imgurImageFor(remoteName)
+	if !ok {
+		return fmt.Errorf("no delete hash for %s", remoteName)
+	}
+	if err := u.do(ctx, http.MethodDelete, "/image/"+img.DeleteHash, nil, nil, 0, nil); err != nil {
+		return err
+	}
+	forgetImgurImage(remoteName)
+	return nil
+}
+
+func (u imgurUploader) stat(ctx context.Context, remoteName string) (os.FileInfo, error) {
+	img, ok := imgurImageFor(remoteName)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	var got imgurImage
+	err := u.do(ctx, http.MethodGet, "/image/"+img.ID, nil, nil, 0, &got)
+	var apiErr *imgurError
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return remoteFileInfo{name: remoteName, size: got.Size, modTime: time.Unix(got.Datetime, 0)}, nil
+}
+
+// check makes sure Imgur takes the client ID or token, and tells how many
+// uploads are left
+func (u imgurUploader) check(ctx context.Context) error {
+	var credits struct {
+		UserRemaining   int `json:"UserRemaining"`
+		ClientRemaining int `json:"ClientRemaining"`
+	}
+	if err := u.do(ctx, http.MethodGet, "/credits", nil, nil, 0, &credits); err != nil {
+		return fmt.Errorf("imgur: %w", err)
+	}
+	debugf("imgur credits left: %d for this address, %d for the client", credits.UserRemaining, credits.ClientRemaining)
+	return nil
+}
+
+// do makes an authenticated API request and decodes the data of the answer
+// into v, unless it's nil. Failures are an *imgurError.
+func (u imgurUploader) do(ctx context.Context, method, endpoint string, header http.Header, body io.Reader, length int64, v interface{}) error {
+	req, err := http.NewRequest(method, imgurAPI+endpoint, body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.ContentLength = length
+	if u.p.ImgurToken != "" {
+		token, err := cachedSecret(u.p.ImgurToken, imgurLabel("token"))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else {
+		id, err := cachedSecret(u.p.ImgurClientID, imgurLabel("client ID"))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Client-ID "+id)
+	}
+
+	resp, err := httpClientFor(u.p).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var answer struct {
+		Data    json.RawMessage `json:"data"`
+		Success bool            `json:"success"`
+	}
+	jsonErr := json.Unmarshal(respBody, &answer)
+	if resp.StatusCode/100 != 2 || jsonErr != nil || !answer.Success {
+		return &imgurError{Status: resp.StatusCode, Message: imgurMessage(answer.Data, respBody), Wait: imgurWait(resp.Header, time.Now())}
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(answer.Data, v)
+}
+
+// imgurMessage is the error in the data of a failed request, which is a
+// string or an object with a message. Without one it's the body itself, cut
+// short.
+func imgurMessage(data json.RawMessage, body []byte) string {
+	var e struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if json.Unmarshal(data, &e) == nil && len(e.Error) > 0 {
+		var s string
+		if json.Unmarshal(e.Error, &s) == nil {
+			return s
+		}
+		var obj struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(e.Error, &obj) == nil && obj.Message != "" {
+			return obj.Message
+		}
+	}
+	return shorten(strings.TrimSpace(string(body)), 200)
+}
+
+// imgurFile holds the uploaded images by remote name, in the state
+// directory
+const imgurFile = "imgur.json"
+
+// imgurMu guards the imgur file
+var imgurMu sync.Mutex
+
+// readImgurImages loads the uploaded images, an unreadable file counts as
+// empty
+func readImgurImages() map[string]imgurImage {
+	images := make(map[string]imgurImage)
+	if err := readState(imgurFile, &images); err != nil && !os.IsNotExist(err) {
+		debugf("ignoring %s: %v", imgurFile, err)
+	}
+	return images
+}
+
+// saveImgurImage remembers the image uploaded as remoteName
+func saveImgurImage(remoteName string, img imgurImage) {
+	imgurMu.Lock()
+	defer imgurMu.Unlock()
+	images := readImgurImages()
+	images[remoteName] = img
+	if err := writeState(imgurFile, images); err != nil {
+		log.Printf("can't save the delete hash of %s (%s): %v", img.Link, img.DeleteHash, err)
+	}
+}
+
+// imgurImageFor returns the image uploaded as remoteName
+func imgurImageFor(remoteName string) (imgurImage, bool) {
+	imgurMu.Lock()
+	defer imgurMu.Unlock()
+	img, ok := readImgurImages()[remoteName]
+	return img, ok
+}
+
+// forgetImgurImage drops the image uploaded as remoteName
+func forgetImgurImage(remoteName string) {
+	imgurMu.Lock()
+	defer imgurMu.Unlock()
+	images := readImgurImages()
+	delete(images, remoteName)
+	if err := writeState(imgurFile, images); err != nil {
+		debugf("can't save %s: %v", imgurFile, err)
+	}
+}
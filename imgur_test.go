@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestImgurWait(t *testing.T) {
+	now := time.Date(2024, 7, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		header map[string]string
+		want   time.Duration
+	}{
+		{map[string]string{"Retry-After": "20"}, 20 * time.Second},
+		{map[string]string{"Retry-After": "20", "X-Post-Rate-Limit-Reset": "600"}, 20 * time.Second},
+		{map[string]string{"X-Post-Rate-Limit-Reset": "600"}, 10 * time.Minute},
+		{map[string]string{"X-RateLimit-UserRemaining": "0", "X-RateLimit-UserReset": strconv.FormatInt(now.Add(time.Hour).Unix(), 10)}, time.Hour},
+		// reset already, or credits left
+		{map[string]string{"X-RateLimit-UserRemaining": "0", "X-RateLimit-UserReset": strconv.FormatInt(now.Add(-time.Hour).Unix(), 10)}, 0},
+		{map[string]string{"X-RateLimit-UserRemaining": "12", "X-RateLimit-UserReset": strconv.FormatInt(now.Add(time.Hour).Unix(), 10)}, 0},
+		{nil, 0},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		for k, v := range tt.header {
+			h.Set(k, v)
+		}
+		if got := imgurWait(h, now); got != tt.want {
+			t.Errorf("%v: wait %s, want %s", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestImgurMessage(t *testing.T) {
+	tests := []struct{ body, want string }{
+		{`{"data":{"error":"Imgur is temporarily over capacity. Please try again later."},"success":false,"status":500}`, "Imgur is temporarily over capacity. Please try again later."},
+		{`{"data":{"error":{"code":1003,"message":"File type invalid (1)","type":"ImgurException"}},"success":false,"status":400}`, "File type invalid (1)"},
+		{"<html>Bad Gateway</html>\n", "<html>Bad Gateway</html>"},
+	}
+	for _, tt := range tests {
+		var answer struct {
+			Data json.RawMessage `json:"data"`
+		}
+		json.Unmarshal([]byte(tt.body), &answer)
+		if got := imgurMessage(answer.Data, []byte(tt.body)); got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.body, got, tt.want)
+		}
+	}
+}
+
+// imgurTestAPI points imgurAPI to a server answering with respond
+func imgurTestAPI(t *testing.T, respond func(w http.ResponseWriter, r recordedRequest)) *requestLog {
+	srv, log := recordingServer(t, respond)
+	old := imgurAPI
+	imgurAPI = srv.URL + "/3"
+	t.Cleanup(func() { imgurAPI = old })
+	tempStateDir(t)
+	return log
+}
+
+const imgurUploaded = `{"data":{"id":"aBc12","link":"https://i.imgur.com/aBc12.png","deletehash":"d3l3t3","size":3,"datetime":1719828000},"success":true,"status":200}`
+
+func TestImgurUpload(t *testing.T) {
+	log := imgurTestAPI(t, func(w http.ResponseWriter, r recordedRequest) {
+		fmt.Fprint(w, imgurUploaded)
+	})
+	u := imgurUploader{p: testProfile(profile{Backend: backendImgur, ImgurClientID: "c1i3nt"})}
+	link, err := u.upload(context.Background(), uploadTestFile(t, "shot.png", []byte("png")), "Zr8tW.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link != "https://i.imgur.com/aBc12.png" {
+		t.Errorf("link = %s, want the one Imgur answered with", link)
+	}
+
+	r := log.all()[0]
+	if r.Method != http.MethodPost || r.Path != "/3/image" || r.Header.Get("Authorization") != "Client-ID c1i3nt" {
+		t.Errorf("%s %s with Authorization %q", r.Method, r.Path, r.Header.Get("Authorization"))
+	}
+	if form := postedForm(t, r); form.Value["type"][0] != "file" || len(form.File["image"]) != 1 || form.File["image"][0].Filename != "Zr8tW.png" {
+		t.Errorf("form %v with files %v", form.Value, form.File)
+	}
+
+	// the delete hash is kept for removing it
+	img, ok := imgurImageFor("Zr8tW.png")
+	if !ok || img.DeleteHash != "d3l3t3" {
+		t.Errorf("kept %+v, want the delete hash", img)
+	}
+}
+
+func TestImgurToken(t *testing.T) {
+	log := imgurTestAPI(t, func(w http.ResponseWriter, r recordedRequest) {
+		fmt.Fprint(w, `{"data":{"UserRemaining":10,"ClientRemaining":100},"success":true}`)
+	})
+	u := imgurUploader{p: testProfile(profile{Backend: backendImgur, ImgurClientID: "c1i3nt", ImgurToken: "t0ken"})}
+	if err := u.check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if r := log.all()[0]; r.Path != "/3/credits" || r.Header.Get("Authorization") != "Bearer t0ken" {
+		t.Errorf("%s with Authorization %q, want the token", r.Path, r.Header.Get("Authorization"))
+	}
+}
+
+func TestImgurRemoveAndStat(t *testing.T) {
+	deleted := false
+	log := imgurTestAPI(t, func(w http.ResponseWriter, r recordedRequest) {
+		switch {
+		case r.Method == http.MethodPost:
+			fmt.Fprint(w, imgurUploaded)
+		case r.Method == http.MethodDelete:
+			deleted = true
+			fmt.Fprint(w, `{"data":true,"success":true}`)
+		case deleted:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"data":{"error":"Unable to find an image with the id, aBc12"},"success":false,"status":404}`)
+		default:
+			fmt.Fprint(w, imgurUploaded)
+		}
+	})
+	u := imgurUploader{p: testProfile(profile{Backend: backendImgur, ImgurClientID: "c1i3nt"})}
+	if _, err := u.stat(context.Background(), "Zr8tW.png"); !os.IsNotExist(err) {
+		t.Errorf("stat before uploading: %v, want it not to exist", err)
+	}
+	if _, err := u.upload(context.Background(), uploadTestFile(t, "shot.png", []byte("png")), "Zr8tW.png"); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := u.stat(context.Background(), "Zr8tW.png")
+	if err != nil || fi.Size() != 3 || fi.ModTime().Unix() != 1719828000 {
+		t.Errorf("stat: %v, %v", fi, err)
+	}
+	if err := u.remove(context.Background(), "Zr8tW.png"); err != nil {
+		t.Fatal(err)
+	}
+	reqs := log.all()
+	if r := reqs[len(reqs)-1]; r.Method != http.MethodDelete || r.Path != "/3/image/d3l3t3" {
+		t.Errorf("removed with %s %s, want the delete hash", r.Method, r.Path)
+	}
+	if _, ok := imgurImageFor("Zr8tW.png"); ok {
+		t.Error("the delete hash is still kept after removing the image")
+	}
+	if err := u.remove(context.Background(), "Zr8tW.png"); err == nil {
+		t.Error("removed an image twice")
+	}
+}
+
+func TestImgurRateLimited(t *testing.T) {
+	waited := fakeClock(t)
+	calls := 0
+	imgurTestAPI(t, func(w http.ResponseWriter, r recordedRequest) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", "3")
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"data":{"error":"Too Many Requests"},"success":false,"status":429}`)
+			return
+		}
+		fmt.Fprint(w, imgurUploaded)
+	})
+	s := retrySettings(3)
+	s.Profile = testProfile(profile{Backend: backendImgur, ImgurClientID: "c1i3nt"})
+	up := imgurUploader{p: s.Profile}
+	link, _, err := uploadWithRetries(context.Background(), s, fakeEffects{up: up}, retryFile(t), "Zr8tW.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link != "https://i.imgur.com/aBc12.png" || calls != 2 {
+		t.Errorf("link %s after %d requests, want it after a retry", link, calls)
+	}
+	if len(*waited) != 1 || (*waited)[0] != 3*time.Second {
+		t.Errorf("waited %v, want the 3s of Retry-After", *waited)
+	}
+}
+
+func TestImgurError(t *testing.T) {
+	e := &imgurError{Status: http.StatusTooManyRequests, Message: "Too Many Requests.", Wait: 90 * time.Second}
+	if got := e.Error(); got != "imgur answered 429 Too Many Requests: Too Many Requests, try again in 1m30s" {
+		t.Errorf("Error() = %s", got)
+	}
+	if !transient(e) || (&imgurError{Status: http.StatusBadRequest}).temporary() {
+		t.Error("only busy and rate limited answers are temporary")
+	}
+}
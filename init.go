@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/lithammer/shortuuid/v3"
+)
+
+// initConfig is what `skrins init` writes out
+type initConfig struct {
+	Path       string `toml:"path"`
+	RemoteHost string `toml:"remote_host"`
+	RemoteUser string `toml:"remote_user"`
+	Key        string `toml:"key"`
+	RemotePath string `toml:"remote_path"`
+	BaseURL    string `toml:"base_url"`
+}
+
+// runInit implements `skrins init`: it asks for every setting, checks that
+// uploading works and writes the config file.
+func runInit(args []string) error {
+	var ic initConfig
+	var configFile string
+	var force, yes, skipCheck bool
+
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	fs.StringVar(&configFile, "config", "", "Where to write the config file (default "+findConfigFile(defaultConfigCandidates())+")")
+	fs.BoolVar(&force, "force", false, "Overwrite an existing config file")
+	fs.BoolVar(&yes, "y", false, "Don't prompt, take every value from flags")
+	fs.BoolVar(&skipCheck, "no-check", false, "Don't test the connection before writing")
+	fs.StringVar(&ic.Path, "p", "", "Path to where screenshots are saved locally")
+	fs.StringVar(&ic.RemoteHost, "r", "", "Remote host, e.g. example.com:2003 or 43.56.122.31:22")
+	fs.StringVar(&ic.RemoteUser, "ru", "", "Username on remote host")
+	fs.StringVar(&ic.Key, "pk", "", "Private key path")
+	fs.StringVar(&ic.RemotePath, "rp", "", "Path on the remote host")
+	fs.StringVar(&ic.BaseURL, "url", "", "A base URL that points to given screenshot, e.g https://i.slacki.io/")
+	fs.Parse(args)
+
+	if configFile == "" {
+		configFile = findConfigFile(defaultConfigCandidates())
+	}
+	if _, err := os.Stat(configFile); err == nil && !force {
+		return fmt.Errorf("%s already exists, use -force to overwrite it", configFile)
+	}
+
+	if !yes {
+		in := bufio.NewReader(os.Stdin)
+		ic.Path = prompt(in, "Directory to watch for screenshots", ic.Path)
+		ic.RemoteHost = prompt(in, "Remote host (host:port)", ic.RemoteHost)
+		ic.RemoteUser = prompt(in, "Remote user", ic.RemoteUser)
+		keys := detectKeys()
+		if ic.Key == "" && len(keys) > 0 {
+			ic.Key = keys[0]
+		}
+		if len(keys) > 0 {
+			fmt.Println("Keys found in ~/.ssh:", strings.Join(keys, ", "))
+		}
+		ic.Key = prompt(in, "Private key", ic.Key)
+		ic.RemotePath = prompt(in, "Directory on the remote host", ic.RemotePath)
+		ic.BaseURL = prompt(in, "Base URL the remote directory is served from", ic.BaseURL)
+	}
+
+	// ~ and variables are written out as given and only expanded for the check
+	path, err := expandPath(ic.Path, os.Getenv)
+	if err != nil {
+		return err
+	}
+	p := profile{
+		RemoteHost: ic.RemoteHost,
+		RemoteUser: ic.RemoteUser,
+		Key:        ic.Key,
+		RemotePath: ic.RemotePath,
+		BaseURL:    ic.BaseURL,
+	}
+	p, problems := p.finish(p.RemoteUser != "", os.Getenv)
+	problems = append(problems, settingsProblems(path, p)...)
+	if len(problems) > 0 {
+		return fmt.Errorf("can't write config: %s", strings.Join(problems, "; "))
+	}
+
+	if !skipCheck {
+		if err := unlockKey(p, true); err != nil {
+			return err
+		}
+		if err := unlockPassword(p, true); err != nil {
+			return err
+		}
+		p = p.withSlashes()
+		fmt.Printf("Checking %s@%s:%s is writable...\n", p.RemoteUser, p.RemoteHost, p.RemotePath)
+		if err := checkWritable(p); err != nil {
+			return fmt.Errorf("connection check failed: %w", err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(configFile), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(configFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := toml.NewEncoder(f).Encode(ic); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	fmt.Println("Wrote", configFile)
+	return nil
+}
+
+// prompt asks for a value, offering def when it's not empty
+func prompt(in *bufio.Reader, label, def string) string {
+	if def != "" {
+		fmt.Printf("%s [%s]: ", label, def)
+	} else {
+		fmt.Printf("%s: ", label)
+	}
+	line, err := in.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return def
+	}
+	if line = strings.TrimSpace(line); line != "" {
+		return line
+	}
+	return def
+}
+
+// detectKeys lists private keys in ~/.ssh
+func detectKeys() []string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+	matches, _ := filepath.Glob(filepath.Join(home, ".ssh", "id_*"))
+
+	var keys []string
+	for _, m := range matches {
+		if !strings.HasSuffix(m, ".pub") {
+			keys = append(keys, m)
+		}
+	}
+	return keys
+}
+
+// checkWritable connects to p and writes, then removes, a small file in its
+// remote directory
+func checkWritable(p profile) error {
+	client, err := newSFTPClient(p)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	name := p.RemotePath + ".skrins-init-" + shortuuid.New()
+	if client.transport() == transportSCP {
+		if err := scpSend(client, name, defaultFileMode, 6, strings.NewReader("skrins")); err != nil {
+			return err
+		}
+		_, err := runRemote(client, "rm -f -- "+shellQuote(name))
+		return err
+	}
+	f, err := client.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write([]byte("skrins")); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	return client.Remove(name)
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Where the node's RPC API is and how links to files look unless the
+// config says otherwise. Subdomain gateways need CIDs that are valid host
+// names, which base32 ones are.
+const (
+	ipfsDefaultAPI     = "http://127.0.0.1:5001"
+	ipfsDefaultGateway = "https://{cid}.ipfs.dweb.link/?filename={name}"
+)
+
+// ipfsUploader adds files to an IPFS node through its RPC API, the local
+// one or a hosted one, optionally pins them with a pinning service and
+// returns their gateway URL
+type ipfsUploader struct {
+	p    profile
+	opts uploadOptions
+}
+
+// ipfsLabel describes an IPFS secret in prompts and errors
+func ipfsLabel(what string) string {
+	return "IPFS " + what
+}
+
+// ipfsAPI is the RPC API files are added with
+func (p profile) ipfsAPI() string {
+	if p.IPFSAPI == "" {
+		return ipfsDefaultAPI
+	}
+	return strings.TrimRight(p.IPFSAPI, "/")
+}
+
+// ipfsProblems checks the settings of an ipfs profile
+func ipfsProblems(p profile) []string {
+	var problems []string
+	if u, err := url.Parse(p.ipfsAPI()); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		problems = append(problems, fmt.Sprintf("ipfs_api %q has to be an http:// or https:// URL", p.IPFSAPI))
+	}
+	if _, err := ipfsGatewayURL(p, "bafkqaaa", "x.png"); err != nil {
+		problems = append(problems, "ipfs_gateway "+err.Error())
+	}
+	if p.IPFSPinService != "" {
+		if u, err := url.Parse(p.IPFSPinService); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			problems = append(problems, fmt.Sprintf("ipfs_pin_service %q has to be an http:// or https:// URL", p.IPFSPinService))
+		}
+		if p.IPFSPinToken == "" {
+			problems = append(problems, "ipfs_pin_service needs ipfs_pin_token")
+		}
+	}
+	return problems
+}
+
+// ipfsGatewayURL is where the gateway ipfs_gateway serves cid, with {cid}
+// and {name} filled in, or with the CID appended when there's no {cid}
+func ipfsGatewayURL(p profile, cid, remoteName string) (string, error) {
+	gateway := p.IPFSGateway
+	if gateway == "" {
+		gateway = ipfsDefaultGateway
+	}
+	hasCID := false
+	link, err := expandTemplate(gateway, func(token, arg string) (string, error) {
+		switch token {
+		case "cid":
+			hasCID = true
+			return cid, nil
+		case "name":
+			return url.QueryEscape(remoteName), nil
+		}
+		return "", fmt.Errorf("unknown placeholder {%s}, use {cid} or {name}", token)
+	})
+	if err != nil {
+		return "", err
+	}
+	if !hasCID {
+		link += cid
+	}
+	return link, nil
+}
+
+// ipfsError is an error answer of the RPC API or the pinning service
+type ipfsError struct {
+	Host    string
+	Status  int
+	Message string
+	Wait    time.Duration
+}
+
+func (e *ipfsError) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = http.StatusText(e.Status)
+	}
+	return fmt.Sprintf("IPFS %s answered %d %s: %s", e.Host, e.Status, http.StatusText(e.Status), msg)
+}
+
+// temporary tells whether trying again may help. Nodes answer 500 to any
+// failed command, so only gateway errors and rate limits count.
+func (e *ipfsError) temporary() bool {
+	return e.Status > 500 || e.Status == http.StatusTooManyRequests
+}
+
+// retryAfter is how long to wait before trying again
+func (e *ipfsError) retryAfter() time.Duration {
+	return e.Wait
+}
+
+func (u ipfsUploader) upload(ctx context.Context, localPath, remoteName string) (string, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, u.p.TransferTimeout.Duration)
+	defer cancel()
+	t := startTransfer(localPath, fi.Size(), 0, u.opts.Progress)
+	defer t.finish()
+	// pinning comes after stalled() ends the context of the transfer
+	transferCtx, stalled := watchStall(ctx, t, u.p.StallTimeout.Duration)
+
+	file := progressTracker{limitedReader{f, uploadLimiter}, t}
+	body, length, formType, err := multipartBody(nil, "file", remoteName, file, fi.Size())
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{"cid-version": {"1"}, "pin": {fmt.Sprint(u.p.IPFSPin)}, "quieter": {"true"}}
+	var added struct {
+		Hash string `json:"Hash"`
+		Size string `json:"Size"`
+	}
+	err = u.call(transferCtx, u.p.ipfsAPI()+"/api/v0/add?"+query.Encode(), u.p.IPFSToken, ipfsLabel("token"), http.Header{"Content-Type": {formType}}, body, length, &added)
+	host := hostOf(u.p.ipfsAPI())
+	if stalled() {
+		return "", &timeoutError{Op: "stall", Host: host, After: u.p.StallTimeout.Duration}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", &timeoutError{Op: "transfer", Host: host, After: u.p.TransferTimeout.Duration, Err: err}
+	}
+	if err != nil {
+		return "", err
+	}
+	cid, err := cidV1Base32(added.Hash)
+	if err != nil {
+		return "", fmt.Errorf("IPFS %s: %w", host, err)
+	}
+	log.Println(t.summary())
+
+	link, err := ipfsGatewayURL(u.p, cid, remoteName)
+	if err != nil {
+		return "", err
+	}
+	if u.p.IPFSPinService != "" {
+		if err := u.pin(ctx, cid, remoteName); err != nil {
+			return link, &degradedError{URL: link, Done: []string{"IPFS"}, Missing: []string{"pinning at " + hostOf(u.p.IPFSPinService)}, Err: err}
+		}
+	}
+	return link, nil
+}
+
+// pin asks the pinning service to pin cid, see
+// https://ipfs.github.io/pinning-services-api-spec/
+func (u ipfsUploader) pin(ctx context.Context, cid, remoteName string) error {
+	request, err := json.Marshal(map[string]string{"cid": cid, "name": remoteName})
+	if err != nil {
+		return err
+	}
+	var status struct {
+		Status string `json:"status"`
+	}
+	header := http.Header{"Content-Type": {"application/json"}}
+	if err := u.call(ctx, strings.TrimRight(u.p.IPFSPinService, "/")+"/pins", u.p.IPFSPinToken, ipfsLabel("pinning token"), header, bytes.NewReader(request), int64(len(request)), &status); err != nil {
+		return err
+	}
+	if status.Status == "failed" {
+		return fmt.Errorf("%s failed to pin %s", hostOf(u.p.IPFSPinService), cid)
+	}
+	debugf("pin of %s at %s is %s", cid, hostOf(u.p.IPFSPinService), status.Status)
+	return nil
+}
+
+// check makes sure the node answers and, with a pinning service, that the
+// service takes the token. A local node that doesn't answer isn't running,
+// that's not a network problem to wait out.
+func (u ipfsUploader) check(ctx context.Context) error {
+	target := u.p.ipfsAPI()
+	var version struct {
+		Version string `json:"Version"`
+	}
+	err := u.call(ctx, target+"/api/v0/version", u.p.IPFSToken, ipfsLabel("token"), nil, nil, 0, &version)
+	var netErr net.Error
+	if errors.As(err, &netErr) && isLoopback(hostOf(target)) {
+		return fmt.Errorf("ipfs: no IPFS node answers at %s, is the daemon running? (%v)", target, err)
+	}
+	if err != nil {
+		return fmt.Errorf("ipfs: %w", err)
+	}
+	debugf("IPFS node at %s runs version %s", target, version.Version)
+
+	if u.p.IPFSPinService != "" {
+		if err := u.call(ctx, strings.TrimRight(u.p.IPFSPinService, "/")+"/pins?limit=1", u.p.IPFSPinToken, ipfsLabel("pinning token"), nil, nil, 0, nil); err != nil {
+			return fmt.Errorf("ipfs: pinning service: %w", err)
+		}
+	}
+	return nil
+}
+
+// call makes a request, a POST when it's to the RPC API since nodes don't
+// take anything else, authorized with the token behind ref when there's
+// one, and decodes the JSON answer into v
+func (u ipfsUploader) call(ctx context.Context, target, ref, label string, header http.Header, body io.Reader, length int64, v interface{}) error {
+	method := http.MethodPost
+	if body == nil && !strings.Contains(target, "/api/v0/") {
+		method = http.MethodGet
+	}
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.ContentLength = length
+	if ref != "" {
+		token, err := cachedSecret(ref, label)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := httpClientFor(u.p).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		e := &ipfsError{Host: req.URL.Host, Status: resp.StatusCode, Wait: retryAfterHeader(resp.Header, time.Now())}
+		// nodes send Message, pinning services error.reason and details
+		var answer struct {
+			Message string `json:"Message"`
+			Error   struct {
+				Reason  string `json:"reason"`
+				Details string `json:"details"`
+			} `json:"error"`
+		}
+		json.Unmarshal(respBody, &answer)
+		switch {
+		case answer.Message != "":
+			e.Message = answer.Message
+		case answer.Error.Details != "":
+			e.Message = answer.Error.Reason + ": " + answer.Error.Details
+		case answer.Error.Reason != "":
+			e.Message = answer.Error.Reason
+		default:
+			e.Message = shorten(strings.TrimSpace(string(respBody)), 200)
+		}
+		return e
+	}
+	if v == nil {
+		return nil
+	}
+	// adding answers a line per file and directory, the last one counts
+	dec := json.NewDecoder(bytes.NewReader(respBody))
+	for {
+		if err := dec.Decode(v); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("bad answer from %s: %w", req.URL.Host, err)
+		}
+	}
+}
+
+// hostOf is the host of the URL target, or target when it isn't one
+func hostOf(target string) string {
+	if u, err := url.Parse(target); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return target
+}
+
+// isLoopback tells whether host, with or without a port, is this machine
+func isLoopback(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// base58Alphabet is the alphabet of CIDv0s, Bitcoin's
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// cidV1Base32 returns cid as a base32 CIDv1, converting a CIDv0 ("Qm…")
+// that nodes ignoring cid-version send
+func cidV1Base32(cid string) (string, error) {
+	if strings.HasPrefix(cid, "b") {
+		return cid, nil
+	}
+	if !strings.HasPrefix(cid, "Qm") || len(cid) != 46 {
+		return "", fmt.Errorf("can't make a base32 CID of %q", cid)
+	}
+	n := new(big.Int)
+	for _, c := range cid {
+		i := strings.IndexRune(base58Alphabet, c)
+		if i < 0 {
+			return "", fmt.Errorf("%q is not a CID", cid)
+		}
+		n.Mul(n, big.NewInt(58))
+		n.Add(n, big.NewInt(int64(i)))
+	}
+	multihash := n.Bytes()
+	// a CIDv1 of the same content: version 1, the dag-pb codec, then the
+	// multihash of the v0
+	v1 := append([]byte{0x01, 0x70}, multihash...)
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	return "b" + strings.ToLower(enc.EncodeToString(v1)), nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// a CIDv0 and the CIDv1 of the same content, from the IPFS docs
+const (
+	ipfsTestCIDv0 = "QmbWqxBEKC3P8tqsKc98xmWNzrzDtRLMiMPL8wBuTGsMnR"
+	ipfsTestCIDv1 = "bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi"
+)
+
+// ipfsTestUploader adds to the node API at api and pins with the service
+// at pinService when it's set
+func ipfsTestUploader(t *testing.T, api, pinService string) ipfsUploader {
+	p := profile{Backend: backendIPFS, IPFSAPI: api}
+	if pinService != "" {
+		setEnv(t, "SKRINS_TEST_IPFS_PIN_TOKEN", "p1nt0k3n")
+		p.IPFSPinService = pinService
+		p.IPFSPinToken = "env:SKRINS_TEST_IPFS_PIN_TOKEN"
+	}
+	return ipfsUploader{p: testProfile(p)}
+}
+
+// ipfsAdded answers an add with cid, after the line of its directory
+func ipfsAdded(w http.ResponseWriter, cid string) {
+	fmt.Fprint(w, `{"Name":"","Hash":"bafyd1r","Size":"0"}`+"\n")
+	fmt.Fprintf(w, `{"Name":"Zr8tW.png","Hash":%q,"Size":"3"}`+"\n", cid)
+}
+
+func TestCIDv1Base32(t *testing.T) {
+	tests := []struct {
+		cid  string
+		want string
+		err  bool
+	}{
+		{ipfsTestCIDv0, ipfsTestCIDv1, false},
+		{ipfsTestCIDv1, ipfsTestCIDv1, false},
+		{"zdj7WWeQ43G6JJvLWQWZpyHuAMq6uYWRjkBXFad11vE2LHhQ7", "", true},
+		{"Qm0WqxBEKC3P8tqsKc98xmWNzrzDtRLMiMPL8wBuTGsMnR", "", true},
+	}
+	for _, tt := range tests {
+		got, err := cidV1Base32(tt.cid)
+		if got != tt.want || (err != nil) != tt.err {
+			t.Errorf("cidV1Base32(%s) = %s, %v, want %s", tt.cid, got, err, tt.want)
+		}
+	}
+}
+
+// nodes that send a CIDv0 anyway get a subdomain gateway link with the
+// base32 CIDv1, which fits in a host name
+func TestIPFSGatewayURL(t *testing.T) {
+	srv, log := recordingServer(t, func(w http.ResponseWriter, r recordedRequest) {
+		ipfsAdded(w, ipfsTestCIDv0)
+	})
+	link, err := ipfsTestUploader(t, srv.URL, "").upload(context.Background(), uploadTestFile(t, "shot.png", []byte("png")), "Zr8tW (1).png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://" + ipfsTestCIDv1 + ".ipfs.dweb.link/?filename=Zr8tW+%281%29.png"; link != want {
+		t.Errorf("link = %s, want %s", link, want)
+	}
+	r := log.all()[0]
+	if r.Method != http.MethodPost || r.Path != "/api/v0/add" || r.Query.Get("cid-version") != "1" || r.Query.Get("pin") != "false" {
+		t.Errorf("added with %s %s?%s", r.Method, r.Path, r.Query.Encode())
+	}
+	if form := postedForm(t, r); len(form.File["file"]) != 1 || form.File["file"][0].Filename != "Zr8tW (1).png" {
+		t.Errorf("sent %v", form.File)
+	}
+
+	tests := []struct {
+		gateway string
+		want    string
+	}{
+		{"https://ipfs.io/ipfs/", "https://ipfs.io/ipfs/" + ipfsTestCIDv1},
+		{"https://gw.example.com/ipfs/{cid}/{name}", "https://gw.example.com/ipfs/" + ipfsTestCIDv1 + "/a+b.png"},
+	}
+	for _, tt := range tests {
+		got, err := ipfsGatewayURL(profile{IPFSGateway: tt.gateway}, ipfsTestCIDv1, "a b.png")
+		if err != nil || got != tt.want {
+			t.Errorf("ipfsGatewayURL(%s) = %s, %v, want %s", tt.gateway, got, err, tt.want)
+		}
+	}
+}
+
+// a pin that fails leaves the file on the node, its link is returned with
+// what went wrong
+func TestIPFSPinFailure(t *testing.T) {
+	tests := []struct {
+		status int
+		answer string
+		want   string
+	}{
+		{http.StatusUnauthorized, `{"error":{"reason":"UNAUTHORIZED","details":"Access token is missing or invalid"}}`, "UNAUTHORIZED: Access token is missing or invalid"},
+		{http.StatusAccepted, `{"requestid":"r3q","status":"failed","pin":{"cid":"` + ipfsTestCIDv1 + `"}}`, "failed to pin " + ipfsTestCIDv1},
+	}
+	for _, tt := range tests {
+		srv, log := recordingServer(t, func(w http.ResponseWriter, r recordedRequest) {
+			if r.Path == "/api/v0/add" {
+				ipfsAdded(w, ipfsTestCIDv1)
+				return
+			}
+			w.WriteHeader(tt.status)
+			fmt.Fprint(w, tt.answer)
+		})
+		link, err := ipfsTestUploader(t, srv.URL, srv.URL+"/psa/").upload(context.Background(), uploadTestFile(t, "shot.png", []byte("png")), "Zr8tW.png")
+		want := "https://" + ipfsTestCIDv1 + ".ipfs.dweb.link/?filename=Zr8tW.png"
+		if link != want {
+			t.Errorf("%d: link = %q, want %s", tt.status, link, want)
+		}
+		var degraded *degradedError
+		if !errors.As(err, &degraded) || degraded.URL != want || !strings.Contains(err.Error(), tt.want) || !strings.Contains(err.Error(), "uploaded to IPFS only, pinning at 127.0.0.1") {
+			t.Errorf("%d: %v, want the pin failure", tt.status, err)
+		}
+		pin := log.all()[1]
+		if pin.Method != http.MethodPost || pin.Path != "/psa/pins" || pin.Header.Get("Authorization") != "Bearer p1nt0k3n" || string(pin.Body) != `{"cid":"`+ipfsTestCIDv1+`","name":"Zr8tW.png"}` {
+			t.Errorf("%d: pinned with %s %s %v %s", tt.status, pin.Method, pin.Path, pin.Header, pin.Body)
+		}
+	}
+}
+
+func TestIPFSCheck(t *testing.T) {
+	srv, log := recordingServer(t, func(w http.ResponseWriter, r recordedRequest) {
+		switch r.Path {
+		case "/api/v0/version":
+			fmt.Fprint(w, `{"Version":"0.25.0","Commit":"","Repo":"15","System":"amd64/linux","Golang":"go1.21.4"}`)
+		case "/psa/pins":
+			if r.Header.Get("Authorization") != "Bearer p1nt0k3n" {
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprint(w, `{"error":{"reason":"UNAUTHORIZED"}}`)
+				return
+			}
+			fmt.Fprint(w, `{"count":0,"results":[]}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	if err := ipfsTestUploader(t, srv.URL, srv.URL+"/psa").check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var calls []string
+	for _, r := range log.all() {
+		calls = append(calls, r.Method+" "+r.Path+" "+r.Query.Encode())
+	}
+	// nodes only take POSTs
+	if want := "POST /api/v0/version , GET /psa/pins limit=1"; strings.Join(calls, ", ") != want {
+		t.Errorf("calls %s, want %s", strings.Join(calls, ", "), want)
+	}
+
+	// a pinning service that turns the token down
+	setEnv(t, "SKRINS_TEST_IPFS_WRONG_TOKEN", "wr0ng")
+	up := ipfsTestUploader(t, srv.URL, srv.URL+"/psa")
+	up.p.IPFSPinToken = "env:SKRINS_TEST_IPFS_WRONG_TOKEN"
+	err := up.check(context.Background())
+	if err == nil || !strings.HasPrefix(err.Error(), "ipfs: pinning service: IPFS 127.0.0.1") || !strings.HasSuffix(err.Error(), "401 Unauthorized: UNAUTHORIZED") {
+		t.Errorf("check with a wrong pinning token: %v", err)
+	}
+}
+
+// a local node that doesn't answer isn't running
+func TestIPFSCheckNotRunning(t *testing.T) {
+	srv, _ := recordingServer(t, func(w http.ResponseWriter, r recordedRequest) {})
+	srv.Close()
+	err := ipfsTestUploader(t, srv.URL, "").check(context.Background())
+	if err == nil || !strings.HasPrefix(err.Error(), "ipfs: no IPFS node answers at "+srv.URL+", is the daemon running?") {
+		t.Errorf("check: %v, want the daemon not running", err)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// jumpError is a failure on the way to a server through jump hosts, Hop is
+// the jump host it happened at
+type jumpError struct {
+	Hop string
+	Err error
+}
+
+func (e *jumpError) Error() string { return fmt.Sprintf("jump host %s: %v", e.Hop, e.Err) }
+
+func (e *jumpError) Unwrap() error { return e.Err }
+
+// jumpHops returns a profile for every jump host of p, in the order they're
+// connected through. They have p's settings but for the host, the user when
+// the jump host names one or the ssh config has one, and the credentials
+// when jump_key or jump_password are set.
+func (p profile) jumpHops() ([]profile, error) {
+	var hops []profile
+	for _, spec := range strings.Split(p.Jump, ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		hop := p
+		hop.Jump, hop.RemoteUser = "", ""
+		hop.RemoteHost = spec
+		if i := strings.LastIndex(spec, "@"); i >= 0 && !strings.Contains(spec, "://") {
+			hop.RemoteUser, hop.RemoteHost = spec[:i], spec[i+1:]
+		}
+		if p.JumpKey != "" {
+			hop.Key, hop.DefaultKey = p.JumpKey, ""
+		}
+		if p.JumpPassword != "" {
+			hop.Password = p.JumpPassword
+		}
+		hop.applySSHConfig()
+		hop.Jump = ""
+		setDefault(&hop.RemoteUser, p.RemoteUser)
+		if err := hop.normalizeHost(false); err != nil {
+			return nil, fmt.Errorf("jump host: %w", err)
+		}
+		keys := hop.keys()
+		for i := range keys {
+			var err error
+			if keys[i], err = expandPath(keys[i], os.Getenv); err != nil {
+				return nil, fmt.Errorf("jump host %s: %w", hop.RemoteHost, err)
+			}
+		}
+		hop.Key = strings.Join(keys, ",")
+		hops = append(hops, hop)
+	}
+	return hops, nil
+}
+
+// dialThroughJumps connects to p's server through its jump hosts. Every
+// hop gets its own SSH handshake, with its host key checked, and the next
+// hop is reached over a direct-tcpip channel of the one before. Only the
+// first jump host is connected to through a proxy.
+func dialThroughJumps(p profile) (net.Conn, error) {
+	hops, err := p.jumpHops()
+	if err != nil {
+		return nil, err
+	}
+	base, err := dialRemote(hops[0])
+	if err != nil {
+		return nil, &jumpError{Hop: hops[0].RemoteHost, Err: withTimeout(err, "dial", hops[0])}
+	}
+	jc := &jumpConn{base: base}
+
+	conn := base
+	for i, hop := range hops {
+		// channels have no deadlines, the connection carrying them does
+		base.SetDeadline(time.Now().Add(hop.DialTimeout.Duration))
+		client, err := sshHandshake(hop, conn)
+		if err != nil {
+			jc.Close()
+			return nil, &jumpError{Hop: hop.RemoteHost, Err: err}
+		}
+		jc.clients = append(jc.clients, client)
+
+		next := p.RemoteHost
+		if i+1 < len(hops) {
+			next = hops[i+1].RemoteHost
+		}
+		debugf("connecting to %s through jump host %s", next, hop.RemoteHost)
+		if conn, err = client.Dial("tcp", next); err != nil {
+			jc.Close()
+			return nil, &jumpError{Hop: hop.RemoteHost, Err: fmt.Errorf("can't reach %s: %w", next, err)}
+		}
+	}
+	base.SetDeadline(time.Time{})
+	jc.Conn = conn
+	return jc, nil
+}
+
+// jumpConn is a connection to a server through jump hosts. Closing it
+// closes the connections to the jump hosts too, and deadlines apply to the
+// connection to the first one since channels don't support them.
+type jumpConn struct {
+	net.Conn
+	base    net.Conn
+	clients []*ssh.Client
+}
+
+func (c *jumpConn) Close() error {
+	var err error
+	if c.Conn != nil {
+		err = c.Conn.Close()
+	}
+	for i := len(c.clients) - 1; i >= 0; i-- {
+		c.clients[i].Close()
+	}
+	c.base.Close()
+	return err
+}
+
+func (c *jumpConn) SetDeadline(t time.Time) error { return c.base.SetDeadline(t) }
+
+func (c *jumpConn) SetReadDeadline(t time.Time) error { return c.base.SetReadDeadline(t) }
+
+func (c *jumpConn) SetWriteDeadline(t time.Time) error { return c.base.SetWriteDeadline(t) }
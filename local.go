@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/lithammer/shortuuid/v3"
+)
+
+// How the local backend puts files into remote_path
+const (
+	localCopy   = "copy"
+	localLink   = "link"
+	localRename = "rename"
+)
+
+var localModes = []string{localCopy, localLink, localRename}
+
+// localUploader puts files into a directory on this machine, like a synced
+// or mounted folder, and returns base_url plus their name. It's the
+// simplest uploader there is.
+type localUploader struct {
+	p    profile
+	opts uploadOptions
+}
+
+// localProblems checks the settings of a local profile
+func localProblems(p profile) []string {
+	if p.LocalMode != "" && !contains(localModes, p.LocalMode) {
+		return []string{fmt.Sprintf("local_mode must be %s, not %q", strings.Join(localModes, ", "), p.LocalMode)}
+	}
+	return nil
+}
+
+// dir is the directory files with the extension ext go to
+func (u localUploader) dir(ext string) (string, error) {
+	return expandPath(u.p.destinationFor(ext).RemotePath, os.Getenv)
+}
+
+func (u localUploader) upload(ctx context.Context, localPath, remoteName string) (string, error) {
+	ext := remoteExtension(remoteName)
+	dir, err := u.dir(ext)
+	if err != nil {
+		return "", err
+	}
+	dest := filepath.Join(dir, remoteName)
+	if u.opts.Mkdirs {
+		// remoteName may have folders of its own, see date_dirs
+		if err := os.MkdirAll(filepath.Dir(dest), dirModeOr(u.p.dirMode(), 0755)); err != nil {
+			return "", err
+		}
+	}
+
+	url := u.p.destinationFor(ext).BaseURL + remoteName
+
+	if u.p.LocalMode == localLink || u.p.LocalMode == localRename {
+		move := os.Link
+		if u.p.LocalMode == localRename {
+			move = os.Rename
+		}
+		err := move(localPath, dest)
+		if err == nil {
+			return url, syncDir(dir)
+		}
+		if !crossDevice(err) {
+			return "", err
+		}
+		debugf("%s is on another filesystem than %s, copying instead", dir, localPath)
+	}
+	if err := u.copyFile(localPath, dest); err != nil {
+		return "", err
+	}
+	return url, nil
+}
+
+// uploadCompressed copies the local file gzipped like upload copies it,
+// the copy is checked against what came out of gzip
+func (u localUploader) uploadCompressed(ctx context.Context, localPath, remoteName string) (string, error) {
+	ext := remoteExtension(remoteName)
+	dir, err := u.dir(ext)
+	if err != nil {
+		return "", err
+	}
+	dest := filepath.Join(dir, remoteName+gzipSuffix)
+	if u.opts.Mkdirs {
+		if err := os.MkdirAll(filepath.Dir(dest), dirModeOr(u.p.dirMode(), 0755)); err != nil {
+			return "", err
+		}
+	}
+	in, err := gzipReader(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	if err := u.copyFrom(in, localPath, -1, dest); err != nil {
+		return "", err
+	}
+	return u.p.destinationFor(ext).BaseURL + remoteName + gzipSuffix, nil
+}
+
+// copyFile copies src to a hidden temporary file next to dest, flushes it
+// to disk, checks it and renames it in place, so a partial copy never shows
+// up as dest
+func (u localUploader) copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	return u.copyFrom(in, src, fi.Size(), dest)
+}
+
+// copyFrom is copyFile for what r reads of src, size bytes of it or as
+// many as it has when size is -1
+func (u localUploader) copyFrom(r io.Reader, src string, size int64, dest string) error {
+	tmp := filepath.Join(filepath.Dir(dest), "."+filepath.Base(dest)+tempSuffix+shortuuid.New())
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, defaultFileMode)
+	if err != nil {
+		return err
+	}
+	t := startTransfer(src, max64(size, 0), 0, u.opts.Progress)
+	defer t.finish()
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(out, h), progressTracker{limitedReader{r, uploadLimiter}, t})
+	if size < 0 {
+		size = n
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = u.checkCopy(tmp, size, fmt.Sprintf("%x", h.Sum(nil)))
+	}
+	if m := u.p.fileMode(); err == nil && m != 0 {
+		err = os.Chmod(tmp, m)
+	}
+	if err == nil {
+		err = os.Rename(tmp, dest)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// a compressed file's size is only known now
+	t.finish()
+	t.Size = size
+	log.Println(t.summary())
+	return syncDir(filepath.Dir(dest))
+}
+
+// checkCopy makes sure the copy at name has the size, and with verify =
+// sha256 the digest, of the original
+func (u localUploader) checkCopy(name string, size int64, digest string) error {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if fi.Size() != size {
+		return &sizeMismatchError{Name: name, Got: fi.Size(), Local: size}
+	}
+	if u.opts.Verify != verifySHA256 {
+		return nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if got := fmt.Sprintf("%x", h.Sum(nil)); got != digest {
+		return &checksumMismatchError{Name: name, Got: got, Local: digest}
+	}
+	return nil
+}
+
+// crossDevice tells whether err is from linking or renaming across
+// filesystems
+func crossDevice(err error) bool {
+	if errors.Is(err, syscall.EXDEV) {
+		return true
+	}
+	// ERROR_NOT_SAME_DEVICE
+	var errno syscall.Errno
+	return runtime.GOOS == "windows" && errors.As(err, &errno) && errno == 17
+}
+
+// syncDir flushes the directory entries of dir to disk, so a renamed file
+// survives a crash. Windows can't open directories for that.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// dirModeOr is m, or def when m is 0 because chmod is skipped
+func dirModeOr(m, def os.FileMode) os.FileMode {
+	if m == 0 {
+		return def
+	}
+	return m
+}
+
+func (u localUploader) remove(ctx context.Context, remoteName string) error {
+	dir, err := u.dir(remoteExtension(remoteName))
+	if err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(dir, remoteName))
+}
+
+func (u localUploader) stat(ctx context.Context, remoteName string) (os.FileInfo, error) {
+	dir, err := u.dir(remoteExtension(remoteName))
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(filepath.Join(dir, remoteName))
+}
+
+// list lists the files in remote_path, leaving out temporary ones
+func (u localUploader) list(ctx context.Context) ([]string, error) {
+	dir, err := u.dir("")
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+// check makes sure remote_path can be written to, unless it's still to be
+// created on the first upload
+func (u localUploader) check(ctx context.Context) error {
+	dir, err := u.dir("")
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+	f, err := ioutil.TempFile(dir, ".skrins-check-")
+	if err != nil {
+		return fmt.Errorf("local: %w", err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
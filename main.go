@@ -2,148 +2,668 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
-	"regexp"
+	"os/signal"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
-	"github.com/0xAX/notificator"
 	"github.com/atotto/clipboard"
 	"github.com/fsnotify/fsnotify"
-	"github.com/lithammer/shortuuid/v3"
-	"github.com/pkg/sftp"
-	"golang.org/x/crypto/ssh"
 )
 
-var notify *notificator.Notificator
 var watcher *fsnotify.Watcher
 
-var screensPath string
-var remoteHost string
-var remoteUser string
-var sshKeyPath string
-var remotePath string
-var baseURL string
-
 func main() {
 	var err error
 
+	if len(os.Args) > 1 && os.Args[1] == "init" {
+		if err := runInit(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "last" {
+		if err := runLast(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "history" {
+		if err := runHistory(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "retry-failed" {
+		if err := runRetryFailed(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && (os.Args[1] == "pause" || os.Args[1] == "resume" || os.Args[1] == "status") {
+		if err := runControl(os.Args[1], os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "upload" {
+		if err := runUpload(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "auth" {
+		if err := runAuth(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	flags()
 
 	// creates a new file watcher
 	watcher, err = fsnotify.NewWatcher()
 	if err != nil {
-		panic(err)
+		log.Fatal(explainWatchError("", err, 0))
 	}
 	defer watcher.Close()
 
 	exit := make(chan bool)
 
+	loadHistory()
+	loadDeletions()
 	go watch()
-
-	if err := watcher.Add(screensPath); err != nil {
-		panic(err)
+	startWorkers(currentSettings().Workers)
+	go pollLoop()
+	go checkRoots()
+	go followScreenshotLocation()
+	listenControl()
+	go handleSignals()
+
+	s := currentSettings()
+	if err := watchPaths(s); err != nil {
+		log.Fatal(err)
+	}
+	go restoreQueue(s)
+	if s.ScanOnStart {
+		// after the watch, files saved in between aren't missed
+		go scanOnStart(s)
 	}
 
 	<-exit
 }
 
-// flags parses flags
+// flags parses flags and merges them with the environment and the config file,
+// in that order of precedence
 func flags() {
-	flag.StringVar(&screensPath, "p", "", "Path to where screenshots are saved locally")
-	flag.StringVar(&remoteHost, "r", "", "Remote host, e.g. example.com:2003 or 43.56.122.31:22")
-	flag.StringVar(&remoteUser, "ru", "", "Username on remote host")
-	flag.StringVar(&sshKeyPath, "pk", "", "Private key path")
-	flag.StringVar(&remotePath, "rp", "", "Path on the remote host")
-	flag.StringVar(&baseURL, "url", "", "A base URL that points to given screenshot, e.g https://i.slacki.io/")
+	defineFlags()
 	flag.Parse()
+	applyFlags()
+}
 
-	screensPath = strings.TrimRight(screensPath, "/") + "/"
-	remotePath = strings.TrimRight(remotePath, "/") + "/"
-	baseURL = strings.TrimRight(baseURL, "/") + "/"
+// defineFlags defines the flags skrins and skrins upload take
+func defineFlags() {
+	flag.StringVar(&cli.ConfigFile, "config", "", "Path to config file, overrides the lookup below")
+	flag.Var((*pathsFlag)(&cli.ScreensPaths), "p", "Path to where screenshots are saved locally, repeat -p to watch several (default on macOS where it saves screenshots)")
+	flag.BoolVar(&cli.Recursive, "recursive", false, "Also upload screenshots saved in directories below -p")
+	flag.BoolVar(&cli.Poll, "poll", false, "Find new files by listing -p every poll_interval instead of waiting for events, for network filesystems")
+	flag.StringVar(&cli.ArchiveDir, "archive-dir", "", "Move files there after uploading them instead of deleting them, into a folder per month")
+	flag.StringVar(&cli.MaxSize, "max-size", "", "Don't upload files larger than this, e.g. 500M or 2G, skrins upload -force uploads them anyway (default unlimited)")
+	flag.BoolVar(&cli.MoveTooLarge, "move-too-large", false, "Move files larger than -max-size to a too-large folder next to them")
+	flag.IntVar(&cli.BundleOver, "bundle-over", 0, "Upload more than this many files coming in within bundle_window (default 2s) as one zip (default never)")
+	flag.IntVar(&cli.MaxUploads, "max-uploads", 0, "Upload at most this many files within max_uploads_per (default 1m), more wait for room (default unlimited)")
+	flag.BoolVar(&cli.NoQuarantine, "no-quarantine", false, "Leave files whose uploads keep failing where they are instead of moving them to a failed folder")
+	flag.BoolVar(&cli.NoNameCheck, "no-name-check", false, "Upload random names without checking whether the server has a file by that name already")
+	flag.StringVar(&cli.DateDirs, "date-dirs", "", "Put files into folders by date below remote_path, as this Go time layout has them, e.g. 2006/01")
+	flag.StringVar(&cli.NameTemplate, "name-template", "", "Name files on the server after this, e.g. '{date:2006-01-02}-{rand:8}.{ext}'")
+	flag.StringVar(&cli.Naming, "naming", "", "How files are named on the server: random, original, original-prefixed with a few random characters, counter, or hash after the SHA-256 of their content (default random)")
+	flag.BoolVar(&cli.Trash, "trash", false, "Move files to the trash after uploading them instead of deleting them")
+	flag.DurationVar(&cli.DeleteAfter, "delete-after", 0, "Keep files this long after uploading them, e.g. 30m, then delete, trash or archive them; skrins status lists them (default right away)")
+	flag.BoolVar(&cli.KeepLocal, "keep-local", false, "Leave files where they are after uploading them instead of deleting them")
+	flag.BoolVar(&cli.NoDedup, "no-dedup", false, "Upload files again that were uploaded already, instead of copying their URL")
+	flag.DurationVar(&cli.MaxAge, "max-age", 0, "Only upload files modified at most this long before their events, e.g. 10m, older ones are left alone (default any age)")
+	flag.BoolVar(&cli.ScanOnStart, "scan-on-start", false, "Also upload the files already in -p at startup, those modified within scan_max_age (default 24h)")
+	flag.IntVar(&cli.Workers, "workers", 0, "How many files are uploaded at once, up to 4 (default 1, in the order they're saved)")
+	flag.DurationVar(&cli.Debounce, "debounce", 0, "How long a file has to be left alone before it's uploaded (default 500ms)")
+	flag.StringVar(&cli.ProfileName, "profile", "", "Name of the config file profile to upload to (default default_profile)")
+	flag.StringVar(&cli.Profile.RemoteHost, "r", "", "Remote host, e.g. example.com, example.com:2003, [2001:db8::1]:22 or ssh://user@example.com:2003")
+	flag.StringVar(&cli.Profile.RemoteUser, "ru", "", "Username on remote host")
+	flag.Var((*keysFlag)(&cli.Profile.Key), "pk", "Private key path, several may be given comma separated or by repeating -pk")
+	flag.StringVar(&cli.Profile.KeyPassphraseFile, "pk-pass-file", "", "File holding the passphrase of the private key")
+	flag.Var(boolFlag{&cli.Profile.UseAgent}, "use-agent", "Authenticate with the SSH agent, also used when -pk is not given and SSH_AUTH_SOCK is set")
+	flag.StringVar(&cli.Profile.RemotePath, "rp", "", "Path on the remote host")
+	flag.StringVar(&cli.Profile.Jump, "jump", "", "Connect through jump hosts, [user@]host[:port], several comma separated, like ssh -J")
+	flag.StringVar(&cli.Profile.Proxy, "proxy", "", "Connect through a proxy, socks5://[user:pass@]host:port or http://[user:pass@]host:port (default ALL_PROXY)")
+	flag.StringVar(&cli.Profile.KnownHosts, "known-hosts", "", "known_hosts file to verify the server key with (default ~/.ssh/known_hosts)")
+	flag.Var(boolFlag{&cli.Profile.InsecureHostKey}, "insecure-host-key", "Don't verify the server key at all")
+	flag.StringVar(&cli.Profile.BaseURL, "url", "", "A base URL that points to given screenshot, e.g https://i.slacki.io/")
+	flag.Var((*listFlag)(&cli.Extensions), "ext", "Comma separated extensions to allow on top of the defaults, e.g. pdf,svg")
+	flag.Var((*listFlag)(&cli.DenyExtensions), "deny-ext", "Comma separated extensions to never upload, wins over -ext")
+	flag.Var((*listFlag)(&cli.Include), "include", "Comma separated file name patterns, only matching files are uploaded, e.g. 'Screenshot*.png'")
+	flag.Var((*listFlag)(&cli.Ignore), "ignore", "Comma separated file name patterns to leave alone on top of the defaults, e.g. '*.psd'")
+	flag.BoolVar(&cli.Debug, "debug", false, "Log more about what skrins is doing")
+	flag.BoolVar(&cli.DryRun, "dry-run", false, "Only log what would be uploaded, deleted and copied")
+	flag.StringVar(&cli.Compress, "compress", "", "Compress files on the way to the server: gzip, for the sftp and local backends; files that are compressed already, like png, mp4 or zip, are left as they are")
+	flag.StringVar(&cli.DetectType, "detect-type", "", "How to tell what a file is: extension, sniff-fallback to look at the content of files without a known extension, or sniff-strict to always look and refuse files that aren't what their extension says (default extension)")
+	flag.StringVar(&cli.Verify, "verify", "", "How to check an upload before deleting the local file: size, or sha256 to also compare checksums (default size)")
+	flag.StringVar(&cli.LimitRate, "limit-rate", "", "Upload at most this many bytes per second over all uploads, e.g. 500K or 2M (default unlimited)")
+	flag.BoolVar(&cli.Mkdirs, "mkdirs", true, "Create missing directories on the remote host")
+	flag.BoolVar(&cli.NoPersistentConn, "no-persistent-conn", false, "Connect for every upload instead of keeping the connection open")
+	flag.BoolVar(&cli.Progress.Notify, "progress-notifications", false, "Show the progress of large uploads in a notification at 25, 50, 75 and 100%")
+	flag.Usage = usage
 }
 
-func watch() {
-	for {
-		select {
-		case event, ok := <-watcher.Events:
-			if !ok {
-				return
-			}
-			if event.Op&fsnotify.Write == fsnotify.Write {
-				upload()
-			}
-			if event.Op&fsnotify.Create == fsnotify.Create {
-				upload()
-			}
-		case err, ok := <-watcher.Errors:
-			if !ok {
-				return
-			}
-			log.Println("error:", err)
+// applyFlags loads the settings with the flags parsed, exiting when they're
+// not good to start with
+func applyFlags() {
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "mkdirs" {
+			cli.MkdirsSet = true
+		}
+	})
+
+	s, err := loadSettings(cli, os.Getenv)
+	var invalid *settingsError
+	if errors.As(err, &invalid) {
+		if (len(s.ScreensPaths) == 0 || s.AutoPath) && s.Profile.empty() {
+			// nothing was configured at all, the user most likely wants help
+			flag.Usage()
+			os.Exit(2)
+		}
+		fmt.Fprintln(os.Stderr, "skrins can't start:")
+		for _, p := range invalid.Problems {
+			fmt.Fprintln(os.Stderr, "  -", p)
+		}
+		fmt.Fprintf(os.Stderr, "set missing values with flags, SKRINS_* environment variables or in %s\n", invalid.ConfigFile)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := unlockCredentials(s, true); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkBackends(s); err != nil {
+		log.Fatal(err)
+	}
+	current.Store(s)
+	uploadLimiter.setRate(s.RateLimit)
+	s.log()
+}
+
+// handleSignals reloads settings on SIGHUP, pauses and resumes uploads on
+// SIGUSR1 and SIGUSR2 and closes open connections before exiting on SIGINT
+// and SIGTERM
+func handleSignals() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, append([]os.Signal{syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM}, pauseSignals...)...)
+	for s := range sig {
+		switch s {
+		case syscall.SIGHUP:
+			reload()
+			continue
+		case pauseSignal:
+			pause(currentSettings())
+			continue
+		case resumeSignal:
+			resume(currentSettings())
+			continue
 		}
+		closeControl()
+		saveQueue()
+		conns.closeAll()
+		ftpConns.closeAll()
+		os.Exit(0)
 	}
 }
 
-func upload() {
-	fileExtRegexp, _ := regexp.Compile(".*?\\.(\\w+)$")
+// usage prints flag defaults followed by the config file lookup order
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintln(flag.CommandLine.Output(), "\nskrins init writes a config file, skrins auth signs in to backends that need a browser for it, skrins last shows the last link and renews a presigned one with -renew, skrins history lists the last uploads, skrins upload uploads the files given and prints their URLs, with -force even those above -max-size, skrins retry-failed brings back the files moved aside after failing, skrins pause, skrins resume and skrins status control the running skrins.")
+	fmt.Fprintln(flag.CommandLine.Output(), "\nWithout -config the first existing file of these is used:")
+	for _, c := range defaultConfigCandidates() {
+		fmt.Fprintln(flag.CommandLine.Output(), "  "+c)
+	}
+}
 
-	fi, err := ioutil.ReadDir(screensPath)
+// announcing keeps the URL copied and the notification of one upload
+// together when several finish at once
+var announcing sync.Mutex
+
+// announced is when the file whose URL was copied last was modified, and
+// when it was copied
+var announced struct{ modified, at time.Time }
+
+// copyURL copies url of the file modified at modified, whose upload started
+// at started, unless the URL of a file modified later was copied since.
+// With several workers a large file may finish after the screenshot taken
+// next, the clipboard gets the newest one's. announcing must be locked.
+func copyURL(fx effects, url string, modified, started time.Time) {
+	if announced.modified.After(modified) && announced.at.After(started) {
+		debugf("not copying %s, the URL of a newer file was copied meanwhile", url)
+		return
+	}
+	announced.modified, announced.at = modified, time.Now()
+	fx.copyToClipboard(url)
+}
+
+// uploadPath uploads the file at path once its events settled. A directory
+// is a screenshot path that came back or, with recursive, one created
+// below it, the files saved to it before its watch was added are uploaded.
+func uploadPath(ctx context.Context, path string) {
+	s := currentSettings()
+	if paths, ok := readyBundle(path); ok {
+		uploadBundle(ctx, s, effectsFor(s), path, paths)
+		return
+	}
+	fi, err := os.Stat(path)
 	if err != nil {
-		log.Fatal(err)
+		// renamed or deleted before its events settled
+		debugf("skipping %s: %v", path, err)
+		return
+	}
+	if !fi.IsDir() {
+		if s.ignored(path) || !s.included(path) {
+			return
+		}
+		uploadFiles(ctx, s, []string{path}, []os.FileInfo{fi})
+		return
+	}
+	if !s.Recursive && !contains(s.ScreensPaths, path) {
+		return
+	}
+	paths, infos, err := s.screenshotFiles(path)
+	if err != nil {
+		debugf("not uploading the files in %s: %v", path, err)
+		return
+	}
+	now := time.Now()
+	recent := byModTime{}
+	for i := range paths {
+		if !s.tooOld(paths[i], infos[i].ModTime(), now) {
+			recent.paths, recent.infos = append(recent.paths, paths[i]), append(recent.infos, infos[i])
+		}
 	}
+	paths, infos = recent.paths, recent.infos
+	sort.Stable(byModTime{paths, infos})
+	uploadFiles(ctx, s, paths, infos)
+}
 
-	for _, f := range fi {
-		fmt.Println(f.Name())
-		if f.IsDir() {
+// uploadFiles uploads the files at paths one after the other, several of
+// them as a batch
+func uploadFiles(ctx context.Context, s *settings, paths []string, infos []os.FileInfo) {
+	fx := effectsFor(s)
+	if len(paths) > 1 {
+		defer uploadingListing()()
+	}
+	for i, path := range paths {
+		if held(s, path) || gathered(s, path) || overUploadLimit(s, path) {
 			continue
 		}
-		fullPath := screensPath + f.Name()
-
-		matches := fileExtRegexp.FindAllStringSubmatch(f.Name(), -1)
+		uploadFile(ctx, s, fx, path, infos[i])
+	}
+}
 
-		if len(matches) > 0 && len(matches[0]) > 1 {
-			ext := matches[0][1]
-			if !allowedExtension(ext) {
-				continue
+// uploadFile takes the file at fullPath through the whole pipeline: it's
+// uploaded once it's written, then its URL is copied and the file removed
+func uploadFile(ctx context.Context, s *settings, fx effects, fullPath string, f os.FileInfo) {
+	started := time.Now()
+	ext := fileExtension(f.Name())
+	if (ext == "" || !s.allowedExtension(ext)) && s.DetectType == detectExtension {
+		return
+	}
+	f, err := waitUntilWritten(fullPath, s.StablePeriod, s.StableMaxWait)
+	if errors.Is(err, errStillWriting) {
+		log.Printf("%s is still being written after %s, trying again later", fullPath, s.StableMaxWait)
+		scheduleRetry(fullPath)
+		return
+	}
+	if err != nil {
+		// gone or renamed since it was listed
+		debugf("skipping %s: %v", fullPath, err)
+		return
+	}
+	if d, ok := pendingDeletionOf(fullPath, f); ok {
+		debugf("skipping %s, it's uploaded and kept until %s", fullPath, d.Due.Format("15:04:05"))
+		return
+	}
+	if skipTiny(s, fx, fullPath, f) {
+		return
+	}
+	// named after the type it has, not the extension it came with
+	namedAs := fullPath
+	if detected, ok := s.detectedExtension(fullPath, ext); !ok {
+		return
+	} else if detected != ext {
+		namedAs = strings.TrimSuffix(fullPath, dotExtension(fullPath)) + "." + detected
+		ext = detected
+	}
+	if strings.EqualFold(ext, "mov") {
+		mp4 := strings.TrimSuffix(fullPath, dotExtension(fullPath)) + ".mp4"
+		kept := s.afterUpload(ext) == actionKeep
+		if _, err := os.Stat(mp4); kept && (err == nil || transcodedAlready(fullPath, f)) {
+			debugf("keeping %s, it's transcoded to %s already", fullPath, mp4)
+			return
+		}
+		log.Println("Detected .mov file, converting to mp4")
+		result := fx.transcode(fullPath, mp4)
+		if result {
+			// remove the .mov file if successfully transcoded, the
+			// mp4 comes with an event of its own and goes as after_upload
+			// has it for mp4
+			dispose(s, fx, fullPath, nil)
+			if kept {
+				rememberTranscoded(fullPath, f)
 			}
-			if ext == "mov" {
-				log.Println("Detected .mov file, converting to mp4")
-				result := ffmpegTranscode(fullPath, screensPath+"out.mp4")
-				if result {
-					// remove the .mov file if successfully transcoded
-					// next pass will upload the file
-					os.Remove(fullPath)
-					continue
-				}
+			return
+		}
+	}
+
+	if m, ok := pendingMirrorFor(fullPath, f); ok {
+		// the URL was handed out already, only the copies are missing
+		if m, err := s.completeMirror(ctx, fx, fullPath, m); len(m.Missing) == 0 {
+			dispose(s, fx, fullPath, nil)
+		} else if retryable(err) {
+			scheduleRetry(fullPath)
+		}
+		return
+	}
+
+	// after transcoding, it's the mp4 that's uploaded
+	if skipTooLarge(s, fx, fullPath, f) {
+		return
+	}
+
+	digest, err := fileSHA256(fullPath)
+	if err != nil {
+		debugf("can't hash %s, uploading it anyway: %v", fullPath, err)
+	}
+	if keptAlready(fullPath, digest) {
+		debugf("skipping %s, it's uploaded and kept already", fullPath)
+		return
+	}
+	entry := historyEntryFor(s, fullPath, f, digest)
+	if url, ok := knownURL(digest, entry.Profile); ok && !s.NoDedup {
+		log.Printf("%s was uploaded already to %s", fullPath, url)
+		announce := func(fx effects) { fx.notifyDuplicate(url) }
+		if !joinBatch(batchResult{name: f.Name(), url: url, announce: announce, modified: f.ModTime(), started: started}) {
+			announcing.Lock()
+			copyURL(fx, url, f.ModTime(), started)
+			announce(fx)
+			announcing.Unlock()
+		}
+		entry.Status, entry.URL = historyDuplicate, url
+		dispose(s, fx, fullPath, &entry)
+		fx.record(entry)
+		return
+	}
+
+	url, remoteFilename, err := uploadWithRetries(withDigest(ctx, digest), s, fx, fullPath, s.remoteNameFor(namedAs, ext, digest))
+	entry.Remote, entry.URL = remoteFilename, url
+	var degraded *degradedError
+	if errors.As(err, &degraded) {
+		log.Println(err)
+		announce := func(fx effects) { fx.notifyDegraded(url, degraded.Done, degraded.Missing) }
+		if !joinBatch(batchResult{name: f.Name(), url: url, announce: announce, modified: f.ModTime(), started: started}) {
+			announcing.Lock()
+			copyURL(fx, url, f.ModTime(), started)
+			announce(fx)
+			announcing.Unlock()
+		}
+		entry.Status, entry.Error = historyPartial, err.Error()
+		entry.Kept = degraded.Keep
+		if !degraded.Keep {
+			dispose(s, fx, fullPath, &entry)
+		} else if retryable(degraded.Err) {
+			scheduleRetry(fullPath)
+		}
+		fx.record(entry)
+		return
+	}
+	if _, statErr := os.Stat(fullPath); err != nil && os.IsNotExist(statErr) {
+		// renamed or deleted while uploading, its new name
+		// comes with an event of its own
+		debugf("%s went away while uploading: %v", fullPath, err)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		entry.Status, entry.Error = historyFailed, err.Error()
+		if moved, ok := s.quarantineIfFailing(fx, fullPath, err); ok {
+			entry.Quarantined = moved
+			fx.record(entry)
+			err = fmt.Errorf("%v, moved to %s after failing %d times", err, failedDir, s.QuarantineAfter)
+			if !joinBatch(batchResult{name: f.Name(), err: err}) {
+				fx.notifyFailure(f.Name(), err)
 			}
+			return
+		}
+		fx.record(entry)
+		if !joinBatch(batchResult{name: f.Name(), err: err}) {
+			fx.notifyFailure(f.Name(), err)
+		}
+		if retryable(err) {
+			scheduleRetry(fullPath)
+		}
+		return
+	}
+	uploadSucceeded(fullPath)
+	announce := func(fx effects) { fx.notify(url) }
+	if !joinBatch(batchResult{name: f.Name(), url: url, announce: announce, modified: f.ModTime(), started: started}) {
+		announcing.Lock()
+		copyURL(fx, url, f.ModTime(), started)
+		announce(fx)
+		announcing.Unlock()
+	}
+	entry.Status, entry.Time = historyUploaded, time.Now()
+	entry.Expires = linkExpiry(s.Profile, url, entry.Time)
+	dispose(s, fx, fullPath, &entry)
+	fx.record(entry)
+}
+
+// dispose deletes the file at path once it's uploaded, unless keep_local
+// says to leave it where it is, trash to move it to the trash or
+// archive_dir where to move it, or an after_upload rule for its extension
+// says otherwise. With delete_after that happens later, see deleteLater.
+// What became of it goes into e, unless that's nil.
+func dispose(s *settings, fx effects, path string, e *historyEntry) {
+	if e == nil {
+		e = &historyEntry{}
+	}
+	if s.DeleteAfter > 0 && s.afterUpload(fileExtension(path)) != actionKeep {
+		due := time.Now().Add(s.DeleteAfter)
+		fx.deleteLater(path, due)
+		e.DeleteAt = &due
+		return
+	}
+	disposeNow(s, fx, path, e)
+}
 
-			remoteFilename := fmt.Sprintf("%s.%s", shortuuid.New(), ext)
-			err = uploadObjectToDestination(fullPath, remoteFilename)
-			if err != nil {
-				log.Println(err)
-				continue
+// disposeNow is dispose without delete_after. Files that can't be moved are
+// kept, never deleted.
+func disposeNow(s *settings, fx effects, path string, e *historyEntry) {
+	action := s.afterUpload(fileExtension(path))
+	if action == actionKeep {
+		debugf("keeping %s", path)
+		e.Kept = true
+		return
+	}
+	if action == actionTrash {
+		err := fx.trash(path)
+		if err == nil {
+			debugf("moved %s to the trash", path)
+			e.Trashed = true
+			return
+		}
+		if s.ArchiveDir == "" {
+			log.Printf("can't move %s to the trash, keeping it: %v", path, err)
+			e.Kept = true
+			return
+		}
+		log.Printf("can't move %s to the trash, archiving it: %v", path, err)
+	} else if action == actionDelete {
+		fx.remove(path)
+		return
+	}
+	archived, err := fx.archive(path, s.ArchiveDir)
+	if err != nil {
+		// left where it is, better than deleting what was to be kept
+		log.Printf("can't move %s to %s: %v", path, s.ArchiveDir, err)
+		e.Kept = true
+		return
+	}
+	debugf("moved %s to %s", path, archived)
+	e.Archived = archived
+}
+
+// uploadToBestProfile uploads to the first reachable profile picked for the
+// current network and returns the file's URL and the name it got, which is
+// remoteFilename unless that was taken
+func uploadToBestProfile(ctx context.Context, s *settings, fx effects, fullPath, remoteFilename string) (string, string, error) {
+	var err error
+	for _, c := range s.profileCandidates() {
+		if c, err = s.takingExtension(c, remoteExtension(remoteFilename)); err != nil {
+			continue
+		}
+		up := fx.uploader(c.Profile)
+		if len(c.Profile.Destinations) > 0 {
+			// the first destination stands in for the others
+			up = fx.uploader(s.RuleProfiles[c.Profile.Destinations[0]])
+		}
+		name := remoteFilename
+		if s.DateDirs != "" && s.keepsFolders(c.Profile) {
+			name = s.inDateDirs(name, time.Now())
+		}
+		// names are freed up without the suffix compressed files get, so
+		// that stays at the end
+		cu, compress := up.(compressor)
+		compress = compress && s.compresses(c.Profile, remoteExtension(remoteFilename))
+		names := up
+		if compress {
+			names = compressedNames{up}
+		}
+		switch {
+		case s.Naming == namingHash:
+			size := int64(-1)
+			if fi, err := os.Stat(fullPath); err == nil && !compress {
+				size = fi.Size()
+			}
+			name = freeHashName(ctx, names, name, size)
+		case s.Naming == namingCounter:
+			name = s.freeCounterName(ctx, names, name)
+		case s.Naming != namingRandom || s.NameTemplate != "":
+			name = freeRemoteName(ctx, names, name)
+		case !s.NoNameCheck:
+			if name, err = freeRandomName(ctx, names, name); err != nil {
+				return "", name, err
 			}
-			url := baseURL + remoteFilename
-			copyToClipboard(url)
-			showNotification(url)
-			os.Remove(fullPath)
 		}
+		// the name is held until the server has the file, the next
+		// profile frees it up again
+		claimed := name
+		var url string
+		switch {
+		case len(c.Profile.Destinations) > 0:
+			url, err = s.uploadToDestinations(ctx, fx, c, fullPath, name)
+		case compress:
+			// routed by the extension the file has, not gzipSuffix
+			url, err = cu.uploadCompressed(ctx, fullPath, name)
+			name += gzipSuffix
+		default:
+			url, err = up.upload(ctx, fullPath, name)
+		}
+		releaseName(claimed)
+		url = escapeRemoteName(url, name)
+		if err == nil {
+			return url, name, nil
+		}
+		if !isUnreachable(err) {
+			// a degraded upload has a URL all the same
+			return url, name, err
+		}
+		log.Printf("profile %s unreachable: %v", c.Name, err)
+	}
+	return "", remoteFilename, err
+}
 
+// keepsFolders tells whether p, or every destination of it, keeps files in
+// folders
+func (s *settings) keepsFolders(p profile) bool {
+	for _, name := range p.Destinations {
+		if !s.RuleProfiles[name].hasFolders() {
+			return false
+		}
 	}
+	return p.hasFolders()
 }
 
 // showNotification displays a system notification about uploaded screenshot
 func showNotification(url string) {
-	notify = notificator.New(notificator.Options{
-		AppName: "Skrins",
-	})
-	notify.Push("Screenshot uploaded!", url, "", notificator.UR_NORMAL)
+	title := "Screenshot uploaded!"
+	if expires, ok := presignExpiry(url); ok {
+		title = "Screenshot uploaded, link expires " + expires.Local().Format("Jan 2 15:04")
+	}
+	if err := pushNotification(title, url); err != nil {
+		log.Println("notification failed:", err)
+	}
+}
+
+// showDuplicateNotification tells the user that the screenshot was
+// uploaded before and its URL copied again
+func showDuplicateNotification(url string) {
+	if err := pushNotification("Screenshot already uploaded", url); err != nil {
+		log.Println("notification failed:", err)
+	}
+}
+
+// showDegradedNotification tells the user that the screenshot at url only
+// reached the destinations done, not those missing
+func showDegradedNotification(url string, done, missing []string) {
+	title := "Screenshot uploaded to " + strings.Join(done, ", ") + " only, " + strings.Join(missing, ", ") + " failed"
+	if err := pushNotification(title, url); err != nil {
+		log.Println("notification failed:", err)
+	}
+}
+
+// showMissingPathNotification tells the user that the screenshot path dir
+// has been gone for a while
+func showMissingPathNotification(dir string) {
+	if err := pushNotification("Screenshots folder missing", dir+" is gone, skrins uploads from it again once it's back"); err != nil {
+		log.Println("notification failed:", err)
+	}
+}
+
+// showPauseNotification tells the user that uploads were paused or resumed
+func showPauseNotification(title, msg string) {
+	if err := pushNotification(title, msg); err != nil {
+		log.Println("notification failed:", err)
+	}
+}
+
+// showFailureNotification tells the user that name couldn't be uploaded
+func showFailureNotification(name string, err error) {
+	if err := pushNotification("Upload failed", fmt.Sprintf("%s: %v", name, err)); err != nil {
+		log.Println("notification failed:", err)
+	}
 }
 
 // copyToClipboard puts a string to clipboards
@@ -151,11 +671,19 @@ func copyToClipboard(s string) {
 	clipboard.WriteAll(s)
 }
 
+// defaultExtensions are uploaded unless the config file says otherwise
+var defaultExtensions = []string{"jpg", "jpeg", "png", "gif", "webm", "mp4", "mov", "zip", "tar", "tar.gz", "tar.bz2"}
+
 // allowedExtension determines whether it is allowed to upload a file with that extension
-func allowedExtension(ext string) bool {
-	allowed := []string{"jpg", "jpeg", "png", "gif", "webm", "mp4", "mov", "zip", "tar", "tar.gz", "tar.bz2"}
+func (s *settings) allowedExtension(ext string) bool {
+	ext = strings.ToLower(ext)
 
-	for _, e := range allowed {
+	for _, e := range s.DenyExtensions {
+		if ext == e {
+			return false
+		}
+	}
+	for _, e := range s.Extensions {
 		if ext == e {
 			return true
 		}
@@ -164,14 +692,37 @@ func allowedExtension(ext string) bool {
 	return false
 }
 
+// ffmpegLocations are tried when ffmpeg is not on PATH, which is common
+// for launchd agents
+var ffmpegLocations = []string{"/usr/local/bin/ffmpeg", "/opt/homebrew/bin/ffmpeg"}
+
+// ffmpegPath finds the ffmpeg binary
+func ffmpegPath() (string, error) {
+	path, err := exec.LookPath("ffmpeg")
+	if err == nil {
+		return path, nil
+	}
+	for _, l := range ffmpegLocations {
+		if _, statErr := os.Stat(l); statErr == nil {
+			return l, nil
+		}
+	}
+	return "", err
+}
+
 // ffmpegTranscode transcodes a media file.
 func ffmpegTranscode(fileIn, fileOut string) bool {
-	cmd := exec.Command("/usr/local/bin/ffmpeg", "-i", fileIn, fileOut)
+	ffmpeg, err := ffmpegPath()
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	cmd := exec.Command(ffmpeg, "-i", fileIn, fileOut)
 	var stderr bytes.Buffer
 	var stdout bytes.Buffer
 	cmd.Stderr = &stderr
 	cmd.Stdout = &stdout
-	err := cmd.Run()
+	err = cmd.Run()
 
 	if err != nil {
 		log.Println(err)
@@ -183,59 +734,17 @@ func ffmpegTranscode(fileIn, fileOut string) bool {
 	return true
 }
 
-// newSFTPClient creates new sFTP client
-func newSFTPClient() (*sftp.Client, error) {
-	key, err := ioutil.ReadFile(sshKeyPath)
-	if err != nil {
-		return nil, err
-	}
-	signer, err := ssh.ParsePrivateKey(key)
-	if err != nil {
-		return nil, err
-	}
-	config := &ssh.ClientConfig{
-		User: remoteUser,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signer),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	}
-	client, err := ssh.Dial("tcp", remoteHost, config)
-	if err != nil {
-		return nil, err
-	}
-	return sftp.NewClient(client)
-}
-
-// uploadObjectToDestination uploads file to a remote host
-func uploadObjectToDestination(src, dest string) error {
-	client, err := newSFTPClient()
-	if err != nil {
-		return err
-	}
-	defer client.Close()
-
-	// create destination file
-	// remotePath is expected to have a trailing slash
-	dstFile, err := client.OpenFile(remotePath+dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
-	if err != nil {
-		return err
-	}
-	defer dstFile.Close()
-
-	// open local file
-	srcReader, err := os.Open(src)
-	if err != nil {
-		return err
-	}
-
-	// copy source file to destination file
-	bytes, err := io.Copy(dstFile, srcReader)
-	if err != nil {
-		return err
+// removeFile deletes a local file. Screenshot tools on Windows may still
+// hold the file open for a moment, so failures are retried with a backoff.
+func removeFile(path string) error {
+	delay := 50 * time.Millisecond
+	var err error
+	for attempt := 0; attempt < 5; attempt++ {
+		if err = os.Remove(path); err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		time.Sleep(delay)
+		delay *= 2
 	}
-
-	log.Printf("Total of %d bytes copied\n", bytes)
-
-	return nil
+	return err
 }
@@ -0,0 +1,85 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/atotto/clipboard"
+)
+
+func TestRemoveFileHeldOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skrins-remove")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "Screenshot (1).png")
+	if err := ioutil.WriteFile(path, []byte("png"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// like the Snipping Tool, which still has it open for a moment
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(100*time.Millisecond, func() { f.Close() })
+	if err := removeFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("%s is still there: %v", path, err)
+	}
+	// gone already counts as removed
+	if err := removeFile(path); err != nil {
+		t.Errorf("removing it again: %v", err)
+	}
+}
+
+func TestFFmpegPath(t *testing.T) {
+	// a Unix path never exists here, only PATH counts
+	dir, err := ioutil.TempDir("", "skrins-ffmpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	setEnv(t, "PATH", dir)
+	if path, err := ffmpegPath(); err == nil {
+		t.Errorf("found ffmpeg at %s, with an empty PATH", path)
+	}
+	ffmpeg := filepath.Join(dir, "ffmpeg.exe")
+	if err := ioutil.WriteFile(ffmpeg, nil, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if path, err := ffmpegPath(); err != nil || !os.SameFile(statOf(t, path), statOf(t, ffmpeg)) {
+		t.Errorf("ffmpegPath() = %s, %v, want %s", path, err, ffmpeg)
+	}
+}
+
+// statOf stats path for t
+func statOf(t *testing.T, path string) os.FileInfo {
+	t.Helper()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi
+}
+
+func TestClipboard(t *testing.T) {
+	old, err := clipboard.ReadAll()
+	if err != nil {
+		t.Skip("no clipboard:", err)
+	}
+	defer clipboard.WriteAll(old)
+	url := "https://i.example.com/Zr8tW.png"
+	copyToClipboard(url)
+	if got, err := clipboard.ReadAll(); err != nil || got != url {
+		t.Errorf("clipboard has %q, %v, want %s", got, err, url)
+	}
+}
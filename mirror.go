@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How a profile with destinations uploads to them
+const (
+	policyMirror   = "mirror"
+	policyFailover = "failover"
+)
+
+// destinationProblems checks the destinations of a profile. Whether the
+// profiles they name exist is checked when they're loaded.
+func destinationProblems(p profile) []string {
+	var problems []string
+	if p.DestinationPolicy != "" && p.DestinationPolicy != policyMirror && p.DestinationPolicy != policyFailover {
+		problems = append(problems, fmt.Sprintf("destination_policy must be %s or %s, not %q", policyMirror, policyFailover, p.DestinationPolicy))
+	}
+	if len(p.Destinations) > 0 && p.Backend != "" {
+		problems = append(problems, "a profile with destinations uploads to them, backend can't be set too")
+	}
+	return problems
+}
+
+// nestedDestinations reports destinations with destinations of their own,
+// which are only followed one level deep
+func (s *settings) nestedDestinations() []string {
+	profiles := map[string]profile{"selected": s.Profile}
+	for name, p := range s.RuleProfiles {
+		profiles[name] = p
+	}
+	var problems []string
+	for name, p := range profiles {
+		for _, d := range p.Destinations {
+			if len(s.RuleProfiles[d].Destinations) > 0 {
+				problems = append(problems, fmt.Sprintf("profile %s: destination %s can't have destinations of its own", name, d))
+			}
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// policy is how p uploads to its destinations
+func (p profile) policy() string {
+	if p.DestinationPolicy == "" {
+		return policyMirror
+	}
+	return p.DestinationPolicy
+}
+
+// degradedError is returned when an upload only reached some of a
+// profile's destinations. The file is at URL all the same. Keep is set for
+// mirrors, whose missing copies are made later from the local file.
+type degradedError struct {
+	URL     string
+	Done    []string
+	Missing []string
+	Keep    bool
+	Err     error
+}
+
+func (e *degradedError) Error() string {
+	return fmt.Sprintf("uploaded to %s only, %s failed: %v", strings.Join(e.Done, ", "), strings.Join(e.Missing, ", "), e.Err)
+}
+
+// temporary is false, the upload isn't done again: a failover made it and
+// the missing copies of a mirror are left to scheduleRetry
+func (e *degradedError) temporary() bool {
+	return false
+}
+
+// uploadToDestinations uploads to the destinations of c by its policy and
+// returns the URL at the first one that has the file. Destinations that
+// don't take the file's extension are left out.
+func (s *settings) uploadToDestinations(ctx context.Context, fx effects, c namedProfile, fullPath, remoteFilename string) (string, error) {
+	var done, missing []string
+	var url string
+	var err error
+	for _, name := range c.Profile.Destinations {
+		d, extErr := s.takingExtension(namedProfile{Name: name, Profile: s.RuleProfiles[name]}, remoteExtension(remoteFilename))
+		if extErr != nil {
+			debugf("destination %s: %v", name, extErr)
+			continue
+		}
+		u, uploadErr := fx.uploader(d.Profile).upload(ctx, fullPath, remoteFilename)
+		if uploadErr != nil {
+			log.Printf("upload of %s to destination %s failed: %v", fullPath, name, uploadErr)
+			missing = append(missing, name)
+			err = uploadErr
+			continue
+		}
+		if url == "" {
+			url = u
+		}
+		done = append(done, name)
+		if c.Profile.policy() == policyFailover {
+			break
+		}
+	}
+
+	switch {
+	case len(done) == 0 && err == nil:
+		return "", fmt.Errorf("none of the destinations of profile %s take .%s files", c.Name, remoteExtension(remoteFilename))
+	case len(done) == 0:
+		return "", err
+	case len(missing) == 0:
+		return url, nil
+	}
+	keep := c.Profile.policy() == policyMirror
+	if keep {
+		fi, statErr := os.Stat(fullPath)
+		if statErr != nil {
+			return url, statErr
+		}
+		savePendingMirror(fullPath, pendingMirror{RemoteName: remoteFilename, URL: url, Missing: missing, Size: fi.Size(), ModTime: fi.ModTime()})
+	}
+	return url, &degradedError{URL: url, Done: done, Missing: missing, Keep: keep, Err: err}
+}
+
+// pendingMirror is a file uploaded to only some destinations of a mirror.
+// It's kept until the missing copies are made, which only applies while
+// it's unchanged.
+type pendingMirror struct {
+	RemoteName string    `json:"remote_name"`
+	URL        string    `json:"url"`
+	Missing    []string  `json:"missing"`
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"mod_time"`
+}
+
+// mirrorsFile holds the pending mirrors by local path, in the state
+// directory
+const mirrorsFile = "mirrors.json"
+
+// mirrorsMu guards the mirrors file
+var mirrorsMu sync.Mutex
+
+// readPendingMirrors loads the pending mirrors, an unreadable file counts
+// as empty and the files are uploaded again
+func readPendingMirrors() map[string]pendingMirror {
+	mirrors := make(map[string]pendingMirror)
+	if err := readState(mirrorsFile, &mirrors); err != nil && !os.IsNotExist(err) {
+		debugf("ignoring %s: %v", mirrorsFile, err)
+	}
+	return mirrors
+}
+
+// pendingMirrorFor returns the pending mirror of the local file src, if
+// there's one and src hasn't changed since
+func pendingMirrorFor(src string, fi os.FileInfo) (pendingMirror, bool) {
+	mirrorsMu.Lock()
+	defer mirrorsMu.Unlock()
+	m, ok := readPendingMirrors()[src]
+	if !ok || m.Size != fi.Size() || !m.ModTime.Equal(fi.ModTime()) {
+		return pendingMirror{}, false
+	}
+	return m, true
+}
+
+// savePendingMirror remembers the missing copies of src, or forgets them
+// when there are none left
+func savePendingMirror(src string, m pendingMirror) {
+	mirrorsMu.Lock()
+	defer mirrorsMu.Unlock()
+	mirrors := readPendingMirrors()
+	if len(m.Missing) == 0 {
+		delete(mirrors, src)
+	} else {
+		mirrors[src] = m
+	}
+	if err := writeState(mirrorsFile, mirrors); err != nil {
+		log.Printf("can't save the missing copies of %s: %v", src, err)
+	}
+}
+
+// completeMirror makes the missing copies of a pending mirror, under the
+// remote name its URL was handed out with. The destinations that still
+// fail stay in it.
+func (s *settings) completeMirror(ctx context.Context, fx effects, fullPath string, m pendingMirror) (pendingMirror, error) {
+	var missing []string
+	var err error
+	for _, name := range m.Missing {
+		p, ok := s.RuleProfiles[name]
+		if !ok {
+			log.Printf("destination %s of %s is gone from the settings, leaving it out", name, fullPath)
+			continue
+		}
+		if _, uploadErr := fx.uploader(p).upload(ctx, fullPath, m.RemoteName); uploadErr != nil {
+			log.Printf("upload of %s to destination %s failed: %v", fullPath, name, uploadErr)
+			missing = append(missing, name)
+			err = uploadErr
+			continue
+		}
+		log.Printf("copied %s to destination %s", m.URL, name)
+	}
+	m.Missing = missing
+	savePendingMirror(fullPath, m)
+	return m, err
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/lithammer/shortuuid/v3"
+	"golang.org/x/text/unicode/norm"
+)
+
+// How files are named on the server, see naming
+const (
+	// namingRandom names them with a random id, nothing about the file
+	// shows in the URL and it can't be guessed
+	namingRandom = "random"
+	// namingOriginal keeps their name, made safe for URLs and servers
+	namingOriginal = "original"
+	// namingOriginalPrefixed keeps their name after namePrefixLength
+	// random characters, so names don't collide and can't be guessed
+	namingOriginalPrefixed = "original-prefixed"
+	// namingCounter numbers them, counter_prefix followed by the number
+	// padded to counter_digits, see claimCounter
+	namingCounter = "counter"
+	// namingHash names them after the first hash_length characters of the
+	// SHA-256 of their content, so the same file always gets the same name
+	namingHash = "hash"
+)
+
+// defaultHashLength is how many characters of the digest namingHash uses
+// unless the config file sets hash_length, 64 bits
+const defaultHashLength = 16
+
+// namePrefixLength is how many random characters namingOriginalPrefixed
+// puts in front of the name
+const namePrefixLength = 6
+
+// maxNameLength caps the length in bytes of a kept name without its
+// extension, servers refuse names above 255 and URLs get unwieldy before
+const maxNameLength = 100
+
+// maxRandomNames is how many random names freeRandomName tries before it
+// gives up, more than one taken means something else is going on
+const maxRandomNames = 5
+
+// maxNameCounter is how far freeRemoteName counts before it gives up and
+// makes the name unique with a random id instead
+const maxNameCounter = 100
+
+// nameValues are what the placeholders of name_template stand for
+type nameValues struct {
+	// Orig is the local file name without its extension, Ext that
+	Orig, Ext string
+	Host      string
+	Now       time.Time
+	Seq       int64
+}
+
+// defaultDateLayout is what {date} without a layout looks like
+const defaultDateLayout = "2006-01-02_15-04-05"
+
+// defaultRandLength is how many random characters {rand} stands for
+const defaultRandLength = 8
+
+// nameFromTemplate fills in the placeholders of the name_template tmpl:
+// {date:layout} with the time as the Go time layout has it, {host},
+// {orig}, {rand:n} with n random characters, {seq:n} with the number
+// from seqFile padded to n digits and {ext}. What's filled in is made safe like
+// sanitizeName does.
+func nameFromTemplate(tmpl string, v nameValues) (string, error) {
+	return expandTemplate(tmpl, func(token, arg string) (string, error) {
+		switch token {
+		case "date":
+			if arg == "" {
+				arg = defaultDateLayout
+			}
+			return sanitizeName(v.Now.Format(arg)), nil
+		case "host":
+			if arg != "" {
+				return "", fmt.Errorf("{host} takes nothing after a colon")
+			}
+			return sanitizeName(v.Host), nil
+		case "orig":
+			if arg != "" {
+				return "", fmt.Errorf("{orig} takes nothing after a colon")
+			}
+			return sanitizeName(v.Orig), nil
+		case "ext":
+			if arg != "" {
+				return "", fmt.Errorf("{ext} takes nothing after a colon")
+			}
+			return v.Ext, nil
+		case "rand":
+			n, err := placeholderNumber(token, arg, defaultRandLength, len(shortuuid.New()))
+			if err != nil {
+				return "", err
+			}
+			return shortuuid.New()[:n], nil
+		case "seq":
+			n, err := placeholderNumber(token, arg, 1, 20)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%0*d", n, v.Seq), nil
+		}
+		return "", fmt.Errorf("unknown placeholder {%s}, use {date}, {host}, {orig}, {rand}, {seq} or {ext}", token)
+	})
+}
+
+// placeholderNumber is the number after the colon of {token:arg}, between
+// 1 and max, or def without one
+func placeholderNumber(token, arg string, def, max int) (int, error) {
+	if arg == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 || n > max {
+		return 0, fmt.Errorf("{%s:%s}: that's a number from 1 to %d", token, arg, max)
+	}
+	return n, nil
+}
+
+// nameTemplateProblems checks name_template by filling it in once, so a
+// mistyped placeholder is found at startup rather than in a URL
+func nameTemplateProblems(tmpl string) []string {
+	if tmpl == "" {
+		return nil
+	}
+	name, err := nameFromTemplate(tmpl, nameValues{Orig: "Screenshot", Ext: "png", Host: "host", Now: time.Now(), Seq: 1})
+	switch {
+	case err != nil:
+		return []string{"name_template " + err.Error()}
+	case !strings.Contains(tmpl, "{ext}"):
+		return []string{fmt.Sprintf("name_template %q has no {ext}, files need their extension on the server", tmpl)}
+	case strings.ContainsAny(name, `/\`):
+		return []string{fmt.Sprintf("name_template %q can't have / or \\ in it", tmpl)}
+	}
+	return nil
+}
+
+// remoteNameFor is the name the file at localPath with the extension ext
+// gets on the server. digest is the SHA-256 of its content when that's
+// known already, naming hash reads the file for it otherwise.
+func (s *settings) remoteNameFor(localPath, ext, digest string) string {
+	if s.NameTemplate != "" {
+		host, _ := os.Hostname()
+		var seq int64
+		var err error
+		if strings.Contains(s.NameTemplate, "{seq") {
+			// counts on from the last run, in seqFile like claimCounter
+			if seq, err = claimNumber(seqFile); err != nil {
+				log.Printf("can't number %s, using a random name: %v", localPath, err)
+				return fmt.Sprintf("%s.%s", shortuuid.New(), ext)
+			}
+		}
+		name, err := nameFromTemplate(s.NameTemplate, nameValues{
+			Orig: strings.TrimSuffix(filepath.Base(localPath), "."+ext),
+			Ext:  ext,
+			Host: host,
+			Now:  time.Now(),
+			Seq:  seq,
+		})
+		if err == nil && strings.TrimSuffix(name, "."+ext) != "" {
+			return name
+		}
+		// checked at startup, but a file name may leave nothing
+		debugf("name_template gives no name for %s, using a random one: %v", localPath, err)
+		return fmt.Sprintf("%s.%s", shortuuid.New(), ext)
+	}
+	if s.Naming == namingCounter {
+		n, err := claimCounter()
+		if err == nil {
+			return s.counterName(n, ext)
+		}
+		log.Printf("can't number %s, using a random name: %v", localPath, err)
+	}
+	if s.Naming == namingHash {
+		var err error
+		if digest == "" {
+			digest, err = fileSHA256(localPath)
+		}
+		if err == nil {
+			return fmt.Sprintf("%s.%s", digest[:s.HashLength], ext)
+		}
+		log.Printf("can't hash %s, using a random name: %v", localPath, err)
+	}
+	if s.Naming == namingRandom || s.Naming == namingCounter || s.Naming == namingHash {
+		return fmt.Sprintf("%s.%s", shortuuid.New(), ext)
+	}
+	stem := sanitizeName(strings.TrimSuffix(filepath.Base(localPath), "."+ext))
+	if stem == "" {
+		// nothing was left of it
+		return fmt.Sprintf("%s.%s", shortuuid.New(), ext)
+	}
+	if s.Naming == namingOriginalPrefixed {
+		stem = shortuuid.New()[:namePrefixLength] + "-" + stem
+	}
+	return fmt.Sprintf("%s.%s", stem, ext)
+}
+
+// sanitizeName makes the file name stem safe to use on servers and in
+// URLs: it's normalized to NFC, runs of spaces become a dash, path
+// separators, control characters and those reserved in URLs or on Windows
+// are left out and it's cut to maxNameLength bytes. Letters of any script
+// are kept, they're percent-encoded in the URL.
+func sanitizeName(stem string) string {
+	var sb strings.Builder
+	dash := false
+	for _, r := range norm.NFC.String(stem) {
+		switch {
+		case unicode.IsSpace(r) || r == '-':
+			dash = sb.Len() > 0
+			continue
+		case unicode.IsControl(r) || strings.ContainsRune(`/\:*?"<>|#%&{}^~[]`+"`", r):
+			continue
+		}
+		if dash {
+			sb.WriteByte('-')
+			dash = false
+		}
+		sb.WriteRune(r)
+	}
+	name := strings.TrimLeft(sb.String(), ".-")
+	if len(name) > maxNameLength {
+		cut := maxNameLength
+		for cut > 0 && !utf8.RuneStart(name[cut]) {
+			cut--
+		}
+		name = strings.TrimRight(name[:cut], "-.")
+	}
+	return name
+}
+
+// claimedNames are the names freeRemoteName and freeRandomName picked for
+// uploads that are still running. The server doesn't show those yet, so
+// without them two uploads at once could pick the same name.
+var claimedNames = struct {
+	sync.Mutex
+	names map[string]bool
+}{names: map[string]bool{}}
+
+// claimName reserves name for an upload, false when another one has it
+func claimName(name string) bool {
+	claimedNames.Lock()
+	defer claimedNames.Unlock()
+	if claimedNames.names[name] {
+		return false
+	}
+	claimedNames.names[name] = true
+	return true
+}
+
+// releaseName lets go of name once its upload is done, the server has it
+// or it failed
+func releaseName(name string) {
+	claimedNames.Lock()
+	defer claimedNames.Unlock()
+	delete(claimedNames.names, name)
+}
+
+// freeRemoteName is name, or name with -2, -3 and so on before the
+// extension when up has a file by that name already or another upload
+// claimed it. Backends that can't look files up, and lookups that fail,
+// get name as it is. The name is claimed until releaseName.
+func freeRemoteName(ctx context.Context, up uploader, name string) string {
+	st, ok := up.(statter)
+	if !ok {
+		return name
+	}
+	ext := dotExtension(name)
+	stem := strings.TrimSuffix(name, ext)
+	candidate := name
+	for n := 2; n <= maxNameCounter; n++ {
+		if !claimName(candidate) {
+			debugf("%s is claimed by another upload", candidate)
+			candidate = fmt.Sprintf("%s-%d%s", stem, n, ext)
+			continue
+		}
+		_, err := st.stat(ctx, candidate)
+		if errors.Is(err, os.ErrNotExist) {
+			return candidate
+		}
+		if err != nil {
+			debugf("can't tell whether %s is taken, uploading it as that: %v", candidate, err)
+			return candidate
+		}
+		releaseName(candidate)
+		debugf("%s is taken", candidate)
+		candidate = fmt.Sprintf("%s-%d%s", stem, n, ext)
+	}
+	candidate = fmt.Sprintf("%s-%s%s", stem, shortuuid.New()[:namePrefixLength], ext)
+	claimName(candidate)
+	return candidate
+}
+
+// freeRandomName is the random name, or another one in the same folder
+// when up has a file by that name already or another upload claimed it,
+// so no upload is overwritten. Backends that can't look files up, and
+// lookups that fail, get name as it is. The name is claimed until
+// releaseName.
+func freeRandomName(ctx context.Context, up uploader, name string) (string, error) {
+	st, ok := up.(statter)
+	if !ok {
+		return name, nil
+	}
+	dir, ext := path.Dir(name), dotExtension(name)
+	for tries := 0; tries < maxRandomNames; tries++ {
+		if !claimName(name) {
+			debugf("%s is claimed by another upload", name)
+			name = path.Join(dir, shortuuid.New()+ext)
+			continue
+		}
+		_, err := st.stat(ctx, name)
+		if errors.Is(err, os.ErrNotExist) {
+			return name, nil
+		}
+		if err != nil {
+			debugf("can't tell whether %s is taken, uploading it as that: %v", name, err)
+			return name, nil
+		}
+		releaseName(name)
+		debugf("%s is taken", name)
+		name = path.Join(dir, shortuuid.New()+ext)
+	}
+	return name, fmt.Errorf("%d random names in a row are taken on the server, not overwriting any of them", maxRandomNames)
+}
+
+// freeHashName is the name namingHash made, which a file with the same
+// content may have on the server already, overwriting that loses nothing.
+// One of another size has other content, the name gets namePrefixLength
+// random characters after a dash then. size is -1 when sizes can't be
+// compared, like for compressed files, which are taken to be the same.
+func freeHashName(ctx context.Context, up uploader, name string, size int64) string {
+	st, ok := up.(statter)
+	if !ok {
+		return name
+	}
+	fi, err := st.stat(ctx, name)
+	if errors.Is(err, os.ErrNotExist) {
+		return name
+	}
+	if err != nil {
+		debugf("can't tell whether %s is taken, uploading it as that: %v", name, err)
+		return name
+	}
+	if size < 0 || fi.Size() == size {
+		debugf("%s is on the server already, with the same content", name)
+		return name
+	}
+	log.Printf("%s is on the server already with other content, %d bytes instead of %d", name, fi.Size(), size)
+	ext := dotExtension(name)
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(name, ext), shortuuid.New()[:namePrefixLength], ext)
+}
+
+// escapeRemoteName percent-encodes name at the end of link, where
+// backends put it as it is, but for the slashes between its folders.
+// Other links are left alone.
+func escapeRemoteName(link, name string) string {
+	parts := strings.Split(name, "/")
+	for i := range parts {
+		parts[i] = url.PathEscape(parts[i])
+	}
+	escaped := strings.Join(parts, "/")
+	if escaped == name || !strings.HasSuffix(link, name) {
+		return link
+	}
+	return strings.TrimSuffix(link, name) + escaped
+}
+
+// inDateDirs puts name into the folders date_dirs makes of now
+func (s *settings) inDateDirs(name string, now time.Time) string {
+	return path.Join(now.Format(s.DateDirs), name)
+}
+
+// dateDirsProblems checks date_dirs on a sample date, it has to make
+// folders below remote_path
+func dateDirsProblems(layout string) []string {
+	if layout == "" {
+		return nil
+	}
+	dirs := time.Date(2024, 6, 30, 23, 59, 58, 0, time.Local).Format(layout)
+	if path.IsAbs(dirs) || strings.Contains(dirs, "\\") || path.Clean(dirs) != dirs || strings.HasPrefix(dirs, "..") {
+		return []string{fmt.Sprintf("date_dirs %q makes %q, it has to be folders below remote_path like 2006/01", layout, dirs)}
+	}
+	for _, dir := range strings.Split(dirs, "/") {
+		if sanitizeName(dir) != dir {
+			return []string{fmt.Sprintf("date_dirs %q makes the folder %q, which would have to be %q", layout, dir, sanitizeName(dir))}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// takenUploader has a file by every name
+type takenUploader struct{ *fakeUploader }
+
+func (u takenUploader) stat(ctx context.Context, remoteName string) (os.FileInfo, error) {
+	return fakeFileInfo{name: remoteName}, nil
+}
+
+// statFailsUploader can't look names up
+type statFailsUploader struct{ *fakeUploader }
+
+func (u statFailsUploader) stat(ctx context.Context, remoteName string) (os.FileInfo, error) {
+	return nil, errors.New("permission denied")
+}
+
+// uploadOnly is a backend that can't look names up at all
+type uploadOnly struct{ up *fakeUploader }
+
+func (u uploadOnly) upload(ctx context.Context, localPath, remoteName string) (string, error) {
+	return u.up.upload(ctx, localPath, remoteName)
+}
+
+func takenNames(names ...string) *fakeUploader {
+	up := &fakeUploader{existing: map[string]bool{}}
+	for _, name := range names {
+		up.existing[name] = true
+	}
+	return up
+}
+
+func TestFreeRemoteName(t *testing.T) {
+	tests := []struct {
+		name  string
+		taken []string
+		want  string
+	}{
+		{"shot.png", nil, "shot.png"},
+		{"shot.png", []string{"shot.png"}, "shot-2.png"},
+		{"shot.png", []string{"shot.png", "shot-2.png", "shot-3.png"}, "shot-4.png"},
+		{"backup.tar.gz", []string{"backup.tar.gz"}, "backup-2.tar.gz"},
+		{"2024/06/shot.png", []string{"2024/06/shot.png"}, "2024/06/shot-2.png"},
+		{"README", []string{"README"}, "README-2"},
+	}
+	for _, tt := range tests {
+		got := freeRemoteName(context.Background(), takenNames(tt.taken...), tt.name)
+		releaseName(got)
+		if got != tt.want {
+			t.Errorf("%s with %v taken: %s, want %s", tt.name, tt.taken, got, tt.want)
+		}
+	}
+
+	// once the counter runs out, random characters
+	got := freeRemoteName(context.Background(), takenUploader{&fakeUploader{}}, "shot.png")
+	releaseName(got)
+	if !regexp.MustCompile(`^shot-[0-9A-Za-z]{6}\.png$`).MatchString(got) {
+		t.Errorf("with every name taken: %s", got)
+	}
+	// names that can't be looked up are used as they are
+	got = freeRemoteName(context.Background(), statFailsUploader{&fakeUploader{}}, "shot.png")
+	releaseName(got)
+	if got != "shot.png" {
+		t.Errorf("with lookups failing: %s", got)
+	}
+	if got := freeRemoteName(context.Background(), uploadOnly{&fakeUploader{}}, "shot.png"); got != "shot.png" {
+		t.Errorf("without lookups: %s", got)
+	}
+
+	// claimed by an upload that's still running
+	if !claimName("shot.png") {
+		t.Fatal("shot.png is claimed already")
+	}
+	got = freeRemoteName(context.Background(), takenNames(), "shot.png")
+	releaseName(got)
+	releaseName("shot.png")
+	if got != "shot-2.png" {
+		t.Errorf("with shot.png claimed: %s, want shot-2.png", got)
+	}
+}
+
+func TestFreeRandomName(t *testing.T) {
+	ctx := context.Background()
+	got, err := freeRandomName(ctx, takenNames(), "i/Zr8tW.png")
+	releaseName(got)
+	if err != nil || got != "i/Zr8tW.png" {
+		t.Errorf("a free name: %s, %v", got, err)
+	}
+	got, err = freeRandomName(ctx, takenNames("i/Zr8tW.png"), "i/Zr8tW.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseName(got)
+	// another random name in the same folder
+	if got == "i/Zr8tW.png" || path.Dir(got) != "i" || !strings.HasSuffix(got, ".png") {
+		t.Errorf("a taken name: %s", got)
+	}
+	if _, err := freeRandomName(ctx, takenUploader{&fakeUploader{}}, "Zr8tW.png"); err == nil {
+		t.Error("overwrote a file after all random names were taken")
+	}
+	got, err = freeRandomName(ctx, statFailsUploader{&fakeUploader{}}, "Zr8tW.png")
+	releaseName(got)
+	if err != nil || got != "Zr8tW.png" {
+		t.Errorf("with lookups failing: %s, %v", got, err)
+	}
+}
+
+func TestFreeHashName(t *testing.T) {
+	up := &fakeUploader{existing: map[string]bool{"3f2a.png": true}}
+	ctx := context.Background()
+	if got := freeHashName(ctx, up, "9c1d.png", 100); got != "9c1d.png" {
+		t.Errorf("a free name: %s", got)
+	}
+	// the fake's files are empty, one of 0 bytes is the same file
+	if got := freeHashName(ctx, up, "3f2a.png", 0); got != "3f2a.png" {
+		t.Errorf("the same file: %s, want it overwritten", got)
+	}
+	if got := freeHashName(ctx, up, "3f2a.png", -1); got != "3f2a.png" {
+		t.Errorf("a compressed file: %s, want it overwritten", got)
+	}
+	if got := freeHashName(ctx, up, "3f2a.png", 100); !regexp.MustCompile(`^3f2a-[0-9A-Za-z]{6}\.png$`).MatchString(got) {
+		t.Errorf("other content: %s", got)
+	}
+}
+
+func TestFreeCounterName(t *testing.T) {
+	tempStateDir(t)
+	s := &settings{CounterPrefix: defaultCounterPrefix, CounterDigits: defaultCounterDigits}
+	// the counter file was lost, the server has the first few
+	up := takenNames("shot-0001.png", "shot-0002.png", "shot-0003.png")
+	if got := s.freeCounterName(context.Background(), up, "shot-0001.png"); got != "shot-0004.png" {
+		t.Errorf("freeCounterName = %s, want shot-0004.png", got)
+	}
+	// the numbers tried were claimed
+	if n, err := claimCounter(); err != nil || n != 5 {
+		t.Errorf("next number %d, %v, want 5", n, err)
+	}
+}
+
+// meetingUploader holds every upload until two are running at once
+type meetingUploader struct {
+	*fakeUploader
+	arrived *sync.WaitGroup
+}
+
+func (u meetingUploader) upload(ctx context.Context, localPath, remoteName string) (string, error) {
+	u.arrived.Done()
+	u.arrived.Wait()
+	return u.fakeUploader.upload(ctx, localPath, remoteName)
+}
+
+// two screenshots by the same name uploaded at once get names of their own,
+// though the server has neither before they're done
+func TestConcurrentUploadNames(t *testing.T) {
+	path := retryFile(t)
+	for _, naming := range []string{namingOriginal, namingRandom} {
+		s := retrySettings(1)
+		s.Naming, s.NoNameCheck = naming, false
+		var arrived sync.WaitGroup
+		arrived.Add(2)
+		up := meetingUploader{takenNames(), &arrived}
+		names := make([]string, 2)
+		errs := make([]error, 2)
+		var done sync.WaitGroup
+		for i := range names {
+			done.Add(1)
+			go func(i int) {
+				defer done.Done()
+				_, names[i], errs[i] = uploadToBestProfile(context.Background(), s, fakeEffects{up: up}, path, "shot.png")
+			}(i)
+		}
+		done.Wait()
+		if errs[0] != nil || errs[1] != nil {
+			t.Fatalf("naming %s: %v, %v", naming, errs[0], errs[1])
+		}
+		if names[0] == names[1] {
+			t.Errorf("naming %s: both uploaded as %s", naming, names[0])
+		}
+		if naming == namingOriginal && !(names[0] == "shot.png" && names[1] == "shot-2.png" || names[0] == "shot-2.png" && names[1] == "shot.png") {
+			t.Errorf("naming %s: uploaded as %v, want shot.png and shot-2.png", naming, names)
+		}
+		// released once they're done
+		for _, name := range names {
+			if !claimName(name) {
+				t.Errorf("naming %s: %s is still claimed", naming, name)
+			}
+			releaseName(name)
+		}
+	}
+}
+
+func TestUploadCollision(t *testing.T) {
+	path := retryFile(t)
+	tests := []struct {
+		naming      string
+		noNameCheck bool
+		want        func(string) bool
+	}{
+		{namingOriginal, false, func(name string) bool { return name == "shot-2.png" }},
+		{namingRandom, false, func(name string) bool { return name != "shot.png" && strings.HasSuffix(name, ".png") }},
+		// trusting random names to be free skips the lookup
+		{namingRandom, true, func(name string) bool { return name == "shot.png" }},
+	}
+	for _, tt := range tests {
+		s := retrySettings(1)
+		s.Naming, s.NoNameCheck = tt.naming, tt.noNameCheck
+		up := takenNames("shot.png")
+		_, name, err := uploadToBestProfile(context.Background(), s, fakeEffects{up: up}, path, "shot.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !tt.want(name) || len(up.uploaded) != 1 || up.uploaded[0] != name {
+			t.Errorf("naming %s, no_name_check %t: uploaded %v as %s", tt.naming, tt.noNameCheck, up.uploaded, name)
+		}
+	}
+}
+
+func TestNameFromTemplate(t *testing.T) {
+	v := nameValues{
+		Orig: "Screenshot 2024-06-01 at 10.00.00",
+		Ext:  "png",
+		Host: "my laptop",
+		Now:  time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC),
+		Seq:  7,
+	}
+	tests := []struct {
+		tmpl string
+		want string // a regular expression
+		err  string
+	}{
+		{"{orig}.{ext}", `^Screenshot-2024-06-01-at-10\.00\.00\.png$`, ""},
+		{"{date}.{ext}", `^2024-06-01_10-00-00\.png$`, ""},
+		{"{date:2006/01/02 15:04}.{ext}", `^20240601-1000\.png$`, ""},
+		{"{host}-{seq:3}.{ext}", `^my-laptop-007\.png$`, ""},
+		{"{seq}.{ext}", `^7\.png$`, ""},
+		{"{rand}.{ext}", `^[0-9A-Za-z]{8}\.png$`, ""},
+		{"shot-{rand:4}.{ext}", `^shot-[0-9A-Za-z]{4}\.png$`, ""},
+		{"{{literal}}-{seq}.{ext}", `^\{literal\}-7\.png$`, ""},
+		{"{nope}.{ext}", "", "unknown placeholder {nope}"},
+		{"{rand:0}.{ext}", "", "{rand:0}: that's a number from 1 to"},
+		{"{seq:x}.{ext}", "", "{seq:x}: that's a number from 1 to 20"},
+		{"{orig:5}.{ext}", "", "{orig} takes nothing after a colon"},
+		{"shot.{ext}-{orig", "", "{ without }"},
+		{"orig}.{ext}", "", "} without {"},
+	}
+	for _, tt := range tests {
+		got, err := nameFromTemplate(tt.tmpl, v)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: %q, %v, want an error with %q", tt.tmpl, got, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.tmpl, err)
+		} else if !regexp.MustCompile(tt.want).MatchString(got) {
+			t.Errorf("%s: %q, want %s", tt.tmpl, got, tt.want)
+		}
+	}
+}
+
+func TestNameTemplateProblems(t *testing.T) {
+	tests := []struct {
+		tmpl string
+		want string
+	}{
+		{"", ""},
+		{"{date}-{rand}.{ext}", ""},
+		{"{orig}.{ext}", ""},
+		{"{date}-{rand}", "has no {ext}"},
+		{"{date:2006/01}.{ext}", ""},
+		{"shots/{orig}.{ext}", "can't have / or \\"},
+		{"{when}.{ext}", "unknown placeholder {when}"},
+	}
+	for _, tt := range tests {
+		problems := nameTemplateProblems(tt.tmpl)
+		switch {
+		case tt.want == "" && len(problems) != 0:
+			t.Errorf("%q: %q", tt.tmpl, problems)
+		case tt.want != "" && (len(problems) != 1 || !strings.Contains(problems[0], tt.want)):
+			t.Errorf("%q: %q, want one with %q", tt.tmpl, problems, tt.want)
+		}
+	}
+}
+
+func TestTemplateCollision(t *testing.T) {
+	path := retryFile(t)
+	tests := []struct {
+		tmpl  string
+		taken []string
+		want  string
+	}{
+		// without {rand} two files can get the same name, the second one
+		// is numbered rather than overwriting the first
+		{"{orig}.{ext}", []string{"shot.png"}, "shot-2.png"},
+		{"{orig}.{ext}", []string{"shot.png", "shot-2.png"}, "shot-3.png"},
+		{"{orig}.{ext}", nil, "shot.png"},
+		{"fixed.{ext}", []string{"fixed.png"}, "fixed-2.png"},
+	}
+	for _, tt := range tests {
+		s := retrySettings(1)
+		s.NameTemplate = tt.tmpl
+		name := s.remoteNameFor(path, "png", "")
+		up := takenNames(tt.taken...)
+		_, got, err := uploadToBestProfile(context.Background(), s, fakeEffects{up: up}, path, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want || len(up.uploaded) != 1 || up.uploaded[0] != got {
+			t.Errorf("%s with %q taken: uploaded %v as %s, want %s", tt.tmpl, tt.taken, up.uploaded, got, tt.want)
+		}
+	}
+}
+
+// {seq} counts on from where the last run stopped, kept in seqFile apart
+// from naming counter's number
+func TestTemplateSeq(t *testing.T) {
+	tempStateDir(t)
+	path := retryFile(t)
+	s := retrySettings(1)
+	s.NameTemplate = "{seq:3}.{ext}"
+	for _, want := range []string{"001.png", "002.png"} {
+		if got := s.remoteNameFor(path, "png", ""); got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+	// another run
+	if err := ioutil.WriteFile(filepath.Join(stateDir(), seqFile), []byte("41\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.remoteNameFor(path, "png", ""); got != "042.png" {
+		t.Errorf("after a restart at 41: got %s, want 042.png", got)
+	}
+	if n, err := claimCounter(); err != nil || n != 1 {
+		t.Errorf("naming counter's number %d, %v, want 1", n, err)
+	}
+}
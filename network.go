@@ -0,0 +1,320 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// networkRule selects a profile while skrins is on a particular network,
+// e.g. to upload to a NAS over the LAN when at home:
+//
+//	[[network_rules]]
+//	subnet  = "192.168.1.0/24"
+//	ssid    = "home"
+//	profile = "nas"
+//
+// Every condition that is set has to match. Rules are tried in order and
+// the selected profile is the fallback when none match or none of the
+// matching destinations can be reached.
+type networkRule struct {
+	// Interface is the name of the interface the default route goes through
+	Interface string `toml:"interface"`
+	// Subnet matches when any local address is inside it
+	Subnet string `toml:"subnet"`
+	// SSID is the Wi-Fi network name, where the platform lets us find out
+	SSID    string `toml:"ssid"`
+	Profile string `toml:"profile"`
+}
+
+// networkInfo is what network rules get matched against
+type networkInfo struct {
+	Interface string
+	Addrs     []net.IP
+	SSID      string
+}
+
+// loadNetworkRules checks the network rules of fc and finishes the profiles
+// they refer to.
+func (s *settings) loadNetworkRules(fc fileConfig, getenv func(string) string) []string {
+	var problems []string
+	s.NetworkRules = fc.NetworkRules
+	s.RuleProfiles = make(map[string]profile)
+
+	for i, r := range fc.NetworkRules {
+		if r.Interface == "" && r.Subnet == "" && r.SSID == "" {
+			problems = append(problems, fmt.Sprintf("network rule %d needs an interface, subnet or ssid", i+1))
+		}
+		if r.Subnet != "" {
+			if _, _, err := net.ParseCIDR(r.Subnet); err != nil {
+				problems = append(problems, fmt.Sprintf("network rule %d: %v", i+1, err))
+			}
+		}
+		if r.Profile == "" {
+			problems = append(problems, fmt.Sprintf("network rule %d needs a profile", i+1))
+			continue
+		}
+		if _, ok := s.RuleProfiles[r.Profile]; ok {
+			continue
+		}
+
+		p, err := fc.profileNamed(r.Profile)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("network rule %d: %v", i+1, err))
+			continue
+		}
+		p.merge(envProfile(getenv))
+		p, finishProblems := p.finish(false, getenv)
+		for _, problem := range finishProblems {
+			problems = append(problems, fmt.Sprintf("profile %s: %s", r.Profile, problem))
+		}
+		problems = append(problems, profileProblems(r.Profile, p)...)
+		s.RuleProfiles[r.Profile] = p.withSlashes()
+	}
+
+	return problems
+}
+
+// loadFallbackProfiles finishes the profiles the fallback_profile settings
+// of the selected profile and the network rules' ones refer to, and theirs
+// in turn
+func (s *settings) loadFallbackProfiles(fc fileConfig, getenv func(string) string) []string {
+	var problems []string
+	if s.RuleProfiles == nil {
+		s.RuleProfiles = make(map[string]profile)
+	}
+	pending := append([]string{s.Profile.FallbackProfile}, s.Profile.Destinations...)
+	for _, p := range s.RuleProfiles {
+		pending = append(pending, p.FallbackProfile)
+		pending = append(pending, p.Destinations...)
+	}
+	for len(pending) > 0 {
+		name := pending[0]
+		pending = pending[1:]
+		if _, ok := s.RuleProfiles[name]; ok || name == "" {
+			continue
+		}
+		p, err := fc.profileNamed(name)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("fallback_profile: %v", err))
+			continue
+		}
+		p.merge(envProfile(getenv))
+		p, finishProblems := p.finish(false, getenv)
+		for _, problem := range finishProblems {
+			problems = append(problems, fmt.Sprintf("profile %s: %s", name, problem))
+		}
+		problems = append(problems, profileProblems(name, p)...)
+		s.RuleProfiles[name] = p.withSlashes()
+		pending = append(pending, p.FallbackProfile)
+		pending = append(pending, p.Destinations...)
+	}
+	return append(problems, s.nestedDestinations()...)
+}
+
+// matches tells whether every condition of r holds on network n
+func (r networkRule) matches(n networkInfo) bool {
+	if r.Interface != "" && r.Interface != n.Interface {
+		return false
+	}
+	if r.SSID != "" && r.SSID != n.SSID {
+		return false
+	}
+	if r.Subnet != "" {
+		_, subnet, err := net.ParseCIDR(r.Subnet)
+		if err != nil {
+			return false
+		}
+		found := false
+		for _, a := range n.Addrs {
+			if subnet.Contains(a) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// namedProfile is a profile together with the name it's logged under
+type namedProfile struct {
+	Name    string
+	Profile profile
+}
+
+// profileCandidates lists the profiles to try for an upload, best first.
+// Profiles of matching network rules come first, the selected profile last.
+func (s *settings) profileCandidates() []namedProfile {
+	fallback := namedProfile{Name: s.ProfileName, Profile: s.Profile}
+	if fallback.Name == "" {
+		fallback.Name = "default"
+	}
+	if len(s.NetworkRules) == 0 {
+		return []namedProfile{fallback}
+	}
+
+	needSSID := false
+	for _, r := range s.NetworkRules {
+		needSSID = needSSID || r.SSID != ""
+	}
+	n := currentNetwork(needSSID)
+
+	var candidates []namedProfile
+	seen := map[string]bool{}
+	for i, r := range s.NetworkRules {
+		if !r.matches(n) || seen[r.Profile] {
+			continue
+		}
+		seen[r.Profile] = true
+		log.Printf("network rule %d matched (interface=%q ssid=%q), trying profile %s", i+1, n.Interface, n.SSID, r.Profile)
+		candidates = append(candidates, namedProfile{Name: r.Profile, Profile: s.RuleProfiles[r.Profile]})
+	}
+	if len(candidates) == 0 {
+		log.Printf("no network rule matched (interface=%q ssid=%q), using profile %s", n.Interface, n.SSID, fallback.Name)
+	}
+	return append(candidates, fallback)
+}
+
+// unsupportedError is returned when no profile takes a file's extension
+type unsupportedError struct {
+	Backend string
+	Ext     string
+}
+
+func (e *unsupportedError) Error() string {
+	return fmt.Sprintf("the %s backend doesn't take .%s files, set fallback_profile to upload them elsewhere", e.Backend, e.Ext)
+}
+
+// takingExtension follows the fallback profiles from c to the first one
+// whose backend takes files with the extension ext
+func (s *settings) takingExtension(c namedProfile, ext string) (namedProfile, error) {
+	seen := map[string]bool{}
+	for {
+		f, ok := newUploader(c.Profile, uploadOptions{}).(extensionFilter)
+		if !ok || f.supports(strings.ToLower(ext)) {
+			return c, nil
+		}
+		next := c.Profile.FallbackProfile
+		if next == "" || seen[next] {
+			return c, &unsupportedError{Backend: c.Profile.Backend, Ext: ext}
+		}
+		seen[c.Name] = true
+		log.Printf("profile %s doesn't take .%s files, using fallback profile %s", c.Name, ext, next)
+		c = namedProfile{Name: next, Profile: s.RuleProfiles[next]}
+	}
+}
+
+// isUnreachable tells whether err means the destination couldn't be
+// reached at all, so trying another destination makes sense
+func isUnreachable(err error) bool {
+	var timeout *timeoutError
+	if errors.As(err, &timeout) {
+		return timeout.Op == "dial" || timeout.Op == "handshake"
+	}
+	var viaProxy *proxyError
+	if errors.As(err, &viaProxy) {
+		return true
+	}
+	// a jump host that couldn't connect to the next hop
+	var refused *ssh.OpenChannelError
+	if errors.As(err, &refused) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// currentNetwork finds out which network the machine is on. The SSID is
+// only looked up when asked for, since that means running a command.
+func currentNetwork(withSSID bool) networkInfo {
+	var n networkInfo
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		log.Println("error:", err)
+		return n
+	}
+
+	// connecting a UDP socket sends nothing but picks the source address the
+	// default route would use
+	var routeIP net.IP
+	if conn, err := net.Dial("udp", "192.0.2.1:9"); err == nil {
+		routeIP = conn.LocalAddr().(*net.UDPAddr).IP
+		conn.Close()
+	}
+
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			n.Addrs = append(n.Addrs, ipnet.IP)
+			if routeIP != nil && ipnet.IP.Equal(routeIP) {
+				n.Interface = iface.Name
+			}
+		}
+	}
+
+	if withSSID {
+		n.SSID = wifiSSID(n.Interface)
+	}
+	return n
+}
+
+// wifiSSID asks the platform's tools for the current Wi-Fi network name.
+// It returns an empty string when that's not possible.
+func wifiSSID(iface string) string {
+	switch runtime.GOOS {
+	case "linux":
+		if out, err := exec.Command("iwgetid", "-r").Output(); err == nil {
+			return strings.TrimSpace(string(out))
+		}
+		out, err := exec.Command("nmcli", "-t", "-f", "active,ssid", "dev", "wifi").Output()
+		if err != nil {
+			return ""
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			if strings.HasPrefix(line, "yes:") {
+				return strings.TrimPrefix(line, "yes:")
+			}
+		}
+	case "darwin":
+		if iface == "" {
+			iface = "en0"
+		}
+		out, err := exec.Command("networksetup", "-getairportnetwork", iface).Output()
+		if err != nil {
+			return ""
+		}
+		const prefix = "Current Wi-Fi Network: "
+		if line := strings.TrimSpace(string(out)); strings.HasPrefix(line, prefix) {
+			return strings.TrimPrefix(line, prefix)
+		}
+	case "windows":
+		out, err := exec.Command("netsh", "wlan", "show", "interfaces").Output()
+		if err != nil {
+			return ""
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			parts := strings.SplitN(line, ":", 2)
+			if len(parts) == 2 && strings.TrimSpace(parts[0]) == "SSID" {
+				return strings.TrimSpace(parts[1])
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,61 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/0xAX/notificator"
+)
+
+var notify *notificator.Notificator
+
+// pushNotification displays a system notification
+func pushNotification(title, text string) error {
+	if notify == nil {
+		notify = notificator.New(notificator.Options{
+			AppName: "Skrins",
+		})
+	}
+	return notify.Push(title, text, "", notificator.UR_NORMAL)
+}
+
+// replaced remembers the notification replaceNotification showed last for
+// each key
+var replaced = struct {
+	sync.Mutex
+	ids map[string]string
+}{ids: map[string]string{}}
+
+// replaceNotification displays a notification that takes the place of the
+// one it showed before with the same key. That needs notify-send 0.8 on
+// Linux and terminal-notifier on macOS, elsewhere a new notification is
+// pushed.
+func replaceNotification(key, title, text string) error {
+	replaced.Lock()
+	defer replaced.Unlock()
+
+	switch runtime.GOOS {
+	case "darwin":
+		if path, err := exec.LookPath("terminal-notifier"); err == nil {
+			return exec.Command(path, "-title", title, "-message", text, "-group", "skrins-progress-"+key).Run()
+		}
+	case "linux":
+		if path, err := exec.LookPath("notify-send"); err == nil {
+			args := []string{"--app-name=Skrins", "--print-id"}
+			if id := replaced.ids[key]; id != "" {
+				args = append(args, "--replace-id="+id)
+			}
+			// older versions don't know the flags and fail
+			if out, err := exec.Command(path, append(args, title, text)...).Output(); err == nil {
+				replaced.ids[key] = strings.TrimSpace(string(out))
+				return nil
+			}
+		}
+	}
+	return pushNotification(title, text)
+}
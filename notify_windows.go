@@ -0,0 +1,47 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"os/exec"
+)
+
+// toastScript shows a toast through the WinRT notification API. Title and
+// text are passed through the environment so nothing has to be quoted.
+const toastScript = `
+[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null
+$t = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$lines = $t.GetElementsByTagName('text')
+$lines.Item(0).AppendChild($t.CreateTextNode($env:SKRINS_TOAST_TITLE)) > $null
+$lines.Item(1).AppendChild($t.CreateTextNode($env:SKRINS_TOAST_TEXT)) > $null
+$toast = [Windows.UI.Notifications.ToastNotification]::new($t)
+if ($env:SKRINS_TOAST_TAG) { $toast.Tag = $env:SKRINS_TOAST_TAG; $toast.Group = 'skrins' }
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier('{1AC14E77-02E7-4E5D-B744-2EB1AE5198B7}\WindowsPowerShell\v1.0\powershell.exe').Show($toast)
+`
+
+// pushNotification shows a toast. notificator needs growlnotify on Windows,
+// which hardly anyone has, so PowerShell is used instead.
+func pushNotification(title, text string) error {
+	return toast(title, text, "")
+}
+
+// replaceNotification shows a toast that takes the place of the one it
+// showed before with the same key. Tags are limited to 16 characters, so
+// it's a hash of key.
+func replaceNotification(key, title, text string) error {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return toast(title, text, fmt.Sprintf("progress%08x", h.Sum32()))
+}
+
+// toast shows a toast, replacing the one with the same tag unless tag is
+// empty
+func toast(title, text, tag string) error {
+	cmd := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", toastScript)
+	cmd.Env = append(os.Environ(), "SKRINS_TOAST_TITLE="+title, "SKRINS_TOAST_TEXT="+text, "SKRINS_TOAST_TAG="+tag)
+	return cmd.Run()
+}
@@ -0,0 +1,659 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Where the Microsoft Graph API and the Microsoft identity platform are,
+// see https://learn.microsoft.com/graph/api/resources/onedrive
+var (
+	onedriveAPI    = "https://graph.microsoft.com/v1.0"
+	microsoftLogin = "https://login.microsoftonline.com"
+)
+
+// onedriveScope is what skrins asks to be allowed, offline_access gets the
+// refresh token
+const onedriveScope = "Files.ReadWrite offline_access"
+
+// Files up to onedriveSimpleMax are uploaded with a single request, larger
+// ones in chunks of onedriveChunk through an upload session. Chunks have to
+// be multiples of 320 KiB.
+const (
+	onedriveSimpleMax = 4 << 20
+	onedriveChunk     = 32 * 320 << 10
+)
+
+// The kinds of sharing links onedrive_link_scope picks from: anyone with
+// the link, or only people signed in to the same organization
+const (
+	onedriveAnonymous    = "anonymous"
+	onedriveOrganization = "organization"
+)
+
+// onedriveUploader uploads into the folder onedrive_folder of the signed in
+// user's OneDrive and returns a view link to the file
+type onedriveUploader struct {
+	p    profile
+	opts uploadOptions
+}
+
+// onedriveLabel describes a OneDrive secret in prompts and errors
+func onedriveLabel(what string) string {
+	return "OneDrive " + what
+}
+
+// onedriveTenant is the directory accounts sign in to, any work, school or
+// personal account by default
+func (p profile) onedriveTenant() string {
+	if p.OneDriveTenant == "" {
+		return "common"
+	}
+	return p.OneDriveTenant
+}
+
+// onedriveLinkScope is who the shared link works for
+func (p profile) onedriveLinkScope() string {
+	if p.OneDriveLinkScope == "" {
+		return onedriveAnonymous
+	}
+	return p.OneDriveLinkScope
+}
+
+// onedriveProblems checks the settings of a onedrive profile
+func onedriveProblems(p profile) []string {
+	var problems []string
+	switch p.onedriveLinkScope() {
+	case onedriveAnonymous:
+	case onedriveOrganization:
+		if p.onedriveTenant() == "consumers" {
+			problems = append(problems, "onedrive_link_scope = \"organization\" needs a work or school account, personal accounts have no organization")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("onedrive_link_scope %q: use %s or %s", p.OneDriveLinkScope, onedriveAnonymous, onedriveOrganization))
+	}
+	if p.OneDriveToken != "" && !strings.HasPrefix(p.OneDriveToken, "keyring:") && !strings.HasPrefix(p.OneDriveToken, "file:") {
+		problems = append(problems, "onedrive_token has to be a keyring: or file: reference, skrins auth and every renewal save the token there")
+	}
+	for _, part := range strings.Split(p.OneDriveFolder, "/") {
+		if part == "." || part == ".." {
+			problems = append(problems, fmt.Sprintf("onedrive_folder %q can't contain . or ..", p.OneDriveFolder))
+			break
+		}
+	}
+	return problems
+}
+
+// onedriveItem is what Graph tells about a file
+type onedriveItem struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModifiedDateTime"`
+	File         struct {
+		Hashes struct {
+			SHA1   string `json:"sha1Hash"`
+			SHA256 string `json:"sha256Hash"`
+		} `json:"hashes"`
+	} `json:"file"`
+}
+
+// onedriveError is an error answer of Graph or of the sign in. Code is
+// Graph's error code, like quotaLimitReached, or the OAuth error when
+// SignIn is set.
+type onedriveError struct {
+	Status  int
+	Code    string
+	Message string
+	SignIn  bool
+	Wait    time.Duration
+}
+
+// The notification only shows the message, so it starts with what kind of
+// problem it is
+func (e *onedriveError) Error() string {
+	msg := strings.TrimRight(e.Message, ".")
+	if msg == "" {
+		msg = http.StatusText(e.Status)
+	}
+	switch {
+	case e.SignIn && e.temporary():
+		return "OneDrive sign in unavailable: " + msg
+	case e.SignIn:
+		return "OneDrive sign in no longer valid: " + msg + "; run skrins auth to sign in again"
+	case e.Code == "quotaLimitReached" || e.Status == http.StatusInsufficientStorage:
+		return "OneDrive is full: " + msg
+	case e.Status == http.StatusTooManyRequests || e.Code == "activityLimitReached":
+		return "OneDrive is throttling requests: " + msg
+	case e.Status == http.StatusUnauthorized || e.Status == http.StatusForbidden:
+		return "OneDrive permission denied: " + msg
+	}
+	return fmt.Sprintf("OneDrive answered %d %s: %s", e.Status, http.StatusText(e.Status), msg)
+}
+
+// temporary tells whether trying again may help, i.e. OneDrive is busy or
+// throttling
+func (e *onedriveError) temporary() bool {
+	return (e.Status >= 500 && e.Status != http.StatusInsufficientStorage) || e.Status == http.StatusTooManyRequests
+}
+
+// retryAfter is how long to wait before trying again, throttled requests
+// tell
+func (e *onedriveError) retryAfter() time.Duration {
+	return e.Wait
+}
+
+// itemPath is the path of remoteName in the drive, escaped for Graph's
+// root:/path: addressing
+func (u onedriveUploader) itemPath(remoteName string) string {
+	var parts []string
+	for _, part := range strings.Split(path.Join(u.p.OneDriveFolder, remoteName), "/") {
+		if part != "" {
+			parts = append(parts, url.PathEscape(part))
+		}
+	}
+	return "/root:/" + strings.Join(parts, "/") + ":"
+}
+
+func (u onedriveUploader) upload(ctx context.Context, localPath, remoteName string) (string, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, u.p.TransferTimeout.Duration)
+	defer cancel()
+	var session string
+	var offset int64
+	if fi.Size() > onedriveSimpleMax {
+		if session, offset, err = u.session(ctx, localPath, fi, remoteName); err != nil {
+			return "", err
+		}
+	}
+	t := startTransfer(localPath, fi.Size(), offset, u.opts.Progress)
+	defer t.finish()
+	// checking and sharing the file come after stalled() ends the context
+	// of the transfer
+	transferCtx, stalled := watchStall(ctx, t, u.p.StallTimeout.Duration)
+
+	var item *onedriveItem
+	if session == "" {
+		item, err = u.uploadSimple(transferCtx, f, fi.Size(), remoteName, t)
+	} else {
+		item, err = u.sendChunks(transferCtx, session, f, offset, fi.Size(), t)
+	}
+	if stalled() {
+		return "", &timeoutError{Op: "stall", Host: "graph.microsoft.com", After: u.p.StallTimeout.Duration}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", &timeoutError{Op: "transfer", Host: "graph.microsoft.com", After: u.p.TransferTimeout.Duration, Err: err}
+	}
+	var apiErr *onedriveError
+	if session != "" && errors.As(err, &apiErr) && (apiErr.Status == http.StatusNotFound || apiErr.Status == http.StatusGone) {
+		// the session expired, the next attempt starts a new one
+		clearResumePoint(localPath)
+	}
+	if err != nil {
+		return "", err
+	}
+	clearResumePoint(localPath)
+	log.Println(t.summary())
+
+	link, err := u.finishUpload(ctx, f, fi, item)
+	if err != nil {
+		if delErr := u.api(ctx, http.MethodDelete, "/items/"+url.PathEscape(item.ID), nil, nil); delErr != nil {
+			log.Printf("can't delete %s from OneDrive: %v", item.Name, delErr)
+		}
+		return "", err
+	}
+	return link, nil
+}
+
+// uploadSimple puts the whole file with one request
+func (u onedriveUploader) uploadSimple(ctx context.Context, f *os.File, size int64, remoteName string, t *transfer) (*onedriveItem, error) {
+	target := onedriveAPI + "/me/drive" + u.itemPath(remoteName) + "/content?@microsoft.graph.conflictBehavior=replace"
+	for attempt := 0; ; attempt++ {
+		token, err := u.accessToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		header := http.Header{
+			"Authorization": {"Bearer " + token},
+			"Content-Type":  {contentType(remoteName)},
+		}
+		atomic.StoreInt64(&t.done, 0)
+		body := progressTracker{limitedReader{io.NewSectionReader(f, 0, size), uploadLimiter}, t}
+		_, respBody, err := u.roundTrip(ctx, http.MethodPut, target, header, body, size)
+		var apiErr *onedriveError
+		if errors.As(err, &apiErr) && apiErr.Status == http.StatusUnauthorized && attempt == 0 {
+			debugf("OneDrive turned down the access token, renewing it")
+			forgetOneDriveToken(u.p)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var item onedriveItem
+		if err := json.Unmarshal(respBody, &item); err != nil {
+			return nil, fmt.Errorf("bad answer from OneDrive: %w", err)
+		}
+		return &item, nil
+	}
+}
+
+// session returns the upload session for localPath and how much of it
+// OneDrive has, continuing one of an earlier attempt when there's one
+func (u onedriveUploader) session(ctx context.Context, localPath string, fi os.FileInfo, remoteName string) (string, int64, error) {
+	server := "onedrive:" + path.Join("/", u.p.OneDriveFolder)
+	if rp, ok := resumePointFor(localPath, fi, server); ok {
+		offset, err := u.uploadStatus(ctx, rp.Temp)
+		if err == nil {
+			debugf("continuing the upload of %s at %d bytes", localPath, offset)
+			return rp.Temp, offset, nil
+		}
+		debugf("can't continue the upload of %s: %v", localPath, err)
+	}
+
+	request := map[string]interface{}{"item": map[string]string{"@microsoft.graph.conflictBehavior": "replace"}}
+	var answer struct {
+		UploadURL string `json:"uploadUrl"`
+	}
+	if err := u.api(ctx, http.MethodPost, u.itemPath(remoteName)+"/createUploadSession", request, &answer); err != nil {
+		return "", 0, err
+	}
+	if answer.UploadURL == "" {
+		return "", 0, errors.New("OneDrive started no upload session")
+	}
+	saveResumePoint(localPath, resumePoint{Server: server, Temp: answer.UploadURL, Size: fi.Size(), ModTime: fi.ModTime()})
+	return answer.UploadURL, 0, nil
+}
+
+// uploadStatus asks from where on OneDrive expects the rest of session
+func (u onedriveUploader) uploadStatus(ctx context.Context, session string) (int64, error) {
+	_, body, err := u.roundTrip(ctx, http.MethodGet, session, nil, nil, 0)
+	if err != nil {
+		return 0, err
+	}
+	return nextExpectedOffset(body)
+}
+
+// nextExpectedOffset reads where the first missing range starts from the
+// status of an upload session, ["26-"] for 26
+func nextExpectedOffset(body []byte) (int64, error) {
+	var status struct {
+		NextExpectedRanges []string `json:"nextExpectedRanges"`
+	}
+	if err := json.Unmarshal(body, &status); err != nil {
+		return 0, fmt.Errorf("bad answer from OneDrive: %w", err)
+	}
+	if len(status.NextExpectedRanges) == 0 {
+		return 0, errors.New("bad answer from OneDrive: no range expected")
+	}
+	first := status.NextExpectedRanges[0]
+	if i := strings.Index(first, "-"); i >= 0 {
+		first = first[:i]
+	}
+	offset, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad answer from OneDrive: range %q", status.NextExpectedRanges[0])
+	}
+	return offset, nil
+}
+
+// sendChunks uploads f from offset on into session, chunk by chunk. Upload
+// URLs carry their own authorization, a token must not be sent along.
+func (u onedriveUploader) sendChunks(ctx context.Context, session string, f *os.File, offset, size int64, t *transfer) (*onedriveItem, error) {
+	for {
+		n := size - offset
+		if n > onedriveChunk {
+			n = onedriveChunk
+		}
+		header := http.Header{"Content-Range": {fmt.Sprintf("bytes %d-%d/%d", offset, offset+n-1, size)}}
+		atomic.StoreInt64(&t.done, offset)
+		body := progressTracker{limitedReader{io.NewSectionReader(f, offset, n), uploadLimiter}, t}
+		resp, respBody, err := u.roundTrip(ctx, http.MethodPut, session, header, body, n)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusAccepted {
+			var item onedriveItem
+			if err := json.Unmarshal(respBody, &item); err != nil {
+				return nil, fmt.Errorf("bad answer from OneDrive: %w", err)
+			}
+			return &item, nil
+		}
+		next, err := nextExpectedOffset(respBody)
+		if err != nil {
+			return nil, err
+		}
+		if next <= offset || next >= size {
+			return nil, fmt.Errorf("OneDrive expects bytes from %d on after %d of %d were sent", next, offset+n, size)
+		}
+		offset = next
+	}
+}
+
+// finishUpload checks the uploaded file and returns a link that shares it
+func (u onedriveUploader) finishUpload(ctx context.Context, f *os.File, fi os.FileInfo, item *onedriveItem) (string, error) {
+	if item.Size != fi.Size() {
+		return "", &sizeMismatchError{Name: item.Name, Got: item.Size, Local: fi.Size()}
+	}
+	if u.opts.Verify == verifySHA256 {
+		hashes := item.File.Hashes
+		switch {
+		case hashes.SHA256 != "":
+			sum, err := localSHA256(ctx, f, fi.Size())
+			if err != nil {
+				return "", err
+			}
+			if !strings.EqualFold(sum, hashes.SHA256) {
+				return "", &checksumMismatchError{Name: item.Name, Got: strings.ToLower(hashes.SHA256), Local: sum}
+			}
+		case hashes.SHA1 != "":
+			// personal OneDrives only have a SHA-1
+			sum, err := sha1Hex(io.NewSectionReader(f, 0, fi.Size()))
+			if err != nil {
+				return "", err
+			}
+			if !strings.EqualFold(sum, hashes.SHA1) {
+				return "", &checksumMismatchError{Name: item.Name, Got: strings.ToLower(hashes.SHA1), Local: sum}
+			}
+		default:
+			log.Printf("warning: OneDrive has no checksum of %s; only its size was checked", item.Name)
+		}
+	}
+
+	request := map[string]string{"type": "view", "scope": u.p.onedriveLinkScope()}
+	var permission struct {
+		Link struct {
+			WebURL string `json:"webUrl"`
+		} `json:"link"`
+	}
+	if err := u.api(ctx, http.MethodPost, "/items/"+url.PathEscape(item.ID)+"/createLink", request, &permission); err != nil {
+		return "", fmt.Errorf("%s was uploaded but can't be shared: %w", item.Name, err)
+	}
+	if permission.Link.WebURL == "" {
+		return "", fmt.Errorf("%s was uploaded but OneDrive sent no link", item.Name)
+	}
+	return permission.Link.WebURL, nil
+}
+
+func (u onedriveUploader) remove(ctx context.Context, remoteName string) error {
+	err := u.api(ctx, http.MethodDelete, u.itemPath(remoteName), nil, nil)
+	var apiErr *onedriveError
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound {
+		return os.ErrNotExist
+	}
+	return err
+}
+
+func (u onedriveUploader) stat(ctx context.Context, remoteName string) (os.FileInfo, error) {
+	var item onedriveItem
+	err := u.api(ctx, http.MethodGet, u.itemPath(remoteName), nil, &item)
+	var apiErr *onedriveError
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return remoteFileInfo{name: remoteName, size: item.Size, modTime: item.LastModified}, nil
+}
+
+// check makes sure the sign in works, the drive isn't full and the link
+// scope fits the account
+func (u onedriveUploader) check(ctx context.Context) error {
+	var drive struct {
+		DriveType string `json:"driveType"`
+		Quota     struct {
+			State string `json:"state"`
+		} `json:"quota"`
+	}
+	if err := u.api(ctx, http.MethodGet, "?$select=driveType,quota", nil, &drive); err != nil {
+		return fmt.Errorf("onedrive: %w", err)
+	}
+	if drive.Quota.State == "exceeded" {
+		return errors.New("onedrive: OneDrive is full, uploads will fail until space is freed")
+	}
+	if drive.DriveType == "personal" && u.p.onedriveLinkScope() == onedriveOrganization {
+		return errors.New("onedrive: onedrive_link_scope = \"organization\" needs a work or school account, this is a personal OneDrive")
+	}
+	return nil
+}
+
+// api makes an authorized request to the signed in user's drive at
+// /me/drive followed by where, sending in as JSON and decoding the answer
+// into out. A turned down access token is renewed once.
+func (u onedriveUploader) api(ctx context.Context, method, where string, in, out interface{}) error {
+	var payload []byte
+	if in != nil {
+		var err error
+		if payload, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		token, err := u.accessToken(ctx)
+		if err != nil {
+			return err
+		}
+		header := http.Header{"Authorization": {"Bearer " + token}}
+		var body io.Reader
+		if payload != nil {
+			header.Set("Content-Type", "application/json")
+			body = bytes.NewReader(payload)
+		}
+		_, respBody, err := u.roundTrip(ctx, method, onedriveAPI+"/me/drive"+where, header, body, int64(len(payload)))
+		var apiErr *onedriveError
+		if errors.As(err, &apiErr) && apiErr.Status == http.StatusUnauthorized && attempt == 0 {
+			debugf("OneDrive turned down the access token, renewing it")
+			forgetOneDriveToken(u.p)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if out == nil {
+			return nil
+		}
+		if err := json.Unmarshal(respBody, out); err != nil {
+			return fmt.Errorf("bad answer from OneDrive: %w", err)
+		}
+		return nil
+	}
+}
+
+// roundTrip makes a request and returns the response with its body.
+// Answers of 400 and more are a *onedriveError.
+func (u onedriveUploader) roundTrip(ctx context.Context, method, target string, header http.Header, body io.Reader, length int64) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	req = req.WithContext(ctx)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.ContentLength = length
+	resp, err := httpClientFor(u.p).Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode >= 400 {
+		return nil, nil, onedriveErrorFrom(resp, respBody)
+	}
+	return resp, respBody, nil
+}
+
+// onedriveErrorFrom reads the error in a failed response of Graph
+func onedriveErrorFrom(resp *http.Response, body []byte) *onedriveError {
+	e := &onedriveError{Status: resp.StatusCode, Wait: retryAfterHeader(resp.Header, time.Now())}
+	var answer struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &answer) == nil && answer.Error.Message != "" {
+		e.Code, e.Message = answer.Error.Code, answer.Error.Message
+	} else {
+		e.Message = shorten(strings.TrimSpace(string(body)), 200)
+	}
+	return e
+}
+
+// onedriveTokens caches access tokens by client ID and token reference,
+// they're good for about an hour
+var onedriveTokens = struct {
+	sync.Mutex
+	m map[string]oauthToken
+}{m: map[string]oauthToken{}}
+
+// forgetOneDriveToken drops the cached access token of p, so the next
+// request gets a new one
+func forgetOneDriveToken(p profile) {
+	onedriveTokens.Lock()
+	delete(onedriveTokens.m, p.OneDriveClientID+"\x00"+p.OneDriveToken)
+	onedriveTokens.Unlock()
+}
+
+// accessToken trades the refresh token skrins auth saved for an access
+// token, cached unless it's about to expire. Microsoft answers with a new
+// refresh token too, which replaces the saved one.
+func (u onedriveUploader) accessToken(ctx context.Context) (string, error) {
+	key := u.p.OneDriveClientID + "\x00" + u.p.OneDriveToken
+	onedriveTokens.Lock()
+	t, ok := onedriveTokens.m[key]
+	onedriveTokens.Unlock()
+	if ok && time.Until(t.expires) > 5*time.Minute {
+		return t.value, nil
+	}
+
+	refresh, err := cachedSecret(u.p.OneDriveToken, onedriveLabel("token"))
+	if err != nil {
+		return "", fmt.Errorf("%w; run skrins auth to sign in", err)
+	}
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refresh},
+		"client_id":     {u.p.OneDriveClientID},
+		"scope":         {onedriveScope},
+	}
+	target := microsoftLogin + "/" + url.PathEscape(u.p.onedriveTenant()) + "/oauth2/v2.0/token"
+	req, err := http.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := httpClientFor(u.p).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	var token struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int    `json:"expires_in"`
+		Error        string `json:"error"`
+		Description  string `json:"error_description"`
+	}
+	json.Unmarshal(body, &token)
+	if resp.StatusCode != http.StatusOK || token.AccessToken == "" {
+		e := &onedriveError{Status: resp.StatusCode, Code: token.Error, SignIn: true, Wait: retryAfterHeader(resp.Header, time.Now())}
+		// the description goes on with trace and correlation IDs
+		e.Message = strings.SplitN(token.Description, "\n", 2)[0]
+		if e.Message = strings.TrimSpace(e.Message); e.Message == "" {
+			e.Message = token.Error
+		}
+		if e.Message == "" {
+			e.Message = shorten(strings.TrimSpace(string(body)), 200)
+		}
+		return "", e
+	}
+	if token.RefreshToken != "" && token.RefreshToken != refresh {
+		if err := storeSecret(u.p.OneDriveToken, onedriveLabel("token"), token.RefreshToken); err != nil {
+			log.Printf("can't save the renewed OneDrive token: %v", err)
+		}
+	}
+
+	t = oauthToken{value: token.AccessToken, expires: time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)}
+	onedriveTokens.Lock()
+	onedriveTokens.m[key] = t
+	onedriveTokens.Unlock()
+	return t.value, nil
+}
+
+// onedriveAuth signs in to OneDrive on this or another device for the
+// profile called name and saves the refresh token where onedrive_token
+// points to
+func onedriveAuth(name string, p profile) error {
+	client := httpClientFor(p)
+	endpoint := microsoftLogin + "/" + url.PathEscape(p.onedriveTenant()) + "/oauth2/v2.0"
+	var code struct {
+		DeviceCode      string `json:"device_code"`
+		UserCode        string `json:"user_code"`
+		VerificationURI string `json:"verification_uri"`
+		ExpiresIn       int    `json:"expires_in"`
+		Interval        int    `json:"interval"`
+		Error           string `json:"error"`
+		Description     string `json:"error_description"`
+	}
+	status, err := postForm(client, endpoint+"/devicecode", url.Values{"client_id": {p.OneDriveClientID}, "scope": {onedriveScope}}, &code)
+	if err != nil {
+		return fmt.Errorf("profile %s: %w", name, err)
+	}
+	if status != http.StatusOK {
+		msg := strings.TrimSpace(strings.SplitN(code.Description, "\n", 2)[0])
+		if msg == "" {
+			msg = http.StatusText(status)
+		}
+		return fmt.Errorf("profile %s: Microsoft turned down the sign in: %s; onedrive_client_id has to be of an app registration that allows public client flows", name, msg)
+	}
+	fmt.Printf("Open %s and enter the code %s\n", code.VerificationURI, code.UserCode)
+
+	form := url.Values{
+		"client_id":   {p.OneDriveClientID},
+		"device_code": {code.DeviceCode},
+		"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+	}
+	refresh, err := pollDeviceToken(client, endpoint+"/token", form, code.Interval, code.ExpiresIn, "Microsoft")
+	if err != nil {
+		return fmt.Errorf("profile %s: %w", name, err)
+	}
+	if err := storeSecret(p.OneDriveToken, onedriveLabel("token"), refresh); err != nil {
+		return fmt.Errorf("profile %s: %w", name, err)
+	}
+	forgetOneDriveToken(p)
+	fmt.Println("Saved the token to", p.OneDriveToken)
+	return nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// onedriveTestAPI points Graph and the Microsoft sign in to a server
+// answering with respond, whose URL it returns
+func onedriveTestAPI(t *testing.T, respond func(w http.ResponseWriter, r recordedRequest)) (string, *requestLog) {
+	srv, log := recordingServer(t, respond)
+	oldAPI, oldLogin := onedriveAPI, microsoftLogin
+	onedriveAPI, microsoftLogin = srv.URL+"/v1.0", srv.URL
+	onedriveTokens.Lock()
+	oldTokens := onedriveTokens.m
+	onedriveTokens.m = map[string]oauthToken{}
+	onedriveTokens.Unlock()
+	t.Cleanup(func() {
+		onedriveAPI, microsoftLogin = oldAPI, oldLogin
+		onedriveTokens.Lock()
+		onedriveTokens.m = oldTokens
+		onedriveTokens.Unlock()
+	})
+	tempStateDir(t)
+	return srv.URL, log
+}
+
+// onedriveTestUploader signs in with the refresh token r3fr3sh, saved in a
+// file it returns the path of
+func onedriveTestUploader(t *testing.T) (onedriveUploader, string) {
+	dir, err := ioutil.TempDir("", "skrins-onedrive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	token := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(token, []byte("r3fr3sh\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return onedriveUploader{p: testProfile(profile{
+		Backend:          backendOneDrive,
+		OneDriveClientID: "c1i3nt",
+		OneDriveToken:    "file:" + token,
+		OneDriveFolder:   "Screenshots",
+	})}, token
+}
+
+// onedriveToken answers a token request with the access token access
+func onedriveToken(w http.ResponseWriter, access string) {
+	fmt.Fprintf(w, `{"token_type":"Bearer","access_token":%q,"refresh_token":"r3fr3sh","expires_in":3600}`, access)
+}
+
+const onedriveUploaded = `{"id":"1TEM","name":"Zr8tW.png","size":%d}`
+
+func TestOneDriveUploadSession(t *testing.T) {
+	size := int64(onedriveChunk + 1000)
+	var base string
+	base, log := onedriveTestAPI(t, func(w http.ResponseWriter, r recordedRequest) {
+		switch {
+		case strings.HasSuffix(r.Path, "/token"):
+			onedriveToken(w, "acc3ss")
+		case strings.HasSuffix(r.Path, "/createUploadSession"):
+			fmt.Fprintf(w, `{"uploadUrl":%q}`, base+"/up/s3ss10n")
+		case r.Path == "/up/s3ss10n" && strings.HasPrefix(r.Header.Get("Content-Range"), "bytes 0-"):
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprintf(w, `{"nextExpectedRanges":["%d-"]}`, onedriveChunk)
+		case r.Path == "/up/s3ss10n":
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, onedriveUploaded, size)
+		case strings.HasSuffix(r.Path, "/createLink"):
+			fmt.Fprint(w, `{"link":{"webUrl":"https://1drv.ms/i/s!Ab12"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	up, _ := onedriveTestUploader(t)
+	link, err := up.upload(context.Background(), uploadTestFile(t, "shot.png", make([]byte, size)), "Zr8tW.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link != "https://1drv.ms/i/s!Ab12" {
+		t.Errorf("link = %s, want the shared one", link)
+	}
+
+	var chunks []string
+	for _, r := range log.all() {
+		switch {
+		case strings.HasSuffix(r.Path, "/createUploadSession"):
+			if r.Path != "/v1.0/me/drive/root:/Screenshots/Zr8tW.png:/createUploadSession" || !strings.Contains(string(r.Body), `"@microsoft.graph.conflictBehavior":"replace"`) {
+				t.Errorf("session created at %s with %s", r.Path, r.Body)
+			}
+		case r.Path == "/up/s3ss10n":
+			chunks = append(chunks, fmt.Sprintf("%s %d", r.Header.Get("Content-Range"), len(r.Body)))
+			// upload URLs are authorized by themselves
+			if r.Header.Get("Authorization") != "" {
+				t.Errorf("a chunk was sent with the access token")
+			}
+		case strings.HasSuffix(r.Path, "/createLink"):
+			var request map[string]string
+			json.Unmarshal(r.Body, &request)
+			if r.Path != "/v1.0/me/drive/items/1TEM/createLink" || request["type"] != "view" || request["scope"] != "anonymous" {
+				t.Errorf("shared at %s with %v", r.Path, request)
+			}
+		}
+	}
+	want := fmt.Sprintf("bytes 0-%d/%d %d, bytes %d-%d/%d 1000", onedriveChunk-1, size, onedriveChunk, onedriveChunk, size-1, size)
+	if strings.Join(chunks, ", ") != want {
+		t.Errorf("chunks %s, want %s", strings.Join(chunks, ", "), want)
+	}
+}
+
+// throttled uploads are tried again after as long as Retry-After asks
+func TestOneDriveRetryAfter(t *testing.T) {
+	waited := fakeClock(t)
+	puts := 0
+	onedriveTestAPI(t, func(w http.ResponseWriter, r recordedRequest) {
+		switch {
+		case strings.HasSuffix(r.Path, "/token"):
+			onedriveToken(w, "acc3ss")
+		case strings.HasSuffix(r.Path, "/content"):
+			if puts++; puts == 1 {
+				w.Header().Set("Retry-After", "3")
+				w.WriteHeader(http.StatusTooManyRequests)
+				fmt.Fprint(w, `{"error":{"code":"activityLimitReached","message":"The request has been throttled"}}`)
+				return
+			}
+			fmt.Fprintf(w, onedriveUploaded, 3)
+		case strings.HasSuffix(r.Path, "/createLink"):
+			fmt.Fprint(w, `{"link":{"webUrl":"https://1drv.ms/i/s!Ab12"}}`)
+		}
+	})
+	up, _ := onedriveTestUploader(t)
+	url, _, err := uploadWithRetries(context.Background(), retrySettings(2), fakeEffects{up: up}, retryFile(t), "Zr8tW.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "https://1drv.ms/i/s!Ab12" || puts != 2 {
+		t.Errorf("uploaded to %s in %d attempts", url, puts)
+	}
+	if len(*waited) != 1 || (*waited)[0] != 3*time.Second {
+		t.Errorf("waited %v, want 3s", *waited)
+	}
+
+	err = onedriveErrorFrom(&http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"3"}}}, []byte(`{"error":{"code":"activityLimitReached","message":"The request has been throttled"}}`))
+	if err.Error() != "OneDrive is throttling requests: The request has been throttled" {
+		t.Errorf("error %q", err)
+	}
+}
+
+// an access token Graph turns down is renewed, and the refresh token that
+// comes with it saved
+func TestOneDriveTokenRefresh(t *testing.T) {
+	tokens := 0
+	_, log := onedriveTestAPI(t, func(w http.ResponseWriter, r recordedRequest) {
+		if strings.HasSuffix(r.Path, "/token") {
+			tokens++
+			fmt.Fprintf(w, `{"access_token":"acc3ss-%d","refresh_token":"r3fr3sh-%d","expires_in":3600}`, tokens, tokens)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer acc3ss-2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":{"code":"InvalidAuthenticationToken","message":"Access token has expired or is not yet valid."}}`)
+			return
+		}
+		fmt.Fprint(w, `{"driveType":"business","quota":{"state":"normal"}}`)
+	})
+	up, token := onedriveTestUploader(t)
+	if err := up.check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	reqs := log.all()
+	if tokens != 2 || len(reqs) != 4 {
+		t.Fatalf("%d tokens in %d requests, want the turned down one renewed", tokens, len(reqs))
+	}
+	if r := reqs[0]; r.Path != "/common/oauth2/v2.0/token" || !strings.Contains(string(r.Body), "refresh_token=r3fr3sh&") {
+		t.Errorf("signed in at %s with %s", r.Path, r.Body)
+	}
+	// the renewed refresh token was saved and used the second time
+	if !strings.Contains(string(reqs[2].Body), "refresh_token=r3fr3sh-1&") {
+		t.Errorf("renewed with %s", reqs[2].Body)
+	}
+	if b, err := ioutil.ReadFile(token); err != nil || string(b) != "r3fr3sh-2\n" {
+		t.Errorf("saved token %q, %v, want r3fr3sh-2", b, err)
+	}
+}
+
+// a refresh token Microsoft turned down needs signing in again
+func TestOneDriveSignInExpired(t *testing.T) {
+	onedriveTestAPI(t, func(w http.ResponseWriter, r recordedRequest) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":"invalid_grant","error_description":"AADSTS70000: The provided grant has expired due to it being revoked.\r\nTrace ID: 0e6a\r\nCorrelation ID: 7f1c"}`)
+	})
+	up, _ := onedriveTestUploader(t)
+	_, err := up.upload(context.Background(), uploadTestFile(t, "shot.png", []byte("png")), "Zr8tW.png")
+	want := "OneDrive sign in no longer valid: AADSTS70000: The provided grant has expired due to it being revoked; run skrins auth to sign in again"
+	if err == nil || err.Error() != want {
+		t.Errorf("upload: %v, want %s", err, want)
+	}
+	var apiErr *onedriveError
+	if !errors.As(err, &apiErr) || apiErr.temporary() || transient(err) {
+		t.Errorf("%v is tried again", err)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// runUpload uploads the files given on the command line once, with the
+// settings the running skrins has, prints their URLs and copies them to the
+// clipboard. The files are left where they are. -force uploads files above
+// max_size too.
+func runUpload(args []string) error {
+	var force bool
+	defineFlags()
+	flag.BoolVar(&force, "force", false, "Upload files larger than -max-size too")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: skrins upload [flags] file...")
+		flag.PrintDefaults()
+	}
+	flag.CommandLine.Parse(args)
+	files := flag.Args()
+	if len(files) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if len(cli.ScreensPaths) == 0 {
+		// nothing is watched, the folder of the first file stands in for
+		// the screenshots path
+		cli.ScreensPaths = []string{filepath.Dir(files[0])}
+	}
+	applyFlags()
+	s := currentSettings()
+	if force {
+		// the stored settings are shared, -force only applies to this copy
+		c := *s
+		c.MaxBytes = 0
+		s = &c
+	}
+	loadHistory()
+
+	fx := effectsFor(s)
+	var urls []string
+	failed := 0
+	for _, path := range files {
+		url, err := uploadOnce(context.Background(), s, fx, path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			failed++
+			continue
+		}
+		fmt.Println(url)
+		urls = append(urls, url)
+	}
+	if len(urls) > 0 {
+		fx.copyToClipboard(strings.Join(urls, s.BatchSeparator))
+	}
+	conns.closeAll()
+	ftpConns.closeAll()
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files not uploaded", failed, len(files))
+	}
+	return nil
+}
+
+// uploadOnce uploads the file at path for skrins upload and returns its
+// URL. Unlike uploadFile it doesn't wait for the file to be written,
+// transcode it or do anything with it afterwards, and says why a file isn't
+// uploaded rather than skipping it.
+func uploadOnce(ctx context.Context, s *settings, fx effects, path string) (string, error) {
+	f, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if f.IsDir() {
+		return "", fmt.Errorf("is a directory")
+	}
+	ext, ok := s.detectedExtension(path, fileExtension(path))
+	switch {
+	case !ok && ext == "":
+		return "", fmt.Errorf("has no extension")
+	case !ok:
+		return "", fmt.Errorf("%s files aren't uploaded, -ext allows them", ext)
+	}
+	if s.MaxBytes > 0 && f.Size() > s.MaxBytes {
+		return "", fmt.Errorf("it's %s, more than max_size %s; -force uploads it anyway", formatSize(uint64(f.Size())), s.MaxSize)
+	}
+
+	digest, err := fileSHA256(path)
+	if err != nil {
+		debugf("can't hash %s, uploading it anyway: %v", path, err)
+	}
+	entry := historyEntryFor(s, path, f, digest)
+	entry.Kept = true
+	if url, ok := knownURL(digest, entry.Profile); ok && !s.NoDedup {
+		log.Printf("%s was uploaded already to %s", path, url)
+		entry.Status, entry.URL = historyDuplicate, url
+		fx.record(entry)
+		return url, nil
+	}
+	named := strings.TrimSuffix(path, dotExtension(path)) + "." + ext
+	url, remoteFilename, err := uploadWithRetries(withDigest(ctx, digest), s, fx, path, s.remoteNameFor(named, ext, digest))
+	entry.Remote, entry.URL = remoteFilename, url
+	var degraded *degradedError
+	switch {
+	case errors.As(err, &degraded):
+		log.Println(err)
+		entry.Status, entry.Error = historyPartial, err.Error()
+	case err != nil:
+		entry.Status, entry.Error = historyFailed, err.Error()
+		fx.record(entry)
+		return "", err
+	default:
+		entry.Status = historyUploaded
+	}
+	entry.Time = time.Now()
+	entry.Expires = linkExpiry(s.Profile, url, entry.Time)
+	fx.record(entry)
+	return url, nil
+}
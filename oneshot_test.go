@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestUploadOnceMaxSize(t *testing.T) {
+	tempStateDir(t)
+	s := retrySettings(0)
+	s.Extensions = []string{"png"}
+	s.MaxBytes, s.MaxSize = 4, "4"
+	path := retryFile(t)
+	if err := ioutil.WriteFile(path, []byte("larger than four bytes"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	up := &fakeUploader{}
+	fx := fakeEffects{up: up}
+
+	if _, err := uploadOnce(context.Background(), s, fx, path); err == nil || !strings.Contains(err.Error(), "-force") {
+		t.Fatalf("a file above max_size: %v, want a hint at -force", err)
+	}
+	if len(up.uploaded) != 0 {
+		t.Fatalf("uploaded %q above max_size", up.uploaded)
+	}
+
+	// -force takes the maximum away
+	s.MaxBytes = 0
+	url, err := uploadOnce(context.Background(), s, fx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(up.uploaded) != 1 || url != "https://fake.example/"+up.uploaded[0] {
+		t.Errorf("uploaded %q, URL %s", up.uploaded, url)
+	}
+}
+
+func TestUploadOnceHashName(t *testing.T) {
+	tempStateDir(t)
+	s := retrySettings(0)
+	s.Extensions = []string{"png"}
+	s.Naming, s.HashLength = namingHash, 16
+	path := retryFile(t)
+	up := &fakeUploader{}
+	if _, err := uploadOnce(context.Background(), s, fakeEffects{up: up}, path); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := fileSHA256(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := digest[:16] + ".png"; len(up.uploaded) != 1 || up.uploaded[0] != want {
+		t.Errorf("uploaded %q, want %s", up.uploaded, want)
+	}
+}
+
+func TestLocalSHA256(t *testing.T) {
+	f := strings.NewReader("png")
+	want := "digest of the file taken before"
+	ctx := withDigest(context.Background(), want)
+	if got, err := localSHA256(ctx, f, f.Size()); err != nil || got != want {
+		t.Errorf("with a digest known: %s, %v, want it as it is", got, err)
+	}
+	got, err := localSHA256(context.Background(), f, f.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("%x", sha256.Sum256([]byte("png"))); got != want {
+		t.Errorf("without one: %s, want %s", got, want)
+	}
+}
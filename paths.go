@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// percentVar matches Windows style %VAR% references
+var percentVar = regexp.MustCompile(`%([A-Za-z_][A-Za-z0-9_]*)%`)
+
+// expandPath expands a leading ~ or ~user and $VAR, ${VAR} and %VAR%
+// references in path. References to unset variables are left alone so a
+// typo shows up in the error about the path rather than silently turning
+// into an empty string. Drive letters and backslashes pass through as is.
+func expandPath(path string, getenv func(string) string) (string, error) {
+	if path == "" {
+		return path, nil
+	}
+
+	path = percentVar.ReplaceAllStringFunc(path, func(ref string) string {
+		if v := getenv(ref[1 : len(ref)-1]); v != "" {
+			return v
+		}
+		return ref
+	})
+	path = os.Expand(path, func(name string) string {
+		if v := getenv(name); v != "" {
+			return v
+		}
+		return "${" + name + "}"
+	})
+
+	if !strings.HasPrefix(path, "~") {
+		return path, nil
+	}
+
+	name, rest := path[1:], ""
+	if i := strings.IndexAny(name, `/\`); i >= 0 {
+		name, rest = name[:i], name[i:]
+	}
+
+	var home string
+	if name == "" {
+		h, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("can't expand ~ in %s: %w", path, err)
+		}
+		home = h
+	} else {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", fmt.Errorf("can't expand ~%s in %s: no such user", name, path)
+		}
+		home = u.HomeDir
+	}
+
+	return filepath.Join(home, rest), nil
+}
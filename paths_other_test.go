@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os/user"
+	"path/filepath"
+	"testing"
+)
+
+func TestExpandPathHome(t *testing.T) {
+	setEnv(t, "HOME", "/home/me")
+	checkExpandPath(t, map[string]string{"SHOTS": "Pictures/shots"}, map[string]string{
+		"~":                   "/home/me",
+		"~/":                  "/home/me",
+		"~/.ssh/id_ed25519":   "/home/me/.ssh/id_ed25519",
+		"~/$SHOTS":            "/home/me/Pictures/shots",
+		"/srv/~/shots":        "/srv/~/shots",
+		"relative/~me/shots":  "relative/~me/shots",
+		`/odd\name`:           `/odd\name`,
+		"~/Pictures/../shots": "/home/me/shots",
+	})
+
+	u, err := user.Current()
+	if err != nil || u.Username == "" {
+		t.Skip("can't look up the current user:", err)
+	}
+	checkExpandPath(t, nil, map[string]string{
+		"~" + u.Username + "/shots": filepath.Join(u.HomeDir, "shots"),
+	})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// setEnv sets the environment variable name to value for t
+func setEnv(t *testing.T, name, value string) {
+	old, set := os.LookupEnv(name)
+	os.Setenv(name, value)
+	t.Cleanup(func() {
+		if set {
+			os.Setenv(name, old)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
+
+// checkExpandPath compares what expandPath makes of each of the paths in
+// tests, with the environment env, to what they map to
+func checkExpandPath(t *testing.T, env map[string]string, tests map[string]string) {
+	t.Helper()
+	for path, want := range tests {
+		got, err := expandPath(path, fakeEnv(env))
+		if err != nil {
+			t.Errorf("expandPath(%q): %v", path, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("expandPath(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestExpandPathVariables(t *testing.T) {
+	env := map[string]string{"PICS": "/pics", "EMPTY": ""}
+	checkExpandPath(t, env, map[string]string{
+		"":              "",
+		"/plain/path":   "/plain/path",
+		"$PICS/shots":   "/pics/shots",
+		"${PICS}/shots": "/pics/shots",
+		"%PICS%/shots":  "/pics/shots",
+		"$PICS$PICS":    "/pics/pics",
+		// unset and empty ones stay, so the error names them
+		"$UNSET/shots":   "${UNSET}/shots",
+		"${UNSET}/shots": "${UNSET}/shots",
+		"%UNSET%/shots":  "%UNSET%/shots",
+		"$EMPTY/shots":   "${EMPTY}/shots",
+		"100%/shots":     "100%/shots",
+	})
+}
+
+func TestExpandPathUnknownUser(t *testing.T) {
+	if got, err := expandPath("~nosuchuser-skrins/shots", fakeEnv(nil)); err == nil {
+		t.Errorf("~nosuchuser-skrins expanded to %q, want an error", got)
+	}
+}
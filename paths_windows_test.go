@@ -0,0 +1,22 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "testing"
+
+func TestExpandPathHome(t *testing.T) {
+	setEnv(t, "USERPROFILE", `C:\Users\me`)
+	checkExpandPath(t, map[string]string{"NAME": "me", "SHOTS": `Pictures\Screenshots`}, map[string]string{
+		"~":                                    `C:\Users\me`,
+		`~\Pictures\Screenshots`:               `C:\Users\me\Pictures\Screenshots`,
+		"~/Pictures/Screenshots":               `C:\Users\me\Pictures\Screenshots`,
+		`~\%SHOTS%`:                            `C:\Users\me\Pictures\Screenshots`,
+		`C:\Users\%NAME%\Pictures\Screenshots`: `C:\Users\me\Pictures\Screenshots`,
+		`D:\Screenshots`:                       `D:\Screenshots`,
+		`C:/Users/me/Pictures`:                 `C:/Users/me/Pictures`,
+		`\\nas\share\Screenshots`:              `\\nas\share\Screenshots`,
+		`C:\Program Files (x86)\skrins\shots`:  `C:\Program Files (x86)\skrins\shots`,
+		`%UNSET%\Screenshots`:                  `%UNSET%\Screenshots`,
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// What happens to new screenshots while uploads are paused: pausedQueue
+// uploads them once resumed, pausedIgnore leaves them where they are
+const (
+	pausedQueue  = "queue"
+	pausedIgnore = "ignore"
+)
+
+// paused is whether uploads are paused, since when and why when it wasn't
+// the user, with the files saved in the meantime in the order they came in
+var paused = struct {
+	sync.Mutex
+	on     bool
+	since  time.Time
+	reason string
+	queue  []string
+	queued map[string]bool
+}{queued: map[string]bool{}}
+
+// pause stops uploading, events still come in and are handled as
+// while_paused says. It returns what it did for the log and the control
+// socket.
+func pause(s *settings) string {
+	paused.Lock()
+	defer paused.Unlock()
+	if paused.on {
+		return fmt.Sprintf("already paused since %s", paused.since.Format("15:04:05"))
+	}
+	paused.on, paused.since, paused.reason = true, time.Now(), ""
+	msg := "paused, new screenshots are uploaded once resumed"
+	if s.WhilePaused == pausedIgnore {
+		msg = "paused, new screenshots stay where they are"
+	}
+	log.Println(msg)
+	if s.PauseNotifications {
+		showPauseNotification("Uploads paused", msg)
+	}
+	return msg
+}
+
+// pauseFor pauses uploads for reason, not the user, and asks them with a
+// notification to resume. Files saved in the meantime are queued whatever
+// while_paused says.
+func pauseFor(s *settings, reason string) {
+	paused.Lock()
+	defer paused.Unlock()
+	if paused.on {
+		return
+	}
+	paused.on, paused.since, paused.reason = true, time.Now(), reason
+	log.Println("paused,", reason)
+	showPauseNotification("Uploads paused", reason)
+}
+
+// resume starts uploading again, beginning with the files queued while
+// paused
+func resume(s *settings) string {
+	paused.Lock()
+	if !paused.on {
+		paused.Unlock()
+		return "not paused"
+	}
+	queue := paused.queue
+	paused.on, paused.reason, paused.queue, paused.queued = false, "", nil, map[string]bool{}
+	paused.Unlock()
+	forgetUploadWindow()
+
+	msg := fmt.Sprintf("resumed, uploading %d files saved while paused", len(queue))
+	if len(queue) == 0 {
+		msg = "resumed"
+	}
+	log.Println(msg)
+	if s.PauseNotifications {
+		showPauseNotification("Uploads resumed", msg)
+	}
+	for _, path := range queue {
+		settledEvents.add(path, s.Debounce)
+	}
+	return msg
+}
+
+// held tells whether path isn't uploaded now because uploads are paused,
+// queueing it when while_paused says so
+func held(s *settings, path string) bool {
+	paused.Lock()
+	defer paused.Unlock()
+	if !paused.on {
+		return false
+	}
+	if s.WhilePaused == pausedIgnore && paused.reason == "" {
+		log.Printf("not uploading %s, paused", path)
+		return true
+	}
+	if !paused.queued[path] {
+		paused.queued[path] = true
+		paused.queue = append(paused.queue, path)
+		log.Printf("uploading %s once resumed", path)
+	}
+	return true
+}
+
+// pauseStatus describes whether uploads are paused, for the control socket
+func pauseStatus() string {
+	paused.Lock()
+	defer paused.Unlock()
+	if !paused.on {
+		return "uploading"
+	}
+	if paused.reason != "" {
+		return fmt.Sprintf("paused since %s, %s, %d files queued", paused.since.Format("2006-01-02 15:04:05"), paused.reason, len(paused.queue))
+	}
+	return fmt.Sprintf("paused since %s, %d files queued", paused.since.Format("2006-01-02 15:04:05"), len(paused.queue))
+}
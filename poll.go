@@ -0,0 +1,119 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultPollInterval is how often polled directories are listed unless
+// the config file sets poll_interval
+const defaultPollInterval = 2 * time.Second
+
+// polledFile is what a polled file looked like the last time around
+type polledFile struct {
+	size    int64
+	modTime int64
+}
+
+// polledDirs are the screenshot paths watched by listing them every
+// poll_interval, with what was in them the last time. It's for network
+// and virtual filesystems, which don't report changes made elsewhere.
+var polledDirs = struct {
+	sync.Mutex
+	dirs map[string]map[string]polledFile
+}{dirs: map[string]map[string]polledFile{}}
+
+// polls tells whether dir is watched by polling and why
+func (s *settings) polls(dir string) (string, bool) {
+	if s.Poll {
+		return "poll is on", true
+	}
+	if fs, ok := eventlessFS(dir); ok {
+		return fs + " doesn't report changes", true
+	}
+	return "", false
+}
+
+// addPoll starts polling dir. What's in it now counts as seen, like files
+// that were there before a watch was added.
+func addPoll(dir string, s *settings) {
+	polledDirs.Lock()
+	_, ok := polledDirs.dirs[dir]
+	polledDirs.Unlock()
+	if ok {
+		return
+	}
+	seen, err := listPolled(dir, s)
+	if err != nil {
+		debugf("polling %s: %v", dir, err)
+	}
+	polledDirs.Lock()
+	polledDirs.dirs[dir] = seen
+	polledDirs.Unlock()
+}
+
+// removePoll stops polling dir
+func removePoll(dir string) {
+	polledDirs.Lock()
+	defer polledDirs.Unlock()
+	delete(polledDirs.dirs, dir)
+}
+
+// polling tells whether dir is polled
+func polling(dir string) bool {
+	polledDirs.Lock()
+	defer polledDirs.Unlock()
+	_, ok := polledDirs.dirs[dir]
+	return ok
+}
+
+// pollLoop lists the polled directories every poll_interval, handing new
+// and changed files to the same pipeline as the events of watched ones
+func pollLoop() {
+	for {
+		time.Sleep(currentSettings().PollInterval)
+		pollOnce(currentSettings())
+	}
+}
+
+// pollOnce lists every polled directory once
+func pollOnce(s *settings) {
+	polledDirs.Lock()
+	dirs := make(map[string]map[string]polledFile, len(polledDirs.dirs))
+	for dir, seen := range polledDirs.dirs {
+		dirs[dir] = seen
+	}
+	polledDirs.Unlock()
+
+	for dir, seen := range dirs {
+		now, err := listPolled(dir, s)
+		if err != nil {
+			// a mount that's gone for now, the next round may see it again
+			debugf("polling %s: %v", dir, err)
+			continue
+		}
+		for path, f := range now {
+			if was, ok := seen[path]; (!ok || was != f) && !s.tooOld(path, time.Unix(0, f.modTime), time.Now()) {
+				settledEvents.add(path, s.Debounce)
+			}
+		}
+		polledDirs.Lock()
+		if _, ok := polledDirs.dirs[dir]; ok {
+			polledDirs.dirs[dir] = now
+		}
+		polledDirs.Unlock()
+	}
+}
+
+// listPolled is what's in dir now
+func listPolled(dir string, s *settings) (map[string]polledFile, error) {
+	paths, infos, err := s.screenshotFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]polledFile, len(paths))
+	for i, path := range paths {
+		files[path] = polledFile{infos[i].Size(), infos[i].ModTime().UnixNano()}
+	}
+	return files, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// httpPreset is a file host the http backend posts to without any
+// settings of its own, like backend = "0x0". The host answers with the
+// file's URL. http_url, http_field and http_form override what's here,
+// e.g. for a self-hosted instance or an account.
+type httpPreset struct {
+	URL   string
+	Field string
+	Form  map[string]string
+	// URLRegex finds the URL in the answer
+	URLRegex string
+	// MaxSize is the largest file the host takes
+	MaxSize int64
+	// ExpiryField is the form field http_expiry goes into, as hours with
+	// ExpiryFormat. Hosts that only take some durations list them in
+	// Expiries, hosts without ExpiryField keep files as long as they like.
+	ExpiryField  string
+	ExpiryFormat string
+	Expiries     []time.Duration
+}
+
+// httpPresets are the file hosts known by name
+var httpPresets = map[string]httpPreset{
+	// https://0x0.st keeps files 30 days to a year, the larger the shorter
+	"0x0": {
+		URL:          "https://0x0.st",
+		Field:        "file",
+		URLRegex:     `https?://\S+`,
+		MaxSize:      512 << 20,
+		ExpiryField:  "expires",
+		ExpiryFormat: "%d",
+	},
+	// https://catbox.moe/tools.php keeps files until they're deleted
+	"catbox": {
+		URL:      "https://catbox.moe/user/api.php",
+		Field:    "fileToUpload",
+		Form:     map[string]string{"reqtype": "fileupload"},
+		URLRegex: `https?://\S+`,
+		MaxSize:  200 << 20,
+	},
+	// https://litterbox.catbox.moe is catbox for files that expire
+	"litterbox": {
+		URL:          "https://litterbox.catbox.moe/resources/internals/api.php",
+		Field:        "fileToUpload",
+		Form:         map[string]string{"reqtype": "fileupload", "time": "1h"},
+		URLRegex:     `https?://\S+`,
+		MaxSize:      1 << 30,
+		ExpiryField:  "time",
+		ExpiryFormat: "%dh",
+		Expiries:     []time.Duration{time.Hour, 12 * time.Hour, 24 * time.Hour, 72 * time.Hour},
+	},
+}
+
+// httpPresetNames lists the presets for messages
+func httpPresetNames() string {
+	names := make([]string, 0, len(httpPresets))
+	for name := range httpPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// withHTTPPreset fills in the http settings of p from the preset named by
+// its backend. The form is a copy, profiles may share the one they were
+// merged from.
+func (p profile) withHTTPPreset() profile {
+	preset, ok := httpPresets[p.Backend]
+	if !ok {
+		return p
+	}
+	setDefault(&p.HTTPURL, preset.URL)
+	setDefault(&p.HTTPField, preset.Field)
+	if p.HTTPURLJSON == "" {
+		setDefault(&p.HTTPURLRegex, preset.URLRegex)
+	}
+	form := map[string]string{}
+	for name, value := range preset.Form {
+		form[name] = value
+	}
+	if preset.ExpiryField != "" && p.HTTPExpiry.Duration > 0 {
+		form[preset.ExpiryField] = fmt.Sprintf(preset.ExpiryFormat, int64(p.HTTPExpiry.Hours()))
+	}
+	for name, value := range p.HTTPForm {
+		form[name] = value
+	}
+	p.HTTPForm = form
+	return p
+}
+
+// httpPresetProblems checks the settings of a profile using a preset
+func httpPresetProblems(p profile) []string {
+	preset := httpPresets[p.Backend]
+	d := p.HTTPExpiry.Duration
+	switch {
+	case d == 0:
+		return nil
+	case preset.ExpiryField == "":
+		return []string{fmt.Sprintf("http_expiry: %s keeps files as long as it likes, there's no expiry to set", p.Backend)}
+	case d < 0 || d%time.Hour != 0:
+		return []string{fmt.Sprintf("http_expiry: %s takes whole hours, not %s", p.Backend, d)}
+	case len(preset.Expiries) > 0 && !containsDuration(preset.Expiries, d):
+		var takes []string
+		for _, e := range preset.Expiries {
+			takes = append(takes, fmt.Sprintf("%dh", int64(e.Hours())))
+		}
+		return []string{fmt.Sprintf("http_expiry: %s only takes %s, not %s", p.Backend, strings.Join(takes, ", "), d)}
+	}
+	return nil
+}
+
+// containsDuration tells whether ds has d
+func containsDuration(ds []time.Duration, d time.Duration) bool {
+	for _, e := range ds {
+		if e == d {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPresetSize makes sure the host takes a file of size bytes, before
+// it's sent over
+func checkPresetSize(p profile, name string, size int64) error {
+	preset, ok := httpPresets[p.Backend]
+	if !ok || preset.MaxSize == 0 || size <= preset.MaxSize {
+		return nil
+	}
+	return fmt.Errorf("%s is %s, %s takes files up to %s", name, formatSize(uint64(size)), p.Backend, formatSize(uint64(preset.MaxSize)))
+}
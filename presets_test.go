@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithHTTPPreset(t *testing.T) {
+	tests := []struct {
+		name string
+		p    profile
+		url  string
+		form map[string]string
+	}{
+		{"0x0", profile{Backend: "0x0"}, "https://0x0.st", map[string]string{}},
+		{"0x0 expiring", profile{Backend: "0x0", HTTPExpiry: duration{48 * time.Hour}}, "https://0x0.st", map[string]string{"expires": "48"}},
+		{"catbox", profile{Backend: "catbox"}, "https://catbox.moe/user/api.php", map[string]string{"reqtype": "fileupload"}},
+		{"catbox account", profile{Backend: "catbox", HTTPForm: map[string]string{"userhash": "abc"}}, "https://catbox.moe/user/api.php", map[string]string{"reqtype": "fileupload", "userhash": "abc"}},
+		{"litterbox", profile{Backend: "litterbox"}, "https://litterbox.catbox.moe/resources/internals/api.php", map[string]string{"reqtype": "fileupload", "time": "1h"}},
+		{"litterbox a day", profile{Backend: "litterbox", HTTPExpiry: duration{24 * time.Hour}}, "https://litterbox.catbox.moe/resources/internals/api.php", map[string]string{"reqtype": "fileupload", "time": "24h"}},
+		{"self-hosted 0x0", profile{Backend: "0x0", HTTPURL: "https://null.example.com"}, "https://null.example.com", map[string]string{}},
+		{"not a preset", profile{Backend: backendHTTP, HTTPURL: "https://up.example.com"}, "https://up.example.com", nil},
+	}
+	for _, tt := range tests {
+		p := tt.p.withHTTPPreset()
+		if p.HTTPURL != tt.url || fmt.Sprint(p.HTTPForm) != fmt.Sprint(tt.form) {
+			t.Errorf("%s: posts to %s with %v, want %s with %v", tt.name, p.HTTPURL, p.HTTPForm, tt.url, tt.form)
+		}
+	}
+
+	// the form of the profile it was merged from is left alone
+	shared := map[string]string{"userhash": "abc"}
+	profile{Backend: "litterbox", HTTPForm: shared, HTTPExpiry: duration{72 * time.Hour}}.withHTTPPreset()
+	if len(shared) != 1 {
+		t.Errorf("the preset changed the form it was given: %v", shared)
+	}
+	// a JSON path replaces the preset's regex
+	if p := (profile{Backend: "0x0", HTTPURLJSON: "url"}).withHTTPPreset(); p.HTTPURLRegex != "" {
+		t.Errorf("http_url_json and the regex %s", p.HTTPURLRegex)
+	}
+}
+
+func TestHTTPPresetProblems(t *testing.T) {
+	tests := []struct {
+		p    profile
+		want string
+	}{
+		{profile{Backend: "0x0"}, ""},
+		{profile{Backend: "0x0", HTTPExpiry: duration{5 * time.Hour}}, ""},
+		{profile{Backend: "0x0", HTTPExpiry: duration{90 * time.Minute}}, "http_expiry: 0x0 takes whole hours, not 1h30m0s"},
+		{profile{Backend: "catbox", HTTPExpiry: duration{time.Hour}}, "http_expiry: catbox keeps files as long as it likes, there's no expiry to set"},
+		{profile{Backend: "litterbox", HTTPExpiry: duration{72 * time.Hour}}, ""},
+		{profile{Backend: "litterbox", HTTPExpiry: duration{48 * time.Hour}}, "http_expiry: litterbox only takes 1h, 12h, 24h, 72h, not 48h0m0s"},
+	}
+	for _, tt := range tests {
+		got := strings.Join(httpPresetProblems(tt.p), "; ")
+		if got != tt.want {
+			t.Errorf("%s with %s: %q, want %q", tt.p.Backend, tt.p.HTTPExpiry, got, tt.want)
+		}
+	}
+}
+
+func TestCheckPresetSize(t *testing.T) {
+	if err := checkPresetSize(profile{Backend: "catbox"}, "rec.mp4", 200<<20); err != nil {
+		t.Errorf("200M to catbox: %v", err)
+	}
+	err := checkPresetSize(profile{Backend: "catbox"}, "rec.mp4", 300<<20)
+	if err == nil || err.Error() != "rec.mp4 is 300.0M, catbox takes files up to 200.0M" {
+		t.Errorf("300M to catbox: %v", err)
+	}
+	if err := checkPresetSize(profile{Backend: backendHTTP}, "rec.mp4", 10<<30); err != nil {
+		t.Errorf("the http backend has no limit: %v", err)
+	}
+}
+
+func TestHTTPPresetUpload(t *testing.T) {
+	srv, log := recordingServer(t, func(w http.ResponseWriter, r recordedRequest) {
+		fmt.Fprint(w, "https://0x0.st/Hx3c.png\n")
+	})
+	u := httpUploader{p: testProfile(profile{Backend: "0x0", HTTPURL: srv.URL, HTTPExpiry: duration{24 * time.Hour}})}
+	link, err := u.upload(context.Background(), uploadTestFile(t, "shot.png", []byte("png")), "Zr8tW.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the host's link, not one made of base_url
+	if link != "https://0x0.st/Hx3c.png" {
+		t.Errorf("link = %q, want the one in the answer", link)
+	}
+	r := log.all()[0]
+	form := postedForm(t, r)
+	if r.Method != http.MethodPost || form.Value["expires"][0] != "24" {
+		t.Errorf("%s with %v, want a POST expiring in 24 hours", r.Method, form.Value)
+	}
+	files := form.File["file"]
+	if len(files) != 1 || files[0].Filename != "Zr8tW.png" || files[0].Header.Get("Content-Type") != "image/png" {
+		t.Fatalf("files %v", form.File)
+	}
+	f, _ := files[0].Open()
+	defer f.Close()
+	if b, _ := ioutil.ReadAll(f); string(b) != "png" {
+		t.Errorf("posted %q", b)
+	}
+	// with the length upfront, not chunked
+	if got := r.Header.Get("Content-Length"); got != strconv.Itoa(len(r.Body)) {
+		t.Errorf("Content-Length %q for %d bytes", got, len(r.Body))
+	}
+}
+
+func TestHTTPPresetErrors(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		want   string
+	}{
+		{200, "<html>Upload failed</html>", "response doesn't match https?://\\S+"},
+		{413, "413 Request Entity Too Large", "server answered 413 Request Entity Too Large: 413 Request Entity Too Large"},
+	}
+	for _, tt := range tests {
+		srv, _ := recordingServer(t, func(w http.ResponseWriter, r recordedRequest) {
+			w.WriteHeader(tt.status)
+			fmt.Fprint(w, tt.body)
+		})
+		u := httpUploader{p: testProfile(profile{Backend: "catbox", HTTPURL: srv.URL})}
+		if _, err := u.upload(context.Background(), uploadTestFile(t, "shot.png", []byte("png")), "Zr8tW.png"); err == nil || err.Error() != tt.want {
+			t.Errorf("%d %s: %v, want %s", tt.status, tt.body, err, tt.want)
+		}
+	}
+}
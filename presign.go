@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// s3MaxSkew is how far this machine's clock may be off from S3's before
+// presigned links are refused, they'd be rejected or expire early
+const s3MaxSkew = 5 * time.Minute
+
+// presign returns a link to key valid for s3_presign, and remembers it so
+// `skrins last -renew` can make a new one
+func (u s3Uploader) presign(key string, now time.Time) (string, error) {
+	link, err := presignS3(u.p, key, u.p.S3Presign.Duration, now)
+	if err != nil {
+		return "", err
+	}
+	savePresignedUpload(presignedUpload{
+		Key:       key,
+		Bucket:    u.p.S3Bucket,
+		Region:    s3RegionFor(u.p, os.Getenv),
+		Endpoint:  u.p.S3Endpoint,
+		PathStyle: u.p.S3PathStyle,
+		Valid:     u.p.S3Presign.Duration,
+		Signed:    now,
+		Expires:   now.Add(u.p.S3Presign.Duration),
+	})
+	return link, nil
+}
+
+// presignS3 signs a GET of key in p's bucket, valid for expires from now
+func presignS3(p profile, key string, expires time.Duration, now time.Time) (string, error) {
+	creds, err := loadAWSCredentials(os.Getenv)
+	if err != nil {
+		return "", err
+	}
+	target, err := s3BucketURL(p, os.Getenv)
+	if err != nil {
+		return "", err
+	}
+	target.Path += "/" + key
+	return presignAWS(target, creds, "s3", s3RegionFor(p, os.Getenv), expires, now).String(), nil
+}
+
+// presignProblems checks s3_presign
+func presignProblems(p profile) []string {
+	switch d := p.S3Presign.Duration; {
+	case d < 0:
+		return []string{"s3_presign can't be negative"}
+	case d > awsMaxPresign:
+		return []string{fmt.Sprintf("s3_presign: presigned links are valid for at most %s, not %s", awsMaxPresign, d)}
+	case d > 0 && d < time.Second:
+		return []string{fmt.Sprintf("s3_presign: %s is less than a second", d)}
+	}
+	return nil
+}
+
+// check makes sure, with s3_presign, that this machine's clock agrees with
+// S3's. Asking the bucket for its Date needs no credentials.
+func (u s3Uploader) check(ctx context.Context) error {
+	if u.p.S3Presign.Duration == 0 {
+		return nil
+	}
+	target, err := s3BucketURL(u.p, os.Getenv)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodHead, target.String()+"/", nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	now := time.Now()
+	resp, err := httpClientFor(u.p).Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	server, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		debugf("%s sent no Date, can't check the clock", target.Host)
+		return nil
+	}
+	skew := now.Sub(server)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > s3MaxSkew {
+		return fmt.Errorf("s3_presign: this computer's clock is %s off, presigned links won't work until it's set right", skew.Round(time.Second))
+	}
+	return nil
+}
+
+// presignedUpload is an object uploaded with a presigned link, with what's
+// needed to sign it again. Signing as of Signed gives the same link.
+type presignedUpload struct {
+	Key       string        `json:"key"`
+	Bucket    string        `json:"bucket"`
+	Region    string        `json:"region"`
+	Endpoint  string        `json:"endpoint,omitempty"`
+	PathStyle bool          `json:"path_style,omitempty"`
+	Valid     time.Duration `json:"valid"`
+	Signed    time.Time     `json:"signed"`
+	Expires   time.Time     `json:"expires"`
+}
+
+// profile returns the settings that sign links to the upload
+func (up presignedUpload) profile() profile {
+	return profile{Backend: backendS3, S3Bucket: up.Bucket, S3Region: up.Region, S3Endpoint: up.Endpoint, S3PathStyle: up.PathStyle}
+}
+
+// presignedFile holds the last presignedKept presigned uploads, oldest
+// first, in the state directory
+const (
+	presignedFile = "presigned.json"
+	presignedKept = 100
+)
+
+// presignedMu guards the presigned file
+var presignedMu sync.Mutex
+
+// readPresignedUploads loads the presigned uploads, an unreadable file
+// counts as empty
+func readPresignedUploads() []presignedUpload {
+	var uploads []presignedUpload
+	if err := readState(presignedFile, &uploads); err != nil && !os.IsNotExist(err) {
+		debugf("ignoring %s: %v", presignedFile, err)
+	}
+	return uploads
+}
+
+// savePresignedUpload remembers up as the last presigned upload
+func savePresignedUpload(up presignedUpload) {
+	presignedMu.Lock()
+	defer presignedMu.Unlock()
+	uploads := append(readPresignedUploads(), up)
+	if len(uploads) > presignedKept {
+		uploads = uploads[len(uploads)-presignedKept:]
+	}
+	if err := writeState(presignedFile, uploads); err != nil {
+		log.Printf("can't save the presigned upload of %s: %v", up.Key, err)
+	}
+}
+
+// runLast implements `skrins last`: it prints the URL of the last upload
+// from the history. For a presigned link it tells when it expires, and with
+// -renew it signs a new one and copies it to the clipboard.
+func runLast(args []string) error {
+	var renew bool
+	var valid time.Duration
+	fs := flag.NewFlagSet("last", flag.ExitOnError)
+	fs.BoolVar(&renew, "renew", false, "Sign a new link and copy it to the clipboard")
+	fs.DurationVar(&valid, "for", 0, "How long the renewed link is valid (default as long as the last one)")
+	fs.Parse(args)
+
+	last, found, err := lastUploaded()
+	if err != nil {
+		return err
+	}
+	if _, presigned := presignExpiry(last.URL); found && !presigned {
+		if renew {
+			return fmt.Errorf("the last upload, %s, has a link that doesn't expire", last.URL)
+		}
+		fmt.Println(last.URL)
+		fmt.Printf("uploaded %s from %s\n", last.Time.Local().Format("2006-01-02 15:04"), last.File)
+		return nil
+	}
+
+	presignedMu.Lock()
+	defer presignedMu.Unlock()
+	uploads := readPresignedUploads()
+	if len(uploads) == 0 {
+		return fmt.Errorf("nothing uploaded yet")
+	}
+	up := &uploads[len(uploads)-1]
+	if renew {
+		if valid == 0 {
+			valid = up.Valid
+		}
+		if problems := presignProblems(profile{S3Presign: duration{valid}}); len(problems) > 0 {
+			return fmt.Errorf("-for: %s", problems[0])
+		}
+		now := time.Now()
+		up.Valid, up.Signed, up.Expires = valid, now, now.Add(valid)
+		if err := writeState(presignedFile, uploads); err != nil {
+			return err
+		}
+	}
+	link, err := presignS3(up.profile(), up.Key, up.Valid, up.Signed)
+	if err != nil {
+		return err
+	}
+	if renew {
+		copyToClipboard(link)
+	}
+
+	fmt.Println(link)
+	if left := time.Until(up.Expires); left > 0 {
+		fmt.Printf("expires %s (in %s)\n", up.Expires.Local().Format("2006-01-02 15:04"), left.Round(time.Minute))
+	} else {
+		fmt.Printf("expired %s, get a new link with -renew\n", up.Expires.Local().Format("2006-01-02 15:04"))
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressOptions says when the progress of an upload is reported
+type progressOptions struct {
+	// Threshold is the size from which uploads log their progress
+	Threshold int64
+	// Interval is how often progress is logged
+	Interval time.Duration
+	// Notify also shows a notification at 25, 50, 75 and 100 percent, each
+	// one replacing the one before of the same upload where the system
+	// allows it
+	Notify bool
+}
+
+// Progress reporting used unless the config file sets progress_threshold
+// or progress_interval
+const (
+	defaultProgressThreshold = 50 << 20
+	defaultProgressInterval  = 5 * time.Second
+)
+
+// transfer is the progress of one upload
+type transfer struct {
+	Name  string
+	Size  int64
+	opts  progressOptions
+	start time.Time
+	// offset is where a resumed upload started, done how far it got. done
+	// is read and written atomically.
+	offset int64
+	done   int64
+
+	// only touched by the reader
+	lastLog  time.Time
+	quarters int64
+}
+
+// activeTransfers are the uploads in progress, one per busy worker
+var activeTransfers = struct {
+	sync.Mutex
+	t map[*transfer]bool
+}{t: map[*transfer]bool{}}
+
+// startTransfer begins tracking the upload of src, size bytes of which
+// offset are on the server already
+func startTransfer(src string, size, offset int64, opts progressOptions) *transfer {
+	now := time.Now()
+	t := &transfer{Name: filepath.Base(src), Size: size, opts: opts, start: now, offset: offset, done: offset, lastLog: now, quarters: offset * 4 / max64(size, 1)}
+	activeTransfers.Lock()
+	activeTransfers.t[t] = true
+	activeTransfers.Unlock()
+	return t
+}
+
+// currentTransfers returns the uploads in progress, oldest first
+func currentTransfers() []*transfer {
+	activeTransfers.Lock()
+	defer activeTransfers.Unlock()
+	var ts []*transfer
+	for t := range activeTransfers.t {
+		ts = append(ts, t)
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i].start.Before(ts[j].start) })
+	return ts
+}
+
+// finish stops tracking t
+func (t *transfer) finish() {
+	activeTransfers.Lock()
+	delete(activeTransfers.t, t)
+	activeTransfers.Unlock()
+}
+
+// percent is how much of the file is on the server
+func (t *transfer) percent() int64 {
+	return atomic.LoadInt64(&t.done) * 100 / max64(t.Size, 1)
+}
+
+// status describes t in a few words, like "uploading foo.mp4 – 43%"
+func (t *transfer) status() string {
+	return fmt.Sprintf("uploading %s – %d%%", t.Name, t.percent())
+}
+
+// rate is the average speed of this attempt in bytes per second
+func (t *transfer) rate() float64 {
+	elapsed := time.Since(t.start).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(atomic.LoadInt64(&t.done)-t.offset) / elapsed
+}
+
+// summary is logged once the upload is complete
+func (t *transfer) summary() string {
+	return fmt.Sprintf("Total of %d bytes copied in %s (%s/s)", t.Size, time.Since(t.start).Round(100*time.Millisecond), formatSize(uint64(t.rate())))
+}
+
+// add counts n more bytes uploaded and reports progress when it's due
+func (t *transfer) add(n int) {
+	done := atomic.AddInt64(&t.done, int64(n))
+	if t.Size < t.opts.Threshold {
+		return
+	}
+	if now := time.Now(); now.Sub(t.lastLog) >= t.opts.Interval {
+		t.lastLog = now
+		log.Printf("%s (%s of %s, %s/s)", t.status(), formatSize(uint64(done)), formatSize(uint64(t.Size)), formatSize(uint64(t.rate())))
+	}
+	if quarters := done * 4 / max64(t.Size, 1); t.opts.Notify && quarters > t.quarters {
+		t.quarters = quarters
+		// notifications can take a moment to show, the upload doesn't wait
+		go showProgressNotification(t.Name, quarters*25)
+	}
+}
+
+// watchStall returns a context that's cancelled once t made no progress
+// for stall, and a function that stops watching and tells whether that
+// happened. It's for uploads that don't run on an sftpConn, which watches
+// by itself.
+func watchStall(ctx context.Context, t *transfer, stall time.Duration) (context.Context, func() bool) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := make(chan struct{})
+	var stalled int32
+	go func() {
+		check := time.NewTicker(stall / 4)
+		defer check.Stop()
+		last, lastChange := atomic.LoadInt64(&t.done), time.Now()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ctx.Done():
+				return
+			case now := <-check.C:
+				// once everything's sent the server may take its time to answer
+				if done := atomic.LoadInt64(&t.done); done != last || done == t.Size {
+					last, lastChange = done, now
+				} else if now.Sub(lastChange) >= stall {
+					atomic.StoreInt32(&stalled, 1)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	return ctx, func() bool {
+		close(stop)
+		cancel()
+		return atomic.LoadInt32(&stalled) == 1
+	}
+}
+
+// progressTracker counts what's read through it in a transfer
+type progressTracker struct {
+	r io.Reader
+	t *transfer
+}
+
+func (pt progressTracker) Read(p []byte) (int, error) {
+	n, err := pt.r.Read(p)
+	pt.t.add(n)
+	return n, err
+}
+
+// showProgressNotification tells how far the upload of name got
+func showProgressNotification(name string, percent int64) {
+	if err := replaceNotification(name, "Uploading "+name, fmt.Sprintf("%d%%", percent)); err != nil {
+		log.Println("notification failed:", err)
+	}
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
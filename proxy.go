@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+func init() {
+	proxy.RegisterDialerType("http", newHTTPConnectDialer)
+}
+
+// proxyError is a failure to reach a server through a proxy. Down tells
+// whether the proxy itself couldn't be reached, rather than the proxy not
+// getting through to Target.
+type proxyError struct {
+	Proxy  string
+	Target string
+	Down   bool
+	Err    error
+}
+
+func (e *proxyError) Error() string {
+	if e.Down {
+		return fmt.Sprintf("proxy %s unreachable: %v", e.Proxy, e.Err)
+	}
+	return fmt.Sprintf("%s unreachable through proxy %s: %v", e.Target, e.Proxy, e.Err)
+}
+
+func (e *proxyError) Unwrap() error { return e.Err }
+
+// proxyURL is the proxy to connect to p's server through: p's proxy setting,
+// or ALL_PROXY unless the server is listed in NO_PROXY. It's nil for
+// connecting directly.
+func proxyURL(p profile, getenv func(string) string) (*url.URL, error) {
+	raw := p.Proxy
+	if raw == "" {
+		raw = firstEnv(getenv, "ALL_PROXY", "all_proxy")
+		if raw == "" {
+			return nil, nil
+		}
+		if bypassed(firstEnv(getenv, "NO_PROXY", "no_proxy"), p.RemoteHost) {
+			return nil, nil
+		}
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: %w", err)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+	default:
+		return nil, fmt.Errorf("proxy %s: expected a socks5:// or http:// URL", raw)
+	}
+	return u, nil
+}
+
+// firstEnv returns the first of the environment variables that is set
+func firstEnv(getenv func(string) string, names ...string) string {
+	for _, name := range names {
+		if v := getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// bypassed tells whether NO_PROXY style noProxy excludes hostport from
+// proxying. It asks proxy.PerHost, which only tells by dialing, so it's
+// given dialers that just note which one it picked.
+func bypassed(noProxy, hostport string) bool {
+	direct := false
+	perHost := proxy.NewPerHost(
+		dialerFunc(func(network, addr string) (net.Conn, error) { return nil, errProbe }),
+		dialerFunc(func(network, addr string) (net.Conn, error) {
+			direct = true
+			return nil, errProbe
+		}),
+	)
+	perHost.AddFromString(noProxy)
+	perHost.Dial("tcp", hostport)
+	return direct
+}
+
+// errProbe is returned by the dialers bypassed hands out
+var errProbe = errors.New("probe")
+
+// dialerFunc makes a function a proxy.Dialer
+type dialerFunc func(network, addr string) (net.Conn, error)
+
+func (f dialerFunc) Dial(network, addr string) (net.Conn, error) { return f(network, addr) }
+
+// dialRemote opens a TCP connection to p's server, through a proxy if one
+// applies, giving up after p's dial timeout
+func dialRemote(p profile) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.DialTimeout.Duration)
+	defer cancel()
+
+	u, err := proxyURL(p, os.Getenv)
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	if u == nil {
+		return d.DialContext(ctx, "tcp", p.RemoteHost)
+	}
+
+	hop := proxyHop{proxy: u.Host}
+	via, err := proxy.FromURL(u, hop)
+	if err != nil {
+		return nil, err
+	}
+	debugf("connecting to %s through proxy %s", p.RemoteHost, u.Host)
+	var conn net.Conn
+	if cd, ok := via.(proxy.ContextDialer); ok {
+		conn, err = cd.DialContext(ctx, "tcp", p.RemoteHost)
+	} else {
+		conn, err = via.Dial("tcp", p.RemoteHost)
+	}
+	if err != nil {
+		var pe *proxyError
+		if errors.As(err, &pe) {
+			return nil, pe
+		}
+		return nil, &proxyError{Proxy: u.Host, Target: p.RemoteHost, Err: err}
+	}
+	return conn, nil
+}
+
+// proxyHop connects to the proxy itself, so failing to reach it can be told
+// apart from the proxy failing to reach the server
+type proxyHop struct {
+	proxy string
+}
+
+func (h proxyHop) Dial(network, addr string) (net.Conn, error) {
+	return h.DialContext(context.Background(), network, addr)
+}
+
+func (h proxyHop) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, &proxyError{Proxy: h.proxy, Down: true, Err: err}
+	}
+	return conn, nil
+}
+
+// httpConnectDialer tunnels connections through an HTTP proxy with CONNECT
+type httpConnectDialer struct {
+	proxy   *url.URL
+	forward proxy.Dialer
+}
+
+func newHTTPConnectDialer(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	return httpConnectDialer{proxy: u, forward: forward}, nil
+}
+
+func (d httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d httpConnectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	proxyAddr := d.proxy.Host
+	if d.proxy.Port() == "" {
+		proxyAddr = net.JoinHostPort(d.proxy.Hostname(), "80")
+	}
+	var conn net.Conn
+	var err error
+	if cd, ok := d.forward.(proxy.ContextDialer); ok {
+		conn, err = cd.DialContext(ctx, network, proxyAddr)
+	} else {
+		conn, err = d.forward.Dial(network, proxyAddr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := d.proxy.User; u != nil {
+		password, _ := u.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy answered %s", resp.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+	// the server may have started talking already, what's buffered goes first
+	return bufferedConn{Conn: conn, r: br}, nil
+}
+
+// bufferedConn is a net.Conn whose reads go through r
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// failedDir is the folder next to them files that keep failing to upload
+// are moved to, with a reasonSuffix file telling why
+const failedDir = "failed"
+
+// reasonSuffix is added to the name of a file in failedDir for the file
+// with the failures that got it there
+const reasonSuffix = ".reason.json"
+
+// defaultQuarantineAfter is how many times an upload may fail for reasons
+// of its own before the file goes to failedDir
+const defaultQuarantineAfter = 3
+
+// uploadFailure is an upload that failed, in the reason file
+type uploadFailure struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+// quarantineReason is what a reason file holds
+type quarantineReason struct {
+	File        string          `json:"file"`
+	Quarantined time.Time       `json:"quarantined"`
+	Failures    []uploadFailure `json:"failures"`
+}
+
+// failures are the uploads that failed since the last success by path,
+// failures of the network don't count as they're no fault of the file
+var failures = struct {
+	sync.Mutex
+	paths map[string][]uploadFailure
+}{paths: map[string][]uploadFailure{}}
+
+// quarantineIfFailing counts err against the file at path and moves it to
+// failedDir when it failed quarantine_after times, returning where it is
+// now
+func (s *settings) quarantineIfFailing(fx effects, path string, err error) (string, bool) {
+	if s.NoQuarantine || networkFailure(err) {
+		return "", false
+	}
+	failures.Lock()
+	failed := append(failures.paths[path], uploadFailure{Time: time.Now(), Error: err.Error()})
+	failures.paths[path] = failed
+	failures.Unlock()
+	if len(failed) < s.QuarantineAfter {
+		return "", false
+	}
+	moved, err := fx.quarantine(path, quarantineReason{File: path, Quarantined: time.Now(), Failures: failed})
+	if err != nil {
+		log.Printf("can't move %s to %s: %v", path, failedDir, err)
+		return "", false
+	}
+	failures.Lock()
+	delete(failures.paths, path)
+	failures.Unlock()
+	log.Printf("moved %s to %s after %d failed uploads, skrins retry-failed brings it back", path, moved, len(failed))
+	return moved, true
+}
+
+// networkFailure tells whether err came from the network rather than the
+// file or the server. Errors of the filesystem look like network errors to
+// transient, those of the network come wrapped in a net.OpError.
+func networkFailure(err error) bool {
+	var errno syscall.Errno
+	var opErr *net.OpError
+	if errors.As(err, &errno) && !errors.As(err, &opErr) {
+		return false
+	}
+	return transient(err)
+}
+
+// uploadSucceeded forgets the failures of the file at path
+func uploadSucceeded(path string) {
+	failures.Lock()
+	delete(failures.paths, path)
+	failures.Unlock()
+}
+
+// quarantine moves the file at path to failedDir next to it with the
+// reason file r and returns where it is now
+func quarantine(path string, r quarantineReason) (string, error) {
+	dir := filepath.Join(filepath.Dir(path), failedDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	target := archiveTarget(dir, path)
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(target+reasonSuffix, append(b, '\n'), 0600); err != nil {
+		return "", err
+	}
+	if err := os.Rename(path, target); err != nil {
+		os.Remove(target + reasonSuffix)
+		return "", err
+	}
+	return target, nil
+}
+
+// inFailedDir tells whether path is in a folder failing files were moved to
+func inFailedDir(path string) bool {
+	return filepath.Base(filepath.Dir(path)) == failedDir
+}
+
+// runRetryFailed implements `skrins retry-failed`: it moves the files the
+// history has in failedDir back to where they were, the running skrins
+// uploads them from there
+func runRetryFailed(args []string) error {
+	fs := flag.NewFlagSet("retry-failed", flag.ExitOnError)
+	fs.Parse(args)
+
+	quarantined := map[string]string{}
+	err := readHistory(func(e historyEntry) {
+		if e.Quarantined != "" {
+			quarantined[e.Quarantined] = e.File
+		}
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	n := 0
+	for moved, file := range quarantined {
+		if _, err := os.Lstat(moved); os.IsNotExist(err) {
+			// brought back before, or deleted
+			continue
+		}
+		if _, err := os.Lstat(file); err == nil {
+			fmt.Fprintf(os.Stderr, "not moving %s back, %s exists\n", moved, file)
+			continue
+		}
+		if err := os.Rename(moved, file); err != nil {
+			fmt.Fprintf(os.Stderr, "can't move %s back: %v\n", moved, err)
+			continue
+		}
+		os.Remove(moved + reasonSuffix)
+		fmt.Println(file)
+		n++
+	}
+	if n == 0 {
+		return fmt.Errorf("no failed files to move back")
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// uploadQueueSize is how many paths may wait for a worker. Adding more
+// blocks until there's room, nothing is dropped, and since a path is only
+// queued once however many events it gets, that takes as many files.
+const uploadQueueSize = 1000
+
+// uploadQueue holds the paths whose events settled until a worker uploads
+// them, the one modified longest ago first, so after a burst the last
+// screenshot taken is the last one uploaded whatever it's called. A path is
+// in it once however often it's added, and a path added while it's being
+// uploaded is queued again once that's done, never uploaded twice at the
+// same time.
+type uploadQueue struct {
+	size int
+
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	paths    []string
+	modified map[string]time.Time
+	queued   map[string]bool
+	active   map[string]bool
+	again    map[string]bool
+}
+
+func newUploadQueue(size int) *uploadQueue {
+	q := &uploadQueue{
+		size:     size,
+		modified: map[string]time.Time{},
+		queued:   map[string]bool{},
+		active:   map[string]bool{},
+		again:    map[string]bool{},
+	}
+	q.notEmpty = sync.NewCond(&q.mu)
+	q.notFull = sync.NewCond(&q.mu)
+	return q
+}
+
+// add queues path unless it's waiting already, blocking while the queue
+// is full
+func (q *uploadQueue) add(path string) {
+	var modified time.Time
+	if fi, err := os.Stat(path); err == nil {
+		modified = fi.ModTime()
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		if q.active[path] {
+			q.again[path] = true
+			return
+		}
+		if q.queued[path] || len(q.paths) < q.size {
+			break
+		}
+		q.notFull.Wait()
+	}
+	q.push(path, modified)
+}
+
+// push queues path, modified at modified, unless it's queued already. q.mu
+// must be locked.
+func (q *uploadQueue) push(path string, modified time.Time) {
+	if q.queued[path] {
+		return
+	}
+	q.queued[path] = true
+	q.modified[path] = modified
+	q.paths = append(q.paths, path)
+	q.notEmpty.Signal()
+}
+
+// next waits for a path and takes the one modified longest ago, of those
+// modified at the same time the one queued first. The worker calls done
+// with it once it's uploaded.
+func (q *uploadQueue) next() string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.paths) == 0 {
+		q.notEmpty.Wait()
+	}
+	oldest := 0
+	for i, path := range q.paths {
+		if q.modified[path].Before(q.modified[q.paths[oldest]]) {
+			oldest = i
+		}
+	}
+	path := q.paths[oldest]
+	copy(q.paths[oldest:], q.paths[oldest+1:])
+	q.paths[len(q.paths)-1] = ""
+	q.paths = q.paths[:len(q.paths)-1]
+	delete(q.queued, path)
+	delete(q.modified, path)
+	q.active[path] = true
+	q.notFull.Broadcast()
+	return path
+}
+
+// done tells that the worker is done with path, which is queued again
+// when it was added in the meantime
+func (q *uploadQueue) done(path string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.active, path)
+	if q.again[path] {
+		delete(q.again, path)
+		// past the size, waiting here would hold up the worker that has to
+		// make room
+		var modified time.Time
+		if fi, err := os.Stat(path); err == nil {
+			modified = fi.ModTime()
+		}
+		q.push(path, modified)
+	}
+}
+
+// depth is how many paths wait for a worker and how many are uploaded
+// right now
+func (q *uploadQueue) depth() (waiting, active int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.paths), len(q.active)
+}
+
+// uploads are the paths the workers take care of
+var uploads = newUploadQueue(uploadQueueSize)
+
+// maxWorkers caps workers, more uploads at once rarely get them done
+// sooner and servers limit connections per user
+const maxWorkers = 4
+
+// workers are the ids of the running upload workers
+var workers = struct {
+	sync.Mutex
+	running map[int]bool
+}{running: map[int]bool{}}
+
+// workerKey is the context key of the worker id an upload runs on
+type workerKey struct{}
+
+// workerOf is the id of the worker ctx belongs to, 0 outside of one
+func workerOf(ctx context.Context) int {
+	id, _ := ctx.Value(workerKey{}).(int)
+	return id
+}
+
+// startWorkers starts upload workers until there are n, those above n
+// stop once they're done with their current path
+func startWorkers(n int) {
+	workers.Lock()
+	defer workers.Unlock()
+	for id := 0; id < n; id++ {
+		if !workers.running[id] {
+			workers.running[id] = true
+			go uploadWorker(id)
+		}
+	}
+}
+
+// uploadWorker uploads queued paths one after the other. With one worker
+// files are uploaded in the order they were modified in, with several a
+// small screenshot isn't held up by a large recording.
+func uploadWorker(id int) {
+	ctx := context.WithValue(context.Background(), workerKey{}, id)
+	for {
+		path := uploads.next()
+		uploadPath(ctx, path)
+		uploads.done(path)
+		s := currentSettings()
+		endBatch(s, effectsFor(s))
+
+		workers.Lock()
+		if id >= currentSettings().Workers {
+			delete(workers.running, id)
+			workers.Unlock()
+			return
+		}
+		workers.Unlock()
+	}
+}
+
+// queueFile holds the paths that were still to be uploaded when skrins
+// exited, in the state directory
+const queueFile = "queue.json"
+
+// saveQueue remembers the paths still to be uploaded on exit: those being
+// uploaded, waiting in the queue, for a retry or for max_uploads
+func saveQueue() {
+	uploads.mu.Lock()
+	paths := []string{}
+	for path := range uploads.active {
+		paths = append(paths, path)
+	}
+	paths = append(paths, uploads.paths...)
+	uploads.mu.Unlock()
+	retries.Lock()
+	for path := range retries.paths {
+		paths = append(paths, path)
+	}
+	retries.Unlock()
+	paths = append(paths, waitingForWindow()...)
+
+	if err := writeState(queueFile, paths); err != nil {
+		log.Printf("can't save the %d files still to upload: %v", len(paths), err)
+	}
+}
+
+// restoreQueue queues the paths saveQueue remembered that are still there
+// and in a screenshot path
+func restoreQueue(s *settings) {
+	var paths []string
+	if err := readState(queueFile, &paths); err != nil {
+		if !os.IsNotExist(err) {
+			debugf("ignoring %s: %v", queueFile, err)
+		}
+		return
+	}
+	var left []string
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		for _, dir := range s.ScreensPaths {
+			if isWithin(path, dir) {
+				left = append(left, path)
+				break
+			}
+		}
+	}
+	if len(left) > 0 {
+		log.Printf("uploading %d files left from the last run", len(left))
+	}
+	writeState(queueFile, []string{})
+	for _, path := range left {
+		uploads.add(path)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUploadQueueStress(t *testing.T) {
+	const (
+		files   = 500
+		events  = 5000
+		workers = 4
+		size    = 16
+	)
+	q := newUploadQueue(size)
+	var mu sync.Mutex
+	uploaded := map[string]int{}
+	active := map[string]bool{}
+	var problems []string
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				path := q.next()
+				if strings.HasPrefix(path, "stop") {
+					return
+				}
+				mu.Lock()
+				if active[path] {
+					problems = append(problems, path+" uploaded twice at the same time")
+				}
+				active[path] = true
+				mu.Unlock()
+				time.Sleep(time.Duration(len(path)%3) * 100 * time.Microsecond)
+				mu.Lock()
+				delete(active, path)
+				uploaded[path]++
+				mu.Unlock()
+				q.done(path)
+			}
+		}()
+	}
+
+	var before runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	// several watchers' worth of events, each file gets ten in no order
+	for p := 0; p < 10; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < events/10; i++ {
+				q.add(fmt.Sprintf("/shots/%d.png", (i*7+p*13)%files))
+				if waiting, _ := q.depth(); waiting > size {
+					mu.Lock()
+					problems = append(problems, fmt.Sprintf("%d paths waiting, more than the %d allowed", waiting, size))
+					mu.Unlock()
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+	eventually(t, "the queue to drain", func() bool {
+		waiting, active := q.depth()
+		return waiting == 0 && active == 0
+	})
+	q.mu.Lock()
+	left := len(q.queued) + len(q.modified) + len(q.active) + len(q.again)
+	q.mu.Unlock()
+	for i := 0; i < workers; i++ {
+		q.add(fmt.Sprintf("stop %d", i))
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, p := range problems {
+		t.Error(p)
+	}
+	for i := 0; i < files; i++ {
+		path := fmt.Sprintf("/shots/%d.png", i)
+		if uploaded[path] == 0 {
+			t.Errorf("%s never uploaded", path)
+		}
+	}
+	if left > 0 {
+		t.Errorf("%d paths still remembered by a drained queue", left)
+	}
+	var after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	if grown := int64(after.HeapInuse) - int64(before.HeapInuse); grown > 4<<20 {
+		t.Errorf("the heap grew by %d bytes for %d events", grown, events)
+	}
+}
+
+func TestUploadQueueBlocksWhenFull(t *testing.T) {
+	q := newUploadQueue(2)
+	q.add("/shots/a.png")
+	q.add("/shots/b.png")
+	// those already queued don't need room
+	q.add("/shots/a.png")
+
+	added := make(chan struct{})
+	go func() {
+		q.add("/shots/c.png")
+		close(added)
+	}()
+	select {
+	case <-added:
+		t.Fatal("added to a full queue")
+	case <-time.After(100 * time.Millisecond):
+	}
+	first := q.next()
+	select {
+	case <-added:
+	case <-time.After(5 * time.Second):
+		t.Fatal("still blocked after a path was taken")
+	}
+	q.done(first)
+	if waiting, active := q.depth(); waiting != 2 || active != 0 {
+		t.Errorf("depth %d waiting and %d active, want 2 and 0", waiting, active)
+	}
+}
+
+func TestUploadQueueAddedWhileActive(t *testing.T) {
+	q := newUploadQueue(10)
+	q.add("/shots/a.png")
+	path := q.next()
+	// events while it's uploaded queue it once more, once it's done
+	q.add(path)
+	q.add(path)
+	if waiting, active := q.depth(); waiting != 0 || active != 1 {
+		t.Fatalf("depth %d waiting and %d active while uploading, want 0 and 1", waiting, active)
+	}
+	q.done(path)
+	if waiting, active := q.depth(); waiting != 1 || active != 0 {
+		t.Fatalf("depth %d waiting and %d active after, want 1 and 0", waiting, active)
+	}
+	if again := q.next(); again != path {
+		t.Errorf("next = %s, want %s again", again, path)
+	}
+	q.done(path)
+	if waiting, active := q.depth(); waiting != 0 || active != 0 {
+		t.Errorf("depth %d waiting and %d active at the end, want none", waiting, active)
+	}
+}
+
+func TestUploadQueueOldestFirst(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skrins-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// a batch whose names sort in another order than they were saved in,
+	// the last two saved in the same second
+	const files = 20
+	base := time.Now().Add(-time.Hour)
+	var want []string
+	for i := 0; i < files; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("%02d.png", (i*7)%files))
+		if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		modified := base.Add(time.Duration(i) * time.Second)
+		if i == files-1 {
+			modified = modified.Add(-time.Second)
+		}
+		if err := os.Chtimes(path, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, path)
+	}
+
+	q := newUploadQueue(files)
+	for i := 0; i < files; i++ {
+		q.add(filepath.Join(dir, fmt.Sprintf("%02d.png", i)))
+	}
+	var got []string
+	for i := 0; i < files; i++ {
+		path := q.next()
+		got = append(got, path)
+		q.done(path)
+	}
+	// of those saved in the same second the one queued first goes first
+	if a, b := want[files-2], want[files-1]; filepath.Base(a) > filepath.Base(b) {
+		want[files-2], want[files-1] = b, a
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("uploaded in the order\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestCopyURLNewestWins(t *testing.T) {
+	old := announced
+	t.Cleanup(func() { announced = old })
+	announced.modified, announced.at = time.Time{}, time.Time{}
+	fx := pipelineEffects{fakeEffects{}, &pipelineLog{}}
+	started := time.Now()
+	recording, screenshot := started.Add(-time.Minute), started.Add(-time.Second)
+
+	// the screenshot finishes first, the recording it was taken after
+	// finishes later and doesn't replace it
+	copyURL(fx, "https://example.com/shot.png", screenshot, started)
+	copyURL(fx, "https://example.com/clip.mp4", recording, started)
+	if want := []string{"https://example.com/shot.png"}; !reflect.DeepEqual(fx.log.clipboard, want) {
+		t.Errorf("copied %q, want %q", fx.log.clipboard, want)
+	}
+	// an upload started after that copy is newer however old the file
+	copyURL(fx, "https://example.com/clip.mp4", recording, time.Now().Add(time.Millisecond))
+	if n := len(fx.log.clipboard); n != 2 || fx.log.clipboard[1] != "https://example.com/clip.mp4" {
+		t.Errorf("copied %q, want the upload started later last", fx.log.clipboard)
+	}
+}
+
+func TestEndBatchSingleResult(t *testing.T) {
+	old := announced
+	t.Cleanup(func() { announced = old })
+	announced.modified, announced.at = time.Time{}, time.Time{}
+	fx := pipelineEffects{fakeEffects{}, &pipelineLog{}}
+	var duplicates []string
+	url := "https://example.com/shot.png"
+
+	// a batch that came to one duplicate is notified of as a duplicate
+	batch.Lock()
+	batch.results = []batchResult{{
+		name:     "shot.png",
+		url:      url,
+		announce: func(fx effects) { duplicates = append(duplicates, url) },
+		modified: time.Now(),
+		started:  time.Now(),
+	}}
+	batch.Unlock()
+	endBatch(retrySettings(0), fx)
+	if !reflect.DeepEqual(duplicates, []string{url}) || len(fx.log.notified) != 0 {
+		t.Errorf("duplicates %q, notified %q, want only the duplicate", duplicates, fx.log.notified)
+	}
+	if !reflect.DeepEqual(fx.log.clipboard, []string{url}) {
+		t.Errorf("copied %q, want %s", fx.log.clipboard, url)
+	}
+}
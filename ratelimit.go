@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rateLimiter is a token bucket shared by every upload, so the limit holds
+// for all of them together. It holds up to a second's worth of tokens.
+type rateLimiter struct {
+	// rate is in bytes per second, 0 for unlimited. It's read without the
+	// lock so unlimited uploads don't pay for it.
+	rate int64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// uploadLimiter throttles every upload, reloading settings changes its rate
+var uploadLimiter = &rateLimiter{}
+
+// setRate changes the limit to rate bytes per second, 0 for unlimited
+func (l *rateLimiter) setRate(rate int64) {
+	atomic.StoreInt64(&l.rate, rate)
+}
+
+// wait takes n tokens from the bucket, sleeping until they would have been
+// there when it runs short
+func (l *rateLimiter) wait(n int) {
+	rate := atomic.LoadInt64(&l.rate)
+	if rate <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * float64(rate)
+	}
+	if l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / float64(rate) * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+// limitedChunk is the most read at once through a limitedReader, so
+// throttled uploads go out steadily rather than in bursts
+const limitedChunk = 32 * 1024
+
+// limitedReader reads through a rateLimiter
+type limitedReader struct {
+	r io.Reader
+	l *rateLimiter
+}
+
+func (lr limitedReader) Read(p []byte) (int, error) {
+	if len(p) > limitedChunk && atomic.LoadInt64(&lr.l.rate) > 0 {
+		p = p[:limitedChunk]
+	}
+	n, err := lr.r.Read(p)
+	lr.l.wait(n)
+	return n, err
+}
+
+// parseRate parses a rate like "500K" or "2M" in bytes per second, see
+// parseSize. An empty string or "0" is unlimited.
+func parseRate(s string) (int64, error) {
+	n, err := parseSize(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q, expected bytes per second like 500K or 2M", s)
+	}
+	return n, nil
+}
+
+// parseSize parses a size like "500K" or "2M" in bytes, with K, M and G
+// meaning multiples of 1024. An empty string is 0.
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	number := s
+	if multiplier > 1 {
+		number = s[:len(s)-1]
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q, expected bytes like 500K or 2M", s)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// formatSize writes n bytes the way parseSize reads them, rounded
+func formatSize(n uint64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fG", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fM", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fK", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d", n)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// BenchmarkLimitedReader compares reading through limitedReader without a
+// limit, with one too high to ever wait, which costs the lock and the
+// smaller reads, and with one it's held to
+func BenchmarkLimitedReader(b *testing.B) {
+	data := bytes.Repeat([]byte("skrins!"), 1<<20/7)
+	for _, bm := range []struct {
+		name string
+		rate int64
+	}{
+		{"unlimited", 0},
+		{"above", 1 << 40},
+		{"64M", 64 << 20},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			l := &rateLimiter{}
+			l.setRate(bm.rate)
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := io.Copy(ioutil.Discard, limitedReader{bytes.NewReader(data), l}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// defaultSSHPort is used when -r doesn't name a port
+const defaultSSHPort = "22"
+
+// remoteHostForms is shown whenever -r can't be understood
+const remoteHostForms = "example.com, example.com:2222, 192.0.2.1:22, [2001:db8::1]:2222 or ssh://user@example.com:2222"
+
+// parseRemoteHost turns the many ways of writing -r into a host:port
+// suitable for net.Dial. A user name is only returned for ssh:// URLs.
+func parseRemoteHost(s string) (hostport, user string, err error) {
+	s = strings.TrimSpace(s)
+	invalid := func(reason string) error {
+		return fmt.Errorf("remote host %q %s, use %s", s, reason, remoteHostForms)
+	}
+
+	if strings.Contains(s, "://") {
+		u, err := url.Parse(s)
+		if err != nil {
+			return "", "", invalid("is not a valid URL")
+		}
+		if u.Scheme != "ssh" {
+			return "", "", invalid("has scheme " + u.Scheme + " instead of ssh")
+		}
+		if u.Path != "" && u.Path != "/" {
+			return "", "", invalid("has a path, set the remote directory with -rp")
+		}
+		if u.User != nil {
+			user = u.User.Username()
+		}
+		s = u.Host
+	}
+
+	if s == "" {
+		return "", "", invalid("has no host")
+	}
+
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		// no port, which is fine, but a bare IPv6 address also ends up here
+		host, port = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"), defaultSSHPort
+		if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+			return "", "", invalid("is not a host, host:port or IPv6 address")
+		}
+	}
+	if host == "" {
+		return "", "", invalid("has no host")
+	}
+	if port == "" {
+		port = defaultSSHPort
+	}
+	if n, err := net.LookupPort("tcp", port); err != nil || n <= 0 {
+		return "", "", invalid("has an invalid port")
+	}
+
+	return net.JoinHostPort(host, port), user, nil
+}
+
+// normalizeHost rewrites p.RemoteHost to host:port. A user from an ssh://
+// URL is only taken when keepUser is false.
+func (p *profile) normalizeHost(keepUser bool) error {
+	if p.RemoteHost == "" {
+		return nil
+	}
+	hostport, user, err := parseRemoteHost(p.RemoteHost)
+	if err != nil {
+		return err
+	}
+	p.RemoteHost = hostport
+	if user != "" && !keepUser {
+		p.RemoteUser = user
+	}
+	return nil
+}
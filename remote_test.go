@@ -0,0 +1,70 @@
+package main
+
+import "testing"
+
+func TestParseRemoteHost(t *testing.T) {
+	tests := []struct {
+		in       string
+		hostport string
+		user     string
+		invalid  bool
+	}{
+		{in: "example.com", hostport: "example.com:22"},
+		{in: " example.com ", hostport: "example.com:22"},
+		{in: "example.com:2222", hostport: "example.com:2222"},
+		{in: "example.com:", hostport: "example.com:22"},
+		{in: "192.0.2.1", hostport: "192.0.2.1:22"},
+		{in: "192.0.2.1:2222", hostport: "192.0.2.1:2222"},
+		{in: "2001:db8::1", hostport: "[2001:db8::1]:22"},
+		{in: "[2001:db8::1]", hostport: "[2001:db8::1]:22"},
+		{in: "[2001:db8::1]:2222", hostport: "[2001:db8::1]:2222"},
+		{in: "ssh://example.com", hostport: "example.com:22"},
+		{in: "ssh://example.com/", hostport: "example.com:22"},
+		{in: "ssh://alice@example.com:2222", hostport: "example.com:2222", user: "alice"},
+		{in: "ssh://alice@example.com:2222/", hostport: "example.com:2222", user: "alice"},
+		{in: "ssh://bob@[2001:db8::1]:2222", hostport: "[2001:db8::1]:2222", user: "bob"},
+
+		{in: "", invalid: true},
+		{in: "example.com:port", invalid: true},
+		{in: "example.com:99999", invalid: true},
+		{in: "a:b:c", invalid: true},
+		{in: "http://example.com", invalid: true},
+		{in: "ssh://", invalid: true},
+		{in: "ssh://example.com/srv/i", invalid: true},
+		{in: ":2222", invalid: true},
+	}
+	for _, tt := range tests {
+		hostport, user, err := parseRemoteHost(tt.in)
+		if tt.invalid {
+			if err == nil {
+				t.Errorf("parseRemoteHost(%q) = %q, %q, want an error", tt.in, hostport, user)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRemoteHost(%q): %v", tt.in, err)
+			continue
+		}
+		if hostport != tt.hostport || user != tt.user {
+			t.Errorf("parseRemoteHost(%q) = %q, %q, want %q, %q", tt.in, hostport, user, tt.hostport, tt.user)
+		}
+	}
+}
+
+func TestNormalizeHost(t *testing.T) {
+	p := profile{RemoteHost: "ssh://alice@example.com:2222", RemoteUser: "flag-user"}
+	if err := p.normalizeHost(true); err != nil {
+		t.Fatal(err)
+	}
+	if p.RemoteHost != "example.com:2222" || p.RemoteUser != "flag-user" {
+		t.Errorf("with -ru: got %q as %q, want example.com:2222 as flag-user", p.RemoteHost, p.RemoteUser)
+	}
+
+	p = profile{RemoteHost: "ssh://alice@example.com:2222"}
+	if err := p.normalizeHost(false); err != nil {
+		t.Fatal(err)
+	}
+	if p.RemoteUser != "alice" {
+		t.Errorf("without -ru: user %q, want alice from the URL", p.RemoteUser)
+	}
+}
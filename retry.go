@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// retryPolicy says how often and how patiently a failed upload is tried
+// again right away, before it's tried again after retryDelay.
+type retryPolicy struct {
+	// Attempts is how many times an upload is tried in total
+	Attempts int
+	// BaseDelay is waited after the first failure, doubling after every
+	// further one up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// Retries used unless the config file sets retry_attempts,
+// retry_base_delay or retry_max_delay
+const (
+	defaultRetryAttempts  = 3
+	defaultRetryBaseDelay = time.Second
+	defaultRetryMaxDelay  = 30 * time.Second
+)
+
+// delay is how long to wait after failed attempt n, counting from 1. Half
+// of it is random so clients that failed together don't retry together.
+func (rp retryPolicy) delay(n int, random func() float64) time.Duration {
+	d := rp.BaseDelay
+	for i := 1; i < n && d < rp.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > rp.MaxDelay {
+		d = rp.MaxDelay
+	}
+	return d/2 + time.Duration(random()*float64(d/2))
+}
+
+// jitter randomizes retry delays, it's shared by the workers through
+// jitterFloat
+var jitter = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+var jitterMu sync.Mutex
+
+// jitterFloat is jitter.Float64 for several goroutines
+func jitterFloat() float64 {
+	jitterMu.Lock()
+	defer jitterMu.Unlock()
+	return jitter.Float64()
+}
+
+// retryTimer is time.After for the waits between attempts, tests swap in a
+// fake clock
+var retryTimer = time.After
+
+// uploadWithRetries is uploadToBestProfile, tried again with backoff as long
+// as it fails for reasons that may go away by themselves
+func uploadWithRetries(ctx context.Context, s *settings, fx effects, fullPath, remoteFilename string) (string, string, error) {
+	for attempt := 1; ; attempt++ {
+		url, name, err := uploadToBestProfile(ctx, s, fx, fullPath, remoteFilename)
+		if err == nil || !transient(err) || attempt >= s.Retry.Attempts {
+			return url, name, err
+		}
+		d := s.Retry.delay(attempt, jitterFloat)
+		// rate limited backends tell how long to hold off, waits longer
+		// than the retry policy allows are left for scheduleRetry
+		var limited interface{ retryAfter() time.Duration }
+		if errors.As(err, &limited) && limited.retryAfter() > d {
+			if limited.retryAfter() > s.Retry.MaxDelay {
+				return url, name, err
+			}
+			d = limited.retryAfter()
+		}
+		log.Printf("upload of %s failed (attempt %d of %d), retrying in %s: %v", fullPath, attempt, s.Retry.Attempts, d.Round(time.Millisecond), err)
+		select {
+		case <-retryTimer(d):
+		case <-ctx.Done():
+			return "", name, ctx.Err()
+		}
+	}
+}
+
+// transient tells whether err came from the network rather than from the
+// server refusing, e.g. failed authentication or permission denied, which
+// trying again won't fix
+func transient(err error) bool {
+	var timeout *timeoutError
+	if errors.As(err, &timeout) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	// backends tell about their own errors, e.g. a busy server
+	var temp interface{ temporary() bool }
+	if errors.As(err, &temp) {
+		return temp.temporary()
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, sftp.ErrSSHFxConnectionLost) || errors.Is(err, sftp.ErrSSHFxNoConnection)
+}
+
+// retryDelay is how long to wait before trying failed uploads again
+const retryDelay = 30 * time.Second
+
+// retries are the paths that are tried again after retryDelay
+var retries = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: map[string]bool{}}
+
+// retryable tells whether an upload that failed with err is worth trying
+// again later without anything changing, e.g. after a short write
+func retryable(err error) bool {
+	var mismatch *sizeMismatchError
+	var checksum *checksumMismatchError
+	return transient(err) || errors.As(err, &mismatch) || errors.As(err, &checksum)
+}
+
+// scheduleRetry hands path to uploadPath again after retryDelay, the file
+// that failed is still there. Each path is tried again once at a time.
+func scheduleRetry(path string) {
+	retries.Lock()
+	defer retries.Unlock()
+	if retries.paths[path] {
+		return
+	}
+	retries.paths[path] = true
+	log.Printf("trying %s again in %s", path, retryDelay)
+	time.AfterFunc(retryDelay, func() {
+		retries.Lock()
+		delete(retries.paths, path)
+		retries.Unlock()
+		settledEvents.add(path, currentSettings().Debounce)
+	})
+}
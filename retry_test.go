@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+func TestRetryDelayDoubles(t *testing.T) {
+	rp := retryPolicy{Attempts: 10, BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, w := range want {
+		n := i + 1
+		// the random half is all there with 1 and none of it with 0
+		if got := rp.delay(n, func() float64 { return 1 }); got != w {
+			t.Errorf("delay(%d) at most = %s, want %s", n, got, w)
+		}
+		if got := rp.delay(n, func() float64 { return 0 }); got != w/2 {
+			t.Errorf("delay(%d) at least = %s, want %s", n, got, w/2)
+		}
+	}
+}
+
+func TestRetryDelayCap(t *testing.T) {
+	rp := retryPolicy{BaseDelay: time.Second, MaxDelay: 30 * time.Second}
+	for _, n := range []int{6, 10, 64, 1000} {
+		if got := rp.delay(n, func() float64 { return 1 }); got != rp.MaxDelay {
+			t.Errorf("delay(%d) = %s, want the cap %s", n, got, rp.MaxDelay)
+		}
+	}
+	// a base delay above the cap is cut down to it
+	rp = retryPolicy{BaseDelay: time.Minute, MaxDelay: 30 * time.Second}
+	if got := rp.delay(1, func() float64 { return 1 }); got != rp.MaxDelay {
+		t.Errorf("delay(1) with base over the cap = %s, want %s", got, rp.MaxDelay)
+	}
+}
+
+func TestRetryDelayJitter(t *testing.T) {
+	rp := retryPolicy{BaseDelay: time.Second, MaxDelay: 30 * time.Second}
+	for n := 1; n <= 6; n++ {
+		full := rp.delay(n, func() float64 { return 1 })
+		seen := map[time.Duration]bool{}
+		for i := 0; i < 200; i++ {
+			d := rp.delay(n, jitterFloat)
+			if d < full/2 || d > full {
+				t.Fatalf("delay(%d) = %s, want between %s and %s", n, d, full/2, full)
+			}
+			seen[d] = true
+		}
+		if len(seen) < 2 {
+			t.Errorf("delay(%d) is always %v, want it random", n, seen)
+		}
+	}
+}
+
+// errTemporary is a backend error that tells whether it's temporary
+type errTemporary bool
+
+func (e errTemporary) Error() string   { return fmt.Sprintf("temporary: %t", bool(e)) }
+func (e errTemporary) temporary() bool { return bool(e) }
+
+func TestTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"timeout", &timeoutError{Op: "write", Host: "example.com:22", After: time.Minute}, true},
+		{"wrapped timeout", fmt.Errorf("upload: %w", &timeoutError{Op: "dial"}), true},
+		{"net error", &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}, true},
+		{"dns error", &net.DNSError{Err: "no such host", Name: "example.com"}, true},
+		{"eof", io.EOF, true},
+		{"unexpected eof", fmt.Errorf("copy: %w", io.ErrUnexpectedEOF), true},
+		{"sftp connection lost", sftp.ErrSSHFxConnectionLost, true},
+		{"sftp no connection", sftp.ErrSSHFxNoConnection, true},
+		{"temporary backend error", errTemporary(true), true},
+		{"permanent backend error", errTemporary(false), false},
+		{"b2 busy", &b2Error{Status: http.StatusServiceUnavailable}, true},
+		{"b2 rate limited", &b2Error{Status: http.StatusTooManyRequests}, true},
+		{"b2 bad key", &b2Error{Status: http.StatusUnauthorized, Code: "unauthorized"}, false},
+		{"ftp 4xx", &ftpError{Cmd: "STOR", Code: 451, Msg: "local error"}, true},
+		{"ftp 5xx", &ftpError{Cmd: "STOR", Code: 553, Msg: "not allowed"}, false},
+		{"permission denied", sftp.ErrSSHFxPermissionDenied, false},
+		{"os permission", &os.PathError{Op: "open", Path: "/srv/i", Err: os.ErrPermission}, false},
+		{"auth failed", errors.New("ssh: handshake failed: ssh: unable to authenticate"), false},
+		{"size mismatch", &sizeMismatchError{Name: "a.png", Got: 10, Local: 20}, false},
+	}
+	for _, tt := range tests {
+		if got := transient(tt.err); got != tt.want {
+			t.Errorf("%s: transient(%v) = %t, want %t", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	if !retryable(&sizeMismatchError{Name: "a.png", Got: 10, Local: 20}) {
+		t.Error("a short write isn't retried later")
+	}
+	if !retryable(&checksumMismatchError{Name: "a.png", Got: "ab", Local: "cd"}) {
+		t.Error("a checksum mismatch isn't retried later")
+	}
+	if retryable(sftp.ErrSSHFxPermissionDenied) {
+		t.Error("permission denied is retried later")
+	}
+}
+
+// fakeClock replaces retryTimer for a test, the waits are recorded and
+// over right away
+func fakeClock(t *testing.T) *[]time.Duration {
+	var waited []time.Duration
+	t.Cleanup(func() { retryTimer = time.After })
+	retryTimer = func(d time.Duration) <-chan time.Time {
+		waited = append(waited, d)
+		c := make(chan time.Time, 1)
+		c <- time.Time{}
+		return c
+	}
+	return &waited
+}
+
+// retryFile is a local file for uploadWithRetries to upload
+func retryFile(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "skrins-retry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "shot.png")
+	if err := ioutil.WriteFile(path, []byte("png"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// retrySettings retries attempts times from a 1s delay up to 4s, with a
+// backend that's never asked about extensions or names
+func retrySettings(attempts int) *settings {
+	return &settings{
+		Profile:     profile{Backend: backendLocal},
+		Naming:      namingRandom,
+		NoNameCheck: true,
+		Retry:       retryPolicy{Attempts: attempts, BaseDelay: time.Second, MaxDelay: 4 * time.Second},
+	}
+}
+
+var errConnReset = &net.OpError{Op: "write", Net: "tcp", Err: errors.New("connection reset by peer")}
+
+func TestUploadWithRetriesRecovers(t *testing.T) {
+	waited := fakeClock(t)
+	up := &fakeUploader{errs: []error{errConnReset, errConnReset}}
+	url, _, err := uploadWithRetries(context.Background(), retrySettings(3), fakeEffects{up: up}, retryFile(t), "abc.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "https://fake.example/abc.png" {
+		t.Errorf("url = %q", url)
+	}
+	if up.calls != 3 {
+		t.Errorf("%d attempts, want 3", up.calls)
+	}
+	if len(*waited) != 2 {
+		t.Fatalf("waited %v, want twice", *waited)
+	}
+	if w := (*waited)[0]; w < 500*time.Millisecond || w > time.Second {
+		t.Errorf("first wait %s, want between 500ms and 1s", w)
+	}
+	if w := (*waited)[1]; w < time.Second || w > 2*time.Second {
+		t.Errorf("second wait %s, want between 1s and 2s", w)
+	}
+}
+
+func TestUploadWithRetriesGivesUp(t *testing.T) {
+	waited := fakeClock(t)
+	up := &fakeUploader{errs: []error{errConnReset, errConnReset, errConnReset, errConnReset, errConnReset}}
+	_, _, err := uploadWithRetries(context.Background(), retrySettings(4), fakeEffects{up: up}, retryFile(t), "abc.png")
+	if !errors.Is(err, errConnReset) {
+		t.Fatalf("err = %v, want the last connection error", err)
+	}
+	if up.calls != 4 {
+		t.Errorf("%d attempts, want retry_attempts = 4", up.calls)
+	}
+	if len(*waited) != 3 {
+		t.Errorf("waited %v, want 3 times", *waited)
+	}
+	for i, w := range *waited {
+		if max := retrySettings(4).Retry.MaxDelay; w > max {
+			t.Errorf("wait %d is %s, over retry_max_delay %s", i, w, max)
+		}
+	}
+}
+
+func TestUploadWithRetriesPermanent(t *testing.T) {
+	waited := fakeClock(t)
+	up := &fakeUploader{errs: []error{sftp.ErrSSHFxPermissionDenied}}
+	_, _, err := uploadWithRetries(context.Background(), retrySettings(5), fakeEffects{up: up}, retryFile(t), "abc.png")
+	if !errors.Is(err, sftp.ErrSSHFxPermissionDenied) {
+		t.Fatalf("err = %v, want permission denied", err)
+	}
+	if up.calls != 1 || len(*waited) != 0 {
+		t.Errorf("%d attempts and waits %v, want one attempt and none", up.calls, *waited)
+	}
+}
+
+func TestUploadWithRetriesRetryAfter(t *testing.T) {
+	waited := fakeClock(t)
+	// a backend asking for 3s, more than the policy's 1s but within its 4s
+	up := &fakeUploader{errs: []error{&b2Error{Status: http.StatusTooManyRequests, Wait: 3 * time.Second}}}
+	if _, _, err := uploadWithRetries(context.Background(), retrySettings(3), fakeEffects{up: up}, retryFile(t), "abc.png"); err != nil {
+		t.Fatal(err)
+	}
+	if len(*waited) != 1 || (*waited)[0] != 3*time.Second {
+		t.Errorf("waited %v, want the 3s the backend asked for", *waited)
+	}
+
+	// and one asking for longer than retry_max_delay is left for later
+	*waited = nil
+	up = &fakeUploader{errs: []error{&b2Error{Status: http.StatusTooManyRequests, Wait: time.Minute}}}
+	if _, _, err := uploadWithRetries(context.Background(), retrySettings(3), fakeEffects{up: up}, retryFile(t), "abc.png"); err == nil {
+		t.Fatal("uploaded although the backend asked to wait a minute")
+	}
+	if up.calls != 1 || len(*waited) != 0 {
+		t.Errorf("%d attempts and waits %v, want one attempt and none", up.calls, *waited)
+	}
+}
+
+func TestUploadWithRetriesCanceled(t *testing.T) {
+	t.Cleanup(func() { retryTimer = time.After })
+	ctx, cancel := context.WithCancel(context.Background())
+	retryTimer = func(d time.Duration) <-chan time.Time {
+		// the clock never gets there, canceling ends the wait
+		cancel()
+		return make(chan time.Time)
+	}
+	up := &fakeUploader{errs: []error{errConnReset, errConnReset}}
+	if _, _, err := uploadWithRetries(ctx, retrySettings(3), fakeEffects{up: up}, retryFile(t), "abc.png"); !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+	if up.calls != 1 {
+		t.Errorf("%d attempts, want 1 before the cancel", up.calls)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// What happens to a screenshot path that doesn't exist, at startup or
+// because it was deleted while running: missingPathFail refuses to start
+// and waits for one deleted later, missingPathWait waits either way and
+// missingPathCreate creates it
+const (
+	missingPathFail   = "fail"
+	missingPathWait   = "wait"
+	missingPathCreate = "create"
+)
+
+// defaultMissingPathAlert is how long a screenshot path may be gone before
+// the user's told, unless the config file sets missing_path_alert
+const defaultMissingPathAlert = time.Minute
+
+// rootCheckInterval is how often the screenshot paths are checked for
+// having been deleted or replaced. Watches go with the directory, not its
+// name, and some platforms don't report the directory itself going away.
+const rootCheckInterval = 2 * time.Second
+
+// roots are the screenshot paths as they were when their watch was added,
+// and since when those that are gone have been missing
+var roots = struct {
+	sync.Mutex
+	watched map[string]os.FileInfo
+	missing map[string]time.Time
+	alerted map[string]bool
+}{watched: map[string]os.FileInfo{}, missing: map[string]time.Time{}, alerted: map[string]bool{}}
+
+// watchRoot watches the screenshot path dir with fsnotify or by polling.
+// A dir that doesn't exist is created or waited for, as missing_path says.
+func watchRoot(dir string, s *settings) error {
+	fi, err := os.Stat(dir)
+	if os.IsNotExist(err) && s.MissingPath == missingPathCreate && !s.DryRun {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		log.Printf("created %s", dir)
+		fi, err = os.Stat(dir)
+	}
+	if os.IsNotExist(err) && s.MissingPath != missingPathFail {
+		if markMissing(dir).IsZero() {
+			log.Printf("%s doesn't exist, watching it once it does", dir)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if why, ok := s.polls(dir); ok {
+		if !polling(dir) {
+			log.Printf("watching %s by listing it every %s, %s", dir, s.PollInterval, why)
+		}
+		addPoll(dir, s)
+	} else {
+		watched := watching(dir)
+		if err := watchTree(dir, s); err != nil {
+			return err
+		}
+		if !watched {
+			log.Printf("watching %s with %s", dir, eventSource())
+		}
+	}
+	roots.Lock()
+	roots.watched[dir] = fi
+	delete(roots.missing, dir)
+	delete(roots.alerted, dir)
+	roots.Unlock()
+	return nil
+}
+
+// markMissing records that dir is gone and returns since when it was
+// already, the zero time if it wasn't
+func markMissing(dir string) time.Time {
+	roots.Lock()
+	defer roots.Unlock()
+	delete(roots.watched, dir)
+	since, ok := roots.missing[dir]
+	if !ok {
+		roots.missing[dir] = time.Now()
+	}
+	return since
+}
+
+// checkRoots watches the screenshot paths again that were deleted and
+// came back or were replaced by another directory, and tells the user
+// about those missing for longer than missing_path_alert
+func checkRoots() {
+	for {
+		time.Sleep(rootCheckInterval)
+		s := currentSettings()
+		for _, dir := range s.ScreensPaths {
+			checkRoot(dir, s)
+		}
+	}
+}
+
+// checkRoot checks one screenshot path, see checkRoots
+func checkRoot(dir string, s *settings) {
+	fi, err := os.Stat(dir)
+	roots.Lock()
+	was, ok := roots.watched[dir]
+	roots.Unlock()
+	// inode numbers are reused, a directory recreated right away may look
+	// the same but lost its watch with the old one
+	if err == nil && fi.IsDir() && ok && os.SameFile(was, fi) && (watching(dir) || polling(dir)) {
+		return
+	}
+	// an event may have told about this already, or never will
+	unwatchTree(dir)
+	removePoll(dir)
+	if missing := err != nil || !fi.IsDir(); missing && !(os.IsNotExist(err) && s.MissingPath == missingPathCreate && !s.DryRun) {
+		since := markMissing(dir)
+		if since.IsZero() {
+			log.Printf("%s is gone, watching it again once it's back", dir)
+		}
+		if !since.IsZero() && time.Since(since) >= s.MissingPathAlert {
+			roots.Lock()
+			alerted := roots.alerted[dir]
+			roots.alerted[dir] = true
+			roots.Unlock()
+			if !alerted {
+				log.Printf("%s has been gone for %s", dir, time.Since(since).Round(time.Second))
+				showMissingPathNotification(dir)
+			}
+		}
+		return
+	}
+	if err := watchRoot(dir, s); err != nil {
+		log.Printf("%s is back, but %v", dir, err)
+		return
+	}
+	log.Printf("%s is back, watching it again", dir)
+	// files may have been saved before the watch was added
+	settledEvents.add(dir, s.Debounce)
+}
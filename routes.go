@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// categories groups extensions so routes can refer to them by name
+var categories = map[string][]string{
+	"image":   {"jpg", "jpeg", "png", "gif"},
+	"video":   {"webm", "mp4", "mov"},
+	"archive": {"zip", "tar", "tar.gz", "tar.bz2"},
+}
+
+// route sends files of a category, or with one of the listed extensions, to
+// their own remote directory and base URL, e.g.
+//
+//	[[routes]]
+//	category    = "video"
+//	remote_path = "/var/www/v/"
+//	base_url    = "https://v.example.com/"
+//
+// Empty fields fall back to the profile's remote_path and base_url.
+type route struct {
+	Category   string   `toml:"category"`
+	Extensions []string `toml:"extensions"`
+	RemotePath string   `toml:"remote_path"`
+	BaseURL    string   `toml:"base_url"`
+}
+
+// destination is where a single file ends up: a remote directory and the
+// base URL that directory is served from. Both have a trailing slash.
+type destination struct {
+	RemotePath string
+	BaseURL    string
+}
+
+// matches tells whether files with extension ext take this route
+func (r route) matches(ext string) bool {
+	for _, e := range r.Extensions {
+		if strings.EqualFold(e, ext) {
+			return true
+		}
+	}
+	for _, e := range categories[r.Category] {
+		if strings.EqualFold(e, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// destinationFor picks where a file with extension ext should go. The first
+// matching route wins, files no route matches go to the profile's defaults.
+func (p profile) destinationFor(ext string) destination {
+	d := destination{RemotePath: p.RemotePath, BaseURL: p.BaseURL}
+	for _, r := range p.Routes {
+		if !r.matches(ext) {
+			continue
+		}
+		if r.RemotePath != "" {
+			d.RemotePath = r.RemotePath
+		}
+		if r.BaseURL != "" {
+			d.BaseURL = r.BaseURL
+		}
+		break
+	}
+	return d
+}
+
+// routeProblems reports routes that can never match or don't change anything.
+func routeProblems(routes []route) []string {
+	var problems []string
+	for i, r := range routes {
+		if r.Category == "" && len(r.Extensions) == 0 {
+			problems = append(problems, fmt.Sprintf("route %d needs a category or extensions", i+1))
+		}
+		if _, ok := categories[r.Category]; r.Category != "" && !ok {
+			problems = append(problems, fmt.Sprintf("route %d: unknown category %q, use image, video or archive", i+1, r.Category))
+		}
+		if r.RemotePath == "" && r.BaseURL == "" {
+			problems = append(problems, fmt.Sprintf("route %d needs a remote_path or base_url", i+1))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// rsyncUploader copies files with the rsync binary over the system's ssh.
+// Interrupted copies are kept and continued by the next attempt, which
+// uses the remote name of the first one.
+type rsyncUploader struct {
+	p    profile
+	opts uploadOptions
+}
+
+// rsyncBinary is the rsync to run
+func (p profile) rsyncBinary() string {
+	if p.RsyncPath == "" {
+		return "rsync"
+	}
+	return p.RsyncPath
+}
+
+// rsyncProblems checks the settings of an rsync profile
+func rsyncProblems(p profile) []string {
+	var problems []string
+	if _, err := exec.LookPath(p.rsyncBinary()); err != nil {
+		problems = append(problems, fmt.Sprintf("rsync_path: %v", err))
+	}
+	if _, err := exec.LookPath("ssh"); err != nil {
+		problems = append(problems, fmt.Sprintf("the rsync backend needs ssh: %v", err))
+	}
+	return problems
+}
+
+// rsyncExitCodes explain rsync's exit codes, see EXIT VALUES in rsync(1)
+var rsyncExitCodes = map[int]string{
+	1:   "syntax or usage error",
+	2:   "protocol incompatibility",
+	3:   "errors selecting input/output files, dirs",
+	4:   "requested action not supported",
+	5:   "error starting client-server protocol",
+	10:  "error in socket I/O",
+	11:  "error in file I/O",
+	12:  "error in rsync protocol data stream",
+	13:  "errors with program diagnostics",
+	14:  "error in IPC code",
+	20:  "received SIGUSR1 or SIGINT",
+	23:  "partial transfer due to error",
+	24:  "partial transfer due to vanished source files",
+	30:  "timeout in data send/receive",
+	35:  "timeout waiting for daemon connection",
+	255: "ssh failed",
+}
+
+// rsyncError is a failed rsync run. Message is the last thing it said.
+type rsyncError struct {
+	Code    int
+	Message string
+}
+
+func (e *rsyncError) Error() string {
+	msg := rsyncExitCodes[e.Code]
+	if msg == "" {
+		msg = "failed"
+	}
+	msg = fmt.Sprintf("rsync: %s (code %d)", msg, e.Code)
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// temporary tells whether trying again may help: the connection broke or
+// timed out, which --partial makes cheap to continue
+func (e *rsyncError) temporary() bool {
+	switch e.Code {
+	case 10, 12, 30, 35:
+		return true
+	case 255:
+		// ssh says why, a refused key won't work next time either
+		return !strings.Contains(e.Message, "Permission denied") && !strings.Contains(e.Message, "Host key verification failed")
+	}
+	return false
+}
+
+// sshCommand is the remote shell rsync runs, as the string for -e. rsync
+// splits it at spaces, outside of quotes, and takes a doubled quote inside
+// quotes for one.
+func (u rsyncUploader) sshCommand() (string, error) {
+	_, port, err := net.SplitHostPort(u.p.RemoteHost)
+	if err != nil {
+		return "", err
+	}
+	args := []string{"ssh", "-p", port, "-o", "BatchMode=yes", "-o", "ConnectTimeout=" + strconv.Itoa(int(u.p.DialTimeout.Seconds()))}
+	for _, k := range u.p.keys() {
+		key, err := expandPath(k, os.Getenv)
+		if err != nil {
+			return "", err
+		}
+		args = append(args, "-i", key)
+	}
+	if isTrue(u.p.InsecureHostKey) {
+		args = append(args, "-o", "StrictHostKeyChecking=no", "-o", "UserKnownHostsFile=/dev/null")
+	} else if u.p.KnownHosts != "" {
+		knownHosts, err := expandPath(u.p.KnownHosts, os.Getenv)
+		if err != nil {
+			return "", err
+		}
+		args = append(args, "-o", "UserKnownHostsFile="+knownHosts)
+	}
+	if u.p.Jump != "" {
+		args = append(args, "-J", u.p.Jump)
+	}
+	args = append(args, "-l", u.p.RemoteUser)
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		if strings.ContainsAny(a, ` '"`) {
+			a = "'" + strings.Replace(a, "'", "''", -1) + "'"
+		}
+		quoted[i] = a
+	}
+	return strings.Join(quoted, " "), nil
+}
+
+// args are the arguments of rsync copying localPath to dest on the server.
+// -s hands file names to the remote rsync as they are, without the remote
+// shell splitting or expanding them.
+func (u rsyncUploader) args(localPath, dest string) ([]string, error) {
+	shell, err := u.sshCommand()
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"--partial", "--inplace", "-s", "-t", "-e", shell}
+	if stall := int(u.p.StallTimeout.Seconds()); stall > 0 {
+		args = append(args, "--timeout="+strconv.Itoa(stall))
+	}
+	if rate := atomic.LoadInt64(&uploadLimiter.rate); rate > 0 {
+		// in units of 1024 bytes per second
+		args = append(args, "--bwlimit="+strconv.FormatInt(max64(rate/1024, 1), 10))
+	}
+	if m := u.p.fileMode(); m != 0 {
+		args = append(args, fmt.Sprintf("--chmod=F%o", m))
+	}
+	if dir := dest[:strings.LastIndex(dest, "/")+1]; u.opts.Mkdirs && dir != "" {
+		// runs in the remote shell, unlike the file names
+		args = append(args, "--rsync-path=mkdir -p "+shellQuote(dir)+" && rsync")
+	}
+	host, _, _ := net.SplitHostPort(u.p.RemoteHost)
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return append(args, "--", localPath, host+":"+dest), nil
+}
+
+func (u rsyncUploader) upload(ctx context.Context, localPath, remoteName string) (string, error) {
+	fi, err := os.Stat(localPath)
+	if err != nil {
+		return "", err
+	}
+	// a partial copy is continued, under the name it was started with
+	server := "rsync:" + u.p.RemoteUser + "@" + u.p.RemoteHost
+	if rp, ok := resumePointFor(localPath, fi, server); ok && remoteExtension(rp.Temp) == remoteExtension(remoteName) {
+		debugf("continuing the upload of %s as %s", localPath, rp.Temp)
+		remoteName = rp.Temp
+	} else {
+		saveResumePoint(localPath, resumePoint{Server: server, Temp: remoteName, Size: fi.Size(), ModTime: fi.ModTime()})
+	}
+	dst := u.p.destinationFor(remoteExtension(remoteName))
+	args, err := u.args(localPath, dst.RemotePath+remoteName)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, u.p.TransferTimeout.Duration)
+	defer cancel()
+	t := startTransfer(localPath, fi.Size(), 0, u.opts.Progress)
+	defer t.finish()
+	cmd := exec.CommandContext(ctx, u.p.rsyncBinary(), args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	debugf("running %s %s", u.p.rsyncBinary(), strings.Join(args, " "))
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", &timeoutError{Op: "transfer", Host: u.p.RemoteHost, After: u.p.TransferTimeout.Duration, Err: err}
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return "", &rsyncError{Code: exitErr.ExitCode(), Message: lastLine(stderr.String())}
+	}
+	if err != nil {
+		return "", err
+	}
+	clearResumePoint(localPath)
+	atomic.StoreInt64(&t.done, fi.Size())
+	log.Println(t.summary())
+	return dst.BaseURL + remoteName, nil
+}
+
+// lastLine is the last line of s that isn't empty
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// check makes sure the rsync binary runs
+func (u rsyncUploader) check(ctx context.Context) error {
+	out, err := exec.CommandContext(ctx, u.p.rsyncBinary(), "--version").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("rsync_path: %s doesn't run: %v %s", u.p.rsyncBinary(), err, lastLine(string(out)))
+	}
+	debugf("%s", strings.SplitN(string(out), "\n", 2)[0])
+	return nil
+}
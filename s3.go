@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Files of s3MultipartThreshold bytes and more are uploaded in parts of at
+// least s3PartSize, so a broken connection only costs one part. S3 allows
+// 10000 parts per upload.
+const (
+	s3MultipartThreshold = 16 << 20
+	s3PartSize           = 8 << 20
+	s3MaxParts           = 10000
+)
+
+// s3Uploader uploads to an S3 bucket on AWS or an S3-compatible service.
+// Objects are named s3_prefix followed by the remote name, and their URL is
+// base_url followed by that.
+type s3Uploader struct {
+	p    profile
+	opts uploadOptions
+}
+
+// s3Error is an error response from S3, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/ErrorResponses.html
+type s3Error struct {
+	Bucket  string
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+	Region  string `xml:"Region"`
+}
+
+func (e *s3Error) Error() string {
+	switch e.Code {
+	case "NoSuchBucket":
+		return fmt.Sprintf("S3 bucket %s doesn't exist", e.Bucket)
+	case "InvalidAccessKeyId":
+		return "AWS rejected the access key, check AWS_ACCESS_KEY_ID or ~/.aws/credentials"
+	case "SignatureDoesNotMatch":
+		return "AWS rejected the secret key, check AWS_SECRET_ACCESS_KEY or ~/.aws/credentials"
+	case "ExpiredToken", "TokenRefreshRequired":
+		return "AWS session token has expired"
+	case "AccessDenied":
+		return fmt.Sprintf("access to S3 bucket %s denied", e.Bucket)
+	case "RequestTimeTooSkewed":
+		return "S3 turned down the request time, this computer's clock is off"
+	case "BadDigest":
+		return "S3 received a different file than was sent, set s3_disable_checksum if the service doesn't check Content-MD5 correctly"
+	case "PermanentRedirect", "AuthorizationHeaderMalformed", "IllegalLocationConstraintException":
+		if e.Region != "" {
+			return fmt.Sprintf("S3 bucket %s is in region %s, set s3_region", e.Bucket, e.Region)
+		}
+		return fmt.Sprintf("S3 bucket %s is in another region, set s3_region", e.Bucket)
+	}
+	if e.Message != "" {
+		return fmt.Sprintf("S3: %s (%s)", e.Message, e.Code)
+	}
+	return fmt.Sprintf("S3 answered %d %s", e.Status, http.StatusText(e.Status))
+}
+
+// temporary tells whether trying again may help, i.e. S3 was busy
+func (e *s3Error) temporary() bool {
+	return e.Status >= 500 || e.Status == http.StatusTooManyRequests || e.Code == "SlowDown" || e.Code == "RequestTimeout" || e.Code == "BadDigest"
+}
+
+// r2Domain is where Cloudflare R2 endpoints live. R2 only takes the region
+// "auto".
+const r2Domain = ".r2.cloudflarestorage.com"
+
+// s3RegionFor is the region requests for p are signed for: s3_region, "auto"
+// on R2, the AWS region from the environment or, for other S3-compatible
+// services, us-east-1 which they usually expect
+func s3RegionFor(p profile, getenv func(string) string) string {
+	if p.S3Region != "" {
+		return p.S3Region
+	}
+	endpoint, _ := url.Parse(p.S3Endpoint)
+	if p.S3Endpoint != "" && endpoint != nil && strings.HasSuffix(endpoint.Hostname(), r2Domain) {
+		return "auto"
+	}
+	if region := awsRegion("", getenv); region != "" || p.S3Endpoint == "" {
+		return region
+	}
+	return "us-east-1"
+}
+
+// s3BucketURL is the URL of p's bucket, without a trailing slash. Without
+// s3_endpoint that's the bucket on AWS. The bucket is part of the host name
+// unless s3_path_style is set, which S3-compatible services like MinIO
+// usually need.
+func s3BucketURL(p profile, getenv func(string) string) (*url.URL, error) {
+	endpoint := p.S3Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + s3RegionFor(p, getenv) + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("s3_endpoint: %w", err)
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("s3_endpoint: %q is not an http or https URL", endpoint)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("s3_endpoint: %q can't have a query", endpoint)
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = ""
+	if p.S3PathStyle {
+		u.Path += "/" + p.S3Bucket
+	} else {
+		u.Host = p.S3Bucket + "." + u.Host
+	}
+	return u, nil
+}
+
+// s3Problems checks the settings an S3 profile needs beyond the required
+// ones, so bad settings show up at startup instead of on the first upload
+func s3Problems(p profile, getenv func(string) string) []string {
+	var problems []string
+	if s3RegionFor(p, getenv) == "" {
+		problems = append(problems, "s3_region: no region set and none in AWS_REGION or ~/.aws/config")
+	}
+	if _, err := s3BucketURL(p, getenv); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := loadAWSCredentials(getenv); err != nil {
+		problems = append(problems, err.Error())
+	}
+	return append(problems, presignProblems(p)...)
+}
+
+func (u s3Uploader) upload(ctx context.Context, localPath, remoteName string) (string, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	key := u.p.S3Prefix + remoteName
+	ctx, cancel := context.WithTimeout(ctx, u.p.TransferTimeout.Duration)
+	defer cancel()
+	t := startTransfer(localPath, fi.Size(), 0, u.opts.Progress)
+	defer t.finish()
+	ctx, stalled := watchStall(ctx, t, u.p.StallTimeout.Duration)
+
+	header := http.Header{"Content-Type": {contentType(remoteName)}}
+	if u.p.S3CacheControl != "" {
+		header.Set("Cache-Control", u.p.S3CacheControl)
+	}
+	if fi.Size() < s3MultipartThreshold {
+		err = u.checksum(header, io.NewSectionReader(f, 0, fi.Size()))
+		if err == nil {
+			body := progressTracker{limitedReader{io.NewSectionReader(f, 0, fi.Size()), uploadLimiter}, t}
+			_, err = u.do(ctx, http.MethodPut, key, nil, header, body, fi.Size())
+		}
+	} else {
+		err = u.uploadParts(ctx, key, header, f, t)
+	}
+	if stalled() {
+		return "", &timeoutError{Op: "stall", Host: u.host(), After: u.p.StallTimeout.Duration}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", &timeoutError{Op: "transfer", Host: u.host(), After: u.p.TransferTimeout.Duration, Err: err}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	log.Println(t.summary())
+	if u.p.S3Presign.Duration > 0 {
+		return u.presign(key, time.Now())
+	}
+	return u.p.destinationFor(remoteExtension(remoteName)).BaseURL + key, nil
+}
+
+// uploadParts uploads f as key with a multipart upload. A failed upload is
+// aborted so its parts don't linger, and cost, in the bucket.
+func (u s3Uploader) uploadParts(ctx context.Context, key string, header http.Header, f *os.File, t *transfer) error {
+	resp, err := u.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, header, nil, 0)
+	if err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(resp, &initiated); err != nil || initiated.UploadID == "" {
+		return fmt.Errorf("S3: can't start multipart upload: %v", err)
+	}
+	uploadID := initiated.UploadID
+
+	err = u.sendParts(ctx, key, uploadID, f, t)
+	if err != nil {
+		// the upload's context may be what failed
+		abortCtx, cancel := context.WithTimeout(context.Background(), u.p.DialTimeout.Duration)
+		defer cancel()
+		if _, abortErr := u.do(abortCtx, http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil, 0); abortErr != nil {
+			log.Printf("can't abort multipart upload of %s: %v", key, abortErr)
+		}
+	}
+	return err
+}
+
+// sendParts uploads the parts of f and completes the multipart upload
+func (u s3Uploader) sendParts(ctx context.Context, key, uploadID string, f *os.File, t *transfer) error {
+	size := t.Size
+	partSize := int64(s3PartSize)
+	if size/partSize >= s3MaxParts {
+		partSize = size/s3MaxParts + 1
+	}
+
+	type part struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	var complete struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}
+	for n, offset := 1, int64(0); offset < size; n, offset = n+1, offset+partSize {
+		length := partSize
+		if offset+length > size {
+			length = size - offset
+		}
+		query := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {uploadID}}
+		header := http.Header{}
+		if err := u.checksum(header, io.NewSectionReader(f, offset, length)); err != nil {
+			return err
+		}
+		body := progressTracker{limitedReader{io.NewSectionReader(f, offset, length), uploadLimiter}, t}
+		etag, err := u.doETag(ctx, key, query, header, body, length)
+		if err != nil {
+			return err
+		}
+		complete.Parts = append(complete.Parts, part{PartNumber: n, ETag: etag})
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	_, err = u.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, bytes.NewReader(body), int64(len(body)))
+	return err
+}
+
+// checksum sets the Content-MD5 header for body, so S3 rejects the
+// upload when it gets something else. It does nothing when
+// s3_disable_checksum is set.
+func (u s3Uploader) checksum(header http.Header, body io.Reader) error {
+	if u.p.S3DisableChecksum {
+		return nil
+	}
+	h := md5.New()
+	if _, err := io.Copy(h, body); err != nil {
+		return err
+	}
+	header.Set("Content-MD5", base64.StdEncoding.EncodeToString(h.Sum(nil)))
+	return nil
+}
+
+// doETag uploads a part and returns its ETag
+func (u s3Uploader) doETag(ctx context.Context, key string, query url.Values, header http.Header, body io.Reader, length int64) (string, error) {
+	var etag string
+	_, err := u.request(ctx, http.MethodPut, key, query, header, body, length, func(resp *http.Response) {
+		etag = resp.Header.Get("ETag")
+	})
+	return etag, err
+}
+
+func (u s3Uploader) remove(ctx context.Context, remoteName string) error {
+	_, err := u.do(ctx, http.MethodDelete, u.p.S3Prefix+remoteName, nil, nil, nil, 0)
+	return err
+}
+
+func (u s3Uploader) stat(ctx context.Context, remoteName string) (os.FileInfo, error) {
+	key := u.p.S3Prefix + remoteName
+	var fi remoteFileInfo
+	_, err := u.request(ctx, http.MethodHead, key, nil, nil, nil, 0, func(resp *http.Response) {
+		modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+		fi = remoteFileInfo{name: remoteName, size: resp.ContentLength, modTime: modTime}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fi, nil
+}
+
+// host is where requests for the bucket go
+func (u s3Uploader) host() string {
+	if bucket, err := s3BucketURL(u.p, os.Getenv); err == nil {
+		return bucket.Host
+	}
+	return u.p.S3Endpoint
+}
+
+// do sends a signed request about key and returns the response body
+func (u s3Uploader) do(ctx context.Context, method, key string, query url.Values, header http.Header, body io.Reader, length int64) ([]byte, error) {
+	return u.request(ctx, method, key, query, header, body, length, nil)
+}
+
+// request sends a signed request about key, calls onSuccess with the
+// response when there is one and returns the response body. Error bodies
+// are turned into an *s3Error.
+func (u s3Uploader) request(ctx context.Context, method, key string, query url.Values, header http.Header, body io.Reader, length int64, onSuccess func(*http.Response)) ([]byte, error) {
+	creds, err := loadAWSCredentials(os.Getenv)
+	if err != nil {
+		return nil, err
+	}
+	target, err := s3BucketURL(u.p, os.Getenv)
+	if err != nil {
+		return nil, err
+	}
+	target.Path += "/" + key
+	target.RawPath = awsEscapePath(target.Path)
+	target.RawQuery = query.Encode()
+	req, err := http.NewRequest(method, target.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.ContentLength = length
+		if length == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	signAWS(req, creds, "s3", s3RegionFor(u.p, os.Getenv), unsignedPayload, time.Now())
+
+	resp, err := httpClientFor(u.p).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	// CompleteMultipartUpload can fail after answering 200
+	if resp.StatusCode/100 != 2 || bytes.Contains(respBody, []byte("<Error>")) {
+		e := &s3Error{Bucket: u.p.S3Bucket, Status: resp.StatusCode}
+		xml.Unmarshal(respBody, e)
+		if e.Code == "" && resp.StatusCode == http.StatusNotFound && method == http.MethodHead {
+			return nil, os.ErrNotExist
+		}
+		setDefault(&e.Region, resp.Header.Get("X-Amz-Bucket-Region"))
+		return nil, e
+	}
+	if onSuccess != nil {
+		onSuccess(resp)
+	}
+	return respBody, nil
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// s3TestUploader uploads to the bucket shots on srv, path style
+func s3TestUploader(t *testing.T, srvURL string) s3Uploader {
+	setEnv(t, "AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	setEnv(t, "AWS_SECRET_ACCESS_KEY", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY")
+	setEnv(t, "AWS_SESSION_TOKEN", "")
+	p := testProfile(profile{
+		Backend:        backendS3,
+		BaseURL:        "https://cdn.example.com/",
+		S3Bucket:       "shots",
+		S3Region:       "eu-west-1",
+		S3Prefix:       "i/",
+		S3Endpoint:     srvURL,
+		S3PathStyle:    true,
+		S3CacheControl: "public, max-age=31536000",
+	})
+	return s3Uploader{p: p}
+}
+
+func TestS3Upload(t *testing.T) {
+	srv, log := recordingServer(t, func(w http.ResponseWriter, r recordedRequest) {})
+	u := s3TestUploader(t, srv.URL)
+	content := []byte("not really a png")
+	url, err := u.upload(context.Background(), uploadTestFile(t, "shot.png", content), "Zr8tW.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "https://cdn.example.com/i/Zr8tW.png" {
+		t.Errorf("url = %s, want base_url, s3_prefix and the name", url)
+	}
+
+	reqs := log.all()
+	if len(reqs) != 1 {
+		t.Fatalf("%d requests, want one PUT", len(reqs))
+	}
+	r := reqs[0]
+	if r.Method != http.MethodPut || r.Path != "/shots/i/Zr8tW.png" {
+		t.Errorf("%s %s, want PUT /shots/i/Zr8tW.png", r.Method, r.Path)
+	}
+	if !bytes.Equal(r.Body, content) {
+		t.Errorf("body %q, want the file", r.Body)
+	}
+	sum := md5.Sum(content)
+	for name, want := range map[string]string{
+		"Content-Type":         "image/png",
+		"Cache-Control":        "public, max-age=31536000",
+		"Content-Md5":          base64.StdEncoding.EncodeToString(sum[:]),
+		"X-Amz-Content-Sha256": unsignedPayload,
+	} {
+		if got := r.Header.Get(name); got != want {
+			t.Errorf("%s: %q, want %q", name, got, want)
+		}
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") || !strings.Contains(auth, "/eu-west-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=") {
+		t.Errorf("Authorization: %s", auth)
+	}
+}
+
+func TestS3Errors(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		want   string
+		temp   bool
+	}{
+		{404, "<Error><Code>NoSuchBucket</Code><Message>The specified bucket does not exist</Message></Error>", "S3 bucket shots doesn't exist", false},
+		{403, "<Error><Code>InvalidAccessKeyId</Code></Error>", "AWS rejected the access key", false},
+		{403, "<Error><Code>SignatureDoesNotMatch</Code></Error>", "AWS rejected the secret key", false},
+		{301, "<Error><Code>PermanentRedirect</Code><Region>us-west-2</Region></Error>", "is in region us-west-2, set s3_region", false},
+		{503, "<Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>", "Please reduce your request rate.", true},
+		{500, "", "S3 answered 500 Internal Server Error", true},
+	}
+	for _, tt := range tests {
+		srv, _ := recordingServer(t, func(w http.ResponseWriter, r recordedRequest) {
+			w.WriteHeader(tt.status)
+			fmt.Fprint(w, tt.body)
+		})
+		u := s3TestUploader(t, srv.URL)
+		_, err := u.upload(context.Background(), uploadTestFile(t, "shot.png", []byte("png")), "Zr8tW.png")
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%d %s: err = %v, want it to say %q", tt.status, tt.body, err, tt.want)
+			continue
+		}
+		if transient(err) != tt.temp {
+			t.Errorf("%d %s: transient = %t, want %t", tt.status, tt.body, !tt.temp, tt.temp)
+		}
+	}
+}
+
+func TestS3Multipart(t *testing.T) {
+	srv, log := recordingServer(t, func(w http.ResponseWriter, r recordedRequest) {
+		switch {
+		case r.Method == http.MethodPost && r.Query["uploads"] != nil:
+			fmt.Fprint(w, "<InitiateMultipartUploadResult><UploadId>up-1</UploadId></InitiateMultipartUploadResult>")
+		case r.Method == http.MethodPut:
+			w.Header().Set("ETag", `"etag-`+r.Query.Get("partNumber")+`"`)
+		}
+	})
+	u := s3TestUploader(t, srv.URL)
+	size := s3MultipartThreshold + 1<<20
+	content := bytes.Repeat([]byte{'x'}, size)
+	if _, err := u.upload(context.Background(), uploadTestFile(t, "rec.mp4", content), "rec.mp4"); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := log.all()
+	// start, two full parts and the rest, complete
+	if len(reqs) != 5 {
+		t.Fatalf("%d requests, want 5", len(reqs))
+	}
+	if reqs[0].Method != http.MethodPost || reqs[0].Header.Get("Content-Type") != "video/mp4" {
+		t.Errorf("start: %s with Content-Type %q", reqs[0].Method, reqs[0].Header.Get("Content-Type"))
+	}
+	total := 0
+	for i, r := range reqs[1:4] {
+		if r.Query.Get("partNumber") != fmt.Sprint(i+1) || r.Query.Get("uploadId") != "up-1" {
+			t.Errorf("part %d: query %v", i+1, r.Query)
+		}
+		if i < 2 && len(r.Body) != s3PartSize {
+			t.Errorf("part %d has %d bytes, want %d", i+1, len(r.Body), s3PartSize)
+		}
+		total += len(r.Body)
+	}
+	if total != size {
+		t.Errorf("parts have %d bytes, want %d", total, size)
+	}
+	var complete struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	last := reqs[4]
+	if err := xml.Unmarshal(last.Body, &complete); err != nil || last.Query.Get("uploadId") != "up-1" {
+		t.Fatalf("complete: %v, query %v", err, last.Query)
+	}
+	if len(complete.Parts) != 3 || complete.Parts[2].PartNumber != 3 || complete.Parts[2].ETag != `"etag-3"` {
+		t.Errorf("completed with %+v", complete.Parts)
+	}
+}
+
+func TestS3MultipartAborted(t *testing.T) {
+	srv, log := recordingServer(t, func(w http.ResponseWriter, r recordedRequest) {
+		switch {
+		case r.Method == http.MethodPost:
+			fmt.Fprint(w, "<InitiateMultipartUploadResult><UploadId>up-1</UploadId></InitiateMultipartUploadResult>")
+		case r.Method == http.MethodPut && r.Query.Get("partNumber") == "2":
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, "<Error><Code>AccessDenied</Code></Error>")
+		}
+	})
+	u := s3TestUploader(t, srv.URL)
+	content := bytes.Repeat([]byte{'x'}, s3MultipartThreshold)
+	if _, err := u.upload(context.Background(), uploadTestFile(t, "rec.mp4", content), "rec.mp4"); err == nil {
+		t.Fatal("uploaded although a part was turned down")
+	}
+	reqs := log.all()
+	last := reqs[len(reqs)-1]
+	if last.Method != http.MethodDelete || last.Query.Get("uploadId") != "up-1" {
+		t.Errorf("last request %s %v, want the upload aborted", last.Method, last.Query)
+	}
+}
+
+func TestS3Stat(t *testing.T) {
+	srv, _ := recordingServer(t, func(w http.ResponseWriter, r recordedRequest) {
+		if r.Path != "/shots/i/taken.png" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", "1234")
+	})
+	u := s3TestUploader(t, srv.URL)
+	if _, err := u.stat(context.Background(), "free.png"); !os.IsNotExist(err) {
+		t.Errorf("free.png: %v, want it not to exist", err)
+	}
+	fi, err := u.stat(context.Background(), "taken.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 1234 {
+		t.Errorf("taken.png has %d bytes, want 1234", fi.Size())
+	}
+}
+
+func TestS3BucketURL(t *testing.T) {
+	tests := []struct {
+		name string
+		p    profile
+		want string // the error when it starts with s3_endpoint
+	}{
+		{"aws", profile{S3Bucket: "shots", S3Region: "eu-west-1"}, "https://shots.s3.eu-west-1.amazonaws.com"},
+		{"aws path style", profile{S3Bucket: "shots", S3Region: "eu-west-1", S3PathStyle: true}, "https://s3.eu-west-1.amazonaws.com/shots"},
+		{"minio", profile{S3Bucket: "shots", S3Endpoint: "http://nas.lan:9000", S3PathStyle: true}, "http://nas.lan:9000/shots"},
+		{"trailing slash", profile{S3Bucket: "shots", S3Endpoint: "http://nas.lan:9000/", S3PathStyle: true}, "http://nas.lan:9000/shots"},
+		{"below a path", profile{S3Bucket: "shots", S3Endpoint: "https://nas.lan/s3//", S3PathStyle: true}, "https://nas.lan/s3/shots"},
+		{"r2", profile{S3Bucket: "shots", S3Endpoint: "https://acc.r2.cloudflarestorage.com"}, "https://shots.acc.r2.cloudflarestorage.com"},
+		{"no scheme", profile{S3Bucket: "shots", S3Endpoint: "nas.lan:9000"}, "s3_endpoint: "},
+		{"ftp", profile{S3Bucket: "shots", S3Endpoint: "ftp://nas.lan"}, `s3_endpoint: "ftp://nas.lan" is not an http or https URL`},
+		{"query", profile{S3Bucket: "shots", S3Endpoint: "https://nas.lan/?x=1"}, `s3_endpoint: "https://nas.lan/?x=1" can't have a query`},
+	}
+	for _, tt := range tests {
+		u, err := s3BucketURL(tt.p, fakeEnv(nil))
+		if strings.HasPrefix(tt.want, "s3_endpoint") {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+				t.Errorf("%s: err = %v, want %s", tt.name, err, tt.want)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if u.String() != tt.want {
+			t.Errorf("%s: %s, want %s", tt.name, u, tt.want)
+		}
+	}
+}
+
+func TestS3RegionFor(t *testing.T) {
+	tests := []struct {
+		name string
+		p    profile
+		env  map[string]string
+		want string
+	}{
+		{"set", profile{S3Region: "eu-west-1", S3Endpoint: "https://acc.r2.cloudflarestorage.com"}, nil, "eu-west-1"},
+		{"r2", profile{S3Endpoint: "https://acc.r2.cloudflarestorage.com"}, map[string]string{"AWS_REGION": "eu-west-1"}, "auto"},
+		{"environment", profile{}, map[string]string{"AWS_REGION": "ap-south-1"}, "ap-south-1"},
+		{"custom endpoint", profile{S3Endpoint: "http://nas.lan:9000"}, nil, "us-east-1"},
+		{"custom endpoint and environment", profile{S3Endpoint: "http://nas.lan:9000"}, map[string]string{"AWS_REGION": "eu-west-1"}, "eu-west-1"},
+		{"nothing", profile{}, map[string]string{"HOME": "/nonexistent"}, ""},
+	}
+	for _, tt := range tests {
+		if got := s3RegionFor(tt.p, fakeEnv(tt.env)); got != tt.want {
+			t.Errorf("%s: region %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestS3CompatibleUpload(t *testing.T) {
+	srv, log := recordingServer(t, func(w http.ResponseWriter, r recordedRequest) {})
+	u := s3TestUploader(t, srv.URL)
+	u.p.S3Region = "auto"
+	u.p.S3DisableChecksum = true
+	url, err := u.upload(context.Background(), uploadTestFile(t, "shot.png", []byte("png")), "Zr8tW.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the URL is the public one, whatever the endpoint
+	if url != "https://cdn.example.com/i/Zr8tW.png" {
+		t.Errorf("url = %s", url)
+	}
+	r := log.all()[0]
+	if _, ok := r.Header["Content-Md5"]; ok {
+		t.Error("Content-MD5 sent with s3_disable_checksum")
+	}
+	if auth := r.Header.Get("Authorization"); !strings.Contains(auth, "/auto/s3/aws4_request") {
+		t.Errorf("Authorization %s isn't scoped to region auto", auth)
+	}
+}
+
+func TestS3DefaultBaseURL(t *testing.T) {
+	p := testProfile(profile{Backend: backendS3, S3Bucket: "shots", S3Endpoint: "http://nas.lan:9000", S3PathStyle: true, S3Prefix: "i/"})
+	if got := p.destinationFor("png").BaseURL + p.S3Prefix + "a.png"; got != "http://nas.lan:9000/shots/i/a.png" {
+		t.Errorf("without base_url the URL is %s, want the bucket's", got)
+	}
+}
+
+// awsTestEnv is a getenv with credentials and no AWS config files
+func awsTestEnv(t *testing.T, env map[string]string) func(string) string {
+	dir, err := ioutil.TempDir("", "skrins-aws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	all := map[string]string{
+		"AWS_ACCESS_KEY_ID":           "AKIDEXAMPLE",
+		"AWS_SECRET_ACCESS_KEY":       "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		"AWS_CONFIG_FILE":             filepath.Join(dir, "config"),
+		"AWS_SHARED_CREDENTIALS_FILE": filepath.Join(dir, "credentials"),
+	}
+	for name, value := range env {
+		all[name] = value
+	}
+	return fakeEnv(all)
+}
+
+func TestS3Problems(t *testing.T) {
+	p := profile{Backend: backendS3, S3Bucket: "shots", S3Region: "eu-west-1"}
+	if problems := s3Problems(p, awsTestEnv(t, nil)); len(problems) != 0 {
+		t.Errorf("with a region and credentials: %q", problems)
+	}
+	p.S3Region = ""
+	if problems := s3Problems(p, awsTestEnv(t, nil)); len(problems) != 1 || !strings.HasPrefix(problems[0], "s3_region") {
+		t.Errorf("without a region: %q", problems)
+	}
+}
+
+func TestS3ErrorMessages(t *testing.T) {
+	tests := []struct {
+		err       *s3Error
+		want      string
+		temporary bool
+	}{
+		{&s3Error{Bucket: "shots", Status: 404, Code: "NoSuchBucket"}, "S3 bucket shots doesn't exist", false},
+		{&s3Error{Bucket: "shots", Status: 403, Code: "AccessDenied"}, "access to S3 bucket shots denied", false},
+		{&s3Error{Bucket: "shots", Status: 301, Code: "PermanentRedirect", Region: "us-west-2"}, "S3 bucket shots is in region us-west-2, set s3_region", false},
+		{&s3Error{Bucket: "shots", Status: 503, Code: "SlowDown", Message: "Please reduce your request rate."}, "S3: Please reduce your request rate. (SlowDown)", true},
+		{&s3Error{Bucket: "shots", Status: 500}, "S3 answered 500 Internal Server Error", true},
+	}
+	for _, tt := range tests {
+		if got := tt.err.Error(); got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.err.Code, got, tt.want)
+		}
+		if got := tt.err.temporary(); got != tt.temporary {
+			t.Errorf("%s: temporary %t, want %t", tt.err.Code, got, tt.temporary)
+		}
+	}
+}
+
+// TestS3MinIO uploads to a MinIO server at SKRINS_TEST_MINIO, e.g.
+// http://localhost:9000 for one in a container, with the credentials in
+// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY or MinIO's default ones. The
+// bucket skrins-test is created when it's missing.
+func TestS3MinIO(t *testing.T) {
+	endpoint := os.Getenv("SKRINS_TEST_MINIO")
+	if endpoint == "" {
+		t.Skip("SKRINS_TEST_MINIO isn't set")
+	}
+	if os.Getenv("AWS_ACCESS_KEY_ID") == "" {
+		setEnv(t, "AWS_ACCESS_KEY_ID", "minioadmin")
+		setEnv(t, "AWS_SECRET_ACCESS_KEY", "minioadmin")
+	}
+	setEnv(t, "AWS_SESSION_TOKEN", "")
+	creds, err := loadAWSCredentials(os.Getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodPut, strings.TrimSuffix(endpoint, "/")+"/skrins-test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signAWS(req, creds, "s3", "us-east-1", unsignedPayload, time.Now())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusConflict {
+		t.Fatalf("can't create the bucket: %s %s", resp.Status, body)
+	}
+
+	u := s3Uploader{p: testProfile(profile{
+		Backend:     backendS3,
+		S3Bucket:    "skrins-test",
+		S3Region:    "us-east-1",
+		S3Prefix:    "i/",
+		S3Endpoint:  endpoint,
+		S3PathStyle: true,
+	})}
+	ctx := context.Background()
+	// one uploaded at once and one in parts
+	for _, size := range []int{16, s3MultipartThreshold + 1} {
+		content := bytes.Repeat([]byte("skrins!"), size/7+1)[:size]
+		name := fmt.Sprintf("%d.png", size)
+		url, err := u.upload(ctx, uploadTestFile(t, "shot.png", content), name)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if want := strings.TrimSuffix(endpoint, "/") + "/skrins-test/i/" + name; url != want {
+			t.Errorf("url = %s, want the bucket's %s", url, want)
+		}
+		got, err := u.do(ctx, http.MethodGet, "i/"+name, nil, nil, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("%s has %d bytes that aren't the %d of the file", name, len(got), size)
+		}
+		if err := u.remove(ctx, name); err != nil {
+			t.Error(err)
+		}
+		if _, err := u.stat(ctx, name); !os.IsNotExist(err) {
+			t.Errorf("%s after removing it: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// defaultScanMaxAge is how old files found by -scan-on-start may be and
+// still be uploaded, unless the config file sets scan_max_age. Older ones
+// are most likely kept there on purpose.
+const defaultScanMaxAge = 24 * time.Hour
+
+// scanOnStart queues the files that were in the screenshot paths before
+// the watch was added for upload, oldest first, so they're uploaded by the
+// same workers as those of events. Files older than scan_max_age are left
+// alone.
+func scanOnStart(s *settings) {
+	paths := startupFiles(s, time.Now())
+	if len(paths) == 0 {
+		debugf("no files from before startup to upload")
+		return
+	}
+	log.Printf("uploading %d files from before startup", len(paths))
+	for _, path := range paths {
+		uploads.add(path)
+	}
+}
+
+// startupFiles lists the files of the screenshot paths modified at most
+// scan_max_age before now, oldest first
+func startupFiles(s *settings, now time.Time) []string {
+	var paths []string
+	var infos []os.FileInfo
+	for _, dir := range s.ScreensPaths {
+		p, f, err := s.screenshotFiles(dir)
+		if err != nil {
+			// missing_path says what happens to it
+			debugf("not scanning %s: %v", dir, err)
+			continue
+		}
+		for i := range p {
+			if age := ageOf(f[i].ModTime(), now); age > s.ScanMaxAge {
+				debugf("not uploading %s, it's %s old", p[i], age.Round(time.Second))
+				continue
+			}
+			paths, infos = append(paths, p[i]), append(infos, f[i])
+		}
+	}
+	sort.Stable(byModTime{paths, infos})
+	return paths
+}
+
+// byModTime sorts files oldest first
+type byModTime struct {
+	paths []string
+	infos []os.FileInfo
+}
+
+func (b byModTime) Len() int { return len(b.paths) }
+func (b byModTime) Less(i, j int) bool {
+	return b.infos[i].ModTime().Before(b.infos[j].ModTime())
+}
+func (b byModTime) Swap(i, j int) {
+	b.paths[i], b.paths[j] = b.paths[j], b.paths[i]
+	b.infos[i], b.infos[j] = b.infos[j], b.infos[i]
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/lithammer/shortuuid/v3"
+)
+
+// Transports files can be uploaded with. Without one set SFTP is used, and
+// SCP when the server has no SFTP subsystem.
+const (
+	transportSFTP = "sftp"
+	transportSCP  = "scp"
+)
+
+// scpError is a failure while uploading with SCP. It's kept apart from the
+// SFTP errors so it's obvious from the message which transport was used.
+type scpError struct {
+	Op  string
+	Err error
+}
+
+func (e *scpError) Error() string { return "scp: " + e.Op + ": " + e.Err.Error() }
+
+func (e *scpError) Unwrap() error { return e.Err }
+
+// scpCopyToRemote is copyToRemote for servers that only speak SCP. The file
+// is still written under a temporary name and moved into place with mv.
+// SCP can't resume, check free space or set modes regardless of the umask,
+// so the upload starts over after a failure, space isn't checked and the
+// file mode is set with chmod where the server allows it.
+func scpCopyToRemote(c *sftpConn, p profile, src, dest string, opts uploadOptions) error {
+	if opts.Mkdirs {
+		command := "mkdir -p -- " + shellQuote(path.Dir(dest))
+		if mode := p.dirMode(); mode != 0 {
+			// only the last directory gets the mode, mkdir -p can't do better
+			command = fmt.Sprintf("mkdir -p -m %o -- %s", mode, shellQuote(path.Dir(dest)))
+		}
+		if _, err := runRemote(c, command); err != nil {
+			return &scpError{Op: "can't create directory " + path.Dir(dest), Err: err}
+		}
+	}
+
+	srcReader, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcReader.Close()
+	fi, err := srcReader.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp := dest + tempSuffix + shortuuid.New()
+	t := startTransfer(src, fi.Size(), 0, opts.Progress)
+	defer t.finish()
+	hash := sha256.New()
+	r := io.TeeReader(limitedReader{srcReader, uploadLimiter}, hash)
+	if err := scpSend(c, tmp, defaultFileMode, fi.Size(), progressReader{progressTracker{r, t}, c}); err != nil {
+		runRemote(c, "rm -f -- "+shellQuote(tmp))
+		return err
+	}
+
+	// scp only acknowledges a file once the server wrote all of it, so
+	// there's no size to compare
+	if opts.Verify == verifySHA256 {
+		if err := checkRemoteSHA256(c, tmp, hex.EncodeToString(hash.Sum(nil))); err != nil {
+			runRemote(c, "rm -f -- "+shellQuote(tmp))
+			return err
+		}
+	}
+	if mode := p.fileMode(); mode != 0 && mode != defaultFileMode {
+		if _, err := runRemote(c, fmt.Sprintf("chmod %o -- %s", mode, shellQuote(tmp))); err != nil {
+			log.Printf("can't chmod %s to %o: %v", tmp, mode, err)
+		}
+	}
+	if _, err := runRemote(c, "mv -f -- "+shellQuote(tmp)+" "+shellQuote(dest)); err != nil {
+		runRemote(c, "rm -f -- "+shellQuote(tmp))
+		return &scpError{Op: "can't rename " + tmp, Err: err}
+	}
+
+	log.Println(t.summary())
+	return nil
+}
+
+// scpSend uploads size bytes read from r to name on the server by running
+// scp in sink mode there and speaking the source side of the protocol
+func scpSend(c *sftpConn, name string, mode os.FileMode, size int64, r io.Reader) error {
+	session, err := c.ssh.NewSession()
+	if err != nil {
+		return &scpError{Op: "can't start session", Err: err}
+	}
+	defer session.Close()
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return &scpError{Op: "can't start session", Err: err}
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return &scpError{Op: "can't start session", Err: err}
+	}
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	if err := session.Start("scp -t " + shellQuote(name)); err != nil {
+		return &scpError{Op: "can't run scp on the server", Err: err}
+	}
+	acks := bufio.NewReader(stdout)
+
+	fail := func(op string, err error) error {
+		stdin.Close()
+		session.Wait()
+		if msg := strings.TrimSpace(stderr.String()); msg != "" && err == io.EOF {
+			err = errors.New(msg)
+		}
+		return &scpError{Op: op, Err: err}
+	}
+	if err := scpAck(acks); err != nil {
+		return fail("scp on the server didn't start", err)
+	}
+	if _, err := fmt.Fprintf(stdin, "C%04o %d %s\n", mode.Perm(), size, path.Base(name)); err != nil {
+		return fail("can't send "+name, err)
+	}
+	if err := scpAck(acks); err != nil {
+		return fail("server refused "+name, err)
+	}
+	n, err := io.Copy(stdin, io.LimitReader(r, size))
+	if err == nil && n < size {
+		err = fmt.Errorf("local file shrank to %d bytes while uploading", n)
+	}
+	if err == nil {
+		_, err = stdin.Write([]byte{0})
+	}
+	if err != nil {
+		return fail("can't send "+name, err)
+	}
+	if err := scpAck(acks); err != nil {
+		return fail("can't write "+name, err)
+	}
+	stdin.Close()
+	if err := session.Wait(); err != nil {
+		return &scpError{Op: "scp on the server failed", Err: err}
+	}
+	return nil
+}
+
+// scpAck reads the server's answer to the last message. 0 is fine, 1 and 2
+// are followed by a message saying what's wrong.
+func scpAck(r *bufio.Reader) error {
+	code, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if code == 0 {
+		return nil
+	}
+	msg, _ := r.ReadString('\n')
+	return errors.New(strings.TrimSpace(msg))
+}
+
+// runRemote runs command on the server over c's connection and returns its
+// output. A failure carries what the command wrote to stderr.
+func runRemote(c *sftpConn, command string) (string, error) {
+	session, err := c.ssh.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+	var stdout, stderr bytes.Buffer
+	session.Stdout, session.Stderr = &stdout, &stderr
+	if err := session.Run(command); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%s: %w", msg, err)
+		}
+		return "", err
+	}
+	return stdout.String(), nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+// TestDropbearSCP uploads to a dropbear server without sftp-server, say one
+// in a container, at SKRINS_TEST_DROPBEAR (host:port) as
+// SKRINS_TEST_DROPBEAR_USER with the key at SKRINS_TEST_DROPBEAR_KEY. The
+// upload has to fall back to SCP, and goes to /tmp/skrins-test.
+func TestDropbearSCP(t *testing.T) {
+	host := os.Getenv("SKRINS_TEST_DROPBEAR")
+	if host == "" {
+		t.Skip("SKRINS_TEST_DROPBEAR isn't set")
+	}
+	tempStateDir(t)
+	u := sftpUploader{
+		p: testProfile(profile{
+			RemoteHost:      host,
+			RemoteUser:      os.Getenv("SKRINS_TEST_DROPBEAR_USER"),
+			Key:             os.Getenv("SKRINS_TEST_DROPBEAR_KEY"),
+			RemotePath:      "/tmp/skrins-test",
+			BaseURL:         "https://example.com/",
+			InsecureHostKey: boolPtr(true),
+			FileMode:        0640,
+		}),
+		opts: uploadOptions{Mkdirs: true, Verify: verifySHA256, Persistent: true},
+	}
+	t.Cleanup(conns.closeAll)
+	ctx := context.Background()
+	content := []byte("not really a png")
+	url, err := u.upload(ctx, uploadTestFile(t, "shot.png", content), "Zr8tW.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "https://example.com/Zr8tW.png" {
+		t.Errorf("url = %s", url)
+	}
+	err = u.withClient(ctx, func(c *sftpConn) error {
+		if c.transport() != transportSCP {
+			t.Errorf("uploaded with %s, want the fallback to %s", c.transport(), transportSCP)
+		}
+		got, err := runRemote(c, "cat -- /tmp/skrins-test/Zr8tW.png")
+		if err != nil {
+			return err
+		}
+		if got != string(content) {
+			t.Errorf("the server has %q, want %q", got, content)
+		}
+		mode, err := runRemote(c, "stat -c %a -- /tmp/skrins-test/Zr8tW.png")
+		if err == nil && mode != "640\n" {
+			t.Errorf("mode %q, want 640 from file_mode", mode)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.remove(ctx, "Zr8tW.png"); err != nil {
+		t.Error(err)
+	}
+}
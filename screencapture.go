@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// screenshotLocationInterval is how often the macOS screenshot location is
+// read again, to follow it when it's changed while skrins runs
+const screenshotLocationInterval = 30 * time.Second
+
+// screenshotLocationFor is where macOS saves screenshots when goos is
+// darwin, "" elsewhere. read returns what `defaults read
+// com.apple.screencapture location` prints, and home is the user's home
+// directory: without a location set it's ~/Desktop. The path is resolved,
+// folders synced with iCloud Drive are watched where they really are.
+func screenshotLocationFor(goos string, read func() (string, error), home string) string {
+	if goos != "darwin" {
+		return ""
+	}
+	dir := filepath.Join(home, "Desktop")
+	if out, err := read(); err == nil && strings.TrimSpace(out) != "" {
+		dir = strings.TrimSpace(out)
+		// set by some tools as a file URL instead of a path
+		if u, err := url.Parse(dir); err == nil && u.Scheme == "file" {
+			dir = u.Path
+		}
+		if dir == "~" || strings.HasPrefix(dir, "~/") {
+			dir = filepath.Join(home, dir[1:])
+		}
+	}
+	if real, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = real
+	}
+	return filepath.Clean(dir)
+}
+
+// screenshotLocation is screenshotLocationFor the running system
+func screenshotLocation() string {
+	home, _ := os.UserHomeDir()
+	return screenshotLocationFor(runtime.GOOS, func() (string, error) {
+		out, err := exec.Command("defaults", "read", "com.apple.screencapture", "location").Output()
+		return string(out), err
+	}, home)
+}
+
+// followScreenshotLocation moves the watch to where macOS saves
+// screenshots when that changes, as long as no screenshot path was given
+// and that's where it came from
+func followScreenshotLocation() {
+	var failed string
+	for {
+		time.Sleep(screenshotLocationInterval)
+		s := currentSettings()
+		if !s.AutoPath {
+			continue
+		}
+		dir := screenshotLocation()
+		if dir == "" || contains(s.ScreensPaths, dir) {
+			continue
+		}
+		moved := *s
+		moved.ScreensPaths = []string{dir}
+		if err := watchPaths(&moved); err != nil {
+			if dir != failed {
+				log.Printf("macOS saves screenshots to %s now, but %v", dir, err)
+			}
+			failed = dir
+			continue
+		}
+		log.Printf("macOS saves screenshots to %s now, watching it instead of %s", dir, strings.Join(s.ScreensPaths, ", "))
+		current.Store(&moved)
+	}
+}
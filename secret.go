@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Secrets such as passwords and tokens are configured as references so
+// they don't have to sit in the config file:
+//
+//	env:NAME                the environment variable NAME
+//	file:/path/to/secret    the contents of a file, without trailing newlines
+//	keyring:service/account the system keyring (macOS Keychain or Secret Service)
+//	prompt                  asked for once at startup
+//
+// Anything else is used as is.
+
+// resolvedSecrets caches resolved references so prompts happen only once
+var resolvedSecrets = struct {
+	sync.Mutex
+	values map[string]string
+}{values: map[string]string{}}
+
+// resolveSecret returns the value ref points to. label describes the secret
+// in prompts and errors. Prompting only happens when interactive is set and
+// skrins runs in a terminal, cached values are returned either way.
+func resolveSecret(ref, label string, interactive bool) (string, error) {
+	key := label + "\x00" + ref
+	resolvedSecrets.Lock()
+	defer resolvedSecrets.Unlock()
+	if v, ok := resolvedSecrets.values[key]; ok {
+		return v, nil
+	}
+
+	v, err := lookupSecret(ref, label, interactive)
+	if err != nil {
+		return "", err
+	}
+	resolvedSecrets.values[key] = v
+	return v, nil
+}
+
+// cachedSecret returns a secret resolved before, without prompting
+func cachedSecret(ref, label string) (string, error) {
+	return resolveSecret(ref, label, false)
+}
+
+func lookupSecret(ref, label string, interactive bool) (string, error) {
+	switch {
+	case ref == "prompt":
+		fd := int(os.Stdin.Fd())
+		if !interactive || !terminal.IsTerminal(fd) {
+			return "", fmt.Errorf("%s has to be typed in but skrins is not running in a terminal, use env:, file: or keyring: instead", label)
+		}
+		fmt.Fprintf(os.Stderr, "%s: ", label)
+		b, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(b), err
+	case strings.HasPrefix(ref, "env:"):
+		name := strings.TrimPrefix(ref, "env:")
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("%s: environment variable %s is not set", label, name)
+		}
+		return v, nil
+	case strings.HasPrefix(ref, "file:"):
+		path, err := expandPath(strings.TrimPrefix(ref, "file:"), os.Getenv)
+		if err != nil {
+			return "", err
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", label, err)
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	case strings.HasPrefix(ref, "keyring:"):
+		v, err := keyringLookup(strings.TrimPrefix(ref, "keyring:"))
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", label, err)
+		}
+		return v, nil
+	}
+	return ref, nil
+}
+
+// keyringLookup reads "service/account" from the system keyring with the
+// platform's command line tool
+func keyringLookup(entry string) (string, error) {
+	parts := strings.SplitN(entry, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("keyring entry %q should look like service/account", entry)
+	}
+	service, account := parts[0], parts[1]
+
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("security", "find-generic-password", "-s", service, "-a", account, "-w")
+	case "windows":
+		return "", errors.New("the keyring is not supported on Windows, use env: or file:")
+	default:
+		cmd = exec.Command("secret-tool", "lookup", "service", service, "account", account)
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("keyring lookup of %s failed: %w", entry, err)
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
+
+// storeSecret saves value where ref points to, for secrets skrins obtains
+// itself. Only keyring: and file: references can be written to.
+func storeSecret(ref, label, value string) error {
+	switch {
+	case strings.HasPrefix(ref, "keyring:"):
+		if err := keyringStore(strings.TrimPrefix(ref, "keyring:"), value); err != nil {
+			return fmt.Errorf("%s: %w", label, err)
+		}
+	case strings.HasPrefix(ref, "file:"):
+		path, err := expandPath(strings.TrimPrefix(ref, "file:"), os.Getenv)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, []byte(value+"\n"), 0600); err != nil {
+			return fmt.Errorf("%s: %w", label, err)
+		}
+	default:
+		return fmt.Errorf("%s can't be saved to %q, use a keyring: or file: reference", label, ref)
+	}
+	resolvedSecrets.Lock()
+	resolvedSecrets.values[label+"\x00"+ref] = value
+	resolvedSecrets.Unlock()
+	return nil
+}
+
+// securityQuote quotes s as an argument of a security -i command line
+func securityQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// keyringStore saves value as "service/account" in the system keyring,
+// replacing what's there
+func keyringStore(entry, value string) error {
+	parts := strings.SplitN(entry, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("keyring entry %q should look like service/account", entry)
+	}
+	service, account := parts[0], parts[1]
+
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		// security -i reads the command from stdin, so the secret isn't in
+		// the arguments ps shows
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("can't save %s to the keyring, it has a line break", entry)
+		}
+		cmd = exec.Command("security", "-i")
+		cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -U -s %s -a %s -w %s\n", securityQuote(service), securityQuote(account), securityQuote(value)))
+	case "windows":
+		return errors.New("the keyring is not supported on Windows, use file:")
+	default:
+		// secret-tool reads the secret from stdin
+		cmd = exec.Command("secret-tool", "store", "--label=skrins "+entry, "service", service, "account", account)
+		cmd.Stdin = strings.NewReader(value)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("saving %s to the keyring failed: %v %s", entry, err, strings.TrimSpace(string(out)))
+	}
+	if runtime.GOOS == "darwin" {
+		// security -i exits with 0 when the command it read failed, only
+		// reading the entry back tells that it's saved
+		if saved, err := keyringLookup(entry); err != nil || saved != value {
+			return fmt.Errorf("saving %s to the keyring failed, it doesn't read back", entry)
+		}
+	}
+	return nil
+}
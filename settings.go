@@ -0,0 +1,895 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// settings is everything a running skrins needs, resolved from flags, the
+// environment and the config file. A settings value is never modified once
+// it's been stored, reloading swaps in a new one.
+type settings struct {
+	ConfigFile string
+	// ScreensPaths are the directories screenshots are saved to, each
+	// one watched and uploaded from the same way
+	ScreensPaths []string
+	// AutoPath is set when ScreensPaths is where macOS saves screenshots,
+	// since no path was given
+	AutoPath    bool
+	ProfileName string
+	Profile     profile
+	// Recursive watches the directories below ScreensPaths too
+	Recursive bool
+	// Poll finds new files by listing the screenshot paths every
+	// PollInterval, which happens anyway for those on filesystems known
+	// not to report changes
+	Poll         bool
+	PollInterval time.Duration
+	// MissingPath is what happens to screenshot paths that don't exist,
+	// see missingPathFail and the others, and MissingPathAlert how long
+	// one may be gone while running before the user's told
+	MissingPath      string
+	MissingPathAlert time.Duration
+	// Debounce is how long a file has to be left alone before it's
+	// uploaded, collapsing the events of saving it into one
+	Debounce time.Duration
+	// Files are uploaded once they didn't change for StablePeriod, those
+	// that still change after StableMaxWait are tried again later
+	StablePeriod  time.Duration
+	StableMaxWait time.Duration
+	// Files smaller than MinBytes, 0 for no minimum, aren't uploaded until
+	// they grow, they're reported when they didn't after TinyTimeout
+	MinBytes    int64
+	TinyTimeout time.Duration
+	// ScanOnStart uploads the files already in ScreensPaths at startup
+	// that aren't older than ScanMaxAge
+	ScanOnStart bool
+	ScanMaxAge  time.Duration
+	// MaxAge is how long before their events files may have been modified
+	// and still be uploaded, 0 for any time
+	MaxAge time.Duration
+	// Workers is how many files are uploaded at once
+	Workers int
+	// WhilePaused is what happens to new screenshots while uploads are
+	// paused, see pausedQueue and pausedIgnore. PauseNotifications tells
+	// about pausing and resuming with a notification.
+	WhilePaused        string
+	PauseNotifications bool
+	// NoDedup uploads every file, even one with the same content as a file
+	// that was uploaded already instead of handing out its URL again
+	NoDedup bool
+	// BatchSeparator joins the URLs of a batch on the clipboard, see
+	// joinBatch
+	BatchSeparator string
+	// KeepLocal leaves files where they are once they're uploaded,
+	// ArchiveDir is where they're moved to instead of deleting them
+	KeepLocal  bool
+	ArchiveDir string
+	// DeleteAfter keeps uploaded files that long before they're deleted,
+	// trashed or archived, 0 for doing that right away
+	DeleteAfter time.Duration
+	// AfterUpload overrides those by extension, see afterUploadRule
+	AfterUpload []afterUploadRule
+	// Naming is how files are named on the server, see namingRandom,
+	// unless they're named after NameTemplate
+	Naming       string
+	NameTemplate string
+	// CounterPrefix and CounterDigits make the names of naming counter,
+	// which only works with AllowGuessableNames
+	CounterPrefix       string
+	CounterDigits       int
+	AllowGuessableNames bool
+	// HashLength is how many characters of the digest naming hash uses
+	HashLength int
+	// DateDirs is the time layout of the folders below remote_path files go
+	// into, none when empty
+	DateDirs string
+	// MaxSize is the size of the largest file uploaded, like "500M",
+	// MaxBytes that in bytes, 0 for no limit. MoveTooLarge moves larger
+	// ones to tooLargeDir.
+	MaxSize      string
+	MaxBytes     int64
+	MoveTooLarge bool
+	// More than BundleOver files coming in within BundleWindow are
+	// uploaded as one zip, 0 uploads every file by itself
+	BundleOver   int
+	BundleWindow time.Duration
+	// MaxUploads is how many files are uploaded within MaxUploadsPer at
+	// most, OverMaxUploads what happens to more, see overLimitQueue
+	MaxUploads     int
+	MaxUploadsPer  time.Duration
+	OverMaxUploads string
+	// Files whose uploads failed QuarantineAfter times are moved to
+	// failedDir, unless NoQuarantine
+	QuarantineAfter int
+	NoQuarantine    bool
+	// NoNameCheck uploads random names without looking them up on the
+	// server first, the others are looked up all the same
+	NoNameCheck bool
+	// Trash moves uploaded files to the trash, to ArchiveDir or nowhere
+	// when that fails
+	Trash bool
+
+	// NetworkRules pick another profile depending on the network skrins is
+	// on, Profile is the fallback. RuleProfiles holds the finished profiles
+	// the rules and fallback_profile settings refer to.
+	NetworkRules []networkRule
+	RuleProfiles map[string]profile
+
+	// Extensions that may be uploaded and those that never are, lower case.
+	// On the command line Extensions are added to the configured list.
+	Extensions     []string
+	DenyExtensions []string
+	// Ignore are file name patterns of files and directories that are
+	// left alone, like the temporary files of other programs. On the
+	// command line they're added to the configured list.
+	Ignore []string
+	// Include are file name patterns, when there are any only files
+	// matching one are uploaded. Ignore wins over Include.
+	Include []string
+
+	Debug  bool
+	DryRun bool
+	// NoPersistentConn connects for every upload instead of keeping the
+	// connection open
+	NoPersistentConn bool
+	// Mkdirs creates missing remote directories before uploading,
+	// MkdirsSet tells that -mkdirs was given so the config file can't
+	// override it
+	Mkdirs    bool
+	MkdirsSet bool
+	// DetectType is how the type of a file is told, by its extension or its
+	// content, see detectExtension
+	DetectType string
+	// Compress is how files are compressed on the way to the server,
+	// compressGzip or "" for not at all, CompressSkip the lower case
+	// extensions that aren't compressed anyway
+	Compress     string
+	CompressSkip []string
+	// Verify is how uploads are checked before the local file is deleted,
+	// verifySize or verifySHA256
+	Verify string
+	// LimitRate caps the upload bandwidth, like "2M", RateLimit is the
+	// same in bytes per second with 0 for unlimited
+	LimitRate string
+	RateLimit int64
+
+	// Retry is how failed uploads are retried right away
+	Retry retryPolicy
+
+	// Progress is how the progress of large uploads is reported
+	Progress progressOptions
+}
+
+// cli holds what was given on the command line, it's the starting point
+// every time settings are resolved
+var cli settings
+
+// current holds the *settings in use
+var current atomic.Value
+
+// currentSettings returns the settings in use right now. Callers should grab
+// them once per operation so a reload can't change things halfway through.
+func currentSettings() *settings {
+	return current.Load().(*settings)
+}
+
+// settingsError lists everything wrong with a set of settings.
+type settingsError struct {
+	ConfigFile string
+	Problems   []string
+}
+
+func (e *settingsError) Error() string {
+	return "invalid settings: " + strings.Join(e.Problems, "; ")
+}
+
+// loadSettings resolves settings starting from the command line values in
+// c, then the environment and finally the config file, and checks them.
+func loadSettings(c settings, getenv func(string) string) (*settings, error) {
+	path, err := expandPath(c.ConfigFile, getenv)
+	if err != nil {
+		return nil, err
+	}
+	explicit := path != ""
+	if !explicit {
+		path = findConfigFile(defaultConfigCandidates())
+	}
+	fc, err := loadConfigFile(path, explicit)
+	if err != nil {
+		return nil, err
+	}
+
+	s := c
+	s.ConfigFile = path
+	s.Profile.Routes = append([]route(nil), c.Profile.Routes...)
+
+	// like PATH, SKRINS_PATH separates directories with : or ; on Windows
+	if len(s.ScreensPaths) == 0 && getenv("SKRINS_PATH") != "" {
+		s.ScreensPaths = filepath.SplitList(getenv("SKRINS_PATH"))
+	}
+	if len(s.ScreensPaths) == 0 {
+		s.ScreensPaths = fc.paths()
+	}
+	if len(s.ScreensPaths) == 0 {
+		if dir := screenshotLocation(); dir != "" {
+			s.ScreensPaths, s.AutoPath = []string{dir}, true
+		}
+	}
+
+	fp, err := fc.profileNamed(s.ProfileName)
+	if err != nil {
+		return nil, err
+	}
+	s.Profile.merge(envProfile(getenv))
+	s.Profile.merge(fp)
+
+	s.ScreensPaths = append([]string(nil), s.ScreensPaths...)
+	for i := range s.ScreensPaths {
+		if s.ScreensPaths[i], err = expandPath(s.ScreensPaths[i], getenv); err != nil {
+			return nil, err
+		}
+	}
+	if s.ArchiveDir == "" {
+		s.ArchiveDir = fc.ArchiveDir
+	}
+	if s.ArchiveDir, err = expandPath(s.ArchiveDir, getenv); err != nil {
+		return nil, err
+	}
+
+	s.Debug = c.Debug || fc.Debug
+	s.Recursive = c.Recursive || fc.Recursive
+	s.Poll = c.Poll || fc.Poll
+	s.ScanOnStart = c.ScanOnStart || fc.ScanOnStart
+	if s.Workers == 0 {
+		s.Workers = fc.Workers
+	}
+	if s.Workers == 0 {
+		s.Workers = 1
+	}
+	s.WhilePaused = fc.WhilePaused
+	setDefault(&s.WhilePaused, pausedQueue)
+	s.PauseNotifications = fc.PauseNotifications
+	s.NoDedup = c.NoDedup || fc.NoDedup
+	s.KeepLocal = c.KeepLocal || fc.KeepLocal
+	if s.DeleteAfter == 0 {
+		s.DeleteAfter = fc.DeleteAfter.Duration
+	}
+	s.Trash = c.Trash || fc.Trash
+	if fc.Mkdirs != nil && !c.MkdirsSet {
+		s.Mkdirs = *fc.Mkdirs
+	}
+	s.AfterUpload = fc.AfterUpload
+	if s.Naming == "" {
+		s.Naming = fc.Naming
+	}
+	setDefault(&s.Naming, namingRandom)
+	if s.NameTemplate == "" {
+		s.NameTemplate = fc.NameTemplate
+	}
+	s.CounterPrefix = fc.CounterPrefix
+	setDefault(&s.CounterPrefix, defaultCounterPrefix)
+	s.BatchSeparator = fc.BatchSeparator
+	setDefault(&s.BatchSeparator, defaultBatchSeparator)
+	s.HashLength = fc.HashLength
+	if s.HashLength == 0 {
+		s.HashLength = defaultHashLength
+	}
+	s.CounterDigits = fc.CounterDigits
+	if s.CounterDigits == 0 {
+		s.CounterDigits = defaultCounterDigits
+	}
+	s.AllowGuessableNames = fc.AllowGuessableNames
+	if s.DateDirs == "" {
+		s.DateDirs = fc.DateDirs
+	}
+	s.NoNameCheck = c.NoNameCheck || fc.NoNameCheck
+	if s.BundleOver == 0 {
+		s.BundleOver = fc.BundleOver
+	}
+	s.BundleWindow = fc.BundleWindow.Duration
+	if s.BundleWindow == 0 {
+		s.BundleWindow = defaultBundleWindow
+	}
+	if s.MaxUploads == 0 {
+		s.MaxUploads = fc.MaxUploads
+	}
+	s.MaxUploadsPer = fc.MaxUploadsPer.Duration
+	if s.MaxUploadsPer == 0 {
+		s.MaxUploadsPer = defaultMaxUploadsPer
+	}
+	s.OverMaxUploads = fc.OverMaxUploads
+	setDefault(&s.OverMaxUploads, overLimitQueue)
+	s.QuarantineAfter = fc.QuarantineAfter
+	if s.QuarantineAfter == 0 {
+		s.QuarantineAfter = defaultQuarantineAfter
+	}
+	s.NoQuarantine = c.NoQuarantine || fc.NoQuarantine
+	if s.MaxAge == 0 {
+		s.MaxAge = fc.MaxAge.Duration
+	}
+	s.ScanMaxAge = fc.ScanMaxAge.Duration
+	if s.ScanMaxAge == 0 {
+		s.ScanMaxAge = defaultScanMaxAge
+	}
+	s.MissingPath = fc.MissingPath
+	setDefault(&s.MissingPath, missingPathFail)
+	s.MissingPathAlert = fc.MissingPathAlert.Duration
+	if s.MissingPathAlert == 0 {
+		s.MissingPathAlert = defaultMissingPathAlert
+	}
+	s.PollInterval = fc.PollInterval.Duration
+	if s.PollInterval == 0 {
+		s.PollInterval = defaultPollInterval
+	}
+	if s.Debounce == 0 {
+		s.Debounce = fc.Debounce.Duration
+	}
+	if s.Debounce == 0 {
+		s.Debounce = defaultDebounce
+	}
+	s.StablePeriod = fc.StablePeriod.Duration
+	if s.StablePeriod == 0 {
+		s.StablePeriod = defaultStablePeriod
+	}
+	s.StableMaxWait = fc.StableMaxWait.Duration
+	if s.StableMaxWait == 0 {
+		s.StableMaxWait = defaultStableMaxWait
+	}
+	s.MinBytes = defaultMinSize
+	if fc.MinSize != nil {
+		s.MinBytes = int64(*fc.MinSize)
+	}
+	s.TinyTimeout = fc.TinyTimeout.Duration
+	if s.TinyTimeout == 0 {
+		s.TinyTimeout = defaultTinyTimeout
+	}
+	extensions := fc.Extensions
+	if len(extensions) == 0 {
+		extensions = defaultExtensions
+	}
+	s.Extensions = lowerAll(extensions, fc.ExtraExtensions, c.Extensions)
+	s.DenyExtensions = lowerAll(fc.DenyExtensions, c.DenyExtensions)
+	ignore := fc.Ignore
+	if ignore == nil {
+		ignore = defaultIgnore
+	}
+	s.Ignore = append(append(append([]string(nil), ignore...), fc.ExtraIgnore...), c.Ignore...)
+	s.Include = append(append([]string(nil), fc.Include...), c.Include...)
+	setDefault(&s.DetectType, fc.DetectType)
+	setDefault(&s.DetectType, detectExtension)
+	setDefault(&s.Compress, fc.Compress)
+	s.CompressSkip = lowerAll(fc.CompressSkip)
+	setDefault(&s.Verify, fc.Verify)
+	setDefault(&s.Verify, verifySize)
+	setDefault(&s.LimitRate, fc.LimitRate)
+	setDefault(&s.MaxSize, fc.MaxSize)
+	s.MoveTooLarge = c.MoveTooLarge || fc.MoveTooLarge
+	s.Retry = retryPolicy{
+		Attempts:  fc.RetryAttempts,
+		BaseDelay: fc.RetryBaseDelay.Duration,
+		MaxDelay:  fc.RetryMaxDelay.Duration,
+	}
+	if s.Retry.Attempts == 0 {
+		s.Retry.Attempts = defaultRetryAttempts
+	}
+	if s.Retry.BaseDelay == 0 {
+		s.Retry.BaseDelay = defaultRetryBaseDelay
+	}
+	if s.Retry.MaxDelay == 0 {
+		s.Retry.MaxDelay = defaultRetryMaxDelay
+	}
+	s.Progress = progressOptions{
+		Threshold: int64(fc.ProgressThreshold),
+		Interval:  fc.ProgressInterval.Duration,
+		Notify:    c.Progress.Notify || fc.ProgressNotifications,
+	}
+	if s.Progress.Threshold == 0 {
+		s.Progress.Threshold = defaultProgressThreshold
+	}
+	if s.Progress.Interval == 0 {
+		s.Progress.Interval = defaultProgressInterval
+	}
+
+	var problems []string
+	s.Profile, problems = s.Profile.finish(c.Profile.RemoteUser != "", getenv)
+	if s.DetectType != detectExtension && s.DetectType != detectFallback && s.DetectType != detectStrict {
+		problems = append(problems, fmt.Sprintf("detect_type must be %s, %s or %s, not %q", detectExtension, detectFallback, detectStrict, s.DetectType))
+	}
+	if s.Compress != "" && s.Compress != compressGzip {
+		problems = append(problems, fmt.Sprintf("compress must be %s, or empty to upload files as they are, not %q", compressGzip, s.Compress))
+	}
+	if s.Verify != verifySize && s.Verify != verifySHA256 {
+		problems = append(problems, fmt.Sprintf("verify must be %s or %s, not %q", verifySize, verifySHA256, s.Verify))
+	}
+	if s.RateLimit, err = parseRate(s.LimitRate); err != nil {
+		problems = append(problems, "limit_rate: "+err.Error())
+	}
+	if s.MaxBytes, err = parseSize(s.MaxSize); err != nil {
+		problems = append(problems, "max_size: "+err.Error())
+	}
+	if s.Retry.Attempts < 0 || s.Retry.BaseDelay < 0 || s.Retry.MaxDelay < 0 {
+		problems = append(problems, "retry settings can't be negative")
+	}
+	if s.BundleOver < 0 || s.BundleWindow < 0 {
+		problems = append(problems, "bundle_over and bundle_window can't be negative")
+	}
+	if s.MaxUploads < 0 || s.MaxUploadsPer < 0 {
+		problems = append(problems, "max_uploads and max_uploads_per can't be negative")
+	}
+	if s.OverMaxUploads != overLimitQueue && s.OverMaxUploads != overLimitPause {
+		problems = append(problems, fmt.Sprintf("over_max_uploads must be %s or %s, not %q", overLimitQueue, overLimitPause, s.OverMaxUploads))
+	}
+	if s.QuarantineAfter < 0 {
+		problems = append(problems, "quarantine_after can't be negative")
+	}
+	if s.Workers < 1 || s.Workers > maxWorkers {
+		problems = append(problems, fmt.Sprintf("workers must be between 1 and %d, not %d", maxWorkers, s.Workers))
+	}
+	if s.Naming != namingRandom && s.Naming != namingOriginal && s.Naming != namingOriginalPrefixed && s.Naming != namingCounter && s.Naming != namingHash {
+		problems = append(problems, fmt.Sprintf("naming must be %s, %s, %s, %s or %s, not %q", namingRandom, namingOriginal, namingOriginalPrefixed, namingCounter, namingHash, s.Naming))
+	}
+	if s.HashLength < 8 || s.HashLength > 64 {
+		problems = append(problems, fmt.Sprintf("hash_length must be between 8 and 64, not %d", s.HashLength))
+	}
+	problems = append(problems, s.counterProblems()...)
+	problems = append(problems, dateDirsProblems(s.DateDirs)...)
+	if s.NameTemplate != "" && s.Naming != namingRandom {
+		problems = append(problems, "naming and name_template can't both be set, name_template has {orig} and {rand} for that")
+	}
+	problems = append(problems, nameTemplateProblems(s.NameTemplate)...)
+	if s.WhilePaused != pausedQueue && s.WhilePaused != pausedIgnore {
+		problems = append(problems, fmt.Sprintf("while_paused must be %s or %s, not %q", pausedQueue, pausedIgnore, s.WhilePaused))
+	}
+	problems = append(problems, patternProblems("ignore", s.Ignore)...)
+	problems = append(problems, patternProblems("include", s.Include)...)
+	if s.Debounce < 0 || s.StablePeriod < 0 || s.StableMaxWait < 0 || s.TinyTimeout < 0 || s.PollInterval < 0 || s.MissingPathAlert < 0 || s.ScanMaxAge < 0 || s.MaxAge < 0 {
+		problems = append(problems, "debounce, stable, poll, missing_path_alert and scan_max_age settings can't be negative")
+	}
+	if s.Progress.Threshold < 0 || s.Progress.Interval < 0 {
+		problems = append(problems, "progress settings can't be negative")
+	}
+	problems = append(problems, s.pathProblems()...)
+	s.Profile = s.Profile.withSlashes()
+
+	// network rules only apply when no profile was picked explicitly
+	if c.ProfileName == "" && len(fc.NetworkRules) > 0 {
+		problems = append(problems, s.loadNetworkRules(fc, getenv)...)
+	}
+	problems = append(problems, s.loadFallbackProfiles(fc, getenv)...)
+
+	if len(problems) > 0 {
+		return &s, &settingsError{ConfigFile: path, Problems: problems}
+	}
+
+	for i := range s.ScreensPaths {
+		s.ScreensPaths[i] = filepath.Clean(s.ScreensPaths[i])
+	}
+	return &s, nil
+}
+
+// pathProblems checks the screenshot paths along with the profile, like
+// settingsProblems. Paths that don't exist are fine unless missing_path is
+// fail, and a path that's recursively watched through another one would
+// be uploaded from twice.
+func (s *settings) pathProblems() []string {
+	first := ""
+	if len(s.ScreensPaths) > 0 {
+		first = s.ScreensPaths[0]
+	}
+	var problems []string
+	for _, m := range missingSettings(first, s.Profile) {
+		problems = append(problems, "missing required setting "+m)
+	}
+	for i, path := range s.ScreensPaths {
+		if _, err := os.Stat(path); s.MissingPath == missingPathFail || !os.IsNotExist(err) {
+			problems = append(problems, screensPathProblems(path)...)
+		}
+		for j, other := range s.ScreensPaths {
+			if i == j || !isWithin(path, other) {
+				continue
+			}
+			if filepath.Clean(path) == filepath.Clean(other) {
+				if i > j {
+					problems = append(problems, fmt.Sprintf("screenshots path %s is given twice", path))
+				}
+			} else if s.Recursive {
+				problems = append(problems, fmt.Sprintf("screenshots path %s is below %s, which is watched recursively", path, other))
+			}
+		}
+		if s.Recursive && s.Profile.Backend == backendLocal && isWithin(s.Profile.RemotePath, path) {
+			problems = append(problems, fmt.Sprintf("remote_path %s is below the screenshots path %s, with recursive every upload would be uploaded again", s.Profile.RemotePath, path))
+		}
+	}
+	// archive_dir goes with keep_local when it's only for after_upload
+	if s.KeepLocal && (s.Trash || s.ArchiveDir != "" && !s.archivesByRule()) {
+		problems = append(problems, "keep_local can't be set with archive_dir or trash, files are either kept where they are or moved; use after_upload to move some of them")
+	}
+	problems = append(problems, s.afterUploadProblems()...)
+	if s.DeleteAfter > 0 && s.KeepLocal {
+		problems = append(problems, "keep_local can't be set with delete_after, files are either kept or deleted later")
+	}
+	if s.DeleteAfter < 0 {
+		problems = append(problems, "delete_after can't be negative")
+	}
+	for _, path := range s.ScreensPaths {
+		if s.ArchiveDir != "" && isWithin(path, s.ArchiveDir) {
+			problems = append(problems, fmt.Sprintf("archive_dir %s can't be or hold the screenshots path %s, none of it would be uploaded", s.ArchiveDir, path))
+		}
+	}
+	if s.MissingPath != missingPathFail && s.MissingPath != missingPathWait && s.MissingPath != missingPathCreate {
+		problems = append(problems, fmt.Sprintf("missing_path must be %s, %s or %s, not %q", missingPathFail, missingPathWait, missingPathCreate, s.MissingPath))
+	}
+	return append(problems, checkProfile(s.Profile)...)
+}
+
+// log prints the settings. Key paths are not printed, unless it's a default
+// key skrins picked by itself.
+func (s *settings) log() {
+	name := s.ProfileName
+	if name == "" {
+		name = "default"
+	}
+	if s.AutoPath {
+		log.Printf("watching %s, where macOS saves screenshots, skrins follows it when that's changed", s.ScreensPaths[0])
+	}
+	if !s.Profile.usesSSH() {
+		log.Printf("profile=%s paths=%q backend=%s %s", name, s.ScreensPaths, s.Profile.Backend, s.Profile.backendSummary())
+		debugf("extensions=%s deny_extensions=%s ignore=%s include=%s", strings.Join(s.Extensions, ","), strings.Join(s.DenyExtensions, ","), strings.Join(s.Ignore, ","), strings.Join(s.Include, ","))
+		return
+	}
+	var keys []string
+	if s.Profile.usesAgent() {
+		keys = append(keys, "agent")
+	}
+	if s.Profile.Key != "" {
+		keys = append(keys, "(redacted)")
+	}
+	if s.Profile.DefaultKey != "" {
+		keys = append(keys, s.Profile.DefaultKey)
+	}
+	if s.Profile.Password != "" {
+		keys = append(keys, "password")
+	}
+	key := strings.Join(keys, ",")
+	log.Printf("profile=%s paths=%q remote_host=%q remote_user=%q key=%s remote_path=%q base_url=%q",
+		name, s.ScreensPaths, s.Profile.RemoteHost, s.Profile.RemoteUser, key, s.Profile.RemotePath, s.Profile.BaseURL)
+	debugf("extensions=%s deny_extensions=%s ignore=%s include=%s", strings.Join(s.Extensions, ","), strings.Join(s.DenyExtensions, ","), strings.Join(s.Ignore, ","), strings.Join(s.Include, ","))
+}
+
+// debugf logs only when debug logging is on
+func debugf(format string, v ...interface{}) {
+	if s, ok := current.Load().(*settings); ok && s.Debug {
+		log.Printf("[debug] "+format, v...)
+	}
+}
+
+// lowerAll joins lists, lower casing and trimming every entry
+func lowerAll(lists ...[]string) []string {
+	var all []string
+	for _, l := range lists {
+		for _, e := range l {
+			if e = strings.ToLower(strings.TrimSpace(e)); e != "" {
+				all = append(all, e)
+			}
+		}
+	}
+	return all
+}
+
+// changes describes what differs between old and s, one line per setting.
+func (s *settings) changes(old *settings) []string {
+	var changes []string
+	diff := func(name, was, is string) {
+		if was != is {
+			changes = append(changes, fmt.Sprintf("%s: %q -> %q", name, was, is))
+		}
+	}
+	diff("config", old.ConfigFile, s.ConfigFile)
+	diff("paths", strings.Join(old.ScreensPaths, ","), strings.Join(s.ScreensPaths, ","))
+	diff("profile", old.ProfileName, s.ProfileName)
+	diff("backend", old.Profile.Backend, s.Profile.Backend)
+	diff("fallback_profile", old.Profile.FallbackProfile, s.Profile.FallbackProfile)
+	diff("destinations", strings.Join(old.Profile.Destinations, ","), strings.Join(s.Profile.Destinations, ","))
+	diff("destination_policy", old.Profile.DestinationPolicy, s.Profile.DestinationPolicy)
+	diff("s3_bucket", old.Profile.S3Bucket, s.Profile.S3Bucket)
+	diff("s3_region", old.Profile.S3Region, s.Profile.S3Region)
+	diff("s3_prefix", old.Profile.S3Prefix, s.Profile.S3Prefix)
+	diff("s3_endpoint", old.Profile.S3Endpoint, s.Profile.S3Endpoint)
+	diff("s3_presign", old.Profile.S3Presign.String(), s.Profile.S3Presign.String())
+	diff("s3_cache_control", old.Profile.S3CacheControl, s.Profile.S3CacheControl)
+	if old.Profile.S3PathStyle != s.Profile.S3PathStyle {
+		changes = append(changes, fmt.Sprintf("s3_path_style: %t -> %t", old.Profile.S3PathStyle, s.Profile.S3PathStyle))
+	}
+	if old.Profile.S3DisableChecksum != s.Profile.S3DisableChecksum {
+		changes = append(changes, fmt.Sprintf("s3_disable_checksum: %t -> %t", old.Profile.S3DisableChecksum, s.Profile.S3DisableChecksum))
+	}
+	diff("gcs_bucket", old.Profile.GCSBucket, s.Profile.GCSBucket)
+	diff("gcs_prefix", old.Profile.GCSPrefix, s.Profile.GCSPrefix)
+	diff("gcs_acl", old.Profile.GCSACL, s.Profile.GCSACL)
+	if old.Profile.GCSCredentials != s.Profile.GCSCredentials {
+		changes = append(changes, "gcs credentials changed")
+	}
+	diff("azure_container", old.Profile.AzureContainer, s.Profile.AzureContainer)
+	diff("azure_prefix", old.Profile.AzurePrefix, s.Profile.AzurePrefix)
+	diff("azure_account", old.Profile.AzureAccount, s.Profile.AzureAccount)
+	diff("http_url", old.Profile.HTTPURL, s.Profile.HTTPURL)
+	diff("http_expiry", old.Profile.HTTPExpiry.String(), s.Profile.HTTPExpiry.String())
+	diff("http_field", old.Profile.HTTPField, s.Profile.HTTPField)
+	diff("http_url_json", old.Profile.HTTPURLJSON, s.Profile.HTTPURLJSON)
+	diff("http_url_regex", old.Profile.HTTPURLRegex, s.Profile.HTTPURLRegex)
+	if !reflect.DeepEqual(old.Profile.HTTPForm, s.Profile.HTTPForm) || !reflect.DeepEqual(old.Profile.HTTPHeaders, s.Profile.HTTPHeaders) {
+		changes = append(changes, "http form or headers changed")
+	}
+	if old.Profile.AzureConnectionString != s.Profile.AzureConnectionString || old.Profile.AzureSAS != s.Profile.AzureSAS {
+		changes = append(changes, "azure credentials changed")
+	}
+	diff("webdav_url", old.Profile.WebDAVURL, s.Profile.WebDAVURL)
+	diff("webdav_user", old.Profile.WebDAVUser, s.Profile.WebDAVUser)
+	if old.Profile.NextcloudShare != s.Profile.NextcloudShare {
+		changes = append(changes, fmt.Sprintf("nextcloud_share: %t -> %t", old.Profile.NextcloudShare, s.Profile.NextcloudShare))
+	}
+	if old.Profile.WebDAVPassword != s.Profile.WebDAVPassword || old.Profile.WebDAVToken != s.Profile.WebDAVToken {
+		changes = append(changes, "webdav credentials changed")
+	}
+	diff("ftp_host", old.Profile.FTPHost, s.Profile.FTPHost)
+	diff("ftp_user", old.Profile.FTPUser, s.Profile.FTPUser)
+	diff("ftp tls", old.Profile.ftpTLSMode(), s.Profile.ftpTLSMode())
+	if old.Profile.FTPActive != s.Profile.FTPActive {
+		changes = append(changes, fmt.Sprintf("ftp_active: %t -> %t", old.Profile.FTPActive, s.Profile.FTPActive))
+	}
+	if old.Profile.FTPPassword != s.Profile.FTPPassword {
+		changes = append(changes, "ftp password changed")
+	}
+	if old.Profile.ImgurClientID != s.Profile.ImgurClientID || old.Profile.ImgurToken != s.Profile.ImgurToken {
+		changes = append(changes, "imgur credentials changed")
+	}
+	diff("dropbox_folder", old.Profile.DropboxFolder, s.Profile.DropboxFolder)
+	diff("dropbox_app_key", old.Profile.DropboxAppKey, s.Profile.DropboxAppKey)
+	if old.Profile.DropboxToken != s.Profile.DropboxToken || old.Profile.DropboxRefreshToken != s.Profile.DropboxRefreshToken || old.Profile.DropboxAppSecret != s.Profile.DropboxAppSecret {
+		changes = append(changes, "dropbox credentials changed")
+	}
+	diff("gdrive_folder", old.Profile.GDriveFolder, s.Profile.GDriveFolder)
+	diff("gdrive_credentials", old.Profile.GDriveCredentials, s.Profile.GDriveCredentials)
+	diff("gdrive_client_id", old.Profile.GDriveClientID, s.Profile.GDriveClientID)
+	if old.Profile.GDriveClientSecret != s.Profile.GDriveClientSecret || old.Profile.GDriveToken != s.Profile.GDriveToken {
+		changes = append(changes, "gdrive credentials changed")
+	}
+	diff("local_mode", old.Profile.LocalMode, s.Profile.LocalMode)
+	diff("rsync_path", old.Profile.RsyncPath, s.Profile.RsyncPath)
+	diff("b2_bucket", old.Profile.B2Bucket, s.Profile.B2Bucket)
+	diff("b2_prefix", old.Profile.B2Prefix, s.Profile.B2Prefix)
+	diff("b2_key_id", old.Profile.B2KeyID, s.Profile.B2KeyID)
+	if old.Profile.B2ApplicationKey != s.Profile.B2ApplicationKey {
+		changes = append(changes, "b2 application key changed")
+	}
+	diff("onedrive_folder", old.Profile.OneDriveFolder, s.Profile.OneDriveFolder)
+	diff("onedrive_client_id", old.Profile.OneDriveClientID, s.Profile.OneDriveClientID)
+	diff("onedrive_tenant", old.Profile.OneDriveTenant, s.Profile.OneDriveTenant)
+	diff("onedrive_link_scope", old.Profile.OneDriveLinkScope, s.Profile.OneDriveLinkScope)
+	if old.Profile.OneDriveToken != s.Profile.OneDriveToken {
+		changes = append(changes, "onedrive credentials changed")
+	}
+	diff("telegram_chat_id", old.Profile.TelegramChatID, s.Profile.TelegramChatID)
+	diff("telegram_caption", old.Profile.TelegramCaption, s.Profile.TelegramCaption)
+	if old.Profile.TelegramToken != s.Profile.TelegramToken {
+		changes = append(changes, "telegram bot token changed")
+	}
+	diff("ipfs_api", old.Profile.IPFSAPI, s.Profile.IPFSAPI)
+	if old.Profile.IPFSPin != s.Profile.IPFSPin {
+		changes = append(changes, fmt.Sprintf("ipfs_pin: %t -> %t", old.Profile.IPFSPin, s.Profile.IPFSPin))
+	}
+	diff("ipfs_gateway", old.Profile.IPFSGateway, s.Profile.IPFSGateway)
+	diff("ipfs_pin_service", old.Profile.IPFSPinService, s.Profile.IPFSPinService)
+	if old.Profile.IPFSToken != s.Profile.IPFSToken || old.Profile.IPFSPinToken != s.Profile.IPFSPinToken {
+		changes = append(changes, "ipfs credentials changed")
+	}
+	diff("remote_host", old.Profile.RemoteHost, s.Profile.RemoteHost)
+	diff("remote_user", old.Profile.RemoteUser, s.Profile.RemoteUser)
+	if old.Profile.Key != s.Profile.Key {
+		changes = append(changes, "key changed")
+	}
+	diff("jump", old.Profile.Jump, s.Profile.Jump)
+	if old.Profile.JumpKey != s.Profile.JumpKey || old.Profile.JumpPassword != s.Profile.JumpPassword {
+		changes = append(changes, "jump credentials changed")
+	}
+	diff("transport", old.Profile.Transport, s.Profile.Transport)
+	diff("remote_path", old.Profile.RemotePath, s.Profile.RemotePath)
+	diff("base_url", old.Profile.BaseURL, s.Profile.BaseURL)
+	if !reflect.DeepEqual(old.Profile.Routes, s.Profile.Routes) {
+		changes = append(changes, "routes changed")
+	}
+	if !reflect.DeepEqual(old.NetworkRules, s.NetworkRules) || !reflect.DeepEqual(old.RuleProfiles, s.RuleProfiles) {
+		changes = append(changes, "network rules changed")
+	}
+	diff("ciphers", strings.Join(old.Profile.Ciphers, ","), strings.Join(s.Profile.Ciphers, ","))
+	diff("key_exchanges", strings.Join(old.Profile.KeyExchanges, ","), strings.Join(s.Profile.KeyExchanges, ","))
+	diff("host_key_algorithms", strings.Join(old.Profile.HostKeyAlgorithms, ","), strings.Join(s.Profile.HostKeyAlgorithms, ","))
+	diff("macs", strings.Join(old.Profile.MACs, ","), strings.Join(s.Profile.MACs, ","))
+	diff("known_hosts", old.Profile.KnownHosts, s.Profile.KnownHosts)
+	diff("key_passphrase_file", old.Profile.KeyPassphraseFile, s.Profile.KeyPassphraseFile)
+	if old.Profile.Proxy != s.Profile.Proxy {
+		// it may hold a password
+		changes = append(changes, "proxy changed")
+	}
+	diff("tls_ca_file", old.Profile.TLSCAFile, s.Profile.TLSCAFile)
+	if old.Profile.InsecureTLS != s.Profile.InsecureTLS {
+		changes = append(changes, fmt.Sprintf("insecure_tls: %t -> %t", old.Profile.InsecureTLS, s.Profile.InsecureTLS))
+	}
+	diff("dial_timeout", old.Profile.DialTimeout.String(), s.Profile.DialTimeout.String())
+	diff("transfer_timeout", old.Profile.TransferTimeout.String(), s.Profile.TransferTimeout.String())
+	diff("stall_timeout", old.Profile.StallTimeout.String(), s.Profile.StallTimeout.String())
+	diff("keepalive_interval", old.Profile.KeepaliveInterval.String(), s.Profile.KeepaliveInterval.String())
+	if old.Profile.KeepaliveMaxMissed != s.Profile.KeepaliveMaxMissed {
+		changes = append(changes, fmt.Sprintf("keepalive_max_missed: %d -> %d", old.Profile.KeepaliveMaxMissed, s.Profile.KeepaliveMaxMissed))
+	}
+	diff("file_mode", fmt.Sprintf("%o", old.Profile.FileMode), fmt.Sprintf("%o", s.Profile.FileMode))
+	diff("dir_mode", fmt.Sprintf("%o", old.Profile.DirMode), fmt.Sprintf("%o", s.Profile.DirMode))
+	if isTrue(old.Profile.SkipChmod) != isTrue(s.Profile.SkipChmod) {
+		changes = append(changes, fmt.Sprintf("skip_chmod: %t -> %t", isTrue(old.Profile.SkipChmod), isTrue(s.Profile.SkipChmod)))
+	}
+	if old.Profile.SFTPMaxPacket != s.Profile.SFTPMaxPacket || old.Profile.SFTPConcurrentRequests != s.Profile.SFTPConcurrentRequests {
+		changes = append(changes, fmt.Sprintf("sftp_max_packet, sftp_concurrent_requests: %d, %d -> %d, %d", old.Profile.SFTPMaxPacket, old.Profile.SFTPConcurrentRequests, s.Profile.SFTPMaxPacket, s.Profile.SFTPConcurrentRequests))
+	}
+	diff("space_check_threshold", formatSize(uint64(old.Profile.SpaceCheckThreshold)), formatSize(uint64(s.Profile.SpaceCheckThreshold)))
+	diff("space_margin", formatSize(uint64(old.Profile.SpaceMargin)), formatSize(uint64(s.Profile.SpaceMargin)))
+	if old.Profile.Password != s.Profile.Password {
+		changes = append(changes, "password changed")
+	}
+	if isTrue(old.Profile.UseAgent) != isTrue(s.Profile.UseAgent) {
+		changes = append(changes, fmt.Sprintf("use_agent: %t -> %t", isTrue(old.Profile.UseAgent), isTrue(s.Profile.UseAgent)))
+	}
+	if isTrue(old.Profile.InsecureHostKey) != isTrue(s.Profile.InsecureHostKey) {
+		changes = append(changes, fmt.Sprintf("insecure_host_key: %t -> %t", isTrue(old.Profile.InsecureHostKey), isTrue(s.Profile.InsecureHostKey)))
+	}
+	diff("extensions", strings.Join(old.Extensions, ","), strings.Join(s.Extensions, ","))
+	diff("deny_extensions", strings.Join(old.DenyExtensions, ","), strings.Join(s.DenyExtensions, ","))
+	diff("ignore", strings.Join(old.Ignore, ","), strings.Join(s.Ignore, ","))
+	diff("include", strings.Join(old.Include, ","), strings.Join(s.Include, ","))
+	diff("verify", old.Verify, s.Verify)
+	if old.Mkdirs != s.Mkdirs {
+		changes = append(changes, fmt.Sprintf("mkdirs: %t -> %t", old.Mkdirs, s.Mkdirs))
+	}
+	diff("limit_rate", old.LimitRate, s.LimitRate)
+	diff("detect_type", old.DetectType, s.DetectType)
+	diff("max_size", old.MaxSize, s.MaxSize)
+	diff("compress", old.Compress, s.Compress)
+	diff("compress_skip", strings.Join(old.CompressSkip, ","), strings.Join(s.CompressSkip, ","))
+	if old.Retry != s.Retry {
+		changes = append(changes, "retries changed")
+	}
+	if old.Progress != s.Progress {
+		changes = append(changes, "progress reporting changed")
+	}
+	if old.Recursive != s.Recursive {
+		changes = append(changes, fmt.Sprintf("recursive: %t -> %t", old.Recursive, s.Recursive))
+	}
+	if old.Poll != s.Poll {
+		changes = append(changes, fmt.Sprintf("poll: %t -> %t", old.Poll, s.Poll))
+	}
+	diff("poll_interval", old.PollInterval.String(), s.PollInterval.String())
+	diff("missing_path", old.MissingPath, s.MissingPath)
+	diff("missing_path_alert", old.MissingPathAlert.String(), s.MissingPathAlert.String())
+	diff("debounce", old.Debounce.String(), s.Debounce.String())
+	diff("stable_period", old.StablePeriod.String(), s.StablePeriod.String())
+	diff("stable_max_wait", old.StableMaxWait.String(), s.StableMaxWait.String())
+	diff("max_age", old.MaxAge.String(), s.MaxAge.String())
+	if old.MinBytes != s.MinBytes {
+		changes = append(changes, fmt.Sprintf("min_size: %d -> %d", old.MinBytes, s.MinBytes))
+	}
+	diff("tiny_timeout", old.TinyTimeout.String(), s.TinyTimeout.String())
+	if old.ScanOnStart != s.ScanOnStart {
+		changes = append(changes, fmt.Sprintf("scan_on_start: %t -> %t", old.ScanOnStart, s.ScanOnStart))
+	}
+	diff("scan_max_age", old.ScanMaxAge.String(), s.ScanMaxAge.String())
+	diff("while_paused", old.WhilePaused, s.WhilePaused)
+	diff("archive_dir", old.ArchiveDir, s.ArchiveDir)
+	diff("naming", old.Naming, s.Naming)
+	diff("name_template", old.NameTemplate, s.NameTemplate)
+	diff("counter_prefix", old.CounterPrefix, s.CounterPrefix)
+	diff("date_dirs", old.DateDirs, s.DateDirs)
+	diff("batch_separator", fmt.Sprintf("%q", old.BatchSeparator), fmt.Sprintf("%q", s.BatchSeparator))
+	if old.HashLength != s.HashLength {
+		changes = append(changes, fmt.Sprintf("hash_length: %d -> %d", old.HashLength, s.HashLength))
+	}
+	if old.AllowGuessableNames != s.AllowGuessableNames {
+		changes = append(changes, fmt.Sprintf("allow_guessable_names: %t -> %t", old.AllowGuessableNames, s.AllowGuessableNames))
+	}
+	if old.CounterDigits != s.CounterDigits {
+		changes = append(changes, fmt.Sprintf("counter_digits: %d -> %d", old.CounterDigits, s.CounterDigits))
+	}
+	if old.Workers != s.Workers {
+		changes = append(changes, fmt.Sprintf("workers: %d -> %d", old.Workers, s.Workers))
+	}
+	if old.PauseNotifications != s.PauseNotifications {
+		changes = append(changes, fmt.Sprintf("pause_notifications: %t -> %t", old.PauseNotifications, s.PauseNotifications))
+	}
+	if old.NoDedup != s.NoDedup {
+		changes = append(changes, fmt.Sprintf("no_dedup: %t -> %t", old.NoDedup, s.NoDedup))
+	}
+	if old.MoveTooLarge != s.MoveTooLarge {
+		changes = append(changes, fmt.Sprintf("move_too_large: %t -> %t", old.MoveTooLarge, s.MoveTooLarge))
+	}
+	if old.BundleOver != s.BundleOver {
+		changes = append(changes, fmt.Sprintf("bundle_over: %d -> %d", old.BundleOver, s.BundleOver))
+	}
+	diff("bundle_window", old.BundleWindow.String(), s.BundleWindow.String())
+	if old.MaxUploads != s.MaxUploads {
+		changes = append(changes, fmt.Sprintf("max_uploads: %d -> %d", old.MaxUploads, s.MaxUploads))
+	}
+	diff("max_uploads_per", old.MaxUploadsPer.String(), s.MaxUploadsPer.String())
+	diff("over_max_uploads", old.OverMaxUploads, s.OverMaxUploads)
+	if old.QuarantineAfter != s.QuarantineAfter {
+		changes = append(changes, fmt.Sprintf("quarantine_after: %d -> %d", old.QuarantineAfter, s.QuarantineAfter))
+	}
+	if old.NoQuarantine != s.NoQuarantine {
+		changes = append(changes, fmt.Sprintf("no_quarantine: %t -> %t", old.NoQuarantine, s.NoQuarantine))
+	}
+	if old.NoNameCheck != s.NoNameCheck {
+		changes = append(changes, fmt.Sprintf("no_name_check: %t -> %t", old.NoNameCheck, s.NoNameCheck))
+	}
+	if old.KeepLocal != s.KeepLocal {
+		changes = append(changes, fmt.Sprintf("keep_local: %t -> %t", old.KeepLocal, s.KeepLocal))
+	}
+	diff("delete_after", old.DeleteAfter.String(), s.DeleteAfter.String())
+	if old.Trash != s.Trash {
+		changes = append(changes, fmt.Sprintf("trash: %t -> %t", old.Trash, s.Trash))
+	}
+	if !reflect.DeepEqual(old.AfterUpload, s.AfterUpload) {
+		changes = append(changes, "after_upload changed")
+	}
+	if old.Debug != s.Debug {
+		changes = append(changes, fmt.Sprintf("debug: %t -> %t", old.Debug, s.Debug))
+	}
+	if old.DryRun != s.DryRun {
+		changes = append(changes, fmt.Sprintf("dry_run: %t -> %t", old.DryRun, s.DryRun))
+	}
+	if old.NoPersistentConn != s.NoPersistentConn {
+		changes = append(changes, fmt.Sprintf("no_persistent_conn: %t -> %t", old.NoPersistentConn, s.NoPersistentConn))
+	}
+	return changes
+}
+
+// reload re-reads the config file and swaps in the new settings. Invalid
+// settings are logged and the old ones stay in use. Uploads that already
+// started keep using the settings they grabbed.
+func reload() {
+	old := currentSettings()
+	s, err := loadSettings(cli, os.Getenv)
+	if err != nil {
+		log.Println("reload rejected, keeping old settings:", err)
+		return
+	}
+	if err := unlockCredentials(s, false); err != nil {
+		log.Println("reload rejected, keeping old settings:", err)
+		return
+	}
+	if err := checkBackends(s); err != nil {
+		log.Println("reload rejected, keeping old settings:", err)
+		return
+	}
+
+	if !reflect.DeepEqual(s.ScreensPaths, old.ScreensPaths) || s.Recursive != old.Recursive || !reflect.DeepEqual(s.Ignore, old.Ignore) || s.Poll != old.Poll {
+		if err := watchPaths(s); err != nil {
+			log.Println("reload rejected, can't watch new path:", err)
+			return
+		}
+	}
+
+	current.Store(s)
+	startWorkers(s.Workers)
+	uploadLimiter.setRate(s.RateLimit)
+
+	changes := s.changes(old)
+	if len(changes) == 0 {
+		log.Println("reloaded settings, nothing changed")
+		return
+	}
+	log.Println("reloaded settings:", strings.Join(changes, ", "))
+}
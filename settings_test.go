@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadTestSettings resolves settings from the command line values c, the
+// environment env and a config file holding config
+func loadTestSettings(t *testing.T, c settings, env map[string]string, config string) *settings {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "skrins-settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	screens := filepath.Join(dir, "screens")
+	if err := os.Mkdir(screens, 0700); err != nil {
+		t.Fatal(err)
+	}
+	c.ConfigFile = filepath.Join(dir, "config.toml")
+	config = "path = " + quoteTOML(screens) + "\n" + config
+	if err := ioutil.WriteFile(c.ConfigFile, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := loadSettings(c, func(name string) string { return env[name] })
+	var invalid *settingsError
+	if err != nil && !errors.As(err, &invalid) {
+		t.Fatal(err)
+	}
+	// settings with problems are resolved all the same, a missing key
+	// doesn't matter here
+	return s
+}
+
+// quoteTOML quotes s as a TOML literal string
+func quoteTOML(s string) string {
+	return "'" + s + "'"
+}
+
+func TestStringPrecedence(t *testing.T) {
+	env := map[string]string{
+		"SKRINS_REMOTE_HOST": "env.example.com:22",
+		"SKRINS_BASE_URL":    "https://env.example.com/",
+	}
+	file := `
+remote_host = "file.example.com:22"
+base_url    = "https://file.example.com/"
+`
+	tests := []struct {
+		name     string
+		flag     profile
+		env      map[string]string
+		file     string
+		wantHost string
+		wantURL  string
+	}{
+		{"file only", profile{}, nil, file, "file.example.com:22", "https://file.example.com/"},
+		{"env over file", profile{}, env, file, "env.example.com:22", "https://env.example.com/"},
+		{"flag over env", profile{RemoteHost: "flag.example.com:22", BaseURL: "https://flag.example.com/"}, env, file, "flag.example.com:22", "https://flag.example.com/"},
+		{"flag over file", profile{RemoteHost: "flag.example.com:22"}, nil, file, "flag.example.com:22", "https://file.example.com/"},
+		{"env without file", profile{}, env, "", "env.example.com:22", "https://env.example.com/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := loadTestSettings(t, settings{Profile: tt.flag}, tt.env, tt.file)
+			if s.Profile.RemoteHost != tt.wantHost {
+				t.Errorf("remote_host = %q, want %q", s.Profile.RemoteHost, tt.wantHost)
+			}
+			if s.Profile.BaseURL != tt.wantURL {
+				t.Errorf("base_url = %q, want %q", s.Profile.BaseURL, tt.wantURL)
+			}
+		})
+	}
+}
+
+func TestPathPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skrins-paths")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	flagPath, envPath := filepath.Join(dir, "flag"), filepath.Join(dir, "env")
+
+	s := loadTestSettings(t, settings{}, map[string]string{"SKRINS_PATH": envPath}, "")
+	if len(s.ScreensPaths) != 1 || s.ScreensPaths[0] != envPath {
+		t.Errorf("SKRINS_PATH over path: got %v, want [%s]", s.ScreensPaths, envPath)
+	}
+	s = loadTestSettings(t, settings{ScreensPaths: []string{flagPath}}, map[string]string{"SKRINS_PATH": envPath}, "")
+	if len(s.ScreensPaths) != 1 || s.ScreensPaths[0] != flagPath {
+		t.Errorf("-p over SKRINS_PATH: got %v, want [%s]", s.ScreensPaths, flagPath)
+	}
+}
+
+func TestBoolPrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		flag settings
+		file string
+		want func(*settings) bool
+		ok   bool
+	}{
+		{"recursive unset", settings{}, "", func(s *settings) bool { return s.Recursive }, false},
+		{"recursive from file", settings{}, "recursive = true", func(s *settings) bool { return s.Recursive }, true},
+		{"recursive from flag", settings{Recursive: true}, "recursive = false", func(s *settings) bool { return s.Recursive }, true},
+		{"keep_local from file", settings{}, "keep_local = true", func(s *settings) bool { return s.KeepLocal }, true},
+		// -mkdirs is on by default, the file can turn it off unless the
+		// flag was given
+		{"mkdirs default", settings{Mkdirs: true}, "", func(s *settings) bool { return s.Mkdirs }, true},
+		{"mkdirs off in file", settings{Mkdirs: true}, "mkdirs = false", func(s *settings) bool { return s.Mkdirs }, false},
+		{"mkdirs flag over file", settings{Mkdirs: true, MkdirsSet: true}, "mkdirs = false", func(s *settings) bool { return s.Mkdirs }, true},
+		{"mkdirs off flag over file", settings{Mkdirs: false, MkdirsSet: true}, "mkdirs = true", func(s *settings) bool { return s.Mkdirs }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := loadTestSettings(t, tt.flag, nil, tt.file)
+			if got := tt.want(s); got != tt.ok {
+				t.Errorf("got %t, want %t", got, tt.ok)
+			}
+		})
+	}
+}
+
+func TestDurationPrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		flag settings
+		file string
+		get  func(*settings) time.Duration
+		want time.Duration
+	}{
+		{"delete_after unset", settings{}, "", func(s *settings) time.Duration { return s.DeleteAfter }, 0},
+		{"delete_after from file", settings{}, `delete_after = "2m"`, func(s *settings) time.Duration { return s.DeleteAfter }, 2 * time.Minute},
+		{"delete_after flag over file", settings{DeleteAfter: time.Minute}, `delete_after = "2m"`, func(s *settings) time.Duration { return s.DeleteAfter }, time.Minute},
+		{"debounce default", settings{}, "", func(s *settings) time.Duration { return s.Debounce }, defaultDebounce},
+		{"debounce from file", settings{}, `debounce = "50ms"`, func(s *settings) time.Duration { return s.Debounce }, 50 * time.Millisecond},
+		{"debounce flag over file", settings{Debounce: time.Second}, `debounce = "50ms"`, func(s *settings) time.Duration { return s.Debounce }, time.Second},
+		{"stall_timeout from file", settings{}, `stall_timeout = "7s"`, func(s *settings) time.Duration { return s.Profile.StallTimeout.Duration }, 7 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := loadTestSettings(t, tt.flag, nil, tt.file)
+			if got := tt.get(s); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMinSize(t *testing.T) {
+	if s := loadTestSettings(t, settings{}, nil, ""); s.MinBytes != defaultMinSize {
+		t.Errorf("min_size unset: got %d, want %d", s.MinBytes, defaultMinSize)
+	}
+	if s := loadTestSettings(t, settings{}, nil, "min_size = 0"); s.MinBytes != 0 {
+		t.Errorf("min_size = 0: got %d, want no minimum", s.MinBytes)
+	}
+	if s := loadTestSettings(t, settings{}, nil, `min_size = "1K"`); s.MinBytes != 1024 {
+		t.Errorf(`min_size = "1K": got %d, want 1024`, s.MinBytes)
+	}
+}
+
+func TestNamedProfile(t *testing.T) {
+	file := `
+remote_host = "top.example.com:22"
+base_url    = "https://top.example.com/"
+default_profile = "work"
+
+[profiles.work]
+base_url = "https://work.example.com/"
+`
+	s := loadTestSettings(t, settings{}, nil, file)
+	if s.Profile.BaseURL != "https://work.example.com/" {
+		t.Errorf("base_url = %q, want the profile's", s.Profile.BaseURL)
+	}
+	if s.Profile.RemoteHost != "top.example.com:22" {
+		t.Errorf("remote_host = %q, want the top level one", s.Profile.RemoteHost)
+	}
+}
+
+// a profile may turn off what the top level turns on, and a flag wins over
+// both
+func TestNamedProfileBools(t *testing.T) {
+	tests := []struct {
+		name    string
+		flag    settings
+		profile string
+		want    bool
+	}{
+		{"from the top level", settings{}, "", true},
+		{"off in the profile", settings{}, "insecure_host_key = false", false},
+		{"on in the profile", settings{}, "insecure_host_key = true", true},
+		{"off by flag", settings{Profile: profile{InsecureHostKey: boolPtr(false)}}, "insecure_host_key = true", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := `
+insecure_host_key = true
+use_agent         = true
+skip_chmod        = true
+allow_insecure    = true
+default_profile   = "work"
+
+[profiles.work]
+` + tt.profile + "\n"
+			s := loadTestSettings(t, tt.flag, nil, file)
+			if got := isTrue(s.Profile.InsecureHostKey); got != tt.want {
+				t.Errorf("insecure_host_key = %t, want %t", got, tt.want)
+			}
+			if !isTrue(s.Profile.UseAgent) || !isTrue(s.Profile.SkipChmod) || !isTrue(s.Profile.AllowInsecure) {
+				t.Errorf("the other top level settings weren't kept: %+v", s.Profile)
+			}
+		})
+	}
+
+	file := `
+use_agent       = true
+skip_chmod      = true
+allow_insecure  = true
+default_profile = "work"
+
+[profiles.work]
+use_agent      = false
+skip_chmod     = false
+allow_insecure = false
+`
+	s := loadTestSettings(t, settings{}, nil, file)
+	if isTrue(s.Profile.UseAgent) || isTrue(s.Profile.SkipChmod) || isTrue(s.Profile.AllowInsecure) {
+		t.Errorf("the profile didn't turn the settings off: use_agent %t, skip_chmod %t, allow_insecure %t",
+			isTrue(s.Profile.UseAgent), isTrue(s.Profile.SkipChmod), isTrue(s.Profile.AllowInsecure))
+	}
+}
+
+// setNonZero sets v to a value that isn't its zero value
+func setNonZero(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString("x")
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(1)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(1)
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(1)
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+		setNonZero(v.Index(0))
+	case reflect.Map:
+		m := reflect.MakeMap(v.Type())
+		key, elem := reflect.New(v.Type().Key()).Elem(), reflect.New(v.Type().Elem()).Elem()
+		setNonZero(key)
+		setNonZero(elem)
+		m.SetMapIndex(key, elem)
+		v.Set(m)
+	case reflect.Ptr:
+		v.Set(reflect.New(v.Type().Elem()))
+		setNonZero(v.Elem())
+	case reflect.Struct:
+		setNonZero(v.Field(0))
+	}
+}
+
+// TestProfileFieldsCovered makes sure every setting of a profile is taken
+// over from the top level by merge and reported by changes when it's
+// reloaded, so a new key can't be forgotten in either
+func TestProfileFieldsCovered(t *testing.T) {
+	typ := reflect.TypeOf(profile{})
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		key := strings.Split(field.Tag.Get("toml"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		var set profile
+		setNonZero(reflect.ValueOf(&set).Elem().Field(i))
+
+		var merged profile
+		merged.merge(set)
+		if reflect.ValueOf(merged).Field(i).IsZero() {
+			t.Errorf("merge leaves out %s", key)
+		}
+		if changes := (&settings{Profile: set}).changes(&settings{}); len(changes) == 0 {
+			t.Errorf("changes leaves out %s", key)
+		}
+	}
+}
+
+// TestSettingsFieldsCovered is TestProfileFieldsCovered for the settings
+// around the profile
+func TestSettingsFieldsCovered(t *testing.T) {
+	// reported as the setting they come from
+	derived := map[string]bool{"AutoPath": true, "MaxBytes": true, "MkdirsSet": true, "RateLimit": true}
+	typ := reflect.TypeOf(settings{})
+	for i := 0; i < typ.NumField(); i++ {
+		if derived[typ.Field(i).Name] {
+			continue
+		}
+		var set settings
+		setNonZero(reflect.ValueOf(&set).Elem().Field(i))
+		if changes := set.changes(&settings{}); len(changes) == 0 {
+			t.Errorf("changes leaves out %s", typ.Field(i).Name)
+		}
+	}
+}
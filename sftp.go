@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lithammer/shortuuid/v3"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// newSFTPClient creates new sFTP client connected to p's remote host
+func newSFTPClient(p profile) (*sftpConn, error) {
+	var conn net.Conn
+	var err error
+	if p.Jump != "" {
+		conn, err = dialThroughJumps(p)
+	} else {
+		conn, err = dialRemote(p)
+	}
+	if err != nil {
+		return nil, withTimeout(err, "dial", p)
+	}
+	// the deadline covers the SSH handshake and starting SFTP, uploads get
+	// their own
+	conn.SetDeadline(time.Now().Add(p.DialTimeout.Duration))
+	client, err := sshHandshake(p, conn)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newSFTPConn(p, client)
+	if err != nil {
+		return nil, withTimeout(err, "handshake", p)
+	}
+	conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// sshHandshake authenticates to p's remote host over conn, checking its
+// host key. conn is closed when that fails.
+func sshHandshake(p profile, conn net.Conn) (*ssh.Client, error) {
+	hostKeys, knownTypes, err := hostKeyCallback(p, p.RemoteHost)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	auth, authNames, authUsed, authDone, err := authMethods(p)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	defer authDone.Close()
+
+	config := &ssh.ClientConfig{
+		User:            p.RemoteUser,
+		Auth:            auth,
+		HostKeyCallback: hostKeys,
+	}
+	applyAlgorithms(config, p)
+	if len(config.HostKeyAlgorithms) == 0 {
+		config.HostKeyAlgorithms = knownTypes
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, p.RemoteHost, config)
+	if err != nil {
+		conn.Close()
+		if strings.Contains(err.Error(), "unable to authenticate") {
+			return nil, fmt.Errorf("authentication as %s@%s failed, tried %s: %w", p.RemoteUser, p.RemoteHost, strings.Join(authNames, ", "), err)
+		}
+		return nil, withTimeout(err, "handshake", p)
+	}
+	if *authUsed != "" {
+		log.Printf("authenticated as %s@%s with %s", p.RemoteUser, p.RemoteHost, *authUsed)
+	}
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// withTimeout turns err into a *timeoutError for op when it's a timeout
+func withTimeout(err error, op string, p profile) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return &timeoutError{Op: op, Host: p.RemoteHost, After: p.DialTimeout.Duration, Err: err}
+	}
+	return err
+}
+
+// uploadOptions are the settings that change how a file gets uploaded
+type uploadOptions struct {
+	// Persistent keeps the connection open for the next upload
+	Persistent bool
+	// Mkdirs creates missing remote directories
+	Mkdirs bool
+	// Verify is how uploads are checked, verifySize or verifySHA256
+	Verify string
+	// Progress is when progress is reported
+	Progress progressOptions
+}
+
+// uploadObjectToDestination uploads file to a remote host, dest is the full
+// remote path
+func uploadObjectToDestination(ctx context.Context, p profile, src, dest string, opts uploadOptions) error {
+	copyFile := func(c *sftpConn) error {
+		if c.transport() == transportSCP {
+			return scpCopyToRemote(c, p, src, dest, opts)
+		}
+		if opts.Mkdirs {
+			if err := mkdirAllRemote(c.Client, path.Dir(dest), p.dirMode()); err != nil {
+				return err
+			}
+		}
+		size, err := localSize(src)
+		if err != nil {
+			return err
+		}
+		if err := checkFreeSpace(c.Client, p, path.Dir(dest), size); err != nil {
+			return err
+		}
+		return copyToRemote(c, p, src, dest, opts)
+	}
+	if opts.Persistent {
+		return conns.withClient(ctx, p, copyFile)
+	}
+	return withNewClient(ctx, p, copyFile)
+}
+
+// compressObjectToDestination uploads file gzipped to a remote host like
+// uploadObjectToDestination, which takes SFTP. The free space needed is
+// taken to be the size of the file, it's less once compressed.
+func compressObjectToDestination(ctx context.Context, p profile, src, dest string, opts uploadOptions) error {
+	copyFile := func(c *sftpConn) error {
+		if c.transport() == transportSCP {
+			return errNoSCPCompression
+		}
+		if opts.Mkdirs {
+			if err := mkdirAllRemote(c.Client, path.Dir(dest), p.dirMode()); err != nil {
+				return err
+			}
+		}
+		size, err := localSize(src)
+		if err != nil {
+			return err
+		}
+		if err := checkFreeSpace(c.Client, p, path.Dir(dest), size); err != nil {
+			return err
+		}
+		return compressToRemote(c, p, src, dest, opts)
+	}
+	if opts.Persistent {
+		return conns.withClient(ctx, p, copyFile)
+	}
+	return withNewClient(ctx, p, copyFile)
+}
+
+// fileMode is what uploaded files get chmodded to, 0 for leaving them be
+func (p profile) fileMode() os.FileMode {
+	if isTrue(p.SkipChmod) {
+		return 0
+	}
+	return os.FileMode(p.FileMode)
+}
+
+// dirMode is what created directories get chmodded to, 0 for leaving them be
+func (p profile) dirMode() os.FileMode {
+	if isTrue(p.SkipChmod) {
+		return 0
+	}
+	return os.FileMode(p.DirMode)
+}
+
+// chmodRemote sets the mode of name unless mode is 0. Some chrooted servers
+// refuse, which is only logged since the file itself is fine.
+func chmodRemote(client *sftp.Client, name string, mode os.FileMode) {
+	if mode == 0 {
+		return
+	}
+	if err := client.Chmod(name, mode); err != nil {
+		log.Printf("can't chmod %s to %o: %v", name, mode, err)
+	}
+}
+
+// mkdirAllRemote creates dir and every missing parent on the server,
+// chmodding the ones it created to mode. Directories created at the same
+// time by someone else are fine.
+func mkdirAllRemote(client *sftp.Client, dir string, mode os.FileMode) error {
+	fi, err := client.Stat(dir)
+	if err == nil {
+		if !fi.IsDir() {
+			return fmt.Errorf("can't create directory %s, it's a file", dir)
+		}
+		return nil
+	}
+
+	// a file in place of a parent makes Stat fail with a generic error, so
+	// parents are looked at first to report that
+	if parent := path.Dir(dir); parent != dir {
+		if err := mkdirAllRemote(client, parent, mode); err != nil {
+			return err
+		}
+	}
+	if !os.IsNotExist(err) {
+		return remoteDirError(dir, err)
+	}
+	if err := client.Mkdir(dir); err != nil {
+		if fi, statErr := client.Stat(dir); statErr == nil && fi.IsDir() {
+			return nil
+		}
+		return remoteDirError(dir, err)
+	}
+	debugf("created remote directory %s", dir)
+	chmodRemote(client, dir, mode)
+	return nil
+}
+
+// remoteDirError describes why dir couldn't be created
+func remoteDirError(dir string, err error) error {
+	var status *sftp.StatusError
+	if os.IsPermission(err) || errors.As(err, &status) && status.Code == sshFxPermissionDenied {
+		return fmt.Errorf("permission denied creating directory %s: %w", dir, err)
+	}
+	return fmt.Errorf("can't create directory %s: %w", dir, err)
+}
+
+// sshFxPermissionDenied is the SFTP status code for SSH_FX_PERMISSION_DENIED
+const sshFxPermissionDenied = 3
+
+// defaultFileMode lets web servers read uploaded files
+const defaultFileMode = 0644
+
+// tempSuffix marks files that are still being uploaded
+const tempSuffix = ".tmp-"
+
+// tempName matches the names of temporary files, tempSuffix and the
+// shortuuid after it at the end
+var tempName = regexp.MustCompile(regexp.QuoteMeta(tempSuffix) + "[" + shortuuid.DefaultAlphabet + "]{22}$")
+
+// staleTempAge is how old a temporary file has to be before it's taken for
+// the leftover of a crashed upload rather than one still in progress
+const staleTempAge = time.Hour
+
+// copyToRemote copies the local file src to dest on the server under a
+// temporary name, renamed to dest with p's file mode once its size, and with
+// verifySHA256 its checksum, are checked, so dest's URL never serves half a
+// file; a copy that breaks off continues where it stopped the next time src
+// is uploaded to the same server, even after a restart.
+func copyToRemote(c *sftpConn, p profile, src, dest string, opts uploadOptions) error {
+	client := c.Client
+
+	// open local file
+	srcReader, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcReader.Close()
+	fi, err := srcReader.Stat()
+	if err != nil {
+		return err
+	}
+
+	server := p.RemoteUser + "@" + p.RemoteHost
+	tmp, offset := resumeUpload(client, src, fi, server, path.Dir(dest))
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_WRONLY
+	} else {
+		tmp = dest + tempSuffix + shortuuid.New()
+	}
+
+	// create temporary destination file
+	dstFile, err := client.OpenFile(tmp, flags)
+	if err != nil {
+		return err
+	}
+
+	// copy source file to destination file, hashing it on the way. When
+	// resuming, the part already uploaded is only hashed.
+	hash := sha256.New()
+	if offset > 0 {
+		log.Printf("resuming upload of %s at %d of %d bytes", src, offset, fi.Size())
+		if _, err = io.CopyN(hash, srcReader, offset); err == nil {
+			_, err = dstFile.Seek(offset, io.SeekStart)
+		}
+	}
+	t := startTransfer(src, fi.Size(), offset, opts.Progress)
+	defer t.finish()
+	if err == nil {
+		// ReadFrom keeps several packets in flight, with a single buffer
+		// of sftp_max_packet bytes
+		r := io.TeeReader(limitedReader{srcReader, uploadLimiter}, hash)
+		_, err = dstFile.ReadFrom(progressReader{progressTracker{r, t}, c})
+	}
+	if closeErr := dstFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// the temporary file stays for the next attempt to continue
+		saveResumePoint(src, resumePoint{Server: server, Temp: tmp, Size: fi.Size(), ModTime: fi.ModTime()})
+		return err
+	}
+
+	// a full quota or a truncated write doesn't always make the copy fail
+	err = checkRemoteSize(client, tmp, fi.Size())
+	digest := hex.EncodeToString(hash.Sum(nil))
+	if err == nil && opts.Verify == verifySHA256 {
+		err = checkRemoteSHA256(c, tmp, digest)
+	}
+	if err == nil {
+		chmodRemote(client, tmp, p.fileMode())
+		err = renameRemote(client, tmp, dest)
+	}
+	clearResumePoint(src)
+	if err != nil {
+		client.Remove(tmp)
+		return err
+	}
+
+	log.Println(t.summary())
+	debugf("sha256 of %s: %s", dest, digest)
+	removeStaleTempFiles(client, path.Dir(dest))
+
+	return nil
+}
+
+// compressToRemote is copyToRemote for src gzipped on the way, the copy is
+// checked against what came out of gzip. It's started over when it breaks
+// off, a stream can't be resumed.
+func compressToRemote(c *sftpConn, p profile, src, dest string, opts uploadOptions) error {
+	client := c.Client
+	in, err := gzipReader(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := dest + tempSuffix + shortuuid.New()
+	dstFile, err := client.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	t := startTransfer(src, 0, 0, opts.Progress)
+	defer t.finish()
+	r := io.TeeReader(limitedReader{in, uploadLimiter}, hash)
+	size, err := dstFile.ReadFrom(progressReader{progressTracker{r, t}, c})
+	if closeErr := dstFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = checkRemoteSize(client, tmp, size)
+	}
+	digest := hex.EncodeToString(hash.Sum(nil))
+	if err == nil && opts.Verify == verifySHA256 {
+		err = checkRemoteSHA256(c, tmp, digest)
+	}
+	if err == nil {
+		chmodRemote(client, tmp, p.fileMode())
+		err = renameRemote(client, tmp, dest)
+	}
+	if err != nil {
+		client.Remove(tmp)
+		return err
+	}
+
+	// the compressed size is only known now
+	t.finish()
+	t.Size = size
+	log.Println(t.summary())
+	debugf("sha256 of %s: %s", dest, digest)
+	removeStaleTempFiles(client, path.Dir(dest))
+	return nil
+}
+
+// resumeUpload finds the temporary file of an earlier, broken off upload of
+// src to dir on server and how much of it made it there. The offset is 0
+// when there's nothing to resume.
+func resumeUpload(client *sftp.Client, src string, fi os.FileInfo, server, dir string) (string, int64) {
+	rp, ok := resumePointFor(src, fi, server)
+	if !ok || path.Dir(rp.Temp) != dir {
+		return "", 0
+	}
+	remote, err := client.Stat(rp.Temp)
+	if err != nil || remote.Size() > fi.Size() {
+		clearResumePoint(src)
+		return "", 0
+	}
+	return rp.Temp, remote.Size()
+}
+
+// sizeMismatchError is returned when the uploaded file doesn't have the size
+// of the local one
+type sizeMismatchError struct {
+	Name       string
+	Got, Local int64
+}
+
+func (e *sizeMismatchError) Error() string {
+	return fmt.Sprintf("%s has %d bytes on the server instead of %d", e.Name, e.Got, e.Local)
+}
+
+// checkRemoteSize makes sure name on the server is size bytes long
+func checkRemoteSize(client *sftp.Client, name string, size int64) error {
+	fi, err := client.Stat(name)
+	if err != nil {
+		return err
+	}
+	if fi.Size() != size {
+		return &sizeMismatchError{Name: name, Got: fi.Size(), Local: size}
+	}
+	return nil
+}
+
+// renameRemote moves oldname to newname on the server, with the
+// posix-rename@openssh.com extension where the server has it
+func renameRemote(client *sftp.Client, oldname, newname string) error {
+	err := client.PosixRename(oldname, newname)
+	if err == nil {
+		return nil
+	}
+	debugf("posix rename failed, falling back to rename: %v", err)
+	return client.Rename(oldname, newname)
+}
+
+// cleanedDirs remembers the remote directories already cleaned of stale
+// temporary files
+var cleanedDirs sync.Map
+
+// removeStaleTempFiles deletes temporary files crashed uploads left in dir.
+// Every directory is only looked at once per run.
+func removeStaleTempFiles(client *sftp.Client, dir string) {
+	if _, done := cleanedDirs.LoadOrStore(dir, true); done {
+		return
+	}
+	files, err := client.ReadDir(dir)
+	if err != nil {
+		debugf("can't look for stale temporary files in %s: %v", dir, err)
+		return
+	}
+	for _, f := range files {
+		if f.IsDir() || !tempName.MatchString(f.Name()) || time.Since(f.ModTime()) < staleTempAge {
+			continue
+		}
+		name := path.Join(dir, f.Name())
+		if err := client.Remove(name); err != nil {
+			log.Printf("can't remove stale temporary file %s: %v", name, err)
+			continue
+		}
+		log.Println("removed stale temporary file", name)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lithammer/shortuuid/v3"
+	"github.com/pkg/sftp"
+)
+
+// pipeConn is one end of an SFTP session over pipes
+type pipeConn struct {
+	io.Reader
+	io.WriteCloser
+}
+
+// memSFTP connects to an SFTP server in memory that serves with h, and
+// keeps the state of partial uploads in a temporary directory
+func memSFTP(t testing.TB, h sftp.Handlers, opts ...sftp.ClientOption) *sftpConn {
+	t.Helper()
+	tempStateDir(t)
+	toServer, fromClient := io.Pipe()
+	toClient, fromServer := io.Pipe()
+	server := sftp.NewRequestServer(pipeConn{toServer, fromServer}, h)
+	go server.Serve()
+	client, err := sftp.NewClientPipe(toClient, fromClient, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		// the client waits for the server to hang up first
+		server.Close()
+		client.Close()
+	})
+	if err := client.Mkdir("/i"); err != nil {
+		t.Fatal(err)
+	}
+	return &sftpConn{Client: client, dead: make(chan struct{})}
+}
+
+// tempStateDir points stateDir to a temporary directory for t
+func tempStateDir(t testing.TB) {
+	dir, err := ioutil.TempDir("", "skrins-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"XDG_STATE_HOME", "HOME", "LOCALAPPDATA"} {
+		old, set := os.LookupEnv(name)
+		os.Setenv(name, dir)
+		name := name
+		t.Cleanup(func() {
+			if set {
+				os.Setenv(name, old)
+			} else {
+				os.Unsetenv(name)
+			}
+		})
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+}
+
+// localFile is a file of size bytes to upload
+func localFile(t testing.TB, size int) (string, []byte) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "skrins-sftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	data := bytes.Repeat([]byte("skrins!"), size/7+1)[:size]
+	path := filepath.Join(dir, "shot.png")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+// noPosixRename is a server without posix-rename@openssh.com. The request
+// server handles it as a rename too, so the first rename of every upload is
+// refused.
+type noPosixRename struct {
+	sftp.FileCmder
+	mu      sync.Mutex
+	renames int
+}
+
+func (c *noPosixRename) Filecmd(r *sftp.Request) error {
+	if r.Method == "Rename" {
+		c.mu.Lock()
+		c.renames++
+		first := c.renames%2 == 1
+		c.mu.Unlock()
+		if first {
+			return sftp.ErrSSHFxOpUnsupported
+		}
+	}
+	return c.FileCmder.Filecmd(r)
+}
+
+// shortWrites is a server that says it wrote everything but keeps no more
+// than limit bytes of a file, like one with a full quota
+type shortWrites struct {
+	sftp.FileWriter
+	limit int64
+}
+
+func (w shortWrites) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	wa, err := w.FileWriter.Filewrite(r)
+	if err != nil {
+		return nil, err
+	}
+	return limitedWriterAt{wa, w.limit}, nil
+}
+
+type limitedWriterAt struct {
+	io.WriterAt
+	limit int64
+}
+
+func (w limitedWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	n := len(p)
+	if off >= w.limit {
+		return n, nil
+	}
+	if off+int64(n) > w.limit {
+		p = p[:w.limit-off]
+	}
+	if _, err := w.WriterAt.WriteAt(p, off); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// slowWrites is a server that takes delay for every write it's sent, like
+// one far away, so requests in flight at once make up for it
+type slowWrites struct {
+	sftp.FileWriter
+	delay time.Duration
+}
+
+func (w slowWrites) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	wa, err := w.FileWriter.Filewrite(r)
+	if err != nil {
+		return nil, err
+	}
+	return slowWriterAt{wa, w.delay}, nil
+}
+
+type slowWriterAt struct {
+	io.WriterAt
+	delay time.Duration
+}
+
+func (w slowWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	time.Sleep(w.delay)
+	return w.WriterAt.WriteAt(p, off)
+}
+
+// remoteFiles are the names of the files in /i on the server
+func remoteFiles(t *testing.T, c *sftpConn) []string {
+	t.Helper()
+	files, err := c.ReadDir("/i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	return names
+}
+
+func TestCopyToRemote(t *testing.T) {
+	c := memSFTP(t, sftp.InMemHandler())
+	src, data := localFile(t, 100000)
+	if err := copyToRemote(c, profile{}, src, "/i/abc.png", uploadOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.Open("/i/abc.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer got.Close()
+	uploaded, err := ioutil.ReadAll(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(uploaded, data) {
+		t.Errorf("uploaded %d bytes that aren't the %d of the file", len(uploaded), len(data))
+	}
+	if names := remoteFiles(t, c); len(names) != 1 {
+		t.Errorf("files on the server %v, want only abc.png", names)
+	}
+}
+
+func TestPosixRenameFallback(t *testing.T) {
+	h := sftp.InMemHandler()
+	cmds := &noPosixRename{FileCmder: h.FileCmd}
+	h.FileCmd = cmds
+	c := memSFTP(t, h)
+	src, _ := localFile(t, 5000)
+	if err := copyToRemote(c, profile{}, src, "/i/abc.png", uploadOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if cmds.renames != 2 {
+		t.Errorf("%d renames, want the posix one and the plain one", cmds.renames)
+	}
+	fi, err := c.Stat("/i/abc.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 5000 {
+		t.Errorf("abc.png has %d bytes, want 5000", fi.Size())
+	}
+	if names := remoteFiles(t, c); len(names) != 1 {
+		t.Errorf("files on the server %v, want the temporary file renamed", names)
+	}
+}
+
+func TestShortWrite(t *testing.T) {
+	h := sftp.InMemHandler()
+	h.FilePut = shortWrites{h.FilePut, 3000}
+	c := memSFTP(t, h)
+	src, _ := localFile(t, 5000)
+	err := copyToRemote(c, profile{}, src, "/i/abc.png", uploadOptions{})
+	var mismatch *sizeMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("err = %v, want a size mismatch", err)
+	}
+	if mismatch.Got != 3000 || mismatch.Local != 5000 {
+		t.Errorf("mismatch %+v, want 3000 of 5000 bytes", mismatch)
+	}
+	if !retryable(err) {
+		t.Error("a short write isn't retried")
+	}
+	// neither the file nor the temporary one is left behind
+	for _, name := range remoteFiles(t, c) {
+		if name == "abc.png" || strings.Contains(name, tempSuffix) {
+			t.Errorf("%s is on the server", name)
+		}
+	}
+	if _, err := os.Stat(src); err != nil {
+		t.Errorf("local file: %v", err)
+	}
+}
+
+func TestTempName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"abc.png" + tempSuffix + shortuuid.New(), true},
+		{".abc.png" + tempSuffix + shortuuid.New(), true},
+		{"abc.png", false},
+		// a name of someone else's with the suffix in it
+		{"notes.tmp-2024.txt", false},
+		{"abc.png" + tempSuffix + "short", false},
+		{"abc.png" + tempSuffix + shortuuid.New() + ".png", false},
+		// 0, 1, I, O and l aren't in a shortuuid
+		{"abc.png" + tempSuffix + "0000000000000000000000", false},
+	}
+	for _, tt := range tests {
+		if got := tempName.MatchString(tt.name); got != tt.want {
+			t.Errorf("%s: %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+// BenchmarkCopyToRemote uploads a recording to a server that takes a while
+// for every write, with one request at a time and with as many in flight as
+// the sftp package allows by default
+func BenchmarkCopyToRemote(b *testing.B) {
+	src, data := localFile(b, 2<<20)
+	for _, bm := range []struct {
+		name string
+		p    profile
+	}{
+		{"one request", profile{SFTPConcurrentRequests: 1}},
+		{"defaults", profile{}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			h := sftp.InMemHandler()
+			h.FilePut = slowWrites{h.FilePut, time.Millisecond}
+			c := memSFTP(b, h, sftpOptions(bm.p)...)
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := copyToRemote(c, bm.p, src, fmt.Sprintf("/i/%d.mp4", i), uploadOptions{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// pauseSignal pauses uploads and resumeSignal resumes them
+var pauseSignal, resumeSignal os.Signal = syscall.SIGUSR1, syscall.SIGUSR2
+
+// pauseSignals are the signals handleSignals listens to for that
+var pauseSignals = []os.Signal{pauseSignal, resumeSignal}
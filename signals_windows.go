@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "os"
+
+// Windows has no SIGUSR1 and SIGUSR2, skrins pause and skrins resume go
+// through the control socket there
+var pauseSignal, resumeSignal os.Signal
+
+var pauseSignals []os.Signal
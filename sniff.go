@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// How a file's type is told, see detect_type: detectExtension goes by its
+// extension alone, detectFallback looks at its content when that doesn't
+// say and detectStrict always does, refusing files whose content isn't
+// what their extension claims
+const (
+	detectExtension = "extension"
+	detectFallback  = "sniff-fallback"
+	detectStrict    = "sniff-strict"
+)
+
+// sniffedExtensions are the extensions of the types http.DetectContentType
+// tells by content
+var sniffedExtensions = map[string]string{
+	"image/png":       "png",
+	"image/jpeg":      "jpg",
+	"image/gif":       "gif",
+	"image/webp":      "webp",
+	"video/mp4":       "mp4",
+	"video/webm":      "webm",
+	"application/zip": "zip",
+}
+
+// sniffExtension is the extension of the type of the file at path by its
+// first 512 bytes, "" when it's none of sniffedExtensions
+func sniffExtension(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	t := http.DetectContentType(head[:n])
+	if i := strings.Index(t, ";"); i >= 0 {
+		t = t[:i]
+	}
+	return sniffedExtensions[t], nil
+}
+
+// claimsSniffable tells whether ext is of a type sniffExtension can tell
+func claimsSniffable(ext string) bool {
+	t := contentType("x." + ext)
+	_, ok := sniffedExtensions[t]
+	return ok
+}
+
+// detectedExtension is the extension the file at path, named with ext, is
+// uploaded with as detect_type has it, false when it isn't uploaded
+func (s *settings) detectedExtension(path, ext string) (string, bool) {
+	allowed := ext != "" && s.allowedExtension(ext)
+	if s.DetectType == detectExtension || s.DetectType == detectFallback && allowed {
+		return ext, allowed
+	}
+	sniffed, err := sniffExtension(path)
+	if err != nil {
+		debugf("can't tell what %s is: %v", path, err)
+		return ext, allowed && s.DetectType == detectFallback
+	}
+	switch {
+	case sniffed != "" && s.allowedExtension(sniffed):
+		if !strings.EqualFold(sniffed, ext) && !(allowed && contentType("x."+ext) == contentType("x."+sniffed)) {
+			debugf("%s is a %s file, uploading it as that", path, sniffed)
+			return sniffed, true
+		}
+		return ext, true
+	case s.DetectType == detectStrict && allowed && claimsSniffable(ext):
+		log.Printf("not uploading %s, it isn't a %s file", path, ext)
+		return ext, false
+	}
+	return ext, allowed
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/pkg/sftp"
+)
+
+// Defaults for space_check_threshold and space_margin
+const (
+	defaultSpaceCheckThreshold = 10 << 20
+	defaultSpaceMargin         = 10 << 20
+)
+
+// noStatVFS remembers the servers, as user@host, that can't report free
+// space, so they're only asked once
+var noStatVFS sync.Map
+
+// insufficientSpaceError is returned when the server doesn't have room for
+// a file
+type insufficientSpaceError struct {
+	Dir        string
+	Free, Need uint64
+}
+
+func (e *insufficientSpaceError) Error() string {
+	return fmt.Sprintf("not enough space in %s on the server, %s free but %s needed", e.Dir, formatSize(e.Free), formatSize(e.Need))
+}
+
+// checkFreeSpace makes sure dir on p's server has room for size bytes and
+// p's margin. Files below p's threshold aren't checked, nor are servers
+// without the statvfs@openssh.com extension.
+func checkFreeSpace(client *sftp.Client, p profile, dir string, size int64) error {
+	if size < int64(p.SpaceCheckThreshold) {
+		return nil
+	}
+	server := p.RemoteUser + "@" + p.RemoteHost
+	if _, unsupported := noStatVFS.Load(server); unsupported {
+		return nil
+	}
+
+	vfs, err := client.StatVFS(dir)
+	if err != nil {
+		if transient(err) {
+			return err
+		}
+		log.Printf("%s can't report free space, not checking it: %v", server, err)
+		noStatVFS.Store(server, true)
+		return nil
+	}
+	free := vfs.Frsize * vfs.Bavail
+	need := uint64(size) + uint64(p.SpaceMargin)
+	if free < need {
+		return &insufficientSpaceError{Dir: dir, Free: free, Need: need}
+	}
+	return nil
+}
+
+// localSize is the size of the file at path
+func localSize(path string) (int64, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The algorithms golang.org/x/crypto/ssh can speak as a client. The library
+// doesn't export these lists so they are repeated here for validation.
+var (
+	supportedCiphers = []string{
+		"aes128-ctr", "aes192-ctr", "aes256-ctr",
+		"aes128-gcm@openssh.com", "chacha20-poly1305@openssh.com",
+		"arcfour256", "arcfour128", "arcfour",
+		"aes128-cbc", "3des-cbc",
+	}
+	supportedKeyExchanges = []string{
+		"curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha1", "diffie-hellman-group1-sha1",
+		"diffie-hellman-group-exchange-sha256", "diffie-hellman-group-exchange-sha1",
+	}
+	supportedHostKeyAlgorithms = []string{
+		ssh.CertAlgoRSAv01, ssh.CertAlgoDSAv01, ssh.CertAlgoECDSA256v01,
+		ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01, ssh.CertAlgoED25519v01,
+		ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+		ssh.KeyAlgoRSA, ssh.KeyAlgoDSA, ssh.KeyAlgoED25519,
+	}
+	supportedMACs = []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256", "hmac-sha1", "hmac-sha1-96",
+	}
+)
+
+// algorithmProblems reports configured algorithm names the SSH library
+// doesn't know, listing the ones it does.
+func algorithmProblems(p profile) []string {
+	var problems []string
+	check := func(key string, configured, supported []string) {
+		for _, name := range configured {
+			if !contains(supported, name) {
+				problems = append(problems, fmt.Sprintf("%s: unknown algorithm %q, supported: %s", key, name, strings.Join(supported, ", ")))
+			}
+		}
+	}
+	check("ciphers", p.Ciphers, supportedCiphers)
+	check("key_exchanges", p.KeyExchanges, supportedKeyExchanges)
+	check("host_key_algorithms", p.HostKeyAlgorithms, supportedHostKeyAlgorithms)
+	check("macs", p.MACs, supportedMACs)
+	return problems
+}
+
+// applyAlgorithms restricts config to the algorithms configured in p. Unset
+// lists keep the library defaults.
+func applyAlgorithms(config *ssh.ClientConfig, p profile) {
+	config.Ciphers = p.Ciphers
+	config.KeyExchanges = p.KeyExchanges
+	config.MACs = p.MACs
+	config.HostKeyAlgorithms = p.HostKeyAlgorithms
+}
+
+// contains tells whether list holds s
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
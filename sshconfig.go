@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/kevinburke/ssh_config"
+)
+
+// sshConfigFiles are searched for Host aliases, first match wins like it
+// does for ssh
+var sshConfigFiles = []string{"~/.ssh/config", "/etc/ssh/ssh_config"}
+
+// sshHost is what skrins takes from a matching Host block
+type sshHost struct {
+	HostName     string
+	Port         string
+	User         string
+	IdentityFile string
+	ProxyJump    string
+}
+
+// lookupSSHConfig finds alias in the ssh config files. Files that can't be
+// read or parsed are skipped.
+func lookupSSHConfig(alias string) sshHost {
+	var h sshHost
+	for _, path := range sshConfigFiles {
+		cfg := readSSHConfig(path)
+		if cfg == nil {
+			continue
+		}
+		setDefault(&h.HostName, sshConfigGet(cfg, alias, "HostName"))
+		setDefault(&h.Port, sshConfigGet(cfg, alias, "Port"))
+		setDefault(&h.User, sshConfigGet(cfg, alias, "User"))
+		setDefault(&h.IdentityFile, sshConfigGet(cfg, alias, "IdentityFile"))
+		setDefault(&h.ProxyJump, sshConfigGet(cfg, alias, "ProxyJump"))
+	}
+	return h
+}
+
+// readSSHConfig parses an ssh config file. The parser doesn't support Match
+// blocks, so they are blanked out first; their settings don't apply then.
+func readSSHConfig(path string) *ssh_config.Config {
+	path, err := expandPath(path, os.Getenv)
+	if err != nil {
+		return nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	cfg, err := ssh_config.Decode(bytes.NewReader(withoutMatchBlocks(b)))
+	if err != nil {
+		debugf("ignoring %s: %v", path, err)
+		return nil
+	}
+	return cfg
+}
+
+// sshConfigGet is cfg.Get that never panics, the parser does on Match
+// blocks in included files
+func sshConfigGet(cfg *ssh_config.Config, alias, key string) (value string) {
+	defer func() {
+		if recover() != nil {
+			value = ""
+		}
+	}()
+	value, _ = cfg.Get(alias, key)
+	return value
+}
+
+// withoutMatchBlocks replaces every line of a Match block with an empty one
+func withoutMatchBlocks(b []byte) []byte {
+	var out bytes.Buffer
+	inMatch := false
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(strings.Replace(line, "=", " ", 1))
+		if len(fields) > 0 {
+			switch strings.ToLower(fields[0]) {
+			case "match":
+				inMatch = true
+			case "host":
+				inMatch = false
+			}
+		}
+		if !inMatch {
+			out.WriteString(line)
+		}
+		out.WriteByte('\n')
+	}
+	return out.Bytes()
+}
+
+// applySSHConfig resolves p.RemoteHost through the ssh config files when
+// it's a bare alias. HostName and Port replace the alias, User,
+// IdentityFile and ProxyJump only fill in what skrins wasn't told already.
+func (p *profile) applySSHConfig() {
+	alias := p.RemoteHost
+	if alias == "" || strings.ContainsAny(alias, ":/[@") {
+		return
+	}
+	h := lookupSSHConfig(alias)
+	if h == (sshHost{}) {
+		return
+	}
+	debugf("using ssh config for %s: hostname=%q port=%q user=%q identityfile=%q proxyjump=%q", alias, h.HostName, h.Port, h.User, h.IdentityFile, h.ProxyJump)
+
+	host := alias
+	if h.HostName != "" {
+		host = h.HostName
+	}
+	if h.Port != "" {
+		p.RemoteHost = net.JoinHostPort(host, h.Port)
+	} else {
+		p.RemoteHost = host
+	}
+	setDefault(&p.RemoteUser, h.User)
+	if h.IdentityFile != "" && p.Key == "" && !isTrue(p.UseAgent) {
+		home, _ := os.UserHomeDir()
+		p.Key = strings.NewReplacer("%d", home, "%%", "%").Replace(h.IdentityFile)
+	}
+	if h.ProxyJump != "none" {
+		setDefault(&p.Jump, h.ProxyJump)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Files count as written once their size and modification time didn't
+// change for stable_period, unless the config file says otherwise. Those
+// still changing after stable_max_wait are tried again later.
+const (
+	defaultStablePeriod  = time.Second
+	defaultStableMaxWait = time.Minute
+)
+
+// errStillWriting is returned for files that kept changing for too long
+var errStillWriting = errors.New("still being written")
+
+// waitUntilWritten polls path until its size and modification time stayed
+// the same for period, which a file last modified that long ago already
+// did, and returns what it looks like then. Files that keep changing for
+// maxWait are an errStillWriting.
+func waitUntilWritten(path string, period, maxWait time.Duration) (os.FileInfo, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(maxWait)
+	same := ageOf(fi.ModTime(), time.Now())
+	for same < period {
+		if time.Now().After(deadline) {
+			return nil, errStillWriting
+		}
+		time.Sleep(period / 4)
+		now, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if now.Size() != fi.Size() || !now.ModTime().Equal(fi.ModTime()) {
+			fi, same = now, 0
+			continue
+		}
+		same += period / 4
+	}
+	return fi, nil
+}
+
+// Files smaller than min_size are left alone until they grow, those still
+// that small after tiny_timeout are reported, once
+const (
+	defaultMinSize     = 256
+	defaultTinyTimeout = time.Minute
+)
+
+// tinyFiles are the files found smaller than min_size, by when they were
+// found like that first
+var tinyFiles = struct {
+	sync.Mutex
+	since map[string]time.Time
+}{since: map[string]time.Time{}}
+
+// skipTiny tells whether the file at path, f, is smaller than min_size and
+// left where it is, like an empty file a screenshot tool writes to later.
+// Its events bring it back once it grows.
+func skipTiny(s *settings, fx effects, path string, f os.FileInfo) bool {
+	tinyFiles.Lock()
+	defer tinyFiles.Unlock()
+	if f.Size() >= s.MinBytes {
+		delete(tinyFiles.since, path)
+		return false
+	}
+	debugf("skipping %s, it has %d bytes, less than min_size, until it grows", path, f.Size())
+	if _, waiting := tinyFiles.since[path]; !waiting {
+		tinyFiles.since[path] = time.Now()
+		time.AfterFunc(s.TinyTimeout, func() { reportTiny(fx, path, s.MinBytes, s.TinyTimeout) })
+	}
+	return true
+}
+
+// reportTiny tells the user about the file at path if it's still smaller
+// than min bytes, after timeout. It stays in tinyFiles so that's once.
+func reportTiny(fx effects, path string, min int64, timeout time.Duration) {
+	fi, err := os.Stat(path)
+	tinyFiles.Lock()
+	defer tinyFiles.Unlock()
+	if _, waiting := tinyFiles.since[path]; !waiting {
+		return
+	}
+	if err != nil {
+		delete(tinyFiles.since, path)
+		return
+	}
+	if fi.Size() >= min {
+		// grew, and its events are on their way
+		return
+	}
+	err = fmt.Errorf("it has %d bytes after %s, it's uploaded once it has %d", fi.Size(), timeout, min)
+	log.Printf("not uploading %s: %v", path, err)
+	fx.notifyFailure(filepath.Base(path), err)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// stateDirFor is where skrins keeps what has to survive a restart. goos is
+// normally runtime.GOOS, getenv os.Getenv and home the user's home directory.
+//
+//	linux & co: $XDG_STATE_HOME/skrins (~/.local/state when unset)
+//	darwin:     ~/Library/Application Support/skrins
+//	windows:    %LOCALAPPDATA%\skrins
+func stateDirFor(goos string, getenv func(string) string, home string) string {
+	switch goos {
+	case "windows":
+		if local := getenv("LOCALAPPDATA"); local != "" {
+			return filepath.Join(local, "skrins")
+		}
+	case "darwin":
+		if home != "" {
+			return filepath.Join(home, "Library", "Application Support", "skrins")
+		}
+	default:
+		if xdg := getenv("XDG_STATE_HOME"); xdg != "" {
+			return filepath.Join(xdg, "skrins")
+		}
+		if home != "" {
+			return filepath.Join(home, ".local", "state", "skrins")
+		}
+	}
+	return filepath.Join(os.TempDir(), "skrins")
+}
+
+// stateDir is stateDirFor the running system.
+func stateDir() string {
+	home, _ := os.UserHomeDir()
+	return stateDirFor(runtime.GOOS, os.Getenv, home)
+}
+
+// resumePoint is a partial upload that can be continued. It only applies
+// while the local file is unchanged.
+type resumePoint struct {
+	// Server is user@host the temporary file is on
+	Server  string    `json:"server"`
+	Temp    string    `json:"temp"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// resumeFile holds the resume points by local path, in the state directory
+const resumeFile = "resume.json"
+
+// resumeMu guards the resume file
+var resumeMu sync.Mutex
+
+// readState loads the state file name into v
+func readState(name string, v interface{}) error {
+	b, err := ioutil.ReadFile(filepath.Join(stateDir(), name))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// writeState replaces the state file name with v
+func writeState(name string, v interface{}) error {
+	dir := stateDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, name+".tmp")
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, name))
+}
+
+// readResumePoints loads every resume point, an unreadable file counts as
+// empty since all that's lost is the partial uploads
+func readResumePoints() map[string]resumePoint {
+	points := make(map[string]resumePoint)
+	if err := readState(resumeFile, &points); err != nil && !os.IsNotExist(err) {
+		debugf("ignoring %s: %v", resumeFile, err)
+	}
+	return points
+}
+
+// writeResumePoints replaces the resume file with points
+func writeResumePoints(points map[string]resumePoint) error {
+	return writeState(resumeFile, points)
+}
+
+// resumePointFor returns the partial upload of src to server, if there's one
+// and src hasn't changed since
+func resumePointFor(src string, fi os.FileInfo, server string) (resumePoint, bool) {
+	resumeMu.Lock()
+	defer resumeMu.Unlock()
+	rp, ok := readResumePoints()[src]
+	if !ok || rp.Server != server || rp.Size != fi.Size() || !rp.ModTime.Equal(fi.ModTime()) {
+		return resumePoint{}, false
+	}
+	return rp, true
+}
+
+// saveResumePoint remembers a partial upload of src
+func saveResumePoint(src string, rp resumePoint) {
+	resumeMu.Lock()
+	defer resumeMu.Unlock()
+	points := readResumePoints()
+	points[src] = rp
+	if err := writeResumePoints(points); err != nil {
+		debugf("can't save resume point: %v", err)
+	}
+}
+
+// clearResumePoint forgets the partial upload of src
+func clearResumePoint(src string) {
+	resumeMu.Lock()
+	defer resumeMu.Unlock()
+	points := readResumePoints()
+	if _, ok := points[src]; !ok {
+		return
+	}
+	delete(points, src)
+	if err := writeResumePoints(points); err != nil {
+		debugf("can't save resume point: %v", err)
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg" // for the dimensions of photos
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// Where the Telegram Bot API is, see https://core.telegram.org/bots/api
+var telegramAPI = "https://api.telegram.org"
+
+// Bots can send files up to telegramMaxFile. Photos are shown in the chat
+// when they're up to telegramMaxPhoto, their width and height add up to at
+// most 10000 pixels and one is at most 20 times the other; everything else
+// is sent as a file.
+const (
+	telegramMaxFile    = 50 << 20
+	telegramMaxPhoto   = 10 << 20
+	telegramMaxCaption = 1024
+)
+
+// telegramPhotoExtensions are the extensions sent with sendPhoto
+var telegramPhotoExtensions = []string{"png", "jpg", "jpeg", "webp"}
+
+// telegramDateLayout is how {date} in a caption looks without a layout
+const telegramDateLayout = "2006-01-02 15:04"
+
+// telegramUploader sends files as a bot to the chat telegram_chat_id and
+// returns a link to the message
+type telegramUploader struct {
+	p    profile
+	opts uploadOptions
+}
+
+// telegramLabel describes a Telegram secret in prompts and errors
+func telegramLabel(what string) string {
+	return "Telegram " + what
+}
+
+// telegramProblems checks the settings of a telegram profile
+func telegramProblems(p profile) []string {
+	var problems []string
+	if id := p.TelegramChatID; id != "" && !strings.HasPrefix(id, "@") {
+		if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+			problems = append(problems, fmt.Sprintf("telegram_chat_id %q: use the chat's numeric ID or @ and the channel's username", id))
+		}
+	}
+	if _, err := (telegramUploader{p: p}).caption("screenshot.png", "abc.png", time.Now()); err != nil {
+		problems = append(problems, "telegram_caption "+err.Error())
+	}
+	return problems
+}
+
+// caption is telegram_caption for the file, with {name} the name of the
+// local file, {remote} the remote name, {ext} its extension and {date} or
+// {date:layout} the time
+func (u telegramUploader) caption(localPath, remoteName string, now time.Time) (string, error) {
+	caption, err := expandTemplate(u.p.TelegramCaption, func(token, arg string) (string, error) {
+		switch token {
+		case "name":
+			return filepath.Base(localPath), nil
+		case "remote":
+			return remoteName, nil
+		case "ext":
+			return remoteExtension(remoteName), nil
+		case "date":
+			if arg == "" {
+				arg = telegramDateLayout
+			}
+			return now.Format(arg), nil
+		}
+		return "", fmt.Errorf("unknown placeholder {%s}, use {name}, {remote}, {ext} or {date}", token)
+	})
+	if err != nil {
+		return "", err
+	}
+	if utf8.RuneCountInString(caption) > telegramMaxCaption {
+		caption = string([]rune(caption)[:telegramMaxCaption-1]) + "…"
+	}
+	return caption, nil
+}
+
+// telegramChat is what the Bot API tells about a chat
+type telegramChat struct {
+	ID       int64  `json:"id"`
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Username string `json:"username"`
+}
+
+// link is the link to the message with the ID id in the chat. Only
+// messages in channels and supergroups have one, for private ones it only
+// works for members.
+func (c telegramChat) link(id int64) (string, bool) {
+	if c.Type != "channel" && c.Type != "supergroup" {
+		return "", false
+	}
+	if c.Username != "" {
+		return fmt.Sprintf("https://t.me/%s/%d", c.Username, id), true
+	}
+	// private ones are linked to by their ID without the -100
+	if chat := strconv.FormatInt(c.ID, 10); strings.HasPrefix(chat, "-100") {
+		return fmt.Sprintf("https://t.me/c/%s/%d", chat[4:], id), true
+	}
+	return "", false
+}
+
+// name tells which chat c is in messages
+func (c telegramChat) name() string {
+	if c.Title != "" {
+		return strconv.Quote(c.Title)
+	}
+	return strconv.FormatInt(c.ID, 10)
+}
+
+// telegramMessage is what the Bot API tells about a sent message
+type telegramMessage struct {
+	MessageID int64        `json:"message_id"`
+	Chat      telegramChat `json:"chat"`
+}
+
+// telegramError is an error answer of the Bot API. MigrateTo is the new ID
+// of a group that became a supergroup.
+type telegramError struct {
+	Status      int
+	Description string
+	Wait        time.Duration
+	MigrateTo   int64
+}
+
+func (e *telegramError) Error() string {
+	msg := e.Description
+	if msg == "" {
+		msg = http.StatusText(e.Status)
+	}
+	switch e.Status {
+	case http.StatusUnauthorized, http.StatusNotFound:
+		// the token is part of the URL, a wrong one is not found
+		return "Telegram turned down the bot token: " + msg
+	case http.StatusTooManyRequests:
+		return "Telegram rate limit reached: " + msg
+	}
+	return "Telegram: " + msg
+}
+
+// temporary tells whether trying again may help, i.e. Telegram is busy or
+// the bot sends too fast
+func (e *telegramError) temporary() bool {
+	return e.Status >= 500 || e.Status == http.StatusTooManyRequests
+}
+
+// retryAfter is how long to wait before trying again
+func (e *telegramError) retryAfter() time.Duration {
+	return e.Wait
+}
+
+// photoRejected tells whether sendPhoto failed because of the photo, so it
+// can be sent as a file instead
+func (e *telegramError) photoRejected() bool {
+	return e.Status == http.StatusBadRequest && (strings.Contains(e.Description, "PHOTO_") || strings.Contains(e.Description, "IMAGE_PROCESS_FAILED"))
+}
+
+func (u telegramUploader) upload(ctx context.Context, localPath, remoteName string) (string, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if fi.Size() > telegramMaxFile {
+		return "", fmt.Errorf("%s is %s, Telegram bots can send at most %s", filepath.Base(localPath), formatSize(uint64(fi.Size())), formatSize(telegramMaxFile))
+	}
+	caption, err := u.caption(localPath, remoteName, time.Now())
+	if err != nil {
+		return "", err
+	}
+	method := "sendDocument"
+	if isPhoto(f, fi.Size(), remoteName) {
+		method = "sendPhoto"
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, u.p.TransferTimeout.Duration)
+	defer cancel()
+	t := startTransfer(localPath, fi.Size(), 0, u.opts.Progress)
+	defer t.finish()
+	ctx, stalled := watchStall(ctx, t, u.p.StallTimeout.Duration)
+
+	chat := u.p.TelegramChatID
+	var msg telegramMessage
+	for attempt := 0; attempt < 3; attempt++ {
+		msg, err = u.send(ctx, method, chat, f, fi.Size(), remoteName, caption, t)
+		var apiErr *telegramError
+		if !errors.As(err, &apiErr) {
+			break
+		}
+		if apiErr.MigrateTo != 0 {
+			chat = strconv.FormatInt(apiErr.MigrateTo, 10)
+			log.Printf("the Telegram group %s became a supergroup, set telegram_chat_id = %q", u.p.TelegramChatID, chat)
+		} else if method == "sendPhoto" && apiErr.photoRejected() {
+			debugf("Telegram turned down %s as a photo, sending it as a file: %v", localPath, err)
+			method = "sendDocument"
+		} else {
+			break
+		}
+	}
+	if stalled() {
+		return "", &timeoutError{Op: "stall", Host: "api.telegram.org", After: u.p.StallTimeout.Duration}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", &timeoutError{Op: "transfer", Host: "api.telegram.org", After: u.p.TransferTimeout.Duration, Err: err}
+	}
+	if err != nil {
+		return "", err
+	}
+	log.Println(t.summary())
+
+	link, ok := msg.Chat.link(msg.MessageID)
+	if !ok {
+		return "", fmt.Errorf("%s was sent to the Telegram chat %s, but messages there have no links, use a channel or supergroup", filepath.Base(localPath), msg.Chat.name())
+	}
+	return link, nil
+}
+
+// isPhoto tells whether the file is an image Telegram shows as a photo.
+// Other images go as files, which keeps them from being scaled down too.
+func isPhoto(f *os.File, size int64, remoteName string) bool {
+	ext := strings.ToLower(remoteExtension(remoteName))
+	if !contains(telegramPhotoExtensions, ext) || size > telegramMaxPhoto {
+		return false
+	}
+	if ext == "webp" {
+		return true
+	}
+	config, _, err := image.DecodeConfig(io.NewSectionReader(f, 0, size))
+	if err != nil || config.Width <= 0 || config.Height <= 0 {
+		return false
+	}
+	long, short := config.Width, config.Height
+	if short > long {
+		long, short = short, long
+	}
+	return long+short <= 10000 && long <= 20*short
+}
+
+// send posts f to chat with method, sendPhoto or sendDocument
+func (u telegramUploader) send(ctx context.Context, method, chat string, f *os.File, size int64, remoteName, caption string, t *transfer) (telegramMessage, error) {
+	fields := map[string]string{"chat_id": chat}
+	if caption != "" {
+		fields["caption"] = caption
+	}
+	field := "document"
+	if method == "sendPhoto" {
+		field = "photo"
+	}
+	atomic.StoreInt64(&t.done, 0)
+	file := progressTracker{limitedReader{io.NewSectionReader(f, 0, size), uploadLimiter}, t}
+	body, length, formType, err := multipartBody(fields, field, remoteName, file, size)
+	if err != nil {
+		return telegramMessage{}, err
+	}
+	var msg telegramMessage
+	err = u.call(ctx, method, http.Header{"Content-Type": {formType}}, body, length, &msg)
+	return msg, err
+}
+
+// check makes sure the bot token works, the bot is in the chat and
+// messages there can be linked to
+func (u telegramUploader) check(ctx context.Context) error {
+	form := url.Values{"chat_id": {u.p.TelegramChatID}}.Encode()
+	header := http.Header{"Content-Type": {"application/x-www-form-urlencoded"}}
+	var chat telegramChat
+	if err := u.call(ctx, "getChat", header, strings.NewReader(form), int64(len(form)), &chat); err != nil {
+		return fmt.Errorf("telegram: chat %s: %w", u.p.TelegramChatID, err)
+	}
+	if _, ok := chat.link(1); !ok {
+		return fmt.Errorf("telegram: messages in the %s chat %s have no links, use a channel or supergroup", chat.Type, chat.name())
+	}
+	return nil
+}
+
+// call calls the Bot API method and decodes its result into v. The token
+// is part of the URL, so it's cut from errors.
+func (u telegramUploader) call(ctx context.Context, method string, header http.Header, body io.Reader, length int64, v interface{}) error {
+	token, err := cachedSecret(u.p.TelegramToken, telegramLabel("bot token"))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, telegramAPI+"/bot"+token+"/"+method, body)
+	if err != nil {
+		return errors.New("telegram_token doesn't fit in a URL")
+	}
+	req = req.WithContext(ctx)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.ContentLength = length
+
+	resp, err := httpClientFor(u.p).Do(req)
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = strings.Replace(urlErr.URL, token, "…", 1)
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var answer struct {
+		OK          bool            `json:"ok"`
+		Result      json.RawMessage `json:"result"`
+		ErrorCode   int             `json:"error_code"`
+		Description string          `json:"description"`
+		Parameters  struct {
+			RetryAfter      int   `json:"retry_after"`
+			MigrateToChatID int64 `json:"migrate_to_chat_id"`
+		} `json:"parameters"`
+	}
+	if err := json.Unmarshal(respBody, &answer); err != nil || !answer.OK {
+		e := &telegramError{Status: resp.StatusCode, Description: answer.Description, MigrateTo: answer.Parameters.MigrateToChatID}
+		if answer.ErrorCode != 0 {
+			e.Status = answer.ErrorCode
+		}
+		if e.Description == "" {
+			e.Description = shorten(strings.TrimSpace(string(respBody)), 200)
+		}
+		e.Wait = time.Duration(answer.Parameters.RetryAfter) * time.Second
+		if e.Wait == 0 {
+			e.Wait = retryAfterHeader(resp.Header, time.Now())
+		}
+		return e
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(answer.Result, v)
+}
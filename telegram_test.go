@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// telegramTestAPI points the Bot API to a server answering with respond
+func telegramTestAPI(t *testing.T, respond func(w http.ResponseWriter, r recordedRequest)) *requestLog {
+	srv, log := recordingServer(t, respond)
+	old := telegramAPI
+	telegramAPI = srv.URL
+	t.Cleanup(func() { telegramAPI = old })
+	setEnv(t, "SKRINS_TEST_TELEGRAM_TOKEN", "123456:AAHt0k3n")
+	return log
+}
+
+// telegramTestUploader sends to the channel @skr1ns with the caption
+func telegramTestUploader(caption string) telegramUploader {
+	return telegramUploader{p: testProfile(profile{
+		Backend:         backendTelegram,
+		TelegramToken:   "env:SKRINS_TEST_TELEGRAM_TOKEN",
+		TelegramChatID:  "@skr1ns",
+		TelegramCaption: caption,
+	})}
+}
+
+// telegramSent answers a sendPhoto or sendDocument with the message 42
+func telegramSent(w http.ResponseWriter) {
+	fmt.Fprint(w, `{"ok":true,"result":{"message_id":42,"chat":{"id":-1001234567890,"type":"channel","title":"Shots","username":"skr1ns"}}}`)
+}
+
+// testPNG is a PNG of width × height pixels
+func testPNG(t *testing.T, width, height int) []byte {
+	var b bytes.Buffer
+	if err := png.Encode(&b, image.NewGray(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestTelegramPhoto(t *testing.T) {
+	tests := []struct {
+		name    string
+		content []byte
+		method  string
+	}{
+		{"shot.png", testPNG(t, 40, 30), "sendPhoto"},
+		// too narrow to be shown as a photo
+		{"strip.png", testPNG(t, 1, 40), "sendDocument"},
+		{"notes.txt", []byte("txt"), "sendDocument"},
+	}
+	for _, tt := range tests {
+		log := telegramTestAPI(t, func(w http.ResponseWriter, r recordedRequest) {
+			telegramSent(w)
+		})
+		link, err := telegramTestUploader("").upload(context.Background(), uploadTestFile(t, tt.name, tt.content), tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if link != "https://t.me/skr1ns/42" {
+			t.Errorf("%s: link = %s, want the message's", tt.name, link)
+		}
+		reqs := log.all()
+		if len(reqs) != 1 || reqs[0].Path != "/bot123456:AAHt0k3n/"+tt.method {
+			t.Fatalf("%s: %d requests, want one %s", tt.name, len(reqs), tt.method)
+		}
+		form := postedForm(t, reqs[0])
+		field := "document"
+		if tt.method == "sendPhoto" {
+			field = "photo"
+		}
+		if form.Value["chat_id"][0] != "@skr1ns" || len(form.File[field]) != 1 || form.File[field][0].Filename != tt.name {
+			t.Errorf("%s: sent %v and %v", tt.name, form.Value, form.File)
+		}
+		if _, ok := form.Value["caption"]; ok {
+			t.Errorf("%s: sent an empty caption", tt.name)
+		}
+	}
+}
+
+// photos Telegram can't process are sent again as files
+func TestTelegramPhotoFallback(t *testing.T) {
+	log := telegramTestAPI(t, func(w http.ResponseWriter, r recordedRequest) {
+		if strings.HasSuffix(r.Path, "/sendPhoto") {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"ok":false,"error_code":400,"description":"Bad Request: PHOTO_INVALID_DIMENSIONS"}`)
+			return
+		}
+		telegramSent(w)
+	})
+	link, err := telegramTestUploader("").upload(context.Background(), uploadTestFile(t, "shot.png", testPNG(t, 40, 30)), "Zr8tW.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link != "https://t.me/skr1ns/42" {
+		t.Errorf("link = %s, want the message's", link)
+	}
+	var methods []string
+	for _, r := range log.all() {
+		methods = append(methods, r.Path[strings.LastIndexByte(r.Path, '/')+1:])
+	}
+	if strings.Join(methods, " ") != "sendPhoto sendDocument" {
+		t.Fatalf("called %v, want the photo sent as a file", methods)
+	}
+	form := postedForm(t, log.all()[1])
+	if len(form.File["document"]) != 1 || form.File["document"][0].Size != int64(len(testPNG(t, 40, 30))) {
+		t.Errorf("sent %v as a file", form.File)
+	}
+
+	// other errors aren't
+	log = telegramTestAPI(t, func(w http.ResponseWriter, r recordedRequest) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"ok":false,"error_code":400,"description":"Bad Request: chat not found"}`)
+	})
+	_, err = telegramTestUploader("").upload(context.Background(), uploadTestFile(t, "shot.png", testPNG(t, 40, 30)), "Zr8tW.png")
+	if err == nil || err.Error() != "Telegram: Bad Request: chat not found" || len(log.all()) != 1 {
+		t.Errorf("upload: %v after %d requests, want chat not found after one", err, len(log.all()))
+	}
+}
+
+// files bigger than bots can send are turned down before sending them
+func TestTelegramTooBig(t *testing.T) {
+	log := telegramTestAPI(t, func(w http.ResponseWriter, r recordedRequest) {
+		telegramSent(w)
+	})
+	path := uploadTestFile(t, "movie.mp4", nil)
+	if err := os.Truncate(path, telegramMaxFile+1); err != nil {
+		t.Fatal(err)
+	}
+	_, err := telegramTestUploader("").upload(context.Background(), path, "Zr8tW.mp4")
+	if err == nil || err.Error() != "movie.mp4 is 50.0M, Telegram bots can send at most 50.0M" {
+		t.Errorf("upload: %v, want it too big", err)
+	}
+	if transient(err) {
+		t.Errorf("%v is tried again", err)
+	}
+	if n := len(log.all()); n != 0 {
+		t.Errorf("%d requests sent", n)
+	}
+}
+
+func TestTelegramCaption(t *testing.T) {
+	now := time.Date(2024, 3, 9, 14, 5, 0, 0, time.UTC)
+	tests := []struct {
+		caption string
+		want    string
+	}{
+		{"", ""},
+		{"{name} as {remote}", "shot.png as Zr8tW.png"},
+		{"a {ext} from {date}", "a png from 2024-03-09 14:05"},
+		{"{date:Jan 2, 15:04}", "Mar 9, 14:05"},
+		{"{{name}}", "{name}"},
+		{strings.Repeat("é", telegramMaxCaption+10), strings.Repeat("é", telegramMaxCaption-1) + "…"},
+	}
+	for _, tt := range tests {
+		got, err := telegramTestUploader(tt.caption).caption("/tmp/shot.png", "Zr8tW.png", now)
+		if err != nil || got != tt.want {
+			t.Errorf("caption(%q) = %q, %v, want %q", shorten(tt.caption, 20), shorten(got, 20), err, shorten(tt.want, 20))
+		}
+	}
+
+	if _, err := telegramTestUploader("{size}").caption("/tmp/shot.png", "Zr8tW.png", now); err == nil || !strings.Contains(err.Error(), "unknown placeholder {size}") {
+		t.Errorf("caption with {size}: %v", err)
+	}
+	if problems := telegramProblems(telegramTestUploader("{name").p); len(problems) != 1 || !strings.HasPrefix(problems[0], "telegram_caption ") {
+		t.Errorf("problems %v, want telegram_caption's", problems)
+	}
+
+	// the caption is sent with the file
+	log := telegramTestAPI(t, func(w http.ResponseWriter, r recordedRequest) {
+		telegramSent(w)
+	})
+	if _, err := telegramTestUploader("{name} as {remote}").upload(context.Background(), uploadTestFile(t, "shot.png", []byte("png")), "Zr8tW.png"); err != nil {
+		t.Fatal(err)
+	}
+	if form := postedForm(t, log.all()[0]); form.Value["caption"][0] != "shot.png as Zr8tW.png" {
+		t.Errorf("sent the caption %q", form.Value["caption"])
+	}
+}
+
+// sending too fast is tried again after as long as retry_after asks, waits
+// longer than the retry policy allows aren't waited for
+func TestTelegramRetryAfter(t *testing.T) {
+	for _, wait := range []int{3, 30} {
+		waited := fakeClock(t)
+		sends := 0
+		telegramTestAPI(t, func(w http.ResponseWriter, r recordedRequest) {
+			if sends++; sends == 1 {
+				w.WriteHeader(http.StatusTooManyRequests)
+				fmt.Fprintf(w, `{"ok":false,"error_code":429,"description":"Too Many Requests: retry after %d","parameters":{"retry_after":%d}}`, wait, wait)
+				return
+			}
+			telegramSent(w)
+		})
+		url, _, err := uploadWithRetries(context.Background(), retrySettings(2), fakeEffects{up: telegramTestUploader("")}, retryFile(t), "Zr8tW.png")
+		if wait == 30 {
+			var apiErr *telegramError
+			if !errors.As(err, &apiErr) || apiErr.retryAfter() != 30*time.Second || sends != 1 || len(*waited) != 0 {
+				t.Errorf("retry after 30s: %v after %d sends, waited %v", err, sends, *waited)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if url != "https://t.me/skr1ns/42" || sends != 2 {
+			t.Errorf("sent to %s in %d attempts", url, sends)
+		}
+		if len(*waited) != 1 || (*waited)[0] != 3*time.Second {
+			t.Errorf("waited %v, want 3s", *waited)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// expandTemplate replaces the placeholders {token} and {token:arg} in tmpl
+// with what value returns for them; "{{" and "}}" stand for single braces
+func expandTemplate(tmpl string, value func(token, arg string) (string, error)) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(tmpl); i++ {
+		c := tmpl[i]
+		switch {
+		case strings.HasPrefix(tmpl[i:], "{{"), strings.HasPrefix(tmpl[i:], "}}"):
+			sb.WriteByte(c)
+			i++
+		case c == '{':
+			end := strings.IndexByte(tmpl[i:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("%q: { without }", tmpl)
+			}
+			token, arg := tmpl[i+1:i+end], ""
+			if j := strings.IndexByte(token, ':'); j >= 0 {
+				token, arg = token[:j], token[j+1:]
+			}
+			v, err := value(token, arg)
+			if err != nil {
+				return "", fmt.Errorf("%q: %w", tmpl, err)
+			}
+			sb.WriteString(v)
+			i += end
+		case c == '}':
+			return "", fmt.Errorf("%q: } without {", tmpl)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// tooLargeDir is the folder next to them files above max_size are moved to
+// with move_too_large, so they don't come up again
+const tooLargeDir = "too-large"
+
+// tooLargeNotified are the files above max_size by the size they had when
+// the user was told about them, once is enough
+var tooLargeNotified = struct {
+	sync.Mutex
+	sizes map[string]int64
+}{sizes: map[string]int64{}}
+
+// skipTooLarge tells whether the file at path, f, is above max_size and
+// left alone. It's logged and notified about, moved to tooLargeDir with
+// move_too_large.
+func skipTooLarge(s *settings, fx effects, path string, f os.FileInfo) bool {
+	if s.MaxBytes == 0 || f.Size() <= s.MaxBytes {
+		return false
+	}
+	log.Printf("not uploading %s, it's %s, more than max_size %s", path, formatSize(uint64(f.Size())), s.MaxSize)
+	tooLargeNotified.Lock()
+	notified := tooLargeNotified.sizes[path] == f.Size()
+	tooLargeNotified.sizes[path] = f.Size()
+	tooLargeNotified.Unlock()
+	if !notified {
+		fx.notifyTooLarge(filepath.Base(path), f.Size(), s.MaxBytes)
+	}
+	if s.MoveTooLarge {
+		if moved, err := fx.setAside(path); err != nil {
+			log.Printf("can't move %s to %s: %v", path, tooLargeDir, err)
+		} else {
+			debugf("moved %s to %s", path, moved)
+		}
+	}
+	return true
+}
+
+// setAside moves the file at path to tooLargeDir next to it and returns
+// where it is now
+func setAside(path string) (string, error) {
+	dir := filepath.Join(filepath.Dir(path), tooLargeDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	target := archiveTarget(dir, path)
+	return target, os.Rename(path, target)
+}
+
+// inTooLargeDir tells whether path is in a folder files were set aside in
+func inTooLargeDir(path string) bool {
+	return filepath.Base(filepath.Dir(path)) == tooLargeDir
+}
+
+// showTooLargeNotification tells the user that the file name of size bytes
+// isn't uploaded because it's above max bytes
+func showTooLargeNotification(name string, size, max int64) {
+	msg := fmt.Sprintf("%s is %s, more than the %s max_size allows", name, formatSize(uint64(size)), formatSize(uint64(max)))
+	if err := pushNotification("File too large to upload", msg); err != nil {
+		log.Println("notification failed:", err)
+	}
+}
@@ -0,0 +1,38 @@
+//go:build darwin
+// +build darwin
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// finderTrashScript has Finder move the file given as the argument to the
+// Trash, which remembers where it was so it can be put back
+const finderTrashScript = `on run argv
+tell application "Finder" to delete POSIX file (item 1 of argv)
+end run`
+
+// moveToTrash moves the file at path to the Trash through Finder. Without
+// the permission to control Finder it's moved to ~/.Trash itself, which
+// only works on the same volume and can't be put back from the Trash.
+func moveToTrash(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	out, err := exec.Command("osascript", "-e", finderTrashScript, path).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	debugf("Finder can't move %s to the Trash, moving it to ~/.Trash: %v %s", path, err, strings.TrimSpace(string(out)))
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	trash := filepath.Join(home, ".Trash")
+	return os.Rename(path, archiveTarget(trash, path))
+}
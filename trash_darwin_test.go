@@ -0,0 +1,44 @@
+//go:build darwin
+// +build darwin
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMoveToTrashWithoutFinder(t *testing.T) {
+	home, err := ioutil.TempDir("", "skrins-trash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	// without osascript Finder can't be asked, and the user's Trash is
+	// left alone
+	setEnv(t, "HOME", home)
+	setEnv(t, "PATH", home)
+	trash := filepath.Join(home, ".Trash")
+	if err := os.Mkdir(trash, 0700); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(home, "Screenshot 2024-06-01 at 10.00.00.png")
+	for i := 0; i < 2; i++ {
+		if err := ioutil.WriteFile(file, []byte("png"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := moveToTrash(file); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("%s is still there: %v", file, err)
+		}
+	}
+	for _, name := range []string{"Screenshot 2024-06-01 at 10.00.00.png", "Screenshot 2024-06-01 at 10.00.00-1.png"} {
+		if _, err := os.Stat(filepath.Join(trash, name)); err != nil {
+			t.Errorf("%s not in the Trash: %v", name, err)
+		}
+	}
+}
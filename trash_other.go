@@ -0,0 +1,141 @@
+//go:build !darwin && !windows
+// +build !darwin,!windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// moveToTrash moves the file at path to the trash as the freedesktop.org
+// trash spec has it, so file managers can restore it: to the trash in the
+// home directory when it's on the same filesystem, otherwise to the one at
+// the top of the file's filesystem.
+func moveToTrash(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	dev, err := deviceOf(path)
+	if err != nil {
+		return err
+	}
+	trash, topdir, err := trashDirFor(path, dev)
+	if err != nil {
+		return err
+	}
+	for _, d := range []string{filepath.Join(trash, "files"), filepath.Join(trash, "info")} {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			return err
+		}
+	}
+
+	// the info file is created first and exclusively, that claims the name
+	inTrash := path
+	if topdir != "" {
+		inTrash, _ = filepath.Rel(topdir, path)
+	}
+	info := fmt.Sprintf("[Trash Info]\nPath=%s\nDeletionDate=%s\n", (&url.URL{Path: inTrash}).EscapedPath(), time.Now().Format("2006-01-02T15:04:05"))
+	name := filepath.Base(path)
+	ext := dotExtension(name)
+	stem := strings.TrimSuffix(name, ext)
+	for n := 1; ; n++ {
+		infoPath := filepath.Join(trash, "info", name+".trashinfo")
+		f, err := os.OpenFile(infoPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			if _, statErr := os.Lstat(filepath.Join(trash, "files", name)); statErr == nil {
+				// left without its info file
+				f.Close()
+				os.Remove(infoPath)
+				err = os.ErrExist
+			}
+		}
+		if os.IsExist(err) {
+			name = fmt.Sprintf("%s-%d%s", stem, n, ext)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		_, err = f.WriteString(info)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(path, filepath.Join(trash, "files", name))
+		}
+		if err != nil {
+			os.Remove(infoPath)
+		}
+		return err
+	}
+}
+
+// trashDirFor is the trash for the file at path on device dev, and the top
+// directory of the filesystem when it's not the one in the home directory
+func trashDirFor(path string, dev uint64) (trash, topdir string, err error) {
+	data := os.Getenv("XDG_DATA_HOME")
+	if data == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", "", err
+		}
+		data = filepath.Join(home, ".local", "share")
+	}
+	home := filepath.Join(data, "Trash")
+	if d, err := deviceOf(home); err == nil && d == dev {
+		return home, "", nil
+	}
+
+	topdir = path
+	for {
+		parent := filepath.Dir(topdir)
+		if d, err := deviceOf(parent); err != nil || d != dev || parent == topdir {
+			break
+		}
+		topdir = parent
+	}
+	uid := strconv.Itoa(os.Getuid())
+	// $topdir/.Trash is shared by every user and only to be trusted when
+	// it's a real directory with the sticky bit
+	if fi, err := os.Lstat(filepath.Join(topdir, ".Trash")); err == nil && fi.IsDir() && fi.Mode()&os.ModeSticky != 0 {
+		trash = filepath.Join(topdir, ".Trash", uid)
+		if err := os.MkdirAll(trash, 0700); err == nil {
+			return trash, topdir, nil
+		}
+	}
+	trash = filepath.Join(topdir, ".Trash-"+uid)
+	if err := os.Mkdir(trash, 0700); err == nil || os.IsExist(err) {
+		if fi, err := os.Lstat(trash); err == nil && fi.IsDir() {
+			return trash, topdir, nil
+		}
+	}
+	return "", "", fmt.Errorf("no trash on the filesystem of %s, at %s or in %s", path, topdir, home)
+}
+
+// deviceOf is the device of the filesystem path is on, or the closest
+// directory above it that exists
+func deviceOf(path string) (uint64, error) {
+	for {
+		fi, err := os.Stat(path)
+		if err == nil {
+			st, ok := fi.Sys().(*syscall.Stat_t)
+			if !ok {
+				return 0, errors.New("no device number")
+			}
+			return uint64(st.Dev), nil
+		}
+		if !os.IsNotExist(err) || filepath.Dir(path) == path {
+			return 0, err
+		}
+		path = filepath.Dir(path)
+	}
+}
@@ -0,0 +1,93 @@
+//go:build !darwin && !windows
+// +build !darwin,!windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// trashTestFile is a file to move to the trash in XDG_DATA_HOME of t, both
+// in the same temporary directory
+func trashTestFile(t *testing.T, dir, name string) (file, trash string) {
+	t.Helper()
+	data, err := ioutil.TempDir("", "skrins-trash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(data) })
+	setEnv(t, "XDG_DATA_HOME", filepath.Join(data, "share"))
+	file = filepath.Join(data, dir, name)
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte("png"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file, filepath.Join(data, "share", "Trash")
+}
+
+func TestMoveToTrash(t *testing.T) {
+	file, trash := trashTestFile(t, "shots", "Screenshot from 2024-06-01.png")
+	if err := moveToTrash(file); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("%s is still there: %v", file, err)
+	}
+	if _, err := os.Stat(filepath.Join(trash, "files", "Screenshot from 2024-06-01.png")); err != nil {
+		t.Errorf("not in the trash: %v", err)
+	}
+	info, err := ioutil.ReadFile(filepath.Join(trash, "info", "Screenshot from 2024-06-01.png.trashinfo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the home trash has absolute paths, escaped like URLs
+	want := "[Trash Info]\nPath=" + strings.Replace(file, " ", "%20", -1) + "\nDeletionDate="
+	if !strings.HasPrefix(string(info), want) {
+		t.Errorf("info file\n%s\nwant it to start with\n%s", info, want)
+	}
+}
+
+func TestMoveToTrashSameName(t *testing.T) {
+	file, trash := trashTestFile(t, "shots", "backup.tar.gz")
+	if err := moveToTrash(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte("again"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := moveToTrash(file); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"backup.tar.gz", "backup-1.tar.gz"} {
+		if _, err := os.Stat(filepath.Join(trash, "files", name)); err != nil {
+			t.Errorf("%s not in the trash: %v", name, err)
+		}
+		if _, err := os.Stat(filepath.Join(trash, "info", name+".trashinfo")); err != nil {
+			t.Errorf("%s has no info file: %v", name, err)
+		}
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(trash, "files", "backup-1.tar.gz")); err != nil || string(got) != "again" {
+		t.Errorf("backup-1.tar.gz has %q, %v, want the second file", got, err)
+	}
+}
+
+func TestMoveToTrashMissing(t *testing.T) {
+	file, trash := trashTestFile(t, "shots", "shot.png")
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := moveToTrash(file); err == nil {
+		t.Fatal("moved a file that isn't there to the trash")
+	}
+	// its info file is gone with it
+	infos, _ := ioutil.ReadDir(filepath.Join(trash, "info"))
+	if len(infos) != 0 {
+		t.Errorf("%d info files left for nothing in the trash", len(infos))
+	}
+}
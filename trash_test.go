@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// trashEffects fails to move files to the trash with err and remembers
+// what else became of them
+type trashEffects struct {
+	dryRun
+	err      error
+	removed  *[]string
+	archived *[]string
+}
+
+func (fx trashEffects) trash(path string) error { return fx.err }
+
+func (fx trashEffects) remove(path string) error {
+	*fx.removed = append(*fx.removed, path)
+	return nil
+}
+
+func (fx trashEffects) archive(path, dir string) (string, error) {
+	*fx.archived = append(*fx.archived, path)
+	return dir + "/shot.png", nil
+}
+
+func TestTrashFallback(t *testing.T) {
+	tests := []struct {
+		name     string
+		s        settings
+		err      error
+		trashed  bool
+		archived bool
+		kept     bool
+	}{
+		{"trashed", settings{Trash: true}, nil, true, false, false},
+		{"no trash, kept", settings{Trash: true}, errors.New("no trash on the filesystem"), false, false, true},
+		{"no trash, archived", settings{Trash: true, ArchiveDir: "/archive"}, errors.New("no trash on the filesystem"), false, true, false},
+	}
+	for _, tt := range tests {
+		var removed, archived []string
+		fx := trashEffects{err: tt.err, removed: &removed, archived: &archived}
+		var e historyEntry
+		disposeNow(&tt.s, fx, "/shots/shot.png", &e)
+		if len(removed) != 0 {
+			t.Errorf("%s: deleted %v", tt.name, removed)
+		}
+		if e.Trashed != tt.trashed || (len(archived) == 1) != tt.archived || e.Kept != tt.kept {
+			t.Errorf("%s: trashed %t, archived %v, kept %t", tt.name, e.Trashed, archived, e.Kept)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// recycleScript sends the file in SKRINS_TRASH_PATH to the Recycle Bin.
+// Only fixed drives have one, elsewhere the file would be deleted for good,
+// so it's left alone and the script exits with 3.
+const recycleScript = `
+$p = $env:SKRINS_TRASH_PATH
+$d = [System.IO.DriveInfo]::new([System.IO.Path]::GetPathRoot($p))
+if ($d.DriveType -ne 'Fixed') { exit 3 }
+Add-Type -AssemblyName Microsoft.VisualBasic
+[Microsoft.VisualBasic.FileIO.FileSystem]::DeleteFile($p, 'OnlyErrorDialogs', 'SendToRecycleBin')
+`
+
+// moveToTrash sends the file at path to the Recycle Bin through PowerShell,
+// like notifications
+func moveToTrash(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", recycleScript)
+	cmd.Env = append(os.Environ(), "SKRINS_TRASH_PATH="+path)
+	err = cmd.Run()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && exit.ExitCode() == 3 {
+		return errors.New("there's no Recycle Bin on the drive of " + path)
+	}
+	return err
+}
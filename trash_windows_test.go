@@ -0,0 +1,52 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMoveToTrash(t *testing.T) {
+	if testing.Short() {
+		t.Skip("fills the Recycle Bin")
+	}
+	dir, err := ioutil.TempDir("", "skrins-trash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "Screenshot (1).png")
+	if err := ioutil.WriteFile(file, []byte("png"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := moveToTrash(file); err != nil {
+		t.Skip("no Recycle Bin for the temporary directory:", err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("%s is still there: %v", file, err)
+	}
+}
+
+func TestMoveToTrashWithoutPowerShell(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skrins-trash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	setEnv(t, "PATH", dir)
+	file := filepath.Join(dir, "Screenshot (1).png")
+	if err := ioutil.WriteFile(file, []byte("png"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := moveToTrash(file); err == nil {
+		t.Fatal("moved to the Recycle Bin without PowerShell")
+	}
+	// failing is never deleting
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("%s is gone: %v", file, err)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Ways of checking an upload before the local file is deleted
+const (
+	verifySize   = "size"
+	verifySHA256 = "sha256"
+)
+
+// checksumCommands are tried in order to hash a file on the server, GNU
+// coreutils first, then what BSDs and macOS have
+var checksumCommands = []string{"sha256sum", "shasum -a 256"}
+
+// errNoRemoteChecksum means the server can't hash files for us
+var errNoRemoteChecksum = errors.New("no sha256sum or shasum on the server")
+
+// checksumMismatchError is returned when the uploaded file's SHA-256 doesn't
+// match the local one
+type checksumMismatchError struct {
+	Name       string
+	Got, Local string
+}
+
+func (e *checksumMismatchError) Error() string {
+	return fmt.Sprintf("%s has sha256 %s on the server instead of %s", e.Name, e.Got, e.Local)
+}
+
+// checkRemoteSHA256 makes sure name on the server hashes to digest. Servers
+// that can't hash files only get the size check, with a warning.
+func checkRemoteSHA256(c *sftpConn, name, digest string) error {
+	got, err := remoteSHA256(c, name)
+	if errors.Is(err, errNoRemoteChecksum) {
+		log.Printf("warning: can't verify the checksum of %s, %v; only its size was checked", name, err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if got != digest {
+		return &checksumMismatchError{Name: name, Got: got, Local: digest}
+	}
+	return nil
+}
+
+// remoteSHA256 runs a checksum command on the server over c's connection
+// and returns the hex digest of name
+func remoteSHA256(c *sftpConn, name string) (string, error) {
+	for _, command := range checksumCommands {
+		session, err := c.ssh.NewSession()
+		if err != nil {
+			return "", err
+		}
+		var stdout bytes.Buffer
+		session.Stdout = &stdout
+		err = session.Run(command + " " + shellQuote(name))
+		session.Close()
+		if err != nil {
+			debugf("%s on the server failed: %v", command, err)
+			continue
+		}
+		fields := strings.Fields(stdout.String())
+		if len(fields) == 0 || len(fields[0]) != 64 {
+			debugf("unexpected output of %s: %q", command, stdout.String())
+			continue
+		}
+		return strings.ToLower(fields[0]), nil
+	}
+	return "", errNoRemoteChecksum
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchedDirs are the directories added to watcher: the screenshots
+// directory and, with -recursive, every directory below it
+var watchedDirs = struct {
+	sync.Mutex
+	dirs map[string]bool
+}{dirs: map[string]bool{}}
+
+// settledEvents queues paths for upload once their events stopped coming
+var settledEvents = newDebouncer(uploads.add)
+
+func watch() {
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			s := currentSettings()
+			if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+				// a directory moved away is gone as far as its watch goes,
+				// a file renamed comes back with a Create of its new name
+				unwatchTree(event.Name)
+				settledEvents.drop(event.Name)
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Chmod) == 0 {
+				continue
+			}
+			if s.ignored(event.Name) {
+				debugf("ignoring %s", event.Name)
+				continue
+			}
+			if event.Op&fsnotify.Create == fsnotify.Create && s.Recursive {
+				if fi, err := os.Stat(event.Name); err == nil && fi.IsDir() {
+					// files may have landed before the watch was added,
+					// uploadPath picks them up
+					if err := watchTree(event.Name, s); err != nil {
+						log.Println(err)
+					}
+					settledEvents.add(event.Name, s.Debounce)
+					continue
+				}
+			}
+			if !s.included(event.Name) {
+				debugf("not uploading %s, it doesn't match include", event.Name)
+				continue
+			}
+			if fi, err := os.Stat(event.Name); err == nil && !fi.IsDir() && s.tooOld(event.Name, fi.ModTime(), time.Now()) {
+				continue
+			}
+			// screencapture and others write a hidden file, which is
+			// ignored, and rename it, then set its attributes, so only the
+			// final name counts and a Chmod may be its last event
+			settledEvents.add(event.Name, s.Debounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				// events were lost, whatever they were about is still
+				// there to be found
+				log.Println("too many events at once, some were lost, looking for new files in every screenshot path")
+				s := currentSettings()
+				for _, dir := range s.ScreensPaths {
+					settledEvents.add(dir, s.Debounce)
+				}
+				continue
+			}
+			log.Println("error:", err)
+		}
+	}
+}
+
+// watchTree adds a watch for dir and, with recursive, for every directory
+// below it that's not ignored. Only failing to watch dir itself is an
+// error, directories below it that can't be watched are logged and
+// skipped.
+func watchTree(dir string, s *settings) error {
+	if !s.Recursive {
+		return addWatch(dir)
+	}
+	dirs := s.watchableDirs(dir)
+	warnWatchLimit(dir, dirs)
+	if err := addWatch(dir); err != nil {
+		return err
+	}
+	added := 0
+	for _, d := range dirs[1:] {
+		err := addWatch(d)
+		if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EMFILE) {
+			// the rest would fail the same way
+			log.Println(err)
+			break
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			debugf("not watching %s, it's gone", d)
+			continue
+		}
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		added++
+	}
+	if added > 0 {
+		debugf("watching %d directories below %s", added, dir)
+	}
+	return nil
+}
+
+// watchableDirs lists dir and the directories below it that aren't
+// ignored, those that are added in the meantime come with an event
+func (s *settings) watchableDirs(dir string) []string {
+	dirs := []string{dir}
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if os.IsPermission(err) && path != dir {
+			log.Println(explainWatchError(path, err, 0))
+			return nil
+		}
+		if err != nil {
+			// vanished, there's nothing to watch
+			debugf("not watching %s: %v", path, err)
+			return nil
+		}
+		if !fi.IsDir() || path == dir {
+			return nil
+		}
+		if s.ignored(path) {
+			return filepath.SkipDir
+		}
+		dirs = append(dirs, path)
+		return nil
+	})
+	return dirs
+}
+
+// addWatch adds a watch for dir unless it has one, failing to is a
+// watchError
+func addWatch(dir string) error {
+	watchedDirs.Lock()
+	defer watchedDirs.Unlock()
+	if watchedDirs.dirs[dir] {
+		return nil
+	}
+	if err := watcher.Add(dir); err != nil {
+		return explainWatchError(dir, err, len(watchedDirs.dirs))
+	}
+	watchedDirs.dirs[dir] = true
+	return nil
+}
+
+// unwatchTree removes the watches of dir and the directories below it
+func unwatchTree(dir string) {
+	watchedDirs.Lock()
+	defer watchedDirs.Unlock()
+	for d := range watchedDirs.dirs {
+		if isWithin(d, dir) {
+			removeWatch(d)
+		}
+	}
+}
+
+// watchPaths watches the screenshot paths of s, see watchRoot, and stops
+// watching what's no longer needed when a reload changed what's watched. The old watches stay when one of the new paths
+// can't be watched.
+func watchPaths(s *settings) error {
+	for _, dir := range s.ScreensPaths {
+		if err := watchRoot(dir, s); err != nil {
+			return err
+		}
+	}
+	watchedDirs.Lock()
+	for d := range watchedDirs.dirs {
+		if !needsWatch(d, s) {
+			removeWatch(d)
+		}
+	}
+	watchedDirs.Unlock()
+	polledDirs.Lock()
+	for d := range polledDirs.dirs {
+		if _, ok := s.polls(d); !ok || !contains(s.ScreensPaths, d) {
+			delete(polledDirs.dirs, d)
+		}
+	}
+	polledDirs.Unlock()
+	return nil
+}
+
+// watching tells whether dir has a watch
+func watching(dir string) bool {
+	watchedDirs.Lock()
+	defer watchedDirs.Unlock()
+	return watchedDirs.dirs[dir]
+}
+
+// eventSource names what fsnotify gets its events from here
+func eventSource() string {
+	switch runtime.GOOS {
+	case "linux":
+		return "inotify"
+	case "windows":
+		return "ReadDirectoryChangesW"
+	}
+	return "kqueue"
+}
+
+// needsWatch tells whether d is one of the screenshot paths or, with
+// recursive, a directory below one that's not ignored, and isn't polled
+func needsWatch(d string, s *settings) bool {
+	for _, dir := range s.ScreensPaths {
+		if _, ok := s.polls(dir); ok {
+			continue
+		}
+		if d == dir {
+			return true
+		}
+		if s.Recursive && isWithin(d, dir) {
+			rel, _ := filepath.Rel(dir, d)
+			for _, name := range strings.Split(rel, string(filepath.Separator)) {
+				if matchName(s.Ignore, name, foldCase) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// removeWatch removes the watch of dir, watchedDirs must be locked
+func removeWatch(dir string) {
+	delete(watchedDirs.dirs, dir)
+	// inotify drops the watches of deleted directories by itself
+	if err := watcher.Remove(dir); err != nil {
+		if _, statErr := os.Stat(dir); os.IsNotExist(statErr) {
+			return
+		}
+		debugf("removing the watch of %s: %v", dir, err)
+	}
+}
+
+// isWithin tells whether path is dir or below it
+func isWithin(path, dir string) bool {
+	path, dir = filepath.Clean(path), filepath.Clean(dir)
+	return path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+}
+
+// warnWatchLimit warns before watching dirs for the screenshot path dir
+// when that takes more than half the inotify watches, which are shared with
+// every other program of the user, or more than there are
+func warnWatchLimit(dir string, dirs []string) {
+	limit := inotifyLimit("max_user_watches")
+	if limit == 0 {
+		return
+	}
+	watchedDirs.Lock()
+	n := len(watchedDirs.dirs)
+	for _, d := range dirs {
+		if !watchedDirs.dirs[d] {
+			n++
+		}
+	}
+	watchedDirs.Unlock()
+	if n > limit {
+		log.Printf("warning: %s has %d directories, watching them needs more than fs.inotify.max_user_watches = %d allows, raise it with `sudo sysctl fs.inotify.max_user_watches=%d`", dir, len(dirs), limit, suggestedLimit(n, 524288))
+	} else if n > limit/2 {
+		log.Printf("warning: watching %d directories, fs.inotify.max_user_watches is %d for all programs of the user together", n, limit)
+	}
+}
+
+// screenshotFiles lists the files in dir that are included and not
+// ignored and, with recursive, those in the directories below it. Only
+// failing to read dir itself is an error.
+func (s *settings) screenshotFiles(dir string) ([]string, []os.FileInfo, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	var paths []string
+	var infos []os.FileInfo
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		if s.ignored(path) {
+			continue
+		}
+		if !e.IsDir() {
+			if !s.included(path) {
+				continue
+			}
+			paths = append(paths, path)
+			infos = append(infos, e)
+			continue
+		}
+		if !s.Recursive {
+			continue
+		}
+		p, i, err := s.screenshotFiles(path)
+		if err != nil {
+			debugf("skipping %s: %v", path, err)
+			continue
+		}
+		paths = append(paths, p...)
+		infos = append(infos, i...)
+	}
+	return paths, infos, nil
+}
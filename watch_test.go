@@ -0,0 +1,555 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// firedPaths counts how often a debouncer handed over each path
+type firedPaths struct {
+	mu sync.Mutex
+	n  map[string]int
+}
+
+func newFiredPaths() *firedPaths {
+	return &firedPaths{n: map[string]int{}}
+}
+
+func (f *firedPaths) fire(path string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.n[path]++
+}
+
+func (f *firedPaths) count(path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.n[path]
+}
+
+func (f *firedPaths) total() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, c := range f.n {
+		n += c
+	}
+	return n
+}
+
+// eventually waits up to 5s for cond to be true
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("gave up waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDebouncerStorm(t *testing.T) {
+	fired := newFiredPaths()
+	d := newDebouncer(fired.fire)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		path := fmt.Sprintf("/shots/%d.png", i)
+		for j := 0; j < 5; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				// a Create and the Writes of saving it
+				for k := 0; k < 20; k++ {
+					d.add(path, 100*time.Millisecond)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	eventually(t, "the storm to settle", func() bool { return fired.total() >= 20 })
+	time.Sleep(200 * time.Millisecond)
+	for i := 0; i < 20; i++ {
+		path := fmt.Sprintf("/shots/%d.png", i)
+		if n := fired.count(path); n != 1 {
+			t.Errorf("%s handed over %d times, want once", path, n)
+		}
+	}
+}
+
+func TestDebouncerKeepsChanging(t *testing.T) {
+	fired := newFiredPaths()
+	d := newDebouncer(fired.fire)
+	window := 20 * time.Millisecond
+	start := time.Now()
+	// a recording that never stops growing is handed over all the same
+	for fired.count("/shots/rec.mp4") == 0 {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("a path that keeps changing is never handed over")
+		}
+		d.add("/shots/rec.mp4", window)
+		time.Sleep(window / 4)
+	}
+	if held := time.Since(start); held < window*debounceMaxWaits/2 {
+		t.Errorf("handed over after %s, want it held back for a while", held)
+	}
+}
+
+func TestDebouncerRunsAgain(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	running, most, calls := 0, 0, 0
+	d := newDebouncer(func(path string) {
+		mu.Lock()
+		running++
+		calls++
+		if running > most {
+			most = running
+		}
+		first := calls == 1
+		mu.Unlock()
+		if first {
+			<-release
+		}
+		mu.Lock()
+		running--
+		mu.Unlock()
+	})
+	d.add("/shots/a.png", 10*time.Millisecond)
+	eventually(t, "the first upload", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls == 1
+	})
+	// events while it's uploaded
+	for i := 0; i < 10; i++ {
+		d.add("/shots/a.png", 10*time.Millisecond)
+		time.Sleep(20 * time.Millisecond)
+	}
+	close(release)
+	eventually(t, "the upload after it", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls == 2 && running == 0
+	})
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 2 || most != 1 {
+		t.Errorf("%d uploads, %d at once, want 2 one after the other", calls, most)
+	}
+}
+
+func TestDebouncerDrop(t *testing.T) {
+	fired := newFiredPaths()
+	d := newDebouncer(fired.fire)
+	d.add("/shots/old.png", 50*time.Millisecond)
+	d.drop("/shots/old.png")
+	d.add("/shots/new.png", 50*time.Millisecond)
+	eventually(t, "new.png", func() bool { return fired.count("/shots/new.png") == 1 })
+	time.Sleep(100 * time.Millisecond)
+	if n := fired.count("/shots/old.png"); n != 0 {
+		t.Errorf("dropped old.png handed over %d times", n)
+	}
+}
+
+// watchTestDir runs watch over a new temporary screenshots directory with s
+// and the debounce window of s, what settles goes to the returned
+// firedPaths instead of the upload queue
+func watchTestDir(t *testing.T, s *settings) (string, *firedPaths) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "skrins-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	// symlinks like macOS's /var don't come back in event names
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	s.ScreensPaths = []string{dir}
+	if s.Ignore == nil {
+		s.Ignore = defaultIgnore
+	}
+	if s.Debounce == 0 {
+		s.Debounce = 100 * time.Millisecond
+	}
+	if s.MissingPath == "" {
+		s.MissingPath = missingPathWait
+	}
+	if old, ok := current.Load().(*settings); ok {
+		t.Cleanup(func() { current.Store(old) })
+	}
+	current.Store(s)
+
+	fired := newFiredPaths()
+	oldWatcher, oldEvents := watcher, settledEvents
+	watcher, settledEvents = w, newDebouncer(fired.fire)
+	watchedDirs.Lock()
+	oldDirs := watchedDirs.dirs
+	watchedDirs.dirs = map[string]bool{}
+	watchedDirs.Unlock()
+	roots.Lock()
+	oldWatched, oldMissing, oldAlerted := roots.watched, roots.missing, roots.alerted
+	roots.watched, roots.missing, roots.alerted = map[string]os.FileInfo{}, map[string]time.Time{}, map[string]bool{}
+	roots.Unlock()
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		w.Close()
+		<-done
+		watcher, settledEvents = oldWatcher, oldEvents
+		watchedDirs.Lock()
+		watchedDirs.dirs = oldDirs
+		watchedDirs.Unlock()
+		roots.Lock()
+		roots.watched, roots.missing, roots.alerted = oldWatched, oldMissing, oldAlerted
+		roots.Unlock()
+	})
+	if err := watchRoot(dir, s); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		watch()
+		close(done)
+	}()
+	return dir, fired
+}
+
+func TestWatchEventStorm(t *testing.T) {
+	dir, fired := watchTestDir(t, &settings{Debounce: 200 * time.Millisecond})
+	var paths []string
+	for i := 0; i < 10; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("shot-%d.png", i))
+		paths = append(paths, path)
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 50; j++ {
+			f.Write(make([]byte, 1024))
+		}
+		f.Chmod(0644)
+		f.Close()
+	}
+	eventually(t, "the screenshots", func() bool { return fired.total() >= len(paths) })
+	time.Sleep(400 * time.Millisecond)
+	for _, path := range paths {
+		if n := fired.count(path); n != 1 {
+			t.Errorf("%s handed over %d times, want once", filepath.Base(path), n)
+		}
+	}
+	if n := fired.total(); n != len(paths) {
+		t.Errorf("%d paths handed over, want %d", n, len(paths))
+	}
+}
+
+// growFile appends to path every tick until stop is closed, and closes
+// stopped once it's done
+func growFile(t *testing.T, path string, tick time.Duration, stop, stopped chan struct{}) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		t.Error(err)
+		close(stopped)
+		return
+	}
+	defer close(stopped)
+	defer f.Close()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(tick):
+			f.Write(make([]byte, 1024))
+		}
+	}
+}
+
+func TestWaitUntilWrittenGrowing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skrins-stable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rec.mp4")
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go growFile(t, path, 10*time.Millisecond, stop, stopped)
+	time.AfterFunc(400*time.Millisecond, func() { close(stop) })
+
+	eventually(t, "the recording to start", func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	})
+	fi, err := waitUntilWritten(path, 150*time.Millisecond, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-stopped:
+	default:
+		t.Fatal("taken for written while it's still growing")
+	}
+	final, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != final.Size() {
+		t.Errorf("has %d bytes when written, want all %d", fi.Size(), final.Size())
+	}
+}
+
+func TestWaitUntilWrittenGivesUp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skrins-stable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rec.mp4")
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go growFile(t, path, 10*time.Millisecond, stop, stopped)
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+
+	eventually(t, "the recording to start", func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	})
+	if _, err := waitUntilWritten(path, 100*time.Millisecond, 300*time.Millisecond); err != errStillWriting {
+		t.Errorf("err = %v, want errStillWriting", err)
+	}
+}
+
+func TestWaitUntilWrittenOld(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skrins-stable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "old.png")
+	if err := ioutil.WriteFile(path, []byte("png"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	hourAgo := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, hourAgo, hourAgo); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := waitUntilWritten(path, time.Minute, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("waited %s for a file last modified an hour ago", waited)
+	}
+
+	if _, err := waitUntilWritten(filepath.Join(dir, "gone.png"), time.Second, time.Second); !os.IsNotExist(err) {
+		t.Errorf("gone.png: err = %v, want it not to exist", err)
+	}
+}
+
+func TestSkipTinyEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skrins-stable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "empty.png")
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		tinyFiles.Lock()
+		delete(tinyFiles.since, path)
+		tinyFiles.Unlock()
+	}()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &settings{MinBytes: defaultMinSize, TinyTimeout: time.Hour}
+	if !skipTiny(s, dryRun{}, path, fi) {
+		t.Error("an empty file is uploaded")
+	}
+	if err := ioutil.WriteFile(path, make([]byte, defaultMinSize), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err = os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+	if skipTiny(s, dryRun{}, path, fi) {
+		t.Error("still skipped after growing to min_size")
+	}
+}
+
+func TestWatchTempFileRenamed(t *testing.T) {
+	dir, fired := watchTestDir(t, &settings{})
+	// how screencapture saves: a hidden file first, renamed once
+	// complete, then its attributes set
+	temp := filepath.Join(dir, ".Screenshot 2024-06-01 at 10.00.00.png")
+	final := filepath.Join(dir, "Screenshot 2024-06-01 at 10.00.00.png")
+	if err := ioutil.WriteFile(temp, make([]byte, 4096), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(temp, final); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(final, 0644); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the renamed screenshot", func() bool { return fired.count(final) == 1 })
+
+	// a visible name renamed before its events settle only counts with
+	// the name it ends up with
+	first := filepath.Join(dir, "draft.png")
+	second := filepath.Join(dir, "shot.png")
+	if err := ioutil.WriteFile(first, make([]byte, 4096), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(first, second); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "shot.png", func() bool { return fired.count(second) == 1 })
+	time.Sleep(300 * time.Millisecond)
+	if n := fired.count(temp); n != 0 {
+		t.Errorf("the hidden temporary file was handed over %d times", n)
+	}
+	if n := fired.count(first); n != 0 {
+		t.Errorf("draft.png was handed over %d times after it was renamed", n)
+	}
+	if n := fired.count(final); n != 1 {
+		t.Errorf("the screenshot was handed over %d times, want once", n)
+	}
+}
+
+func TestWatchFileDeletedBeforeSettled(t *testing.T) {
+	dir, fired := watchTestDir(t, &settings{Debounce: 200 * time.Millisecond})
+	path := filepath.Join(dir, "shot.png")
+	if err := ioutil.WriteFile(path, make([]byte, 4096), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	kept := filepath.Join(dir, "kept.png")
+	if err := ioutil.WriteFile(kept, make([]byte, 4096), 0600); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "kept.png", func() bool { return fired.count(kept) == 1 })
+	time.Sleep(300 * time.Millisecond)
+	if n := fired.count(path); n != 0 {
+		t.Errorf("a file deleted before its events settled was handed over %d times", n)
+	}
+}
+
+// missingSince is since when checkRoot found dir missing, the zero time
+// if it didn't
+func missingSince(dir string) time.Time {
+	roots.Lock()
+	defer roots.Unlock()
+	return roots.missing[dir]
+}
+
+// waitUnwatched gives watch up to a second to handle the event of dir's
+// deletion, which checkRoots, running every few seconds, always comes after.
+// Not every platform reports it.
+func waitUnwatched(dir string) {
+	for i := 0; i < 100 && watching(dir); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatchDirRecreated(t *testing.T) {
+	s := &settings{MissingPathAlert: time.Hour}
+	dir, fired := watchTestDir(t, s)
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	waitUnwatched(dir)
+	checkRoot(dir, s)
+	if watching(dir) || missingSince(dir).IsZero() {
+		t.Fatalf("%s deleted, still watched or not missing", dir)
+	}
+	// a check while it's still gone changes nothing
+	checkRoot(dir, s)
+	if watching(dir) {
+		t.Fatalf("%s watched while it's gone", dir)
+	}
+
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	// saved while nothing watched it
+	early := filepath.Join(dir, "early.png")
+	if err := ioutil.WriteFile(early, make([]byte, 4096), 0600); err != nil {
+		t.Fatal(err)
+	}
+	checkRoot(dir, s)
+	if !watching(dir) || !missingSince(dir).IsZero() {
+		t.Fatalf("%s is back, but isn't watched again", dir)
+	}
+	eventually(t, "the directory to be looked through", func() bool { return fired.count(dir) >= 1 })
+	if n := fired.count(dir); n != 1 {
+		t.Errorf("looked through %d times", n)
+	}
+
+	later := filepath.Join(dir, "later.png")
+	if err := ioutil.WriteFile(later, make([]byte, 4096), 0600); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "a screenshot saved after it came back", func() bool { return fired.count(later) == 1 })
+}
+
+func TestWatchDirRecreatedRightAway(t *testing.T) {
+	s := &settings{MissingPathAlert: time.Hour}
+	dir, fired := watchTestDir(t, s)
+	// gone and back between two checks, maybe with the same inode, its
+	// watch went with the old one all the same
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the old watch to go", func() bool {
+		checkRoot(dir, s)
+		return fired.count(dir) == 1
+	})
+	path := filepath.Join(dir, "shot.png")
+	if err := ioutil.WriteFile(path, make([]byte, 4096), 0600); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "a screenshot in the new directory", func() bool { return fired.count(path) == 1 })
+}
+
+func TestWatchDirCreatedAgain(t *testing.T) {
+	s := &settings{MissingPath: missingPathCreate, MissingPathAlert: time.Hour}
+	dir, fired := watchTestDir(t, s)
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	waitUnwatched(dir)
+	checkRoot(dir, s)
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		t.Fatalf("missing_path = create, but %s wasn't created again: %v", dir, err)
+	}
+	if !watching(dir) {
+		t.Fatalf("%s created again, but isn't watched", dir)
+	}
+	path := filepath.Join(dir, "shot.png")
+	if err := ioutil.WriteFile(path, make([]byte, 4096), 0600); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "a screenshot in the new directory", func() bool { return fired.count(path) == 1 })
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// watchError is a directory that couldn't be watched, with what the user
+// can do about it. The errors of fsnotify are only the bare errno, and "no
+// space left on device" for running out of inotify watches has little to
+// do with disk space.
+type watchError struct {
+	Dir  string
+	Err  error
+	Hint string
+}
+
+func (e *watchError) Error() string {
+	what := "can't watch " + e.Dir
+	if e.Dir == "" {
+		what = "can't start watching"
+	}
+	if e.Hint == "" {
+		return fmt.Sprintf("%s: %v", what, e.Err)
+	}
+	return fmt.Sprintf("%s: %v, %s", what, e.Err, e.Hint)
+}
+
+func (e *watchError) Unwrap() error { return e.Err }
+
+// explainWatchError classifies err, returned when adding a watch for dir
+// or creating the watcher when dir is empty, and adds a hint for the
+// failures that have a known cause. watches is how many directories are
+// watched already.
+func explainWatchError(dir string, err error, watches int) error {
+	e := &watchError{Dir: dir, Err: err}
+	switch {
+	case errors.Is(err, syscall.ENOSPC) && runtime.GOOS == "linux":
+		limit := inotifyLimit("max_user_watches")
+		e.Hint = fmt.Sprintf("out of inotify watches after %d directories: fs.inotify.max_user_watches is %d for all programs of the user together, raise it with `sudo sysctl fs.inotify.max_user_watches=%d` and in /etc/sysctl.d/ to keep it", watches, limit, suggestedLimit(limit, 524288))
+	case errors.Is(err, syscall.EMFILE) && runtime.GOOS == "linux":
+		limit := inotifyLimit("max_user_instances")
+		e.Hint = fmt.Sprintf("too many programs of the user watch files: fs.inotify.max_user_instances is %d, raise it with `sudo sysctl fs.inotify.max_user_instances=%d`", limit, suggestedLimit(limit, 1024))
+	case errors.Is(err, syscall.EMFILE):
+		e.Hint = fmt.Sprintf("%s needs a file descriptor for every watched directory, raise the limit with `ulimit -n`", eventSource())
+	case errors.Is(err, os.ErrPermission) && runtime.GOOS == "darwin":
+		e.Hint = "skrins may not read it: check its permissions, and for Desktop, Documents and Downloads allow the terminal running skrins in System Settings > Privacy & Security > Files and Folders"
+	case errors.Is(err, os.ErrPermission):
+		e.Hint = "skrins may not read it, check its permissions and owner"
+	case errors.Is(err, os.ErrNotExist):
+		e.Hint = "it doesn't exist (any more)"
+	}
+	return e
+}
+
+// suggestedLimit is what to raise an inotify limit of limit to, at least
+// floor, a common setting of distributions that raise it
+func suggestedLimit(limit, floor int) int {
+	if limit < floor/2 {
+		return floor
+	}
+	return limit * 2
+}
+
+// inotifyLimit is the inotify setting name in /proc/sys/fs/inotify, 0 where
+// that's unknown or there's no inotify
+func inotifyLimit(name string) int {
+	b, err := ioutil.ReadFile("/proc/sys/fs/inotify/" + name)
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+	return n
+}
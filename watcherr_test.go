@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestExplainWatchError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		goos string // only there, any when empty
+		hint string // what the hint says, none when empty
+	}{
+		{"inotify watches", syscall.ENOSPC, "linux", "fs.inotify.max_user_watches"},
+		{"inotify instances", syscall.EMFILE, "linux", "fs.inotify.max_user_instances"},
+		{"file descriptors", syscall.EMFILE, "darwin", "ulimit -n"},
+		{"permission", syscall.EACCES, "linux", "check its permissions and owner"},
+		{"wrapped permission", &os.PathError{Op: "open", Path: "/x", Err: syscall.EACCES}, "linux", "check its permissions and owner"},
+		{"macOS privacy", syscall.EACCES, "darwin", "Privacy & Security"},
+		{"missing", syscall.ENOENT, "", "doesn't exist"},
+		{"missing path error", &os.PathError{Op: "lstat", Path: "/x", Err: syscall.ENOENT}, "", "doesn't exist"},
+		{"unknown", errors.New("something else"), "", ""},
+	}
+	for _, tt := range tests {
+		if tt.goos != "" && tt.goos != runtime.GOOS {
+			continue
+		}
+		err := explainWatchError("/home/me/shots", tt.err, 3)
+		var we *watchError
+		if !errors.As(err, &we) {
+			t.Fatalf("%s: %T isn't a watchError", tt.name, err)
+		}
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: %v doesn't wrap %v", tt.name, err, tt.err)
+		}
+		if tt.hint == "" && we.Hint != "" {
+			t.Errorf("%s: hint %q, want none", tt.name, we.Hint)
+		}
+		if !strings.Contains(we.Hint, tt.hint) {
+			t.Errorf("%s: hint %q, want it to mention %q", tt.name, we.Hint, tt.hint)
+		}
+		if !strings.HasPrefix(err.Error(), "can't watch /home/me/shots: ") {
+			t.Errorf("%s: message %q doesn't name the directory", tt.name, err)
+		}
+	}
+
+	if err := explainWatchError("", syscall.EMFILE, 0); !strings.HasPrefix(err.Error(), "can't start watching: ") {
+		t.Errorf("creating the watcher: %q", err)
+	}
+}
+
+func TestSuggestedLimit(t *testing.T) {
+	tests := []struct{ limit, floor, want int }{
+		{8192, 524288, 524288},
+		{300000, 524288, 600000},
+		{0, 1024, 1024},
+	}
+	for _, tt := range tests {
+		if got := suggestedLimit(tt.limit, tt.floor); got != tt.want {
+			t.Errorf("suggestedLimit(%d, %d) = %d, want %d", tt.limit, tt.floor, got, tt.want)
+		}
+	}
+}
+
+func TestWatchableDirs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skrins-watchable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"2024/06", "2024/07", ".cache/deep", "other"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "2024", "a.png"), []byte("png"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s := &settings{Recursive: true, Ignore: defaultIgnore}
+	dirs := s.watchableDirs(dir)
+	// hidden directories are ignored with all below them, files don't count
+	if len(dirs) != 5 || dirs[0] != dir {
+		t.Errorf("watchableDirs = %v, want %s and the 4 directories not ignored below it", dirs, dir)
+	}
+}
+
+func TestAddWatchMissing(t *testing.T) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Skip(err)
+	}
+	defer w.Close()
+	old := watcher
+	watcher = w
+	defer func() { watcher = old }()
+
+	missing := filepath.Join(os.TempDir(), "skrins-not-there", "shots")
+	err = addWatch(missing)
+	var we *watchError
+	if !errors.As(err, &we) || !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("addWatch(%s) = %v, want a watchError for a missing directory", missing, err)
+	}
+	if we.Dir != missing || !strings.Contains(we.Hint, "doesn't exist") {
+		t.Errorf("watchError %+v", we)
+	}
+	if watching(missing) {
+		t.Error("a directory that couldn't be watched counts as watched")
+	}
+}
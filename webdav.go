@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/lithammer/shortuuid/v3"
+)
+
+// webdavUploader uploads into a WebDAV collection, e.g. a Nextcloud or
+// ownCloud folder. Files are written under a temporary name and moved in
+// place once their size checks out, like over SFTP.
+type webdavUploader struct {
+	p    profile
+	opts uploadOptions
+}
+
+// webdavLabel describes one of p's WebDAV secrets in prompts and errors
+func webdavLabel(p profile, what string) string {
+	return fmt.Sprintf("WebDAV %s for %s", what, p.WebDAVURL)
+}
+
+// webdavProblems checks the settings of a webdav profile
+func webdavProblems(p profile) []string {
+	var problems []string
+	if u, err := url.Parse(p.WebDAVURL); p.WebDAVURL != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+		problems = append(problems, fmt.Sprintf("webdav_url: %q is not an http or https URL", p.WebDAVURL))
+	}
+	if p.WebDAVPassword != "" && p.WebDAVToken != "" {
+		problems = append(problems, "only one of webdav_password and webdav_token can be set")
+	}
+	if p.NextcloudShare {
+		if _, _, err := nextcloudPaths(p.WebDAVURL); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	return problems
+}
+
+// nextcloudPaths splits a Nextcloud WebDAV URL into the server's URL and
+// the folder in the user's files, which is what the share API takes
+func nextcloudPaths(webdavURL string) (string, string, error) {
+	u, err := url.Parse(webdavURL)
+	if err != nil {
+		return "", "", err
+	}
+	i := strings.Index(u.Path, "/remote.php/")
+	if i < 0 {
+		return "", "", errors.New("nextcloud_share needs a Nextcloud webdav_url, like https://cloud.example.com/remote.php/dav/files/<user>/Screenshots")
+	}
+	root, rest := u.Path[:i], u.Path[i+len("/remote.php/"):]
+	switch {
+	case strings.HasPrefix(rest, "webdav"):
+		rest = strings.TrimPrefix(rest, "webdav")
+	case strings.HasPrefix(rest, "dav/files/"):
+		// skip the user
+		rest = strings.TrimPrefix(rest, "dav/files/")
+		if j := strings.Index(rest, "/"); j >= 0 {
+			rest = rest[j:]
+		} else {
+			rest = ""
+		}
+	default:
+		return "", "", fmt.Errorf("nextcloud_share: can't tell the folder from %s", webdavURL)
+	}
+	server := *u
+	server.Path, server.RawPath = root, ""
+	return server.String(), "/" + strings.Trim(rest, "/"), nil
+}
+
+// fileURL is where the file called name goes
+func (u webdavUploader) fileURL(name string) (*url.URL, error) {
+	base, err := url.Parse(strings.TrimRight(u.p.WebDAVURL, "/") + "/")
+	if err != nil {
+		return nil, err
+	}
+	return base.ResolveReference(&url.URL{Path: name}), nil
+}
+
+func (u webdavUploader) upload(ctx context.Context, localPath, remoteName string) (string, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	target, err := u.fileURL(remoteName)
+	if err != nil {
+		return "", err
+	}
+	tmp, err := u.fileURL(remoteName + tempSuffix + shortuuid.New())
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, u.p.TransferTimeout.Duration)
+	defer cancel()
+	t := startTransfer(localPath, fi.Size(), 0, u.opts.Progress)
+	defer t.finish()
+	// the share is made once the transfer is over, after stalled() ends
+	// the context it ran in
+	transferCtx, stalled := watchStall(ctx, t, u.p.StallTimeout.Duration)
+
+	put := func() error {
+		atomic.StoreInt64(&t.done, 0)
+		body := progressTracker{limitedReader{io.NewSectionReader(f, 0, fi.Size()), uploadLimiter}, t}
+		_, _, err := u.do(transferCtx, http.MethodPut, tmp.String(), nil, body, fi.Size())
+		return err
+	}
+	err = put()
+	// the folder for the file is missing
+	var status *httpStatusError
+	if errors.As(err, &status) && status.Status == http.StatusConflict && u.opts.Mkdirs {
+		if err = u.mkcol(transferCtx, tmp.ResolveReference(&url.URL{Path: "."})); err == nil {
+			err = put()
+		}
+	}
+	if err == nil {
+		err = u.finishUpload(transferCtx, tmp, target, fi.Size())
+	}
+	if stalled() {
+		return "", &timeoutError{Op: "stall", Host: target.Host, After: u.p.StallTimeout.Duration}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", &timeoutError{Op: "transfer", Host: target.Host, After: u.p.TransferTimeout.Duration, Err: err}
+	}
+	if err != nil {
+		return "", err
+	}
+	log.Println(t.summary())
+
+	if u.p.NextcloudShare {
+		return u.share(ctx, remoteName)
+	}
+	return u.p.destinationFor(remoteExtension(remoteName)).BaseURL + remoteName, nil
+}
+
+// finishUpload checks the size of the uploaded tmp and moves it to target.
+// tmp is deleted when that fails.
+func (u webdavUploader) finishUpload(ctx context.Context, tmp, target *url.URL, size int64) error {
+	fi, err := u.propfind(ctx, tmp, path.Base(target.Path))
+	if err == nil && fi.Size() != size {
+		err = &sizeMismatchError{Name: target.Path, Got: fi.Size(), Local: size}
+	}
+	if err == nil {
+		header := http.Header{"Destination": {target.String()}, "Overwrite": {"T"}}
+		_, _, err = u.do(ctx, "MOVE", tmp.String(), header, nil, 0)
+	}
+	if err != nil {
+		if _, _, delErr := u.do(ctx, http.MethodDelete, tmp.String(), nil, nil, 0); delErr != nil {
+			log.Printf("can't delete %s: %v", tmp, delErr)
+		}
+	}
+	return err
+}
+
+// mkcol creates the collection dir and the ones above it that are missing
+func (u webdavUploader) mkcol(ctx context.Context, dir *url.URL) error {
+	_, _, err := u.do(ctx, "MKCOL", dir.String(), nil, nil, 0)
+	var status *httpStatusError
+	if errors.As(err, &status) {
+		switch status.Status {
+		case http.StatusMethodNotAllowed:
+			// it exists already
+			return nil
+		case http.StatusConflict:
+			parent := dir.ResolveReference(&url.URL{Path: ".."})
+			if parent.Path == dir.Path {
+				return err
+			}
+			if err := u.mkcol(ctx, parent); err != nil {
+				return err
+			}
+			_, _, err = u.do(ctx, "MKCOL", dir.String(), nil, nil, 0)
+		}
+	}
+	return err
+}
+
+// propfind looks up the size and modification time of the file at target
+func (u webdavUploader) propfind(ctx context.Context, target *url.URL, name string) (os.FileInfo, error) {
+	query := xml.Header + `<d:propfind xmlns:d="DAV:"><d:prop><d:getcontentlength/><d:getlastmodified/></d:prop></d:propfind>`
+	header := http.Header{"Depth": {"0"}, "Content-Type": {"application/xml; charset=utf-8"}}
+	_, body, err := u.do(ctx, "PROPFIND", target.String(), header, strings.NewReader(query), int64(len(query)))
+	if err != nil {
+		return nil, err
+	}
+	var ms struct {
+		Props []struct {
+			Length       string `xml:"getcontentlength"`
+			LastModified string `xml:"getlastmodified"`
+		} `xml:"response>propstat>prop"`
+	}
+	if err := xml.Unmarshal(body, &ms); err != nil {
+		return nil, fmt.Errorf("WebDAV: bad PROPFIND answer: %v", err)
+	}
+	fi := remoteFileInfo{name: name, size: -1}
+	for _, prop := range ms.Props {
+		if n, err := strconv.ParseInt(prop.Length, 10, 64); err == nil {
+			fi.size = n
+		}
+		if t, err := http.ParseTime(prop.LastModified); err == nil {
+			fi.modTime = t
+		}
+	}
+	return fi, nil
+}
+
+// share creates a public Nextcloud share of the uploaded remoteName and
+// returns its link, see
+// https://docs.nextcloud.com/server/latest/developer_manual/client_apis/OCS/ocs-share-api.html
+func (u webdavUploader) share(ctx context.Context, remoteName string) (string, error) {
+	server, folder, err := nextcloudPaths(u.p.WebDAVURL)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"path":        {path.Join(folder, remoteName)},
+		"shareType":   {"3"}, // public link
+		"permissions": {"1"}, // read only
+	}
+	header := http.Header{
+		"Ocs-Apirequest": {"true"},
+		"Accept":         {"application/json"},
+		"Content-Type":   {"application/x-www-form-urlencoded"},
+	}
+	target := server + "/ocs/v2.php/apps/files_sharing/api/v1/shares?format=json"
+	_, body, err := u.do(ctx, http.MethodPost, target, header, strings.NewReader(form.Encode()), int64(len(form.Encode())))
+	if err != nil {
+		return "", fmt.Errorf("Nextcloud share: %w", err)
+	}
+	var resp struct {
+		OCS struct {
+			Meta struct {
+				StatusCode int    `json:"statuscode"`
+				Message    string `json:"message"`
+			} `json:"meta"`
+			Data struct {
+				URL string `json:"url"`
+			} `json:"data"`
+		} `json:"ocs"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return "", fmt.Errorf("Nextcloud share: bad answer: %v", err)
+	}
+	if resp.OCS.Data.URL == "" {
+		return "", fmt.Errorf("Nextcloud share: %s (%d)", resp.OCS.Meta.Message, resp.OCS.Meta.StatusCode)
+	}
+	return resp.OCS.Data.URL, nil
+}
+
+// check logs in to webdav_url, so wrong credentials show at startup. A
+// missing folder is fine, uploads create it.
+func (u webdavUploader) check(ctx context.Context) error {
+	target, err := u.fileURL("")
+	if err != nil {
+		return err
+	}
+	_, err = u.propfind(ctx, target, "")
+	var status *httpStatusError
+	if errors.As(err, &status) && status.Status == http.StatusNotFound {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("WebDAV %s: %w", u.p.WebDAVURL, err)
+	}
+	return nil
+}
+
+func (u webdavUploader) remove(ctx context.Context, remoteName string) error {
+	target, err := u.fileURL(remoteName)
+	if err != nil {
+		return err
+	}
+	_, _, err = u.do(ctx, http.MethodDelete, target.String(), nil, nil, 0)
+	return err
+}
+
+func (u webdavUploader) stat(ctx context.Context, remoteName string) (os.FileInfo, error) {
+	target, err := u.fileURL(remoteName)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := u.propfind(ctx, target, remoteName)
+	var status *httpStatusError
+	if errors.As(err, &status) && status.Status == http.StatusNotFound {
+		return nil, os.ErrNotExist
+	}
+	return fi, err
+}
+
+// do makes an authenticated request and returns the response with its body
+// read. Answers outside 2xx are an *httpStatusError.
+func (u webdavUploader) do(ctx context.Context, method, target string, header http.Header, body io.Reader, length int64) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	req = req.WithContext(ctx)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.ContentLength = length
+	if length == 0 {
+		req.Body = http.NoBody
+	}
+	switch {
+	case u.p.WebDAVToken != "":
+		token, err := cachedSecret(u.p.WebDAVToken, webdavLabel(u.p, "token"))
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	case u.p.WebDAVUser != "":
+		var password string
+		if u.p.WebDAVPassword != "" {
+			if password, err = cachedSecret(u.p.WebDAVPassword, webdavLabel(u.p, "password")); err != nil {
+				return nil, nil, err
+			}
+		}
+		req.SetBasicAuth(u.p.WebDAVUser, password)
+	}
+
+	resp, err := httpClientFor(u.p).Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, nil, &httpStatusError{Status: resp.StatusCode, Body: shorten(strings.TrimSpace(webdavMessage(respBody)), 200)}
+	}
+	return resp, respBody, nil
+}
+
+// webdavMessage is the message of a Sabre (Nextcloud, ownCloud) error
+// response, or the body when it's none
+func webdavMessage(body []byte) string {
+	var e struct {
+		Message string `xml:"message"`
+	}
+	if xml.Unmarshal(body, &e) == nil && e.Message != "" {
+		return e.Message
+	}
+	return string(body)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestNextcloudPaths(t *testing.T) {
+	tests := []struct {
+		url, server, folder string
+	}{
+		{"https://cloud.example.com/remote.php/dav/files/me/Screenshots", "https://cloud.example.com", "/Screenshots"},
+		{"https://cloud.example.com/remote.php/dav/files/me/Screenshots/2024/", "https://cloud.example.com", "/Screenshots/2024"},
+		{"https://cloud.example.com/remote.php/dav/files/me", "https://cloud.example.com", "/"},
+		{"https://example.com/nextcloud/remote.php/webdav/Shots", "https://example.com/nextcloud", "/Shots"},
+		{"https://dav.example.com/shots", "", ""},
+		{"https://cloud.example.com/remote.php/caldav/x", "", ""},
+	}
+	for _, tt := range tests {
+		server, folder, err := nextcloudPaths(tt.url)
+		if tt.server == "" {
+			if err == nil {
+				t.Errorf("%s: server %s and folder %s, want an error", tt.url, server, folder)
+			}
+			continue
+		}
+		if err != nil || server != tt.server || folder != tt.folder {
+			t.Errorf("%s: %s, %s, %v, want %s and %s", tt.url, server, folder, err, tt.server, tt.folder)
+		}
+	}
+}
+
+func TestWebDAVProblems(t *testing.T) {
+	tests := []struct {
+		p    profile
+		want []string
+	}{
+		{profile{WebDAVURL: "https://dav.example.com/shots", WebDAVPassword: "secret"}, nil},
+		{profile{WebDAVURL: "dav.example.com/shots"}, []string{`webdav_url: "dav.example.com/shots" is not an http or https URL`}},
+		{profile{WebDAVURL: "https://dav.example.com", WebDAVPassword: "a", WebDAVToken: "b"}, []string{"only one of webdav_password and webdav_token can be set"}},
+		{profile{WebDAVURL: "https://dav.example.com/shots", NextcloudShare: true}, []string{"nextcloud_share needs a Nextcloud webdav_url, like https://cloud.example.com/remote.php/dav/files/<user>/Screenshots"}},
+	}
+	for _, tt := range tests {
+		if got := webdavProblems(tt.p); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%+v: %q, want %q", tt.p, got, tt.want)
+		}
+	}
+}
+
+// davServer is a WebDAV server in memory with just enough of RFC 4918
+// for uploads
+type davServer struct {
+	mu    sync.Mutex
+	dirs  map[string]bool
+	files map[string][]byte
+	// keep, when set, is how many bytes of a PUT are kept
+	keep int
+	// methods are the methods of the requests, in order
+	methods []string
+}
+
+func newDAVServer(t *testing.T, dirs ...string) (*davServer, string) {
+	d := &davServer{dirs: map[string]bool{"/": true}, files: map[string][]byte{}}
+	for _, dir := range dirs {
+		d.dirs[dir] = true
+	}
+	srv, _ := recordingServer(t, d.serve)
+	return d, srv.URL
+}
+
+func (d *davServer) serve(w http.ResponseWriter, r recordedRequest) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.methods = append(d.methods, r.Method)
+	name, _ := url.PathUnescape(r.Path)
+	name = strings.TrimRight(name, "/")
+	parent := path.Dir(name)
+	switch r.Method {
+	case http.MethodPut:
+		if !d.dirs[parent] {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		body := r.Body
+		if d.keep > 0 && len(body) > d.keep {
+			body = body[:d.keep]
+		}
+		d.files[name] = body
+		w.WriteHeader(http.StatusCreated)
+	case "MKCOL":
+		switch {
+		case d.dirs[name]:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		case !d.dirs[parent]:
+			w.WriteHeader(http.StatusConflict)
+		default:
+			d.dirs[name] = true
+			w.WriteHeader(http.StatusCreated)
+		}
+	case "PROPFIND":
+		f, ok := d.files[name]
+		if !ok && !d.dirs[name] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(207)
+		fmt.Fprintf(w, `<?xml version="1.0"?><d:multistatus xmlns:d="DAV:"><d:response><d:href>%s</d:href><d:propstat><d:prop><d:getcontentlength>%d</d:getcontentlength><d:getlastmodified>Mon, 01 Jul 2024 10:00:00 GMT</d:getlastmodified></d:prop></d:propstat></d:response></d:multistatus>`, r.Path, len(f))
+	case "MOVE":
+		dest, err := url.Parse(r.Header.Get("Destination"))
+		if err != nil || r.Header.Get("Overwrite") != "T" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		d.files[dest.Path] = d.files[name]
+		delete(d.files, name)
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		delete(d.files, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// names are the files on the server
+func (d *davServer) names() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var names []string
+	for name := range d.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func webdavTestUploader(davURL string, mkdirs bool) webdavUploader {
+	return webdavUploader{p: testProfile(profile{
+		Backend:   backendWebDAV,
+		WebDAVURL: davURL,
+		BaseURL:   "https://shots.example.com/",
+	}), opts: uploadOptions{Mkdirs: mkdirs}}
+}
+
+func TestWebDAVUpload(t *testing.T) {
+	d, davURL := newDAVServer(t, "/dav", "/dav/shots")
+	u := webdavTestUploader(davURL+"/dav/shots", false)
+	url, err := u.upload(context.Background(), uploadTestFile(t, "shot.png", []byte("png")), "Zr8tW.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "https://shots.example.com/Zr8tW.png" {
+		t.Errorf("url = %s", url)
+	}
+	if names := d.names(); len(names) != 1 || names[0] != "/dav/shots/Zr8tW.png" {
+		t.Errorf("files on the server %v, want only the upload", names)
+	}
+	// the temporary file is checked before it's moved in place
+	if got := strings.Join(d.methods, " "); got != "PUT PROPFIND MOVE" {
+		t.Errorf("requests %s, want PUT PROPFIND MOVE", got)
+	}
+}
+
+func TestWebDAVMkcol(t *testing.T) {
+	d, davURL := newDAVServer(t, "/dav")
+	u := webdavTestUploader(davURL+"/dav/shots/2024", true)
+	if _, err := u.upload(context.Background(), uploadTestFile(t, "shot.png", []byte("png")), "Zr8tW.png"); err != nil {
+		t.Fatal(err)
+	}
+	if names := d.names(); len(names) != 1 || names[0] != "/dav/shots/2024/Zr8tW.png" {
+		t.Errorf("files on the server %v", names)
+	}
+	// the PUT fails, so does creating 2024, then shots and 2024 are created
+	if got := strings.Join(d.methods, " "); got != "PUT MKCOL MKCOL MKCOL PUT PROPFIND MOVE" {
+		t.Errorf("requests %s", got)
+	}
+
+	// without mkdirs a missing folder is an error
+	d, davURL = newDAVServer(t, "/dav")
+	u = webdavTestUploader(davURL+"/dav/shots", false)
+	if _, err := u.upload(context.Background(), uploadTestFile(t, "shot.png", []byte("png")), "Zr8tW.png"); err == nil {
+		t.Error("uploaded to a missing folder without mkdirs")
+	}
+}
+
+func TestWebDAVSizeMismatch(t *testing.T) {
+	d, davURL := newDAVServer(t, "/dav")
+	d.keep = 2
+	u := webdavTestUploader(davURL+"/dav", false)
+	_, err := u.upload(context.Background(), uploadTestFile(t, "shot.png", []byte("png")), "Zr8tW.png")
+	if !retryable(err) || !strings.Contains(fmt.Sprint(err), "Zr8tW.png") {
+		t.Errorf("err = %v, want a size mismatch to retry", err)
+	}
+	if names := d.names(); len(names) != 0 {
+		t.Errorf("files on the server %v, want the temporary one deleted", names)
+	}
+}
+
+func TestWebDAVAuth(t *testing.T) {
+	srv, log := recordingServer(t, func(w http.ResponseWriter, r recordedRequest) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	setEnv(t, "SKRINS_TEST_DAV_TOKEN", "t0ken")
+	tests := []struct {
+		p    profile
+		want string
+	}{
+		{profile{WebDAVUser: "me", WebDAVPassword: "secret"}, "Basic bWU6c2VjcmV0"},
+		{profile{WebDAVToken: "env:SKRINS_TEST_DAV_TOKEN"}, "Bearer t0ken"},
+		{profile{}, ""},
+	}
+	for i, tt := range tests {
+		tt.p.Backend, tt.p.WebDAVURL = backendWebDAV, srv.URL+"/dav"
+		u := webdavUploader{p: testProfile(tt.p)}
+		if _, err := u.stat(context.Background(), "a.png"); !os.IsNotExist(err) {
+			t.Errorf("stat: %v, want the file not to exist", err)
+		}
+		if got := log.all()[i].Header.Get("Authorization"); got != tt.want {
+			t.Errorf("%+v: Authorization %q, want %q", tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestWebDAVCheck(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		want   string
+	}{
+		{207, "<d:multistatus xmlns:d=\"DAV:\"/>", ""},
+		{404, "", ""},
+		{401, `<?xml version="1.0"?><d:error xmlns:d="DAV:" xmlns:s="http://sabredav.org/ns"><s:exception>Sabre\DAV\Exception\NotAuthenticated</s:exception><s:message>No public access to this resource.</s:message></d:error>`, "No public access to this resource."},
+	}
+	for _, tt := range tests {
+		srv, _ := recordingServer(t, func(w http.ResponseWriter, r recordedRequest) {
+			w.WriteHeader(tt.status)
+			fmt.Fprint(w, tt.body)
+		})
+		err := webdavTestUploader(srv.URL+"/dav", false).check(context.Background())
+		if tt.want == "" && err != nil {
+			t.Errorf("%d: %v", tt.status, err)
+		}
+		if tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+			t.Errorf("%d: %v, want it to say %s", tt.status, err, tt.want)
+		}
+	}
+}
+
+func TestNextcloudShare(t *testing.T) {
+	d := &davServer{dirs: map[string]bool{"/": true, "/remote.php/dav/files/me/Shots": true}, files: map[string][]byte{}}
+	var share recordedRequest
+	srv, _ := recordingServer(t, func(w http.ResponseWriter, r recordedRequest) {
+		if !strings.HasPrefix(r.Path, "/ocs/") {
+			d.serve(w, r)
+			return
+		}
+		share = r
+		fmt.Fprint(w, `{"ocs":{"meta":{"statuscode":200},"data":{"url":"https://cloud.example.com/s/abc"}}}`)
+	})
+	u := webdavUploader{p: testProfile(profile{
+		Backend:        backendWebDAV,
+		WebDAVURL:      srv.URL + "/remote.php/dav/files/me/Shots",
+		NextcloudShare: true,
+	})}
+	link, err := u.upload(context.Background(), uploadTestFile(t, "shot.png", []byte("png")), "Zr8tW.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link != "https://cloud.example.com/s/abc" {
+		t.Errorf("url = %s, want the share link", link)
+	}
+	form, _ := url.ParseQuery(string(share.Body))
+	if share.Path != "/ocs/v2.php/apps/files_sharing/api/v1/shares" || share.Header.Get("Ocs-Apirequest") != "true" {
+		t.Errorf("shared with %s %v", share.Path, share.Header)
+	}
+	if form.Get("path") != "/Shots/Zr8tW.png" || form.Get("shareType") != "3" {
+		t.Errorf("shared %v", form)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// What happens to files beyond max_uploads: overLimitQueue uploads them
+// once there's room in the window again, overLimitPause pauses uploads
+// until `skrins resume`
+const (
+	overLimitQueue = "queue"
+	overLimitPause = "pause"
+)
+
+// defaultMaxUploadsPer is the window of max_uploads unless the config file
+// sets max_uploads_per
+const defaultMaxUploadsPer = time.Minute
+
+// uploadWindow are the times files were let through to be uploaded within
+// the last max_uploads_per, and the files held back until there's room in
+// the order they came in, queued again all at once by a timer
+var uploadWindow = struct {
+	sync.Mutex
+	let     []time.Time
+	waiting []string
+	held    map[string]bool
+	timer   bool
+}{held: map[string]bool{}}
+
+// overUploadLimit tells whether the file at path has to wait because
+// max_uploads files were let through within max_uploads_per already, say
+// when a script dumps hundreds into the screenshot path. It goes back to
+// the upload queue once there's room, or uploads are paused, as
+// over_max_uploads says.
+func overUploadLimit(s *settings, path string) bool {
+	if s.MaxUploads == 0 {
+		return false
+	}
+	now := time.Now()
+	uploadWindow.Lock()
+	defer uploadWindow.Unlock()
+	let := uploadWindow.let[:0]
+	for _, t := range uploadWindow.let {
+		if now.Sub(t) < s.MaxUploadsPer {
+			let = append(let, t)
+		}
+	}
+	uploadWindow.let = let
+	if len(let) < s.MaxUploads {
+		uploadWindow.let = append(let, now)
+		return false
+	}
+
+	if s.OverMaxUploads == overLimitPause {
+		msg := fmt.Sprintf("%d files uploaded within %s, more wait for skrins resume", len(let), s.MaxUploadsPer)
+		pauseFor(s, msg)
+		return held(s, path)
+	}
+	if uploadWindow.held[path] {
+		return true
+	}
+	uploadWindow.held[path] = true
+	uploadWindow.waiting = append(uploadWindow.waiting, path)
+	room := let[0].Add(s.MaxUploadsPer).Sub(now)
+	log.Printf("%d files uploaded within %s, %s waits for room", len(let), s.MaxUploadsPer, path)
+	if !uploadWindow.timer {
+		uploadWindow.timer = true
+		time.AfterFunc(room, requeueWaiting)
+	}
+	return true
+}
+
+// requeueWaiting hands the files held back by max_uploads to the upload
+// queue again, those there's no room for yet come back
+func requeueWaiting() {
+	uploadWindow.Lock()
+	waiting := uploadWindow.waiting
+	uploadWindow.waiting, uploadWindow.held, uploadWindow.timer = nil, map[string]bool{}, false
+	uploadWindow.Unlock()
+	for _, path := range waiting {
+		uploads.add(path)
+	}
+}
+
+// forgetUploadWindow lets max_uploads files through again right away, once
+// the user resumed uploads
+func forgetUploadWindow() {
+	uploadWindow.Lock()
+	defer uploadWindow.Unlock()
+	uploadWindow.let = nil
+}
+
+// waitingForWindow are the files held back by max_uploads
+func waitingForWindow() []string {
+	uploadWindow.Lock()
+	defer uploadWindow.Unlock()
+	return append([]string(nil), uploadWindow.waiting...)
+}